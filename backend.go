@@ -0,0 +1,247 @@
+// Copyright 2017, Timothy Bogdala <tdb@animal-machine.com>
+// See the LICENSE file for more details.
+
+package filefreezer
+
+import (
+	"fmt"
+	"io"
+	"sort"
+	"sync"
+)
+
+// UserStore keeps the user accounts along with their quotas and pruning freezes.
+//
+// Lookups of a user that doesn't exist return an error. SetUserQuota and
+// UpdateUser replace the quota, and GetUserStats reports the bytes allocated by
+// all of the user's chunks against it. SetUserMaxVersions sets the user's limit
+// on the versions kept for each file and SetUserMaxEgress the user's limit on
+// the bytes downloaded each month, where zero uses the server's setting.
+// GetAccountDeletion returns nil for users that haven't asked to be erased, and
+// GetDueAccountDeletions only returns the requests that have been confirmed.
+type UserStore interface {
+	AddUser(username string, salt string, saltedHash []byte, quota int) (*User, error)
+	GetUser(username string) (*User, error)
+	GetAllUsers() ([]User, error)
+	RemoveUser(username string) error
+	UpdateUser(userID int, name string, salt string, saltedHash []byte, cryptoHash []byte, quota int) error
+	UpdateUserCryptoHash(userID int, cryptoHash []byte) error
+	SetUserQuota(userID int, quota int) error
+	SetUserMaxVersions(userID int, maxVersions int) error
+	SetUserMaxEgress(userID int, maxEgress int64) error
+	GetUserStats(userID int) (*UserStats, error)
+	FreezeUserPruning(userID int, reason string) error
+	UnfreezeUserPruning(userID int) error
+	GetUserPruningFreeze(userID int) (frozen bool, frozenAt int64, reason string, e error)
+	SetAccountDeletion(userID int, token string, deleteAt int64) error
+	GetAccountDeletion(userID int) (*AccountDeletion, error)
+	GetDueAccountDeletions(now int64) ([]AccountDeletion, error)
+	RemoveAccountDeletion(userID int) error
+}
+
+// FileStore keeps the file listings and their versions.
+//
+// Every method taking a userID must fail for files the user doesn't own.
+// Version numbers start at 1 for a new file and each tagged version becomes
+// the current one. Removing a file removes all of its versions and chunks and
+// returns their bytes to the user's quota. File names are opaque to the store
+// since clients encrypt them. PatchFileVersion tags a version that starts with
+// copies of the base version's chunks named by sources, and the copies count
+// against the quota.
+type FileStore interface {
+	AddFileInfo(userID int, filename string, isDir bool, permissions uint32, lastMod int64, chunkCount int, fileHash string, device string) (*FileInfo, error)
+	GetFileInfo(userID int, fileID int) (*FileInfo, error)
+	GetFileInfoByName(userID int, filename string) (*FileInfo, error)
+	GetAllUserFileInfos(userID int) ([]FileInfo, error)
+	GetDuplicateFileInfos(userID int) ([][]FileInfo, error)
+	RenameFile(userID int, fileID int, filename string) error
+	RemoveFile(userID int, fileID int) error
+	GetFileVersions(fileID int) ([]FileVersionInfo, error)
+	TagNewFileVersion(userID int, fileID int, permissions uint32, lastMod int64, chunkCount int, fileHash string, device string) (*FileInfo, error)
+	PatchFileVersion(userID int, fileID int, baseVersionID int, permissions uint32, lastMod int64, chunkCount int, fileHash string, device string, sources []int) (*FileInfo, error)
+	UpdateFileVersionChunks(userID int, fileID int, versionID int, chunkCount int, fileHash string) error
+	RemoveFileVersions(userID int, fileID int, minVersion int, maxVersion int) error
+}
+
+// ChunkStore keeps the encrypted chunk data of file versions.
+//
+// MaxChunkSize is the size that clients split files into; chunks may be a little
+// larger once encrypted so the store doesn't enforce it. Adding a chunk fails if
+// it would take the user over their quota or if the chunk number is outside of
+// the version's chunk count. GetMissingChunkNumbersForFile reports the chunk
+// numbers of the current version that haven't been added yet.
+// GetUserChunkUsage reports the bytes of all of a user's chunks along with the
+// bytes of the ones with unique hashes. GetUserUsage counts those along with the user's
+// files and versions, and the user's revision they were counted at.
+type ChunkStore interface {
+	MaxChunkSize() int64
+	AddFileChunk(userID int, fileID int, versionID int, chunkNumber int, chunkHash string, chunk []byte) (*FileChunk, error)
+	GetFileChunk(fileID int, chunkNumber int, versionID int) (*FileChunk, error)
+	GetFileChunkInfos(userID int, fileID int, versionID int) ([]FileChunk, error)
+	GetMissingChunkNumbersForFile(userID int, fileID int) ([]int, error)
+	RemoveFileChunk(userID int, fileID int, versionID int, chunkNumber int) (bool, error)
+	GetUserChunkUsage(userID int) (logical int, physical int, e error)
+	GetUserUsage(userID int) (*UserUsage, error)
+}
+
+// ShareStore keeps the unencrypted copies of files that are shared publicly.
+//
+// Since shares are unencrypted the store can split them into chunks of a new
+// size itself: GetSharesToRechunk finds the complete shares with chunks of the
+// wrong size and RechunkShare replaces a share's chunks all at once.
+type ShareStore interface {
+	AddShare(userID int, name string, lastMod int64, chunkCount int, fileHash string, contentType string, passwordHash []byte, maxDownloads int) (*Share, error)
+	AddShareChunk(userID int, shareID int, chunkNumber int, chunk []byte) error
+	GetShares(userID int) ([]Share, error)
+	GetShareByName(userID int, name string) (*Share, error)
+	GetShareChunk(shareID int, chunkNumber int) ([]byte, error)
+	GetShareChunkSizes(shareID int) ([]int64, error)
+	GetSharesToRechunk(chunkSize int64) ([]Share, error)
+	RechunkShare(userID int, shareID int, chunkSize int64) (int, error)
+	SetShareLimits(userID int, shareID int, passwordHash []byte, maxDownloads int) error
+	GetSharePassword(shareID int) (passwordHash []byte, e error)
+	SetShareContentType(userID int, shareID int, contentType string) error
+	CountShareDownload(shareID int) (bool, error)
+	RemoveShare(userID int, shareID int) error
+}
+
+// DropStore keeps the upload-only drop tokens and the files uploaded with them.
+//
+// AddDropFile reads the file from r a chunk at a time and fails with
+// ErrDropFileTooLarge past the token's size limit; the file isn't returned by
+// GetDropFiles until all of it has been stored.
+type DropStore interface {
+	AddDropToken(userID int, token string, folder string, maxFileSize int64, maxFiles int) (*DropToken, error)
+	GetDropTokenByToken(token string) (*DropToken, error)
+	GetDropTokens(userID int) ([]DropToken, error)
+	RemoveDropToken(userID int, dropID int) error
+	AddDropFile(token string, name string, r io.Reader) (*DropFile, error)
+	GetDropFiles(userID int) ([]DropFile, error)
+	GetDropFileData(userID int, dropFileID int) ([]byte, error)
+	RemoveDropFile(userID int, dropFileID int) error
+}
+
+// SupportStore keeps the users' consent to support access, the support tokens
+// made for admins and the audit of what was done with them.
+//
+// GetSupportConsent returns zero for users that haven't consented.
+type SupportStore interface {
+	SetSupportConsent(userID int, expires int64) error
+	GetSupportConsent(userID int) (int64, error)
+	RemoveSupportConsent(userID int) error
+	AddSupportToken(userID int, token string, reason string, breakGlass bool, expires int64) (*SupportToken, error)
+	GetSupportTokenByToken(token string) (*SupportToken, error)
+	AddSupportAudit(userID int, supportID int, action string) error
+	GetSupportAudit(userID int) ([]SupportAudit, error)
+}
+
+// BandwidthStore keeps the traffic of each user's requests per day.
+//
+// Days are formatted with BandwidthDayFormat, so they sort by date as strings.
+type BandwidthStore interface {
+	AddUserBandwidth(userID int, day string, uploaded int64, downloaded int64) error
+	GetUserBandwidth(userID int, since string) ([]BandwidthDay, error)
+}
+
+// LockStore keeps the advisory locks that clients take on files.
+//
+// Expired locks are treated as if they don't exist, and removing a file or user
+// removes their locks.
+type LockStore interface {
+	LockFile(userID int, fileID int, token string, holder string, expires int64) (*FileLock, bool, error)
+	GetFileLock(userID int, fileID int) (*FileLock, error)
+	UnlockFile(userID int, fileID int, token string) (bool, error)
+	GetFileLocks(userID int) ([]FileLock, error)
+}
+
+// Backend is everything the server needs from its storage. The SQLite based
+// Storage is the default backend; others can be added with RegisterBackend
+// and should pass the suite in the backendtest package.
+//
+// A Backend must be safe to use from multiple goroutines.
+type Backend interface {
+	UserStore
+	FileStore
+	ChunkStore
+	ShareStore
+	DropStore
+	SupportStore
+	BandwidthStore
+	LockStore
+
+	// CreateTables prepares a new data source or upgrades an old one and
+	// must be safe to call more than once
+	CreateTables() error
+
+	// Close releases the data source
+	Close()
+}
+
+// BackendOpener opens a backend for the data source, such as a database path,
+// that clients split files into chunkSize byte chunks for.
+type BackendOpener func(dataSource string, chunkSize int64) (Backend, error)
+
+var (
+	backendsLock sync.Mutex
+	backends     = make(map[string]BackendOpener)
+)
+
+// DefaultBackend is the name of the backend used when none is given.
+const DefaultBackend = "sqlite"
+
+func init() {
+	RegisterBackend(DefaultBackend, func(dataSource string, chunkSize int64) (Backend, error) {
+		store, err := NewStorage(dataSource)
+		if err != nil {
+			return nil, err
+		}
+		store.ChunkSize = chunkSize
+		return store, nil
+	})
+}
+
+// RegisterBackend makes a backend available to OpenBackend under the name,
+// replacing any backend already registered with it. It's usually called from
+// the init function of the package implementing the backend.
+func RegisterBackend(name string, open BackendOpener) {
+	backendsLock.Lock()
+	defer backendsLock.Unlock()
+	backends[name] = open
+}
+
+// BackendNames returns the names of the registered backends, sorted.
+func BackendNames() []string {
+	backendsLock.Lock()
+	defer backendsLock.Unlock()
+	names := make([]string, 0, len(backends))
+	for name := range backends {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// OpenBackend opens the data source with the backend registered under name and
+// creates or upgrades its tables. An empty name uses DefaultBackend.
+func OpenBackend(name string, dataSource string, chunkSize int64) (Backend, error) {
+	if name == "" {
+		name = DefaultBackend
+	}
+	backendsLock.Lock()
+	open, found := backends[name]
+	backendsLock.Unlock()
+	if !found {
+		return nil, fmt.Errorf("unknown storage backend %q; the available backends are %v", name, BackendNames())
+	}
+
+	backend, err := open(dataSource, chunkSize)
+	if err != nil {
+		return nil, err
+	}
+	err = backend.CreateTables()
+	if err != nil {
+		backend.Close()
+		return nil, fmt.Errorf("failed to create the tables for the %s backend: %v", name, err)
+	}
+	return backend, nil
+}
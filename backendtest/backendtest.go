@@ -0,0 +1,762 @@
+// Copyright 2017, Timothy Bogdala <tdb@animal-machine.com>
+// See the LICENSE file for more details.
+
+// Package backendtest is a conformance suite for implementations of
+// filefreezer.Backend. A backend's own tests call Run with a function that
+// opens an empty data source:
+//
+//	func TestConformance(t *testing.T) {
+//		backendtest.Run(t, func(t *testing.T) filefreezer.Backend {
+//			b, err := filefreezer.OpenBackend("mybackend", newEmptySource(t), 1024)
+//			if err != nil {
+//				t.Fatalf("Failed to open the backend: %v", err)
+//			}
+//			return b
+//		})
+//	}
+package backendtest
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/marcoziti/gringotts"
+)
+
+// OpenFunc opens a new, empty backend with its tables created. Run closes
+// the backends it opens.
+type OpenFunc func(t *testing.T) filefreezer.Backend
+
+// Run tests the backends returned by open against the contract documented on
+// the filefreezer.Backend interfaces. Each part of the suite runs as a subtest
+// on its own backend.
+func Run(t *testing.T, open OpenFunc) {
+	tests := []struct {
+		name string
+		fn   func(*testing.T, filefreezer.Backend)
+	}{
+		{"Users", testUsers},
+		{"Files", testFiles},
+		{"Chunks", testChunks},
+		{"Patches", testPatches},
+		{"Streams", testStreams},
+		{"Ownership", testOwnership},
+		{"Shares", testShares},
+		{"Drops", testDrops},
+		{"Support", testSupport},
+		{"Bandwidth", testBandwidth},
+		{"Locks", testLocks},
+	}
+	for _, test := range tests {
+		fn := test.fn
+		t.Run(test.name, func(t *testing.T) {
+			b := open(t)
+			defer b.Close()
+			fn(t, b)
+		})
+	}
+}
+
+// addUser adds a user with the quota, failing the test if it can't.
+func addUser(t *testing.T, b filefreezer.Backend, name string, quota int) *filefreezer.User {
+	user, err := b.AddUser(name, "salt", []byte("saltedhash"), quota)
+	if err != nil {
+		t.Fatalf("Failed to add the user %s: %v", name, err)
+	}
+	return user
+}
+
+// allocated returns the bytes allocated to the user.
+func allocated(t *testing.T, b filefreezer.Backend, userID int) int {
+	stats, err := b.GetUserStats(userID)
+	if err != nil {
+		t.Fatalf("Failed to get the user stats: %v", err)
+	}
+	return stats.Allocated
+}
+
+func testUsers(t *testing.T, b filefreezer.Backend) {
+	user := addUser(t, b, "alice", 1000)
+	if _, err := b.AddUser("alice", "salt", []byte("saltedhash"), 1000); err == nil {
+		t.Fatal("Adding a user with a name that's taken should fail.")
+	}
+	if _, err := b.GetUser("nobody"); err == nil {
+		t.Fatal("Getting a user that doesn't exist should fail.")
+	}
+
+	found, err := b.GetUser("alice")
+	if err != nil || found.ID != user.ID || found.Salt != "salt" || !bytes.Equal(found.SaltedHash, []byte("saltedhash")) {
+		t.Fatalf("GetUser didn't return the user that was added (%v): %v", found, err)
+	}
+
+	stats, err := b.GetUserStats(user.ID)
+	if err != nil || stats.Quota != 1000 || stats.Allocated != 0 {
+		t.Fatalf("A new user should have its quota and nothing allocated (%v): %v", stats, err)
+	}
+	if err = b.SetUserQuota(user.ID, 2000); err != nil {
+		t.Fatalf("Failed to set the user quota: %v", err)
+	}
+	if stats, _ = b.GetUserStats(user.ID); stats.Quota != 2000 {
+		t.Fatalf("SetUserQuota didn't change the quota (%d).", stats.Quota)
+	}
+	if stats.MaxVersions != 0 {
+		t.Fatalf("A new user should use the server's maximum versions (%d).", stats.MaxVersions)
+	}
+	if err = b.SetUserMaxVersions(user.ID, 5); err != nil {
+		t.Fatalf("Failed to set the user's maximum versions: %v", err)
+	}
+	if stats, _ = b.GetUserStats(user.ID); stats.MaxVersions != 5 || stats.Quota != 2000 {
+		t.Fatalf("SetUserMaxVersions didn't change only the maximum versions (%v).", stats)
+	}
+	if err = b.SetUserMaxEgress(user.ID, 1<<30); err != nil {
+		t.Fatalf("Failed to set the user's maximum egress: %v", err)
+	}
+	if stats, _ = b.GetUserStats(user.ID); stats.MaxEgress != 1<<30 || stats.MaxVersions != 5 {
+		t.Fatalf("SetUserMaxEgress didn't change only the maximum egress (%v).", stats)
+	}
+
+	if err = b.FreezeUserPruning(user.ID, "audit"); err != nil {
+		t.Fatalf("Failed to freeze pruning: %v", err)
+	}
+	frozen, _, reason, err := b.GetUserPruningFreeze(user.ID)
+	if err != nil || !frozen || reason != "audit" {
+		t.Fatalf("Pruning should be frozen for the audit (%v, %s): %v", frozen, reason, err)
+	}
+	if err = b.UnfreezeUserPruning(user.ID); err != nil {
+		t.Fatalf("Failed to unfreeze pruning: %v", err)
+	}
+	if frozen, _, _, _ = b.GetUserPruningFreeze(user.ID); frozen {
+		t.Fatal("Pruning should no longer be frozen.")
+	}
+
+	if deletion, err := b.GetAccountDeletion(user.ID); err != nil || deletion != nil {
+		t.Fatalf("A new user shouldn't have asked to be erased (%v): %v", deletion, err)
+	}
+	if err = b.SetAccountDeletion(user.ID, "confirm", 0); err != nil {
+		t.Fatalf("Failed to request the account deletion: %v", err)
+	}
+	if due, _ := b.GetDueAccountDeletions(3000); len(due) != 0 {
+		t.Fatal("An unconfirmed account deletion shouldn't be due.")
+	}
+	if err = b.SetAccountDeletion(user.ID, "confirm", 2000); err != nil {
+		t.Fatalf("Failed to confirm the account deletion: %v", err)
+	}
+	deletion, err := b.GetAccountDeletion(user.ID)
+	if err != nil || deletion == nil || deletion.Token != "confirm" || deletion.DeleteAt != 2000 {
+		t.Fatalf("GetAccountDeletion didn't return the confirmed deletion (%v): %v", deletion, err)
+	}
+	if due, _ := b.GetDueAccountDeletions(1000); len(due) != 0 {
+		t.Fatal("An account deletion shouldn't be due before its grace period ends.")
+	}
+	if due, _ := b.GetDueAccountDeletions(3000); len(due) != 1 || due[0].UserID != user.ID {
+		t.Fatalf("Expected the account deletion to be due (%v).", due)
+	}
+	if err = b.RemoveAccountDeletion(user.ID); err != nil {
+		t.Fatalf("Failed to cancel the account deletion: %v", err)
+	}
+	if deletion, _ = b.GetAccountDeletion(user.ID); deletion != nil {
+		t.Fatal("A cancelled account deletion should be gone.")
+	}
+
+	bob := addUser(t, b, "bob", 1000)
+	users, err := b.GetAllUsers()
+	if err != nil || len(users) != 2 {
+		t.Fatalf("Expected two users but got %d: %v", len(users), err)
+	}
+	b.SetAccountDeletion(bob.ID, "confirm", 2000)
+	if err = b.RemoveUser("bob"); err != nil {
+		t.Fatalf("Failed to remove a user: %v", err)
+	}
+	if _, err = b.GetUser("bob"); err == nil {
+		t.Fatal("A removed user shouldn't be found.")
+	}
+	if due, _ := b.GetDueAccountDeletions(3000); len(due) != 0 {
+		t.Fatal("Removing a user should remove their account deletion.")
+	}
+}
+
+func testFiles(t *testing.T, b filefreezer.Backend) {
+	user := addUser(t, b, "alice", 1000)
+
+	fi, err := b.AddFileInfo(user.ID, "encrypted-name", false, 0644, 100, 2, "hash1", "")
+	if err != nil {
+		t.Fatalf("Failed to add a file: %v", err)
+	}
+	if fi.CurrentVersion.VersionNumber != 1 || fi.CurrentVersion.ChunkCount != 2 {
+		t.Fatalf("A new file should start at version 1 with its chunk count (%v).", fi.CurrentVersion)
+	}
+	if _, err = b.AddFileInfo(user.ID, "encrypted-name", false, 0644, 100, 2, "hash1", ""); err == nil {
+		t.Fatal("Adding a file with a name the user already has should fail.")
+	}
+
+	byName, err := b.GetFileInfoByName(user.ID, "encrypted-name")
+	if err != nil || byName.FileID != fi.FileID {
+		t.Fatalf("GetFileInfoByName didn't find the file: %v", err)
+	}
+
+	tagged, err := b.TagNewFileVersion(user.ID, fi.FileID, 0600, 200, 1, "hash2", "")
+	if err != nil {
+		t.Fatalf("Failed to tag a new file version: %v", err)
+	}
+	if tagged.CurrentVersion.VersionNumber != 2 || tagged.CurrentVersion.FileHash != "hash2" {
+		t.Fatalf("The tagged version should be version 2 (%v).", tagged.CurrentVersion)
+	}
+	current, err := b.GetFileInfo(user.ID, fi.FileID)
+	if err != nil || current.CurrentVersion.VersionID != tagged.CurrentVersion.VersionID {
+		t.Fatalf("The tagged version should be the current version: %v", err)
+	}
+	versions, err := b.GetFileVersions(fi.FileID)
+	if err != nil || len(versions) != 2 {
+		t.Fatalf("Expected two versions but got %d: %v", len(versions), err)
+	}
+
+	if err = b.RenameFile(user.ID, fi.FileID, "renamed"); err != nil {
+		t.Fatalf("Failed to rename the file: %v", err)
+	}
+	if _, err = b.GetFileInfoByName(user.ID, "renamed"); err != nil {
+		t.Fatalf("The renamed file wasn't found by its new name: %v", err)
+	}
+
+	all, err := b.GetAllUserFileInfos(user.ID)
+	if err != nil || len(all) != 1 {
+		t.Fatalf("Expected one file but got %d: %v", len(all), err)
+	}
+	if err = b.RemoveFile(user.ID, fi.FileID); err != nil {
+		t.Fatalf("Failed to remove the file: %v", err)
+	}
+	if _, err = b.GetFileInfo(user.ID, fi.FileID); err == nil {
+		t.Fatal("A removed file shouldn't be found.")
+	}
+}
+
+func testChunks(t *testing.T, b filefreezer.Backend) {
+	user := addUser(t, b, "alice", 100)
+	fi, err := b.AddFileInfo(user.ID, "file", false, 0644, 100, 3, "hash", "")
+	if err != nil {
+		t.Fatalf("Failed to add a file: %v", err)
+	}
+	versionID := fi.CurrentVersion.VersionID
+
+	missing, err := b.GetMissingChunkNumbersForFile(user.ID, fi.FileID)
+	if err != nil || len(missing) != 3 {
+		t.Fatalf("All three chunks should be missing (%v): %v", missing, err)
+	}
+
+	chunk := bytes.Repeat([]byte{1}, 40)
+	if _, err = b.AddFileChunk(user.ID, fi.FileID, versionID, 0, "c0", chunk); err != nil {
+		t.Fatalf("Failed to add a chunk: %v", err)
+	}
+	if _, err = b.AddFileChunk(user.ID, fi.FileID, versionID, 3, "c3", chunk); err == nil {
+		t.Fatal("Adding a chunk past the version's chunk count should fail.")
+	}
+	if _, err = b.AddFileChunk(user.ID, fi.FileID, versionID, 1, "c1", chunk); err != nil {
+		t.Fatalf("Failed to add a chunk: %v", err)
+	}
+	if _, err = b.AddFileChunk(user.ID, fi.FileID, versionID, 2, "c2", chunk); err == nil {
+		t.Fatal("Adding a chunk that goes over the quota should fail.")
+	}
+	if got := allocated(t, b, user.ID); got != 80 {
+		t.Fatalf("Expected 80 bytes allocated but got %d.", got)
+	}
+
+	missing, err = b.GetMissingChunkNumbersForFile(user.ID, fi.FileID)
+	if err != nil || len(missing) != 1 || missing[0] != 2 {
+		t.Fatalf("Only chunk 2 should be missing (%v): %v", missing, err)
+	}
+
+	got, err := b.GetFileChunk(fi.FileID, 1, versionID)
+	if err != nil || got.ChunkHash != "c1" || !bytes.Equal(got.Chunk, chunk) {
+		t.Fatalf("GetFileChunk didn't return the chunk that was added: %v", err)
+	}
+	infos, err := b.GetFileChunkInfos(user.ID, fi.FileID, versionID)
+	if err != nil || len(infos) != 2 {
+		t.Fatalf("Expected two chunk infos but got %d: %v", len(infos), err)
+	}
+	if infos[0].Length != 40 || infos[1].Length != 40 {
+		t.Fatalf("The chunk infos should have the chunk lengths (%d, %d).", infos[0].Length, infos[1].Length)
+	}
+
+	removed, err := b.RemoveFileChunk(user.ID, fi.FileID, versionID, 0)
+	if err != nil || !removed {
+		t.Fatalf("Failed to remove a chunk: %v", err)
+	}
+	if got := allocated(t, b, user.ID); got != 40 {
+		t.Fatalf("Removing a chunk should free its bytes; %d bytes are still allocated.", got)
+	}
+
+	// a chunk with the same hash as another only counts once physically
+	if _, err = b.AddFileChunk(user.ID, fi.FileID, versionID, 2, "c1", chunk); err != nil {
+		t.Fatalf("Failed to add a chunk: %v", err)
+	}
+	logical, physical, err := b.GetUserChunkUsage(user.ID)
+	if err != nil || logical != 80 || physical != 40 {
+		t.Fatalf("Expected 80 logical and 40 physical bytes but got %d and %d: %v", logical, physical, err)
+	}
+	usage, err := b.GetUserUsage(user.ID)
+	if err != nil || usage.FileCount != 1 || usage.VersionCount != 1 || usage.LogicalSize != 80 || usage.PhysicalSize != 40 {
+		t.Fatalf("Expected one file and version with 80 logical and 40 physical bytes but got %+v: %v", usage, err)
+	}
+	stats, err := b.GetUserStats(user.ID)
+	if err != nil || usage.Revision != stats.Revision {
+		t.Fatalf("The usage should be counted at the user's current revision (%d): %v", usage.Revision, err)
+	}
+	if err = b.RemoveFile(user.ID, fi.FileID); err != nil {
+		t.Fatalf("Failed to remove the file: %v", err)
+	}
+	if got := allocated(t, b, user.ID); got != 0 {
+		t.Fatalf("Removing a file should free its chunks; %d bytes are still allocated.", got)
+	}
+}
+
+func testPatches(t *testing.T, b filefreezer.Backend) {
+	user := addUser(t, b, "alice", 200)
+	fi, err := b.AddFileInfo(user.ID, "file", false, 0644, 100, 3, "hash", "")
+	if err != nil {
+		t.Fatalf("Failed to add a file: %v", err)
+	}
+	baseID := fi.CurrentVersion.VersionID
+	chunk := func(i int) []byte { return bytes.Repeat([]byte{byte(i + 1)}, 40) }
+	for i := 0; i < 3; i++ {
+		if _, err = b.AddFileChunk(user.ID, fi.FileID, baseID, i, "c", chunk(i)); err != nil {
+			t.Fatalf("Failed to add a chunk: %v", err)
+		}
+	}
+
+	// chunk 0 is copied from chunk 2, which moved, and chunk 1 is left out
+	patched, err := b.PatchFileVersion(user.ID, fi.FileID, baseID, 0644, 200, 2, "hash2", "", []int{2, -1})
+	if err != nil {
+		t.Fatalf("Failed to patch the file: %v", err)
+	}
+	if patched.CurrentVersion.VersionNumber != 2 || patched.CurrentVersion.ChunkCount != 2 {
+		t.Fatalf("The patched version should be version 2 with 2 chunks (%+v).", patched.CurrentVersion)
+	}
+	missing, err := b.GetMissingChunkNumbersForFile(user.ID, fi.FileID)
+	if err != nil || len(missing) != 1 || missing[0] != 1 {
+		t.Fatalf("Only the replaced chunk should be missing (%v): %v", missing, err)
+	}
+	got, err := b.GetFileChunk(fi.FileID, 0, patched.CurrentVersion.VersionID)
+	if err != nil || !bytes.Equal(got.Chunk, chunk(2)) {
+		t.Fatalf("The patched version should have a copy of chunk 2 as chunk 0: %v", err)
+	}
+	if got := allocated(t, b, user.ID); got != 160 {
+		t.Fatalf("The copied chunk should count against the quota; %d bytes are allocated.", got)
+	}
+
+	// copying more than the quota allows fails without tagging a version
+	if _, err = b.PatchFileVersion(user.ID, fi.FileID, baseID, 0644, 300, 3, "hash3", "", []int{0, 1, 2}); err == nil {
+		t.Fatal("Patching a file over the quota should fail.")
+	}
+	if _, err = b.PatchFileVersion(user.ID, fi.FileID, baseID+100, 0644, 300, 1, "hash3", "", nil); err == nil {
+		t.Fatal("Patching from a version of another file should fail.")
+	}
+	versions, err := b.GetFileVersions(fi.FileID)
+	if err != nil || len(versions) != 2 {
+		t.Fatalf("Failed patches shouldn't tag versions (%d versions): %v", len(versions), err)
+	}
+}
+
+func testStreams(t *testing.T, b filefreezer.Backend) {
+	user := addUser(t, b, "alice", 1000)
+
+	// a version tagged without chunks or a hash takes chunks until it's
+	// finalized with the count
+	fi, err := b.AddFileInfo(user.ID, "stream", false, 0600, 100, 0, "", "")
+	if err != nil {
+		t.Fatalf("Failed to add an unfinished file: %v", err)
+	}
+	versionID := fi.CurrentVersion.VersionID
+	chunk := bytes.Repeat([]byte{1}, 40)
+	for i := 0; i < 3; i++ {
+		if _, err = b.AddFileChunk(user.ID, fi.FileID, versionID, i, "c", chunk); err != nil {
+			t.Fatalf("Failed to add chunk %d to the unfinished version: %v", i, err)
+		}
+	}
+	if _, err = b.AddFileChunk(user.ID, fi.FileID, versionID, -1, "c", chunk); err == nil {
+		t.Fatal("Adding a negative chunk number should fail.")
+	}
+	if err = b.UpdateFileVersionChunks(user.ID, fi.FileID, versionID, 2, "hash"); err == nil {
+		t.Fatal("Finalizing a version with fewer chunks than were uploaded should fail.")
+	}
+	if err = b.UpdateFileVersionChunks(user.ID, fi.FileID, versionID, 3, "hash"); err != nil {
+		t.Fatalf("Failed to finalize the version: %v", err)
+	}
+	if _, err = b.AddFileChunk(user.ID, fi.FileID, versionID, 3, "c", chunk); err == nil {
+		t.Fatal("Adding a chunk past the count of a finalized version should fail.")
+	}
+	missing, err := b.GetMissingChunkNumbersForFile(user.ID, fi.FileID)
+	if err != nil || len(missing) != 0 {
+		t.Fatalf("The finalized version shouldn't be missing chunks (%v): %v", missing, err)
+	}
+
+	// finished versions and versions that aren't current can't be changed
+	if err = b.UpdateFileVersionChunks(user.ID, fi.FileID, versionID, 1, "hash"); !errors.Is(err, filefreezer.ErrVersionFinalized) {
+		t.Fatalf("Expected ErrVersionFinalized changing a finished version: %v", err)
+	}
+	next, err := b.TagNewFileVersion(user.ID, fi.FileID, 0600, 200, 0, "", "")
+	if err != nil {
+		t.Fatalf("Failed to tag an unfinished version: %v", err)
+	}
+	if _, err = b.TagNewFileVersion(user.ID, fi.FileID, 0600, 300, 0, "", ""); err != nil {
+		t.Fatalf("Failed to tag another unfinished version: %v", err)
+	}
+	if err = b.UpdateFileVersionChunks(user.ID, fi.FileID, next.CurrentVersion.VersionID, 1, "hash2"); !errors.Is(err, filefreezer.ErrVersionFinalized) {
+		t.Fatalf("Expected ErrVersionFinalized finalizing a version that isn't current: %v", err)
+	}
+	infos, err := b.GetFileChunkInfos(user.ID, fi.FileID, versionID)
+	if err != nil || len(infos) != 3 {
+		t.Fatalf("The finished version should keep its three chunks but has %d: %v", len(infos), err)
+	}
+}
+
+func testOwnership(t *testing.T, b filefreezer.Backend) {
+	alice := addUser(t, b, "alice", 1000)
+	bob := addUser(t, b, "bob", 1000)
+	fi, err := b.AddFileInfo(alice.ID, "file", false, 0644, 100, 1, "hash", "")
+	if err != nil {
+		t.Fatalf("Failed to add a file: %v", err)
+	}
+	versionID := fi.CurrentVersion.VersionID
+
+	if _, err = b.GetFileInfo(bob.ID, fi.FileID); err == nil {
+		t.Fatal("Getting another user's file should fail.")
+	}
+	if _, err = b.AddFileChunk(bob.ID, fi.FileID, versionID, 0, "c0", []byte("data")); err == nil {
+		t.Fatal("Adding a chunk to another user's file should fail.")
+	}
+	if _, err = b.TagNewFileVersion(bob.ID, fi.FileID, 0644, 200, 1, "hash2", ""); err == nil {
+		t.Fatal("Tagging a version of another user's file should fail.")
+	}
+	if err = b.RenameFile(bob.ID, fi.FileID, "stolen"); err == nil {
+		t.Fatal("Renaming another user's file should fail.")
+	}
+	if err = b.RemoveFile(bob.ID, fi.FileID); err == nil {
+		t.Fatal("Removing another user's file should fail.")
+	}
+
+	// the same name may be used by different users
+	if _, err = b.AddFileInfo(bob.ID, "file", false, 0644, 100, 1, "hash", ""); err != nil {
+		t.Fatalf("A second user should be able to add a file with the same name: %v", err)
+	}
+	files, err := b.GetAllUserFileInfos(alice.ID)
+	if err != nil || len(files) != 1 || files[0].FileID != fi.FileID {
+		t.Fatalf("The first user should only see their own file: %v", err)
+	}
+}
+
+func testShares(t *testing.T, b filefreezer.Backend) {
+	alice := addUser(t, b, "alice", 100)
+	bob := addUser(t, b, "bob", 100)
+
+	share, err := b.AddShare(alice.ID, "shared.txt", 100, 2, "hash", "text/plain", nil, 0)
+	if err != nil {
+		t.Fatalf("Failed to add a share: %v", err)
+	}
+	locked, err := b.AddShare(alice.ID, "locked.txt", 100, 0, "hash", "", []byte("hash"), 2)
+	if err != nil || !locked.Protected || locked.MaxDownloads != 2 {
+		t.Fatalf("Failed to add a share with a password and download limit (%+v): %v", locked, err)
+	}
+	if byName, err := b.GetShareByName(alice.ID, "locked.txt"); err != nil || !byName.Protected || byName.MaxDownloads != 2 {
+		t.Fatalf("A share should be protected and limited as soon as it's added (%+v): %v", byName, err)
+	}
+	if err = b.RemoveShare(alice.ID, locked.ShareID); err != nil {
+		t.Fatalf("Failed to remove the share: %v", err)
+	}
+	if err = b.AddShareChunk(bob.ID, share.ShareID, 0, []byte("data")); err == nil {
+		t.Fatal("Adding a chunk to another user's share should fail.")
+	}
+	if err = b.AddShareChunk(alice.ID, share.ShareID, 2, []byte("data")); err == nil {
+		t.Fatal("Adding a share chunk past its chunk count should fail.")
+	}
+	if err = b.AddShareChunk(alice.ID, share.ShareID, 0, []byte("hello ")); err != nil {
+		t.Fatalf("Failed to add a share chunk: %v", err)
+	}
+	if err = b.AddShareChunk(alice.ID, share.ShareID, 1, []byte("world")); err != nil {
+		t.Fatalf("Failed to add a share chunk: %v", err)
+	}
+	if got := allocated(t, b, alice.ID); got != 11 {
+		t.Fatalf("Share chunks should count against the quota; expected 11 bytes allocated but got %d.", got)
+	}
+
+	chunk, err := b.GetShareChunk(share.ShareID, 1)
+	if err != nil || string(chunk) != "world" {
+		t.Fatalf("GetShareChunk didn't return the chunk that was added (%q): %v", chunk, err)
+	}
+	byName, err := b.GetShareByName(alice.ID, "shared.txt")
+	if err != nil || byName.ShareID != share.ShareID {
+		t.Fatalf("GetShareByName didn't find the share: %v", err)
+	}
+
+	toRechunk, err := b.GetSharesToRechunk(4)
+	if err != nil || len(toRechunk) != 1 || toRechunk[0].ShareID != share.ShareID {
+		t.Fatalf("The share should need rechunking for a new chunk size (%v): %v", toRechunk, err)
+	}
+	if _, err = b.RechunkShare(bob.ID, share.ShareID, 4); err == nil {
+		t.Fatal("Rechunking another user's share should fail.")
+	}
+	count, err := b.RechunkShare(alice.ID, share.ShareID, 4)
+	if err != nil || count != 3 {
+		t.Fatalf("Expected the share to be rechunked into 3 chunks but got %d: %v", count, err)
+	}
+	sizes, err := b.GetShareChunkSizes(share.ShareID)
+	if err != nil || len(sizes) != 3 || sizes[0] != 4 || sizes[1] != 4 || sizes[2] != 3 {
+		t.Fatalf("Unexpected chunk sizes after rechunking (%v): %v", sizes, err)
+	}
+	chunk, err = b.GetShareChunk(share.ShareID, 1)
+	if err != nil || string(chunk) != "o wo" {
+		t.Fatalf("The rechunked data doesn't match (%q): %v", chunk, err)
+	}
+	if got := allocated(t, b, alice.ID); got != 11 {
+		t.Fatalf("Rechunking shouldn't change the allocation; expected 11 bytes but got %d.", got)
+	}
+	if toRechunk, err = b.GetSharesToRechunk(4); err != nil || len(toRechunk) != 0 {
+		t.Fatalf("No shares should need rechunking after it's done (%v): %v", toRechunk, err)
+	}
+
+	if err = b.SetShareLimits(alice.ID, share.ShareID, []byte("hash"), 1); err != nil {
+		t.Fatalf("Failed to set the share limits: %v", err)
+	}
+	byName, err = b.GetShareByName(alice.ID, "shared.txt")
+	if err != nil || !byName.Protected || byName.MaxDownloads != 1 {
+		t.Fatalf("The share should be protected and limited after setting its limits (%+v): %v", byName, err)
+	}
+	if hash, err := b.GetSharePassword(share.ShareID); err != nil || string(hash) != "hash" {
+		t.Fatalf("GetSharePassword didn't return the hash that was set (%q): %v", hash, err)
+	}
+	if ok, err := b.CountShareDownload(share.ShareID); err != nil || !ok {
+		t.Fatalf("The first download should be allowed: %v", err)
+	}
+	if ok, _ := b.CountShareDownload(share.ShareID); ok {
+		t.Fatal("A download past the share's limit should not be allowed.")
+	}
+
+	if err = b.RemoveShare(bob.ID, share.ShareID); err == nil {
+		t.Fatal("Removing another user's share should fail.")
+	}
+	if err = b.RemoveShare(alice.ID, share.ShareID); err != nil {
+		t.Fatalf("Failed to remove the share: %v", err)
+	}
+	if got := allocated(t, b, alice.ID); got != 0 {
+		t.Fatalf("Removing a share should free its chunks; %d bytes are still allocated.", got)
+	}
+	shares, err := b.GetShares(alice.ID)
+	if err != nil || len(shares) != 0 {
+		t.Fatalf("Expected no shares but got %d: %v", len(shares), err)
+	}
+}
+
+// failingReader fails every read like an upload whose connection was lost.
+type failingReader struct{}
+
+func (failingReader) Read(p []byte) (int, error) {
+	return 0, errors.New("the connection was lost")
+}
+
+func testDrops(t *testing.T, b filefreezer.Backend) {
+	alice := addUser(t, b, "alice", 100)
+
+	dt, err := b.AddDropToken(alice.ID, "token", "inbox", 10, 2)
+	if err != nil {
+		t.Fatalf("Failed to add a drop token: %v", err)
+	}
+	if _, err = b.AddDropFile("token", "big.txt", bytes.NewReader(bytes.Repeat([]byte{1}, 11))); !errors.Is(err, filefreezer.ErrDropFileTooLarge) {
+		t.Fatalf("Dropping a file larger than the token's limit should fail: %v", err)
+	}
+	if _, err = b.AddDropFile("token", "broken.txt", io.MultiReader(strings.NewReader("aa"), failingReader{})); err == nil {
+		t.Fatal("Dropping a file whose upload fails should fail.")
+	}
+	if got := allocated(t, b, alice.ID); got != 0 {
+		t.Fatalf("Failed drops should be removed; expected 0 bytes allocated but got %d.", got)
+	}
+	df, err := b.AddDropFile("token", "a.txt", strings.NewReader("aaaa"))
+	if err != nil {
+		t.Fatalf("Failed to drop a file: %v", err)
+	}
+	if _, err = b.AddDropFile("token", "b.txt", strings.NewReader("bbbb")); err != nil {
+		t.Fatalf("Failed to drop a file: %v", err)
+	}
+	if _, err = b.AddDropFile("token", "c.txt", strings.NewReader("cccc")); err == nil {
+		t.Fatal("Dropping more files than the token allows should fail.")
+	}
+	if _, err = b.AddDropFile("unknown", "a.txt", strings.NewReader("aaaa")); err == nil {
+		t.Fatal("Dropping a file with an unknown token should fail.")
+	}
+
+	found, err := b.GetDropTokenByToken("token")
+	if err != nil || found.DropID != dt.DropID || found.FileCount != 2 {
+		t.Fatalf("GetDropTokenByToken should count the dropped files (%v): %v", found, err)
+	}
+	data, err := b.GetDropFileData(alice.ID, df.DropFileID)
+	if err != nil || string(data) != "aaaa" {
+		t.Fatalf("GetDropFileData didn't return the dropped data (%q): %v", data, err)
+	}
+	if got := allocated(t, b, alice.ID); got != 8 {
+		t.Fatalf("Dropped files should count against the quota; expected 8 bytes allocated but got %d.", got)
+	}
+
+	if err = b.RemoveDropFile(alice.ID, df.DropFileID); err != nil {
+		t.Fatalf("Failed to remove a drop file: %v", err)
+	}
+	files, err := b.GetDropFiles(alice.ID)
+	if err != nil || len(files) != 1 {
+		t.Fatalf("Expected one drop file but got %d: %v", len(files), err)
+	}
+	if err = b.RemoveDropToken(alice.ID, dt.DropID); err != nil {
+		t.Fatalf("Failed to remove the drop token: %v", err)
+	}
+	if _, err = b.GetDropTokenByToken("token"); err == nil {
+		t.Fatal("A removed drop token shouldn't be found.")
+	}
+}
+
+func testSupport(t *testing.T, b filefreezer.Backend) {
+	alice := addUser(t, b, "alice", 100)
+
+	expires, err := b.GetSupportConsent(alice.ID)
+	if err != nil || expires != 0 {
+		t.Fatalf("A new user shouldn't have consented to support access (%d): %v", expires, err)
+	}
+	if err = b.SetSupportConsent(alice.ID, 1000); err != nil {
+		t.Fatalf("Failed to set the support consent: %v", err)
+	}
+	if expires, _ = b.GetSupportConsent(alice.ID); expires != 1000 {
+		t.Fatalf("Expected the consent to expire at 1000 but got %d.", expires)
+	}
+	if err = b.RemoveSupportConsent(alice.ID); err != nil {
+		t.Fatalf("Failed to remove the support consent: %v", err)
+	}
+	if expires, _ = b.GetSupportConsent(alice.ID); expires != 0 {
+		t.Fatalf("A removed consent should be gone but it expires at %d.", expires)
+	}
+
+	st, err := b.AddSupportToken(alice.ID, "support", "outage", true, 2000)
+	if err != nil {
+		t.Fatalf("Failed to add a support token: %v", err)
+	}
+	found, err := b.GetSupportTokenByToken("support")
+	if err != nil || found.SupportID != st.SupportID || found.UserID != alice.ID || !found.BreakGlass ||
+		found.Reason != "outage" || found.Expires != 2000 {
+		t.Fatalf("GetSupportTokenByToken didn't return the token that was added (%v): %v", found, err)
+	}
+	if _, err = b.GetSupportTokenByToken("unknown"); err == nil {
+		t.Fatal("An unknown support token shouldn't be found.")
+	}
+
+	for _, action := range []string{"created", "listed files"} {
+		if err = b.AddSupportAudit(alice.ID, st.SupportID, action); err != nil {
+			t.Fatalf("Failed to add a support audit record: %v", err)
+		}
+	}
+	audit, err := b.GetSupportAudit(alice.ID)
+	if err != nil || len(audit) != 2 || audit[0].Action != "created" || audit[1].SupportID != st.SupportID {
+		t.Fatalf("GetSupportAudit didn't return the records in order (%v): %v", audit, err)
+	}
+}
+
+func testBandwidth(t *testing.T, b filefreezer.Backend) {
+	alice := addUser(t, b, "alice", 100)
+	bob := addUser(t, b, "bob", 100)
+
+	days, err := b.GetUserBandwidth(alice.ID, "")
+	if err != nil || len(days) != 0 {
+		t.Fatalf("A new user shouldn't have any bandwidth (%v): %v", days, err)
+	}
+
+	for _, r := range []struct {
+		userID   int
+		day      string
+		up, down int64
+	}{
+		{alice.ID, "2017-06-30", 100, 10},
+		{alice.ID, "2017-06-29", 5, 0},
+		{alice.ID, "2017-06-30", 20, 1000},
+		{bob.ID, "2017-06-30", 1, 1},
+	} {
+		if err = b.AddUserBandwidth(r.userID, r.day, r.up, r.down); err != nil {
+			t.Fatalf("Failed to add bandwidth: %v", err)
+		}
+	}
+
+	days, err = b.GetUserBandwidth(alice.ID, "")
+	if err != nil || len(days) != 2 || days[0].Day != "2017-06-29" || days[1].Day != "2017-06-30" {
+		t.Fatalf("GetUserBandwidth didn't return the days in order (%v): %v", days, err)
+	}
+	if days[1].Requests != 2 || days[1].Uploaded != 120 || days[1].Downloaded != 1010 {
+		t.Fatalf("The requests of a day should be summed up but got %+v.", days[1])
+	}
+	days, err = b.GetUserBandwidth(alice.ID, "2017-06-30")
+	if err != nil || len(days) != 1 || days[0].Day != "2017-06-30" {
+		t.Fatalf("Expected only the days since 2017-06-30 (%v): %v", days, err)
+	}
+
+	if err = b.RemoveUser("alice"); err != nil {
+		t.Fatalf("Failed to remove the user: %v", err)
+	}
+	days, err = b.GetUserBandwidth(bob.ID, "")
+	if err != nil || len(days) != 1 || days[0].Requests != 1 {
+		t.Fatalf("Removing a user shouldn't touch the bandwidth of others (%v): %v", days, err)
+	}
+}
+
+func testLocks(t *testing.T, b filefreezer.Backend) {
+	alice := addUser(t, b, "alice", 100)
+	bob := addUser(t, b, "bob", 100)
+	fi, err := b.AddFileInfo(alice.ID, "file", false, 0644, 100, 0, "hash", "")
+	if err != nil {
+		t.Fatalf("Failed to add a file: %v", err)
+	}
+	expires := time.Now().UTC().Unix() + 600
+
+	if lock, err := b.GetFileLock(alice.ID, fi.FileID); err != nil || lock != nil {
+		t.Fatalf("A new file shouldn't be locked (%v): %v", lock, err)
+	}
+	if _, _, err = b.LockFile(bob.ID, fi.FileID, "bob", "laptop", expires); err == nil {
+		t.Fatal("Locking another user's file should fail.")
+	}
+	lock, acquired, err := b.LockFile(alice.ID, fi.FileID, "one", "laptop", expires)
+	if err != nil || !acquired || lock.Holder != "laptop" || lock.Expires != expires {
+		t.Fatalf("Failed to lock the file (%v): %v", lock, err)
+	}
+
+	// another token can't take the lock but the holder can renew it
+	lock, acquired, err = b.LockFile(alice.ID, fi.FileID, "two", "desktop", expires)
+	if err != nil || acquired || lock.Holder != "laptop" {
+		t.Fatalf("The lock should still be held by the first token (%v): %v", lock, err)
+	}
+	lock, acquired, err = b.LockFile(alice.ID, fi.FileID, "one", "laptop", expires+60)
+	if err != nil || !acquired || lock.Expires != expires+60 {
+		t.Fatalf("Failed to renew the lock (%v): %v", lock, err)
+	}
+	locks, err := b.GetFileLocks(alice.ID)
+	if err != nil || len(locks) != 1 || locks[0].FileID != fi.FileID || locks[0].Token != "one" {
+		t.Fatalf("GetFileLocks didn't return the lock (%v): %v", locks, err)
+	}
+
+	if released, err := b.UnlockFile(alice.ID, fi.FileID, "two"); err != nil || released {
+		t.Fatalf("Another token shouldn't release the lock: %v", err)
+	}
+	if released, err := b.UnlockFile(alice.ID, fi.FileID, "one"); err != nil || !released {
+		t.Fatalf("Failed to release the lock: %v", err)
+	}
+
+	// expired locks are ignored and can be taken over
+	if _, _, err = b.LockFile(alice.ID, fi.FileID, "one", "laptop", expires-1200); err != nil {
+		t.Fatalf("Failed to lock the file: %v", err)
+	}
+	if lock, err = b.GetFileLock(alice.ID, fi.FileID); err != nil || lock != nil {
+		t.Fatalf("An expired lock should be ignored (%v): %v", lock, err)
+	}
+	if _, acquired, err = b.LockFile(alice.ID, fi.FileID, "two", "desktop", expires); err != nil || !acquired {
+		t.Fatalf("An expired lock should be taken over: %v", err)
+	}
+
+	if err = b.RemoveFile(alice.ID, fi.FileID); err != nil {
+		t.Fatalf("Failed to remove the file: %v", err)
+	}
+	if locks, err = b.GetFileLocks(alice.ID); err != nil || len(locks) != 0 {
+		t.Fatalf("Removing a file should remove its lock (%v): %v", locks, err)
+	}
+}
@@ -0,0 +1,61 @@
+// Copyright 2017, Timothy Bogdala <tdb@animal-machine.com>
+// See the LICENSE file for more details.
+
+package backendtest
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/marcoziti/gringotts"
+)
+
+func TestSQLiteBackend(t *testing.T) {
+	dbCount := 0
+	Run(t, func(t *testing.T) filefreezer.Backend {
+		// each subtest gets its own shared-cache memory database
+		dbCount++
+		source := fmt.Sprintf("file:backendtest%d?mode=memory&cache=shared", dbCount)
+		b, err := filefreezer.OpenBackend("sqlite", source, 1024)
+		if err != nil {
+			t.Fatalf("Failed to open the sqlite backend: %v", err)
+		}
+		if b.MaxChunkSize() != 1024 {
+			t.Fatalf("The backend should keep the chunk size it was opened with (%d).", b.MaxChunkSize())
+		}
+		return b
+	})
+
+	// the same suite with the chunk data kept in a directory instead
+	var blobDirs []string
+	defer func() {
+		for _, dir := range blobDirs {
+			os.RemoveAll(dir)
+		}
+	}()
+	Run(t, func(t *testing.T) filefreezer.Backend {
+		dbCount++
+		source := fmt.Sprintf("file:backendtest%d?mode=memory&cache=shared", dbCount)
+		b, err := filefreezer.OpenBackend("sqlite", source, 1024)
+		if err != nil {
+			t.Fatalf("Failed to open the sqlite backend: %v", err)
+		}
+		dir, err := ioutil.TempDir("", "backendtest")
+		if err != nil {
+			t.Fatalf("Failed to create a directory for the chunks: %v", err)
+		}
+		blobDirs = append(blobDirs, dir)
+		b.(*filefreezer.Storage).Blobs, err = filefreezer.OpenBlobStore("file://" + filepath.ToSlash(dir))
+		if err != nil {
+			t.Fatalf("Failed to open the chunk store: %v", err)
+		}
+		return b
+	})
+
+	if _, err := filefreezer.OpenBackend("nosuchbackend", "", 1024); err == nil {
+		t.Fatal("Opening a backend that isn't registered should fail.")
+	}
+}
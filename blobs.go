@@ -0,0 +1,125 @@
+// Copyright 2017, Timothy Bogdala <tdb@animal-machine.com>
+// See the LICENSE file for more details.
+
+package filefreezer
+
+import (
+	"fmt"
+	"io/ioutil"
+	"net/url"
+	"os"
+	"path/filepath"
+	"sort"
+	"sync"
+)
+
+// BlobStore keeps the data of file chunks by key so that a Storage only has to
+// hold the metadata, such as when the chunks live in a cloud object store.
+//
+// Put replaces any data already stored under the key. Get must fail for a key
+// that hasn't been Put, while deleting a missing key isn't an error. Keys are
+// made of letters, digits and slashes.
+type BlobStore interface {
+	Put(key string, data []byte) error
+	Get(key string) ([]byte, error)
+	Delete(key string) error
+}
+
+// BlobStoreOpener opens a BlobStore from a URL, such as file:///var/chunks.
+type BlobStoreOpener func(u *url.URL) (BlobStore, error)
+
+var (
+	blobStoresLock sync.Mutex
+	blobStores     = make(map[string]BlobStoreOpener)
+)
+
+func init() {
+	RegisterBlobStore("file", func(u *url.URL) (BlobStore, error) {
+		if u.Path == "" {
+			return nil, fmt.Errorf("the blob store URL %s has no directory", u)
+		}
+		return NewDirBlobStore(filepath.FromSlash(u.Path))
+	})
+}
+
+// RegisterBlobStore makes a BlobStore available to OpenBlobStore for URLs with
+// the scheme, replacing any opener already registered for it.
+func RegisterBlobStore(scheme string, open BlobStoreOpener) {
+	blobStoresLock.Lock()
+	defer blobStoresLock.Unlock()
+	blobStores[scheme] = open
+}
+
+// OpenBlobStore opens the BlobStore registered for the scheme of the URL.
+func OpenBlobStore(rawurl string) (BlobStore, error) {
+	u, err := url.Parse(rawurl)
+	if err != nil {
+		return nil, fmt.Errorf("invalid blob store URL %s: %v", rawurl, err)
+	}
+
+	blobStoresLock.Lock()
+	open, found := blobStores[u.Scheme]
+	schemes := make([]string, 0, len(blobStores))
+	for scheme := range blobStores {
+		schemes = append(schemes, scheme)
+	}
+	blobStoresLock.Unlock()
+	if !found {
+		sort.Strings(schemes)
+		return nil, fmt.Errorf("unknown blob store %q; the available blob stores are %v", u.Scheme, schemes)
+	}
+	return open(u)
+}
+
+// DirBlobStore is a BlobStore that keeps each blob as a file under a local
+// directory.
+type DirBlobStore struct {
+	Dir string
+}
+
+// NewDirBlobStore creates the directory if needed and returns a DirBlobStore
+// for it.
+func NewDirBlobStore(dir string) (*DirBlobStore, error) {
+	err := os.MkdirAll(dir, 0700)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create the blob directory %s: %v", dir, err)
+	}
+	return &DirBlobStore{Dir: dir}, nil
+}
+
+// Put writes the data to a temporary file that's then renamed over the blob so
+// that readers never see a partial blob.
+func (d *DirBlobStore) Put(key string, data []byte) error {
+	blobPath := filepath.Join(d.Dir, filepath.FromSlash(key))
+	err := os.MkdirAll(filepath.Dir(blobPath), 0700)
+	if err != nil {
+		return err
+	}
+	tmp, err := ioutil.TempFile(filepath.Dir(blobPath), ".blob")
+	if err != nil {
+		return err
+	}
+	_, err = tmp.Write(data)
+	if closeErr := tmp.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		os.Remove(tmp.Name())
+		return err
+	}
+	return os.Rename(tmp.Name(), blobPath)
+}
+
+// Get reads the blob stored under the key.
+func (d *DirBlobStore) Get(key string) ([]byte, error) {
+	return ioutil.ReadFile(filepath.Join(d.Dir, filepath.FromSlash(key)))
+}
+
+// Delete removes the blob stored under the key, if any.
+func (d *DirBlobStore) Delete(key string) error {
+	err := os.Remove(filepath.Join(d.Dir, filepath.FromSlash(key)))
+	if os.IsNotExist(err) {
+		return nil
+	}
+	return err
+}
@@ -0,0 +1,181 @@
+// Copyright 2017, Timothy Bogdala <tdb@animal-machine.com>
+// See the LICENSE file for more details.
+
+package blobstore
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"fmt"
+	"net/http"
+	"net/url"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/marcoziti/gringotts"
+)
+
+// azureVersion is the Blob service REST API version requests are made with.
+const azureVersion = "2019-12-12"
+
+// Azure is a filefreezer.BlobStore that keeps blobs in an Azure Blob Storage
+// container. Requests are authorized with either the storage account's shared
+// key or a SAS token.
+type Azure struct {
+	// Account is the name of the storage account
+	Account string
+
+	// Container is the name of the blob container, which must already exist
+	Container string
+
+	// Endpoint is the URL of the account's blob service; it defaults to
+	// https://<account>.blob.core.windows.net and can be pointed at an emulator
+	Endpoint string
+
+	// Key is the base64 encoded shared key of the account
+	Key string
+
+	// SAS is a shared access signature query string that's used when Key is empty
+	SAS string
+
+	// Client sends the requests; http.DefaultClient is used if it's nil
+	Client *http.Client
+}
+
+func init() {
+	filefreezer.RegisterBlobStore("azure", openAzure)
+}
+
+// openAzure opens a blob store URL of the form azure://account/container. The
+// credentials are taken from the AZURE_STORAGE_KEY or AZURE_STORAGE_SAS_TOKEN
+// environment variables and an endpoint query parameter overrides the default
+// endpoint.
+func openAzure(u *url.URL) (filefreezer.BlobStore, error) {
+	a := &Azure{
+		Account:   u.Host,
+		Container: strings.Trim(u.Path, "/"),
+		Endpoint:  u.Query().Get("endpoint"),
+		Key:       os.Getenv("AZURE_STORAGE_KEY"),
+		SAS:       os.Getenv("AZURE_STORAGE_SAS_TOKEN"),
+	}
+	if a.Account == "" || a.Container == "" {
+		return nil, fmt.Errorf("the blob store URL %s must name the storage account and container as azure://account/container", u)
+	}
+	if a.Key == "" && a.SAS == "" {
+		return nil, fmt.Errorf("set AZURE_STORAGE_KEY or AZURE_STORAGE_SAS_TOKEN to authorize access to the %s storage account", a.Account)
+	}
+	return a, nil
+}
+
+// Put uploads the data as a block blob.
+func (a *Azure) Put(key string, data []byte) error {
+	req, err := a.newRequest("PUT", key, data)
+	if err != nil {
+		return err
+	}
+	req.Header.Set("x-ms-blob-type", "BlockBlob")
+	_, err = a.do(req)
+	return err
+}
+
+// Get downloads the blob.
+func (a *Azure) Get(key string) ([]byte, error) {
+	req, err := a.newRequest("GET", key, nil)
+	if err != nil {
+		return nil, err
+	}
+	return a.do(req)
+}
+
+// Delete removes the blob, if it exists.
+func (a *Azure) Delete(key string) error {
+	req, err := a.newRequest("DELETE", key, nil)
+	if err != nil {
+		return err
+	}
+	_, err = a.do(req)
+	if err == errNotFound {
+		return nil
+	}
+	return err
+}
+
+// newRequest builds a request for the blob; it's signed by do.
+func (a *Azure) newRequest(method string, key string, data []byte) (*http.Request, error) {
+	endpoint := a.Endpoint
+	if endpoint == "" {
+		endpoint = fmt.Sprintf("https://%s.blob.core.windows.net", a.Account)
+	}
+	target := fmt.Sprintf("%s/%s/%s", strings.TrimSuffix(endpoint, "/"), a.Container, key)
+	if a.Key == "" {
+		target += "?" + strings.TrimPrefix(a.SAS, "?")
+	}
+
+	req, err := http.NewRequest(method, target, bytes.NewReader(data))
+	if err != nil {
+		return nil, err
+	}
+	req.ContentLength = int64(len(data))
+	req.Header.Set("x-ms-date", time.Now().UTC().Format(http.TimeFormat))
+	req.Header.Set("x-ms-version", azureVersion)
+	return req, nil
+}
+
+// do signs the request with the shared key, if there is one, and sends it.
+func (a *Azure) do(req *http.Request) ([]byte, error) {
+	if a.Key != "" {
+		signature, err := a.sign(req)
+		if err != nil {
+			return nil, err
+		}
+		req.Header.Set("Authorization", fmt.Sprintf("SharedKey %s:%s", a.Account, signature))
+	}
+	return send(a.Client, req)
+}
+
+// sign returns the Shared Key signature of the request as described at
+// https://docs.microsoft.com/rest/api/storageservices/authorize-with-shared-key
+func (a *Azure) sign(req *http.Request) (string, error) {
+	key, err := base64.StdEncoding.DecodeString(a.Key)
+	if err != nil {
+		return "", fmt.Errorf("the Azure storage key isn't valid base64: %v", err)
+	}
+
+	contentLength := ""
+	if req.ContentLength > 0 {
+		contentLength = strconv.FormatInt(req.ContentLength, 10)
+	}
+
+	var msHeaders []string
+	for name := range req.Header {
+		name = strings.ToLower(name)
+		if strings.HasPrefix(name, "x-ms-") {
+			msHeaders = append(msHeaders, name)
+		}
+	}
+	sort.Strings(msHeaders)
+
+	var toSign bytes.Buffer
+	toSign.WriteString(req.Method + "\n")
+	for _, name := range []string{"Content-Encoding", "Content-Language"} {
+		toSign.WriteString(req.Header.Get(name) + "\n")
+	}
+	toSign.WriteString(contentLength + "\n")
+	for _, name := range []string{"Content-MD5", "Content-Type", "Date", "If-Modified-Since", "If-Match",
+		"If-None-Match", "If-Unmodified-Since", "Range"} {
+		toSign.WriteString(req.Header.Get(name) + "\n")
+	}
+	for _, name := range msHeaders {
+		toSign.WriteString(name + ":" + strings.TrimSpace(req.Header.Get(name)) + "\n")
+	}
+	toSign.WriteString("/" + a.Account + req.URL.EscapedPath())
+
+	mac := hmac.New(sha256.New, key)
+	mac.Write(toSign.Bytes())
+	return base64.StdEncoding.EncodeToString(mac.Sum(nil)), nil
+}
@@ -0,0 +1,416 @@
+// Copyright 2017, Timothy Bogdala <tdb@animal-machine.com>
+// See the LICENSE file for more details.
+
+package blobstore
+
+import (
+	"bytes"
+	"crypto/sha1"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/marcoziti/gringotts"
+)
+
+// B2 is a filefreezer.BlobStore that keeps blobs as files in a Backblaze B2
+// bucket using the native B2 API. It authorizes with an application key, which
+// may be restricted to the bucket. Blobs larger than the part size are uploaded
+// in parts with the large file API.
+type B2 struct {
+	// KeyID and Key are the application key ID and the application key
+	KeyID string
+	Key   string
+
+	// Bucket is the name of the bucket, which must already exist
+	Bucket string
+
+	// Endpoint is the URL accounts are authorized with; it defaults to
+	// https://api.backblazeb2.com
+	Endpoint string
+
+	// PartSize is the size of the parts of large files; it defaults to the part
+	// size recommended for the account. B2 requires parts of at least 5 MB
+	// other than the last one.
+	PartSize int64
+
+	// Client sends the requests; http.DefaultClient is used if it's nil
+	Client *http.Client
+
+	lock      sync.Mutex
+	auth      *b2Auth
+	bucketID  string
+	uploadURL *b2UploadURL
+}
+
+// b2Auth is the result of b2_authorize_account.
+type b2Auth struct {
+	AccountID           string `json:"accountId"`
+	AuthorizationToken  string `json:"authorizationToken"`
+	APIURL              string `json:"apiUrl"`
+	DownloadURL         string `json:"downloadUrl"`
+	RecommendedPartSize int64  `json:"recommendedPartSize"`
+	Allowed             struct {
+		BucketID   string `json:"bucketId"`
+		BucketName string `json:"bucketName"`
+	} `json:"allowed"`
+}
+
+// b2UploadURL is the result of b2_get_upload_url and b2_get_upload_part_url.
+type b2UploadURL struct {
+	UploadURL          string `json:"uploadUrl"`
+	AuthorizationToken string `json:"authorizationToken"`
+}
+
+func init() {
+	filefreezer.RegisterBlobStore("b2", openB2)
+}
+
+// openB2 opens a blob store URL of the form b2://bucket. The application key
+// is taken from the B2_APPLICATION_KEY_ID and B2_APPLICATION_KEY environment
+// variables and an endpoint query parameter overrides the default endpoint.
+func openB2(u *url.URL) (filefreezer.BlobStore, error) {
+	b := &B2{
+		KeyID:    os.Getenv("B2_APPLICATION_KEY_ID"),
+		Key:      os.Getenv("B2_APPLICATION_KEY"),
+		Bucket:   u.Host,
+		Endpoint: u.Query().Get("endpoint"),
+	}
+	if b.Bucket == "" {
+		return nil, fmt.Errorf("the blob store URL %s must name the bucket as b2://bucket", u)
+	}
+	if b.KeyID == "" || b.Key == "" {
+		return nil, fmt.Errorf("set B2_APPLICATION_KEY_ID and B2_APPLICATION_KEY to authorize access to the %s bucket", b.Bucket)
+	}
+	if partSize := u.Query().Get("partsize"); partSize != "" {
+		var err error
+		b.PartSize, err = strconv.ParseInt(partSize, 10, 64)
+		if err != nil {
+			return nil, fmt.Errorf("invalid part size in the blob store URL %s: %v", u, err)
+		}
+	}
+	return b, nil
+}
+
+// Put uploads the data as a file. B2 keeps a version for every upload of a
+// name and downloads the newest one, so replaced chunks stay stored until the
+// blob is deleted.
+func (b *B2) Put(key string, data []byte) error {
+	auth, _, err := b.session()
+	if err != nil {
+		return err
+	}
+	partSize := b.PartSize
+	if partSize <= 0 {
+		partSize = auth.RecommendedPartSize
+	}
+
+	if partSize > 0 && int64(len(data)) > partSize {
+		return b.putLarge(key, data, partSize)
+	}
+	return b.putSmall(key, data)
+}
+
+// putSmall uploads the data with a single request, getting a new upload URL
+// and trying again once if the cached one fails.
+func (b *B2) putSmall(key string, data []byte) error {
+	for attempt := 0; ; attempt++ {
+		upload, err := b.getUploadURL()
+		if err != nil {
+			return err
+		}
+
+		req, err := newB2Upload(upload, data)
+		if err != nil {
+			return err
+		}
+		req.Header.Set("X-Bz-File-Name", b2EscapeName(key))
+		req.Header.Set("Content-Type", "b2/x-auto")
+		_, err = send(b.Client, req)
+		if err == nil {
+			return nil
+		}
+
+		b.lock.Lock()
+		b.uploadURL = nil
+		b.lock.Unlock()
+		if attempt > 0 {
+			return err
+		}
+	}
+}
+
+// putLarge uploads the data in parts of partSize bytes, cancelling the large
+// file if a part fails.
+func (b *B2) putLarge(key string, data []byte, partSize int64) error {
+	_, bucketID, err := b.session()
+	if err != nil {
+		return err
+	}
+
+	var started struct {
+		FileID string `json:"fileId"`
+	}
+	err = b.call("b2_start_large_file", map[string]string{
+		"bucketId":    bucketID,
+		"fileName":    key,
+		"contentType": "b2/x-auto",
+	}, &started)
+	if err != nil {
+		return err
+	}
+
+	err = b.uploadParts(started.FileID, data, partSize)
+	if err != nil {
+		b.call("b2_cancel_large_file", map[string]string{"fileId": started.FileID}, nil)
+		return err
+	}
+	return nil
+}
+
+func (b *B2) uploadParts(fileID string, data []byte, partSize int64) error {
+	var upload b2UploadURL
+	err := b.call("b2_get_upload_part_url", map[string]string{"fileId": fileID}, &upload)
+	if err != nil {
+		return err
+	}
+
+	var partHashes []string
+	for start := int64(0); start < int64(len(data)); start += partSize {
+		end := start + partSize
+		if end > int64(len(data)) {
+			end = int64(len(data))
+		}
+		part := data[start:end]
+
+		req, err := newB2Upload(&upload, part)
+		if err != nil {
+			return err
+		}
+		req.Header.Set("X-Bz-Part-Number", strconv.Itoa(len(partHashes)+1))
+		_, err = send(b.Client, req)
+		if err != nil {
+			return err
+		}
+		partHashes = append(partHashes, req.Header.Get("X-Bz-Content-Sha1"))
+	}
+
+	return b.call("b2_finish_large_file", map[string]interface{}{
+		"fileId":        fileID,
+		"partSha1Array": partHashes,
+	}, nil)
+}
+
+// Get downloads the file by name.
+func (b *B2) Get(key string) ([]byte, error) {
+	for attempt := 0; ; attempt++ {
+		auth, _, err := b.session()
+		if err != nil {
+			return nil, err
+		}
+		req, err := http.NewRequest("GET", fmt.Sprintf("%s/file/%s/%s", auth.DownloadURL, b.Bucket, b2EscapeName(key)), nil)
+		if err != nil {
+			return nil, err
+		}
+		req.Header.Set("Authorization", auth.AuthorizationToken)
+		data, err := send(b.Client, req)
+		if attempt == 0 && b.expired(err) {
+			continue
+		}
+		return data, err
+	}
+}
+
+// Delete removes every version of the file.
+func (b *B2) Delete(key string) error {
+	_, bucketID, err := b.session()
+	if err != nil {
+		return err
+	}
+
+	var listed struct {
+		Files []struct {
+			FileID   string `json:"fileId"`
+			FileName string `json:"fileName"`
+		} `json:"files"`
+	}
+	err = b.call("b2_list_file_versions", map[string]interface{}{
+		"bucketId":      bucketID,
+		"startFileName": key,
+		"maxFileCount":  100,
+	}, &listed)
+	if err != nil {
+		return err
+	}
+
+	// the listing starts at the name and carries on to the following names
+	for _, f := range listed.Files {
+		if f.FileName != key {
+			break
+		}
+		err = b.call("b2_delete_file_version", map[string]string{
+			"fileName": f.FileName,
+			"fileId":   f.FileID,
+		}, nil)
+		if err != nil && err != errNotFound {
+			return err
+		}
+	}
+	return nil
+}
+
+// session returns the account authorization and the bucket ID, authorizing
+// the account if it hasn't been yet.
+func (b *B2) session() (*b2Auth, string, error) {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+	if b.auth != nil {
+		return b.auth, b.bucketID, nil
+	}
+
+	endpoint := b.Endpoint
+	if endpoint == "" {
+		endpoint = "https://api.backblazeb2.com"
+	}
+	req, err := http.NewRequest("GET", strings.TrimSuffix(endpoint, "/")+"/b2api/v2/b2_authorize_account", nil)
+	if err != nil {
+		return nil, "", err
+	}
+	req.SetBasicAuth(b.KeyID, b.Key)
+	body, err := send(b.Client, req)
+	if err != nil {
+		return nil, "", fmt.Errorf("failed to authorize the B2 application key: %v", err)
+	}
+	auth := new(b2Auth)
+	err = json.Unmarshal(body, auth)
+	if err != nil {
+		return nil, "", err
+	}
+
+	// keys restricted to the bucket already name it, others have to look it up
+	bucketID := ""
+	if auth.Allowed.BucketName == b.Bucket {
+		bucketID = auth.Allowed.BucketID
+	} else if auth.Allowed.BucketID != "" {
+		return nil, "", fmt.Errorf("the B2 application key is restricted to the %s bucket", auth.Allowed.BucketName)
+	} else {
+		var buckets struct {
+			Buckets []struct {
+				BucketID string `json:"bucketId"`
+			} `json:"buckets"`
+		}
+		err = b.post(auth, "b2_list_buckets", map[string]string{"accountId": auth.AccountID, "bucketName": b.Bucket}, &buckets)
+		if err != nil {
+			return nil, "", err
+		}
+		if len(buckets.Buckets) == 0 {
+			return nil, "", fmt.Errorf("the B2 bucket %s was not found", b.Bucket)
+		}
+		bucketID = buckets.Buckets[0].BucketID
+	}
+
+	b.auth = auth
+	b.bucketID = bucketID
+	return auth, bucketID, nil
+}
+
+// expired returns true if the error means the account authorization has
+// expired, in which case it's dropped so that the next session reauthorizes.
+func (b *B2) expired(err error) bool {
+	httpErr, ok := err.(*httpError)
+	if !ok || httpErr.StatusCode != http.StatusUnauthorized {
+		return false
+	}
+	b.lock.Lock()
+	b.auth = nil
+	b.uploadURL = nil
+	b.lock.Unlock()
+	return true
+}
+
+// call makes an API call with the session, reauthorizing and trying again
+// once if the authorization has expired.
+func (b *B2) call(name string, request interface{}, response interface{}) error {
+	for attempt := 0; ; attempt++ {
+		auth, _, err := b.session()
+		if err != nil {
+			return err
+		}
+		err = b.post(auth, name, request, response)
+		if attempt == 0 && b.expired(err) {
+			continue
+		}
+		return err
+	}
+}
+
+// post sends the request to the API call as JSON and decodes the response
+// into response if it isn't nil.
+func (b *B2) post(auth *b2Auth, name string, request interface{}, response interface{}) error {
+	reqJSON, err := json.Marshal(request)
+	if err != nil {
+		return err
+	}
+	req, err := http.NewRequest("POST", auth.APIURL+"/b2api/v2/"+name, bytes.NewReader(reqJSON))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Authorization", auth.AuthorizationToken)
+	body, err := send(b.Client, req)
+	if err != nil {
+		return err
+	}
+	if response == nil {
+		return nil
+	}
+	return json.Unmarshal(body, response)
+}
+
+// getUploadURL returns the cached upload URL or gets a new one.
+func (b *B2) getUploadURL() (*b2UploadURL, error) {
+	b.lock.Lock()
+	upload := b.uploadURL
+	b.lock.Unlock()
+	if upload != nil {
+		return upload, nil
+	}
+
+	_, bucketID, err := b.session()
+	if err != nil {
+		return nil, err
+	}
+	upload = new(b2UploadURL)
+	err = b.call("b2_get_upload_url", map[string]string{"bucketId": bucketID}, upload)
+	if err != nil {
+		return nil, err
+	}
+
+	b.lock.Lock()
+	b.uploadURL = upload
+	b.lock.Unlock()
+	return upload, nil
+}
+
+// newB2Upload builds an upload request for the data with its SHA1.
+func newB2Upload(upload *b2UploadURL, data []byte) (*http.Request, error) {
+	req, err := http.NewRequest("POST", upload.UploadURL, bytes.NewReader(data))
+	if err != nil {
+		return nil, err
+	}
+	hash := sha1.Sum(data)
+	req.ContentLength = int64(len(data))
+	req.Header.Set("Authorization", upload.AuthorizationToken)
+	req.Header.Set("X-Bz-Content-Sha1", hex.EncodeToString(hash[:]))
+	return req, nil
+}
+
+// b2EscapeName percent-encodes a file name for B2, which keeps the slashes.
+func b2EscapeName(name string) string {
+	return strings.Replace(url.PathEscape(name), "%2F", "/", -1)
+}
@@ -0,0 +1,57 @@
+// Copyright 2017, Timothy Bogdala <tdb@animal-machine.com>
+// See the LICENSE file for more details.
+
+// Package blobstore registers filefreezer.BlobStore drivers for cloud object
+// stores so that servers can keep chunk data in them. The drivers talk to the
+// REST APIs directly. Import it for its side effects:
+//
+//	import _ "github.com/marcoziti/gringotts/blobstore"
+package blobstore
+
+import (
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"strings"
+)
+
+// errNotFound is returned by send when the blob doesn't exist.
+var errNotFound = fmt.Errorf("the blob was not found")
+
+// httpError is returned by send for the other unsuccessful responses.
+type httpError struct {
+	StatusCode int
+	Message    string
+}
+
+func (e *httpError) Error() string {
+	return e.Message
+}
+
+// send sends the request and returns the response body, turning responses
+// other than 2xx into errors.
+func send(client *http.Client, req *http.Request) ([]byte, error) {
+	if client == nil {
+		client = http.DefaultClient
+	}
+	resp, err := client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	body, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode == http.StatusNotFound {
+		return nil, errNotFound
+	}
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return nil, &httpError{
+			StatusCode: resp.StatusCode,
+			Message:    fmt.Sprintf("%s %s failed with %s: %s", req.Method, req.URL.Path, resp.Status, strings.TrimSpace(string(body))),
+		}
+	}
+	return body, nil
+}
@@ -0,0 +1,263 @@
+// Copyright 2017, Timothy Bogdala <tdb@animal-machine.com>
+// See the LICENSE file for more details.
+
+package blobstore
+
+import (
+	"bytes"
+	"crypto"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha1"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"encoding/pem"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/marcoziti/gringotts"
+)
+
+// fakeObjects is a map of objects served by the fake cloud servers.
+type fakeObjects struct {
+	sync.Mutex
+	data map[string][]byte
+}
+
+func (f *fakeObjects) serve(w http.ResponseWriter, r *http.Request, name string) {
+	f.Lock()
+	defer f.Unlock()
+	switch r.Method {
+	case "PUT", "POST":
+		body, _ := ioutil.ReadAll(r.Body)
+		f.data[name] = body
+	case "GET":
+		body, found := f.data[name]
+		if !found {
+			http.NotFound(w, r)
+			return
+		}
+		w.Write(body)
+	case "DELETE":
+		if _, found := f.data[name]; !found {
+			http.NotFound(w, r)
+			return
+		}
+		delete(f.data, name)
+	}
+}
+
+// testBlobStore puts, gets and deletes a blob in the store.
+func testBlobStore(t *testing.T, store filefreezer.BlobStore) {
+	err := store.Put("chunks/1/2/3", []byte("chunk data"))
+	if err != nil {
+		t.Fatalf("Failed to put a blob: %v", err)
+	}
+	data, err := store.Get("chunks/1/2/3")
+	if err != nil || string(data) != "chunk data" {
+		t.Fatalf("Get didn't return the blob that was put (%q): %v", data, err)
+	}
+	if err = store.Delete("chunks/1/2/3"); err != nil {
+		t.Fatalf("Failed to delete the blob: %v", err)
+	}
+	if _, err = store.Get("chunks/1/2/3"); err == nil {
+		t.Fatal("Getting a deleted blob should fail.")
+	}
+	if err = store.Delete("chunks/1/2/3"); err != nil {
+		t.Fatalf("Deleting a missing blob shouldn't fail: %v", err)
+	}
+}
+
+func TestDir(t *testing.T) {
+	dir, err := ioutil.TempDir("", "blobstore")
+	if err != nil {
+		t.Fatalf("Failed to create a temporary directory: %v", err)
+	}
+	defer os.RemoveAll(dir)
+
+	store, err := filefreezer.OpenBlobStore("file://" + filepath.ToSlash(dir))
+	if err != nil {
+		t.Fatalf("Failed to open the directory blob store: %v", err)
+	}
+	testBlobStore(t, store)
+}
+
+func TestAzure(t *testing.T) {
+	objects := &fakeObjects{data: make(map[string][]byte)}
+	key := base64.StdEncoding.EncodeToString([]byte("account key"))
+	var store *Azure
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		// check the signature the same way the service does
+		signature, err := store.sign(r)
+		if err != nil || r.Header.Get("Authorization") != "SharedKey devstore:"+signature {
+			http.Error(w, "bad signature", http.StatusForbidden)
+			return
+		}
+		if r.Method == "PUT" && r.Header.Get("x-ms-blob-type") != "BlockBlob" {
+			http.Error(w, "missing blob type", http.StatusBadRequest)
+			return
+		}
+		objects.serve(w, r, strings.TrimPrefix(r.URL.Path, "/devstore/freezer/"))
+	}))
+	defer server.Close()
+
+	u := "azure://devstore/freezer?endpoint=" + server.URL + "/devstore"
+	_, err := filefreezer.OpenBlobStore(u)
+	if err == nil {
+		t.Fatal("Opening an Azure blob store without credentials should fail.")
+	}
+	store = &Azure{Account: "devstore", Container: "freezer", Endpoint: server.URL + "/devstore", Key: key}
+	testBlobStore(t, store)
+	if _, found := objects.data["chunks/1/2/3"]; found {
+		t.Fatal("The deleted blob is still stored.")
+	}
+}
+
+func TestGCS(t *testing.T) {
+	privateKey, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatalf("Failed to generate a key: %v", err)
+	}
+	der, err := x509.MarshalPKCS8PrivateKey(privateKey)
+	if err != nil {
+		t.Fatalf("Failed to encode the key: %v", err)
+	}
+
+	objects := &fakeObjects{data: make(map[string][]byte)}
+	tokenRequests := 0
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/token" {
+			// verify the signed assertion with the service account's public key
+			tokenRequests++
+			parts := strings.Split(r.FormValue("assertion"), ".")
+			if len(parts) != 3 {
+				http.Error(w, "bad assertion", http.StatusUnauthorized)
+				return
+			}
+			signature, _ := base64.RawURLEncoding.DecodeString(parts[2])
+			hashed := sha256.Sum256([]byte(parts[0] + "." + parts[1]))
+			if rsa.VerifyPKCS1v15(&privateKey.PublicKey, crypto.SHA256, hashed[:], signature) != nil {
+				http.Error(w, "bad assertion", http.StatusUnauthorized)
+				return
+			}
+			w.Write([]byte(`{"access_token":"token1","expires_in":3600}`))
+			return
+		}
+		if r.Header.Get("Authorization") != "Bearer token1" {
+			http.Error(w, "bad token", http.StatusUnauthorized)
+			return
+		}
+		if r.Method == "POST" {
+			objects.serve(w, r, r.URL.Query().Get("name"))
+			return
+		}
+		objects.serve(w, r, strings.TrimPrefix(r.URL.Path, "/storage/v1/b/freezer/o/"))
+	}))
+	defer server.Close()
+
+	store := &GCS{
+		Bucket:   "freezer",
+		Endpoint: server.URL,
+		ServiceAccount: &ServiceAccountKey{
+			ClientEmail: "freezer@example.iam.gserviceaccount.com",
+			PrivateKey:  string(pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: der})),
+			TokenURI:    server.URL + "/token",
+		},
+	}
+	testBlobStore(t, store)
+	if tokenRequests != 1 {
+		t.Fatalf("The access token should be cached; it was requested %d times.", tokenRequests)
+	}
+}
+
+func TestB2(t *testing.T) {
+	objects := &fakeObjects{data: make(map[string][]byte)}
+	var lock sync.Mutex
+	largeParts := make(map[string][]byte)
+	largeNames := make(map[string]string)
+	largeFinished := 0
+	var server *httptest.Server
+	server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		lock.Lock()
+		defer lock.Unlock()
+		if r.URL.Path == "/b2api/v2/b2_authorize_account" {
+			if user, pass, _ := r.BasicAuth(); user != "keyid" || pass != "appkey" {
+				http.Error(w, "bad key", http.StatusUnauthorized)
+				return
+			}
+			fmt.Fprintf(w, `{"accountId":"acct","authorizationToken":"auth1","apiUrl":"%s","downloadUrl":"%s","recommendedPartSize":100}`, server.URL, server.URL)
+			return
+		}
+		if r.Header.Get("Authorization") != "auth1" && r.Header.Get("Authorization") != "upload1" {
+			http.Error(w, "bad token", http.StatusUnauthorized)
+			return
+		}
+
+		var req map[string]interface{}
+		if strings.HasPrefix(r.URL.Path, "/b2api/") {
+			json.NewDecoder(r.Body).Decode(&req)
+		}
+		switch {
+		case r.URL.Path == "/b2api/v2/b2_list_buckets":
+			w.Write([]byte(`{"buckets":[{"bucketId":"bucket1"}]}`))
+		case r.URL.Path == "/b2api/v2/b2_get_upload_url":
+			fmt.Fprintf(w, `{"uploadUrl":"%s/upload","authorizationToken":"upload1"}`, server.URL)
+		case r.URL.Path == "/upload":
+			body, _ := ioutil.ReadAll(r.Body)
+			hash := sha1.Sum(body)
+			if r.Header.Get("X-Bz-Content-Sha1") != hex.EncodeToString(hash[:]) {
+				http.Error(w, "bad sha1", http.StatusBadRequest)
+				return
+			}
+			objects.data[r.Header.Get("X-Bz-File-Name")] = body
+		case r.URL.Path == "/b2api/v2/b2_start_large_file":
+			largeNames["large1"] = req["fileName"].(string)
+			w.Write([]byte(`{"fileId":"large1"}`))
+		case r.URL.Path == "/b2api/v2/b2_get_upload_part_url":
+			fmt.Fprintf(w, `{"uploadUrl":"%s/part","authorizationToken":"upload1"}`, server.URL)
+		case r.URL.Path == "/part":
+			body, _ := ioutil.ReadAll(r.Body)
+			largeParts["large1"] = append(largeParts["large1"], body...)
+		case r.URL.Path == "/b2api/v2/b2_finish_large_file":
+			largeFinished++
+			objects.data[largeNames["large1"]] = largeParts["large1"]
+		case r.URL.Path == "/b2api/v2/b2_list_file_versions":
+			name := req["startFileName"].(string)
+			if _, found := objects.data[name]; found {
+				fmt.Fprintf(w, `{"files":[{"fileId":"id1","fileName":"%s"}]}`, name)
+			} else {
+				w.Write([]byte(`{"files":[]}`))
+			}
+		case r.URL.Path == "/b2api/v2/b2_delete_file_version":
+			delete(objects.data, req["fileName"].(string))
+		case strings.HasPrefix(r.URL.Path, "/file/freezer/"):
+			objects.serve(w, r, strings.TrimPrefix(r.URL.Path, "/file/freezer/"))
+		default:
+			http.NotFound(w, r)
+		}
+	}))
+	defer server.Close()
+
+	store := &B2{KeyID: "keyid", Key: "appkey", Bucket: "freezer", Endpoint: server.URL}
+	testBlobStore(t, store)
+
+	// data over the recommended part size goes up as a large file
+	large := bytes.Repeat([]byte("0123456789"), 25)
+	if err := store.Put("chunks/4/5/6", large); err != nil {
+		t.Fatalf("Failed to put a large blob: %v", err)
+	}
+	data, err := store.Get("chunks/4/5/6")
+	if err != nil || !bytes.Equal(data, large) || largeFinished != 1 {
+		t.Fatalf("The large blob wasn't uploaded in parts (%d bytes): %v", len(data), err)
+	}
+}
@@ -0,0 +1,242 @@
+// Copyright 2017, Timothy Bogdala <tdb@animal-machine.com>
+// See the LICENSE file for more details.
+
+package blobstore
+
+import (
+	"bytes"
+	"crypto"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/pem"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/marcoziti/gringotts"
+)
+
+const (
+	// gcsScope is the OAuth2 scope requested for access tokens
+	gcsScope = "https://www.googleapis.com/auth/devstorage.read_write"
+
+	// gcsMetadataToken is where the default service account's access token is
+	// fetched from when running on Google Cloud
+	gcsMetadataToken = "http://metadata.google.internal/computeMetadata/v1/instance/service-accounts/default/token"
+)
+
+// GCS is a filefreezer.BlobStore that keeps blobs as objects in a Google Cloud
+// Storage bucket. Requests are authorized with OAuth2 access tokens for either
+// a service account key or, on Google Cloud, the instance's service account.
+type GCS struct {
+	// Bucket is the name of the bucket, which must already exist
+	Bucket string
+
+	// Endpoint is the URL of the JSON API; it defaults to
+	// https://storage.googleapis.com and can be pointed at an emulator
+	Endpoint string
+
+	// ServiceAccount is the key of the service account to authorize as; the
+	// metadata server is asked for tokens if it's nil
+	ServiceAccount *ServiceAccountKey
+
+	// Client sends the requests; http.DefaultClient is used if it's nil
+	Client *http.Client
+
+	tokenLock   sync.Mutex
+	token       string
+	tokenExpiry time.Time
+}
+
+// ServiceAccountKey holds the fields used from a service account's JSON key file.
+type ServiceAccountKey struct {
+	ClientEmail string `json:"client_email"`
+	PrivateKey  string `json:"private_key"`
+	TokenURI    string `json:"token_uri"`
+}
+
+func init() {
+	filefreezer.RegisterBlobStore("gs", openGCS)
+}
+
+// openGCS opens a blob store URL of the form gs://bucket. The service account
+// key is read from the file named by GOOGLE_APPLICATION_CREDENTIALS if it's set
+// and an endpoint query parameter overrides the default endpoint.
+func openGCS(u *url.URL) (filefreezer.BlobStore, error) {
+	g := &GCS{
+		Bucket:   u.Host,
+		Endpoint: u.Query().Get("endpoint"),
+	}
+	if g.Bucket == "" {
+		return nil, fmt.Errorf("the blob store URL %s must name the bucket as gs://bucket", u)
+	}
+
+	keyFile := os.Getenv("GOOGLE_APPLICATION_CREDENTIALS")
+	if keyFile != "" {
+		keyJSON, err := ioutil.ReadFile(keyFile)
+		if err != nil {
+			return nil, fmt.Errorf("failed to read the service account key: %v", err)
+		}
+		g.ServiceAccount = new(ServiceAccountKey)
+		err = json.Unmarshal(keyJSON, g.ServiceAccount)
+		if err != nil {
+			return nil, fmt.Errorf("failed to parse the service account key %s: %v", keyFile, err)
+		}
+	}
+	return g, nil
+}
+
+// Put uploads the data as an object.
+func (g *GCS) Put(key string, data []byte) error {
+	target := fmt.Sprintf("%s/upload/storage/v1/b/%s/o?uploadType=media&name=%s",
+		g.endpoint(), g.Bucket, url.QueryEscape(key))
+	req, err := http.NewRequest("POST", target, bytes.NewReader(data))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/octet-stream")
+	_, err = g.do(req)
+	return err
+}
+
+// Get downloads the object.
+func (g *GCS) Get(key string) ([]byte, error) {
+	req, err := http.NewRequest("GET", g.objectURL(key)+"?alt=media", nil)
+	if err != nil {
+		return nil, err
+	}
+	return g.do(req)
+}
+
+// Delete removes the object, if it exists.
+func (g *GCS) Delete(key string) error {
+	req, err := http.NewRequest("DELETE", g.objectURL(key), nil)
+	if err != nil {
+		return err
+	}
+	_, err = g.do(req)
+	if err == errNotFound {
+		return nil
+	}
+	return err
+}
+
+func (g *GCS) endpoint() string {
+	if g.Endpoint == "" {
+		return "https://storage.googleapis.com"
+	}
+	return strings.TrimSuffix(g.Endpoint, "/")
+}
+
+// objectURL returns the JSON API URL of the object, whose name has to be
+// escaped as a single path segment.
+func (g *GCS) objectURL(key string) string {
+	return fmt.Sprintf("%s/storage/v1/b/%s/o/%s", g.endpoint(), g.Bucket, url.PathEscape(key))
+}
+
+// do authorizes the request with an access token and sends it.
+func (g *GCS) do(req *http.Request) ([]byte, error) {
+	token, err := g.accessToken()
+	if err != nil {
+		return nil, fmt.Errorf("failed to get an access token for Google Cloud Storage: %v", err)
+	}
+	req.Header.Set("Authorization", "Bearer "+token)
+	return send(g.Client, req)
+}
+
+// accessToken returns the cached access token, getting a new one when it's
+// about to expire.
+func (g *GCS) accessToken() (string, error) {
+	g.tokenLock.Lock()
+	defer g.tokenLock.Unlock()
+	if g.token != "" && time.Now().Add(time.Minute).Before(g.tokenExpiry) {
+		return g.token, nil
+	}
+
+	var req *http.Request
+	var err error
+	if g.ServiceAccount != nil {
+		req, err = g.ServiceAccount.tokenRequest(time.Now())
+	} else {
+		req, err = http.NewRequest("GET", gcsMetadataToken, nil)
+		if req != nil {
+			req.Header.Set("Metadata-Flavor", "Google")
+		}
+	}
+	if err != nil {
+		return "", err
+	}
+
+	body, err := send(g.Client, req)
+	if err != nil {
+		return "", err
+	}
+	var tokenResp struct {
+		AccessToken string `json:"access_token"`
+		ExpiresIn   int    `json:"expires_in"`
+	}
+	err = json.Unmarshal(body, &tokenResp)
+	if err != nil {
+		return "", err
+	}
+
+	g.token = tokenResp.AccessToken
+	g.tokenExpiry = time.Now().Add(time.Duration(tokenResp.ExpiresIn) * time.Second)
+	return g.token, nil
+}
+
+// tokenRequest builds the OAuth2 request that exchanges a JWT signed with the
+// service account's key for an access token.
+func (k *ServiceAccountKey) tokenRequest(now time.Time) (*http.Request, error) {
+	block, _ := pem.Decode([]byte(k.PrivateKey))
+	if block == nil {
+		return nil, fmt.Errorf("the service account key has no PEM encoded private key")
+	}
+	parsed, err := x509.ParsePKCS8PrivateKey(block.Bytes)
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse the service account's private key: %v", err)
+	}
+	key, ok := parsed.(*rsa.PrivateKey)
+	if !ok {
+		return nil, fmt.Errorf("the service account's private key isn't an RSA key")
+	}
+
+	tokenURI := k.TokenURI
+	if tokenURI == "" {
+		tokenURI = "https://oauth2.googleapis.com/token"
+	}
+	header, _ := json.Marshal(map[string]string{"alg": "RS256", "typ": "JWT"})
+	claims, _ := json.Marshal(map[string]interface{}{
+		"iss":   k.ClientEmail,
+		"scope": gcsScope,
+		"aud":   tokenURI,
+		"iat":   now.Unix(),
+		"exp":   now.Add(time.Hour).Unix(),
+	})
+	unsigned := base64.RawURLEncoding.EncodeToString(header) + "." + base64.RawURLEncoding.EncodeToString(claims)
+	hashed := sha256.Sum256([]byte(unsigned))
+	signature, err := rsa.SignPKCS1v15(rand.Reader, key, crypto.SHA256, hashed[:])
+	if err != nil {
+		return nil, fmt.Errorf("failed to sign the access token request: %v", err)
+	}
+	assertion := unsigned + "." + base64.RawURLEncoding.EncodeToString(signature)
+
+	form := url.Values{}
+	form.Set("grant_type", "urn:ietf:params:oauth:grant-type:jwt-bearer")
+	form.Set("assertion", assertion)
+	req, err := http.NewRequest("POST", tokenURI, strings.NewReader(form.Encode()))
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	return req, nil
+}
@@ -0,0 +1,347 @@
+// Copyright 2017, Timothy Bogdala <tdb@animal-machine.com>
+// See the LICENSE file for more details.
+
+package filefreezer
+
+import (
+	"crypto/sha256"
+	"database/sql"
+	"encoding/hex"
+	"fmt"
+)
+
+const (
+	getCheckCounts        = `SELECT (SELECT COUNT(*) FROM FileInfo), (SELECT COUNT(*) FROM FileVersion), (SELECT COUNT(*) FROM FileChunks);`
+	getOrphanVersions     = `SELECT VersionID, FileID FROM FileVersion WHERE FileID NOT IN (SELECT FileID FROM FileInfo);`
+	removeFileVersionByID = `DELETE FROM FileVersion WHERE VersionID = ?;`
+	getMissingVersions    = `SELECT FileID, UserID, CurrentVersionID, (SELECT MAX(VersionID) FROM FileVersion WHERE FileVersion.FileID = FileInfo.FileID) FROM FileInfo
+					WHERE CurrentVersionID NOT IN (SELECT VersionID FROM FileVersion WHERE FileVersion.FileID = FileInfo.FileID);`
+	getOrphanChunks = `SELECT FileChunks.FileID, FileChunks.VersionID, ChunkNum FROM FileChunks
+					LEFT JOIN FileVersion ON FileChunks.VersionID = FileVersion.VersionID AND FileChunks.FileID = FileVersion.FileID
+					LEFT JOIN FileInfo ON FileChunks.FileID = FileInfo.FileID
+					WHERE FileVersion.VersionID IS NULL OR FileInfo.FileID IS NULL;`
+	getOutOfRangeChunks = `SELECT FileChunks.FileID, FileChunks.VersionID, ChunkNum FROM FileChunks
+					INNER JOIN FileVersion ON FileChunks.VersionID = FileVersion.VersionID AND FileChunks.FileID = FileVersion.FileID
+					WHERE ChunkNum < 0 OR ChunkNum >= FileVersion.ChunkCount;`
+	getCheckChunkData = `SELECT FileInfo.UserID, FileChunks.FileID, VersionID, ChunkNum, ChunkLength, DataHash, Chunk FROM FileChunks
+					INNER JOIN FileInfo ON FileChunks.FileID = FileInfo.FileID ORDER BY FileChunks.FileID, VersionID, ChunkNum;`
+	setFileChunkDataHash = `UPDATE FileChunks SET DataHash = ? WHERE FileID = ? AND VersionID = ? AND ChunkNum = ?;`
+	getAllocationDrift   = `SELECT UserID, Allocated, Expected FROM (
+						SELECT UserStats.UserID, Allocated,
+							(SELECT COALESCE(SUM(ChunkLength), 0) FROM FileChunks INNER JOIN FileInfo ON FileChunks.FileID = FileInfo.FileID WHERE FileInfo.UserID = UserStats.UserID) +
+							(SELECT COALESCE(SUM(LENGTH(Chunk)), 0) FROM ShareChunks INNER JOIN Shares ON ShareChunks.ShareID = Shares.ShareID WHERE Shares.UserID = UserStats.UserID) +
+							(SELECT COALESCE(SUM(LENGTH(Data)), 0) FROM DropFiles WHERE DropFiles.UserID = UserStats.UserID) AS Expected
+						FROM UserStats
+					) WHERE Allocated <> Expected;`
+	setUserAllocated = `UPDATE UserStats SET Allocated = ?, Revision = Revision + 1 WHERE UserID = ?;`
+)
+
+// The kinds of problems that Storage.Check can find.
+const (
+	CheckOrphanVersion   = "orphan version"
+	CheckMissingVersion  = "missing current version"
+	CheckOrphanChunk     = "orphan chunk"
+	CheckChunkOutOfRange = "chunk out of range"
+	CheckMissingData     = "missing chunk data"
+	CheckCorruptData     = "corrupt chunk data"
+	CheckAllocation      = "allocation drift"
+)
+
+// CheckOptions changes what Storage.Check does.
+type CheckOptions struct {
+	// Repair fixes the problems found: orphaned rows and chunks whose data is
+	// missing or corrupt are removed, so that clients upload them again, and
+	// allocation counts are recounted. Chunks without a data hash get one.
+	Repair bool
+
+	// SkipData leaves out reading the data of every chunk, which only leaves
+	// the checks of the metadata.
+	SkipData bool
+}
+
+// CheckProblem is an inconsistency found by Storage.Check. The IDs that don't
+// apply to its Kind are zero.
+type CheckProblem struct {
+	Kind        string
+	UserID      int
+	FileID      int
+	VersionID   int
+	ChunkNumber int
+	Detail      string
+
+	// Repaired is set when the problem was fixed.
+	Repaired bool
+}
+
+// CheckReport is the result of Storage.Check.
+type CheckReport struct {
+	// Files, Versions and Chunks are the number of rows checked
+	Files    int
+	Versions int
+	Chunks   int
+
+	// HashesAdded is the number of chunks given a data hash by a repair
+	HashesAdded int
+
+	Problems []CheckProblem
+}
+
+// chunkDataHash returns the hash of a chunk's stored data, which unlike the
+// ChunkHash from clients covers the encrypted bytes that the server keeps.
+func chunkDataHash(data []byte) string {
+	sum := sha256.Sum256(data)
+	return hex.EncodeToString(sum[:])
+}
+
+// Check cross-checks the files, versions and chunks in the database and, unless
+// SkipData is set, the presence, length and hash of the data of every chunk in
+// the database or BlobStore. The problems found are returned in the report and
+// fixed if Repair is set. It should be run while the server is stopped.
+func (s *Storage) Check(opts CheckOptions) (*CheckReport, error) {
+	report := new(CheckReport)
+	err := s.db.QueryRow(getCheckCounts).Scan(&report.Files, &report.Versions, &report.Chunks)
+	if err != nil {
+		return nil, fmt.Errorf("failed to count the rows to check: %v", err)
+	}
+
+	// each step repairs what it finds before the next so that, for example,
+	// the chunks of an orphaned version are then found as orphans themselves
+	steps := []func(*CheckReport, CheckOptions) error{
+		s.checkVersions,
+		s.checkChunks,
+	}
+	if !opts.SkipData {
+		steps = append(steps, s.checkChunkData)
+	}
+	steps = append(steps, s.checkAllocations)
+	for _, step := range steps {
+		err = step(report, opts)
+		if err != nil {
+			return report, err
+		}
+	}
+
+	return report, nil
+}
+
+// checkVersions finds versions of files that don't exist and files whose
+// current version doesn't exist. A file whose current version is missing is
+// repaired by making its newest remaining version current, or removed if it
+// has none.
+func (s *Storage) checkVersions(report *CheckReport, opts CheckOptions) error {
+	var problems []CheckProblem
+	rows, err := s.db.Query(getOrphanVersions)
+	if err != nil {
+		return fmt.Errorf("failed to get the orphaned file versions: %v", err)
+	}
+	for rows.Next() {
+		p := CheckProblem{Kind: CheckOrphanVersion}
+		err = rows.Scan(&p.VersionID, &p.FileID)
+		if err != nil {
+			rows.Close()
+			return fmt.Errorf("failed to scan the next row while processing orphaned file versions: %v", err)
+		}
+		p.Detail = "the version's file doesn't exist"
+		problems = append(problems, p)
+	}
+	rows.Close()
+	if opts.Repair {
+		for i := range problems {
+			_, err = s.db.Exec(removeFileVersionByID, problems[i].VersionID)
+			problems[i].Repaired = err == nil
+		}
+	}
+	report.Problems = append(report.Problems, problems...)
+
+	problems = nil
+	var latest []sql.NullInt64
+	rows, err = s.db.Query(getMissingVersions)
+	if err != nil {
+		return fmt.Errorf("failed to get the files missing their current version: %v", err)
+	}
+	for rows.Next() {
+		p := CheckProblem{Kind: CheckMissingVersion}
+		var newest sql.NullInt64
+		err = rows.Scan(&p.FileID, &p.UserID, &p.VersionID, &newest)
+		if err != nil {
+			rows.Close()
+			return fmt.Errorf("failed to scan the next row while processing files missing their current version: %v", err)
+		}
+		p.Detail = "the file's current version doesn't exist"
+		problems = append(problems, p)
+		latest = append(latest, newest)
+	}
+	rows.Close()
+	if opts.Repair {
+		for i := range problems {
+			if latest[i].Valid {
+				_, err = s.db.Exec(setFileCurrentVersion, latest[i].Int64, problems[i].FileID)
+			} else {
+				_, err = s.db.Exec(removeFileInfoByID, problems[i].FileID)
+			}
+			if err == nil {
+				_, err = s.db.Exec(bumpUserRevision, problems[i].UserID)
+			}
+			problems[i].Repaired = err == nil
+		}
+	}
+	report.Problems = append(report.Problems, problems...)
+	return nil
+}
+
+// checkChunks finds chunks whose file or version doesn't exist and chunks
+// numbered beyond the chunk count of their version.
+func (s *Storage) checkChunks(report *CheckReport, opts CheckOptions) error {
+	for _, check := range []struct {
+		kind   string
+		query  string
+		detail string
+	}{
+		{CheckOrphanChunk, getOrphanChunks, "the chunk's file or version doesn't exist"},
+		{CheckChunkOutOfRange, getOutOfRangeChunks, "the chunk is beyond the version's chunk count"},
+	} {
+		var problems []CheckProblem
+		rows, err := s.db.Query(check.query)
+		if err != nil {
+			return fmt.Errorf("failed to get the chunks to check: %v", err)
+		}
+		for rows.Next() {
+			p := CheckProblem{Kind: check.kind, Detail: check.detail}
+			err = rows.Scan(&p.FileID, &p.VersionID, &p.ChunkNumber)
+			if err != nil {
+				rows.Close()
+				return fmt.Errorf("failed to scan the next row while processing chunks to check: %v", err)
+			}
+			problems = append(problems, p)
+		}
+		rows.Close()
+
+		if opts.Repair {
+			var blobKeys []string
+			for i, p := range problems {
+				_, err = s.db.Exec(removeFileChunk, p.FileID, p.VersionID, p.ChunkNumber)
+				problems[i].Repaired = err == nil
+				if err == nil {
+					blobKeys = append(blobKeys, chunkBlobKey(p.FileID, p.VersionID, p.ChunkNumber))
+				}
+			}
+			s.removeChunkBlobs(blobKeys)
+		}
+		report.Problems = append(report.Problems, problems...)
+	}
+	return nil
+}
+
+// checkChunkData reads the data of every chunk, from the BlobStore if it's not
+// in the database, and compares its length and hash with the ones recorded.
+// Chunks whose data is missing or corrupt are removed by a repair so that
+// clients upload them again on their next sync.
+func (s *Storage) checkChunkData(report *CheckReport, opts CheckOptions) error {
+	type unhashed struct {
+		fileID, versionID, chunkNumber int
+		hash                           string
+	}
+	var problems []CheckProblem
+	var missingHashes []unhashed
+
+	rows, err := s.db.Query(getCheckChunkData)
+	if err != nil {
+		return fmt.Errorf("failed to get the chunks to check: %v", err)
+	}
+	for rows.Next() {
+		var p CheckProblem
+		var length int64
+		var dataHash string
+		var data []byte
+		err = rows.Scan(&p.UserID, &p.FileID, &p.VersionID, &p.ChunkNumber, &length, &dataHash, &data)
+		if err != nil {
+			rows.Close()
+			return fmt.Errorf("failed to scan the next row while processing the chunk data: %v", err)
+		}
+
+		// as in GetFileChunk, chunks stored before the BlobStore was set up
+		// are still in the database
+		if len(data) == 0 && length > 0 {
+			if s.Blobs == nil {
+				p.Kind = CheckMissingData
+				p.Detail = "the chunk has no data in the database and no chunk store was given"
+				problems = append(problems, p)
+				continue
+			}
+			data, err = s.Blobs.Get(chunkBlobKey(p.FileID, p.VersionID, p.ChunkNumber))
+			if err != nil {
+				p.Kind = CheckMissingData
+				p.Detail = fmt.Sprintf("the chunk store doesn't have the chunk's data: %v", err)
+				problems = append(problems, p)
+				continue
+			}
+		}
+
+		hash := chunkDataHash(data)
+		switch {
+		case int64(len(data)) != length:
+			p.Kind = CheckCorruptData
+			p.Detail = fmt.Sprintf("the chunk's data is %d bytes but should be %d", len(data), length)
+			problems = append(problems, p)
+		case dataHash != "" && dataHash != hash:
+			p.Kind = CheckCorruptData
+			p.Detail = "the chunk's data doesn't match its hash"
+			problems = append(problems, p)
+		case dataHash == "":
+			missingHashes = append(missingHashes, unhashed{p.FileID, p.VersionID, p.ChunkNumber, hash})
+		}
+	}
+	rows.Close()
+	if err = rows.Err(); err != nil {
+		return err
+	}
+
+	if opts.Repair {
+		for i, p := range problems {
+			removed, err := s.RemoveFileChunk(p.UserID, p.FileID, p.VersionID, p.ChunkNumber)
+			problems[i].Repaired = removed && err == nil
+		}
+		for _, c := range missingHashes {
+			_, err = s.db.Exec(setFileChunkDataHash, c.hash, c.fileID, c.versionID, c.chunkNumber)
+			if err != nil {
+				return fmt.Errorf("failed to set the data hash of a chunk: %v", err)
+			}
+			report.HashesAdded++
+		}
+	}
+	report.Problems = append(report.Problems, problems...)
+	return nil
+}
+
+// checkAllocations compares the allocation count of each user with the bytes
+// of their chunks, shares and drop files, and recounts it if repairing.
+func (s *Storage) checkAllocations(report *CheckReport, opts CheckOptions) error {
+	var problems []CheckProblem
+	var expected []int64
+	rows, err := s.db.Query(getAllocationDrift)
+	if err != nil {
+		return fmt.Errorf("failed to get the user allocations: %v", err)
+	}
+	for rows.Next() {
+		p := CheckProblem{Kind: CheckAllocation}
+		var allocated, want int64
+		err = rows.Scan(&p.UserID, &allocated, &want)
+		if err != nil {
+			rows.Close()
+			return fmt.Errorf("failed to scan the next row while processing the user allocations: %v", err)
+		}
+		p.Detail = fmt.Sprintf("the user has %d bytes allocated but stores %d", allocated, want)
+		problems = append(problems, p)
+		expected = append(expected, want)
+	}
+	rows.Close()
+
+	if opts.Repair {
+		for i := range problems {
+			_, err = s.db.Exec(setUserAllocated, expected[i], problems[i].UserID)
+			problems[i].Repaired = err == nil
+		}
+	}
+	report.Problems = append(report.Problems, problems...)
+	return nil
+}
@@ -0,0 +1,74 @@
+// Copyright 2017, Timothy Bogdala <tdb@animal-machine.com>
+// See the LICENSE file for more details.
+
+package command
+
+import (
+	"encoding/json"
+	"fmt"
+
+	"github.com/marcoziti/gringotts/cmd/freezer/models"
+)
+
+// ExportAccount gets all of the authenticated user's metadata from the server
+// and writes it as JSON to outPath. File names and data stay encrypted in the
+// export; each chunk is listed with the API path its data can be downloaded from.
+func (s *State) ExportAccount(outPath string) (*models.AccountExportResponse, error) {
+	target := fmt.Sprintf("%s/api/users/self/export", s.HostURI)
+	body, err := s.RunAuthRequest(target, "GET", s.AuthToken, nil)
+	if err != nil {
+		return nil, fmt.Errorf("Failed to export the account: %v", err)
+	}
+
+	var export models.AccountExportResponse
+	err = json.Unmarshal(body, &export)
+	if err != nil {
+		return nil, fmt.Errorf("Failed to read the account export: %v", err)
+	}
+
+	data, err := json.MarshalIndent(&export, "", "  ")
+	if err != nil {
+		return nil, err
+	}
+	err = writeFileAtomic(outPath, data)
+	if err != nil {
+		return nil, fmt.Errorf("Failed to write the account export to %s: %v", outPath, err)
+	}
+
+	return &export, nil
+}
+
+// DeleteAccount asks the server to erase the authenticated user's account.
+// Without a confirmation token the response has the token to confirm with;
+// confirming schedules the erasure for the end of the server's grace period,
+// which the response's DeleteAt has.
+func (s *State) DeleteAccount(confirm string) (*models.AccountDeleteResponse, error) {
+	var req models.AccountDeleteRequest
+	req.Confirm = confirm
+	target := fmt.Sprintf("%s/api/users/self/delete", s.HostURI)
+	body, err := s.RunAuthRequest(target, "POST", s.AuthToken, req)
+	if err != nil {
+		return nil, fmt.Errorf("Failed to request the account deletion: %v", err)
+	}
+
+	var resp models.AccountDeleteResponse
+	err = json.Unmarshal(body, &resp)
+	if err != nil {
+		return nil, fmt.Errorf("Failed to read the response for the account deletion: %v", err)
+	}
+
+	return &resp, nil
+}
+
+// CancelAccountDeletion cancels the authenticated user's request to erase their
+// account before the server's grace period ends.
+func (s *State) CancelAccountDeletion() error {
+	target := fmt.Sprintf("%s/api/users/self/delete", s.HostURI)
+	_, err := s.RunAuthRequest(target, "DELETE", s.AuthToken, nil)
+	if err != nil {
+		return fmt.Errorf("Failed to cancel the account deletion: %v", err)
+	}
+
+	s.Println("Account deletion cancelled")
+	return nil
+}
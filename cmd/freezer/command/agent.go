@@ -0,0 +1,397 @@
+// Copyright 2017, Timothy Bogdala <tdb@animal-machine.com>
+// See the LICENSE file for more details.
+
+package command
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+)
+
+// AgentPath is a local directory that an Agent keeps in sync with a remote directory.
+type AgentPath struct {
+	LocalDir  string
+	RemoteDir string
+}
+
+// AgentStatus is a snapshot of what an Agent is doing and how its last sync went.
+type AgentStatus struct {
+	// Syncing is true while a sync pass is in progress
+	Syncing bool
+
+	// Paused is true while scheduled sync passes are being skipped
+	Paused bool
+
+	// SyncCount is the number of sync passes that have completed
+	SyncCount int
+
+	// LastSyncStart and LastSyncEnd are the times the last completed pass
+	// started and finished; they are zero before the first pass completes.
+	LastSyncStart time.Time
+	LastSyncEnd   time.Time
+
+	// LastChangeCount is the number of chunks transferred in the last pass
+	LastChangeCount int
+
+	// LastError is the error from the last pass or empty if it succeeded
+	LastError string
+
+	// QueueDepth is the number of paths still waiting to be synced in the
+	// pass that is in progress
+	QueueDepth int
+
+	// PendingConflicts is the number of files the last pass found to differ
+	// from the server in a way it couldn't reconcile
+	PendingConflicts int64
+
+	// DeferredUploads is the number of uploads the last pass put off
+	// because the connection was metered or the battery was low
+	DeferredUploads int64
+
+	// LowBattery is true if the computer was on a low battery when the
+	// power was last checked
+	LowBattery bool
+
+	// UploadRate and DownloadRate are the bytes per second transferred
+	// during the last pass
+	UploadRate   float64
+	DownloadRate float64
+
+	// Totals are the counts of everything transferred since the agent started
+	Totals SyncCounts
+
+	// Recent are the last few completed sync passes, newest first
+	Recent []AgentPass
+
+	// Interval is the time between the start of each sync pass
+	Interval string
+
+	// Paths are the directories being kept in sync
+	Paths []AgentPath
+
+	// Healthy is only set in the status served over HTTP and reports
+	// the same result as the /healthz probe
+	Healthy bool
+}
+
+// AgentPass is the outcome of one of the agent's sync passes.
+type AgentPass struct {
+	Start       time.Time
+	End         time.Time
+	ChangeCount int
+	Error       string
+}
+
+// agentRecentPasses is the number of sync passes kept in AgentStatus.Recent.
+const agentRecentPasses = 10
+
+// Agent periodically syncs a set of local directories with the server and
+// reports its status over HTTP. It is meant to run unattended, such as in a
+// sidecar container watching mounted volumes, so it logs in again as needed
+// using the credentials it was created with.
+type Agent struct {
+	// Paths are the directories to keep in sync
+	Paths []AgentPath
+
+	// Interval is the time between the start of each sync pass
+	Interval time.Duration
+
+	// Notify is an optional function, such as DesktopNotify, that's called
+	// when a sync pass finishes with changes, conflicts or an error and with
+	// the State's Notices, like quota warnings, which it then takes over from
+	// being printed
+	Notify func(title string, message string)
+
+	bridge     *Bridge
+	syncNow    chan struct{}
+	statusLock sync.Mutex
+	status     AgentStatus
+}
+
+// NewAgent creates a new agent for the State, which must already be authenticated
+// with the server and have its CryptoKey set.
+func NewAgent(s *State, username string, password string, paths []AgentPath, interval time.Duration) *Agent {
+	a := new(Agent)
+	a.Paths = paths
+	a.Interval = interval
+	a.bridge = NewBridge(s, username, password)
+	a.syncNow = make(chan struct{}, 1)
+	a.status.Interval = interval.String()
+	a.status.Paths = paths
+	return a
+}
+
+// Run syncs all of the paths immediately and then again every interval until
+// stop is closed. Scheduled passes are skipped while the agent is paused, but
+// a pass requested with SyncNow always runs. If the last pass deferred uploads
+// because the battery was low, another runs as soon as the computer is back
+// on AC power.
+func (a *Agent) Run(stop <-chan struct{}) {
+	ticker := time.NewTicker(a.Interval)
+	defer ticker.Stop()
+	powerTicker := time.NewTicker(powerCheckInterval)
+	defer powerTicker.Stop()
+
+	forced := false
+	for {
+		if forced || !a.Status().Paused {
+			a.syncAll()
+		}
+		forced = false
+
+		for waiting := true; waiting; {
+			select {
+			case <-stop:
+				return
+			case <-ticker.C:
+				waiting = false
+			case <-a.syncNow:
+				forced, waiting = true, false
+			case <-powerTicker.C:
+				status := a.Status()
+				waiting = !status.LowBattery || status.DeferredUploads == 0 || a.checkLowBattery()
+			}
+		}
+	}
+}
+
+// checkLowBattery returns true if the computer is on a low battery and
+// records it in the status.
+func (a *Agent) checkLowBattery() bool {
+	a.bridge.lock.Lock()
+	low := a.bridge.state.isLowBattery()
+	a.bridge.lock.Unlock()
+
+	a.statusLock.Lock()
+	a.status.LowBattery = low
+	a.statusLock.Unlock()
+	return low
+}
+
+// Pause stops the scheduled sync passes until Resume is called. A pass that
+// is already in progress runs to completion.
+func (a *Agent) Pause() {
+	a.statusLock.Lock()
+	a.status.Paused = true
+	a.statusLock.Unlock()
+}
+
+// Resume restarts the scheduled sync passes after Pause.
+func (a *Agent) Resume() {
+	a.statusLock.Lock()
+	a.status.Paused = false
+	a.statusLock.Unlock()
+}
+
+// SyncNow starts a sync pass as soon as the current one, if any, finishes,
+// even if the agent is paused.
+func (a *Agent) SyncNow() {
+	select {
+	case a.syncNow <- struct{}{}:
+	default:
+		// a pass is already waiting to run
+	}
+}
+
+// syncAll runs a single sync pass over all of the paths and updates the status.
+func (a *Agent) syncAll() {
+	a.statusLock.Lock()
+	a.status.Syncing = true
+	a.status.QueueDepth = len(a.Paths)
+	a.statusLock.Unlock()
+
+	stats := &a.bridge.state.Stats
+	before := stats.Counts()
+	start := time.Now()
+	changeCount, err := a.syncPaths()
+	after := stats.Counts()
+	a.checkLowBattery()
+
+	a.statusLock.Lock()
+	a.status.Syncing = false
+	a.status.QueueDepth = 0
+	a.status.PendingConflicts = after.Conflicts - before.Conflicts
+	a.status.DeferredUploads = after.Deferred - before.Deferred
+	a.status.Totals = after
+	elapsed := time.Since(start).Seconds()
+	if elapsed > 0 {
+		a.status.UploadRate = float64(after.BytesUploaded-before.BytesUploaded) / elapsed
+		a.status.DownloadRate = float64(after.BytesDownloaded-before.BytesDownloaded) / elapsed
+	}
+	a.status.SyncCount++
+	a.status.LastSyncStart = start
+	a.status.LastSyncEnd = time.Now()
+	a.status.LastChangeCount = changeCount
+	a.status.LastError = ""
+	if err != nil {
+		a.status.LastError = err.Error()
+		a.bridge.state.Printf("Agent sync failed: %v\n", err)
+	}
+	pass := AgentPass{Start: start, End: a.status.LastSyncEnd, ChangeCount: changeCount, Error: a.status.LastError}
+	a.status.Recent = append([]AgentPass{pass}, a.status.Recent...)
+	if len(a.status.Recent) > agentRecentPasses {
+		a.status.Recent = a.status.Recent[:agentRecentPasses]
+	}
+	status := a.status
+	a.statusLock.Unlock()
+	a.notifyPass(status, err)
+}
+
+// notifyPass calls Notify with how the sync pass that set status went and
+// with any notices the State sent while it ran.
+func (a *Agent) notifyPass(status AgentStatus, err error) {
+	if a.Notify == nil {
+		return
+	}
+
+	switch {
+	case err != nil:
+		a.Notify("Sync failed", err.Error())
+	case status.PendingConflicts > 0:
+		a.Notify("Sync conflicts", fmt.Sprintf("%d files changed both here and on the server and need to be checked.", status.PendingConflicts))
+	case status.LastChangeCount > 0:
+		a.Notify("Sync complete", fmt.Sprintf("%d chunks were transferred.", status.LastChangeCount))
+	}
+
+	for notices := a.bridge.state.Notices; notices != nil; {
+		select {
+		case notice := <-notices:
+			a.Notify("Filefreezer", notice)
+		default:
+			notices = nil
+		}
+	}
+}
+
+// syncPaths syncs each of the paths with the server.
+func (a *Agent) syncPaths() (changeCount int, e error) {
+	a.bridge.lock.Lock()
+	defer a.bridge.lock.Unlock()
+
+	err := a.bridge.refreshAuth()
+	if err != nil {
+		return 0, err
+	}
+
+	for i, p := range a.Paths {
+		changes, err := a.bridge.state.SyncDirectory(p.LocalDir, p.RemoteDir)
+		changeCount += changes
+
+		a.statusLock.Lock()
+		a.status.QueueDepth = len(a.Paths) - i - 1
+		a.statusLock.Unlock()
+		if err != nil {
+			return changeCount, err
+		}
+	}
+
+	return changeCount, nil
+}
+
+// Status returns a copy of the agent's current status. While a pass is in
+// progress the totals include what has been transferred so far.
+func (a *Agent) Status() AgentStatus {
+	a.statusLock.Lock()
+	defer a.statusLock.Unlock()
+	status := a.status
+	if status.Syncing {
+		status.Totals = a.bridge.state.Stats.Counts()
+	}
+	return status
+}
+
+// Healthy returns true if the last sync pass succeeded without conflicts and one has completed
+// recently enough given the interval. An agent that hasn't finished its first
+// pass or is paused is considered healthy so that long initial syncs and
+// pauses don't fail probes.
+func (a *Agent) Healthy() bool {
+	status := a.Status()
+	if status.SyncCount == 0 || status.Paused {
+		return true
+	}
+	if status.LastError != "" || status.PendingConflicts > 0 {
+		return false
+	}
+	return time.Since(status.LastSyncEnd) < 2*a.Interval || status.Syncing
+}
+
+// ServeHTTP reports the agent's status as JSON on /status and responds on
+// /healthz with 200 when healthy or 503 otherwise, for use as a liveness probe.
+// POST requests to /pause, /resume and /sync control the agent.
+func (a *Agent) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	switch r.URL.Path {
+	case "/pause", "/resume", "/sync":
+		if r.Method != "POST" {
+			w.Header().Set("Allow", "POST")
+			http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		switch r.URL.Path {
+		case "/pause":
+			a.Pause()
+		case "/resume":
+			a.Resume()
+		case "/sync":
+			a.SyncNow()
+		}
+		w.Write([]byte("ok\n"))
+	case "/status":
+		status := a.Status()
+		status.Healthy = a.Healthy()
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(status)
+	case "/healthz":
+		if a.Healthy() {
+			w.Write([]byte("ok\n"))
+		} else {
+			http.Error(w, "unhealthy", http.StatusServiceUnavailable)
+		}
+	default:
+		http.NotFound(w, r)
+	}
+}
+
+// agentURL returns the URL for the path on an agent serving its status on addr.
+func agentURL(addr string, path string) string {
+	if strings.HasPrefix(addr, ":") {
+		addr = "localhost" + addr
+	}
+	return "http://" + addr + path
+}
+
+// GetAgentStatus fetches the status of an agent serving it on the net address given.
+func GetAgentStatus(addr string) (*AgentStatus, error) {
+	resp, err := http.Get(agentURL(addr, "/status"))
+	if err != nil {
+		return nil, fmt.Errorf("Failed to reach the agent at %s: %v", addr, err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("Failed to get the agent status from %s: %s", addr, resp.Status)
+	}
+
+	var status AgentStatus
+	err = json.NewDecoder(resp.Body).Decode(&status)
+	if err != nil {
+		return nil, fmt.Errorf("Failed to read the agent status: %v", err)
+	}
+	return &status, nil
+}
+
+// ControlAgent sends a "pause", "resume" or "sync" request to an agent serving
+// its status on the net address given.
+func ControlAgent(addr string, action string) error {
+	resp, err := http.Post(agentURL(addr, "/"+action), "text/plain", nil)
+	if err != nil {
+		return fmt.Errorf("Failed to reach the agent at %s: %v", addr, err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("Failed to %s the agent at %s: %s", action, addr, resp.Status)
+	}
+	return nil
+}
@@ -0,0 +1,153 @@
+// Copyright 2017, Timothy Bogdala <tdb@animal-machine.com>
+// See the LICENSE file for more details.
+
+package command
+
+import (
+	"crypto/sha1"
+	"encoding/base64"
+	"fmt"
+	"io"
+	"os"
+
+	"github.com/marcoziti/gringotts"
+	"github.com/marcoziti/gringotts/cmd/freezer/models"
+)
+
+// syncAppend uploads a newer local file whose policy marks it as only ever
+// appended to, like a log. Only the chunks after the last full chunk of the
+// server's current version are sent, which includes the partial chunk the
+// version ended with, and the server copies the rest into the new version.
+// The chunks before that aren't read or compared, except for the last one
+// kept, so a file that was truncated or rewritten, such as a rotated log, is
+// noticed and uploaded in full instead. With content defined chunking where
+// the chunks end can't be worked out without reading them, so the chunks are
+// matched by hash like PatchFile does, which still only uploads the new ones.
+func (s *State) syncAppend(remote filefreezer.FileInfo, localFilename string, remoteFilepath string, localStats filefreezer.FileStats) (uploadCount int, e error) {
+	if s.chunking() != filefreezer.ChunkingFixed {
+		return s.syncAppendMatched(remote, localFilename, remoteFilepath, localStats)
+	}
+
+	first, ok, err := s.appendStart(remote, localFilename, remoteFilepath, localStats)
+	if err != nil {
+		return 0, err
+	}
+	if !ok {
+		return s.syncUploadNewer(remote.FileID, localFilename, remoteFilepath, false,
+			localStats.Permissions, localStats.LastMod, localStats.ChunkCount, localStats.HashString)
+	}
+
+	// don't add a version that would conflict with another device's edits
+	err = s.checkFileLock(remote.FileID, remoteFilepath)
+	if err != nil {
+		return 0, err
+	}
+
+	sources := make([]int, localStats.ChunkCount)
+	upload := make(map[int]bool)
+	for i := range sources {
+		sources[i] = i
+		if i >= first {
+			sources[i] = -1
+			upload[i] = true
+		}
+	}
+	_, uploadCount, err = s.patchVersion(remote.FileID, remote.CurrentVersion.VersionID, localFilename, remoteFilepath, localStats, sources, upload)
+	if err != nil {
+		return uploadCount, err
+	}
+
+	s.Printf("%s ==> appended %d chunks\n", remoteFilepath, len(upload))
+	return uploadCount, nil
+}
+
+// syncAppendMatched is syncAppend for content defined chunks, which patches
+// the current version with the local chunks it doesn't have yet.
+func (s *State) syncAppendMatched(remote filefreezer.FileInfo, localFilename string, remoteFilepath string, localStats filefreezer.FileStats) (uploadCount int, e error) {
+	if !s.ServerCapabilities.Supports(models.FeaturePatch) || s.transformFor(remoteFilepath) != nil ||
+		remote.CurrentVersion.ChunkCount == 0 || isUnfinishedVersion(remote.CurrentVersion) {
+		return s.syncUploadNewer(remote.FileID, localFilename, remoteFilepath, false,
+			localStats.Permissions, localStats.LastMod, localStats.ChunkCount, localStats.HashString)
+	}
+
+	// don't add a version that would conflict with another device's edits
+	err := s.checkFileLock(remote.FileID, remoteFilepath)
+	if err != nil {
+		return 0, err
+	}
+
+	chunks, err := s.getFileChunkInfos(remote.FileID, remote.CurrentVersion.VersionID)
+	if err != nil {
+		return 0, fmt.Errorf("Failed to get the chunks of the file %d: %v", remote.FileID, err)
+	}
+	sources, upload, err := s.matchChunks(localFilename, localStats.ChunkCount, chunks)
+	if err != nil {
+		return 0, err
+	}
+	_, uploadCount, err = s.patchVersion(remote.FileID, remote.CurrentVersion.VersionID, localFilename, remoteFilepath, localStats, sources, upload)
+	if err != nil {
+		return uploadCount, err
+	}
+
+	s.Printf("%s ==> appended %d chunks\n", remoteFilepath, len(upload))
+	return uploadCount, nil
+}
+
+// appendStart returns the first chunk number of the local file that needs to
+// be uploaded to append it to the current version of the remote file. False
+// is returned if the local file isn't an append of the remote one or the
+// version can't be patched, in which case the whole file is uploaded.
+func (s *State) appendStart(remote filefreezer.FileInfo, localFilename string, remoteFilepath string, localStats filefreezer.FileStats) (int, bool, error) {
+	chunkCount := remote.CurrentVersion.ChunkCount
+	if !s.ServerCapabilities.Supports(models.FeaturePatch) || s.transformFor(remoteFilepath) != nil ||
+		chunkCount == 0 || localStats.ChunkCount < chunkCount {
+		return 0, false, nil
+	}
+
+	// every chunk of the version has to be there and of the server's chunk
+	// size, other than the last which may be partial
+	chunks, err := s.getFileChunkInfos(remote.FileID, remote.CurrentVersion.VersionID)
+	if err != nil {
+		return 0, false, fmt.Errorf("Failed to get the chunks of the file %d: %v", remote.FileID, err)
+	}
+	if len(chunks) != chunkCount {
+		return 0, false, nil
+	}
+	chunkSize := s.ServerCapabilities.ChunkSize
+	hashes := make(map[int]string)
+	first := chunkCount
+	for _, c := range chunks {
+		hashes[c.ChunkNumber] = c.ChunkHash
+		length := c.Length - cryptoOverhead
+		if c.ChunkNumber == chunkCount-1 && length < chunkSize {
+			first = chunkCount - 1
+		} else if length != chunkSize {
+			return 0, false, nil
+		}
+	}
+	if first == 0 {
+		return 0, true, nil
+	}
+
+	// the last chunk kept has to be the same locally
+	f, err := os.Open(localFilename)
+	if err != nil {
+		return 0, false, fmt.Errorf("Failed to open the file %s: %v", localFilename, err)
+	}
+	defer f.Close()
+	buffer := make([]byte, chunkSize)
+	_, err = f.ReadAt(buffer, int64(first-1)*chunkSize)
+	if err != nil && err != io.EOF {
+		return 0, false, fmt.Errorf("Failed to read the file %s: %v", localFilename, err)
+	}
+	if err == io.EOF {
+		return 0, false, nil
+	}
+	hasher := sha1.New()
+	hasher.Write(buffer)
+	if base64.URLEncoding.EncodeToString(hasher.Sum(nil)) != hashes[first-1] {
+		return 0, false, nil
+	}
+
+	return first, true, nil
+}
@@ -0,0 +1,18 @@
+// Copyright 2017, Timothy Bogdala <tdb@animal-machine.com>
+// See the LICENSE file for more details.
+
+//go:build !linux && !darwin && !dragonfly && !freebsd && !netbsd && !openbsd && !windows
+// +build !linux,!darwin,!dragonfly,!freebsd,!netbsd,!openbsd,!windows
+
+package command
+
+import (
+	"fmt"
+	"runtime"
+)
+
+// SetBackgroundPriority lowers the scheduling priority of the process, which
+// isn't supported on this platform.
+func SetBackgroundPriority() error {
+	return fmt.Errorf("Lowering the process priority isn't supported on %s", runtime.GOOS)
+}
@@ -0,0 +1,54 @@
+// Copyright 2017, Timothy Bogdala <tdb@animal-machine.com>
+// See the LICENSE file for more details.
+
+//go:build linux || darwin || dragonfly || freebsd || netbsd || openbsd
+// +build linux darwin dragonfly freebsd netbsd openbsd
+
+package command
+
+import (
+	"fmt"
+	"io/ioutil"
+	"runtime"
+	"strconv"
+	"syscall"
+)
+
+// backgroundNice is the nice value the process runs at with low priority.
+const backgroundNice = 10
+
+// SetBackgroundPriority lowers the scheduling priority of the process so
+// that syncing in the background doesn't slow down the rest of the system.
+// The commands it runs, like transforms, inherit the lower priority.
+func SetBackgroundPriority() error {
+	if runtime.GOOS != "linux" {
+		return setNice(0)
+	}
+
+	// linux sets the priority of each thread separately; threads started
+	// later inherit it from the thread that starts them
+	tasks, err := ioutil.ReadDir("/proc/self/task")
+	if err != nil {
+		return fmt.Errorf("Failed to list the threads of the process: %v", err)
+	}
+	for _, task := range tasks {
+		tid, err := strconv.Atoi(task.Name())
+		if err != nil {
+			continue
+		}
+		err = setNice(tid)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// setNice sets the nice value of the process, or of the thread on linux.
+func setNice(id int) error {
+	err := syscall.Setpriority(syscall.PRIO_PROCESS, id, backgroundNice)
+	if err != nil {
+		return fmt.Errorf("Failed to lower the process priority: %v", err)
+	}
+	return nil
+}
@@ -0,0 +1,29 @@
+// Copyright 2017, Timothy Bogdala <tdb@animal-machine.com>
+// See the LICENSE file for more details.
+
+package command
+
+import (
+	"fmt"
+	"syscall"
+)
+
+// belowNormalPriorityClass is the BELOW_NORMAL_PRIORITY_CLASS for
+// SetPriorityClass.
+const belowNormalPriorityClass = 0x00004000
+
+// SetBackgroundPriority lowers the scheduling priority of the process so
+// that syncing in the background doesn't slow down the rest of the system.
+// The commands it runs, like transforms, inherit the lower priority.
+func SetBackgroundPriority() error {
+	kernel32 := syscall.NewLazyDLL("kernel32.dll")
+	process, err := syscall.GetCurrentProcess()
+	if err != nil {
+		return fmt.Errorf("Failed to lower the process priority: %v", err)
+	}
+	ok, _, err := kernel32.NewProc("SetPriorityClass").Call(uintptr(process), belowNormalPriorityClass)
+	if ok == 0 {
+		return fmt.Errorf("Failed to lower the process priority: %v", err)
+	}
+	return nil
+}
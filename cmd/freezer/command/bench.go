@@ -0,0 +1,203 @@
+// Copyright 2017, Timothy Bogdala <tdb@animal-machine.com>
+// See the LICENSE file for more details.
+
+package command
+
+import (
+	"fmt"
+	"io/ioutil"
+	"math/rand"
+	"os"
+	"path/filepath"
+	"sort"
+	"sync"
+	"time"
+)
+
+// BenchOptions are the settings for a load test run with RunBench.
+type BenchOptions struct {
+	// Clients is the number of simulated clients running at once
+	Clients int
+
+	// Files is the number of files each client uploads and then downloads
+	Files int
+
+	// FileSize is the size in bytes of each synthetic file
+	FileSize int64
+}
+
+// BenchLatencies summarizes the time taken by one kind of operation.
+type BenchLatencies struct {
+	Count int
+	P50   time.Duration
+	P90   time.Duration
+	P99   time.Duration
+	Max   time.Duration
+}
+
+// BenchResult is the outcome of a load test.
+type BenchResult struct {
+	// Duration is the wall clock time for all of the clients to finish
+	Duration time.Duration
+
+	// Uploads and Downloads are the latencies of whole file transfers
+	Uploads   BenchLatencies
+	Downloads BenchLatencies
+
+	// BytesUploaded and BytesDownloaded count the file data transferred
+	BytesUploaded   int64
+	BytesDownloaded int64
+
+	// Errors is the number of operations that failed and FirstError is
+	// the first of them, if any
+	Errors     int
+	FirstError error
+}
+
+// UploadThroughput returns the bytes uploaded per second over the run.
+func (r *BenchResult) UploadThroughput() float64 {
+	return float64(r.BytesUploaded) / r.Duration.Seconds()
+}
+
+// DownloadThroughput returns the bytes downloaded per second over the run.
+func (r *BenchResult) DownloadThroughput() float64 {
+	return float64(r.BytesDownloaded) / r.Duration.Seconds()
+}
+
+// benchRecorder collects the measurements from all of the clients.
+type benchRecorder struct {
+	lock      sync.Mutex
+	uploads   []time.Duration
+	downloads []time.Duration
+	result    BenchResult
+}
+
+func (br *benchRecorder) record(upload bool, latency time.Duration, size int64, err error) {
+	br.lock.Lock()
+	defer br.lock.Unlock()
+	if err != nil {
+		br.result.Errors++
+		if br.result.FirstError == nil {
+			br.result.FirstError = err
+		}
+		return
+	}
+	if upload {
+		br.uploads = append(br.uploads, latency)
+		br.result.BytesUploaded += size
+	} else {
+		br.downloads = append(br.downloads, latency)
+		br.result.BytesDownloaded += size
+	}
+}
+
+// RunBench simulates many clients of the authenticated user uploading and then
+// downloading synthetic files at the same time and measures how the server
+// copes. Each client works in its own directory on the server under
+// freezer-bench/ and removes its files when it's done.
+func (s *State) RunBench(opts BenchOptions) (*BenchResult, error) {
+	if opts.Clients < 1 || opts.Files < 1 || opts.FileSize < 1 {
+		return nil, fmt.Errorf("the number of clients, files and the file size must all be positive")
+	}
+
+	tmpDir, err := ioutil.TempDir("", "freezer-bench")
+	if err != nil {
+		return nil, fmt.Errorf("Failed to create a temporary directory for the benchmark: %v", err)
+	}
+	defer os.RemoveAll(tmpDir)
+
+	// every client uploads the same data, which is encrypted with a new
+	// nonce for each chunk so the server sees it as distinct
+	data := make([]byte, opts.FileSize)
+	rand.Read(data)
+	source := filepath.Join(tmpDir, "source.dat")
+	err = ioutil.WriteFile(source, data, 0600)
+	if err != nil {
+		return nil, fmt.Errorf("Failed to write the synthetic file for the benchmark: %v", err)
+	}
+
+	runPrefix := fmt.Sprintf("freezer-bench/%d", time.Now().UnixNano())
+	recorder := new(benchRecorder)
+	var wg sync.WaitGroup
+	start := time.Now()
+	for i := 0; i < opts.Clients; i++ {
+		wg.Add(1)
+		go func(client int) {
+			defer wg.Done()
+			s.runBenchClient(client, opts, source, tmpDir, runPrefix, recorder)
+		}(i)
+	}
+	wg.Wait()
+
+	result := recorder.result
+	result.Duration = time.Since(start)
+	result.Uploads = summarizeLatencies(recorder.uploads)
+	result.Downloads = summarizeLatencies(recorder.downloads)
+	return &result, nil
+}
+
+// runBenchClient uploads each file for the client, downloads them all back
+// and then removes them from the server.
+func (s *State) runBenchClient(client int, opts BenchOptions, source string, tmpDir string, runPrefix string, recorder *benchRecorder) {
+	c := s.newBenchClient()
+	remoteDir := fmt.Sprintf("%s/client%d", runPrefix, client)
+
+	for f := 0; f < opts.Files; f++ {
+		remote := fmt.Sprintf("%s/file%d.dat", remoteDir, f)
+		opStart := time.Now()
+		_, _, err := c.SyncFile(source, remote, SyncCurrentVersion)
+		recorder.record(true, time.Since(opStart), opts.FileSize, err)
+	}
+
+	for f := 0; f < opts.Files; f++ {
+		remote := fmt.Sprintf("%s/file%d.dat", remoteDir, f)
+		local := filepath.Join(tmpDir, fmt.Sprintf("client%d-file%d.dat", client, f))
+		opStart := time.Now()
+		_, _, err := c.SyncFile(local, remote, SyncCurrentVersion)
+		recorder.record(false, time.Since(opStart), opts.FileSize, err)
+		os.Remove(local)
+	}
+
+	for f := 0; f < opts.Files; f++ {
+		c.RmFile(fmt.Sprintf("%s/file%d.dat", remoteDir, f), false)
+	}
+}
+
+// newBenchClient returns a quiet copy of the authenticated session so that
+// each simulated client has its own transfer tuning and counters.
+func (s *State) newBenchClient() *State {
+	c := NewState()
+	c.SetQuiet(true)
+	c.HostURI = s.HostURI
+	c.AuthToken = s.AuthToken
+	c.CryptoHash = s.CryptoHash
+	c.CryptoKey = s.CryptoKey
+	c.ServerCapabilities = s.ServerCapabilities
+	c.TLSCrt = s.TLSCrt
+	c.TLSKey = s.TLSKey
+	c.Transport = s.Transport
+	c.MaxTransfers = s.MaxTransfers
+	c.Metered = MeteredNo
+	return c
+}
+
+// summarizeLatencies returns the percentiles of the latencies supplied.
+func summarizeLatencies(latencies []time.Duration) BenchLatencies {
+	var bl BenchLatencies
+	bl.Count = len(latencies)
+	if bl.Count == 0 {
+		return bl
+	}
+
+	sorted := make([]time.Duration, len(latencies))
+	copy(sorted, latencies)
+	sort.Slice(sorted, func(i, j int) bool { return sorted[i] < sorted[j] })
+	percentile := func(p int) time.Duration {
+		return sorted[(len(sorted)-1)*p/100]
+	}
+	bl.P50 = percentile(50)
+	bl.P90 = percentile(90)
+	bl.P99 = percentile(99)
+	bl.Max = sorted[len(sorted)-1]
+	return bl
+}
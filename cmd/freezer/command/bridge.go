@@ -0,0 +1,260 @@
+// Copyright 2017, Timothy Bogdala <tdb@animal-machine.com>
+// See the LICENSE file for more details.
+
+package command
+
+import (
+	"fmt"
+	"html"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"path"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/marcoziti/gringotts"
+)
+
+const (
+	// bridgeAuthLifetime is how long a bridge will use an authentication token
+	// before logging in again; the server issues tokens that last 15 minutes.
+	bridgeAuthLifetime = time.Minute * 10
+)
+
+// Bridge exposes the files of an authenticated user through other protocols
+// so that tools which don't speak the freezer API can read and write storage.
+// All of the encryption and decryption happens in the bridge, so the server
+// never sees the plaintext. Requests are serialized because State is not
+// safe for concurrent use.
+type Bridge struct {
+	state    *State
+	username string
+	password string
+	authTime time.Time
+	lock     sync.Mutex
+}
+
+// NewBridge creates a new bridge for the State which must already be
+// authenticated with the server and have its CryptoKey set. The credentials
+// are kept so that the bridge can log in again when the token expires.
+func NewBridge(s *State, username string, password string) *Bridge {
+	b := new(Bridge)
+	b.state = s
+	b.username = username
+	b.password = password
+	b.authTime = time.Now()
+	return b
+}
+
+// refreshAuth logs in to the server again if the current token is close to expiring.
+func (b *Bridge) refreshAuth() error {
+	if time.Since(b.authTime) < bridgeAuthLifetime {
+		return nil
+	}
+
+	err := b.state.Authenticate(b.state.HostURI, b.username, b.password)
+	if err != nil {
+		return err
+	}
+	b.authTime = time.Now()
+	return nil
+}
+
+// LocalListenAddr returns addr with the loopback address filled in if it
+// doesn't name a host, such as ":8081", so that a bridge is only reachable
+// from other machines when an address like 0.0.0.0:8081 is given on purpose.
+func LocalListenAddr(addr string) string {
+	host, port, err := net.SplitHostPort(addr)
+	if err != nil || host != "" {
+		return addr
+	}
+	return net.JoinHostPort("127.0.0.1", port)
+}
+
+// bridgePath returns the remote file path for the bridged URL path with any
+// dot segments resolved and without the leading slash.
+func bridgePath(p string) string {
+	return strings.TrimPrefix(path.Clean("/"+p), "/")
+}
+
+// remoteFiles returns all of the files for the user keyed by their decrypted names.
+func (b *Bridge) remoteFiles() (map[string]filefreezer.FileInfo, error) {
+	return b.state.getAllFilesByName()
+}
+
+// bridgeEntry is a single entry in a bridged directory listing.
+type bridgeEntry struct {
+	Name  string
+	IsDir bool
+	Info  filefreezer.FileInfo
+}
+
+// listDir returns the immediate children of the remote directory dir. Directories
+// are implied by the paths of the files in storage so they don't need to be
+// registered on the server to be listed.
+func listDir(files map[string]filefreezer.FileInfo, dir string) []bridgeEntry {
+	prefix := strings.Trim(dir, "/")
+	if prefix != "" {
+		prefix += "/"
+	}
+
+	seen := make(map[string]bool)
+	var entries []bridgeEntry
+	for name, fi := range files {
+		trimmed := strings.TrimPrefix(name, "/")
+		if !strings.HasPrefix(trimmed, prefix) || trimmed == prefix {
+			continue
+		}
+
+		rest := trimmed[len(prefix):]
+		slash := strings.Index(rest, "/")
+		entry := bridgeEntry{Name: rest, IsDir: fi.IsDir, Info: fi}
+		if slash >= 0 {
+			entry = bridgeEntry{Name: rest[:slash], IsDir: true}
+		}
+		if entry.Name == "" || seen[entry.Name] {
+			continue
+		}
+
+		seen[entry.Name] = true
+		entries = append(entries, entry)
+	}
+
+	sort.Slice(entries, func(i, j int) bool {
+		return entries[i].Name < entries[j].Name
+	})
+
+	return entries
+}
+
+// findRemoteFile looks up the remote file for the bridged path, accepting the
+// name with or without a leading slash.
+func findRemoteFile(files map[string]filefreezer.FileInfo, p string) (filefreezer.FileInfo, string, bool) {
+	trimmed := strings.Trim(p, "/")
+	if fi, found := files[trimmed]; found {
+		return fi, trimmed, true
+	}
+	if fi, found := files["/"+trimmed]; found {
+		return fi, "/" + trimmed, true
+	}
+	return filefreezer.FileInfo{}, trimmed, false
+}
+
+// uploadFrom writes the data from r to a temporary file and syncs it to the
+// server as remoteFilepath, creating a new version if the file already exists.
+func (b *Bridge) uploadFrom(r io.Reader, remoteFilepath string) error {
+	tmpFile, err := ioutil.TempFile("", "freezer-bridge")
+	if err != nil {
+		return fmt.Errorf("Failed to create a temporary file for the upload: %v", err)
+	}
+	tmpName := tmpFile.Name()
+	defer os.Remove(tmpName)
+
+	_, err = io.Copy(tmpFile, r)
+	tmpFile.Close()
+	if err != nil {
+		return fmt.Errorf("Failed to receive the upload for %s: %v", remoteFilepath, err)
+	}
+
+	_, _, err = b.state.SyncFile(tmpName, remoteFilepath, SyncCurrentVersion)
+	return err
+}
+
+// ServeHTTP implements a plain HTTP frontend in the style of a web server's
+// directory index: GET on a directory returns an HTML page linking to its
+// children, GET on a file returns its current version and PUT uploads a file.
+// This is the format read by rclone's http backend, so rclone can copy data out
+// of freezer storage with a remote such as `--http-url http://localhost:8081`.
+func (b *Bridge) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+
+	err := b.refreshAuth()
+	if err != nil {
+		http.Error(w, "Failed to authenticate with the freezer server.", http.StatusBadGateway)
+		return
+	}
+
+	remotePath := bridgePath(r.URL.Path)
+	if r.Method == "PUT" {
+		if strings.HasSuffix(r.URL.Path, "/") || remotePath == "" {
+			http.Error(w, "Cannot upload to a directory path.", http.StatusBadRequest)
+			return
+		}
+		err = b.uploadFrom(r.Body, remotePath)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		w.WriteHeader(http.StatusCreated)
+		return
+	}
+
+	if r.Method != "GET" && r.Method != "HEAD" {
+		http.Error(w, "Method not allowed.", http.StatusMethodNotAllowed)
+		return
+	}
+
+	files, err := b.remoteFiles()
+	if err != nil {
+		http.Error(w, "Failed to get the file list from the freezer server.", http.StatusBadGateway)
+		return
+	}
+
+	fi, remoteName, found := findRemoteFile(files, remotePath)
+	if found && !fi.IsDir {
+		if strings.HasSuffix(r.URL.Path, "/") {
+			http.Redirect(w, r, strings.TrimSuffix(r.URL.Path, "/"), http.StatusMovedPermanently)
+			return
+		}
+
+		w.Header().Set("Content-Type", "application/octet-stream")
+		w.Header().Set("Last-Modified", time.Unix(fi.CurrentVersion.LastMod, 0).UTC().Format(http.TimeFormat))
+		if r.Method == "HEAD" {
+			return
+		}
+		_, err = b.state.downloadVersion(w, fi.FileID, fi.CurrentVersion.VersionID, remoteName, fi.CurrentVersion.ChunkCount)
+		if err != nil {
+			b.state.Printf("Failed to send %s: %v\n", remoteName, err)
+		}
+		return
+	}
+
+	entries := listDir(files, remotePath)
+	if !found && len(entries) == 0 && remotePath != "" {
+		http.NotFound(w, r)
+		return
+	}
+
+	// directory listings need a trailing slash so that relative links resolve
+	if !strings.HasSuffix(r.URL.Path, "/") {
+		http.Redirect(w, r, r.URL.Path+"/", http.StatusMovedPermanently)
+		return
+	}
+
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	if r.Method == "HEAD" {
+		return
+	}
+
+	fmt.Fprintf(w, "<html><head><title>Index of %s</title></head><body>\n", html.EscapeString(r.URL.Path))
+	fmt.Fprintf(w, "<h1>Index of %s</h1>\n<pre>\n", html.EscapeString(r.URL.Path))
+	for _, entry := range entries {
+		name := entry.Name
+		if entry.IsDir {
+			name += "/"
+		}
+		link := (&url.URL{Path: path.Join(r.URL.Path, entry.Name)}).EscapedPath()
+		if entry.IsDir {
+			link += "/"
+		}
+		fmt.Fprintf(w, "<a href=\"%s\">%s</a>\n", link, html.EscapeString(name))
+	}
+	fmt.Fprint(w, "</pre></body></html>\n")
+}
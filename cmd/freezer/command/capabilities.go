@@ -0,0 +1,72 @@
+// Copyright 2017, Timothy Bogdala <tdb@animal-machine.com>
+// See the LICENSE file for more details.
+
+package command
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/marcoziti/gringotts/cmd/freezer/models"
+)
+
+const (
+	// cryptoOverhead is the number of bytes encryption adds to a chunk: the
+	// nonce and the AES-GCM tag.
+	cryptoOverhead = cryptoNonceSize + 16
+)
+
+// checkCapabilities makes sure the server that was logged in to can store what
+// this client writes: the hash algorithm and encryption format it uses and
+// chunks of the size the server asks for once they're encrypted. Servers from
+// before capabilities were negotiated are only checked for a chunk size.
+func (s *State) checkCapabilities() error {
+	caps := s.ServerCapabilities
+	if caps.ChunkSize <= 0 {
+		return fmt.Errorf("the server at %s didn't report a chunk size", s.HostURI)
+	}
+	if caps.ProtocolVersion == 0 {
+		return nil
+	}
+
+	if !containsString(caps.HashAlgorithms, models.HashSHA1) {
+		return fmt.Errorf("the server at %s doesn't accept the %s hashes this client uses (it accepts: %s)",
+			s.HostURI, models.HashSHA1, strings.Join(caps.HashAlgorithms, ", "))
+	}
+
+	cryptoSupported := false
+	for _, v := range caps.CryptoVersions {
+		if v == models.CryptoAESGCM {
+			cryptoSupported = true
+		}
+	}
+	if !cryptoSupported {
+		return fmt.Errorf("the server at %s doesn't store encryption format %d used by this client (it stores: %v)",
+			s.HostURI, models.CryptoAESGCM, caps.CryptoVersions)
+	}
+
+	if caps.MaxChunkUpload > 0 && caps.ChunkSize+cryptoOverhead > caps.MaxChunkUpload {
+		return fmt.Errorf("the server at %s asks for %d byte chunks but only accepts %d bytes once they're encrypted",
+			s.HostURI, caps.ChunkSize, caps.MaxChunkUpload)
+	}
+
+	return nil
+}
+
+// requireFeature returns an error naming the feature if the server doesn't
+// support it, so that commands needing it fail before changing anything.
+func (s *State) requireFeature(feature string) error {
+	if s.ServerCapabilities.Supports(feature) {
+		return nil
+	}
+	return fmt.Errorf("the server at %s doesn't support %s; it may be older than this client or have it disabled", s.HostURI, feature)
+}
+
+func containsString(list []string, value string) bool {
+	for _, v := range list {
+		if v == value {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,168 @@
+// Copyright 2017, Timothy Bogdala <tdb@animal-machine.com>
+// See the LICENSE file for more details.
+
+package command
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	"github.com/marcoziti/gringotts"
+)
+
+// The differences that CheckSync finds between local and remote files.
+const (
+	SyncDiffLocalOnly   = "local only"
+	SyncDiffRemoteOnly  = "remote only"
+	SyncDiffLocalNewer  = "local newer"
+	SyncDiffRemoteNewer = "remote newer"
+	SyncDiffConflict    = "conflict"
+)
+
+// SyncDifference is a file that a sync would change.
+type SyncDifference struct {
+	LocalPath  string
+	RemotePath string
+	Status     string
+}
+
+// CheckSync compares localPath, a file or a directory, with remotePath on the
+// server the way that SyncFile or SyncDirectory would, but without
+// transferring any file data: only the list of the user's files is fetched and
+// local files are hashed if their metadata doesn't show whether they changed.
+// The files that a sync would change are returned sorted by their remote path.
+func (s *State) CheckSync(localPath string, remotePath string) ([]SyncDifference, error) {
+	remoteFiles, err := s.getAllFilesByName()
+	if err != nil {
+		return nil, err
+	}
+	return s.checkSync(localPath, remotePath, remoteFiles)
+}
+
+// checkSync does the work of CheckSync with the user's files keyed by name.
+func (s *State) checkSync(localPath string, remotePath string, remoteFiles map[string]filefreezer.FileInfo) ([]SyncDifference, error) {
+	localInfo, err := os.Stat(localPath)
+	if err != nil && !os.IsNotExist(err) {
+		return nil, fmt.Errorf("Failed to read the local path %s: %v", localPath, err)
+	}
+
+	// pair up the local and remote files that a sync would look at
+	locals := make(map[string]string)
+	if err == nil && localInfo.IsDir() {
+		err = filepath.Walk(localPath, func(path string, info os.FileInfo, err error) error {
+			if err != nil {
+				return err
+			}
+			if path == localPath {
+				return nil
+			}
+			rel, err := filepath.Rel(localPath, path)
+			if err != nil {
+				return err
+			}
+			locals[remotePath+"/"+filepath.ToSlash(rel)] = path
+			return nil
+		})
+		if err != nil {
+			return nil, fmt.Errorf("Failed to list the local directory %s: %v", localPath, err)
+		}
+	} else if err == nil {
+		locals[remotePath] = localPath
+	}
+
+	var diffs []SyncDifference
+	for name, local := range locals {
+		remote, found := remoteFiles[name]
+		if !found {
+			diffs = append(diffs, SyncDifference{LocalPath: local, RemotePath: name, Status: SyncDiffLocalOnly})
+			continue
+		}
+		status, err := s.checkFile(local, name, remote)
+		if err != nil {
+			return nil, err
+		}
+		if status != "" {
+			diffs = append(diffs, SyncDifference{LocalPath: local, RemotePath: name, Status: status})
+		}
+	}
+
+	prefix := remotePath + "/"
+	for name := range remoteFiles {
+		if _, found := locals[name]; found {
+			continue
+		}
+		if name == remotePath && (localInfo == nil || !localInfo.IsDir()) {
+			diffs = append(diffs, SyncDifference{LocalPath: localPath, RemotePath: name, Status: SyncDiffRemoteOnly})
+		} else if strings.HasPrefix(name, prefix) && localInfo != nil && localInfo.IsDir() {
+			local := filepath.Join(localPath, filepath.FromSlash(name[len(prefix):]))
+			diffs = append(diffs, SyncDifference{LocalPath: local, RemotePath: name, Status: SyncDiffRemoteOnly})
+		}
+	}
+
+	sort.Slice(diffs, func(i, j int) bool {
+		return diffs[i].RemotePath < diffs[j].RemotePath
+	})
+	return diffs, nil
+}
+
+// checkFile returns how a sync would change the local file and its remote
+// counterpart, or an empty string if they're the same.
+func (s *State) checkFile(localFilename string, remoteFilepath string, remote filefreezer.FileInfo) (string, error) {
+	info, err := os.Stat(localFilename)
+	if err != nil {
+		return "", fmt.Errorf("Failed to read the local file %s: %v", localFilename, err)
+	}
+	if info.IsDir() || remote.IsDir {
+		return "", nil
+	}
+
+	// files synced through a transform are stored as different data, so
+	// only their modification times can be compared
+	localLastMod := info.ModTime().Unix()
+	if s.transformFor(remoteFilepath) != nil {
+		return compareLastMod(localLastMod, remote.CurrentVersion.LastMod), nil
+	}
+
+	last, tracked, err := s.lastSynced(localFilename, remoteFilepath)
+	if err != nil {
+		return "", err
+	}
+	if tracked && last.VersionID == remote.CurrentVersion.VersionID &&
+		last.LastMod == localLastMod && last.Size == info.Size() {
+		return "", nil
+	}
+
+	localStats, err := s.calcFileHashInfo(localFilename)
+	if err != nil {
+		return "", fmt.Errorf("Failed to calculate the local file hash data for %s: %v", localFilename, err)
+	}
+	remoteHash := remote.CurrentVersion.FileHash
+	switch {
+	case localStats.HashString == remoteHash:
+		return "", nil
+	case tracked && last.Hash != localStats.HashString && last.Hash != remoteHash:
+		return SyncDiffConflict, nil
+	case tracked && last.Hash == localStats.HashString:
+		return SyncDiffRemoteNewer, nil
+	case localLastMod < remote.CurrentVersion.LastMod:
+		return SyncDiffRemoteNewer, nil
+	}
+
+	// sync uploads the local file if the modification times are the same
+	return SyncDiffLocalNewer, nil
+}
+
+// compareLastMod returns which side is newer by modification time, or an
+// empty string if they're the same.
+func compareLastMod(local int64, remote int64) string {
+	switch {
+	case local > remote:
+		return SyncDiffLocalNewer
+	case local < remote:
+		return SyncDiffRemoteNewer
+	}
+	return ""
+}
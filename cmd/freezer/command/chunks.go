@@ -0,0 +1,145 @@
+// Copyright 2017, Timothy Bogdala <tdb@animal-machine.com>
+// See the LICENSE file for more details.
+
+package command
+
+import (
+	"crypto/sha1"
+	"encoding/base64"
+	"fmt"
+	"io"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/marcoziti/gringotts"
+)
+
+// The results of comparing the chunks of a version with a local file.
+const (
+	ChunkMatches     = "match"
+	ChunkDiffers     = "differs"
+	ChunkNotUploaded = "not uploaded"
+	ChunkNotLocal    = "not local"
+	ChunkLocalOnly   = "local only"
+)
+
+// ParseVersionSpec splits a file@version target into the file path and the
+// version number. The version is zero, meaning the current version, if the
+// target doesn't end in @ and a number.
+func ParseVersionSpec(target string) (remoteFilepath string, versionNumber int) {
+	i := strings.LastIndex(target, "@")
+	if i < 0 {
+		return target, 0
+	}
+	v, err := strconv.Atoi(target[i+1:])
+	if err != nil || v < 1 {
+		return target, 0
+	}
+	return target[:i], v
+}
+
+// GetVersionChunks returns a version of the file along with the information
+// about its chunks, sorted by chunk number, including their hash and the bytes
+// stored for them. A versionNumber of zero gets the current version. Chunks
+// that haven't been uploaded are missing from the result.
+func (s *State) GetVersionChunks(remoteFilepath string, versionNumber int) (version filefreezer.FileVersionInfo, chunks []filefreezer.FileChunk, e error) {
+	fi, err := s.GetFileInfoByFilename(remoteFilepath)
+	if err != nil {
+		return version, nil, err
+	}
+	if fi.IsDir {
+		return version, nil, fmt.Errorf("%s is a directory on the server", remoteFilepath)
+	}
+
+	version = fi.CurrentVersion
+	if versionNumber != 0 && versionNumber != version.VersionNumber {
+		versions, err := s.GetFileVersions(remoteFilepath)
+		if err != nil {
+			return version, nil, err
+		}
+		found := false
+		for _, v := range versions {
+			if v.VersionNumber == versionNumber {
+				version = v
+				found = true
+				break
+			}
+		}
+		if !found {
+			return version, nil, fmt.Errorf("Version %d of %s doesn't exist on the server", versionNumber, remoteFilepath)
+		}
+	}
+
+	chunks, err = s.getFileChunkInfos(fi.FileID, version.VersionID)
+	if err != nil {
+		return version, nil, fmt.Errorf("Failed to get the chunks of version %d of %s: %v", version.VersionNumber, remoteFilepath, err)
+	}
+	sort.Slice(chunks, func(i, j int) bool {
+		return chunks[i].ChunkNumber < chunks[j].ChunkNumber
+	})
+	return version, chunks, nil
+}
+
+// CompareChunks splits a local file into chunks like the version's and
+// compares the hash of each with the chunk of the version on the server. The
+// result has a status for each chunk number of the version or the local file,
+// whichever has more. With fixed chunking the chunk size is taken from the
+// version's first chunk since the server's chunk size may have changed after
+// it was uploaded.
+func (s *State) CompareChunks(localFilepath string, chunks []filefreezer.FileChunk, chunkCount int) ([]string, error) {
+	chunking := s.chunking()
+	chunkSize := s.ServerCapabilities.ChunkSize
+	hashes := make(map[int]string)
+	for _, c := range chunks {
+		hashes[c.ChunkNumber] = c.ChunkHash
+		if c.ChunkNumber == 0 && chunkCount > 1 && chunking == filefreezer.ChunkingFixed {
+			chunkSize = c.Length - cryptoOverhead
+		}
+	}
+	if chunkSize <= 0 {
+		return nil, fmt.Errorf("Failed to work out the chunk size of the version")
+	}
+
+	f, err := os.Open(localFilepath)
+	if err != nil {
+		return nil, fmt.Errorf("Failed to open the file %s: %v", localFilepath, err)
+	}
+	defer f.Close()
+	chunker, err := filefreezer.NewChunker(f, chunking, int(chunkSize))
+	if err != nil {
+		return nil, err
+	}
+
+	var statuses []string
+	for i := 0; ; i++ {
+		chunk, err := chunker.Next()
+		if err == io.EOF {
+			for ; i < chunkCount; i++ {
+				statuses = append(statuses, ChunkNotLocal)
+			}
+			break
+		}
+		if err != nil {
+			return statuses, fmt.Errorf("Failed to read the file %s: %v", localFilepath, err)
+		}
+
+		hasher := sha1.New()
+		hasher.Write(chunk)
+		localHash := base64.URLEncoding.EncodeToString(hasher.Sum(nil))
+		remoteHash, found := hashes[i]
+		switch {
+		case i >= chunkCount:
+			statuses = append(statuses, ChunkLocalOnly)
+		case !found:
+			statuses = append(statuses, ChunkNotUploaded)
+		case remoteHash == localHash:
+			statuses = append(statuses, ChunkMatches)
+		default:
+			statuses = append(statuses, ChunkDiffers)
+		}
+	}
+
+	return statuses, nil
+}
@@ -0,0 +1,96 @@
+// Copyright 2017, Timothy Bogdala <tdb@animal-machine.com>
+// See the LICENSE file for more details.
+
+package command
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"time"
+
+	"github.com/marcoziti/gringotts/cmd/freezer/models"
+)
+
+const (
+	// authRenewMargin is how long before the authentication token expires
+	// that it's renewed so that slow requests don't outlive it.
+	authRenewMargin = time.Minute
+)
+
+// measureSkew returns how far the server's clock, given in nanoseconds, is ahead
+// of the local clock. The server is assumed to have read its clock halfway
+// through the request.
+func measureSkew(serverTime int64, sent time.Time, received time.Time) time.Duration {
+	midpoint := sent.Add(received.Sub(sent) / 2)
+	return time.Unix(0, serverTime).Sub(midpoint)
+}
+
+// ServerTime asks the server at HostURI for its clock and updates ClockSkew
+// with how far it is from the local clock. The server's time is returned.
+func (s *State) ServerTime() (time.Time, error) {
+	client, err := s.getHTTPClient()
+	if err != nil {
+		return time.Time{}, err
+	}
+
+	target := fmt.Sprintf("%s/api/time", s.HostURI)
+	sent := time.Now()
+	req, _ := http.NewRequest("GET", target, nil)
+	req.Header.Set(models.ClientVersionHeader, Version)
+	resp, err := client.Do(req)
+	received := time.Now()
+	if err != nil {
+		return time.Time{}, fmt.Errorf("Failed to make the HTTP GET request to %s: %v", target, err)
+	}
+	defer resp.Body.Close()
+	body, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return time.Time{}, fmt.Errorf("Failed to read the response body from %s: %v", target, err)
+	}
+
+	var r models.ServerTimeResponse
+	err = json.Unmarshal(body, &r)
+	if err != nil || r.Time == 0 {
+		return time.Time{}, fmt.Errorf("Poorly formatted response to %s: %v", target, err)
+	}
+
+	s.ClockSkew = measureSkew(r.Time, sent, received)
+	return time.Unix(0, r.Time), nil
+}
+
+// freshToken returns the authentication token, renewing it first if it expires
+// within the renewal margin. Tokens from servers that don't report their expiry
+// are never renewed ahead of time.
+func (s *State) freshToken() (string, error) {
+	s.authLock.Lock()
+	defer s.authLock.Unlock()
+	if s.authExpires.IsZero() || s.authUser == "" || time.Now().Add(authRenewMargin).Before(s.authExpires) {
+		return s.AuthToken, nil
+	}
+	err := s.renewAuth()
+	return s.AuthToken, err
+}
+
+// renewToken renews the authentication token after the server rejected it,
+// unless another request already replaced it.
+func (s *State) renewToken(rejected string) (string, error) {
+	s.authLock.Lock()
+	defer s.authLock.Unlock()
+	if s.AuthToken != rejected {
+		return s.AuthToken, nil
+	}
+	err := s.renewAuth()
+	return s.AuthToken, err
+}
+
+// renewAuth logs in again with the credentials used by Authenticate to get a
+// new token.
+func (s *State) renewAuth() error {
+	err := s.Authenticate(s.HostURI, s.authUser, s.authPassword)
+	if err != nil {
+		return fmt.Errorf("Failed to renew the login to %s (the server's clock is %v ahead of this one): %w", s.HostURI, s.ClockSkew, err)
+	}
+	return nil
+}
@@ -5,6 +5,10 @@ package command
 
 import (
 	"fmt"
+	"io"
+	"net/http"
+	"sync"
+	"time"
 
 	"github.com/marcoziti/gringotts/cmd/freezer/models"
 )
@@ -28,6 +32,18 @@ type State struct {
 	// the capabilities returned by the authenticated server
 	ServerCapabilities models.ServerCapabilities
 
+	// how far the server's clock is ahead of the local one, as measured when
+	// authenticating or by ServerTime
+	ClockSkew time.Duration
+
+	// the credentials used to renew the authentication token and when it
+	// expires by the local clock
+	authUser     string
+	authPassword string
+	authDerived  string
+	authExpires  time.Time
+	authLock     sync.Mutex
+
 	// an overridable Println implementation that defaults to using
 	// the fmt package version from the stdlib.
 	Println func(v ...interface{})
@@ -36,14 +52,149 @@ type State struct {
 	// the fmt package version from the stdlib.
 	Printf func(format string, v ...interface{})
 
+	// the newest client version, if the server says it's newer than this one
+	UpgradeAvailable string
+
+	// the highest quota warning threshold, in percent, that the server said
+	// the user is over
+	QuotaWarning int
+	quotaLock    sync.Mutex
+
+	// an optional channel that notices for the user, such as an upgrade being
+	// available, are sent to instead of being printed; notices are dropped
+	// if it's full
+	Notices chan string
+
+	// never send the plaintext password to log in, even to servers or for
+	// accounts that predate derived login passwords
+	StrictLogin bool
+
 	// the HTTPS TLS public crt file
 	TLSCrt string
 
 	// the HTTPS TLS private key file
 	TLSKey string
 
+	// an optional transport that all requests to the server are sent through
+	// instead of a new connection using the TLS settings above, such as one
+	// that serves them in memory for tests
+	Transport http.RoundTripper
+
+	// how much is logged about the requests made to the server: zero logs
+	// nothing and VerbosityRequests, VerbosityDebug and VerbosityWire log
+	// more and more
+	Verbosity int
+
+	// where the Verbosity logging is written; stderr if it's nil
+	TraceOutput io.Writer
+
 	// extra strict file checking during sync operations
 	ExtraStrict bool
+
+	// read the local files synced by SyncDirectory from a snapshot of their
+	// volume, so that open and locked files can be read consistently; only
+	// supported on Windows with the Volume Shadow Copy Service
+	UseSnapshot bool
+
+	// the snapshot files are read from during the current SyncDirectory
+	snapshot *shadowCopy
+
+	// the name recorded, encrypted, with each file version uploaded so that
+	// versions can be told apart by where they came from; the host name is
+	// used if it's empty
+	Device string
+
+	// an optional command, such as "clamscan --no-summary", that downloaded
+	// files are passed to before being moved into place; a non-zero exit
+	// status marks the file as infected.
+	Scanner string
+
+	// the directory that downloaded files failing the scan are moved into
+	QuarantineDir string
+
+	// commands that change the data of files matching their patterns as they're
+	// synced, such as for compression or redaction; the first match is used
+	Transforms []Transform
+
+	// the dictionaries used by transforms, keyed by their path on the server
+	dictionaries   map[string][]byte
+	dictionaryLock sync.Mutex
+
+	// counters for the chunks transferred and conflicts found while syncing
+	Stats SyncStats
+
+	// whether the connection is metered: MeteredAuto, MeteredYes or MeteredNo
+	Metered string
+
+	// the policies for how files matching their patterns are synced; the
+	// first match is used
+	Policies []SyncPolicy
+
+	// paths that SyncDirectory skips in the HomeDir, such as caches and the
+	// trash, matched like the patterns of DefaultExclusions; a policy marked
+	// Include syncs the matching files anyway
+	Exclusions []string
+
+	// the home directory the Exclusions apply in; empty doesn't apply them
+	HomeDir string
+
+	// the order SyncDirectory syncs files in: SyncPriorityName, SyncPrioritySmall
+	// or SyncPriorityRecent; empty is the same as SyncPriorityName
+	SyncPriority string
+
+	// uploads of files larger than this many bytes are deferred while the
+	// connection is metered; zero never defers uploads
+	DeferSize int64
+
+	// the cached result of detecting a metered connection
+	meteredChecked time.Time
+	meteredCached  bool
+
+	// whether the computer is on battery: PowerAuto, PowerBattery or PowerAC
+	Power string
+
+	// uploads of files larger than DeferSize are also deferred while the
+	// computer is on battery with this charge, in percent, or less; zero
+	// never defers them for the battery
+	BatteryThreshold int
+
+	// the cached result of detecting a low battery
+	batteryChecked time.Time
+	batteryCached  bool
+
+	// the bytes per second that requests are limited to when no rule in the
+	// BandwidthSchedule applies; zero is unlimited
+	BandwidthLimit int64
+
+	// time of day windows with their own bandwidth limits
+	BandwidthSchedule []BandwidthRule
+
+	// when the bytes transferred so far will have been paid off at the limit
+	throttleNext time.Time
+	throttleLock sync.Mutex
+
+	// the most chunks to transfer at once; the number actually used is tuned
+	// from how quickly the transfers complete
+	MaxTransfers int
+
+	// an optional directory that encrypted chunks are written to before they're
+	// uploaded and removed from once the server has them; chunks that fail to
+	// upload stay there until FlushSpool pushes them
+	SpoolDir string
+
+	// an optional file that file removals and renames are queued in while the
+	// server can't be reached so that ReplayOpQueue can apply them later
+	QueueFile string
+
+	// an optional file that the version and hash of each local file are
+	// recorded in when it's synced so that unchanged files aren't hashed again
+	// and files changed both locally and on the server since are found
+	SyncStateFile string
+	syncState     map[string]map[string]SyncedFile
+	syncStateLock sync.Mutex
+
+	// the tuning for the number of chunks transferred at once
+	transfers *transferWindow
 }
 
 // NewState creates a new State object.
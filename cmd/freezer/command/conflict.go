@@ -0,0 +1,88 @@
+// Copyright 2017, Timothy Bogdala <tdb@animal-machine.com>
+// See the LICENSE file for more details.
+
+package command
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/marcoziti/gringotts"
+)
+
+// maxConflictCopies is the most conflicted copies of a file made on the same
+// day by the same device before syncing it fails instead.
+const maxConflictCopies = 100
+
+// ConflictedCopyName returns the name that a copy of the file changed on the
+// device is kept under when it conflicts with a change from another one, such
+// as "notes (conflicted copy from laptop 2017-05-01).txt". A copy number is
+// added after the first one.
+func ConflictedCopyName(name string, device string, when time.Time, n int) string {
+	ext := path.Ext(name)
+	if ext == name || strings.HasSuffix(name, "/"+ext) {
+		ext = ""
+	}
+	suffix := fmt.Sprintf(" (conflicted copy from %s %s)", device, when.Format("2006-01-02"))
+	if n > 1 {
+		suffix = fmt.Sprintf(" (conflicted copy %d from %s %s)", n, device, when.Format("2006-01-02"))
+	}
+	return name[:len(name)-len(ext)] + suffix + ext
+}
+
+// syncConflict resolves a file that was changed both locally and on the
+// server since it was last synced. Neither change is thrown away: the local
+// copy is renamed to a conflicted copy and uploaded under that name, and the
+// server's version is then downloaded into the file's place. The number of
+// chunks changed is returned.
+func (s *State) syncConflict(remote filefreezer.FileInfo, localFilename string, remoteFilepath string) (changeCount int, e error) {
+	device := s.deviceName()
+	if device == "" {
+		device = "unknown device"
+	}
+	now := time.Now()
+
+	// find a name that isn't taken locally or on the server
+	var localCopy, remoteCopy string
+	for i := 1; ; i++ {
+		if i > maxConflictCopies {
+			return 0, fmt.Errorf("Failed to find a name for the conflicted copy of %s", remoteFilepath)
+		}
+		localCopy = ConflictedCopyName(localFilename, device, now, i)
+		remoteCopy = ConflictedCopyName(remoteFilepath, device, now, i)
+		if _, err := os.Stat(localCopy); !os.IsNotExist(err) {
+			continue
+		}
+		_, err := s.GetFileInfoByFilename(remoteCopy)
+		if err == nil {
+			continue
+		}
+		if !errors.Is(err, ErrFileNotFound) {
+			return 0, err
+		}
+		break
+	}
+
+	err := os.Rename(localFilename, localCopy)
+	if err != nil {
+		return 0, fmt.Errorf("Failed to rename the conflicted copy of %s: %v", localFilename, err)
+	}
+	_, ulCount, err := s.syncFile(localCopy, remoteCopy, SyncCurrentVersion)
+	if err != nil {
+		return ulCount, fmt.Errorf("Failed to upload the conflicted copy of %s: %v", remoteFilepath, err)
+	}
+
+	dlCount, err := s.syncDownload(remote.FileID, remote.CurrentVersion.VersionID, localFilename,
+		remoteFilepath, remote.CurrentVersion.ChunkCount)
+	if err != nil {
+		return ulCount + dlCount, err
+	}
+
+	s.Printf("%s !!! conflict; the local copy was kept as %s\n", remoteFilepath, filepath.Base(localCopy))
+	return ulCount + dlCount, nil
+}
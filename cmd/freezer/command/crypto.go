@@ -10,6 +10,7 @@ import (
 	"encoding/base64"
 	"fmt"
 	"io"
+	"os"
 )
 
 const (
@@ -43,22 +44,46 @@ func (s *State) DecryptString(encoded string) (string, error) {
 	return string(decrypted), nil
 }
 
+// deviceName returns the Device name, or the host name if it's empty.
+func (s *State) deviceName() string {
+	if s.Device != "" {
+		return s.Device
+	}
+	hostname, _ := os.Hostname()
+	return hostname
+}
+
+// encryptedDevice returns the Device name, or the host name if it's empty,
+// encrypted so that it can be sent with a new file version.
+func (s *State) encryptedDevice() (string, error) {
+	device := s.deviceName()
+	if device == "" {
+		return "", nil
+	}
+
+	encrypted, err := s.EncryptString(device)
+	if err != nil {
+		return "", fmt.Errorf("Could not encrypt the device name: %v", err)
+	}
+	return encrypted, nil
+}
+
 func (s *State) encryptBytes(b []byte) ([]byte, error) {
 	// encrypt the original bytes
 	aesCipher, err := aes.NewCipher(s.CryptoKey)
 	if err != nil {
-		return nil, fmt.Errorf("Couldn't initialize the AES cipher. " + err.Error())
+		return nil, fmt.Errorf("Couldn't initialize the AES cipher. %v", err)
 	}
 
 	gcm, err := cipher.NewGCM(aesCipher)
 	if err != nil {
-		return nil, fmt.Errorf("Couldn't initialize the AES-GCM cipher. " + err.Error())
+		return nil, fmt.Errorf("Couldn't initialize the AES-GCM cipher. %v", err)
 	}
 
 	nonce := make([]byte, cryptoNonceSize)
 	_, err = io.ReadFull(rand.Reader, nonce)
 	if err != nil {
-		return nil, fmt.Errorf("Failed to initialize random data for AES-GCM. " + err.Error())
+		return nil, fmt.Errorf("Failed to initialize random data for AES-GCM. %v", err)
 	}
 
 	cipherBytes := gcm.Seal(nil, nonce, b, nil)
@@ -70,12 +95,12 @@ func (s *State) decryptBytes(b []byte) ([]byte, error) {
 	// encrypt the original bytes
 	aesCipher, err := aes.NewCipher(s.CryptoKey)
 	if err != nil {
-		return nil, fmt.Errorf("Couldn't initialize the AES cipher. " + err.Error())
+		return nil, fmt.Errorf("Couldn't initialize the AES cipher. %v", err)
 	}
 
 	gcm, err := cipher.NewGCM(aesCipher)
 	if err != nil {
-		return nil, fmt.Errorf("Couldn't initialize the AES-GCM cipher. " + err.Error())
+		return nil, fmt.Errorf("Couldn't initialize the AES-GCM cipher. %v", err)
 	}
 
 	nonce := make([]byte, cryptoNonceSize)
@@ -0,0 +1,212 @@
+// Copyright 2017, Timothy Bogdala <tdb@animal-machine.com>
+// See the LICENSE file for more details.
+
+package command
+
+import (
+	"archive/tar"
+	"bytes"
+	"compress/gzip"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/url"
+	"os"
+	"path/filepath"
+	"regexp"
+	"runtime"
+	"sort"
+	"time"
+)
+
+// debugLogTail is the most bytes from the end of each log file that are
+// put in a debug bundle.
+const debugLogTail = 1 << 20
+
+// debugDialTimeout is how long the connectivity test waits to connect.
+const debugDialTimeout = 10 * time.Second
+
+// secretSetting matches the names of the settings whose values are redacted
+// from debug bundles.
+var secretSetting = regexp.MustCompile(`(?i)pass|crypt|secret|token|key`)
+
+// DebugBundle is what WriteDebugBundle collects for a bug report.
+type DebugBundle struct {
+	// Settings are the client's settings by name; the values of the ones
+	// that look like secrets are redacted
+	Settings map[string]string
+
+	// LogFiles are log files, such as the agent's output, whose last
+	// megabyte is included
+	LogFiles []string
+
+	// AgentAddr is the net address of an agent whose status is included if
+	// it's running; empty skips it
+	AgentAddr string
+
+	// Username and Password are used to test logging in to the server at
+	// HostURI; an empty Username skips it
+	Username string
+	Password string
+}
+
+// WriteDebugBundle writes a gzipped tarball to w with the version of the
+// client, its settings with the secrets redacted, the tail of the log files,
+// the status of the agent and a report of testing the connection to the
+// server along with the requests it made. Problems found collecting each
+// part are written into the bundle instead of failing it.
+func (s *State) WriteDebugBundle(w io.Writer, b DebugBundle) error {
+	gz := gzip.NewWriter(w)
+	tw := tar.NewWriter(gz)
+	add := func(name string, data []byte) error {
+		hdr := &tar.Header{Name: name, Mode: 0644, Size: int64(len(data)), ModTime: time.Now()}
+		err := tw.WriteHeader(hdr)
+		if err == nil {
+			_, err = tw.Write(data)
+		}
+		if err != nil {
+			return fmt.Errorf("Failed to write %s to the debug bundle: %v", name, err)
+		}
+		return nil
+	}
+
+	version := fmt.Sprintf("freezer %s\n%s %s/%s\n", Version, runtime.Version(), runtime.GOOS, runtime.GOARCH)
+	err := add("version.txt", []byte(version))
+	if err != nil {
+		return err
+	}
+
+	settings := make(map[string]string)
+	for name, value := range b.Settings {
+		if value != "" && secretSetting.MatchString(name) {
+			value = "[redacted]"
+		}
+		settings[name] = value
+	}
+	settingsData, _ := json.MarshalIndent(settings, "", "  ")
+	err = add("settings.json", settingsData)
+	if err != nil {
+		return err
+	}
+
+	for i, logFile := range b.LogFiles {
+		name := fmt.Sprintf("logs/%d-%s", i+1, filepath.Base(logFile))
+		err = add(name, readTail(logFile, debugLogTail))
+		if err != nil {
+			return err
+		}
+	}
+
+	if b.AgentAddr != "" {
+		var statusData []byte
+		status, err := GetAgentStatus(b.AgentAddr)
+		if err != nil {
+			statusData = []byte(err.Error() + "\n")
+		} else {
+			statusData, _ = json.MarshalIndent(status, "", "  ")
+		}
+		err = add("agent-status.json", statusData)
+		if err != nil {
+			return err
+		}
+	}
+
+	// the requests made by the test are traced at the highest verbosity
+	var trace bytes.Buffer
+	verbosity, traceOutput := s.Verbosity, s.TraceOutput
+	s.Verbosity, s.TraceOutput = VerbosityWire, &trace
+	report := s.testConnectivity(b.Username, b.Password)
+	s.Verbosity, s.TraceOutput = verbosity, traceOutput
+	err = add("connectivity.txt", []byte(report))
+	if err == nil {
+		err = add("trace.txt", trace.Bytes())
+	}
+	if err != nil {
+		return err
+	}
+
+	err = tw.Close()
+	if err == nil {
+		err = gz.Close()
+	}
+	if err != nil {
+		return fmt.Errorf("Failed to finish the debug bundle: %v", err)
+	}
+	return nil
+}
+
+// testConnectivity checks each step of reaching the server at HostURI and
+// logging in, returning a report with a line for each. The steps after one
+// that fails are still tried since they can narrow the problem down.
+func (s *State) testConnectivity(username string, password string) string {
+	var report bytes.Buffer
+	step := func(name string, err error, format string, v ...interface{}) {
+		if err != nil {
+			fmt.Fprintf(&report, "FAIL %-8s %v\n", name, err)
+			return
+		}
+		fmt.Fprintf(&report, "OK   %-8s %s\n", name, fmt.Sprintf(format, v...))
+	}
+	fmt.Fprintf(&report, "Testing %s at %s\n", s.HostURI, time.Now().Format(time.RFC3339))
+
+	u, err := url.Parse(s.HostURI)
+	if err != nil || u.Host == "" {
+		step("url", fmt.Errorf("the server URL %q can't be parsed: %v", s.HostURI, err), "")
+		return report.String()
+	}
+	port := u.Port()
+	if port == "" {
+		port = "80"
+		if u.Scheme == "https" {
+			port = "443"
+		}
+	}
+
+	addrs, err := net.LookupHost(u.Hostname())
+	sort.Strings(addrs)
+	step("dns", err, "%s resolves to %v", u.Hostname(), addrs)
+
+	start := time.Now()
+	conn, err := net.DialTimeout("tcp", net.JoinHostPort(u.Hostname(), port), debugDialTimeout)
+	if err == nil {
+		conn.Close()
+	}
+	step("connect", err, "connected to port %s in %s", port, time.Since(start).Round(time.Millisecond))
+
+	serverTime, err := s.ServerTime()
+	step("time", err, "the server's clock is %s, %s ahead of this one", serverTime.Format(time.RFC3339), s.ClockSkew.Round(time.Millisecond))
+
+	if username == "" {
+		fmt.Fprintf(&report, "SKIP %-8s no user name was given\n", "login")
+		return report.String()
+	}
+	err = s.Authenticate(s.HostURI, username, password)
+	step("login", err, "logged in as %s; chunk size %d, protocol version %d",
+		username, s.ServerCapabilities.ChunkSize, s.ServerCapabilities.ProtocolVersion)
+	return report.String()
+}
+
+// readTail returns up to max bytes from the end of the file or the error
+// reading it as text.
+func readTail(filename string, max int64) []byte {
+	f, err := os.Open(filename)
+	if err != nil {
+		return []byte(err.Error() + "\n")
+	}
+	defer f.Close()
+
+	info, err := f.Stat()
+	if err == nil && info.Size() > max {
+		_, err = f.Seek(-max, io.SeekEnd)
+	}
+	if err != nil {
+		return []byte(err.Error() + "\n")
+	}
+	data, err := ioutil.ReadAll(f)
+	if err != nil {
+		return []byte(err.Error() + "\n")
+	}
+	return data
+}
@@ -0,0 +1,52 @@
+// Copyright 2017, Timothy Bogdala <tdb@animal-machine.com>
+// See the LICENSE file for more details.
+
+package command
+
+import (
+	"fmt"
+	"os/exec"
+	"runtime"
+	"strings"
+)
+
+// desktopAppName is the application the desktop notifications come from.
+const desktopAppName = "Filefreezer"
+
+// DesktopNotify shows a notification on the desktop with the title and
+// message. Linux uses notify-send, macOS the notification center through
+// osascript and Windows a toast through PowerShell.
+func DesktopNotify(title string, message string) error {
+	var cmd *exec.Cmd
+	switch runtime.GOOS {
+	case "linux", "freebsd", "openbsd", "netbsd", "dragonfly":
+		cmd = exec.Command("notify-send", "--app-name="+desktopAppName, title, message)
+
+	case "darwin":
+		// the text is passed as arguments so it doesn't need to be quoted
+		cmd = exec.Command("osascript",
+			"-e", "on run argv",
+			"-e", "display notification (item 2 of argv) with title (item 1 of argv)",
+			"-e", "end run",
+			title, message)
+
+	case "windows":
+		quote := func(s string) string { return "'" + strings.Replace(s, "'", "''", -1) + "'" }
+		script := "[Windows.UI.Notifications.ToastNotificationManager, Windows.UI.Notifications, ContentType = WindowsRuntime] > $null; " +
+			"$t = [Windows.UI.Notifications.ToastNotificationManager]::GetTemplateContent([Windows.UI.Notifications.ToastTemplateType]::ToastText02); " +
+			"$x = $t.GetElementsByTagName('text'); " +
+			"$x.Item(0).AppendChild($t.CreateTextNode(" + quote(title) + ")) > $null; " +
+			"$x.Item(1).AppendChild($t.CreateTextNode(" + quote(message) + ")) > $null; " +
+			"[Windows.UI.Notifications.ToastNotificationManager]::CreateToastNotifier(" + quote(desktopAppName) + ").Show([Windows.UI.Notifications.ToastNotification]::new($t))"
+		cmd = exec.Command("powershell", "-NoProfile", "-Command", script)
+
+	default:
+		return fmt.Errorf("Desktop notifications aren't supported on %s", runtime.GOOS)
+	}
+
+	output, err := cmd.CombinedOutput()
+	if err != nil {
+		return fmt.Errorf("Failed to show a desktop notification (%s): %v", strings.TrimSpace(string(output)), err)
+	}
+	return nil
+}
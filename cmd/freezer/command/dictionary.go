@@ -0,0 +1,137 @@
+// Copyright 2017, Timothy Bogdala <tdb@animal-machine.com>
+// See the LICENSE file for more details.
+
+package command
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path"
+	"path/filepath"
+	"strings"
+)
+
+const (
+	// DictionaryName is the name of the file on the server that holds the
+	// zstd dictionary trained for the files in its directory.
+	DictionaryName = ".freezer-dictionary"
+
+	// DictionaryPlaceholder is replaced in transform commands with the path
+	// of a local copy of the dictionary for the file's directory, such as in
+	// "zstd -q -D {dict}|zstd -q -d -D {dict}".
+	DictionaryPlaceholder = "{dict}"
+
+	// minDictionarySamples is the fewest files a dictionary is trained on.
+	minDictionarySamples = 5
+)
+
+// TrainDictionary trains a zstd dictionary with `zstd --train` on the files
+// directly in localDir that are no larger than maxSize bytes and stores it
+// on the server as DictionaryName in remoteDir, encrypted like any other
+// file. Many small, similar files, such as JSON documents or logs, compress
+// much better with a dictionary than on their own. The number of files the
+// dictionary was trained on is returned.
+func (s *State) TrainDictionary(localDir string, remoteDir string, maxSize int64) (int, error) {
+	entries, err := ioutil.ReadDir(localDir)
+	if err != nil {
+		return 0, fmt.Errorf("Failed to list the local directory %s: %v", localDir, err)
+	}
+	var samples []string
+	for _, entry := range entries {
+		if !entry.Mode().IsRegular() || entry.Size() == 0 || entry.Size() > maxSize || entry.Name() == DictionaryName {
+			continue
+		}
+		samples = append(samples, filepath.Join(localDir, entry.Name()))
+	}
+	if len(samples) < minDictionarySamples {
+		return 0, fmt.Errorf("Failed to train a dictionary: %s has %d files of up to %d bytes and at least %d are needed",
+			localDir, len(samples), maxSize, minDictionarySamples)
+	}
+
+	tmpDir, err := ioutil.TempDir("", "freezer-dictionary")
+	if err != nil {
+		return 0, fmt.Errorf("Failed to create a temporary directory for the dictionary: %v", err)
+	}
+	defer os.RemoveAll(tmpDir)
+	dictPath := filepath.Join(tmpDir, DictionaryName)
+
+	var stderr bytes.Buffer
+	cmd := exec.Command("zstd", append([]string{"--train", "-q", "-o", dictPath}, samples...)...)
+	cmd.Stderr = &stderr
+	err = cmd.Run()
+	if err != nil {
+		return 0, fmt.Errorf("Failed to train a dictionary with zstd: %s: %s", err, strings.TrimSpace(stderr.String()))
+	}
+
+	// the dictionary is uploaded without syncing it so that the temporary
+	// file isn't recorded in the sync state
+	remotePath := path.Join(remoteDir, DictionaryName)
+	stats, err := s.calcFileHashInfo(dictPath)
+	if err != nil {
+		return 0, fmt.Errorf("Failed to calculate the file hash data for the dictionary: %v", err)
+	}
+	fi, err := s.GetFileInfoByFilename(remotePath)
+	switch {
+	case errors.Is(err, ErrFileNotFound):
+		_, err = s.syncUploadNew(dictPath, remotePath, false, stats.Permissions, stats.LastMod, stats.ChunkCount, stats.HashString)
+	case err == nil && fi.CurrentVersion.FileHash != stats.HashString:
+		_, err = s.syncUploadNewer(fi.FileID, dictPath, remotePath, false, stats.Permissions, stats.LastMod, stats.ChunkCount, stats.HashString)
+	}
+	if err != nil {
+		return 0, fmt.Errorf("Failed to upload the dictionary to %s: %v", remotePath, err)
+	}
+
+	s.dictionaryLock.Lock()
+	delete(s.dictionaries, remotePath)
+	s.dictionaryLock.Unlock()
+	return len(samples), nil
+}
+
+// expandTransform replaces the DictionaryPlaceholder in the transform command
+// with the path of a copy of the dictionary for the remote file's directory,
+// which is written to tmpDir.
+func (s *State) expandTransform(command string, remoteFilepath string, tmpDir string) (string, error) {
+	if !strings.Contains(command, DictionaryPlaceholder) {
+		return command, nil
+	}
+	dict, err := s.getDictionary(path.Join(path.Dir(remoteFilepath), DictionaryName))
+	if err != nil {
+		return "", err
+	}
+	dictPath := filepath.Join(tmpDir, DictionaryName)
+	err = ioutil.WriteFile(dictPath, dict, 0600)
+	if err != nil {
+		return "", fmt.Errorf("Failed to write the dictionary for %s: %v", remoteFilepath, err)
+	}
+	return strings.Replace(command, DictionaryPlaceholder, dictPath, -1), nil
+}
+
+// getDictionary returns the data of the dictionary file on the server,
+// downloading it the first time it's needed.
+func (s *State) getDictionary(remotePath string) ([]byte, error) {
+	s.dictionaryLock.Lock()
+	defer s.dictionaryLock.Unlock()
+	if dict, found := s.dictionaries[remotePath]; found {
+		return dict, nil
+	}
+
+	fi, err := s.GetFileInfoByFilename(remotePath)
+	if err != nil {
+		return nil, fmt.Errorf("Failed to find the dictionary %s; one can be made with train-dict: %v", remotePath, err)
+	}
+	var dict bytes.Buffer
+	_, err = s.downloadVersion(&dict, fi.FileID, fi.CurrentVersion.VersionID, remotePath, fi.CurrentVersion.ChunkCount)
+	if err != nil {
+		return nil, fmt.Errorf("Failed to download the dictionary %s: %v", remotePath, err)
+	}
+
+	if s.dictionaries == nil {
+		s.dictionaries = make(map[string][]byte)
+	}
+	s.dictionaries[remotePath] = dict.Bytes()
+	return dict.Bytes(), nil
+}
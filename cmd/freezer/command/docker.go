@@ -0,0 +1,121 @@
+// Copyright 2017, Timothy Bogdala <tdb@animal-machine.com>
+// See the LICENSE file for more details.
+
+package command
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+)
+
+const (
+	// dockerHelperImage is the image used for the temporary containers that
+	// archive and extract the volume data.
+	dockerHelperImage = "alpine"
+
+	// dockerBackupTimeFormat is the layout used to date the volume archives
+	// so that they sort chronologically.
+	dockerBackupTimeFormat = "20060102-150405"
+)
+
+// runDockerVolumeTar runs tar in a temporary container with the volume mounted
+// at /volume and the local directory mounted at /backup.
+func (s *State) runDockerVolumeTar(volume string, localDir string, readOnly bool, tarArgs ...string) error {
+	volumeMount := volume + ":/volume"
+	if readOnly {
+		volumeMount += ":ro"
+	}
+
+	args := []string{"run", "--rm", "-v", volumeMount, "-v", localDir + ":/backup", dockerHelperImage, "tar"}
+	args = append(args, tarArgs...)
+	output, err := exec.Command("docker", args...).CombinedOutput()
+	if err != nil {
+		return fmt.Errorf("docker failed: %v: %s", err, strings.TrimSpace(string(output)))
+	}
+	return nil
+}
+
+// DockerBackup archives the Docker named volume using a temporary container and
+// uploads the archive to the server as remoteDir/<volume>/<volume>-<date>.tar.gz.
+// The remote file name of the archive is returned along with a non-nil error
+// on failure.
+func (s *State) DockerBackup(volume string, remoteDir string) (string, error) {
+	tmpDir, err := ioutil.TempDir("", "freezer-docker")
+	if err != nil {
+		return "", fmt.Errorf("Failed to create a temporary directory for the archive: %v", err)
+	}
+	defer os.RemoveAll(tmpDir)
+
+	archiveName := fmt.Sprintf("%s-%s.tar.gz", volume, time.Now().UTC().Format(dockerBackupTimeFormat))
+	err = s.runDockerVolumeTar(volume, tmpDir, true, "czf", "/backup/"+archiveName, "-C", "/volume", ".")
+	if err != nil {
+		return "", fmt.Errorf("Failed to archive the volume %s: %v", volume, err)
+	}
+
+	remoteFilepath := strings.Trim(remoteDir, "/") + "/" + volume + "/" + archiveName
+	_, _, err = s.SyncFile(filepath.Join(tmpDir, archiveName), remoteFilepath, SyncCurrentVersion)
+	if err != nil {
+		return "", fmt.Errorf("Failed to upload the archive of volume %s: %v", volume, err)
+	}
+
+	return remoteFilepath, nil
+}
+
+// DockerRestore downloads a volume archive made by DockerBackup and extracts it
+// into the Docker named volume using a temporary container. If remoteFilepath is
+// empty, the latest archive for the volume under remoteDir is restored. Existing
+// files in the volume are overwritten but other files are left in place.
+func (s *State) DockerRestore(volume string, remoteDir string, remoteFilepath string) error {
+	files, err := s.getAllFilesByName()
+	if err != nil {
+		return err
+	}
+
+	if remoteFilepath == "" {
+		// the dated archive names sort chronologically
+		prefix := strings.Trim(remoteDir, "/") + "/" + volume + "/" + volume + "-"
+		var archives []string
+		for name, fi := range files {
+			if !fi.IsDir && strings.HasPrefix(name, prefix) && strings.HasSuffix(name, ".tar.gz") {
+				archives = append(archives, name)
+			}
+		}
+		if len(archives) == 0 {
+			return fmt.Errorf("no archives were found for the volume %s", volume)
+		}
+		sort.Strings(archives)
+		remoteFilepath = archives[len(archives)-1]
+	}
+
+	fi, found := files[remoteFilepath]
+	if !found || fi.IsDir {
+		return fmt.Errorf("the archive %s was not found on the server", remoteFilepath)
+	}
+
+	tmpDir, err := ioutil.TempDir("", "freezer-docker")
+	if err != nil {
+		return fmt.Errorf("Failed to create a temporary directory for the archive: %v", err)
+	}
+	defer os.RemoveAll(tmpDir)
+
+	archiveName := filepath.Base(remoteFilepath)
+	_, err = s.syncDownload(fi.FileID, fi.CurrentVersion.VersionID, filepath.Join(tmpDir, archiveName),
+		remoteFilepath, fi.CurrentVersion.ChunkCount)
+	if err != nil {
+		return fmt.Errorf("Failed to download the archive %s: %v", remoteFilepath, err)
+	}
+
+	err = s.runDockerVolumeTar(volume, tmpDir, false, "xzf", "/backup/"+archiveName, "-C", "/volume")
+	if err != nil {
+		return fmt.Errorf("Failed to extract the archive into the volume %s: %v", volume, err)
+	}
+
+	s.Printf("%s ==> restored into volume %s\n", remoteFilepath, volume)
+	return nil
+}
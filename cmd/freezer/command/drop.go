@@ -0,0 +1,225 @@
+// Copyright 2017, Timothy Bogdala <tdb@animal-machine.com>
+// See the LICENSE file for more details.
+
+package command
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path"
+	"strings"
+	"time"
+
+	"github.com/marcoziti/gringotts"
+	"github.com/marcoziti/gringotts/cmd/freezer/models"
+)
+
+// CreateDrop creates an upload-only drop token that lets anyone holding it upload
+// files into remoteDir without being able to read anything in the account. Each
+// file can be at most maxFileSize bytes and at most maxFiles files can be uploaded;
+// zero for maxFiles removes the count limit. The folder name is encrypted before
+// it's sent to the server like any other file name.
+func (s *State) CreateDrop(remoteDir string, maxFileSize int64, maxFiles int) (*filefreezer.DropToken, error) {
+	if err := s.requireFeature(models.FeatureDrops); err != nil {
+		return nil, err
+	}
+
+	remoteDir = strings.Trim(remoteDir, "/")
+	cryptoFolder, err := s.EncryptString(remoteDir)
+	if err != nil {
+		return nil, fmt.Errorf("Could not encrypt the drop folder name: %v", err)
+	}
+
+	var postReq models.DropCreateRequest
+	postReq.Folder = cryptoFolder
+	postReq.MaxFileSize = maxFileSize
+	postReq.MaxFiles = maxFiles
+	target := fmt.Sprintf("%s/api/drops", s.HostURI)
+	body, err := s.RunAuthRequest(target, "POST", s.AuthToken, postReq)
+	if err != nil {
+		return nil, fmt.Errorf("Failed to create the drop token: %v", err)
+	}
+
+	var postResp models.DropCreateResponse
+	err = json.Unmarshal(body, &postResp)
+	if err != nil {
+		return nil, fmt.Errorf("Failed to read the response for creating the drop token: %v", err)
+	}
+
+	postResp.Folder = remoteDir
+	return &postResp.DropToken, nil
+}
+
+// GetDrops returns all of the drop tokens for the authenticated user with
+// their folder names decrypted.
+func (s *State) GetDrops() ([]filefreezer.DropToken, error) {
+	if err := s.requireFeature(models.FeatureDrops); err != nil {
+		return nil, err
+	}
+
+	target := fmt.Sprintf("%s/api/drops", s.HostURI)
+	body, err := s.RunAuthRequest(target, "GET", s.AuthToken, nil)
+	if err != nil {
+		return nil, fmt.Errorf("Failed to get the list of drop tokens: %v", err)
+	}
+
+	var resp models.DropsGetResponse
+	err = json.Unmarshal(body, &resp)
+	if err != nil {
+		return nil, fmt.Errorf("Failed to read the list of drop tokens: %v", err)
+	}
+
+	for i, dt := range resp.Drops {
+		resp.Drops[i].Folder, err = s.DecryptString(dt.Folder)
+		if err != nil {
+			return nil, fmt.Errorf("Failed to decrypt the folder name for a drop token: %v", err)
+		}
+	}
+
+	return resp.Drops, nil
+}
+
+// RmDrop revokes the drop token so that no more files can be uploaded with it.
+// Files already uploaded with the token can still be collected.
+func (s *State) RmDrop(token string) error {
+	drops, err := s.GetDrops()
+	if err != nil {
+		return err
+	}
+
+	for _, dt := range drops {
+		if dt.Token != token {
+			continue
+		}
+
+		target := fmt.Sprintf("%s/api/drop/%d", s.HostURI, dt.DropID)
+		body, err := s.RunAuthRequest(target, "DELETE", s.AuthToken, nil)
+		if err != nil {
+			return fmt.Errorf("Failed to revoke the drop token: %v", err)
+		}
+
+		var resp models.DropDeleteResponse
+		err = json.Unmarshal(body, &resp)
+		if err != nil || resp.Success == false {
+			return fmt.Errorf("Failed to revoke the drop token: %v", err)
+		}
+
+		s.Println("Drop token revoked")
+		return nil
+	}
+
+	return fmt.Errorf("the drop token was not found")
+}
+
+// CollectDrops moves the files uploaded with the user's drop tokens into their
+// folders, encrypting them like any other file, and then removes the unencrypted
+// copies from the server. Files whose names are already taken get a number
+// appended instead of replacing the existing file. The number of collected
+// files is returned along with a non-nil error on failure.
+func (s *State) CollectDrops() (collectCount int, e error) {
+	if err := s.requireFeature(models.FeatureDrops); err != nil {
+		return 0, err
+	}
+
+	target := fmt.Sprintf("%s/api/dropfiles", s.HostURI)
+	body, err := s.RunAuthRequest(target, "GET", s.AuthToken, nil)
+	if err != nil {
+		return 0, fmt.Errorf("Failed to get the list of drop files: %v", err)
+	}
+
+	var resp models.DropFilesGetResponse
+	err = json.Unmarshal(body, &resp)
+	if err != nil {
+		return 0, fmt.Errorf("Failed to read the list of drop files: %v", err)
+	}
+	if len(resp.Files) == 0 {
+		return 0, nil
+	}
+
+	remoteFiles, err := s.getAllFilesByName()
+	if err != nil {
+		return 0, err
+	}
+
+	for _, df := range resp.Files {
+		folder, err := s.DecryptString(df.Folder)
+		if err != nil {
+			return collectCount, fmt.Errorf("Failed to decrypt the folder name for a drop file: %v", err)
+		}
+
+		remoteFilepath := uniqueRemoteName(remoteFiles, folder+"/"+df.Name)
+		err = s.collectDropFile(df, remoteFilepath)
+		if err != nil {
+			return collectCount, err
+		}
+		remoteFiles[remoteFilepath] = filefreezer.FileInfo{}
+		collectCount++
+	}
+
+	return collectCount, nil
+}
+
+// collectDropFile downloads the drop file, syncs it to remoteFilepath and then
+// removes the drop file from the server.
+func (s *State) collectDropFile(df filefreezer.DropFile, remoteFilepath string) error {
+	target := fmt.Sprintf("%s/api/dropfile/%d", s.HostURI, df.DropFileID)
+	data, err := s.RunAuthRequest(target, "GET", s.AuthToken, nil)
+	if err != nil {
+		return fmt.Errorf("Failed to download the drop file %s: %v", df.Name, err)
+	}
+
+	tmpFile, err := ioutil.TempFile("", "freezer-drop")
+	if err != nil {
+		return fmt.Errorf("Failed to create a temporary file for the drop file: %v", err)
+	}
+	tmpName := tmpFile.Name()
+	defer os.Remove(tmpName)
+
+	_, err = tmpFile.Write(data)
+	tmpFile.Close()
+	if err != nil {
+		return fmt.Errorf("Failed to write the drop file %s to a temporary file: %v", df.Name, err)
+	}
+	uploaded := time.Unix(df.Uploaded, 0)
+	os.Chtimes(tmpName, uploaded, uploaded)
+
+	_, _, err = s.SyncFile(tmpName, remoteFilepath, SyncCurrentVersion)
+	if err != nil {
+		return fmt.Errorf("Failed to upload the drop file %s: %v", df.Name, err)
+	}
+
+	// only remove the unencrypted copy once it's safely stored
+	body, err := s.RunAuthRequest(target, "DELETE", s.AuthToken, nil)
+	if err != nil {
+		return fmt.Errorf("Failed to remove the collected drop file %s: %v", df.Name, err)
+	}
+
+	var resp models.DropFileDeleteResponse
+	err = json.Unmarshal(body, &resp)
+	if err != nil || resp.Success == false {
+		return fmt.Errorf("Failed to remove the collected drop file %s: %v", df.Name, err)
+	}
+
+	s.Printf("%s ==> collected\n", remoteFilepath)
+	return nil
+}
+
+// uniqueRemoteName returns remoteFilepath if it isn't in use or otherwise the
+// first name with a number appended before the extension that isn't in use.
+func uniqueRemoteName(files map[string]filefreezer.FileInfo, remoteFilepath string) string {
+	_, found := files[remoteFilepath]
+	if !found {
+		return remoteFilepath
+	}
+
+	ext := path.Ext(remoteFilepath)
+	stem := strings.TrimSuffix(remoteFilepath, ext)
+	for i := 1; ; i++ {
+		candidate := fmt.Sprintf("%s (%d)%s", stem, i, ext)
+		if _, found := files[candidate]; !found {
+			return candidate
+		}
+	}
+}
@@ -0,0 +1,88 @@
+// Copyright 2017, Timothy Bogdala <tdb@animal-machine.com>
+// See the LICENSE file for more details.
+
+package command
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+)
+
+// DiskUsage is the storage used by a file or directory on the server.
+type DiskUsage struct {
+	// Name is the path of the file or directory
+	Name string
+
+	// Files is the number of files counted, not including directories
+	Files int
+
+	// Current is the number of bytes stored for the current versions
+	Current int64
+
+	// Total is the number of bytes stored for all of the versions
+	Total int64
+}
+
+// add counts a file towards the usage.
+func (du *DiskUsage) add(current int64, total int64) {
+	du.Files++
+	du.Current += current
+	du.Total += total
+}
+
+// GetDiskUsage returns the storage used under remotePath on the server for
+// each file and directory directly inside it, sorted by name, along with the
+// total for remotePath. An empty remotePath covers all of the user's files.
+// The sizes are totaled by the server so no chunk information is downloaded.
+func (s *State) GetDiskUsage(remotePath string) ([]DiskUsage, DiskUsage, error) {
+	files, err := s.getAllFilesByName()
+	if err != nil {
+		return nil, DiskUsage{}, err
+	}
+
+	prefix := strings.Trim(remotePath, "/")
+	total := DiskUsage{Name: prefix}
+	entries := make(map[string]*DiskUsage)
+	for name, fi := range files {
+		rel := strings.TrimPrefix(name, "/")
+		if prefix != "" {
+			if rel != prefix && !strings.HasPrefix(rel, prefix+"/") {
+				continue
+			}
+			rel = strings.TrimPrefix(strings.TrimPrefix(rel, prefix), "/")
+		}
+		if fi.IsDir {
+			continue
+		}
+		total.add(fi.CurrentVersion.Size, fi.Size)
+
+		// group everything under the first path element below the prefix
+		entryName := prefix
+		if rel != "" {
+			entryName = strings.SplitN(rel, "/", 2)[0]
+			if prefix != "" {
+				entryName = prefix + "/" + entryName
+			}
+		}
+		entry, found := entries[entryName]
+		if !found {
+			entry = &DiskUsage{Name: entryName}
+			entries[entryName] = entry
+		}
+		entry.add(fi.CurrentVersion.Size, fi.Size)
+	}
+
+	if total.Files == 0 {
+		if _, _, found := findRemoteFile(files, remotePath); !found && prefix != "" {
+			return nil, total, fmt.Errorf("no files were found on the server for %s", remotePath)
+		}
+	}
+
+	result := make([]DiskUsage, 0, len(entries))
+	for _, entry := range entries {
+		result = append(result, *entry)
+	}
+	sort.Slice(result, func(i, j int) bool { return result[i].Name < result[j].Name })
+	return result, total, nil
+}
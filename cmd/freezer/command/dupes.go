@@ -0,0 +1,69 @@
+// Copyright 2017, Timothy Bogdala <tdb@animal-machine.com>
+// See the LICENSE file for more details.
+
+package command
+
+import (
+	"encoding/json"
+	"fmt"
+	"sort"
+
+	"github.com/marcoziti/gringotts/cmd/freezer/models"
+)
+
+// DuplicateFiles is a set of files on the server whose current versions
+// have the same content.
+type DuplicateFiles struct {
+	// FileHash is the content hash shared by the files
+	FileHash string
+
+	// Size is the number of bytes stored for the current version of each file
+	Size int64
+
+	// FileNames are the decrypted names of the files, sorted
+	FileNames []string
+}
+
+// GetDuplicateFiles asks the server for the authenticated user's files that
+// have the same content in their current versions. The groups are returned
+// ordered by their first file name.
+func (s *State) GetDuplicateFiles() ([]DuplicateFiles, error) {
+	if err := s.requireFeature(models.FeatureDuplicates); err != nil {
+		return nil, err
+	}
+
+	target := fmt.Sprintf("%s/api/files/duplicates", s.HostURI)
+	body, err := s.RunAuthRequest(target, "GET", s.AuthToken, nil)
+	if err != nil {
+		return nil, fmt.Errorf("Failed to get the duplicate files: %v", err)
+	}
+
+	var r models.DuplicateFilesGetResponse
+	err = json.Unmarshal(body, &r)
+	if err != nil {
+		return nil, fmt.Errorf("Poorly formatted response to %s: %v", target, err)
+	}
+
+	dupes := make([]DuplicateFiles, 0, len(r.Groups))
+	for _, group := range r.Groups {
+		if len(group) == 0 {
+			continue
+		}
+		df := DuplicateFiles{
+			FileHash: group[0].CurrentVersion.FileHash,
+			Size:     group[0].CurrentVersion.Size,
+		}
+		for _, fi := range group {
+			name, err := s.DecryptString(fi.FileName)
+			if err != nil {
+				return nil, fmt.Errorf("Failed to decrypt remote file name for file id %d: %v", fi.FileID, err)
+			}
+			df.FileNames = append(df.FileNames, name)
+		}
+		sort.Strings(df.FileNames)
+		dupes = append(dupes, df)
+	}
+	sort.Slice(dupes, func(i, j int) bool { return dupes[i].FileNames[0] < dupes[j].FileNames[0] })
+
+	return dupes, nil
+}
@@ -0,0 +1,55 @@
+// Copyright 2017, Timothy Bogdala <tdb@animal-machine.com>
+// See the LICENSE file for more details.
+
+package command
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+)
+
+// The errors that State methods wrap for the failures callers act on, so
+// that they can be told apart with errors.Is instead of matching messages.
+var (
+	// ErrFileNotFound is returned when the server has no file by the name,
+	// or when it answers a request with 404 Not Found.
+	ErrFileNotFound = errors.New("could not find the file")
+
+	// ErrConflict is returned when the server answers 409 Conflict, such as
+	// for adding a file whose name is taken or changing a locked file.
+	ErrConflict = errors.New("the request conflicts with the data on the server")
+
+	// ErrUnauthorized is returned when the server answers 401 Unauthorized,
+	// such as for a bad password or a token that can't be renewed.
+	ErrUnauthorized = errors.New("the request was not authorized")
+)
+
+// StatusError is returned for a request the server didn't answer with 200 OK.
+type StatusError struct {
+	Method     string
+	Target     string
+	StatusCode int
+	Status     string
+
+	// Body is the message the server sent with the status
+	Body string
+}
+
+func (e *StatusError) Error() string {
+	return fmt.Sprintf("Failed to make the HTTP %s request to %s (status: %s): %v", e.Method, e.Target, e.Status, e.Body)
+}
+
+// Unwrap returns ErrFileNotFound, ErrConflict or ErrUnauthorized for those
+// statuses and nil for the others.
+func (e *StatusError) Unwrap() error {
+	switch e.StatusCode {
+	case http.StatusNotFound:
+		return ErrFileNotFound
+	case http.StatusConflict:
+		return ErrConflict
+	case http.StatusUnauthorized:
+		return ErrUnauthorized
+	}
+	return nil
+}
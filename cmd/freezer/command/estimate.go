@@ -0,0 +1,74 @@
+// Copyright 2017, Timothy Bogdala <tdb@animal-machine.com>
+// See the LICENSE file for more details.
+
+package command
+
+import (
+	"fmt"
+	"os"
+)
+
+// SyncEstimate is how much a sync would transfer.
+type SyncEstimate struct {
+	// Files is the number of files the sync would change.
+	Files int
+
+	// the chunks and bytes, as sent with encryption, that would be uploaded
+	UploadChunks int
+	UploadBytes  int64
+
+	// the chunks and bytes, as stored on the server, that would be downloaded
+	DownloadChunks int
+	DownloadBytes  int64
+}
+
+// EstimateSync works out how many chunks and bytes a sync of localPath, a
+// file or a directory, with remotePath on the server would transfer without
+// transferring any file data. The files that would change are found like
+// CheckSync does. Uploads are sized from the local files since every chunk of
+// a changed file is sent, and downloads are sized from the chunks the server
+// has stored for the current versions. Conflicts are counted as both.
+func (s *State) EstimateSync(localPath string, remotePath string) (SyncEstimate, []SyncDifference, error) {
+	var estimate SyncEstimate
+	remoteFiles, err := s.getAllFilesByName()
+	if err != nil {
+		return estimate, nil, err
+	}
+	diffs, err := s.checkSync(localPath, remotePath, remoteFiles)
+	if err != nil {
+		return estimate, nil, err
+	}
+
+	estimate.Files = len(diffs)
+	for _, diff := range diffs {
+		upload := diff.Status == SyncDiffLocalOnly || diff.Status == SyncDiffLocalNewer || diff.Status == SyncDiffConflict
+		download := diff.Status == SyncDiffRemoteOnly || diff.Status == SyncDiffRemoteNewer || diff.Status == SyncDiffConflict
+
+		if upload {
+			info, err := os.Stat(diff.LocalPath)
+			if err != nil {
+				return estimate, diffs, fmt.Errorf("Failed to read the local file %s: %v", diff.LocalPath, err)
+			}
+			if !info.IsDir() {
+				_, chunkSize := s.chunkSizes()
+				chunks := int((info.Size() + chunkSize - 1) / chunkSize)
+				estimate.UploadChunks += chunks
+				estimate.UploadBytes += info.Size() + int64(chunks)*cryptoOverhead
+			}
+		}
+
+		remote := remoteFiles[diff.RemotePath]
+		if download && !remote.IsDir {
+			chunks, err := s.getFileChunkInfos(remote.FileID, remote.CurrentVersion.VersionID)
+			if err != nil {
+				return estimate, diffs, fmt.Errorf("Failed to get the chunks of %s: %v", diff.RemotePath, err)
+			}
+			for _, c := range chunks {
+				estimate.DownloadChunks++
+				estimate.DownloadBytes += c.Length
+			}
+		}
+	}
+
+	return estimate, diffs, nil
+}
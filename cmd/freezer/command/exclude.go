@@ -0,0 +1,108 @@
+// Copyright 2017, Timothy Bogdala <tdb@animal-machine.com>
+// See the LICENSE file for more details.
+
+package command
+
+import (
+	"path"
+	"path/filepath"
+	"strings"
+)
+
+// defaultExclusions are the directories and files in a home directory that
+// are skipped by SyncDirectory on each OS, like the ones Time Machine leaves
+// out: caches, the trash, logs and thumbnails that are rebuilt or thrown
+// away anyway. Patterns with a slash are matched against the path relative
+// to the home directory and the ones without against each file name.
+var defaultExclusions = map[string][]string{
+	"darwin": {
+		".Trash",
+		"Library/Caches",
+		"Library/Logs",
+		"Library/Containers/*/Data/Library/Caches",
+		"Library/Developer/Xcode/DerivedData",
+		"Library/Developer/CoreSimulator/Caches",
+		".cache",
+		".DS_Store",
+		".Spotlight-V100",
+		".fseventsd",
+	},
+	"linux": {
+		".cache",
+		".local/share/Trash",
+		".thumbnails",
+		".npm/_cacache",
+		".gradle/caches",
+		".xsession-errors",
+	},
+	"windows": {
+		"AppData/Local/Temp",
+		"AppData/Local/CrashDumps",
+		"AppData/Local/Microsoft/Windows/INetCache",
+		"AppData/Local/Microsoft/Windows/Explorer",
+		"AppData/Local/Google/Chrome/User Data/*/Cache",
+		"AppData/Local/Mozilla/Firefox/Profiles/*/cache2",
+		"Thumbs.db",
+	},
+}
+
+// DefaultExclusions returns the paths SyncDirectory skips in a home directory
+// on the OS, such as runtime.GOOS, or nil if there aren't any for it.
+func DefaultExclusions(goos string) []string {
+	return defaultExclusions[goos]
+}
+
+// excluded returns true if SyncDirectory should skip the local file found
+// while syncing localDir. A policy marked Exclude or Include decides it and
+// otherwise the file is skipped if it, or a directory it's in below localDir,
+// is in the HomeDir and matches one of the Exclusions without a policy
+// marking it Include.
+func (s *State) excluded(localDir string, localFilename string, remoteFilepath string) bool {
+	if p := s.policyFor(remoteFilepath); p != nil && (p.Exclude || p.Include) {
+		return p.Exclude
+	}
+	if s.HomeDir == "" || len(s.Exclusions) == 0 {
+		return false
+	}
+
+	// the paths relative to the home directory of the file and of the
+	// directory being synced, which is never excluded itself
+	rel, ok := s.homeRelative(localFilename)
+	if !ok {
+		return false
+	}
+	top, ok := s.homeRelative(localDir)
+	if !ok {
+		top = "."
+	}
+
+	d, remoteDir := rel, remoteFilepath
+	for ; d != "." && d != top; d, remoteDir = path.Dir(d), path.Dir(remoteDir) {
+		for _, pattern := range s.Exclusions {
+			name := d
+			if !strings.Contains(pattern, "/") {
+				name = path.Base(d)
+			}
+			if matched, _ := path.Match(pattern, name); !matched {
+				continue
+			}
+			p := s.policyFor(remoteDir)
+			return p == nil || !p.Include
+		}
+	}
+	return false
+}
+
+// homeRelative returns the slash separated path of the local file relative
+// to the HomeDir and true if it's in the home directory.
+func (s *State) homeRelative(localFilename string) (string, bool) {
+	absFilename, err := filepath.Abs(localFilename)
+	if err != nil {
+		return "", false
+	}
+	rel, err := filepath.Rel(s.HomeDir, absFilename)
+	if err != nil || rel == ".." || strings.HasPrefix(rel, ".."+string(filepath.Separator)) {
+		return "", false
+	}
+	return filepath.ToSlash(rel), true
+}
@@ -0,0 +1,67 @@
+// Copyright 2017, Timothy Bogdala <tdb@animal-machine.com>
+// See the LICENSE file for more details.
+
+package command
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// exportTimeFormat is the layout used to timestamp exported version files;
+// it avoids characters that are not valid in filenames on some platforms.
+const exportTimeFormat = "2006-01-02T150405"
+
+// ExportHistory downloads every stored version of the remote file into the
+// local directory, naming each one with the version's modification time and
+// version number (e.g. report.2017-06-01T134500.v3.txt). The modification
+// time of each exported file is set to the one recorded for the version.
+// The number of versions exported is returned along with a non-nil error
+// on failure.
+func (s *State) ExportHistory(remoteFilepath string, localDir string) (exportCount int, e error) {
+	fi, err := s.GetFileInfoByFilename(remoteFilepath)
+	if err != nil {
+		return 0, fmt.Errorf("Failed to get the file information for %s: %v", remoteFilepath, err)
+	}
+	if fi.IsDir {
+		return 0, fmt.Errorf("%s is a directory and has no version data to export", remoteFilepath)
+	}
+
+	versions, err := s.GetFileVersions(remoteFilepath)
+	if err != nil {
+		return 0, err
+	}
+
+	err = os.MkdirAll(localDir, os.ModeDir|os.ModePerm)
+	if err != nil {
+		return 0, fmt.Errorf("Failed to create the export directory %s: %v", localDir, err)
+	}
+
+	base := filepath.Base(remoteFilepath)
+	ext := filepath.Ext(base)
+	stem := strings.TrimSuffix(base, ext)
+
+	for _, v := range versions {
+		modTime := time.Unix(v.LastMod, 0)
+		exportName := fmt.Sprintf("%s.%s.v%d%s", stem, modTime.UTC().Format(exportTimeFormat), v.VersionNumber, ext)
+		exportPath := filepath.Join(localDir, exportName)
+
+		_, err = s.syncDownload(fi.FileID, v.VersionID, exportPath, remoteFilepath, v.ChunkCount)
+		if err != nil {
+			return exportCount, fmt.Errorf("Failed to export version %d of %s: %v", v.VersionNumber, remoteFilepath, err)
+		}
+
+		err = os.Chtimes(exportPath, modTime, modTime)
+		if err != nil {
+			return exportCount, fmt.Errorf("Failed to set the modification time on %s: %v", exportPath, err)
+		}
+
+		s.Printf("%s ==> %s\n", remoteFilepath, exportPath)
+		exportCount++
+	}
+
+	return exportCount, nil
+}
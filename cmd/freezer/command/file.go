@@ -7,8 +7,9 @@ import (
 	"encoding/json"
 	"fmt"
 	"log"
-	"regexp"
+	"sort"
 	"strconv"
+	"strings"
 
 	"github.com/marcoziti/gringotts"
 	"github.com/marcoziti/gringotts/cmd/freezer/models"
@@ -17,14 +18,15 @@ import (
 // GetFileInfoByFilename takes the long way of finding a FileInfo object
 // by scanning all FileInfo objects registered for a given user. If a matching
 // file is found it is returned and the error value will be null; otherwise
-// an error will be set.
+// an error will be set, which wraps ErrFileNotFound if the server has no file
+// by that name.
 // NOTE: implemented like this to support encrypted filenames.
 func (s *State) GetFileInfoByFilename(filename string) (foundFile filefreezer.FileInfo, e error) {
 	// get the entire file info list so that we can go through each file info
 	// and find the right one for a given filename.
 	allFileInfos, err := s.GetAllFileHashes()
 	if err != nil {
-		return foundFile, fmt.Errorf("failed to getall of the file hashes: %v", err)
+		return foundFile, fmt.Errorf("failed to getall of the file hashes: %w", err)
 	}
 
 	// iterate through all of the files
@@ -39,7 +41,7 @@ func (s *State) GetFileInfoByFilename(filename string) (foundFile filefreezer.Fi
 		}
 	}
 
-	return foundFile, fmt.Errorf("could not find the file: %s", filename)
+	return foundFile, fmt.Errorf("%w: %s", ErrFileNotFound, filename)
 }
 
 // RmFile takes the filename and attempts to find it in the list of filenames
@@ -54,9 +56,9 @@ func (s *State) RmFile(filename string, dryRun bool) error {
 
 	if !dryRun {
 		target := fmt.Sprintf("%s/api/file/%d", s.HostURI, fi.FileID)
-		_, err = s.RunAuthRequest(target, "DELETE", s.AuthToken, nil)
+		_, err = s.RunIdempotentRequest(target, "DELETE", s.AuthToken, nil)
 		if err != nil {
-			return fmt.Errorf("Failed to remove the file %s: %v", filename, err)
+			return fmt.Errorf("Failed to remove the file %s: %w", filename, err)
 		}
 	}
 
@@ -65,34 +67,79 @@ func (s *State) RmFile(filename string, dryRun bool) error {
 	return nil
 }
 
-// RmRxFiles removes files by regular expression matching against the filenames.
+// RmRxFiles removes files by regular expression matching against the filenames
+// with opts changing how the pattern is matched.
 // The dryRun argument controls whether or not the actual removeal request is
 // sent to the server allowing the user to preview the result of the regex match.
 // A non-nil error is returned on failure.
-func (s *State) RmRxFiles(pattern string, dryRun bool) error {
-	allFiles, err := s.GetAllFileHashes()
+func (s *State) RmRxFiles(pattern string, opts MatchOptions, dryRun bool) error {
+	compiledFilter, err := NewFileMatcher(pattern, opts)
+	if err != nil {
+		return err
+	}
+
+	matched, err := s.rmMatchingFiles(func(plaintextFilename string, fi filefreezer.FileInfo) bool {
+		return compiledFilter.Match(plaintextFilename)
+	}, dryRun)
+	if err != nil {
+		return err
+	}
+	s.warnNoMatches(pattern, matched)
+
+	return nil
+}
+
+// RmIgnoredFiles removes the files under remoteDir on the server that the
+// IgnoreFileName files in localDir ignore, such as build artifacts uploaded
+// before they were ignored, so that syncs of localDir with remoteDir no longer
+// leave them behind. The dryRun argument works like it does for RmRxFiles.
+func (s *State) RmIgnoredFiles(localDir string, remoteDir string, dryRun bool) error {
+	ignore, err := loadIgnoreFiles(localDir)
 	if err != nil {
-		return fmt.Errorf("could not get all of the files from the server: %v", err)
+		return err
+	}
+	if len(remoteDir) > 1 {
+		remoteDir = strings.TrimSuffix(remoteDir, "/")
 	}
 
-	compiledFilter, err := regexp.Compile(pattern)
+	matched, err := s.rmMatchingFiles(func(plaintextFilename string, fi filefreezer.FileInfo) bool {
+		if !strings.HasPrefix(plaintextFilename, remoteDir+"/") {
+			return false
+		}
+		return ignore.Match(plaintextFilename[len(remoteDir)+1:], fi.IsDir)
+	}, dryRun)
 	if err != nil {
-		return fmt.Errorf("failed to compile the regular expression: %v", err)
+		return err
+	}
+	if matched == 0 {
+		s.Printf("No files on the server under %s are ignored by %s.\n", remoteDir, IgnoreFileName)
+	}
+
+	return nil
+}
+
+// rmMatchingFiles removes the files whose decrypted names are selected by
+// match, or only prints them on a dryRun, and returns how many there were.
+func (s *State) rmMatchingFiles(match func(plaintextFilename string, fi filefreezer.FileInfo) bool, dryRun bool) (matched int, e error) {
+	allFiles, err := s.GetAllFileHashes()
+	if err != nil {
+		return 0, fmt.Errorf("could not get all of the files from the server: %w", err)
 	}
 
 	for _, fi := range allFiles {
 		plaintextFilename, err := s.DecryptString(fi.FileName)
 		if err != nil {
-			return fmt.Errorf("failed to decrypt one of the file names: %v", err)
+			return matched, fmt.Errorf("failed to decrypt one of the file names: %v", err)
 		}
 
-		if compiledFilter.MatchString(plaintextFilename) {
+		if match(plaintextFilename, fi) {
+			matched++
 			// only attempt to actually delete when not on a dryRun
 			if !dryRun {
 				target := fmt.Sprintf("%s/api/file/%d", s.HostURI, fi.FileID)
-				_, err = s.RunAuthRequest(target, "DELETE", s.AuthToken, nil)
+				_, err = s.RunIdempotentRequest(target, "DELETE", s.AuthToken, nil)
 				if err != nil {
-					return fmt.Errorf("Failed to remove the file %s: %v", plaintextFilename, err)
+					return matched, fmt.Errorf("Failed to remove the file %s: %w", plaintextFilename, err)
 				}
 			}
 
@@ -100,6 +147,100 @@ func (s *State) RmRxFiles(pattern string, dryRun bool) error {
 		}
 	}
 
+	return matched, nil
+}
+
+// FileRename is a planned change of a file's name on the server.
+type FileRename struct {
+	FileID int
+	From   string
+	To     string
+}
+
+// PlanRxRenames matches the regular expression pattern against all of the file
+// names on the server and returns the renames that would result from replacing
+// the matches with replacement, which can refer to capture groups like $1.
+// The renames are sorted by their current name. An error is returned if two
+// files would end up with the same name or if a new name is already taken by
+// a file that isn't being renamed. Inverted matches can't be used since there
+// would be nothing to replace.
+func (s *State) PlanRxRenames(pattern string, replacement string, opts MatchOptions) ([]FileRename, error) {
+	if err := s.requireFeature(models.FeatureRename); err != nil {
+		return nil, err
+	}
+
+	if opts.Invert {
+		return nil, fmt.Errorf("an inverted pattern can't be used to rename files")
+	}
+	compiledFilter, err := NewFileMatcher(pattern, opts)
+	if err != nil {
+		return nil, err
+	}
+
+	files, err := s.getAllFilesByName()
+	if err != nil {
+		return nil, fmt.Errorf("could not get all of the files from the server: %w", err)
+	}
+
+	var renames []FileRename
+	matched := 0
+	for name, fi := range files {
+		if !compiledFilter.Match(name) {
+			continue
+		}
+		matched++
+		newName := compiledFilter.Replace(name, replacement)
+		if newName == name {
+			continue
+		}
+		if newName == "" {
+			return nil, fmt.Errorf("the new name for %s would be empty", name)
+		}
+		renames = append(renames, FileRename{FileID: fi.FileID, From: name, To: newName})
+	}
+	sort.Slice(renames, func(i, j int) bool { return renames[i].From < renames[j].From })
+	s.warnNoMatches(pattern, matched)
+
+	// names only stay taken if their file isn't being renamed away
+	renamed := make(map[string]bool, len(renames))
+	for _, r := range renames {
+		renamed[r.From] = true
+	}
+	targets := make(map[string]string, len(renames))
+	for _, r := range renames {
+		if other, found := targets[r.To]; found {
+			return nil, fmt.Errorf("both %s and %s would be renamed to %s", other, r.From, r.To)
+		}
+		targets[r.To] = r.From
+		if _, exists := files[r.To]; exists && !renamed[r.To] {
+			return nil, fmt.Errorf("%s can't be renamed to %s because that file already exists", r.From, r.To)
+		}
+	}
+
+	return renames, nil
+}
+
+// RenameFiles applies the renames on the server in order. The new names are
+// encrypted before they're sent like all file names. A non-nil error is
+// returned on the first failure, leaving the remaining files unchanged.
+func (s *State) RenameFiles(renames []FileRename) error {
+	for _, r := range renames {
+		var putReq models.FileRenameRequest
+		var err error
+		putReq.FileName, err = s.EncryptString(r.To)
+		if err != nil {
+			return fmt.Errorf("Failed to encrypt the new name for %s: %v", r.From, err)
+		}
+
+		target := fmt.Sprintf("%s/api/file/%d", s.HostURI, r.FileID)
+		_, err = s.RunAuthRequest(target, "PUT", s.AuthToken, putReq)
+		if err != nil {
+			return fmt.Errorf("Failed to rename the file %s to %s: %w", r.From, r.To, err)
+		}
+
+		s.Printf("Renamed file: %s -> %s\n", r.From, r.To)
+	}
+
 	return nil
 }
 
@@ -107,9 +248,9 @@ func (s *State) RmRxFiles(pattern string, dryRun bool) error {
 // delete the object. A non-nil error is returned on failure.
 func (s *State) RmFileByID(fileID int) error {
 	target := fmt.Sprintf("%s/api/file/%d", s.HostURI, fileID)
-	_, err := s.RunAuthRequest(target, "DELETE", s.AuthToken, nil)
+	_, err := s.RunIdempotentRequest(target, "DELETE", s.AuthToken, nil)
 	if err != nil {
-		return fmt.Errorf("Failed to remove the file by file ID (%d): %v", fileID, err)
+		return fmt.Errorf("Failed to remove the file by file ID (%d): %w", fileID, err)
 	}
 
 	s.Printf("Removed file by ID: %d\n", fileID)
@@ -129,7 +270,7 @@ func (s *State) GetFileVersions(filename string) (versions []filefreezer.FileVer
 	target := fmt.Sprintf("%s/api/file/%d/versions", s.HostURI, fi.FileID)
 	body, err := s.RunAuthRequest(target, "GET", s.AuthToken, nil)
 	if err != nil {
-		return nil, fmt.Errorf("Failed to get the file versions for %s: %v", target, err)
+		return nil, fmt.Errorf("Failed to get the file versions for %s: %w", target, err)
 	}
 
 	var r models.FileGetAllVersionsResponse
@@ -138,6 +279,18 @@ func (s *State) GetFileVersions(filename string) (versions []filefreezer.FileVer
 		return nil, fmt.Errorf("Failed to get the file versions: %v", err)
 	}
 
+	// device names are encrypted like file names; versions from older
+	// clients don't have one
+	for i, v := range r.Versions {
+		if v.Device == "" {
+			continue
+		}
+		r.Versions[i].Device, err = s.DecryptString(v.Device)
+		if err != nil {
+			return nil, fmt.Errorf("Failed to decrypt the device name for version %d: %v", v.VersionNumber, err)
+		}
+	}
+
 	return r.Versions, nil
 }
 
@@ -160,9 +313,9 @@ func (s *State) RmFileVersions(filename string, minVersion int, maxVersion int,
 	// get the file id for the filename provided
 	if !dryRun {
 		target := fmt.Sprintf("%s/api/file/%d/versions", s.HostURI, fi.FileID)
-		body, err := s.RunAuthRequest(target, "DELETE", s.AuthToken, putReq)
+		body, err := s.RunIdempotentRequest(target, "DELETE", s.AuthToken, putReq)
 		if err != nil {
-			return fmt.Errorf("Failed to delete the file versions for %s: %v", target, err)
+			return fmt.Errorf("Failed to delete the file versions for %s: %w", target, err)
 		}
 
 		var r models.FileDeleteVersionsResponse
@@ -179,26 +332,28 @@ func (s *State) RmFileVersions(filename string, minVersion int, maxVersion int,
 }
 
 // RmRxFileVersions removes a range of versions (inclusive) from minVersion to
-// maxVersion from storage for all files matching a regexp pattern.
-// A non-nil error is returned on failure.
-func (s *State) RmRxFileVersions(pattern string, minVersion int, maxVersionStr string, dryRun bool) error {
+// maxVersion from storage for all files matching a regexp pattern, with opts
+// changing how the pattern is matched. A non-nil error is returned on failure.
+func (s *State) RmRxFileVersions(pattern string, opts MatchOptions, minVersion int, maxVersionStr string, dryRun bool) error {
 	allFiles, err := s.GetAllFileHashes()
 	if err != nil {
-		return fmt.Errorf("could not get all of the files from the server: %v", err)
+		return fmt.Errorf("could not get all of the files from the server: %w", err)
 	}
 
-	compiledFilter, err := regexp.Compile(pattern)
+	compiledFilter, err := NewFileMatcher(pattern, opts)
 	if err != nil {
-		return fmt.Errorf("failed to compile the regular expression: %v", err)
+		return err
 	}
 
+	matched := 0
 	for _, fi := range allFiles {
 		plaintextFilename, err := s.DecryptString(fi.FileName)
 		if err != nil {
 			return fmt.Errorf("failed to decrypt one of the file names: %v", err)
 		}
 
-		if compiledFilter.MatchString(plaintextFilename) {
+		if compiledFilter.Match(plaintextFilename) {
+			matched++
 			var maxVersion int
 			if maxVersionStr == "H~" {
 				maxVersion = fi.CurrentVersion.VersionNumber - 1
@@ -223,9 +378,9 @@ func (s *State) RmRxFileVersions(pattern string, minVersion int, maxVersionStr s
 				putReq.MaxVersion = maxVersion
 
 				target := fmt.Sprintf("%s/api/file/%d/versions", s.HostURI, fi.FileID)
-				body, err := s.RunAuthRequest(target, "DELETE", s.AuthToken, putReq)
+				body, err := s.RunIdempotentRequest(target, "DELETE", s.AuthToken, putReq)
 				if err != nil {
-					return fmt.Errorf("Failed to delete the file versions for %s: %v", plaintextFilename, err)
+					return fmt.Errorf("Failed to delete the file versions for %s: %w", plaintextFilename, err)
 				}
 
 				var r models.FileDeleteVersionsResponse
@@ -242,6 +397,7 @@ func (s *State) RmRxFileVersions(pattern string, minVersion int, maxVersionStr s
 			s.Printf("%s -- successfully removed versions %d to %d.\n", plaintextFilename, minVersion, maxVersion)
 		}
 	}
+	s.warnNoMatches(pattern, matched)
 
 	return nil
 }
@@ -254,7 +410,7 @@ func (s *State) GetMissingChunksForFile(fileID int) ([]int, error) {
 	target := fmt.Sprintf("%s/api/file/%d", s.HostURI, fileID)
 	body, err := s.RunAuthRequest(target, "GET", s.AuthToken, nil)
 	if err != nil {
-		return nil, fmt.Errorf("Failed to get the file's missing chunk list: %v", err)
+		return nil, fmt.Errorf("Failed to get the file's missing chunk list: %w", err)
 	}
 
 	var r models.FileGetResponse
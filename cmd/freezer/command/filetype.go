@@ -0,0 +1,52 @@
+// Copyright 2017, Timothy Bogdala <tdb@animal-machine.com>
+// See the LICENSE file for more details.
+
+package command
+
+import (
+	"bytes"
+	"io"
+	"os"
+)
+
+// compressedMagic are the signatures at the start of file formats whose data
+// is already compressed, so compressing them again only wastes time. The
+// formats that compression transforms write, like gzip and zstd, are left out
+// so that a transform's output is never mistaken for a file that skipped it.
+var compressedMagic = []struct {
+	offset int
+	magic  []byte
+}{
+	{0, []byte{0xFF, 0xD8, 0xFF}},                            // JPEG
+	{0, []byte{0x89, 'P', 'N', 'G', '\r', '\n', 0x1A, '\n'}}, // PNG
+	{0, []byte("GIF8")},                                      // GIF
+	{8, []byte("WEBP")},                                      // WebP
+	{4, []byte("ftyp")},                                      // MP4, MOV, HEIC
+	{0, []byte{0x1A, 0x45, 0xDF, 0xA3}},                      // Matroska, WebM
+	{0, []byte("ID3")},                                       // MP3
+	{0, []byte("OggS")},                                      // Ogg
+	{0, []byte("fLaC")},                                      // FLAC
+	{0, []byte{'P', 'K', 0x03, 0x04}},                        // ZIP, JAR, DOCX
+	{0, []byte{'7', 'z', 0xBC, 0xAF, 0x27, 0x1C}},            // 7z
+	{0, []byte{'R', 'a', 'r', '!', 0x1A, 0x07}},              // RAR
+}
+
+// isCompressedFormat returns true if the file starts with the signature of a
+// format that's already compressed. Files that can't be read aren't.
+func isCompressedFormat(filename string) bool {
+	f, err := os.Open(filename)
+	if err != nil {
+		return false
+	}
+	defer f.Close()
+
+	header := make([]byte, 16)
+	n, _ := io.ReadFull(f, header)
+	header = header[:n]
+	for _, m := range compressedMagic {
+		if len(header) >= m.offset+len(m.magic) && bytes.Equal(header[m.offset:m.offset+len(m.magic)], m.magic) {
+			return true
+		}
+	}
+	return false
+}
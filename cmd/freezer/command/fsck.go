@@ -0,0 +1,42 @@
+// Copyright 2017, Timothy Bogdala <tdb@animal-machine.com>
+// See the LICENSE file for more details.
+
+package command
+
+import (
+	"fmt"
+
+	"github.com/marcoziti/gringotts"
+)
+
+// Fsck cross-checks the file metadata in the storage against the chunks and
+// their data, printing each problem found and a summary. With opts.Repair set
+// the problems are fixed as well; see filefreezer.Storage.Check.
+func (s *State) Fsck(store *filefreezer.Storage, opts filefreezer.CheckOptions) (*filefreezer.CheckReport, error) {
+	report, err := store.Check(opts)
+	if err != nil {
+		return report, fmt.Errorf("Failed to check the storage: %v", err)
+	}
+
+	for _, p := range report.Problems {
+		status := ""
+		if p.Repaired {
+			status = " (repaired)"
+		}
+		switch p.Kind {
+		case filefreezer.CheckAllocation:
+			s.Printf("%s: user %d: %s%s\n", p.Kind, p.UserID, p.Detail, status)
+		case filefreezer.CheckOrphanVersion, filefreezer.CheckMissingVersion:
+			s.Printf("%s: file %d version %d: %s%s\n", p.Kind, p.FileID, p.VersionID, p.Detail, status)
+		default:
+			s.Printf("%s: file %d version %d chunk %d: %s%s\n", p.Kind, p.FileID, p.VersionID, p.ChunkNumber, p.Detail, status)
+		}
+	}
+
+	s.Printf("Checked %d files, %d versions and %d chunks; found %d problems.\n",
+		report.Files, report.Versions, report.Chunks, len(report.Problems))
+	if report.HashesAdded > 0 {
+		s.Printf("Recorded the data hash of %d chunks.\n", report.HashesAdded)
+	}
+	return report, nil
+}
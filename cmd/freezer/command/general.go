@@ -5,57 +5,117 @@ package command
 
 import (
 	"bytes"
+	"crypto/rand"
 	"crypto/tls"
 	"crypto/x509"
+	"encoding/base64"
+	"errors"
 	"fmt"
 	"io"
 	"net/http"
 	"net/url"
 	"os"
+	"strconv"
+	"strings"
+	"time"
 
+	"github.com/marcoziti/gringotts"
 	"github.com/marcoziti/gringotts/cmd/freezer/models"
 
 	"encoding/json"
 	"io/ioutil"
 )
 
+const (
+	// busyAttempts is the number of times a request is made while the server
+	// responds that it's too busy before giving up.
+	busyAttempts = 5
+
+	// retryAttempts is the number of times a request with an idempotency key
+	// is made while it fails in ways that may be temporary, and retryBackoff is
+	// how long to wait before the first retry, which doubles for each one after.
+	retryAttempts = 5
+	retryBackoff  = time.Second
+)
+
 // Authenticate will use a HTTP call to authenticate the user
 // and set the the JWT authentication token string in the command State object.
 func (s *State) Authenticate(hostURI, username, password string) error {
+	reused := s.reusesDerived(hostURI, username, password)
+	derived, err := s.authenticate(hostURI, username, password, false)
+	if err != nil {
+		// the remembered derived password is dropped when a login fails, since
+		// the user's salt may have changed, and a login that reused it is tried
+		// again with the current login params
+		s.authDerived = ""
+		if reused {
+			derived, err = s.authenticate(hostURI, username, password, false)
+		}
+	}
+
+	// accounts made by older versions only have a hash of the plaintext password,
+	// which the login params don't reveal so that they can't be used to find out
+	// which users exist; the plaintext password is tried once for those and the
+	// server upgrades the hash
+	if derived && errors.Is(err, ErrUnauthorized) && !s.StrictLogin {
+		if _, plainErr := s.authenticate(hostURI, username, password, true); plainErr == nil {
+			return nil
+		}
+	}
+	return err
+}
+
+// authenticate makes a single login request for Authenticate, sending the
+// plaintext password if plaintext is set. It returns true if the login sent
+// the derived password.
+func (s *State) authenticate(hostURI, username, password string, plaintext bool) (bool, error) {
 	// get the http client to use for the connection
 	client, err := s.getHTTPClient()
 	if err != nil {
-		return err
+		return false, err
+	}
+
+	form, err := s.loginForm(client, hostURI, username, password, plaintext)
+	if err != nil {
+		return false, err
 	}
+	derived := form.Get("derived") != ""
 
 	// Build and perform the request
 	target := fmt.Sprintf("%s/api/users/login", hostURI)
-	resp, err := client.PostForm(target, url.Values{
-		"user":     {username},
-		"password": {password},
-	})
+	req, _ := http.NewRequest("POST", target, strings.NewReader(form.Encode()))
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	req.Header.Set(models.ClientVersionHeader, Version)
+	sent := time.Now()
+	resp, err := client.Do(req)
+	received := time.Now()
 	if err != nil {
 		if resp != nil {
-			return fmt.Errorf("Failed to make the HTTP POST request to %s (status: %s): %v", target, resp.Status, err)
+			return derived, fmt.Errorf("Failed to make the HTTP POST request to %s (status: %s): %v", target, resp.Status, err)
 		}
-		return fmt.Errorf("Failed to make the HTTP POST request to %s: %v", target, err)
+		return derived, fmt.Errorf("Failed to make the HTTP POST request to %s: %v", target, err)
 	}
 	defer resp.Body.Close()
 	body, err := ioutil.ReadAll(resp.Body)
 	if err != nil {
-		return fmt.Errorf("Failed to read the response body from %s: %v", target, err)
+		return derived, fmt.Errorf("Failed to read the response body from %s: %v", target, err)
 	}
 
 	// check the status code to ensure the success of the call
+	if resp.StatusCode == http.StatusUpgradeRequired {
+		return derived, upgradeRequiredError(hostURI, body)
+	}
 	if resp.StatusCode != http.StatusOK {
-		return fmt.Errorf("Failed to make the HTTP POST request to %s (status: %s): %v", target, resp.Status, string(body))
+		return derived, &StatusError{Method: "POST", Target: target, StatusCode: resp.StatusCode, Status: resp.Status, Body: string(body)}
 	}
+	s.checkLatestVersion(resp.Header.Get(models.LatestClientHeader))
+	s.checkQuotaWarning(resp.Header.Get(models.QuotaWarningHeader))
 
 	// get the response by deserializing the JSON
 	var userLogin models.UserLoginResponse
 	err = json.Unmarshal(body, &userLogin)
 	if err != nil {
-		return fmt.Errorf("Poorly formatted response to %s: %v", target, err)
+		return derived, fmt.Errorf("Poorly formatted response to %s: %v", target, err)
 	}
 
 	// authentication was successful so update the command state
@@ -63,13 +123,97 @@ func (s *State) Authenticate(hostURI, username, password string) error {
 	s.AuthToken = userLogin.Token
 	s.CryptoHash = userLogin.CryptoHash
 	s.ServerCapabilities = userLogin.Capabilities
+	err = s.checkCapabilities()
+	if err != nil {
+		return derived, err
+	}
+	if s.ServerCapabilities.Supports(models.FeatureReadOnly) {
+		s.Printf("The server at %s is a read-only replica; files can be restored but not changed.\n", hostURI)
+	}
 
-	return nil
+	// remember the credentials so that the token can be renewed before it expires
+	s.authUser = username
+	s.authPassword = password
+	s.authDerived = form.Get("derived")
+	s.authExpires = time.Time{}
+	if userLogin.ServerTime != 0 {
+		s.ClockSkew = measureSkew(userLogin.ServerTime, sent, received)
+		s.authExpires = time.Unix(userLogin.ExpiresAt, 0).Add(-s.ClockSkew)
+	}
+
+	return derived, nil
 }
 
-// getHttpClient returns a new http Client object set to work with TLS if keys are provided
-// on the command line or plain http otherwise.
+// loginForm returns the form posted to log in. The password derived from the
+// plaintext password and the user's salt is sent instead of the plaintext one
+// unless plaintext is set or the server predates it; StrictLogin refuses to send
+// the plaintext password to older servers.
+func (s *State) loginForm(client *http.Client, hostURI, username, password string, plaintext bool) (url.Values, error) {
+	form := url.Values{"user": {username}}
+	if plaintext {
+		form.Set("password", password)
+		return form, nil
+	}
+
+	// renewing the login reuses the derived password
+	if s.reusesDerived(hostURI, username, password) {
+		form.Set("derived", s.authDerived)
+		return form, nil
+	}
+
+	target := fmt.Sprintf("%s/api/users/login/params?user=%s", hostURI, url.QueryEscape(username))
+	req, _ := http.NewRequest("GET", target, nil)
+	req.Header.Set(models.ClientVersionHeader, Version)
+	resp, err := client.Do(req)
+	if err != nil {
+		return nil, fmt.Errorf("Failed to make the HTTP GET request to %s: %v", target, err)
+	}
+	defer resp.Body.Close()
+	body, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return nil, fmt.Errorf("Failed to read the response body from %s: %v", target, err)
+	}
+	if resp.StatusCode == http.StatusUpgradeRequired {
+		return nil, upgradeRequiredError(hostURI, body)
+	}
+
+	var params models.LoginParamsResponse
+	if resp.StatusCode == http.StatusOK {
+		err = json.Unmarshal(body, &params)
+		if err != nil {
+			return nil, fmt.Errorf("Poorly formatted response to %s: %v", target, err)
+		}
+	}
+
+	if params.LoginVersion < models.LoginDerived {
+		if s.StrictLogin {
+			return nil, fmt.Errorf("the server at %s needs the plaintext password to log in, which isn't sent with strict logins", hostURI)
+		}
+		form.Set("password", password)
+		return form, nil
+	}
+
+	derived, err := filefreezer.DeriveLoginPassword(password, params.Salt)
+	if err != nil {
+		return nil, err
+	}
+	form.Set("derived", derived)
+	return form, nil
+}
+
+// reusesDerived returns true if logging in with the credentials will reuse the
+// derived password remembered from the last login instead of deriving it again.
+func (s *State) reusesDerived(hostURI, username, password string) bool {
+	return s.authDerived != "" && s.HostURI == hostURI && s.authUser == username && s.authPassword == password
+}
+
+// getHttpClient returns a new http Client object using the Transport if one was set, or
+// otherwise set to work with TLS if keys are provided on the command line or plain http.
 func (s *State) getHTTPClient() (*http.Client, error) {
+	if s.Transport != nil {
+		return &http.Client{Transport: s.traceHTTP(s.Transport)}, nil
+	}
+
 	var client *http.Client
 	if s.TLSCrt != "" && s.TLSKey != "" {
 		cert, err := tls.LoadX509KeyPair(s.TLSCrt, s.TLSKey)
@@ -84,7 +228,7 @@ func (s *State) getHTTPClient() (*http.Client, error) {
 		}
 		//tlsConfig.BuildNameToCertificate()
 		transport := &http.Transport{TLSClientConfig: tlsConfig}
-		client = &http.Client{Transport: transport}
+		client = &http.Client{Transport: s.traceHTTP(transport)}
 
 		// Load our trusted certificate path
 		certPath := s.TLSCrt
@@ -97,7 +241,7 @@ func (s *State) getHTTPClient() (*http.Client, error) {
 			return nil, fmt.Errorf("couldn't load PEM data for HTTPS client")
 		}
 	} else {
-		client = &http.Client{}
+		client = &http.Client{Transport: s.traceHTTP(nil)}
 	}
 
 	return client, nil
@@ -118,6 +262,7 @@ func (s *State) buildAuthRequest(target string, method string, token string, bod
 		req, _ = http.NewRequest(method, target, nil)
 	}
 	req.Header.Add("Authorization", "Bearer "+token)
+	req.Header.Set(models.ClientVersionHeader, Version)
 	return client, req, nil
 }
 
@@ -125,6 +270,40 @@ func (s *State) buildAuthRequest(target string, method string, token string, bod
 // the body into a byte array. If reqBody is a []byte array, no transformation is done,
 // but if it's another type than it gets marshalled to a text JSON object.
 func (s *State) RunAuthRequest(target string, method string, token string, reqBody interface{}) ([]byte, error) {
+	return s.runAuthRequest(target, method, token, reqBody, "")
+}
+
+// RunIdempotentRequest is RunAuthRequest for the requests that create or remove
+// file versions. If the server supports idempotency keys the request is sent
+// with a new one and, when it fails in a way that may have happened after the
+// server ran it, such as a dropped connection or a gateway error, it's made
+// again with the same key after a backoff. The server answers those retries
+// with its response to the first request instead of running it twice.
+func (s *State) RunIdempotentRequest(target string, method string, token string, reqBody interface{}) ([]byte, error) {
+	if !s.ServerCapabilities.Supports(models.FeatureIdempotency) {
+		return s.RunAuthRequest(target, method, token, reqBody)
+	}
+	var randoms [18]byte
+	_, err := rand.Read(randoms[:])
+	if err != nil {
+		return nil, fmt.Errorf("Failed to generate the idempotency key: %v", err)
+	}
+	return s.runAuthRequest(target, method, token, reqBody, base64.RawURLEncoding.EncodeToString(randoms[:]))
+}
+
+// retryable returns true if a request that got the status code, or zero if
+// it failed before a response arrived, may succeed when it's made again.
+func retryable(statusCode int) bool {
+	switch statusCode {
+	case 0, http.StatusBadGateway, http.StatusServiceUnavailable, http.StatusGatewayTimeout:
+		return true
+	}
+	return false
+}
+
+// runAuthRequest makes the request for RunAuthRequest, sending the idempotency
+// key and retrying the failures that are retryable if a key is given.
+func (s *State) runAuthRequest(target string, method string, token string, reqBody interface{}, idempotencyKey string) ([]byte, error) {
 	// serialize the reqBody object if one was passed in
 	var err error
 	var reqBodyIsByteSlice bool
@@ -139,63 +318,168 @@ func (s *State) RunAuthRequest(target string, method string, token string, reqBo
 		}
 	}
 
-	client, req, err := s.buildAuthRequest(target, method, token, reqBytes)
-	if err != nil {
-		return nil, err
+	// renew the login if the token would expire soon by the server's clock
+	ownToken := token == s.AuthToken
+	if ownToken {
+		token, err = s.freshToken()
+		if err != nil {
+			return nil, err
+		}
 	}
 
-	// set the header if a JSON object is being sent
-	if reqBytes != nil && !reqBodyIsByteSlice {
-		req.Header.Set("Content-Type", "application/json")
-	}
+	var resp *http.Response
+	var body []byte
+	renewed := false
+	for attempt := 1; ; attempt++ {
+		client, req, err := s.buildAuthRequest(target, method, token, reqBytes)
+		if err != nil {
+			return nil, err
+		}
 
-	// perform the request and read the response body
-	resp, err := client.Do(req)
-	if err != nil {
-		return nil, fmt.Errorf("Failed to make the HTTP %s request to %s (status: %s): %v", method, target, resp.Status, err)
-	}
-	defer resp.Body.Close()
-	body, err := ioutil.ReadAll(resp.Body)
-	if err != nil {
-		return nil, fmt.Errorf("Failed to read the response body from %s: %v", target, err)
+		// set the header if a JSON object is being sent
+		if reqBytes != nil && !reqBodyIsByteSlice {
+			req.Header.Set("Content-Type", "application/json")
+		}
+		if idempotencyKey != "" {
+			req.Header.Set(models.IdempotencyKeyHeader, idempotencyKey)
+		}
+
+		// perform the request and read the response body
+		resp, err = client.Do(req)
+		if err == nil {
+			body, err = ioutil.ReadAll(resp.Body)
+			resp.Body.Close()
+			if err != nil {
+				err = fmt.Errorf("Failed to read the response body from %s: %w", target, err)
+			}
+		} else {
+			err = fmt.Errorf("Failed to make the HTTP %s request to %s: %w", method, target, err)
+		}
+
+		// requests with an idempotency key are safe to make again when they
+		// fail in ways that may be temporary
+		statusCode := 0
+		if err == nil {
+			statusCode = resp.StatusCode
+		}
+		if idempotencyKey != "" && retryable(statusCode) && attempt < retryAttempts {
+			backoff := retryBackoff << uint(attempt-1)
+			s.tracef(VerbosityDebug, "Retrying %s %s in %s (attempt %d of %d) after it failed: %v\n",
+				method, target, backoff, attempt+1, retryAttempts, retryReason(statusCode, err))
+			time.Sleep(backoff)
+			continue
+		}
+		if err != nil {
+			return nil, err
+		}
+		s.throttle(len(reqBytes) + len(body))
+
+		// a token can still be rejected as expired if the skew changed, so
+		// renew it once and try again
+		if resp.StatusCode == http.StatusUnauthorized && ownToken && !renewed && s.authUser != "" {
+			renewed = true
+			s.tracef(VerbosityDebug, "The token was rejected for %s %s; logging in again\n", method, target)
+			token, err = s.renewToken(token)
+			if err != nil {
+				return nil, err
+			}
+			continue
+		}
+
+		// wait as long as the server asks when it's too busy and then try again;
+		// a download turned away for the egress limit won't succeed until it resets
+		if resp.StatusCode != http.StatusTooManyRequests || attempt >= busyAttempts || resp.Header.Get(models.EgressResetHeader) != "" {
+			break
+		}
+		retryAfter, err := strconv.Atoi(resp.Header.Get("Retry-After"))
+		if err != nil || retryAfter < 1 {
+			retryAfter = 1
+		}
+		s.tracef(VerbosityDebug, "The server is busy; retrying %s %s in %ds (attempt %d of %d)\n", method, target, retryAfter, attempt+1, busyAttempts)
+		time.Sleep(time.Duration(retryAfter) * time.Second)
 	}
 
 	// check the status code to ensure the success of the call
+	if resp.StatusCode == http.StatusUpgradeRequired {
+		return nil, upgradeRequiredError(s.HostURI, body)
+	}
+	if resp.StatusCode == http.StatusTooManyRequests && resp.Header.Get(models.EgressResetHeader) != "" {
+		return nil, egressLimitError(body)
+	}
+	if resp.StatusCode == http.StatusConflict && resp.Header.Get(models.FileLockedHeader) != "" {
+		return nil, fileLockedError(body)
+	}
 	if resp.StatusCode != http.StatusOK {
-		return nil, fmt.Errorf("Failed to make the HTTP %s request to %s (status: %s): %v", method, target, resp.Status, string(body))
+		return nil, &StatusError{Method: method, Target: target, StatusCode: resp.StatusCode, Status: resp.Status, Body: string(body)}
+	}
+	if ownToken {
+		s.checkQuotaWarning(resp.Header.Get(models.QuotaWarningHeader))
 	}
 
 	return body, nil
 }
 
+// retryReason describes why a request is retried for the trace.
+func retryReason(statusCode int, err error) string {
+	if err != nil {
+		return err.Error()
+	}
+	return http.StatusText(statusCode)
+}
+
 type eachChunkFunc func(chunkNumber int, chunk []byte) (bool, error)
 
-func forEachChunk(chunkSize int, filename string, localChunkCount int, eachFunc eachChunkFunc) error {
-	// open the local file and create a chunk sized buffer
-	buffer := make([]byte, chunkSize)
+// chunking returns how the server wants files split into chunks.
+func (s *State) chunking() string {
+	if s.ServerCapabilities.Chunking == "" {
+		return filefreezer.ChunkingFixed
+	}
+	return s.ServerCapabilities.Chunking
+}
+
+// chunkSizes returns the smallest size of a chunk other than the last one of a
+// file and the average chunk size for the server's chunking, which estimate
+// file sizes from their chunk counts and the other way around.
+func (s *State) chunkSizes() (min int64, avg int64) {
+	if s.chunking() == filefreezer.ChunkingFixed {
+		return s.ServerCapabilities.ChunkSize, s.ServerCapabilities.ChunkSize
+	}
+	return filefreezer.FastCDCChunkSizes(s.ServerCapabilities.ChunkSize)
+}
+
+// calcFileHashInfo returns the stats of the local file with its chunk count
+// for the server's chunking.
+func (s *State) calcFileHashInfo(filename string) (filefreezer.FileStats, error) {
+	return filefreezer.CalcFileHashInfoChunked(s.chunking(), s.ServerCapabilities.ChunkSize, filename)
+}
+
+// forEachChunk calls eachFunc with the first localChunkCount chunks of the
+// file split with the chunking method. The chunk buffer is reused, so
+// eachFunc has to copy what it keeps.
+func forEachChunk(chunking string, chunkSize int, filename string, localChunkCount int, eachFunc eachChunkFunc) error {
 	f, err := os.Open(filename)
 	if err != nil {
 		return fmt.Errorf("Failed to open the file %s: %v", filename, err)
 	}
 	defer f.Close()
+	chunker, err := filefreezer.NewChunker(f, chunking, chunkSize)
+	if err != nil {
+		return err
+	}
 
 	// with the chunk list, lets make sure that each chunk locally has the same hash
 	for i := 0; i < localChunkCount; i++ {
-		readCount, err := io.ReadAtLeast(f, buffer, chunkSize)
+		chunk, err := chunker.Next()
+		if err == io.EOF {
+			// the file is shorter than it was when its chunks were counted
+			return fmt.Errorf("unexpected EOF while reading the file %s", filename)
+		}
 		if err != nil {
-			if err == io.ErrUnexpectedEOF {
-				// if we don't fill the buffer and we're not on the last chunk, the files are different
-				if i+1 != localChunkCount {
-					return fmt.Errorf("nexpeced EOF while reading the file %s", filename)
-				}
-			} else {
-				return fmt.Errorf("an error occured while reading %d bytes from the file %s: %v", readCount, filename, err)
-			}
+			return fmt.Errorf("an error occured while reading chunk %d from the file %s: %v", i, filename, err)
 		}
-		clampedBuffer := buffer[:readCount]
 
 		// call the supplied callback and break the loop if false is returned
-		contLoop, err := eachFunc(i, clampedBuffer)
+		contLoop, err := eachFunc(i, chunk)
 		if err != nil {
 			return err
 		}
@@ -0,0 +1,222 @@
+// Copyright 2017, Timothy Bogdala <tdb@animal-machine.com>
+// See the LICENSE file for more details.
+
+package command
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/marcoziti/gringotts"
+)
+
+// RestoreManifestName is the file in the local directory of GetDirectory that
+// tracks the files restored so far, so that an interrupted restore can pick up
+// where it left off.
+const RestoreManifestName = ".freezer-restore.json"
+
+// RestoreManifest records the progress of restoring a directory from the server.
+type RestoreManifest struct {
+	HostURI   string
+	RemoteDir string
+
+	// Files are the files that were downloaded and verified, keyed by their
+	// path on the server.
+	Files map[string]RestoredFile
+}
+
+// RestoredFile is a file that GetDirectory downloaded and verified.
+type RestoredFile struct {
+	VersionID int
+	FileHash  string
+
+	// Size and LastMod are what the local file had once it was restored; a
+	// file that doesn't match them anymore is restored again.
+	Size    int64
+	LastMod int64
+}
+
+// GetDirectory downloads the current version of every file under remoteDir on
+// the server into localDir, overwriting the local files. Each file is
+// downloaded next to its destination, verified against the hash of the version
+// and then moved into place, and the restore manifest in localDir records it.
+// If the restore is interrupted, running it again skips the files the manifest
+// has that are still the same on the server and on disk. The manifest is
+// removed once every file has been restored. The number of files downloaded
+// is returned along with a non-nil error on failure.
+func (s *State) GetDirectory(remoteDir string, localDir string) (downloadCount int, e error) {
+	remoteDir = strings.TrimSuffix(remoteDir, "/")
+	files, err := s.getAllFilesByName()
+	if err != nil {
+		return 0, fmt.Errorf("Failed to get the list of files from the server: %v", err)
+	}
+
+	var names []string
+	for name := range files {
+		if (name == remoteDir && files[name].IsDir) || strings.HasPrefix(name, remoteDir+"/") {
+			names = append(names, name)
+		}
+	}
+	if len(names) == 0 {
+		return 0, fmt.Errorf("no files were found under %s on the server", remoteDir)
+	}
+	sort.Strings(names)
+
+	err = os.MkdirAll(localDir, os.ModeDir|os.ModePerm)
+	if err != nil {
+		return 0, fmt.Errorf("Failed to create the local directory %s: %v", localDir, err)
+	}
+	manifestPath := filepath.Join(localDir, RestoreManifestName)
+	manifest, err := s.loadRestoreManifest(manifestPath, remoteDir)
+	if err != nil {
+		return 0, err
+	}
+
+	for _, name := range names {
+		fi := files[name]
+		localPath := filepath.Join(localDir, filepath.FromSlash(strings.TrimPrefix(name[len(remoteDir):], "/")))
+
+		if fi.IsDir {
+			err = os.MkdirAll(localPath, os.ModeDir|os.FileMode(fi.CurrentVersion.Permissions))
+			if err != nil {
+				return downloadCount, fmt.Errorf("Failed to create the local directory %s: %v", localPath, err)
+			}
+			continue
+		}
+
+		if restored, found := manifest.Files[name]; found && restored.matches(fi.CurrentVersion, localPath) {
+			s.Printf("%s --- already restored\n", name)
+			continue
+		}
+
+		err = os.MkdirAll(filepath.Dir(localPath), os.ModeDir|os.ModePerm)
+		if err != nil {
+			return downloadCount, fmt.Errorf("Failed to create the local directory for %s: %v", localPath, err)
+		}
+		restored, err := s.restoreFile(fi, name, localPath)
+		if err != nil {
+			return downloadCount, err
+		}
+		downloadCount++
+
+		manifest.Files[name] = restored
+		err = saveRestoreManifest(manifestPath, manifest)
+		if err != nil {
+			return downloadCount, err
+		}
+	}
+
+	err = os.Remove(manifestPath)
+	if err != nil && !os.IsNotExist(err) {
+		return downloadCount, fmt.Errorf("Failed to remove the restore manifest: %v", err)
+	}
+	return downloadCount, nil
+}
+
+// restoreFile downloads the current version of the file to a partial file
+// next to localPath, checks it against the version's hash and then moves it
+// into place with the version's modification time.
+func (s *State) restoreFile(fi filefreezer.FileInfo, remoteFilepath string, localPath string) (RestoredFile, error) {
+	var restored RestoredFile
+	version := fi.CurrentVersion
+	partPath := localPath + ".part"
+
+	_, err := s.syncDownload(fi.FileID, version.VersionID, partPath, remoteFilepath, version.ChunkCount)
+	if err != nil {
+		os.Remove(partPath)
+		return restored, fmt.Errorf("Failed to download %s: %v", remoteFilepath, err)
+	}
+
+	stats, err := s.calcFileHashInfo(partPath)
+	if err != nil {
+		os.Remove(partPath)
+		return restored, fmt.Errorf("Failed to verify the download of %s: %v", remoteFilepath, err)
+	}
+	if stats.HashString != version.FileHash {
+		os.Remove(partPath)
+		return restored, fmt.Errorf("the download of %s does not match the hash of version %d", remoteFilepath, version.VersionNumber)
+	}
+
+	modTime := time.Unix(version.LastMod, 0)
+	err = os.Chtimes(partPath, modTime, modTime)
+	if err != nil {
+		os.Remove(partPath)
+		return restored, fmt.Errorf("Failed to set the modification time on %s: %v", localPath, err)
+	}
+	err = os.Rename(partPath, localPath)
+	if err != nil {
+		os.Remove(partPath)
+		return restored, fmt.Errorf("Failed to move the download of %s into place: %v", remoteFilepath, err)
+	}
+
+	info, err := os.Stat(localPath)
+	if err != nil {
+		return restored, err
+	}
+	restored.VersionID = version.VersionID
+	restored.FileHash = version.FileHash
+	restored.Size = info.Size()
+	restored.LastMod = info.ModTime().Unix()
+	return restored, nil
+}
+
+// matches returns true if the restored file is still the version on the
+// server and the local file hasn't changed since it was restored.
+func (r RestoredFile) matches(version filefreezer.FileVersionInfo, localPath string) bool {
+	if r.VersionID != version.VersionID || r.FileHash != version.FileHash {
+		return false
+	}
+	info, err := os.Stat(localPath)
+	if err != nil {
+		return false
+	}
+	return info.Size() == r.Size && info.ModTime().Unix() == r.LastMod
+}
+
+// loadRestoreManifest reads the restore manifest, starting a new one if it's
+// missing or was made for another server or directory.
+func (s *State) loadRestoreManifest(manifestPath string, remoteDir string) (*RestoreManifest, error) {
+	fresh := &RestoreManifest{
+		HostURI:   s.HostURI,
+		RemoteDir: remoteDir,
+		Files:     make(map[string]RestoredFile),
+	}
+
+	data, err := ioutil.ReadFile(manifestPath)
+	if os.IsNotExist(err) {
+		return fresh, nil
+	} else if err != nil {
+		return nil, fmt.Errorf("Failed to read the restore manifest: %v", err)
+	}
+
+	var manifest RestoreManifest
+	err = json.Unmarshal(data, &manifest)
+	if err != nil {
+		return nil, fmt.Errorf("Failed to read the restore manifest: %v", err)
+	}
+	if manifest.HostURI != s.HostURI || manifest.RemoteDir != remoteDir || manifest.Files == nil {
+		return fresh, nil
+	}
+
+	s.Printf("Resuming the restore of %s with %d files already restored.\n", remoteDir, len(manifest.Files))
+	return &manifest, nil
+}
+
+// saveRestoreManifest writes the restore manifest.
+func saveRestoreManifest(manifestPath string, manifest *RestoreManifest) error {
+	data, err := json.MarshalIndent(manifest, "", "  ")
+	if err != nil {
+		return err
+	}
+	err = writeFileAtomic(manifestPath, data)
+	if err != nil {
+		return fmt.Errorf("Failed to write the restore manifest: %v", err)
+	}
+	return nil
+}
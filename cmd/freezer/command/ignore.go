@@ -0,0 +1,265 @@
+// Copyright 2017, Timothy Bogdala <tdb@animal-machine.com>
+// See the LICENSE file for more details.
+
+package command
+
+import (
+	"bufio"
+	"fmt"
+	"os"
+	"path"
+	"path/filepath"
+	"regexp"
+	"strings"
+)
+
+// IgnoreFileName is the name of the files in a synced directory, or in any
+// directory below it, that list the gitignore-style patterns of the files that
+// are never uploaded, such as build artifacts and caches.
+const IgnoreFileName = ".freezerignore"
+
+// ignorePattern is one line of an ignore file.
+type ignorePattern struct {
+	// base is the slash separated directory of the ignore file relative to
+	// the synced directory, or empty for the synced directory itself
+	base string
+
+	re      *regexp.Regexp
+	negate  bool
+	dirOnly bool
+}
+
+// IgnoreMatcher matches the paths relative to a synced directory against the
+// patterns of the ignore files in it. The patterns work like the ones in a
+// .gitignore: blank lines and lines starting with # are skipped, a pattern
+// without a slash matches a file or directory of that name anywhere below
+// the ignore file and one with a slash matches the path relative to it, * and
+// ? match within a path element and ** across them, a trailing slash only
+// matches directories and a leading ! includes what an earlier pattern
+// excluded. The last pattern matching a path decides it, and everything in an
+// ignored directory is ignored.
+type IgnoreMatcher struct {
+	patterns []ignorePattern
+}
+
+// NewIgnoreMatcher returns a matcher with the patterns in lines, as if they
+// were read from an ignore file in the synced directory.
+func NewIgnoreMatcher(lines ...string) (*IgnoreMatcher, error) {
+	m := new(IgnoreMatcher)
+	err := m.addPatterns("", lines)
+	if err != nil {
+		return nil, err
+	}
+	return m, nil
+}
+
+// loadIgnoreFile reads the ignore file in the directory rel below root, if
+// there is one, and adds its patterns.
+func (m *IgnoreMatcher) loadIgnoreFile(root string, rel string) error {
+	f, err := os.Open(filepath.Join(root, filepath.FromSlash(rel), IgnoreFileName))
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return fmt.Errorf("Failed to open the ignore file: %v", err)
+	}
+	defer f.Close()
+
+	var lines []string
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		lines = append(lines, scanner.Text())
+	}
+	if err = scanner.Err(); err != nil {
+		return fmt.Errorf("Failed to read the ignore file %s: %v", f.Name(), err)
+	}
+	err = m.addPatterns(rel, lines)
+	if err != nil {
+		return fmt.Errorf("Failed to parse the ignore file %s: %v", f.Name(), err)
+	}
+	return nil
+}
+
+// addPatterns adds the patterns in the lines of an ignore file in the
+// directory base.
+func (m *IgnoreMatcher) addPatterns(base string, lines []string) error {
+	for i, line := range lines {
+		line = strings.TrimRight(strings.TrimSuffix(line, "\r"), " \t")
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+
+		p := ignorePattern{base: base}
+		if strings.HasPrefix(line, "!") {
+			p.negate = true
+			line = line[1:]
+		} else if strings.HasPrefix(line, `\`) {
+			// a backslash escapes a leading # or !
+			line = line[1:]
+		}
+		if strings.HasSuffix(line, "/") {
+			p.dirOnly = true
+			line = strings.TrimRight(line, "/")
+		}
+		if line == "" {
+			continue
+		}
+
+		// patterns with a slash are anchored to the ignore file's directory
+		// and the others match at any depth below it
+		prefix := "(?:.*/)?"
+		if strings.Contains(line, "/") {
+			prefix = ""
+			line = strings.TrimPrefix(line, "/")
+		}
+
+		re, err := regexp.Compile("^" + prefix + globToRegexp(line) + "$")
+		if err != nil {
+			return fmt.Errorf("line %d: %v", i+1, err)
+		}
+		p.re = re
+		m.patterns = append(m.patterns, p)
+	}
+	return nil
+}
+
+// globToRegexp converts a gitignore glob into a regular expression.
+func globToRegexp(glob string) string {
+	var re strings.Builder
+	for i := 0; i < len(glob); i++ {
+		switch c := glob[i]; c {
+		case '*':
+			if !strings.HasPrefix(glob[i:], "**") {
+				re.WriteString("[^/]*")
+				continue
+			}
+			// ** matches any number of directories when it's a whole element
+			i++
+			switch {
+			case strings.HasPrefix(glob[i+1:], "/"):
+				re.WriteString("(?:.*/)?")
+				i++
+			default:
+				re.WriteString(".*")
+			}
+		case '?':
+			re.WriteString("[^/]")
+		case '[':
+			end := strings.IndexByte(glob[i+1:], ']')
+			if end < 0 {
+				re.WriteString(`\[`)
+				continue
+			}
+			class := glob[i+1 : i+1+end]
+			if strings.HasPrefix(class, "!") {
+				class = "^" + class[1:]
+			}
+			re.WriteString("[" + strings.Replace(class, `\`, `\\`, -1) + "]")
+			i += end + 1
+		case '\\':
+			if i+1 < len(glob) {
+				i++
+			}
+			re.WriteString(regexp.QuoteMeta(glob[i : i+1]))
+		default:
+			re.WriteString(regexp.QuoteMeta(string(c)))
+		}
+	}
+	return re.String()
+}
+
+// Match returns true if the file or directory at the slash separated path
+// relative to the synced directory is ignored, either by itself or because
+// a directory it's in is.
+func (m *IgnoreMatcher) Match(rel string, isDir bool) bool {
+	if m == nil || len(m.patterns) == 0 {
+		return false
+	}
+	rel = strings.Trim(rel, "/")
+	for i := strings.IndexByte(rel, '/'); i >= 0; i = nextSlash(rel, i) {
+		if m.matchOne(rel[:i], true) {
+			return true
+		}
+	}
+	return m.matchOne(rel, isDir)
+}
+
+// nextSlash returns the index of the slash after the one at i, or -1.
+func nextSlash(s string, i int) int {
+	j := strings.IndexByte(s[i+1:], '/')
+	if j < 0 {
+		return -1
+	}
+	return i + 1 + j
+}
+
+// matchOne returns true if the last pattern matching the path excludes it.
+func (m *IgnoreMatcher) matchOne(rel string, isDir bool) bool {
+	ignored := false
+	for _, p := range m.patterns {
+		if p.dirOnly && !isDir {
+			continue
+		}
+		name := rel
+		if p.base != "" {
+			if !strings.HasPrefix(rel, p.base+"/") {
+				continue
+			}
+			name = rel[len(p.base)+1:]
+		}
+		if p.re.MatchString(name) {
+			ignored = !p.negate
+		}
+	}
+	return ignored
+}
+
+// syncRelative returns the slash separated path of a file found while syncing
+// root, whose name was built by appending to root, relative to root.
+func syncRelative(root string, name string) string {
+	return strings.TrimLeft(strings.TrimPrefix(name, root), "/")
+}
+
+// loadIgnoreFiles returns a matcher with the patterns of the ignore files in
+// localDir and the directories below it, skipping the directories that are
+// ignored themselves like git does.
+func loadIgnoreFiles(localDir string) (*IgnoreMatcher, error) {
+	m := new(IgnoreMatcher)
+	var loadDir func(rel string) error
+	loadDir = func(rel string) error {
+		err := m.loadIgnoreFile(localDir, rel)
+		if err != nil {
+			return err
+		}
+		dir := filepath.Join(localDir, filepath.FromSlash(rel))
+		f, err := os.Open(dir)
+		if err != nil {
+			// a missing directory has nothing to ignore
+			return nil
+		}
+		infos, err := f.Readdir(-1)
+		f.Close()
+		if err != nil {
+			return fmt.Errorf("Failed to read the directory %s: %v", dir, err)
+		}
+		for _, info := range infos {
+			if !info.IsDir() {
+				continue
+			}
+			childRel := path.Join(rel, info.Name())
+			if m.Match(childRel, true) {
+				continue
+			}
+			err = loadDir(childRel)
+			if err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+	err := loadDir("")
+	if err != nil {
+		return nil, err
+	}
+	return m, nil
+}
@@ -0,0 +1,144 @@
+// Copyright 2017, Timothy Bogdala <tdb@animal-machine.com>
+// See the LICENSE file for more details.
+
+package command
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"time"
+)
+
+// importSnapshot is a dated snapshot directory found by ImportHistory.
+type importSnapshot struct {
+	Path string
+	Time time.Time
+}
+
+// ImportHistory takes a directory of dated snapshot directories, such as those
+// made by rsnapshot or Time Machine, and uploads each snapshot in chronological
+// order as versions of the files under remoteDir. Each snapshot directory name
+// is parsed with the time layout supplied, or if layout is empty, the modification
+// time of the snapshot directory is used instead. Directories that don't parse
+// are skipped. Files get tagged with the snapshot time as their modification time
+// and only files that changed from the previous snapshot get a new version.
+// The total number of uploaded chunks is returned along with a non-nil error
+// on failure.
+func (s *State) ImportHistory(snapshotsDir string, remoteDir string, layout string) (changeCount int, e error) {
+	snapshots, err := s.findImportSnapshots(snapshotsDir, layout)
+	if err != nil {
+		return 0, err
+	}
+	if len(snapshots) == 0 {
+		return 0, fmt.Errorf("no dated snapshot directories were found in %s", snapshotsDir)
+	}
+
+	for _, snapshot := range snapshots {
+		s.Printf("Importing snapshot %s as %s\n", snapshot.Path, snapshot.Time.Format(time.UnixDate))
+		changes, err := s.importSnapshot(snapshot, remoteDir)
+		changeCount += changes
+		if err != nil {
+			return changeCount, fmt.Errorf("Failed to import the snapshot %s: %v", snapshot.Path, err)
+		}
+	}
+
+	return changeCount, nil
+}
+
+// findImportSnapshots returns the dated snapshot directories in snapshotsDir
+// sorted from oldest to newest.
+func (s *State) findImportSnapshots(snapshotsDir string, layout string) ([]importSnapshot, error) {
+	dirInfos, err := ioutil.ReadDir(snapshotsDir)
+	if err != nil {
+		return nil, fmt.Errorf("Failed to get a list of the snapshot directories: %v", err)
+	}
+
+	var snapshots []importSnapshot
+	for _, dirInfo := range dirInfos {
+		if !dirInfo.IsDir() {
+			continue
+		}
+
+		snapshotTime := dirInfo.ModTime()
+		if layout != "" {
+			snapshotTime, err = time.ParseInLocation(layout, dirInfo.Name(), time.Local)
+			if err != nil {
+				s.Printf("Skipping %s: the name does not match the time layout\n", dirInfo.Name())
+				continue
+			}
+		}
+
+		snapshots = append(snapshots, importSnapshot{
+			Path: filepath.Join(snapshotsDir, dirInfo.Name()),
+			Time: snapshotTime,
+		})
+	}
+
+	sort.Slice(snapshots, func(i, j int) bool {
+		return snapshots[i].Time.Before(snapshots[j].Time)
+	})
+
+	return snapshots, nil
+}
+
+// importSnapshot uploads all of the files in the snapshot that are either new
+// or different from the current version on the server.
+func (s *State) importSnapshot(snapshot importSnapshot, remoteDir string) (changeCount int, e error) {
+	remoteFiles, err := s.getAllFilesByName()
+	if err != nil {
+		return 0, fmt.Errorf("Failed to get a list of remote files: %v", err)
+	}
+
+	snapshotLastMod := snapshot.Time.UTC().Unix()
+
+	err = filepath.Walk(snapshot.Path, func(localFileName string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		if localFileName == snapshot.Path || !(info.Mode().IsRegular() || info.IsDir()) {
+			return nil
+		}
+
+		relPath, err := filepath.Rel(snapshot.Path, localFileName)
+		if err != nil {
+			return err
+		}
+		remoteFileName := filepath.ToSlash(relPath)
+		if remoteDir != "" {
+			remoteFileName = remoteDir + "/" + remoteFileName
+		}
+
+		localStats, err := s.calcFileHashInfo(localFileName)
+		if err != nil {
+			return err
+		}
+
+		remote, found := remoteFiles[remoteFileName]
+		if !found {
+			changes, err := s.syncUploadNew(localFileName, remoteFileName, localStats.IsDir,
+				localStats.Permissions, snapshotLastMod, localStats.ChunkCount, localStats.HashString)
+			changeCount += changes
+			return err
+		}
+
+		// directories only need to be registered once and unchanged files are skipped
+		if localStats.IsDir || localStats.HashString == remote.CurrentVersion.FileHash {
+			return nil
+		}
+
+		changes, err := s.syncUploadNewer(remote.FileID, localFileName, remoteFileName, false,
+			localStats.Permissions, snapshotLastMod, localStats.ChunkCount, localStats.HashString)
+		changeCount += changes
+		if err != nil {
+			return err
+		}
+
+		s.Printf("%s ==> new version imported\n", remoteFileName)
+		return nil
+	})
+
+	return changeCount, err
+}
@@ -0,0 +1,131 @@
+// Copyright 2017, Timothy Bogdala <tdb@animal-machine.com>
+// See the LICENSE file for more details.
+
+package command
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"strings"
+)
+
+// lfsError is the error object sent back to git-lfs for a failed transfer.
+type lfsError struct {
+	Code    int    `json:"code"`
+	Message string `json:"message"`
+}
+
+// lfsMessage covers all of the messages exchanged with git-lfs using the
+// custom transfer protocol; unused fields are omitted.
+type lfsMessage struct {
+	Event     string    `json:"event,omitempty"`
+	Operation string    `json:"operation,omitempty"`
+	Oid       string    `json:"oid,omitempty"`
+	Size      int64     `json:"size,omitempty"`
+	Path      string    `json:"path,omitempty"`
+	Error     *lfsError `json:"error,omitempty"`
+}
+
+// ServeLFSTransfer implements the git-lfs custom transfer protocol, reading
+// requests from r and writing responses to w, so that git-lfs can store
+// objects in freezer storage. Each object is stored as prefix/<oid>. Since w
+// is used for the protocol, the State should be set to quiet. This function
+// returns once git-lfs sends the terminate event or r is closed.
+func (b *Bridge) ServeLFSTransfer(r io.Reader, w io.Writer, prefix string) error {
+	prefix = strings.Trim(prefix, "/")
+	encoder := json.NewEncoder(w)
+	scanner := bufio.NewScanner(r)
+	for scanner.Scan() {
+		var req lfsMessage
+		err := json.Unmarshal(scanner.Bytes(), &req)
+		if err != nil {
+			return fmt.Errorf("Failed to parse the git-lfs request: %v", err)
+		}
+
+		var resp interface{}
+		switch req.Event {
+		case "init":
+			resp = struct{}{}
+		case "upload", "download":
+			resp = b.lfsTransfer(req, prefix+"/"+req.Oid)
+		case "terminate":
+			return nil
+		default:
+			continue
+		}
+
+		err = encoder.Encode(resp)
+		if err != nil {
+			return fmt.Errorf("Failed to write the git-lfs response: %v", err)
+		}
+	}
+
+	return scanner.Err()
+}
+
+// lfsTransfer performs a single upload or download and returns the complete
+// event to send back to git-lfs.
+func (b *Bridge) lfsTransfer(req lfsMessage, remoteName string) lfsMessage {
+	resp := lfsMessage{Event: "complete", Oid: req.Oid}
+	var err error
+	if req.Event == "upload" {
+		err = b.lfsUpload(req.Path, remoteName)
+	} else {
+		resp.Path, err = b.lfsDownload(remoteName)
+	}
+	if err != nil {
+		resp.Error = &lfsError{Code: 2, Message: err.Error()}
+	}
+	return resp
+}
+
+// lfsUpload syncs the local object file to the server.
+func (b *Bridge) lfsUpload(filename string, remoteName string) error {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+	err := b.refreshAuth()
+	if err != nil {
+		return err
+	}
+
+	_, _, err = b.state.SyncFile(filename, remoteName, SyncCurrentVersion)
+	return err
+}
+
+// lfsDownload downloads the object to a temporary file, which git-lfs moves
+// into place, and returns its path.
+func (b *Bridge) lfsDownload(remoteName string) (string, error) {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+	err := b.refreshAuth()
+	if err != nil {
+		return "", err
+	}
+
+	files, err := b.remoteFiles()
+	if err != nil {
+		return "", err
+	}
+	fi, _, found := findRemoteFile(files, remoteName)
+	if !found {
+		return "", fmt.Errorf("object %s not found", remoteName)
+	}
+
+	tmpFile, err := ioutil.TempFile("", "freezer-lfs")
+	if err != nil {
+		return "", err
+	}
+	defer tmpFile.Close()
+
+	_, err = b.state.downloadVersion(tmpFile, fi.FileID, fi.CurrentVersion.VersionID, remoteName, fi.CurrentVersion.ChunkCount)
+	if err != nil {
+		os.Remove(tmpFile.Name())
+		return "", err
+	}
+
+	return tmpFile.Name(), nil
+}
@@ -0,0 +1,140 @@
+// Copyright 2017, Timothy Bogdala <tdb@animal-machine.com>
+// See the LICENSE file for more details.
+
+package command
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/marcoziti/gringotts"
+)
+
+// FileFilter selects files in a listing by their current version. The zero
+// value selects every file.
+type FileFilter struct {
+	// ModifiedSince skips files last modified before it unless it's zero
+	ModifiedSince time.Time
+
+	// MinSize skips files with fewer bytes stored for their current
+	// version, and all directories, unless it's zero
+	MinSize int64
+}
+
+// Match returns true if the file passes the filter.
+func (f FileFilter) Match(fi filefreezer.FileInfo) bool {
+	if !f.ModifiedSince.IsZero() && fi.CurrentVersion.LastMod < f.ModifiedSince.Unix() {
+		return false
+	}
+	if f.MinSize > 0 && (fi.IsDir || fi.CurrentVersion.Size < f.MinSize) {
+		return false
+	}
+	return true
+}
+
+// FilterFiles returns the files that pass the filter, keeping their order.
+func FilterFiles(files []filefreezer.FileInfo, filter FileFilter) []filefreezer.FileInfo {
+	var result []filefreezer.FileInfo
+	for _, fi := range files {
+		if filter.Match(fi) {
+			result = append(result, fi)
+		}
+	}
+	return result
+}
+
+// ListEntry is a file in a listing along with its decrypted name.
+type ListEntry struct {
+	filefreezer.FileInfo
+	Name string
+}
+
+// ListFiles returns the authenticated user's files that pass the filter with
+// their names decrypted, sorted by name.
+func (s *State) ListFiles(filter FileFilter) ([]ListEntry, error) {
+	files, err := s.getAllFilesByName()
+	if err != nil {
+		return nil, err
+	}
+
+	entries := make([]ListEntry, 0, len(files))
+	for name, fi := range files {
+		if filter.Match(fi) {
+			entries = append(entries, ListEntry{FileInfo: fi, Name: name})
+		}
+	}
+	SortListEntries(entries, SortByName, false)
+	return entries, nil
+}
+
+// The columns a listing can be sorted by.
+const (
+	SortByName     = "name"
+	SortBySize     = "size"
+	SortByVersions = "versions"
+	SortByModified = "modified"
+)
+
+// SortListEntries sorts the entries in place by the column named, which must
+// be one of the SortBy constants, breaking ties by name. Sizes, version counts
+// and modification times sort largest or newest first unless reverse is set,
+// while names sort alphabetically unless reverse is set.
+func SortListEntries(entries []ListEntry, by string, reverse bool) error {
+	var less func(a, b *ListEntry) bool
+	switch by {
+	case SortByName:
+		less = func(a, b *ListEntry) bool { return false }
+	case SortBySize:
+		less = func(a, b *ListEntry) bool { return a.CurrentVersion.Size > b.CurrentVersion.Size }
+	case SortByVersions:
+		less = func(a, b *ListEntry) bool { return a.CurrentVersion.VersionNumber > b.CurrentVersion.VersionNumber }
+	case SortByModified:
+		less = func(a, b *ListEntry) bool { return a.CurrentVersion.LastMod > b.CurrentVersion.LastMod }
+	default:
+		return fmt.Errorf("unknown sort column %q", by)
+	}
+
+	sort.SliceStable(entries, func(i, j int) bool {
+		a, b := &entries[i], &entries[j]
+		if reverse {
+			a, b = b, a
+		}
+		if less(a, b) {
+			return true
+		}
+		if less(b, a) {
+			return false
+		}
+		return a.Name < b.Name
+	})
+	return nil
+}
+
+// ParseSize parses a number of bytes with an optional K, M or G suffix,
+// such as "100K" or "1.5G".
+func ParseSize(value string) (int64, error) {
+	n, err := ParseBandwidth(value)
+	if err != nil {
+		return 0, fmt.Errorf("invalid size %q", value)
+	}
+	return n, nil
+}
+
+// ParseSince parses the start of a time window relative to now. The value
+// can be a local date such as "2017-06-30", a local date and time such as
+// "2017-06-30 18:00" or a duration before now such as "36h".
+func ParseSince(value string, now time.Time) (time.Time, error) {
+	value = strings.TrimSpace(value)
+	if d, err := time.ParseDuration(value); err == nil {
+		return now.Add(-d), nil
+	}
+	for _, layout := range []string{"2006-01-02", "2006-01-02 15:04", "2006-01-02T15:04:05"} {
+		t, err := time.ParseInLocation(layout, value, time.Local)
+		if err == nil {
+			return t, nil
+		}
+	}
+	return time.Time{}, fmt.Errorf("invalid time %q; use a date like 2017-06-30 or a duration like 36h", value)
+}
@@ -0,0 +1,232 @@
+// Copyright 2017, Timothy Bogdala <tdb@animal-machine.com>
+// See the LICENSE file for more details.
+
+package command
+
+import (
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"sort"
+	"time"
+
+	"github.com/marcoziti/gringotts"
+	"github.com/marcoziti/gringotts/cmd/freezer/models"
+)
+
+// FileLockedError is returned when a file is locked by another client.
+type FileLockedError struct {
+	Lock filefreezer.FileLock
+
+	// File and Holder are the decrypted file name and holder of the lock,
+	// which are empty until the lock has been decrypted.
+	File   string
+	Holder string
+}
+
+func (e *FileLockedError) Error() string {
+	expires := time.Unix(e.Lock.Expires, 0).Format("2006-01-02 15:04:05")
+	if e.File == "" {
+		return fmt.Sprintf("the file is locked by another client until %s", expires)
+	}
+	return fmt.Sprintf("%s is locked by %s until %s", e.File, e.Holder, expires)
+}
+
+// Unwrap returns ErrConflict since the server refused the request with 409.
+func (e *FileLockedError) Unwrap() error {
+	return ErrConflict
+}
+
+// fileLockedError returns the error for a response refused because the file
+// is locked by another client.
+func fileLockedError(body []byte) error {
+	var resp models.FileLockResponse
+	err := json.Unmarshal(body, &resp)
+	if err != nil {
+		return fmt.Errorf("the file is locked by another client: %w", ErrConflict)
+	}
+	return &FileLockedError{Lock: resp.Lock}
+}
+
+// FileLockInfo is a lock on one of the user's files with the file name and the
+// holder decrypted.
+type FileLockInfo struct {
+	filefreezer.FileLock
+
+	// FileName is the decrypted name of the locked file.
+	FileName string
+
+	// Mine is true if the lock is held by this client's device.
+	Mine bool
+}
+
+// lockToken returns the token that identifies this client's locks. It's
+// derived from the crypto key and the device name so that the same device can
+// renew and release its locks without storing anything, while other devices
+// and users can't produce it.
+func (s *State) lockToken() string {
+	hasher := sha256.New()
+	hasher.Write(s.CryptoKey)
+	hasher.Write([]byte{0})
+	hasher.Write([]byte(s.deviceName()))
+	return base64.URLEncoding.EncodeToString(hasher.Sum(nil))
+}
+
+// decryptLock fills in the decrypted parts of the lock.
+func (s *State) decryptLock(lock filefreezer.FileLock, fileName string) FileLockInfo {
+	info := FileLockInfo{FileLock: lock, FileName: fileName, Mine: lock.Token == s.lockToken()}
+	if lock.Holder != "" {
+		holder, err := s.DecryptString(lock.Holder)
+		if err == nil {
+			info.Holder = holder
+		}
+	}
+	return info
+}
+
+// lockedBy returns the error for a file that is locked by another device.
+func lockedBy(remoteFilepath string, lock FileLockInfo) error {
+	holder := lock.Holder
+	if holder == "" {
+		holder = "another client"
+	}
+	return &FileLockedError{Lock: lock.FileLock, File: remoteFilepath, Holder: holder}
+}
+
+// LockFile takes the advisory lock on the remote file for this device, or
+// renews it if the device already holds it, so that it expires after ttl.
+// The lock doesn't keep other clients from changing the file; syncs and
+// uploads from other devices of the user check it and refuse to upload a new
+// version while it's held.
+func (s *State) LockFile(remoteFilepath string, ttl time.Duration) (*FileLockInfo, error) {
+	if err := s.requireFeature(models.FeatureLocks); err != nil {
+		return nil, err
+	}
+
+	fi, err := s.GetFileInfoByFilename(remoteFilepath)
+	if err != nil {
+		return nil, err
+	}
+
+	var putReq models.FileLockRequest
+	putReq.Token = s.lockToken()
+	putReq.Seconds = int64(ttl / time.Second)
+	putReq.Holder, err = s.encryptedDevice()
+	if err != nil {
+		return nil, err
+	}
+
+	target := fmt.Sprintf("%s/api/file/%d/lock", s.HostURI, fi.FileID)
+	body, err := s.RunAuthRequest(target, "PUT", s.AuthToken, putReq)
+	if lockedErr, ok := err.(*FileLockedError); ok {
+		return nil, lockedBy(remoteFilepath, s.decryptLock(lockedErr.Lock, remoteFilepath))
+	}
+	if err != nil {
+		return nil, fmt.Errorf("Failed to lock %s: %w", remoteFilepath, err)
+	}
+
+	var r models.FileLockResponse
+	err = json.Unmarshal(body, &r)
+	if err != nil {
+		return nil, fmt.Errorf("Failed to read the response for locking %s: %v", remoteFilepath, err)
+	}
+
+	lock := s.decryptLock(r.Lock, remoteFilepath)
+	s.Printf("%s locked until %s\n", remoteFilepath, time.Unix(lock.Expires, 0).Format("2006-01-02 15:04:05"))
+	return &lock, nil
+}
+
+// UnlockFile releases this device's lock on the remote file. If force is
+// true the lock is released even if another device holds it, such as when
+// that device is gone and the lock shouldn't be waited out.
+func (s *State) UnlockFile(remoteFilepath string, force bool) error {
+	if err := s.requireFeature(models.FeatureLocks); err != nil {
+		return err
+	}
+
+	fi, err := s.GetFileInfoByFilename(remoteFilepath)
+	if err != nil {
+		return err
+	}
+
+	var delReq models.FileUnlockRequest
+	delReq.Token = s.lockToken()
+	delReq.Force = force
+
+	target := fmt.Sprintf("%s/api/file/%d/lock", s.HostURI, fi.FileID)
+	_, err = s.RunAuthRequest(target, "DELETE", s.AuthToken, delReq)
+	if lockedErr, ok := err.(*FileLockedError); ok {
+		return lockedBy(remoteFilepath, s.decryptLock(lockedErr.Lock, remoteFilepath))
+	}
+	if err != nil {
+		return fmt.Errorf("Failed to unlock %s: %w", remoteFilepath, err)
+	}
+
+	s.Printf("%s unlocked\n", remoteFilepath)
+	return nil
+}
+
+// GetFileLocks returns the locks on the user's files sorted by file name.
+func (s *State) GetFileLocks() ([]FileLockInfo, error) {
+	if err := s.requireFeature(models.FeatureLocks); err != nil {
+		return nil, err
+	}
+
+	target := fmt.Sprintf("%s/api/locks", s.HostURI)
+	body, err := s.RunAuthRequest(target, "GET", s.AuthToken, nil)
+	if err != nil {
+		return nil, fmt.Errorf("Failed to get the file locks: %v", err)
+	}
+
+	var r models.FileLocksGetResponse
+	err = json.Unmarshal(body, &r)
+	if err != nil {
+		return nil, fmt.Errorf("Failed to read the file locks: %v", err)
+	}
+	if len(r.Locks) == 0 {
+		return nil, nil
+	}
+
+	files, err := s.getAllFilesByName()
+	if err != nil {
+		return nil, err
+	}
+	names := make(map[int]string)
+	for name, fi := range files {
+		names[fi.FileID] = name
+	}
+
+	locks := make([]FileLockInfo, 0, len(r.Locks))
+	for _, lock := range r.Locks {
+		locks = append(locks, s.decryptLock(lock, names[lock.FileID]))
+	}
+	sort.Slice(locks, func(i, j int) bool {
+		return locks[i].FileName < locks[j].FileName
+	})
+	return locks, nil
+}
+
+// checkFileLock returns an error if the file is locked by another device.
+// Servers without locks are treated as if the file isn't locked.
+func (s *State) checkFileLock(fileID int, remoteFilepath string) error {
+	if !s.ServerCapabilities.Supports(models.FeatureLocks) {
+		return nil
+	}
+
+	target := fmt.Sprintf("%s/api/file/%d/lock", s.HostURI, fileID)
+	body, err := s.RunAuthRequest(target, "GET", s.AuthToken, nil)
+	if err != nil {
+		return fmt.Errorf("Failed to get the lock on %s: %v", remoteFilepath, err)
+	}
+
+	var r models.FileLockResponse
+	err = json.Unmarshal(body, &r)
+	if err != nil {
+		return fmt.Errorf("Failed to read the lock on %s: %v", remoteFilepath, err)
+	}
+	if !r.Locked || r.Lock.Token == s.lockToken() {
+		return nil
+	}
+	return lockedBy(remoteFilepath, s.decryptLock(r.Lock, remoteFilepath))
+}
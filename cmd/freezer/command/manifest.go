@@ -0,0 +1,108 @@
+// Copyright 2017, Timothy Bogdala <tdb@animal-machine.com>
+// See the LICENSE file for more details.
+
+package command
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strings"
+)
+
+// ManifestEntry is a line of a checksum manifest.
+type ManifestEntry struct {
+	// Path is the file path relative to the manifest's prefix, using slashes
+	Path string
+
+	// SHA256 is the hex encoded SHA-256 of the file's plaintext
+	SHA256 string
+}
+
+// BuildManifest downloads the current version of every file under prefix and
+// returns their SHA-256 checksums sorted by path. The server only knows the
+// hashes of encrypted data, so the files have to be downloaded and decrypted to
+// be hashed; nothing is written to local disk. If prefix names a single file
+// the manifest holds just that file.
+func (s *State) BuildManifest(prefix string) ([]ManifestEntry, error) {
+	files, err := s.getAllFilesByName()
+	if err != nil {
+		return nil, err
+	}
+
+	prefix = strings.Trim(prefix, "/")
+	var entries []ManifestEntry
+	for name, fi := range files {
+		if fi.IsDir {
+			continue
+		}
+		rel := strings.Trim(name, "/")
+		if prefix != "" {
+			if rel == prefix {
+				rel = path.Base(rel)
+			} else if strings.HasPrefix(rel, prefix+"/") {
+				rel = strings.TrimPrefix(rel, prefix+"/")
+			} else {
+				continue
+			}
+		}
+
+		hasher := sha256.New()
+		_, err := s.downloadVersion(hasher, fi.FileID, fi.CurrentVersion.VersionID, name, fi.CurrentVersion.ChunkCount)
+		if err != nil {
+			return nil, fmt.Errorf("Failed to download %s for its checksum: %v", name, err)
+		}
+		entries = append(entries, ManifestEntry{Path: rel, SHA256: hex.EncodeToString(hasher.Sum(nil))})
+	}
+
+	if len(entries) == 0 && prefix != "" {
+		return nil, fmt.Errorf("no files were found on the server under %s", prefix)
+	}
+
+	sort.Slice(entries, func(i, j int) bool { return entries[i].Path < entries[j].Path })
+	return entries, nil
+}
+
+// WriteManifest writes the entries in the format of the sha256sum tool so that
+// the manifest can be checked with `sha256sum -c`.
+func WriteManifest(w io.Writer, entries []ManifestEntry) error {
+	for _, e := range entries {
+		_, err := fmt.Fprintf(w, "%s  %s\n", e.SHA256, e.Path)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// VerifyManifest checks the files in localDir against the entries and returns
+// a line for each file that is missing or has different contents, in the style
+// of `sha256sum -c`. An empty result means the local tree matches.
+func VerifyManifest(entries []ManifestEntry, localDir string) ([]string, error) {
+	var failed []string
+	for _, e := range entries {
+		f, err := os.Open(filepath.Join(localDir, filepath.FromSlash(e.Path)))
+		if os.IsNotExist(err) {
+			failed = append(failed, fmt.Sprintf("%s: MISSING", e.Path))
+			continue
+		} else if err != nil {
+			return nil, fmt.Errorf("Failed to open the local file %s: %v", e.Path, err)
+		}
+
+		hasher := sha256.New()
+		_, err = io.Copy(hasher, f)
+		f.Close()
+		if err != nil {
+			return nil, fmt.Errorf("Failed to read the local file %s: %v", e.Path, err)
+		}
+		if hex.EncodeToString(hasher.Sum(nil)) != e.SHA256 {
+			failed = append(failed, fmt.Sprintf("%s: FAILED", e.Path))
+		}
+	}
+	return failed, nil
+}
@@ -0,0 +1,65 @@
+// Copyright 2017, Timothy Bogdala <tdb@animal-machine.com>
+// See the LICENSE file for more details.
+
+package command
+
+import (
+	"fmt"
+	"regexp"
+)
+
+// MatchOptions change how the regular expressions given to the file commands
+// are matched against the remote file names.
+type MatchOptions struct {
+	// IgnoreCase matches letters regardless of their case
+	IgnoreCase bool
+
+	// Anchored requires the pattern to match the whole file path instead
+	// of any part of it
+	Anchored bool
+
+	// Invert selects the files that don't match the pattern
+	Invert bool
+}
+
+// FileMatcher selects remote file names with a regular expression.
+type FileMatcher struct {
+	re     *regexp.Regexp
+	invert bool
+}
+
+// NewFileMatcher compiles the pattern with the options applied.
+func NewFileMatcher(pattern string, opts MatchOptions) (*FileMatcher, error) {
+	if opts.Anchored {
+		pattern = "^(?:" + pattern + ")$"
+	}
+	if opts.IgnoreCase {
+		pattern = "(?i)" + pattern
+	}
+
+	re, err := regexp.Compile(pattern)
+	if err != nil {
+		return nil, fmt.Errorf("failed to compile the regular expression: %v", err)
+	}
+
+	return &FileMatcher{re: re, invert: opts.Invert}, nil
+}
+
+// Match returns true if the file name is selected by the matcher.
+func (m *FileMatcher) Match(filename string) bool {
+	return m.re.MatchString(filename) != m.invert
+}
+
+// Replace returns the file name with the matches of the pattern replaced,
+// expanding capture groups such as $1 in replacement.
+func (m *FileMatcher) Replace(filename string, replacement string) string {
+	return m.re.ReplaceAllString(filename, replacement)
+}
+
+// warnNoMatches lets the user know when a pattern didn't select any files,
+// which is usually a mistake in the pattern or its quoting.
+func (s *State) warnNoMatches(pattern string, matched int) {
+	if matched == 0 {
+		s.Printf("Warning: the pattern %q didn't match any files on the server.\n", pattern)
+	}
+}
@@ -0,0 +1,247 @@
+// Copyright 2017, Timothy Bogdala <tdb@animal-machine.com>
+// See the LICENSE file for more details.
+
+package command
+
+import (
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"strings"
+	"unicode/utf8"
+
+	"github.com/marcoziti/gringotts"
+)
+
+const (
+	// maxMergeSize is the largest file, in bytes, that a conflict is merged
+	// for; larger files are kept as conflicted copies.
+	maxMergeSize = 4 * 1024 * 1024
+
+	// maxMergeCells limits the work done to diff the changed lines of two
+	// files, in lines of one times lines of the other.
+	maxMergeCells = 4 * 1024 * 1024
+)
+
+// syncMerge tries to resolve a file that was changed both locally and on the
+// server since it was last synced by merging the changes into the version
+// they were both made to, which is the version it was last synced with or, if
+// that was pruned, one with the same hash. Only text files can be merged, and only if
+// the two sides didn't change the same lines. The merged file replaces the
+// local one and is uploaded as a new version, and its hash is returned. The
+// hash is empty without an error if the file couldn't be merged.
+func (s *State) syncMerge(remote filefreezer.FileInfo, localFilename string, remoteFilepath string, last SyncedFile) (mergedHash string, changeCount int, e error) {
+	minChunkSize, _ := s.chunkSizes()
+	localInfo, err := os.Stat(localFilename)
+	if err != nil || localInfo.Size() > maxMergeSize ||
+		int64(remote.CurrentVersion.ChunkCount-1)*minChunkSize > maxMergeSize {
+		return "", 0, nil
+	}
+	local, err := ioutil.ReadFile(localFilename)
+	if err != nil || !isText(local) {
+		return "", 0, nil
+	}
+
+	// find the version both changes were made to
+	versions, err := s.GetFileVersions(remoteFilepath)
+	if err != nil {
+		return "", 0, err
+	}
+	var base *filefreezer.FileVersionInfo
+	for i, v := range versions {
+		if v.VersionID == last.VersionID {
+			base = &versions[i]
+			break
+		}
+		if v.FileHash == last.Hash && (base == nil || v.VersionNumber > base.VersionNumber) {
+			base = &versions[i]
+		}
+	}
+	if base == nil {
+		return "", 0, nil
+	}
+
+	var baseData, remoteData bytes.Buffer
+	dlCount, err := s.downloadVersion(&baseData, remote.FileID, base.VersionID, remoteFilepath, base.ChunkCount)
+	changeCount += dlCount
+	if err != nil {
+		return "", changeCount, fmt.Errorf("Failed to download version %d of %s to merge: %v", base.VersionNumber, remoteFilepath, err)
+	}
+	dlCount, err = s.downloadVersion(&remoteData, remote.FileID, remote.CurrentVersion.VersionID, remoteFilepath, remote.CurrentVersion.ChunkCount)
+	changeCount += dlCount
+	if err != nil {
+		return "", changeCount, fmt.Errorf("Failed to download the current version of %s to merge: %v", remoteFilepath, err)
+	}
+	if !isText(baseData.Bytes()) || !isText(remoteData.Bytes()) {
+		return "", changeCount, nil
+	}
+
+	lines, ok := mergeLines(splitLines(baseData.String()), splitLines(string(local)), splitLines(remoteData.String()))
+	if !ok {
+		return "", changeCount, nil
+	}
+
+	err = ioutil.WriteFile(localFilename, []byte(strings.Join(lines, "")), localInfo.Mode().Perm())
+	if err != nil {
+		return "", changeCount, fmt.Errorf("Failed to write the merged file %s: %v", localFilename, err)
+	}
+	localStats, err := s.calcFileHashInfo(localFilename)
+	if err != nil {
+		return "", changeCount, fmt.Errorf("Failed to calculate the file hash data for the merged file %s: %v", localFilename, err)
+	}
+	ulCount, err := s.syncUploadNewer(remote.FileID, localFilename, remoteFilepath, false,
+		localStats.Permissions, localStats.LastMod, localStats.ChunkCount, localStats.HashString)
+	changeCount += ulCount
+	if err != nil {
+		return "", changeCount, err
+	}
+
+	s.Printf("%s <=> merged with the changes on the server\n", remoteFilepath)
+	return localStats.HashString, changeCount, nil
+}
+
+// isText returns true if the data looks like text: valid UTF-8 without any
+// NUL bytes.
+func isText(data []byte) bool {
+	return bytes.IndexByte(data, 0) < 0 && utf8.Valid(data)
+}
+
+// splitLines splits the text into lines that keep their line endings so that
+// joining them gives back the text.
+func splitLines(text string) []string {
+	var lines []string
+	for len(text) > 0 {
+		i := strings.IndexByte(text, '\n')
+		if i < 0 {
+			lines = append(lines, text)
+			break
+		}
+		lines = append(lines, text[:i+1])
+		text = text[i+1:]
+	}
+	return lines
+}
+
+// mergeLines does a three-way merge of the changes made to the base lines in
+// local and remote. Changes to different parts of the base are combined and
+// the same change made on both sides is kept once. False is returned if both
+// sides changed the same lines differently or the files are too different to
+// be compared.
+func mergeLines(base, local, remote []string) ([]string, bool) {
+	localMatches, ok := matchLines(base, local)
+	if !ok {
+		return nil, false
+	}
+	remoteMatches, ok := matchLines(base, remote)
+	if !ok {
+		return nil, false
+	}
+
+	var merged []string
+	o, a, b := 0, 0, 0
+	for {
+		// copy the lines that neither side changed
+		for o < len(base) && localMatches[o] == a && remoteMatches[o] == b {
+			merged = append(merged, base[o])
+			o, a, b = o+1, a+1, b+1
+		}
+		if o == len(base) && a == len(local) && b == len(remote) {
+			return merged, true
+		}
+
+		// the changed region ends at the next base line kept on both sides
+		next := o
+		for next < len(base) && (localMatches[next] < 0 || remoteMatches[next] < 0) {
+			next++
+		}
+		endA, endB := len(local), len(remote)
+		if next < len(base) {
+			endA, endB = localMatches[next], remoteMatches[next]
+		}
+
+		changedO, changedA, changedB := base[o:next], local[a:endA], remote[b:endB]
+		switch {
+		case equalLines(changedA, changedO):
+			merged = append(merged, changedB...)
+		case equalLines(changedB, changedO), equalLines(changedA, changedB):
+			merged = append(merged, changedA...)
+		default:
+			return nil, false
+		}
+		o, a, b = next, endA, endB
+	}
+}
+
+// matchLines returns, for each line of a, the index of the line of b it's
+// matched with in a longest common subsequence of the two, or -1 if it isn't
+// in it. False is returned if the changed lines are too many to compare.
+func matchLines(a, b []string) ([]int, bool) {
+	matches := make([]int, len(a))
+	for i := range matches {
+		matches[i] = -1
+	}
+
+	// lines that are the same at the start and end are matched up front
+	// since most edits only touch a small part of a file
+	prefix := 0
+	for prefix < len(a) && prefix < len(b) && a[prefix] == b[prefix] {
+		matches[prefix] = prefix
+		prefix++
+	}
+	suffix := 0
+	for suffix < len(a)-prefix && suffix < len(b)-prefix && a[len(a)-1-suffix] == b[len(b)-1-suffix] {
+		matches[len(a)-1-suffix] = len(b) - 1 - suffix
+		suffix++
+	}
+
+	n, m := len(a)-prefix-suffix, len(b)-prefix-suffix
+	if n == 0 || m == 0 {
+		return matches, true
+	}
+	if int64(n+1)*int64(m+1) > maxMergeCells {
+		return nil, false
+	}
+
+	// lengths[i*(m+1)+j] is the length of the longest common subsequence of
+	// the changed lines of a from i and of b from j
+	lengths := make([]int32, (n+1)*(m+1))
+	for i := n - 1; i >= 0; i-- {
+		for j := m - 1; j >= 0; j-- {
+			if a[prefix+i] == b[prefix+j] {
+				lengths[i*(m+1)+j] = lengths[(i+1)*(m+1)+j+1] + 1
+			} else if lengths[(i+1)*(m+1)+j] >= lengths[i*(m+1)+j+1] {
+				lengths[i*(m+1)+j] = lengths[(i+1)*(m+1)+j]
+			} else {
+				lengths[i*(m+1)+j] = lengths[i*(m+1)+j+1]
+			}
+		}
+	}
+
+	i, j := 0, 0
+	for i < n && j < m {
+		switch {
+		case a[prefix+i] == b[prefix+j]:
+			matches[prefix+i] = prefix + j
+			i, j = i+1, j+1
+		case lengths[(i+1)*(m+1)+j] >= lengths[i*(m+1)+j+1]:
+			i++
+		default:
+			j++
+		}
+	}
+	return matches, true
+}
+
+// equalLines returns true if both lists have the same lines.
+func equalLines(a, b []string) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if a[i] != b[i] {
+			return false
+		}
+	}
+	return true
+}
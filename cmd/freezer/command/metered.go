@@ -0,0 +1,104 @@
+// Copyright 2017, Timothy Bogdala <tdb@animal-machine.com>
+// See the LICENSE file for more details.
+
+package command
+
+import (
+	"os/exec"
+	"runtime"
+	"strings"
+	"time"
+)
+
+// Metered settings for State.Metered.
+const (
+	MeteredAuto = "auto" // detect metered connections from the OS
+	MeteredYes  = "yes"  // always treat the connection as metered
+	MeteredNo   = "no"   // never treat the connection as metered
+)
+
+const (
+	// meteredCheckInterval is how long the result of detecting a metered
+	// connection is reused before checking again.
+	meteredCheckInterval = time.Minute
+)
+
+// deferUpload returns true if uploading a file of the given size should wait
+// for an unmetered connection or for the computer to be on AC power.
+func (s *State) deferUpload(remoteFilepath string, size int64) bool {
+	if s.DeferSize <= 0 || size <= s.DeferSize {
+		return false
+	}
+	var until string
+	switch {
+	case s.isMetered():
+		until = "the connection isn't metered"
+	case s.isLowBattery():
+		until = "the computer is on AC power"
+	default:
+		return false
+	}
+
+	s.Stats.addDeferred()
+	s.Printf("%s ... deferred until %s\n", remoteFilepath, until)
+	return true
+}
+
+// isMetered returns true if the network connection should be treated as
+// metered according to the Metered setting.
+func (s *State) isMetered() bool {
+	switch s.Metered {
+	case MeteredYes:
+		return true
+	case MeteredAuto:
+		if time.Since(s.meteredChecked) > meteredCheckInterval {
+			s.meteredCached = detectMetered()
+			s.meteredChecked = time.Now()
+		}
+		return s.meteredCached
+	default:
+		return false
+	}
+}
+
+// detectMetered asks the OS whether the current connection is metered. On
+// Windows the cost of the internet connection profile is checked and on Linux
+// NetworkManager is asked about the connected devices. If the OS has no way
+// to tell, the connection is assumed to be unmetered.
+func detectMetered() bool {
+	switch runtime.GOOS {
+	case "windows":
+		script := "[void][Windows.Networking.Connectivity.NetworkInformation,Windows.Networking.Connectivity,ContentType=WindowsRuntime];" +
+			"$p = [Windows.Networking.Connectivity.NetworkInformation]::GetInternetConnectionProfile();" +
+			"if ($p) { $c = $p.GetConnectionCost(); $c.NetworkCostType; $c.Roaming }"
+		output, err := exec.Command("powershell", "-NoProfile", "-Command", script).Output()
+		if err != nil {
+			return false
+		}
+		fields := strings.Fields(string(output))
+		for _, f := range fields {
+			// Fixed and Variable costs are metered; being roaming is too
+			if f == "Fixed" || f == "Variable" || f == "True" {
+				return true
+			}
+		}
+		return false
+
+	case "linux":
+		output, err := exec.Command("nmcli", "-t", "-f", "GENERAL.METERED", "device", "show").Output()
+		if err != nil {
+			return false
+		}
+		for _, line := range strings.Split(string(output), "\n") {
+			// values are "yes", "no", "unknown" or guesses such as "yes (guessed)"
+			value := strings.TrimPrefix(strings.TrimSpace(line), "GENERAL.METERED:")
+			if strings.HasPrefix(value, "yes") {
+				return true
+			}
+		}
+		return false
+
+	default:
+		return false
+	}
+}
@@ -0,0 +1,173 @@
+// Copyright 2017, Timothy Bogdala <tdb@animal-machine.com>
+// See the LICENSE file for more details.
+
+package command
+
+import (
+	"crypto/sha1"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+
+	"github.com/marcoziti/gringotts"
+	"github.com/marcoziti/gringotts/cmd/freezer/models"
+)
+
+// PatchFile uploads the local file as a new version of the remote file that
+// only sends the chunks that differ from its current version. The server
+// copies the rest, so a small change to a large file like a database or a
+// disk image costs a few chunks instead of the whole file. The chunks are
+// compared by hash, which with content defined chunking also finds the ones
+// that moved, and the number uploaded is returned.
+func (s *State) PatchFile(localFilename string, remoteFilepath string) (uploadCount int, e error) {
+	err := s.requireFeature(models.FeaturePatch)
+	if err != nil {
+		return 0, err
+	}
+	if s.transformFor(remoteFilepath) != nil {
+		return 0, fmt.Errorf("Failed to patch %s: files synced through a transform can't be patched", remoteFilepath)
+	}
+
+	fi, err := s.GetFileInfoByFilename(remoteFilepath)
+	if err != nil {
+		return 0, err
+	}
+	if fi.IsDir {
+		return 0, fmt.Errorf("%s is a directory on the server", remoteFilepath)
+	}
+	rechunk, err := s.needsRechunk(fi)
+	if err != nil {
+		return 0, fmt.Errorf("Failed to get the chunks of %s: %v", remoteFilepath, err)
+	}
+	if rechunk {
+		return 0, fmt.Errorf("Failed to patch %s: its chunks aren't the server's chunk size; sync it instead", remoteFilepath)
+	}
+
+	// don't add a version that would conflict with another device's edits
+	err = s.checkFileLock(fi.FileID, remoteFilepath)
+	if err != nil {
+		return 0, err
+	}
+
+	localStats, err := s.calcFileHashInfo(localFilename)
+	if err != nil {
+		return 0, fmt.Errorf("Failed to calculate the local file hash data for %s: %v", localFilename, err)
+	}
+	if localStats.IsDir {
+		return 0, fmt.Errorf("%s is a local directory", localFilename)
+	}
+	if localStats.HashString == fi.CurrentVersion.FileHash {
+		s.Printf("%s --- unchanged\n", remoteFilepath)
+		return 0, nil
+	}
+
+	// find the chunks of the local file that the current version doesn't have
+	chunks, err := s.getFileChunkInfos(fi.FileID, fi.CurrentVersion.VersionID)
+	if err != nil {
+		return 0, fmt.Errorf("Failed to get the chunks of %s: %v", remoteFilepath, err)
+	}
+	sources, changed, err := s.matchChunks(localFilename, localStats.ChunkCount, chunks)
+	if err != nil {
+		return 0, err
+	}
+
+	version, uploadCount, err := s.patchVersion(fi.FileID, fi.CurrentVersion.VersionID, localFilename, remoteFilepath, localStats, sources, changed)
+	if err != nil {
+		return uploadCount, err
+	}
+	err = s.recordSynced(localFilename, remoteFilepath, localStats.HashString, &version)
+	if err != nil {
+		return uploadCount, err
+	}
+
+	s.Printf("%s ==> patched %d of %d chunks\n", remoteFilepath, len(changed), localStats.ChunkCount)
+	return uploadCount, nil
+}
+
+// matchChunks hashes the chunks of the local file and returns the chunk
+// number of the base version's chunks with the same hash for each of them, or
+// -1 for the ones in upload that the base version doesn't have. A chunk that's
+// still at its chunk number keeps it. Servers from before chunking was
+// configurable can't move chunks, so for them only chunks that stayed at their
+// number are matched.
+func (s *State) matchChunks(localFilename string, localChunkCount int, chunks []filefreezer.FileChunk) (sources []int, upload map[int]bool, e error) {
+	moved := s.ServerCapabilities.Chunking != ""
+	atNumber := make(map[int]string)
+	byHash := make(map[string]int)
+	for _, c := range chunks {
+		atNumber[c.ChunkNumber] = c.ChunkHash
+		if n, found := byHash[c.ChunkHash]; !found || c.ChunkNumber < n {
+			byHash[c.ChunkHash] = c.ChunkNumber
+		}
+	}
+
+	sources = make([]int, localChunkCount)
+	upload = make(map[int]bool)
+	err := forEachChunk(s.chunking(), int(s.ServerCapabilities.ChunkSize), localFilename, localChunkCount, func(i int, b []byte) (bool, error) {
+		hasher := sha1.New()
+		hasher.Write(b)
+		hash := base64.URLEncoding.EncodeToString(hasher.Sum(nil))
+
+		n, found := byHash[hash]
+		switch {
+		case atNumber[i] == hash:
+			sources[i] = i
+		case found && moved:
+			sources[i] = n
+		default:
+			sources[i] = -1
+			upload[i] = true
+		}
+		return true, nil
+	})
+	if err != nil {
+		return nil, nil, fmt.Errorf("Failed to compare the chunks of %s: %v", localFilename, err)
+	}
+	return sources, upload, nil
+}
+
+// patchVersion tags a new version of the file for the local file that starts
+// with copies of the base version's chunks in sources, like matchChunks
+// returns, and then uploads the local chunks in upload. The new version and
+// the number of chunks uploaded are returned.
+func (s *State) patchVersion(fileID int, baseVersionID int, localFilename string, remoteFilepath string, localStats filefreezer.FileStats, sources []int, upload map[int]bool) (version filefreezer.FileVersionInfo, uploadCount int, e error) {
+	device, err := s.encryptedDevice()
+	if err != nil {
+		return version, 0, err
+	}
+
+	// servers from before chunk sources were sent read the chunks that
+	// aren't copied in place instead
+	var replaced []int
+	for i, n := range sources {
+		if n != i {
+			replaced = append(replaced, i)
+		}
+	}
+
+	// tag the new version with the unchanged chunks copied from the base one
+	var patchReq models.FilePatchRequest
+	patchReq.BaseVersionID = baseVersionID
+	patchReq.Permissions = localStats.Permissions
+	patchReq.LastMod = localStats.LastMod
+	patchReq.ChunkCount = localStats.ChunkCount
+	patchReq.FileHash = localStats.HashString
+	patchReq.Device = device
+	patchReq.Chunks = replaced
+	patchReq.Sources = sources
+	target := fmt.Sprintf("%s/api/file/%d/patch", s.HostURI, fileID)
+	body, err := s.RunIdempotentRequest(target, "POST", s.AuthToken, patchReq)
+	if err != nil {
+		return version, 0, fmt.Errorf("Failed to patch the file %s: %v", remoteFilepath, err)
+	}
+
+	var patchResp models.NewFileVersionResponse
+	err = json.Unmarshal(body, &patchResp)
+	if err != nil {
+		return version, 0, fmt.Errorf("Failed to read the response for patching the file %s: %v", remoteFilepath, err)
+	}
+
+	version = patchResp.FileInfo.CurrentVersion
+	uploadCount, err = s.uploadChunks(fileID, version.VersionID, localFilename, remoteFilepath, localStats.ChunkCount, ">>>", upload)
+	return version, uploadCount, err
+}
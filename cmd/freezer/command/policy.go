@@ -0,0 +1,196 @@
+// Copyright 2017, Timothy Bogdala <tdb@animal-machine.com>
+// See the LICENSE file for more details.
+
+package command
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"path"
+	"sort"
+	"strings"
+)
+
+// PolicyNoTransform is the SyncPolicy Transform that turns off the --transform
+// rules for the files matching the policy.
+const PolicyNoTransform = "none"
+
+// SyncPolicy changes how the files matching a glob pattern are synced, so
+// that mixed datasets don't have to share one setting. Policies are read from
+// a JSON file with LoadSyncPolicies and the first one matching a file is used.
+type SyncPolicy struct {
+	// Pattern is matched against the remote file path with path.Match. A
+	// pattern without a slash is matched against the base name, such as
+	// *.mp4, and one ending in /** matches every file under the directory.
+	Pattern string
+
+	// Keep is the number of versions of a file to keep; older versions are
+	// removed after a sync uploads a new one and by PruneVersions. Zero
+	// keeps every version.
+	Keep int
+
+	// Transform is the "upload command|download command" pair used for the
+	// files instead of the --transform rules, or PolicyNoTransform to not
+	// transform them at all; empty leaves the --transform rules in place.
+	Transform string
+
+	// Append marks files that are only ever appended to, like logs. Newer
+	// copies are uploaded as the previous version's chunks plus the ones
+	// appended after them, without sending the data already on the server.
+	Append bool
+
+	// Exclude marks files that SyncDirectory skips.
+	Exclude bool
+
+	// Include marks files that SyncDirectory syncs even if they're in one of
+	// the default exclusions for the home directory, such as a cache that
+	// takes a long time to rebuild.
+	Include bool
+
+	// the parsed Transform; nil for PolicyNoTransform
+	transform *Transform
+}
+
+// LoadSyncPolicies reads a JSON array of SyncPolicy objects from the file,
+// such as:
+//
+//	[
+//	  {"Pattern": "*.mp4", "Keep": 2, "Transform": "none"},
+//	  {"Pattern": "docs/**", "Keep": 20, "Transform": "gzip -n|gunzip"},
+//	  {"Pattern": "*.log", "Append": true},
+//	  {"Pattern": "*.iso", "Exclude": true}
+//	]
+func LoadSyncPolicies(filename string) ([]SyncPolicy, error) {
+	data, err := ioutil.ReadFile(filename)
+	if err != nil {
+		return nil, fmt.Errorf("Failed to read the sync policies: %v", err)
+	}
+
+	var policies []SyncPolicy
+	err = json.Unmarshal(data, &policies)
+	if err != nil {
+		return nil, fmt.Errorf("Failed to read the sync policies in %s: %v", filename, err)
+	}
+
+	for i := range policies {
+		p := &policies[i]
+		if p.Pattern == "" {
+			return nil, fmt.Errorf("sync policy #%d has no pattern", i+1)
+		}
+		_, err = path.Match(strings.TrimSuffix(p.Pattern, "/**"), "")
+		if err != nil {
+			return nil, fmt.Errorf("invalid pattern for the sync policy %q: %v", p.Pattern, err)
+		}
+		if p.Keep < 0 {
+			return nil, fmt.Errorf("the sync policy %q can't keep a negative number of versions", p.Pattern)
+		}
+		if p.Transform != "" && p.Transform != PolicyNoTransform {
+			t := Transform{}
+			t.Upload, t.Download = parseTransformCommands(p.Transform)
+			if t.Upload == "" {
+				return nil, fmt.Errorf("the transform of the sync policy %q has no upload command", p.Pattern)
+			}
+			p.transform = &t
+		}
+		if p.Append && p.transform != nil {
+			return nil, fmt.Errorf("the sync policy %q can't append to transformed files", p.Pattern)
+		}
+		if p.Exclude && p.Include {
+			return nil, fmt.Errorf("the sync policy %q can't both exclude and include files", p.Pattern)
+		}
+	}
+	return policies, nil
+}
+
+// Matches returns true if the remote file path matches the policy's pattern.
+func (p *SyncPolicy) Matches(remoteFilepath string) bool {
+	if strings.HasSuffix(p.Pattern, "/**") {
+		dir := strings.TrimSuffix(p.Pattern, "/**")
+		for d := path.Dir(remoteFilepath); d != "." && d != "/"; d = path.Dir(d) {
+			if matched, _ := path.Match(dir, d); matched {
+				return true
+			}
+		}
+		return false
+	}
+
+	name := remoteFilepath
+	if !strings.Contains(p.Pattern, "/") {
+		name = path.Base(remoteFilepath)
+	}
+	matched, _ := path.Match(p.Pattern, name)
+	return matched
+}
+
+// policyFor returns the first policy matching the remote file path or nil if
+// there isn't one.
+func (s *State) policyFor(remoteFilepath string) *SyncPolicy {
+	for i := range s.Policies {
+		if s.Policies[i].Matches(remoteFilepath) {
+			return &s.Policies[i]
+		}
+	}
+	return nil
+}
+
+// applyKeep removes the versions of the file that are older than the ones its
+// policy keeps. Failures, such as an account frozen against pruning, are only
+// printed since the sync that uploaded the new version worked.
+func (s *State) applyKeep(remoteFilepath string) {
+	p := s.policyFor(remoteFilepath)
+	if p == nil || p.Keep < 1 {
+		return
+	}
+	fi, err := s.GetFileInfoByFilename(remoteFilepath)
+	if err != nil {
+		s.Printf("Failed to prune the versions of %s: %v\n", remoteFilepath, err)
+		return
+	}
+	maxVersion := fi.CurrentVersion.VersionNumber - p.Keep
+	if maxVersion < 1 {
+		return
+	}
+	err = s.RmFileVersions(remoteFilepath, 0, maxVersion, false)
+	if err != nil {
+		s.Printf("Failed to prune the versions of %s: %v\n", remoteFilepath, err)
+		return
+	}
+	s.Printf("%s -- pruned to the last %d versions\n", remoteFilepath, p.Keep)
+}
+
+// PruneVersions removes the versions of every file on the server that are
+// older than the ones kept by its policy. Nothing is removed on a dry run.
+// The number of files with versions to remove is returned along with a
+// non-nil error on failure.
+func (s *State) PruneVersions(dryRun bool) (pruneCount int, e error) {
+	files, err := s.getAllFilesByName()
+	if err != nil {
+		return 0, fmt.Errorf("could not get all of the files from the server: %v", err)
+	}
+
+	for name, fi := range files {
+		p := s.policyFor(name)
+		if fi.IsDir || p == nil || p.Keep < 1 {
+			continue
+		}
+		versions, err := s.GetFileVersions(name)
+		if err != nil {
+			return pruneCount, err
+		}
+		if len(versions) <= p.Keep {
+			continue
+		}
+
+		// the newest version to remove is the one before the kept ones
+		sort.Slice(versions, func(i, j int) bool { return versions[i].VersionNumber < versions[j].VersionNumber })
+		maxVersion := versions[len(versions)-p.Keep-1].VersionNumber
+		err = s.RmFileVersions(name, 0, maxVersion, dryRun)
+		if err != nil {
+			return pruneCount, fmt.Errorf("Failed to prune the versions of %s: %v", name, err)
+		}
+		s.Printf("%s -- removing %d versions up to version %d to keep %d\n", name, len(versions)-p.Keep, maxVersion, p.Keep)
+		pruneCount++
+	}
+	return pruneCount, nil
+}
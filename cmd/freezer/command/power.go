@@ -0,0 +1,121 @@
+// Copyright 2017, Timothy Bogdala <tdb@animal-machine.com>
+// See the LICENSE file for more details.
+
+package command
+
+import (
+	"io/ioutil"
+	"os/exec"
+	"path/filepath"
+	"regexp"
+	"runtime"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Power settings for State.Power.
+const (
+	PowerAuto    = "auto"    // detect whether the computer is on battery from the OS
+	PowerBattery = "battery" // always treat the computer as running on a low battery
+	PowerAC      = "ac"      // never treat the computer as running on battery
+)
+
+// powerCheckInterval is how long the result of detecting the power state is
+// reused before checking again.
+const powerCheckInterval = time.Minute
+
+// isLowBattery returns true if the computer is running on battery power with
+// a charge at or below the BatteryThreshold according to the Power setting.
+func (s *State) isLowBattery() bool {
+	if s.BatteryThreshold <= 0 {
+		return false
+	}
+	switch s.Power {
+	case PowerBattery:
+		return true
+	case PowerAuto:
+		if time.Since(s.batteryChecked) > powerCheckInterval {
+			onBattery, percent := detectPower()
+			s.batteryCached = onBattery && percent <= s.BatteryThreshold
+			s.batteryChecked = time.Now()
+		}
+		return s.batteryCached
+	default:
+		return false
+	}
+}
+
+// pmsetBattery matches the charge and state of a battery in the output of
+// `pmset -g batt`, such as "-InternalBattery-0 (id=1234)	85%; discharging;".
+var pmsetBattery = regexp.MustCompile(`(\d+)%;\s*(\w+)`)
+
+// detectPower asks the OS whether the computer is running on battery power
+// and the battery's charge in percent. Linux reads the power supplies in
+// sysfs, macOS asks pmset and Windows asks WMI about the battery. If the OS
+// has no way to tell, or there's no battery, it's assumed to be on AC power.
+func detectPower() (onBattery bool, percent int) {
+	switch runtime.GOOS {
+	case "linux":
+		supplies, _ := filepath.Glob("/sys/class/power_supply/*")
+		percent = 100
+		for _, supply := range supplies {
+			kind := readPowerSupply(supply, "type")
+			if kind == "Mains" && readPowerSupply(supply, "online") == "1" {
+				return false, 100
+			}
+			if kind != "Battery" {
+				continue
+			}
+			if readPowerSupply(supply, "status") == "Discharging" {
+				onBattery = true
+			}
+			if capacity, err := strconv.Atoi(readPowerSupply(supply, "capacity")); err == nil && capacity < percent {
+				percent = capacity
+			}
+		}
+		return onBattery, percent
+
+	case "darwin":
+		output, err := exec.Command("pmset", "-g", "batt").Output()
+		if err != nil || !strings.Contains(string(output), "'Battery Power'") {
+			return false, 100
+		}
+		match := pmsetBattery.FindStringSubmatch(string(output))
+		if match == nil {
+			return false, 100
+		}
+		percent, _ = strconv.Atoi(match[1])
+		return true, percent
+
+	case "windows":
+		// a BatteryStatus of 1 is discharging
+		script := "Get-CimInstance -ClassName Win32_Battery | ForEach-Object { $_.BatteryStatus; $_.EstimatedChargeRemaining }"
+		output, err := exec.Command("powershell", "-NoProfile", "-Command", script).Output()
+		if err != nil {
+			return false, 100
+		}
+		fields := strings.Fields(string(output))
+		if len(fields) < 2 || fields[0] != "1" {
+			return false, 100
+		}
+		percent, err = strconv.Atoi(fields[1])
+		if err != nil {
+			return false, 100
+		}
+		return true, percent
+
+	default:
+		return false, 100
+	}
+}
+
+// readPowerSupply returns the trimmed value of a sysfs power supply attribute
+// or an empty string if it can't be read.
+func readPowerSupply(supply string, attribute string) string {
+	data, err := ioutil.ReadFile(filepath.Join(supply, attribute))
+	if err != nil {
+		return ""
+	}
+	return strings.TrimSpace(string(data))
+}
@@ -0,0 +1,54 @@
+// Copyright 2017, Timothy Bogdala <tdb@animal-machine.com>
+// See the LICENSE file for more details.
+
+package command
+
+import (
+	"sort"
+)
+
+// Sync priorities for State.SyncPriority.
+const (
+	SyncPriorityName   = "name"   // sync files in the order the directories are walked
+	SyncPrioritySmall  = "small"  // sync the smallest files first
+	SyncPriorityRecent = "recent" // sync the most recently modified files first
+)
+
+// syncItem is a file found by SyncDirectory that is waiting to be synced.
+type syncItem struct {
+	localName  string
+	remoteName string
+	isDir      bool
+
+	// size is the length of the file, which is estimated from the chunk
+	// count for remote files
+	size int64
+
+	// lastMod is the modification time of the file (time in seconds
+	// since 1/1/1970)
+	lastMod int64
+}
+
+// prioritize orders the items to sync by the SyncPriority policy. For any
+// policy but SyncPriorityName directories go first, since syncing them only
+// registers or creates them, followed by the files in priority order; ties
+// keep the order the items were found in.
+func (s *State) prioritize(items []syncItem) {
+	var less func(a, b syncItem) bool
+	switch s.SyncPriority {
+	case SyncPrioritySmall:
+		less = func(a, b syncItem) bool { return a.size < b.size }
+	case SyncPriorityRecent:
+		less = func(a, b syncItem) bool { return a.lastMod > b.lastMod }
+	default:
+		return
+	}
+
+	sort.SliceStable(items, func(i, j int) bool {
+		a, b := items[i], items[j]
+		if a.isDir != b.isDir {
+			return a.isDir
+		}
+		return less(a, b)
+	})
+}
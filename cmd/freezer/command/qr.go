@@ -0,0 +1,59 @@
+// Copyright 2017, Timothy Bogdala <tdb@animal-machine.com>
+// See the LICENSE file for more details.
+
+package command
+
+import (
+	"bytes"
+	"fmt"
+
+	qrcode "github.com/skip2/go-qrcode"
+)
+
+const (
+	// qrPNGSize is the width and height in pixels of QR code PNG files.
+	qrPNGSize = 512
+)
+
+// PrintQRCode prints a QR code of the content to the terminal so that it can be
+// scanned by a phone. Two rows of modules are drawn per line with half block
+// characters, and the light modules are the ones drawn so that the code scans
+// correctly on terminals with light text on a dark background.
+func (s *State) PrintQRCode(content string) error {
+	qr, err := qrcode.New(content, qrcode.Medium)
+	if err != nil {
+		return fmt.Errorf("Failed to generate the QR code: %v", err)
+	}
+
+	bitmap := qr.Bitmap()
+	var buf bytes.Buffer
+	for y := 0; y < len(bitmap); y += 2 {
+		for x := range bitmap[y] {
+			top := !bitmap[y][x]
+			bottom := y+1 < len(bitmap) && !bitmap[y+1][x]
+			switch {
+			case top && bottom:
+				buf.WriteString("█")
+			case top:
+				buf.WriteString("▀")
+			case bottom:
+				buf.WriteString("▄")
+			default:
+				buf.WriteString(" ")
+			}
+		}
+		buf.WriteString("\n")
+	}
+
+	s.Printf("%s", buf.String())
+	return nil
+}
+
+// WriteQRCodePNG writes a QR code of the content to a PNG file.
+func (s *State) WriteQRCodePNG(content string, filename string) error {
+	err := qrcode.WriteFile(content, qrcode.Medium, qrPNGSize, filename)
+	if err != nil {
+		return fmt.Errorf("Failed to write the QR code to %s: %v", filename, err)
+	}
+	return nil
+}
@@ -0,0 +1,236 @@
+// Copyright 2017, Timothy Bogdala <tdb@animal-machine.com>
+// See the LICENSE file for more details.
+
+package command
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"time"
+)
+
+const (
+	// QueuedRm removes a file or, with Regex, the files matching Pattern.
+	QueuedRm = "rm"
+
+	// QueuedMv renames the files matching Pattern using Replacement.
+	QueuedMv = "mv"
+)
+
+// QueuedOp is a file operation made while the server couldn't be reached that
+// is kept in the operation queue until it's replayed.
+type QueuedOp struct {
+	// Op is QueuedRm or QueuedMv
+	Op string
+
+	// HostURI is the server the operation was meant for
+	HostURI string
+
+	// Queued is when the operation was queued (time in seconds since 1/1/1970)
+	Queued int64
+
+	Pattern     string
+	Replacement string
+	Regex       bool
+	Options     MatchOptions
+}
+
+// String describes the operation like the command that queued it.
+func (op QueuedOp) String() string {
+	switch {
+	case op.Op == QueuedMv:
+		return fmt.Sprintf("mvrx %q %q", op.Pattern, op.Replacement)
+	case op.Regex:
+		return fmt.Sprintf("file rm --regex %q", op.Pattern)
+	default:
+		return fmt.Sprintf("file rm %q", op.Pattern)
+	}
+}
+
+// ServerReachable returns true if the server at hostURI answers HTTP requests
+// at all, which tells a server that is down or a lost connection apart from
+// one rejecting the request.
+func (s *State) ServerReachable(hostURI string) bool {
+	client, err := s.getHTTPClient()
+	if err != nil {
+		return false
+	}
+	client.Timeout = 10 * time.Second
+	resp, err := client.Get(hostURI)
+	if err != nil {
+		return false
+	}
+	resp.Body.Close()
+	return true
+}
+
+// LoadOpQueue reads the queued operations from the QueueFile. A missing file
+// is an empty queue.
+func (s *State) LoadOpQueue() ([]QueuedOp, error) {
+	if s.QueueFile == "" {
+		return nil, fmt.Errorf("no operation queue file has been set")
+	}
+	data, err := ioutil.ReadFile(s.QueueFile)
+	if os.IsNotExist(err) {
+		return nil, nil
+	} else if err != nil {
+		return nil, fmt.Errorf("Failed to read the operation queue: %v", err)
+	}
+
+	var ops []QueuedOp
+	err = json.Unmarshal(data, &ops)
+	if err != nil {
+		return nil, fmt.Errorf("Failed to read the operation queue: %v", err)
+	}
+	return ops, nil
+}
+
+// saveOpQueue writes the operations to the QueueFile, removing it when there
+// aren't any left.
+func (s *State) saveOpQueue(ops []QueuedOp) error {
+	if len(ops) == 0 {
+		err := os.Remove(s.QueueFile)
+		if err != nil && !os.IsNotExist(err) {
+			return fmt.Errorf("Failed to clear the operation queue: %v", err)
+		}
+		return nil
+	}
+
+	data, err := json.MarshalIndent(ops, "", "  ")
+	if err != nil {
+		return err
+	}
+	err = writeFileAtomic(s.QueueFile, data)
+	if err != nil {
+		return fmt.Errorf("Failed to write the operation queue: %v", err)
+	}
+	return nil
+}
+
+// QueueOp adds the operation to the end of the queue in the QueueFile, stamping
+// it with the host it's for and the current time.
+func (s *State) QueueOp(hostURI string, op QueuedOp) error {
+	ops, err := s.LoadOpQueue()
+	if err != nil {
+		return err
+	}
+	op.HostURI = hostURI
+	op.Queued = time.Now().Unix()
+	ops = append(ops, op)
+	err = s.saveOpQueue(ops)
+	if err != nil {
+		return err
+	}
+
+	s.Printf("Queued until the server can be reached: %s\n", op)
+	return nil
+}
+
+// ReplayOpQueue applies the queued operations for the server at HostURI in the
+// order they were made. An operation is a conflict, and is left in the queue,
+// if a file it would change got a new version after it was queued or if it
+// can't be applied to the files on the server anymore; force applies them
+// anyway. Operations removing a single file that's already gone are dropped.
+// The number of operations applied is returned along with the conflicts.
+func (s *State) ReplayOpQueue(force bool) (applied int, conflicts []string, e error) {
+	ops, err := s.LoadOpQueue()
+	if err != nil {
+		return 0, nil, err
+	}
+
+	var remaining []QueuedOp
+	for i, op := range ops {
+		if op.HostURI != s.HostURI {
+			remaining = append(remaining, op)
+			continue
+		}
+
+		conflict, err := s.replayOp(op, force)
+		if err != nil {
+			// keep the operations that weren't attempted for next time
+			remaining = append(remaining, ops[i:]...)
+			s.saveOpQueue(remaining)
+			return applied, conflicts, fmt.Errorf("Failed to replay %s: %v", op, err)
+		}
+		if conflict != "" {
+			conflicts = append(conflicts, fmt.Sprintf("%s: %s", op, conflict))
+			remaining = append(remaining, op)
+			continue
+		}
+		applied++
+	}
+
+	return applied, conflicts, s.saveOpQueue(remaining)
+}
+
+// replayOp applies a queued operation unless it conflicts with the files on
+// the server, in which case the conflict is described instead.
+func (s *State) replayOp(op QueuedOp, force bool) (conflict string, e error) {
+	files, err := s.getAllFilesByName()
+	if err != nil {
+		return "", fmt.Errorf("could not get all of the files from the server: %v", err)
+	}
+
+	// changedSince describes a file with a version newer than the operation
+	changedSince := func(name string) string {
+		fi := files[name]
+		if force || fi.CurrentVersion.Created <= op.Queued {
+			return ""
+		}
+		return fmt.Sprintf("%s has a new version since the operation was queued", name)
+	}
+
+	switch op.Op {
+	case QueuedRm:
+		if !op.Regex {
+			fi, found := files[op.Pattern]
+			if !found {
+				s.Printf("Already removed: %s\n", op.Pattern)
+				return "", nil
+			}
+			if conflict := changedSince(op.Pattern); conflict != "" {
+				return conflict, nil
+			}
+			return "", s.RmFileByID(fi.FileID)
+		}
+
+		matcher, err := NewFileMatcher(op.Pattern, op.Options)
+		if err != nil {
+			return "", err
+		}
+		var matched []string
+		for name := range files {
+			if matcher.Match(name) {
+				if conflict := changedSince(name); conflict != "" {
+					return conflict, nil
+				}
+				matched = append(matched, name)
+			}
+		}
+		for _, name := range matched {
+			target := fmt.Sprintf("%s/api/file/%d", s.HostURI, files[name].FileID)
+			_, err = s.RunIdempotentRequest(target, "DELETE", s.AuthToken, nil)
+			if err != nil {
+				return "", fmt.Errorf("Failed to remove the file %s: %v", name, err)
+			}
+			s.Printf("Removed file: %s\n", name)
+		}
+		return "", nil
+
+	case QueuedMv:
+		renames, err := s.PlanRxRenames(op.Pattern, op.Replacement, op.Options)
+		if err != nil {
+			return err.Error(), nil
+		}
+		for _, r := range renames {
+			if conflict := changedSince(r.From); conflict != "" {
+				return conflict, nil
+			}
+		}
+		return "", s.RenameFiles(renames)
+	}
+
+	return "", fmt.Errorf("unknown queued operation %q", op.Op)
+}
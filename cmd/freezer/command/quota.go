@@ -0,0 +1,47 @@
+// Copyright 2017, Timothy Bogdala <tdb@animal-machine.com>
+// See the LICENSE file for more details.
+
+package command
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strconv"
+
+	"github.com/marcoziti/gringotts/cmd/freezer/models"
+)
+
+// checkQuotaWarning tells the user when a response says they crossed a quota
+// warning threshold they weren't told about yet, so that they can clean up
+// before their uploads start getting rejected. Servers only send the warning
+// with logins and chunk uploads, so responses without one are ignored.
+func (s *State) checkQuotaWarning(header string) {
+	threshold, err := strconv.Atoi(header)
+	if err != nil {
+		return
+	}
+
+	s.quotaLock.Lock()
+	crossed := threshold > s.QuotaWarning
+	if crossed {
+		s.QuotaWarning = threshold
+	}
+	s.quotaLock.Unlock()
+
+	if crossed {
+		s.notify(fmt.Sprintf("%d%% or more of your storage quota is used; remove old files or versions, or ask for "+
+			"a larger quota, before uploads start being rejected.", threshold))
+	}
+}
+
+// egressLimitError describes a download that the server turned away because
+// the user reached their monthly egress limit.
+func egressLimitError(body []byte) error {
+	var resp models.ErrorResponse
+	json.Unmarshal(body, &resp)
+	if resp.Error == "" {
+		return errors.New("the monthly download limit of the account has been reached")
+	}
+	return errors.New(resp.Error)
+}
@@ -0,0 +1,241 @@
+// Copyright 2017, Timothy Bogdala <tdb@animal-machine.com>
+// See the LICENSE file for more details.
+
+package command
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"sort"
+	"time"
+
+	"github.com/marcoziti/gringotts"
+	"github.com/marcoziti/gringotts/cmd/freezer/models"
+)
+
+// Rechunk splits the current version of each of the user's files whose chunks
+// don't match the server's chunk size, such as after it was changed, into
+// chunks of the new size. The server can't do this itself since the chunks are
+// encrypted, so each file is streamed down and back up as a new version with
+// the same modification time and permissions, which keeps syncs from seeing a
+// change; older versions keep their chunks. The client waits for pause between
+// files so that the server isn't kept busy. A rechunk that was interrupted is
+// resumed from the chunks it already uploaded the next time it's run. The
+// number of files rechunked is returned.
+func (s *State) Rechunk(pause time.Duration) (rechunked int, e error) {
+	if err := s.requireFeature(models.FeatureRechunk); err != nil {
+		return 0, err
+	}
+
+	// rechunking tags a new version, which would prune the one being read
+	// from if only one version of each file is kept
+	versionLimit, err := s.getVersionLimit()
+	if err != nil {
+		return 0, err
+	}
+	if versionLimit == 1 {
+		return 0, fmt.Errorf("Files can't be rechunked while only one version of each is kept")
+	}
+
+	files, err := s.getAllFilesByName()
+	if err != nil {
+		return 0, err
+	}
+	var names []string
+	for name, fi := range files {
+		if !fi.IsDir {
+			names = append(names, name)
+		}
+	}
+	sort.Strings(names)
+
+	// find the files that need rechunking first so that the progress can be shown
+	var todo []string
+	for _, name := range names {
+		needed, err := s.needsRechunk(files[name])
+		if err != nil {
+			return rechunked, fmt.Errorf("Failed to check the chunks of %s: %v", name, err)
+		}
+		if needed {
+			todo = append(todo, name)
+		}
+	}
+	if len(todo) == 0 {
+		s.Println("All files are chunked in the server's chunk size.")
+		return 0, nil
+	}
+
+	for i, name := range todo {
+		if i > 0 && pause > 0 {
+			time.Sleep(pause)
+		}
+		s.Printf("[%d/%d] Rechunking %s\n", i+1, len(todo), name)
+		done, err := s.rechunkFile(name, files[name])
+		if err != nil {
+			return rechunked, err
+		}
+		if done {
+			rechunked++
+		}
+	}
+
+	s.Printf("Rechunked %d files.\n", rechunked)
+	return rechunked, nil
+}
+
+// getVersionLimit returns the number of versions kept of each of the
+// authenticated user's files, or zero if all are kept.
+func (s *State) getVersionLimit() (int, error) {
+	target := fmt.Sprintf("%s/api/user/stats", s.HostURI)
+	body, err := s.RunAuthRequest(target, "GET", s.AuthToken, nil)
+	if err != nil {
+		return 0, fmt.Errorf("Failed to get the user stats: %v", err)
+	}
+	var r models.UserStatsGetResponse
+	err = json.Unmarshal(body, &r)
+	if err != nil {
+		return 0, fmt.Errorf("Failed to get the user stats: %v", err)
+	}
+	return r.VersionLimit, nil
+}
+
+// isUnfinishedVersion returns true if the version was tagged without chunks
+// and never finalized, such as by an interrupted stream or rechunk.
+func isUnfinishedVersion(v filefreezer.FileVersionInfo) bool {
+	return v.ChunkCount == 0 && v.FileHash == ""
+}
+
+// getFileChunkInfos returns the information about the chunks of a file version.
+func (s *State) getFileChunkInfos(fileID int, versionID int) ([]filefreezer.FileChunk, error) {
+	target := fmt.Sprintf("%s/api/chunk/%d/%d", s.HostURI, fileID, versionID)
+	body, err := s.RunAuthRequest(target, "GET", s.AuthToken, nil)
+	if err != nil {
+		return nil, err
+	}
+	var r models.FileChunksGetResponse
+	err = json.Unmarshal(body, &r)
+	if err != nil {
+		return nil, err
+	}
+	return r.Chunks, nil
+}
+
+// needsRechunk returns true if the current version of the file has chunks of
+// a different size than the server's chunk size, or is an unfinished version
+// that may be left over from an interrupted rechunk. With content defined
+// chunking only chunks over the chunk size count since the others vary in
+// size anyway. Versions that are missing chunks are skipped since they can't
+// be read.
+func (s *State) needsRechunk(fi filefreezer.FileInfo) (bool, error) {
+	if isUnfinishedVersion(fi.CurrentVersion) {
+		return true, nil
+	}
+
+	chunks, err := s.getFileChunkInfos(fi.FileID, fi.CurrentVersion.VersionID)
+	if err != nil {
+		return false, err
+	}
+	if len(chunks) != fi.CurrentVersion.ChunkCount {
+		return false, nil
+	}
+
+	want := s.ServerCapabilities.ChunkSize + cryptoOverhead
+	last := fi.CurrentVersion.ChunkCount - 1
+	fixed := s.chunking() == filefreezer.ChunkingFixed
+	for _, c := range chunks {
+		if c.Length > want || (fixed && c.Length < want && c.ChunkNumber != last) {
+			return true, nil
+		}
+	}
+	return false, nil
+}
+
+// rechunkFile streams the current version of the file into a new version
+// split into the server's chunk size. If the current version is an unfinished
+// rechunk it's resumed instead, reading from the version before it. False is
+// returned if the file was skipped.
+func (s *State) rechunkFile(name string, fi filefreezer.FileInfo) (bool, error) {
+	source := fi.CurrentVersion
+	dest := fi.CurrentVersion
+	skip := 0
+
+	if isUnfinishedVersion(fi.CurrentVersion) {
+		// a rechunk keeps the modification time of the version it reads
+		// from, which tells it apart from other unfinished uploads
+		versions, err := s.GetFileVersions(name)
+		if err != nil {
+			return false, err
+		}
+		found := false
+		for _, v := range versions {
+			if v.VersionNumber < fi.CurrentVersion.VersionNumber && !isUnfinishedVersion(v) &&
+				(!found || v.VersionNumber > source.VersionNumber) {
+				source = v
+				found = true
+			}
+		}
+		if !found || source.LastMod != fi.CurrentVersion.LastMod {
+			s.Printf("%s has an unfinished version that wasn't made by a rechunk; skipping it.\n", name)
+			return false, nil
+		}
+
+		// skip the chunks that were already uploaded in order
+		chunks, err := s.getFileChunkInfos(fi.FileID, dest.VersionID)
+		if err != nil {
+			return false, fmt.Errorf("Failed to get the uploaded chunks of %s: %v", name, err)
+		}
+		uploaded := make(map[int]bool)
+		for _, c := range chunks {
+			uploaded[c.ChunkNumber] = true
+		}
+		for uploaded[skip] {
+			skip++
+		}
+		s.Printf("%s: resuming after %d uploaded chunks\n", name, skip)
+	} else {
+		var err error
+		var postReq models.NewFileVersionRequest
+		postReq.Permissions = source.Permissions
+		postReq.LastMod = source.LastMod
+		postReq.Device, err = s.encryptedDevice()
+		if err != nil {
+			return false, err
+		}
+		target := fmt.Sprintf("%s/api/file/%d/version", s.HostURI, fi.FileID)
+		body, err := s.RunIdempotentRequest(target, "POST", s.AuthToken, postReq)
+		if err != nil {
+			return false, fmt.Errorf("Failed to tag a new version for %s: %v", name, err)
+		}
+		var postResp models.NewFileVersionResponse
+		err = json.Unmarshal(body, &postResp)
+		if err != nil {
+			return false, fmt.Errorf("Failed to read the response for tagging a new version for %s: %v", name, err)
+		}
+		dest = postResp.FileInfo.CurrentVersion
+	}
+
+	// the source version is downloaded into a pipe that the upload reads
+	// from so that nothing is written to local disk
+	pr, pw := io.Pipe()
+	go func() {
+		_, err := s.downloadVersion(pw, fi.FileID, source.VersionID, name, source.ChunkCount)
+		pw.CloseWithError(err)
+	}()
+	chunkCount, fileHash, err := s.uploadStreamChunks(pr, fi.FileID, dest.VersionID, name, skip)
+	pr.Close()
+	if err != nil {
+		return false, err
+	}
+
+	if fileHash != source.FileHash {
+		return false, fmt.Errorf("The rechunked data of %s doesn't match the hash of version %d; the new version was left unfinished", name, source.VersionNumber)
+	}
+	err = s.finalizeStreamVersion(fi.FileID, dest.VersionID, name, chunkCount, fileHash)
+	if err != nil {
+		return false, err
+	}
+
+	s.Printf("%s ==> rechunked into %d chunks\n", name, chunkCount)
+	return true, nil
+}
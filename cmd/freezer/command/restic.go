@@ -0,0 +1,287 @@
+// Copyright 2017, Timothy Bogdala <tdb@animal-machine.com>
+// See the LICENSE file for more details.
+
+package command
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/marcoziti/gringotts"
+)
+
+// resticTypes are the object types that make up a restic repository.
+var resticTypes = map[string]bool{
+	"data":      true,
+	"keys":      true,
+	"locks":     true,
+	"snapshots": true,
+	"index":     true,
+}
+
+// resticHandler implements version 1 of restic's REST backend protocol on top
+// of a Bridge. Each object in the repository is stored as its own file under
+// the prefix, e.g. restic/snapshots/<id>, and gets encrypted like any other file.
+type resticHandler struct {
+	bridge *Bridge
+	prefix string
+}
+
+// ResticHandler returns a http.Handler implementing the restic REST backend
+// protocol so that restic can use freezer storage as a repository with
+// `restic -r rest:http://localhost:8000/`. The repository is stored under the
+// remote directory prefix.
+func (b *Bridge) ResticHandler(prefix string) http.Handler {
+	return &resticHandler{bridge: b, prefix: strings.Trim(prefix, "/")}
+}
+
+// remoteName returns the remote file path for the repository object.
+func (h *resticHandler) remoteName(objType string, name string) string {
+	p := objType
+	if name != "" {
+		p += "/" + name
+	}
+	if h.prefix != "" {
+		p = h.prefix + "/" + p
+	}
+	return p
+}
+
+// remoteSize returns the plaintext size of a file. With fixed chunking every
+// chunk but the last is the full chunk size, so only the last chunk needs to
+// be downloaded; otherwise the chunk sizes are added up.
+func (h *resticHandler) remoteSize(fi filefreezer.FileInfo) (int64, error) {
+	chunkCount := fi.CurrentVersion.ChunkCount
+	if chunkCount == 0 {
+		return 0, nil
+	}
+	if h.bridge.state.chunking() != filefreezer.ChunkingFixed {
+		starts, err := h.chunkStarts(fi)
+		if err != nil {
+			return 0, err
+		}
+		return starts[chunkCount], nil
+	}
+
+	last, err := h.bridge.state.downloadChunk(fi.FileID, fi.CurrentVersion.VersionID, chunkCount-1)
+	if err != nil {
+		return 0, err
+	}
+	return int64(chunkCount-1)*h.bridge.state.ServerCapabilities.ChunkSize + int64(len(last)), nil
+}
+
+// chunkStarts returns the plaintext offset of each chunk of the file followed
+// by its plaintext size, worked out from the stored chunk lengths.
+func (h *resticHandler) chunkStarts(fi filefreezer.FileInfo) ([]int64, error) {
+	chunks, err := h.bridge.state.getFileChunkInfos(fi.FileID, fi.CurrentVersion.VersionID)
+	if err != nil {
+		return nil, err
+	}
+	if len(chunks) != fi.CurrentVersion.ChunkCount {
+		return nil, fmt.Errorf("the file %d is missing chunks", fi.FileID)
+	}
+	sort.Slice(chunks, func(i, j int) bool {
+		return chunks[i].ChunkNumber < chunks[j].ChunkNumber
+	})
+	starts := make([]int64, len(chunks)+1)
+	for i, c := range chunks {
+		starts[i+1] = starts[i] + c.Length - cryptoOverhead
+	}
+	return starts, nil
+}
+
+// parseRange parses a single byte range header of the form 'bytes=start-end'
+// or 'bytes=start-' and returns the offset and length clamped to size.
+func parseRange(header string, size int64) (offset int64, length int64, e error) {
+	spec := strings.TrimPrefix(header, "bytes=")
+	dash := strings.Index(spec, "-")
+	if spec == header || dash < 1 || strings.Contains(spec, ",") {
+		return 0, 0, fmt.Errorf("unsupported range: %s", header)
+	}
+
+	offset, err := strconv.ParseInt(spec[:dash], 10, 64)
+	if err != nil || offset >= size {
+		return 0, 0, fmt.Errorf("invalid range start: %s", header)
+	}
+
+	end := size - 1
+	if spec[dash+1:] != "" {
+		end, err = strconv.ParseInt(spec[dash+1:], 10, 64)
+		if err != nil || end < offset {
+			return 0, 0, fmt.Errorf("invalid range end: %s", header)
+		}
+		if end > size-1 {
+			end = size - 1
+		}
+	}
+
+	return offset, end - offset + 1, nil
+}
+
+// sendRange writes length bytes of the file starting at offset to w, only
+// downloading the chunks that overlap the range.
+func (h *resticHandler) sendRange(w http.ResponseWriter, fi filefreezer.FileInfo, offset int64, length int64) error {
+	chunkSize := h.bridge.state.ServerCapabilities.ChunkSize
+	startOf := func(i int) int64 { return int64(i) * chunkSize }
+	first := int(offset / chunkSize)
+	if h.bridge.state.chunking() != filefreezer.ChunkingFixed {
+		starts, err := h.chunkStarts(fi)
+		if err != nil {
+			return err
+		}
+		startOf = func(i int) int64 { return starts[i] }
+		// the first chunk is the last one starting at or before the offset
+		first = sort.Search(len(starts), func(i int) bool { return starts[i] > offset }) - 1
+	}
+
+	end := offset + length
+	for i := first; i < fi.CurrentVersion.ChunkCount && startOf(i) < end; i++ {
+		chunk, err := h.bridge.state.downloadChunk(fi.FileID, fi.CurrentVersion.VersionID, i)
+		if err != nil {
+			return err
+		}
+
+		// trim the chunk down to the part that overlaps the range
+		chunkStart := startOf(i)
+		from := int64(0)
+		if offset > chunkStart {
+			from = offset - chunkStart
+		}
+		to := int64(len(chunk))
+		if end-chunkStart < to {
+			to = end - chunkStart
+		}
+
+		_, err = w.Write(chunk[from:to])
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+func (h *resticHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	h.bridge.lock.Lock()
+	defer h.bridge.lock.Unlock()
+
+	err := h.bridge.refreshAuth()
+	if err != nil {
+		http.Error(w, "Failed to authenticate with the freezer server.", http.StatusBadGateway)
+		return
+	}
+
+	// creating the repository only creates directories, which are implied by file paths
+	p := strings.Trim(r.URL.Path, "/")
+	if p == "" {
+		if r.Method == "POST" && r.URL.Query().Get("create") == "true" {
+			return
+		}
+		http.Error(w, "Method not allowed.", http.StatusMethodNotAllowed)
+		return
+	}
+
+	var objType, name string
+	parts := strings.Split(p, "/")
+	switch {
+	case len(parts) == 1 && parts[0] == "config":
+		objType = "config"
+	case len(parts) <= 2 && resticTypes[parts[0]]:
+		objType = parts[0]
+		if len(parts) == 2 {
+			name = parts[1]
+		}
+	default:
+		http.NotFound(w, r)
+		return
+	}
+
+	files, err := h.bridge.remoteFiles()
+	if err != nil {
+		http.Error(w, "Failed to get the file list from the freezer server.", http.StatusBadGateway)
+		return
+	}
+
+	// list all of the objects of a type
+	if objType != "config" && name == "" {
+		if r.Method != "GET" {
+			http.Error(w, "Method not allowed.", http.StatusMethodNotAllowed)
+			return
+		}
+		names := []string{}
+		for _, entry := range listDir(files, h.remoteName(objType, "")) {
+			if !entry.IsDir {
+				names = append(names, entry.Name)
+			}
+		}
+		w.Header().Set("Content-Type", "application/vnd.x.restic.rest.v1")
+		json.NewEncoder(w).Encode(names)
+		return
+	}
+
+	remoteName := h.remoteName(objType, name)
+	fi, _, found := findRemoteFile(files, remoteName)
+
+	switch r.Method {
+	case "POST":
+		if found {
+			http.Error(w, "The object already exists.", http.StatusForbidden)
+			return
+		}
+		err = h.bridge.uploadFrom(r.Body, remoteName)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+		}
+
+	case "DELETE":
+		if !found {
+			http.NotFound(w, r)
+			return
+		}
+		err = h.bridge.state.RmFile(remoteName, false)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+		}
+
+	case "HEAD", "GET":
+		if !found || fi.IsDir {
+			http.NotFound(w, r)
+			return
+		}
+		size, err := h.remoteSize(fi)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadGateway)
+			return
+		}
+
+		offset, length := int64(0), size
+		status := http.StatusOK
+		if rangeHeader := r.Header.Get("Range"); rangeHeader != "" && size > 0 {
+			offset, length, err = parseRange(rangeHeader, size)
+			if err != nil {
+				http.Error(w, err.Error(), http.StatusRequestedRangeNotSatisfiable)
+				return
+			}
+			w.Header().Set("Content-Range", fmt.Sprintf("bytes %d-%d/%d", offset, offset+length-1, size))
+			status = http.StatusPartialContent
+		}
+
+		w.Header().Set("Content-Type", "application/octet-stream")
+		w.Header().Set("Content-Length", strconv.FormatInt(length, 10))
+		w.WriteHeader(status)
+		if r.Method == "HEAD" {
+			return
+		}
+		err = h.sendRange(w, fi, offset, length)
+		if err != nil {
+			h.bridge.state.Printf("Failed to send %s: %v\n", remoteName, err)
+		}
+
+	default:
+		http.Error(w, "Method not allowed.", http.StatusMethodNotAllowed)
+	}
+}
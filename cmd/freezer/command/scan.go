@@ -0,0 +1,100 @@
+// Copyright 2017, Timothy Bogdala <tdb@animal-machine.com>
+// See the LICENSE file for more details.
+
+package command
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// scanDownload downloads the file version to a temporary file in the same directory
+// as filename, runs the Scanner on it and then moves it into place if it passed.
+// Files that fail the scan are moved into QuarantineDir instead and an error is
+// returned so that the infected data never replaces the local file.
+func (s *State) scanDownload(remoteID int, remoteVersionID int, filename string, remoteFilepath string, chunkCount int) (downloadCount int, e error) {
+	tmpFile, err := ioutil.TempFile(filepath.Dir(filename), ".freezer-scan")
+	if err != nil {
+		return 0, fmt.Errorf("Failed to create a temporary file to download %s into: %v", remoteFilepath, err)
+	}
+	tmpName := tmpFile.Name()
+
+	downloadCount, err = s.downloadVersion(tmpFile, remoteID, remoteVersionID, remoteFilepath, chunkCount)
+	tmpFile.Close()
+	if err != nil {
+		os.Remove(tmpName)
+		return downloadCount, err
+	}
+
+	err = s.scanFile(tmpName)
+	if err != nil {
+		quarantined, qErr := s.quarantineFile(tmpName, filepath.Base(filename))
+		if qErr != nil {
+			os.Remove(tmpName)
+			return downloadCount, fmt.Errorf("%s failed the scan and was deleted because it couldn't be quarantined (%v): %v", remoteFilepath, qErr, err)
+		}
+		return downloadCount, fmt.Errorf("%s failed the scan and was quarantined as %s: %v", remoteFilepath, quarantined, err)
+	}
+
+	// keep the permissions of a file being replaced since the temporary
+	// file is created readable only by the owner
+	perms := os.FileMode(0644)
+	if info, err := os.Stat(filename); err == nil {
+		perms = info.Mode().Perm()
+	}
+	os.Chmod(tmpName, perms)
+
+	err = os.Rename(tmpName, filename)
+	if err != nil {
+		os.Remove(tmpName)
+		return downloadCount, fmt.Errorf("Failed to move the scanned download into place as %s: %v", filename, err)
+	}
+
+	s.Printf("%s <== scanned\n", remoteFilepath)
+	return downloadCount, nil
+}
+
+// scanFile runs the Scanner command with the filename appended to its arguments
+// and returns an error if it exits with a non-zero status.
+func (s *State) scanFile(filename string) error {
+	args := strings.Fields(s.Scanner)
+	if len(args) == 0 {
+		return nil
+	}
+	args = append(args, filename)
+
+	output, err := exec.Command(args[0], args[1:]...).CombinedOutput()
+	if err != nil {
+		return fmt.Errorf("%s: %s", err, strings.TrimSpace(string(output)))
+	}
+	return nil
+}
+
+// quarantineFile moves the file into QuarantineDir under its name with the time
+// appended so that repeated failures don't overwrite each other. The path of the
+// quarantined file is returned.
+func (s *State) quarantineFile(filename string, name string) (string, error) {
+	if s.QuarantineDir == "" {
+		return "", fmt.Errorf("no quarantine directory is configured")
+	}
+
+	err := os.MkdirAll(s.QuarantineDir, 0700)
+	if err != nil {
+		return "", err
+	}
+
+	quarantined := filepath.Join(s.QuarantineDir, name+"."+time.Now().UTC().Format("20060102-150405.000"))
+	err = os.Rename(filename, quarantined)
+	if err != nil {
+		return "", err
+	}
+
+	// nothing in quarantine should be readable or runnable by accident
+	os.Chmod(quarantined, 0400)
+	return quarantined, nil
+}
@@ -0,0 +1,241 @@
+// Copyright 2017, Timothy Bogdala <tdb@animal-machine.com>
+// See the LICENSE file for more details.
+
+package command
+
+import (
+	"bytes"
+	"crypto/ecdsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/asn1"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"encoding/pem"
+	"fmt"
+	"io/ioutil"
+	"math/big"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"runtime"
+	"strings"
+	"time"
+
+	"github.com/marcoziti/gringotts/cmd/freezer/models"
+)
+
+// ReleaseKey is the PEM encoded ECDSA public key that release binaries are
+// signed with. It's meant to be set when building releases with
+// -ldflags "-X github.com/marcoziti/gringotts/cmd/freezer/command.ReleaseKey=...".
+var ReleaseKey = ""
+
+// Release is the description of the newest client release served by a release
+// endpoint.
+type Release struct {
+	Version string
+
+	// Binaries has the builds of the release keyed by GOOS-GOARCH, such as
+	// linux-amd64.
+	Binaries map[string]ReleaseBinary
+}
+
+// ReleaseBinary is a build of a release for one platform.
+type ReleaseBinary struct {
+	// URL is where the binary is downloaded from; relative URLs are resolved
+	// against the release endpoint.
+	URL string
+
+	// SHA256 is the hex encoded hash of the binary
+	SHA256 string
+
+	// Signature is the base64 encoded ASN.1 ECDSA signature of the SHA-256
+	// hash of the binary's ReleaseManifest made with the release key.
+	Signature string
+}
+
+// ReleasePlatform is the key of the release binaries built for this platform.
+func ReleasePlatform() string {
+	return runtime.GOOS + "-" + runtime.GOARCH
+}
+
+// ReleaseManifest returns the text that's signed for a release binary. It
+// names the version and platform along with the binary's hash so that a signed
+// binary can't be served as another version, such as an older one with known
+// bugs, or for another platform.
+func ReleaseManifest(version string, platform string, sha256Hex string) []byte {
+	return []byte(fmt.Sprintf("filefreezer release\nversion: %s\nplatform: %s\nsha256: %s\n",
+		version, platform, strings.ToLower(sha256Hex)))
+}
+
+// ParseReleaseKey parses a PEM encoded ECDSA public key.
+func ParseReleaseKey(pemData []byte) (*ecdsa.PublicKey, error) {
+	block, _ := pem.Decode(pemData)
+	if block == nil {
+		return nil, fmt.Errorf("no PEM data was found for the release key")
+	}
+	pub, err := x509.ParsePKIXPublicKey(block.Bytes)
+	if err != nil {
+		return nil, fmt.Errorf("Failed to parse the release key: %v", err)
+	}
+	key, ok := pub.(*ecdsa.PublicKey)
+	if !ok {
+		return nil, fmt.Errorf("the release key is not an ECDSA public key")
+	}
+	return key, nil
+}
+
+// CheckRelease gets the newest release from the release endpoint and returns
+// it along with the binary built for this platform.
+func (s *State) CheckRelease(releaseURL string) (*Release, *ReleaseBinary, error) {
+	body, err := s.getRelease(releaseURL)
+	if err != nil {
+		return nil, nil, fmt.Errorf("Failed to get the release from %s: %v", releaseURL, err)
+	}
+
+	var release Release
+	err = json.Unmarshal(body, &release)
+	if err != nil {
+		return nil, nil, fmt.Errorf("Failed to read the release from %s: %v", releaseURL, err)
+	}
+	if release.Version == "" {
+		return nil, nil, fmt.Errorf("the release from %s has no version", releaseURL)
+	}
+	binary, found := release.Binaries[ReleasePlatform()]
+	if !found {
+		return &release, nil, fmt.Errorf("release %s has no binary for %s", release.Version, ReleasePlatform())
+	}
+
+	// resolve the binary's URL against the endpoint
+	base, err := url.Parse(releaseURL)
+	if err != nil {
+		return nil, nil, err
+	}
+	ref, err := url.Parse(binary.URL)
+	if err != nil {
+		return nil, nil, fmt.Errorf("the release binary URL %s is invalid: %v", binary.URL, err)
+	}
+	binary.URL = base.ResolveReference(ref).String()
+
+	return &release, &binary, nil
+}
+
+// SelfUpdate replaces the executable at exePath with the release binary for
+// this platform if the release endpoint has a newer version than this client.
+// The binary has to match its hash and be signed by key or nothing is changed.
+// The version of the release is returned along with whether the executable
+// was replaced.
+func (s *State) SelfUpdate(releaseURL string, key *ecdsa.PublicKey, exePath string) (version string, updated bool, e error) {
+	release, binary, err := s.CheckRelease(releaseURL)
+	if err != nil {
+		return "", false, err
+	}
+	if models.CompareVersions(release.Version, Version) <= 0 {
+		return release.Version, false, nil
+	}
+
+	data, err := s.getRelease(binary.URL)
+	if err != nil {
+		return release.Version, false, fmt.Errorf("Failed to download release %s: %v", release.Version, err)
+	}
+	err = verifyRelease(key, data, release.Version, binary)
+	if err != nil {
+		return release.Version, false, fmt.Errorf("Failed to verify release %s: %v", release.Version, err)
+	}
+
+	err = replaceExecutable(exePath, data)
+	if err != nil {
+		return release.Version, false, fmt.Errorf("Failed to replace %s: %v", exePath, err)
+	}
+	return release.Version, true, nil
+}
+
+// getRelease downloads the target from the release endpoint. Release endpoints
+// are usually not the freezer server so its certificate isn't used.
+func (s *State) getRelease(target string) ([]byte, error) {
+	client := &http.Client{Transport: s.Transport, Timeout: 5 * time.Minute}
+	resp, err := client.Get(target)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("the request to %s returned status %d", target, resp.StatusCode)
+	}
+	return ioutil.ReadAll(resp.Body)
+}
+
+// verifyRelease checks that the data is the release binary and that the
+// manifest of the version, this platform and its hash was signed with the
+// release key.
+func verifyRelease(key *ecdsa.PublicKey, data []byte, version string, binary *ReleaseBinary) error {
+	hash := sha256.Sum256(data)
+	expected, err := hex.DecodeString(binary.SHA256)
+	if err != nil || !bytes.Equal(expected, hash[:]) {
+		return fmt.Errorf("the downloaded binary does not match the release's hash")
+	}
+
+	sigBytes, err := base64.StdEncoding.DecodeString(binary.Signature)
+	if err != nil {
+		return fmt.Errorf("the release signature is not valid base64: %v", err)
+	}
+	var sig struct {
+		R, S *big.Int
+	}
+	_, err = asn1.Unmarshal(sigBytes, &sig)
+	if err != nil {
+		return fmt.Errorf("the release signature could not be parsed: %v", err)
+	}
+	manifestHash := sha256.Sum256(ReleaseManifest(version, ReleasePlatform(), binary.SHA256))
+	if !ecdsa.Verify(key, manifestHash[:], sig.R, sig.S) {
+		return fmt.Errorf("the release signature does not match the release key")
+	}
+	return nil
+}
+
+// replaceExecutable writes the data to a file next to exePath with the same
+// permissions and then renames it into place. Windows won't replace a running
+// executable so the old one is moved out of the way first and left as .old.
+func replaceExecutable(exePath string, data []byte) error {
+	info, err := os.Stat(exePath)
+	if err != nil {
+		return err
+	}
+
+	newPath := filepath.Join(filepath.Dir(exePath), "."+filepath.Base(exePath)+".new")
+	err = ioutil.WriteFile(newPath, data, info.Mode().Perm())
+	if err != nil {
+		return err
+	}
+	// WriteFile doesn't change the mode of an existing file
+	err = os.Chmod(newPath, info.Mode().Perm())
+	if err != nil {
+		os.Remove(newPath)
+		return err
+	}
+
+	if runtime.GOOS == "windows" {
+		oldPath := exePath + ".old"
+		os.Remove(oldPath)
+		err = os.Rename(exePath, oldPath)
+		if err != nil {
+			os.Remove(newPath)
+			return err
+		}
+		err = os.Rename(newPath, exePath)
+		if err != nil {
+			// put the old executable back
+			os.Rename(oldPath, exePath)
+			os.Remove(newPath)
+		}
+		return err
+	}
+
+	err = os.Rename(newPath, exePath)
+	if err != nil {
+		os.Remove(newPath)
+	}
+	return err
+}
@@ -0,0 +1,299 @@
+// Copyright 2017, Timothy Bogdala <tdb@animal-machine.com>
+// See the LICENSE file for more details.
+
+package command
+
+import (
+	"crypto/subtle"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/pkg/sftp"
+	"golang.org/x/crypto/ssh"
+)
+
+// ServeSFTP listens on listenAddr and serves the user's files over SFTP using
+// hostKey as the server's key. Clients log in with the same username and
+// password that the bridge used to authenticate with the freezer server.
+// This function blocks until the listener fails.
+func (b *Bridge) ServeSFTP(listenAddr string, hostKey ssh.Signer) error {
+	listener, err := net.Listen("tcp", listenAddr)
+	if err != nil {
+		return fmt.Errorf("Failed to listen on %s: %v", listenAddr, err)
+	}
+	return b.ServeSFTPListener(listener, hostKey)
+}
+
+// ServeSFTPListener is ServeSFTP for connections accepted from listener, which
+// gets closed when the function returns.
+func (b *Bridge) ServeSFTPListener(listener net.Listener, hostKey ssh.Signer) error {
+	config := &ssh.ServerConfig{
+		PasswordCallback: func(conn ssh.ConnMetadata, password []byte) (*ssh.Permissions, error) {
+			userOK := subtle.ConstantTimeCompare([]byte(conn.User()), []byte(b.username)) == 1
+			passOK := subtle.ConstantTimeCompare(password, []byte(b.password)) == 1
+			if userOK && passOK {
+				return nil, nil
+			}
+			return nil, fmt.Errorf("password rejected for %s", conn.User())
+		},
+	}
+	config.AddHostKey(hostKey)
+	defer listener.Close()
+
+	for {
+		conn, err := listener.Accept()
+		if err != nil {
+			return fmt.Errorf("Failed to accept an incoming connection: %v", err)
+		}
+		go b.handleSSHConn(conn, config)
+	}
+}
+
+// handleSSHConn performs the SSH handshake and starts the SFTP subsystem for
+// any session channel that requests it.
+func (b *Bridge) handleSSHConn(conn net.Conn, config *ssh.ServerConfig) {
+	sconn, chans, reqs, err := ssh.NewServerConn(conn, config)
+	if err != nil {
+		b.state.Printf("SFTP handshake failed for %s: %v\n", conn.RemoteAddr(), err)
+		conn.Close()
+		return
+	}
+	defer sconn.Close()
+	go ssh.DiscardRequests(reqs)
+
+	for newChannel := range chans {
+		if newChannel.ChannelType() != "session" {
+			newChannel.Reject(ssh.UnknownChannelType, "unknown channel type")
+			continue
+		}
+
+		channel, requests, err := newChannel.Accept()
+		if err != nil {
+			b.state.Printf("Failed to accept the SSH channel: %v\n", err)
+			continue
+		}
+
+		go func(in <-chan *ssh.Request) {
+			for req := range in {
+				// the payload of a subsystem request is a length prefixed string
+				ok := false
+				if req.Type == "subsystem" && len(req.Payload) > 4 &&
+					int(binary.BigEndian.Uint32(req.Payload)) == len(req.Payload)-4 &&
+					string(req.Payload[4:]) == "sftp" {
+					ok = true
+				}
+				req.Reply(ok, nil)
+			}
+		}(requests)
+
+		server := sftp.NewRequestServer(channel, sftp.Handlers{
+			FileGet:  b,
+			FilePut:  b,
+			FileCmd:  b,
+			FileList: b,
+		})
+		go func() {
+			err := server.Serve()
+			if err != nil && err != io.EOF {
+				b.state.Printf("SFTP session ended with an error: %v\n", err)
+			}
+			server.Close()
+		}()
+	}
+}
+
+// sftpFileInfo implements os.FileInfo for the bridged files. The plaintext size
+// of a file isn't known without downloading it, so it is reported as zero;
+// clients read until EOF.
+type sftpFileInfo struct {
+	name    string
+	isDir   bool
+	mode    os.FileMode
+	modTime time.Time
+}
+
+func (fi *sftpFileInfo) Name() string       { return fi.name }
+func (fi *sftpFileInfo) Size() int64        { return 0 }
+func (fi *sftpFileInfo) Mode() os.FileMode  { return fi.mode }
+func (fi *sftpFileInfo) ModTime() time.Time { return fi.modTime }
+func (fi *sftpFileInfo) IsDir() bool        { return fi.isDir }
+func (fi *sftpFileInfo) Sys() interface{}   { return nil }
+
+// newSFTPFileInfo builds the file information for a bridged directory entry.
+func newSFTPFileInfo(entry bridgeEntry) *sftpFileInfo {
+	fi := &sftpFileInfo{name: entry.Name, isDir: entry.IsDir}
+	if entry.IsDir {
+		fi.mode = os.ModeDir | 0755
+		if entry.Info.FileID != 0 {
+			fi.modTime = time.Unix(entry.Info.CurrentVersion.LastMod, 0)
+		}
+	} else {
+		fi.mode = os.FileMode(entry.Info.CurrentVersion.Permissions).Perm()
+		fi.modTime = time.Unix(entry.Info.CurrentVersion.LastMod, 0)
+	}
+	return fi
+}
+
+// sftpLister implements sftp.ListerAt for a slice of file information.
+type sftpLister []os.FileInfo
+
+func (l sftpLister) ListAt(f []os.FileInfo, offset int64) (int, error) {
+	if offset >= int64(len(l)) {
+		return 0, io.EOF
+	}
+	n := copy(f, l[offset:])
+	if n < len(f) {
+		return n, io.EOF
+	}
+	return n, nil
+}
+
+// sftpTempFile is a temporary file that gets removed when it's closed; if
+// remoteFilepath is set, the file is uploaded to the server first.
+type sftpTempFile struct {
+	*os.File
+	bridge         *Bridge
+	remoteFilepath string
+}
+
+func (f *sftpTempFile) Close() error {
+	defer os.Remove(f.Name())
+	err := f.File.Close()
+	if err != nil || f.remoteFilepath == "" {
+		return err
+	}
+
+	f.bridge.lock.Lock()
+	defer f.bridge.lock.Unlock()
+	err = f.bridge.refreshAuth()
+	if err != nil {
+		return err
+	}
+	_, _, err = f.bridge.state.SyncFile(f.Name(), f.remoteFilepath, SyncCurrentVersion)
+	return err
+}
+
+// Fileread implements sftp.FileReader by downloading the current version of the
+// file to a temporary file.
+func (b *Bridge) Fileread(r *sftp.Request) (io.ReaderAt, error) {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+	err := b.refreshAuth()
+	if err != nil {
+		return nil, err
+	}
+
+	files, err := b.remoteFiles()
+	if err != nil {
+		return nil, err
+	}
+	fi, remoteName, found := findRemoteFile(files, r.Filepath)
+	if !found || fi.IsDir {
+		return nil, os.ErrNotExist
+	}
+
+	tmpFile, err := ioutil.TempFile("", "freezer-sftp")
+	if err != nil {
+		return nil, err
+	}
+	f := &sftpTempFile{File: tmpFile, bridge: b}
+	_, err = b.state.downloadVersion(tmpFile, fi.FileID, fi.CurrentVersion.VersionID, remoteName, fi.CurrentVersion.ChunkCount)
+	if err != nil {
+		f.Close()
+		return nil, err
+	}
+
+	return f, nil
+}
+
+// Filewrite implements sftp.FileWriter by writing to a temporary file that gets
+// uploaded to the server when the client closes it.
+func (b *Bridge) Filewrite(r *sftp.Request) (io.WriterAt, error) {
+	tmpFile, err := ioutil.TempFile("", "freezer-sftp")
+	if err != nil {
+		return nil, err
+	}
+	return &sftpTempFile{File: tmpFile, bridge: b, remoteFilepath: strings.TrimPrefix(r.Filepath, "/")}, nil
+}
+
+// Filecmd implements sftp.FileCmder. Directories are implied by the file paths
+// so creating or removing them is a no-op and renames are not supported.
+func (b *Bridge) Filecmd(r *sftp.Request) error {
+	switch r.Method {
+	case "Setstat", "Mkdir", "Rmdir":
+		return nil
+	case "Remove":
+		b.lock.Lock()
+		defer b.lock.Unlock()
+		err := b.refreshAuth()
+		if err != nil {
+			return err
+		}
+
+		files, err := b.remoteFiles()
+		if err != nil {
+			return err
+		}
+		_, remoteName, found := findRemoteFile(files, r.Filepath)
+		if !found {
+			return os.ErrNotExist
+		}
+		return b.state.RmFile(remoteName, false)
+	}
+
+	return sftp.ErrSshFxOpUnsupported
+}
+
+// Filelist implements sftp.FileLister for directory listings and stat calls.
+func (b *Bridge) Filelist(r *sftp.Request) (sftp.ListerAt, error) {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+	err := b.refreshAuth()
+	if err != nil {
+		return nil, err
+	}
+
+	files, err := b.remoteFiles()
+	if err != nil {
+		return nil, err
+	}
+
+	switch r.Method {
+	case "List":
+		entries := listDir(files, r.Filepath)
+		list := make(sftpLister, 0, len(entries))
+		for _, entry := range entries {
+			list = append(list, newSFTPFileInfo(entry))
+		}
+		return list, nil
+
+	case "Stat":
+		name := strings.Trim(r.Filepath, "/")
+		if name == "" {
+			return sftpLister{&sftpFileInfo{name: "/", isDir: true, mode: os.ModeDir | 0755}}, nil
+		}
+
+		fi, _, found := findRemoteFile(files, r.Filepath)
+		if !found {
+			// it may still be a directory implied by the paths of other files
+			if len(listDir(files, r.Filepath)) == 0 {
+				return nil, os.ErrNotExist
+			}
+			return sftpLister{newSFTPFileInfo(bridgeEntry{Name: lastPathElement(name), IsDir: true})}, nil
+		}
+		return sftpLister{newSFTPFileInfo(bridgeEntry{Name: lastPathElement(name), IsDir: fi.IsDir, Info: fi})}, nil
+	}
+
+	return nil, sftp.ErrSshFxOpUnsupported
+}
+
+// lastPathElement returns the final element of a slash separated path.
+func lastPathElement(p string) string {
+	return p[strings.LastIndex(p, "/")+1:]
+}
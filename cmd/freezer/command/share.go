@@ -0,0 +1,191 @@
+// Copyright 2017, Timothy Bogdala <tdb@animal-machine.com>
+// See the LICENSE file for more details.
+
+package command
+
+import (
+	"encoding/json"
+	"fmt"
+	"mime"
+	"path"
+	"sort"
+	"strings"
+
+	"github.com/marcoziti/gringotts"
+	"github.com/marcoziti/gringotts/cmd/freezer/models"
+)
+
+// ShareOptions are the optional settings for new shares.
+type ShareOptions struct {
+	// ContentType is the MIME type the shares are served with; if it's empty
+	// the type is guessed from each name's extension or by the server from the data
+	ContentType string
+
+	// Password is required to download the shares if it isn't empty
+	Password string
+
+	// MaxDownloads limits the number of times each share can be downloaded
+	// if it isn't zero
+	MaxDownloads int
+}
+
+// ShareFiles publishes the current version of remotePath so that it can be
+// downloaded anonymously from servers that allow public access. The file is
+// decrypted client-side and uploaded to the server unencrypted. If remotePath
+// is a directory, every file under it gets shared with its relative path
+// appended to shareName. An empty shareName uses remotePath itself. The shares
+// that were created are returned along with a non-nil error on failure.
+func (s *State) ShareFiles(remotePath string, shareName string, opts ShareOptions) ([]filefreezer.Share, error) {
+	if err := s.requireFeature(models.FeatureShares); err != nil {
+		return nil, err
+	}
+
+	files, err := s.getAllFilesByName()
+	if err != nil {
+		return nil, err
+	}
+
+	if shareName == "" {
+		shareName = remotePath
+	}
+	shareName = strings.Trim(shareName, "/")
+
+	// a single file gets shared under the name as is
+	fi, remoteName, found := findRemoteFile(files, remotePath)
+	if found && !fi.IsDir {
+		share, err := s.shareFile(fi, remoteName, shareName, opts)
+		if err != nil {
+			return nil, err
+		}
+		return []filefreezer.Share{*share}, nil
+	}
+
+	// otherwise share everything under the directory prefix
+	prefix := strings.Trim(remotePath, "/") + "/"
+	var names []string
+	for name, fi := range files {
+		if !fi.IsDir && strings.HasPrefix(strings.TrimPrefix(name, "/"), prefix) {
+			names = append(names, name)
+		}
+	}
+	if len(names) == 0 {
+		return nil, fmt.Errorf("no files were found on the server for %s", remotePath)
+	}
+	sort.Strings(names)
+
+	var shares []filefreezer.Share
+	for _, name := range names {
+		rel := strings.TrimPrefix(strings.TrimPrefix(name, "/"), prefix)
+		share, err := s.shareFile(files[name], name, shareName+"/"+rel, opts)
+		if err != nil {
+			return shares, err
+		}
+		shares = append(shares, *share)
+	}
+
+	return shares, nil
+}
+
+// shareFile registers the share and uploads each decrypted chunk of the current
+// version of the file.
+func (s *State) shareFile(fi filefreezer.FileInfo, remoteName string, shareName string, opts ShareOptions) (*filefreezer.Share, error) {
+	contentType := opts.ContentType
+	if contentType == "" {
+		contentType = mime.TypeByExtension(path.Ext(shareName))
+	}
+
+	var postReq models.ShareAddRequest
+	postReq.Name = shareName
+	postReq.LastMod = fi.CurrentVersion.LastMod
+	postReq.ChunkCount = fi.CurrentVersion.ChunkCount
+	postReq.FileHash = fi.CurrentVersion.FileHash
+	postReq.ContentType = contentType
+	postReq.Password = opts.Password
+	postReq.MaxDownloads = opts.MaxDownloads
+	target := fmt.Sprintf("%s/api/shares", s.HostURI)
+	body, err := s.RunAuthRequest(target, "POST", s.AuthToken, postReq)
+	if err != nil {
+		return nil, fmt.Errorf("Failed to create the share %s: %v", shareName, err)
+	}
+
+	var postResp models.ShareAddResponse
+	err = json.Unmarshal(body, &postResp)
+	if err != nil {
+		return nil, fmt.Errorf("Failed to read the response for creating the share %s: %v", shareName, err)
+	}
+
+	for i := 0; i < fi.CurrentVersion.ChunkCount; i++ {
+		chunk, err := s.downloadChunk(fi.FileID, fi.CurrentVersion.VersionID, i)
+		if err != nil {
+			return nil, err
+		}
+
+		target = fmt.Sprintf("%s/api/share/%d/%d", s.HostURI, postResp.ShareID, i)
+		body, err = s.RunAuthRequest(target, "PUT", s.AuthToken, chunk)
+		if err != nil {
+			return nil, fmt.Errorf("Failed to upload chunk #%d for the share %s: %v", i, shareName, err)
+		}
+
+		var putResp models.ShareChunkPutResponse
+		err = json.Unmarshal(body, &putResp)
+		if err != nil || putResp.Status == false {
+			return nil, fmt.Errorf("Failed to upload chunk #%d for the share %s: %v", i, shareName, err)
+		}
+	}
+
+	s.Printf("%s ==> shared as %s\n", remoteName, shareName)
+	return &postResp.Share, nil
+}
+
+// GetShares returns all of the public shares for the authenticated user.
+func (s *State) GetShares() ([]filefreezer.Share, error) {
+	if err := s.requireFeature(models.FeatureShares); err != nil {
+		return nil, err
+	}
+
+	target := fmt.Sprintf("%s/api/shares", s.HostURI)
+	body, err := s.RunAuthRequest(target, "GET", s.AuthToken, nil)
+	if err != nil {
+		return nil, fmt.Errorf("Failed to get the list of shares: %v", err)
+	}
+
+	var resp models.SharesGetResponse
+	err = json.Unmarshal(body, &resp)
+	if err != nil {
+		return nil, fmt.Errorf("Failed to read the list of shares: %v", err)
+	}
+
+	return resp.Shares, nil
+}
+
+// RmShare stops sharing the file with the share name given.
+func (s *State) RmShare(shareName string) error {
+	shares, err := s.GetShares()
+	if err != nil {
+		return err
+	}
+
+	shareName = strings.Trim(shareName, "/")
+	for _, share := range shares {
+		if share.Name != shareName {
+			continue
+		}
+
+		target := fmt.Sprintf("%s/api/share/%d", s.HostURI, share.ShareID)
+		body, err := s.RunAuthRequest(target, "DELETE", s.AuthToken, nil)
+		if err != nil {
+			return fmt.Errorf("Failed to remove the share %s: %v", shareName, err)
+		}
+
+		var resp models.ShareDeleteResponse
+		err = json.Unmarshal(body, &resp)
+		if err != nil || resp.Success == false {
+			return fmt.Errorf("Failed to remove the share %s: %v", shareName, err)
+		}
+
+		s.Printf("Share %s removed\n", shareName)
+		return nil
+	}
+
+	return fmt.Errorf("the share %s was not found", shareName)
+}
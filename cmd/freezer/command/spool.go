@@ -0,0 +1,161 @@
+// Copyright 2017, Timothy Bogdala <tdb@animal-machine.com>
+// See the LICENSE file for more details.
+
+package command
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	"github.com/marcoziti/gringotts/cmd/freezer/models"
+)
+
+// SpooledChunk describes an encrypted chunk in the spool directory that is
+// waiting to be uploaded to a file version on the server.
+type SpooledChunk struct {
+	HostURI        string
+	FileID         int
+	VersionID      int
+	ChunkNumber    int
+	ChunkCount     int
+	ChunkHash      string
+	RemoteFilepath string
+
+	// the path of the spool file without the .json or .chunk extension
+	path string
+}
+
+// spoolChunk writes the encrypted chunk and where it goes to the spool
+// directory before it's sent so that it can be pushed later with FlushSpool
+// if the upload fails. The data is written before the description so that
+// every described chunk is complete.
+func (s *State) spoolChunk(sc SpooledChunk, cryptoBytes []byte) (SpooledChunk, error) {
+	err := os.MkdirAll(s.SpoolDir, 0700)
+	if err != nil {
+		return sc, fmt.Errorf("Failed to create the spool directory: %v", err)
+	}
+
+	sc.path = filepath.Join(s.SpoolDir, fmt.Sprintf("%d-%d-%d", sc.FileID, sc.VersionID, sc.ChunkNumber))
+	err = writeFileAtomic(sc.path+".chunk", cryptoBytes)
+	if err != nil {
+		return sc, fmt.Errorf("Failed to write the chunk to the spool: %v", err)
+	}
+	desc, err := json.Marshal(sc)
+	if err != nil {
+		return sc, err
+	}
+	err = writeFileAtomic(sc.path+".json", desc)
+	if err != nil {
+		return sc, fmt.Errorf("Failed to write the chunk to the spool: %v", err)
+	}
+	return sc, nil
+}
+
+// unspoolChunk removes an uploaded chunk from the spool directory.
+func (s *State) unspoolChunk(sc SpooledChunk) {
+	if sc.path == "" {
+		return
+	}
+	os.Remove(sc.path + ".json")
+	os.Remove(sc.path + ".chunk")
+}
+
+// SpooledChunks returns the chunks waiting in the spool directory to be
+// uploaded to the server at HostURI, ordered by file version and chunk number.
+func (s *State) SpooledChunks() ([]SpooledChunk, error) {
+	if s.SpoolDir == "" {
+		return nil, fmt.Errorf("no spool directory has been set")
+	}
+	names, err := filepath.Glob(filepath.Join(s.SpoolDir, "*.json"))
+	if err != nil {
+		return nil, err
+	}
+
+	var chunks []SpooledChunk
+	for _, name := range names {
+		desc, err := ioutil.ReadFile(name)
+		if err != nil {
+			return nil, fmt.Errorf("Failed to read the spooled chunk %s: %v", name, err)
+		}
+		var sc SpooledChunk
+		err = json.Unmarshal(desc, &sc)
+		if err != nil {
+			return nil, fmt.Errorf("Failed to read the spooled chunk %s: %v", name, err)
+		}
+		if sc.HostURI != s.HostURI {
+			continue
+		}
+		sc.path = strings.TrimSuffix(name, ".json")
+		chunks = append(chunks, sc)
+	}
+
+	sort.Slice(chunks, func(i, j int) bool {
+		a, b := chunks[i], chunks[j]
+		if a.FileID != b.FileID {
+			return a.FileID < b.FileID
+		}
+		if a.VersionID != b.VersionID {
+			return a.VersionID < b.VersionID
+		}
+		return a.ChunkNumber < b.ChunkNumber
+	})
+	return chunks, nil
+}
+
+// FlushSpool uploads the chunks waiting in the spool directory for the server
+// at HostURI, removing each one once the server has it. Chunks that fail to
+// upload are left in the spool and the last error is returned.
+func (s *State) FlushSpool() (uploadCount int, e error) {
+	chunks, err := s.SpooledChunks()
+	if err != nil {
+		return 0, err
+	}
+
+	var lastErr error
+	for _, sc := range chunks {
+		cryptoBytes, err := ioutil.ReadFile(sc.path + ".chunk")
+		if err != nil {
+			lastErr = fmt.Errorf("Failed to read the spooled chunk %s: %v", sc.path, err)
+			s.Println(lastErr)
+			continue
+		}
+
+		target := fmt.Sprintf("%s/api/chunk/%d/%d/%d/%s", s.HostURI, sc.FileID, sc.VersionID, sc.ChunkNumber, sc.ChunkHash)
+		body, err := s.RunAuthRequest(target, "PUT", s.AuthToken, cryptoBytes)
+		if err == nil {
+			var resp models.FileChunkPutResponse
+			err = json.Unmarshal(body, &resp)
+			if err == nil && resp.Status == false {
+				err = fmt.Errorf("the server did not accept the chunk")
+			}
+		}
+		if err != nil {
+			lastErr = fmt.Errorf("Failed to upload spooled chunk %d of %s: %v", sc.ChunkNumber+1, sc.RemoteFilepath, err)
+			s.Println(lastErr)
+			continue
+		}
+
+		s.Stats.addUpload(len(cryptoBytes))
+		s.unspoolChunk(sc)
+		uploadCount++
+		s.Printf("%s ==> %d / %d (spooled)\n", sc.RemoteFilepath, sc.ChunkNumber+1, sc.ChunkCount)
+	}
+
+	return uploadCount, lastErr
+}
+
+// writeFileAtomic writes the data to a temporary file next to filename and
+// then renames it into place.
+func writeFileAtomic(filename string, data []byte) error {
+	tmp := filename + ".tmp"
+	err := ioutil.WriteFile(tmp, data, 0600)
+	if err != nil {
+		return err
+	}
+	return os.Rename(tmp, filename)
+}
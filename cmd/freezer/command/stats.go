@@ -0,0 +1,81 @@
+// Copyright 2017, Timothy Bogdala <tdb@animal-machine.com>
+// See the LICENSE file for more details.
+
+package command
+
+import (
+	"sync"
+)
+
+// SyncStats counts the work done by sync operations over the life of a State.
+// It is safe to read while a sync is running in another goroutine.
+type SyncStats struct {
+	lock sync.Mutex
+
+	chunksUploaded   int64
+	chunksDownloaded int64
+	bytesUploaded    int64
+	bytesDownloaded  int64
+	conflicts        int64
+	deferred         int64
+}
+
+// SyncCounts is a snapshot of the counters in SyncStats.
+type SyncCounts struct {
+	ChunksUploaded   int64
+	ChunksDownloaded int64
+	BytesUploaded    int64
+	BytesDownloaded  int64
+
+	// Conflicts is the number of files found to differ from the server
+	// in a way that sync couldn't reconcile
+	Conflicts int64
+
+	// Deferred is the number of uploads put off because the connection
+	// was metered
+	Deferred int64
+}
+
+// Counts returns a snapshot of the counters.
+func (ss *SyncStats) Counts() SyncCounts {
+	ss.lock.Lock()
+	defer ss.lock.Unlock()
+	return SyncCounts{
+		ChunksUploaded:   ss.chunksUploaded,
+		ChunksDownloaded: ss.chunksDownloaded,
+		BytesUploaded:    ss.bytesUploaded,
+		BytesDownloaded:  ss.bytesDownloaded,
+		Conflicts:        ss.conflicts,
+		Deferred:         ss.deferred,
+	}
+}
+
+// addUpload counts a chunk of the given size, as sent, that was uploaded.
+func (ss *SyncStats) addUpload(size int) {
+	ss.lock.Lock()
+	ss.chunksUploaded++
+	ss.bytesUploaded += int64(size)
+	ss.lock.Unlock()
+}
+
+// addDownload counts a chunk of the given size, as received, that was downloaded.
+func (ss *SyncStats) addDownload(size int) {
+	ss.lock.Lock()
+	ss.chunksDownloaded++
+	ss.bytesDownloaded += int64(size)
+	ss.lock.Unlock()
+}
+
+// addConflict counts a file that couldn't be reconciled.
+func (ss *SyncStats) addConflict() {
+	ss.lock.Lock()
+	ss.conflicts++
+	ss.lock.Unlock()
+}
+
+// addDeferred counts an upload that was put off until later.
+func (ss *SyncStats) addDeferred() {
+	ss.lock.Lock()
+	ss.deferred++
+	ss.lock.Unlock()
+}
@@ -0,0 +1,267 @@
+// Copyright 2017, Timothy Bogdala <tdb@animal-machine.com>
+// See the LICENSE file for more details.
+
+package command
+
+import (
+	"crypto/sha1"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"os/exec"
+	"time"
+
+	"github.com/marcoziti/gringotts"
+	"github.com/marcoziti/gringotts/cmd/freezer/models"
+)
+
+// UploadStream reads r until EOF and uploads the data as a new version of
+// remoteFilepath, registering the file if it doesn't exist yet. The data is
+// chunked and encrypted as it is read so the total length doesn't need to be
+// known in advance and nothing is written to local disk. The version gets tagged
+// with zero chunks first and then finalized once the stream has been read. The
+// number of uploaded chunks is returned along with a non-nil error on failure.
+func (s *State) UploadStream(r io.Reader, remoteFilepath string) (uploadCount int, e error) {
+	if err := s.requireFeature(models.FeatureStreaming); err != nil {
+		return 0, err
+	}
+
+	fi, err := s.tagStreamVersion(remoteFilepath)
+	if err != nil {
+		return 0, err
+	}
+
+	uploadCount, fileHash, err := s.uploadStreamChunks(r, fi.FileID, fi.CurrentVersion.VersionID, remoteFilepath, 0)
+	if err != nil {
+		return uploadCount, err
+	}
+
+	// finalize the version now that the chunk count and hash are known
+	err = s.finalizeStreamVersion(fi.FileID, fi.CurrentVersion.VersionID, remoteFilepath, uploadCount, fileHash)
+	if err != nil {
+		return uploadCount, err
+	}
+
+	s.Printf("%s ==> uploaded\n", remoteFilepath)
+	return uploadCount, nil
+}
+
+// uploadStreamChunks reads r until EOF and uploads the data split with the
+// server's chunking to the version given. The first skip chunks are only
+// hashed, which resumes an upload that already sent them. The number of chunks
+// read is returned along with the hash of all of the data.
+func (s *State) uploadStreamChunks(r io.Reader, fileID int, versionID int, remoteFilepath string, skip int) (chunkCount int, fileHash string, e error) {
+	fileHasher := sha1.New()
+	chunker, err := filefreezer.NewChunker(r, s.chunking(), int(s.ServerCapabilities.ChunkSize))
+	if err != nil {
+		return 0, "", err
+	}
+	for {
+		chunk, err := chunker.Next()
+		if err == io.EOF {
+			break
+		} else if err != nil {
+			return chunkCount, "", fmt.Errorf("Failed to read the data to upload for %s: %v", remoteFilepath, err)
+		}
+		fileHasher.Write(chunk)
+		if chunkCount >= skip {
+			err := s.uploadChunk(fileID, versionID, chunkCount, chunk)
+			if err != nil {
+				return chunkCount, "", fmt.Errorf("Failed to upload chunk #%d for %s: %v", chunkCount, remoteFilepath, err)
+			}
+		}
+		chunkCount++
+		s.Printf("%s >>> %d\n", remoteFilepath, chunkCount)
+	}
+
+	return chunkCount, base64.URLEncoding.EncodeToString(fileHasher.Sum(nil)), nil
+}
+
+// finalizeStreamVersion sets the chunk count and hash of a version that was
+// tagged with zero chunks once all of its chunks have been uploaded.
+func (s *State) finalizeStreamVersion(fileID int, versionID int, remoteFilepath string, chunkCount int, fileHash string) error {
+	var putReq models.FileVersionUpdateRequest
+	putReq.ChunkCount = chunkCount
+	putReq.FileHash = fileHash
+	target := fmt.Sprintf("%s/api/file/%d/version/%d", s.HostURI, fileID, versionID)
+	body, err := s.RunAuthRequest(target, "PUT", s.AuthToken, putReq)
+	if err != nil {
+		return fmt.Errorf("Failed to finalize the version for %s: %v", remoteFilepath, err)
+	}
+
+	var putResp models.FileVersionUpdateResponse
+	err = json.Unmarshal(body, &putResp)
+	if err != nil || putResp.Status == false {
+		return fmt.Errorf("Failed to finalize the version for %s: %v", remoteFilepath, err)
+	}
+	return nil
+}
+
+// tagStreamVersion registers remoteFilepath if needed, or otherwise tags a new
+// version of it, with no chunks and returns the updated file information.
+func (s *State) tagStreamVersion(remoteFilepath string) (fi filefreezer.FileInfo, e error) {
+	lastMod := time.Now().UTC().Unix()
+	perms := uint32(0600)
+
+	remote, err := s.GetFileInfoByFilename(remoteFilepath)
+	if err == nil {
+		if remote.IsDir {
+			return fi, fmt.Errorf("%s is a directory on the server", remoteFilepath)
+		}
+
+		var postReq models.NewFileVersionRequest
+		postReq.LastMod = lastMod
+		postReq.Permissions = perms
+		postReq.Device, err = s.encryptedDevice()
+		if err != nil {
+			return fi, err
+		}
+		target := fmt.Sprintf("%s/api/file/%d/version", s.HostURI, remote.FileID)
+		body, err := s.RunIdempotentRequest(target, "POST", s.AuthToken, postReq)
+		if err != nil {
+			return fi, fmt.Errorf("Failed to tag a new version for the file %d: %v", remote.FileID, err)
+		}
+
+		var postResp models.NewFileVersionResponse
+		err = json.Unmarshal(body, &postResp)
+		if err != nil {
+			return fi, fmt.Errorf("Failed to read the response for tagging a new version for the file %d: %v", remote.FileID, err)
+		}
+		return postResp.FileInfo, nil
+	}
+	if !errors.Is(err, ErrFileNotFound) {
+		return fi, err
+	}
+
+	cryptoRemoteName, err := s.EncryptString(remoteFilepath)
+	if err != nil {
+		return fi, fmt.Errorf("Could not encrypt the remote file name before uploading: %v", err)
+	}
+
+	var putReq models.FilePutRequest
+	putReq.FileName = cryptoRemoteName
+	putReq.Permissions = perms
+	putReq.LastMod = lastMod
+	putReq.Device, err = s.encryptedDevice()
+	if err != nil {
+		return fi, err
+	}
+	target := fmt.Sprintf("%s/api/files", s.HostURI)
+	body, err := s.RunIdempotentRequest(target, "POST", s.AuthToken, putReq)
+	if err != nil {
+		return fi, err
+	}
+
+	var putResp models.FilePutResponse
+	err = json.Unmarshal(body, &putResp)
+	if err != nil {
+		return fi, err
+	}
+	return putResp.FileInfo, nil
+}
+
+// uploadChunk hashes, encrypts and uploads a single chunk of a file version.
+func (s *State) uploadChunk(fileID int, versionID int, chunkNumber int, chunk []byte) error {
+	hasher := sha1.New()
+	hasher.Write(chunk)
+	chunkHash := base64.URLEncoding.EncodeToString(hasher.Sum(nil))
+
+	cryptoBytes, err := s.encryptBytes(chunk)
+	if err != nil {
+		return fmt.Errorf("Failed to encrypt chunk before sending to the server: %v", err)
+	}
+
+	target := fmt.Sprintf("%s/api/chunk/%d/%d/%d/%s", s.HostURI, fileID, versionID, chunkNumber, chunkHash)
+	body, err := s.RunAuthRequest(target, "PUT", s.AuthToken, cryptoBytes)
+	if err != nil {
+		return err
+	}
+
+	var resp models.FileChunkPutResponse
+	err = json.Unmarshal(body, &resp)
+	if err != nil || resp.Status == false {
+		return fmt.Errorf("Failed to upload the chunk to the server: %v", err)
+	}
+
+	return nil
+}
+
+// DownloadStream writes the current version of remoteFilepath to w, downloading
+// and decrypting one chunk at a time so nothing is written to local disk.
+func (s *State) DownloadStream(w io.Writer, remoteFilepath string) (downloadCount int, e error) {
+	fi, err := s.GetFileInfoByFilename(remoteFilepath)
+	if err != nil {
+		return 0, err
+	}
+	if fi.IsDir {
+		return 0, fmt.Errorf("%s is a directory on the server", remoteFilepath)
+	}
+
+	return s.downloadVersion(w, fi.FileID, fi.CurrentVersion.VersionID, remoteFilepath, fi.CurrentVersion.ChunkCount)
+}
+
+// DumpDatabase runs a database dump tool, such as pg_dump or mysqldump, and
+// streams its output to the server as a new version of remoteFilepath.
+// The tool's stderr is passed through to this process.
+func (s *State) DumpDatabase(tool string, args []string, remoteFilepath string) error {
+	cmd := exec.Command(tool, args...)
+	cmd.Stderr = os.Stderr
+	stdout, err := cmd.StdoutPipe()
+	if err != nil {
+		return err
+	}
+
+	err = cmd.Start()
+	if err != nil {
+		return fmt.Errorf("Failed to start %s: %v", tool, err)
+	}
+
+	_, uploadErr := s.UploadStream(stdout, remoteFilepath)
+	if uploadErr != nil {
+		// stop the dump since nothing is reading its output anymore
+		cmd.Process.Kill()
+		cmd.Wait()
+		return uploadErr
+	}
+
+	// a dump that fails part way through leaves an incomplete version on the
+	// server, which is reported so that it isn't mistaken for a good backup
+	err = cmd.Wait()
+	if err != nil {
+		return fmt.Errorf("%s failed and the uploaded version of %s is likely incomplete: %v", tool, remoteFilepath, err)
+	}
+
+	return nil
+}
+
+// RestoreDatabase streams the current version of remoteFilepath from the server
+// into the stdin of a database restore tool, such as psql or mysql.
+func (s *State) RestoreDatabase(tool string, args []string, remoteFilepath string) error {
+	cmd := exec.Command(tool, args...)
+	cmd.Stdout = os.Stdout
+	cmd.Stderr = os.Stderr
+	stdin, err := cmd.StdinPipe()
+	if err != nil {
+		return err
+	}
+
+	err = cmd.Start()
+	if err != nil {
+		return fmt.Errorf("Failed to start %s: %v", tool, err)
+	}
+
+	_, downloadErr := s.DownloadStream(stdin, remoteFilepath)
+	stdin.Close()
+	err = cmd.Wait()
+	if downloadErr != nil {
+		return downloadErr
+	}
+	if err != nil {
+		return fmt.Errorf("%s failed: %v", tool, err)
+	}
+
+	return nil
+}
@@ -0,0 +1,147 @@
+// Copyright 2017, Timothy Bogdala <tdb@animal-machine.com>
+// See the LICENSE file for more details.
+
+package command
+
+import (
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"time"
+
+	"github.com/marcoziti/gringotts"
+	"github.com/marcoziti/gringotts/cmd/freezer/models"
+)
+
+// GrantSupport lets admins make support tokens for the authenticated user's
+// account for the duration given. Support tokens only read the account's
+// metadata, such as the encrypted file names, versions and chunk hashes, and
+// never the file data. The time the consent expires is returned.
+func (s *State) GrantSupport(duration time.Duration) (time.Time, error) {
+	if err := s.requireFeature(models.FeatureSupport); err != nil {
+		return time.Time{}, err
+	}
+
+	var putReq models.SupportConsentRequest
+	putReq.Seconds = int64(duration / time.Second)
+	target := fmt.Sprintf("%s/api/user/support", s.HostURI)
+	body, err := s.RunAuthRequest(target, "PUT", s.AuthToken, putReq)
+	if err != nil {
+		return time.Time{}, fmt.Errorf("Failed to consent to support access: %v", err)
+	}
+
+	var putResp models.SupportConsentResponse
+	err = json.Unmarshal(body, &putResp)
+	if err != nil {
+		return time.Time{}, fmt.Errorf("Failed to read the response for consenting to support access: %v", err)
+	}
+
+	return time.Unix(putResp.Expires, 0), nil
+}
+
+// RevokeSupport withdraws the authenticated user's consent to support access,
+// which also stops the support tokens made with it from working. Break-glass
+// tokens keep working until they expire.
+func (s *State) RevokeSupport() error {
+	if err := s.requireFeature(models.FeatureSupport); err != nil {
+		return err
+	}
+
+	target := fmt.Sprintf("%s/api/user/support", s.HostURI)
+	body, err := s.RunAuthRequest(target, "DELETE", s.AuthToken, nil)
+	if err != nil {
+		return fmt.Errorf("Failed to withdraw the consent to support access: %v", err)
+	}
+
+	var resp models.SupportDeleteResponse
+	err = json.Unmarshal(body, &resp)
+	if err != nil || resp.Success == false {
+		return fmt.Errorf("Failed to withdraw the consent to support access: %v", err)
+	}
+
+	s.Println("Support access consent withdrawn")
+	return nil
+}
+
+// GetSupport returns the authenticated user's consent to support access along
+// with the audit of the support tokens made for the account and their use.
+func (s *State) GetSupport() (*models.SupportGetResponse, error) {
+	if err := s.requireFeature(models.FeatureSupport); err != nil {
+		return nil, err
+	}
+
+	target := fmt.Sprintf("%s/api/user/support", s.HostURI)
+	body, err := s.RunAuthRequest(target, "GET", s.AuthToken, nil)
+	if err != nil {
+		return nil, fmt.Errorf("Failed to get the support access audit: %v", err)
+	}
+
+	var resp models.SupportGetResponse
+	err = json.Unmarshal(body, &resp)
+	if err != nil {
+		return nil, fmt.Errorf("Failed to read the support access audit: %v", err)
+	}
+
+	return &resp, nil
+}
+
+// CreateSupportToken makes a support token in the storage for an admin to read
+// the user's metadata with. Unless breakGlass is set the user has to have
+// consented to support access, and the token won't outlast the consent. A
+// break-glass token needs a reason, which the user sees in their audit along
+// with everything done with the token.
+func (s *State) CreateSupportToken(store filefreezer.Backend, username string, reason string, breakGlass bool, duration time.Duration) (*filefreezer.SupportToken, error) {
+	if duration <= 0 {
+		return nil, fmt.Errorf("the support token needs a positive duration")
+	}
+	if breakGlass && reason == "" {
+		return nil, fmt.Errorf("a reason is required to make a break-glass support token")
+	}
+
+	user, err := store.GetUser(username)
+	if err != nil {
+		return nil, fmt.Errorf("Failed to get an existing user with the name %s: %v", username, err)
+	}
+
+	now := time.Now().UTC()
+	expires := now.Add(duration).Unix()
+	if !breakGlass {
+		consent, err := store.GetSupportConsent(user.ID)
+		if err != nil {
+			return nil, err
+		}
+		if consent <= now.Unix() {
+			return nil, fmt.Errorf("the user %s has not consented to support access", username)
+		}
+		if consent < expires {
+			expires = consent
+		}
+	}
+
+	var randoms [24]byte
+	_, err = rand.Read(randoms[:])
+	if err != nil {
+		return nil, fmt.Errorf("Failed to generate the support token: %v", err)
+	}
+	token := base64.RawURLEncoding.EncodeToString(randoms[:])
+
+	st, err := store.AddSupportToken(user.ID, token, reason, breakGlass, expires)
+	if err != nil {
+		return nil, fmt.Errorf("Failed to add the support token: %v", err)
+	}
+
+	action := fmt.Sprintf("support token created until %s", time.Unix(expires, 0).UTC().Format(time.RFC3339))
+	if breakGlass {
+		action = "break-glass " + action
+	}
+	if reason != "" {
+		action += ": " + reason
+	}
+	err = store.AddSupportAudit(user.ID, st.SupportID, action)
+	if err != nil {
+		return nil, err
+	}
+
+	return st, nil
+}
@@ -7,7 +7,9 @@ import (
 	"crypto/sha1"
 	"encoding/base64"
 	"encoding/json"
+	"errors"
 	"fmt"
+	"io"
 	"io/ioutil"
 	"os"
 	"strings"
@@ -24,6 +26,9 @@ const (
 	SyncStatusRemoteNewer         = 3 // remote file newer
 	SyncStatusSame                = 4 // local and remote files are the same
 	SyncStatusUnsupportedFileType = 5 // returned when sync encouters device files or socket files, etc...
+	SyncStatusDeferred            = 6 // local file newer but the upload waits for an unmetered connection
+	SyncStatusConflict            = 7 // both files changed; the local one was kept as a conflicted copy
+	SyncStatusMerged              = 8 // both files changed and were merged into a new version
 )
 
 const (
@@ -34,8 +39,10 @@ const (
 
 // SyncDirectory will take a localDir and recursively walk the filesystem calling SyncFile
 // for each file encountered. remoteDir can be specified to prefix the remote filepath
-// for each file. The total number of changed chunks is returned and upon error a non-nil
-// error value is returned.
+// for each file. The local files are synced first and then the remote files missing
+// locally, each in the order picked by SyncPriority. Files matched by the patterns in
+// the IgnoreFileName files are skipped both ways. The total number of changed chunks
+// is returned and upon error a non-nil error value is returned.
 func (s *State) SyncDirectory(localDir string, remoteDir string) (changeCount int, e error) {
 	changeCount = 0
 
@@ -49,56 +56,92 @@ func (s *State) SyncDirectory(localDir string, remoteDir string) (changeCount in
 	if err != nil {
 		return 0, fmt.Errorf("Failed to a list of remote file hashes: %v", err)
 	}
-	var processDir func(localDir string, remoteDir string) (changeCount int, e error)
-	processDir = func(localDir string, remoteDir string) (changeCount int, e error) {
+
+	// the directory being synced, since processDir shadows localDir, and the
+	// patterns of its ignore files, which are loaded as their directories are
+	syncRoot := localDir
+	ignore := new(IgnoreMatcher)
+
+	var localItems []syncItem
+	var processDir func(localDir string, remoteDir string) error
+	processDir = func(localDir string, remoteDir string) error {
 		// silently return if the directory does not exist
 		if _, err := os.Stat(localDir); os.IsNotExist(err) {
-			return 0, nil
+			return nil
+		}
+		err := ignore.loadIgnoreFile(syncRoot, syncRelative(syncRoot, localDir))
+		if err != nil {
+			return err
 		}
 
 		// get all of the local files
 		localFileInfos, err := ioutil.ReadDir(localDir)
 		if err != nil {
-			return 0, fmt.Errorf("Failed to get a list of local file names: %v", err)
+			return fmt.Errorf("Failed to get a list of local file names: %v", err)
 		}
 
-		// sync all of the local files
 		var localFileInfo os.FileInfo
 		for _, localFileInfo = range localFileInfos {
 			localFileName := localDir + "/" + localFileInfo.Name()
 			remoteFileName := remoteDir + "/" + localFileInfo.Name()
 
+			// caches, the trash, build artifacts and the like aren't worth the space
+			if s.excluded(syncRoot, localFileName, remoteFileName) ||
+				ignore.Match(syncRelative(syncRoot, localFileName), localFileInfo.IsDir()) {
+				continue
+			}
+
 			// process directories by recursively looking into them for local files
 			// and other directories; after that, add the directory itself
 			if localFileInfo.IsDir() {
-				changes, err := processDir(localFileName, remoteFileName)
+				err = processDir(localFileName, remoteFileName)
 				if err != nil {
-					return changes, err
+					return err
 				}
-				changeCount += changes
 			}
 
-			// attempt the local file sync operation
-			_, changes, err := s.SyncFile(localFileName, remoteFileName, SyncCurrentVersion)
-			if err != nil {
-				return changeCount, fmt.Errorf("Failed to sync local file (%s) with the remote file (%s): %v", localFileName, remoteFileName, err)
-			}
-
-			// on success, keep processing and update the change count
-			changeCount += changes
-			alreadyProccessed[localFileName] = true
+			localItems = append(localItems, syncItem{
+				localName:  localFileName,
+				remoteName: remoteFileName,
+				isDir:      localFileInfo.IsDir(),
+				size:       localFileInfo.Size(),
+				lastMod:    localFileInfo.ModTime().Unix(),
+			})
 		}
 
-		return changeCount, nil
+		return nil
 	}
 
 	// start recursively processing at the local directory specified
-	changeCount, e = processDir(localDir, remoteDir)
+	e = processDir(localDir, remoteDir)
 	if e != nil {
-		return changeCount, e
+		return 0, e
 	}
 
-	// sync all of the remote files
+	// local files are read from a snapshot, if one is wanted, while they're synced
+	endSnapshot, err := s.beginSnapshot(localDir)
+	if err != nil {
+		return 0, err
+	}
+	defer endSnapshot()
+
+	// sync all of the local files
+	s.prioritize(localItems)
+	for _, item := range localItems {
+		// attempt the local file sync operation
+		_, changes, err := s.SyncFile(item.localName, item.remoteName, SyncCurrentVersion)
+		if err != nil {
+			return changeCount, fmt.Errorf("Failed to sync local file (%s) with the remote file (%s): %v", item.localName, item.remoteName, err)
+		}
+
+		// on success, keep processing and update the change count
+		changeCount += changes
+		alreadyProccessed[item.localName] = true
+	}
+
+	// find the remote files that weren't synced with a local file
+	_, avgChunkSize := s.chunkSizes()
+	var remoteItems []syncItem
 	for _, remoteFileHash := range remoteFileHashes {
 		remoteFileName, err := s.DecryptString(remoteFileHash.FileName)
 		if err != nil {
@@ -113,17 +156,30 @@ func (s *State) SyncDirectory(localDir string, remoteDir string) (changeCount in
 		// build the local file path
 		localFileName := localDir + remoteFileName[len(remoteDir):]
 
-		// have we already processed it?
+		// have we already processed it or is it excluded?
 		_, processed := alreadyProccessed[localFileName]
-		if processed {
+		if processed || s.excluded(localDir, localFileName, remoteFileName) ||
+			ignore.Match(syncRelative(localDir, localFileName), remoteFileHash.IsDir) {
 			continue
 		}
 
-		dirIndex := strings.LastIndex(localFileName, "/")
+		remoteItems = append(remoteItems, syncItem{
+			localName:  localFileName,
+			remoteName: remoteFileName,
+			isDir:      remoteFileHash.IsDir,
+			size:       int64(remoteFileHash.CurrentVersion.ChunkCount) * avgChunkSize,
+			lastMod:    remoteFileHash.CurrentVersion.LastMod,
+		})
+	}
+
+	// sync all of the remote files
+	s.prioritize(remoteItems)
+	for _, item := range remoteItems {
+		dirIndex := strings.LastIndex(item.localName, "/")
 		if dirIndex > 0 {
 			// ensure the directory exists already
 			// FIXME: DIRECTORY PERMISSIONS ARE NOT SAVED
-			dirToCreate := localFileName[:dirIndex]
+			dirToCreate := item.localName[:dirIndex]
 			err = os.MkdirAll(dirToCreate, 0777)
 			if err != nil {
 				return changeCount, fmt.Errorf("Failed to create the local directory for %s: %v", localDir, err)
@@ -131,9 +187,9 @@ func (s *State) SyncDirectory(localDir string, remoteDir string) (changeCount in
 		}
 
 		// attempt the remote file sync
-		_, changes, err := s.SyncFile(localFileName, remoteFileName, SyncCurrentVersion)
+		_, changes, err := s.SyncFile(item.localName, item.remoteName, SyncCurrentVersion)
 		if err != nil {
-			return changeCount, fmt.Errorf("Failed to sync remote file (%s) with the local file (%s): %v", remoteFileName, localFileName, err)
+			return changeCount, fmt.Errorf("Failed to sync remote file (%s) with the local file (%s): %v", item.remoteName, item.localName, err)
 		}
 
 		// on success, keep processing and update the change count
@@ -149,9 +205,48 @@ func (s *State) SyncDirectory(localDir string, remoteDir string) (changeCount in
 // the local or remote version were considered newer. The number of chunks changes is also returned and
 // a non-nil error value is returned on error.
 func (s *State) SyncFile(localFilename string, remoteFilepath string, versionNum int) (status int, changeCount int, e error) {
+	// files with a transform are synced through it unless they're directories
+	t := s.transformFor(remoteFilepath)
+	if info, err := os.Stat(localFilename); t != nil && err == nil && info.IsDir() {
+		t = nil
+	}
+	if t != nil {
+		status, changeCount, e = s.syncTransformed(t, localFilename, remoteFilepath, versionNum)
+	} else {
+		status, changeCount, e = s.syncFile(localFilename, remoteFilepath, versionNum)
+	}
+
+	// a new version may leave older ones for the file's policy to prune
+	if e == nil && status == SyncStatusLocalNewer {
+		s.applyKeep(remoteFilepath)
+	}
+	return status, changeCount, e
+}
+
+// syncFile does the work of SyncFile once any transform has been applied.
+func (s *State) syncFile(localFilename string, remoteFilepath string, versionNum int) (status int, changeCount int, e error) {
+	// the hash both copies of the file have once it's synced and the version
+	// if it's known, which are recorded so that later changes on both sides
+	// can be found. files staged for a transform aren't recorded since they're
+	// in a temporary directory.
+	var syncedHash string
+	var syncedVersion *filefreezer.FileVersionInfo
+	defer func() {
+		if e == nil && syncedHash != "" && s.transformFor(remoteFilepath) == nil {
+			e = s.recordSynced(localFilename, remoteFilepath, syncedHash, syncedVersion)
+		}
+	}()
+
+	// the local file is read from the snapshot, if there is one, but written
+	// to localFilename
+	sourceFilename := s.snapshotPath(localFilename)
+
 	// make sure that we're not attempting to sync a symlink, device, named pipe or socket
-	localFileStat, localFileStatErr := os.Stat(localFilename)
+	var localSize int64
+	localFileStat, localFileStatErr := os.Stat(sourceFilename)
 	if localFileStatErr == nil {
+		localSize = localFileStat.Size()
+
 		// only check local files that exist
 		localMode := localFileStat.Mode()
 		if (localMode&os.ModeCharDevice) != 0 ||
@@ -166,19 +261,28 @@ func (s *State) SyncFile(localFilename string, remoteFilepath string, versionNum
 	// get the file information for the filename, which provides
 	// all of the information necessary to determine what to sync.
 	remote, err := s.GetFileInfoByFilename(remoteFilepath)
+	if err != nil && !errors.Is(err, ErrFileNotFound) {
+		return 0, 0, fmt.Errorf("Failed to get the file information for %s: %w", remoteFilepath, err)
+	}
 
 	// if the file is not registered with the storage server, then upload it ...
 	// futher checking will be unnecessary.
 	if err != nil {
-		localStats, err := filefreezer.CalcFileHashInfo(s.ServerCapabilities.ChunkSize, localFilename)
+		localStats, err := s.calcFileHashInfo(sourceFilename)
 		if err != nil {
 			return SyncStatusMissing, 0, fmt.Errorf("Failed to calculate the file hash data for file %s to upload as %s: %v", localFilename, remoteFilepath, err)
 		}
-		ulCount, err := s.syncUploadNew(localFilename, remoteFilepath, localStats.IsDir,
+		if !localStats.IsDir && s.deferUpload(remoteFilepath, localSize) {
+			return SyncStatusDeferred, 0, nil
+		}
+		ulCount, err := s.syncUploadNew(sourceFilename, remoteFilepath, localStats.IsDir,
 			localStats.Permissions, localStats.LastMod, localStats.ChunkCount, localStats.HashString)
 		if err != nil {
 			return SyncStatusMissing, ulCount, fmt.Errorf("Failed to upload the file to the server %s: %v", s.HostURI, err)
 		}
+		if !localStats.IsDir {
+			syncedHash = localStats.HashString
+		}
 		return SyncStatusLocalNewer, ulCount, nil
 	}
 
@@ -212,6 +316,7 @@ func (s *State) SyncFile(localFilename string, remoteFilepath string, versionNum
 		if !remote.IsDir {
 			dlCount, err := s.syncDownload(remote.FileID, syncVersion.VersionID, localFilename,
 				remoteFilepath, syncVersion.ChunkCount)
+			syncedHash, syncedVersion = syncVersion.FileHash, syncVersion
 			return SyncStatusRemoteNewer, dlCount, err
 		}
 
@@ -228,8 +333,22 @@ func (s *State) SyncFile(localFilename string, remoteFilepath string, versionNum
 	// At this point the it is registered on the server and the local file exists,
 	// so it is time to calculate hash information and do comparisons ...
 
+	// a file that wasn't changed on either side since it was last synced
+	// doesn't need to be hashed
+	last, tracked, err := s.lastSynced(localFilename, remoteFilepath)
+	if err != nil {
+		return 0, 0, err
+	}
+	tracked = tracked && versionNum == SyncCurrentVersion && s.transformFor(remoteFilepath) == nil
+	if tracked && !localFileStat.IsDir() &&
+		last.VersionID == remote.CurrentVersion.VersionID &&
+		last.LastMod == localFileStat.ModTime().Unix() && last.Size == localSize {
+		s.Printf("%s --- unchanged\n", remoteFilepath)
+		return SyncStatusSame, 0, nil
+	}
+
 	// calculate some of the local file information
-	localStats, err := filefreezer.CalcFileHashInfo(s.ServerCapabilities.ChunkSize, localFilename)
+	localStats, err := s.calcFileHashInfo(sourceFilename)
 	if err != nil {
 		return 0, 0, fmt.Errorf("Failed to calculate the local file hash data for %s: %v", localFilename, err)
 	}
@@ -281,7 +400,7 @@ func (s *State) SyncFile(localFilename string, remoteFilepath string, versionNum
 			remoteChunkCount := len(remoteChunks.Chunks)
 			if localStats.ChunkCount == remoteChunkCount {
 				// check the local chunks against remote hashes
-				err = forEachChunk(int(s.ServerCapabilities.ChunkSize), localFilename, localStats.ChunkCount, func(i int, b []byte) (bool, error) {
+				err = forEachChunk(s.chunking(), int(s.ServerCapabilities.ChunkSize), sourceFilename, localStats.ChunkCount, func(i int, b []byte) (bool, error) {
 					// hash the chunk
 					hasher := sha1.New()
 					hasher.Write(b)
@@ -306,28 +425,71 @@ func (s *State) SyncFile(localFilename string, remoteFilepath string, versionNum
 		// after whole-file hashs and all chunk hashs match, we can feel safe in saying they're not different
 		if !different {
 			s.Printf("%s --- unchanged\n", remoteFilepath)
+			syncedHash, syncedVersion = localStats.HashString, &remote.CurrentVersion
 			return SyncStatusSame, 0, nil
 		}
 	}
 
+	// a file changed both locally and on the server since it was last synced
+	// is a conflict; neither copy can be trusted over the other so the changes
+	// are merged if they can be and both copies are kept if not. files synced
+	// through a transform are staged in a temporary directory so they're left
+	// to the usual rules.
+	if tracked && last.Hash != localStats.HashString && last.Hash != remote.CurrentVersion.FileHash &&
+		localStats.HashString != remote.CurrentVersion.FileHash {
+		mergedHash, changes, e := s.syncMerge(remote, localFilename, remoteFilepath, last)
+		if mergedHash != "" || e != nil {
+			syncedHash = mergedHash
+			return SyncStatusMerged, changes, e
+		}
+		mergeChanges := changes
+		changes, e = s.syncConflict(remote, localFilename, remoteFilepath)
+		changes += mergeChanges
+		syncedHash, syncedVersion = remote.CurrentVersion.FileHash, &remote.CurrentVersion
+		return SyncStatusConflict, changes, e
+	}
+
+	// a file that only changed on the server since it was last synced is
+	// downloaded even if the local copy's modification time is newer, such as
+	// after another device merged changes into it
+	if tracked && last.Hash == localStats.HashString && last.Hash != remote.CurrentVersion.FileHash {
+		dlCount, e := s.syncDownload(remote.FileID, remote.CurrentVersion.VersionID, localFilename,
+			remoteFilepath, remote.CurrentVersion.ChunkCount)
+		syncedHash, syncedVersion = remote.CurrentVersion.FileHash, &remote.CurrentVersion
+		return SyncStatusRemoteNewer, dlCount, e
+	}
+
 	// at this point we have a file difference. we'll use the local file as the source of truth
 	// if it's lastMod is newer than the remote file.
 	if localStats.LastMod > remote.CurrentVersion.LastMod {
-		ulCount, e := s.syncUploadNewer(remote.FileID, localFilename, remoteFilepath, localStats.IsDir,
-			localStats.Permissions, localStats.LastMod, localStats.ChunkCount, localStats.HashString)
+		if s.deferUpload(remoteFilepath, localSize) {
+			return SyncStatusDeferred, 0, nil
+		}
+		var ulCount int
+		if p := s.policyFor(remoteFilepath); p != nil && p.Append && !localStats.IsDir {
+			ulCount, e = s.syncAppend(remote, sourceFilename, remoteFilepath, localStats)
+		} else {
+			ulCount, e = s.syncUploadNewer(remote.FileID, sourceFilename, remoteFilepath, localStats.IsDir,
+				localStats.Permissions, localStats.LastMod, localStats.ChunkCount, localStats.HashString)
+		}
+		syncedHash = localStats.HashString
 		return SyncStatusLocalNewer, ulCount, e
 	}
 
 	if localStats.LastMod < remote.CurrentVersion.LastMod {
 		dlCount, e := s.syncDownload(remote.FileID, remote.CurrentVersion.VersionID, localFilename,
 			remoteFilepath, remote.CurrentVersion.ChunkCount)
+		syncedHash, syncedVersion = remote.CurrentVersion.FileHash, &remote.CurrentVersion
 		return SyncStatusRemoteNewer, dlCount, e
 	}
 
 	// there's been a difference detected in the files, but the mod times were the same, so
 	// we attempt to upload any missing chunks.
 	if len(remoteMissingChunks) > 0 {
-		ulCount, e := s.syncUploadMissing(remote.FileID, remote.CurrentVersion.VersionID, localFilename, remoteFilepath, localStats.ChunkCount)
+		if s.deferUpload(remoteFilepath, localSize) {
+			return SyncStatusDeferred, 0, nil
+		}
+		ulCount, e := s.syncUploadMissing(remote.FileID, remote.CurrentVersion.VersionID, sourceFilename, remoteFilepath, localStats.ChunkCount)
 		return SyncStatusMissing, ulCount, e
 	}
 
@@ -335,13 +497,18 @@ func (s *State) SyncFile(localFilename string, remoteFilepath string, versionNum
 	// but differing hashes. for this case we'll upload the local file as a newer version.
 	if localStats.HashString != remote.CurrentVersion.FileHash &&
 		localStats.LastMod == remote.CurrentVersion.LastMod {
-		ulCount, e := s.syncUploadNewer(remote.FileID, localFilename, remoteFilepath, localStats.IsDir,
+		if s.deferUpload(remoteFilepath, localSize) {
+			return SyncStatusDeferred, 0, nil
+		}
+		ulCount, e := s.syncUploadNewer(remote.FileID, sourceFilename, remoteFilepath, localStats.IsDir,
 			localStats.Permissions, localStats.LastMod, localStats.ChunkCount, localStats.HashString)
+		syncedHash = localStats.HashString
 		return SyncStatusLocalNewer, ulCount, e
 	}
 
 	// we checked to make sure it was the same above, but we found it different -- however, no steps to
 	// resolve this were taken, so through an error.
+	s.Stats.addConflict()
 	return 0, 0, fmt.Errorf("found differences between local (%s) and remote (%s) versions, "+
 		"but this was not reconcilled; lastmod equality (%v); hash equality (%v)",
 		localFilename, remoteFilepath,
@@ -350,52 +517,46 @@ func (s *State) SyncFile(localFilename string, remoteFilepath string, versionNum
 }
 
 func (s *State) syncUploadMissing(remoteID int, remoteVersionID int, filename string, remoteFilepath string, localChunkCount int) (uploadCount int, e error) {
-	// upload each chunk
-	err := forEachChunk(int(s.ServerCapabilities.ChunkSize), filename, localChunkCount, func(i int, b []byte) (bool, error) {
-		// hash the chunk with unencrypted data
-		hasher := sha1.New()
-		hasher.Write(b)
-		hash := hasher.Sum(nil)
-		chunkHash := base64.URLEncoding.EncodeToString(hash)
-
-		cryptoBytes, err := s.encryptBytes(b)
-		if err != nil {
-			return false, fmt.Errorf("Failed to encrypt chunk before sending to the server: %v", err)
-		}
-
-		target := fmt.Sprintf("%s/api/chunk/%d/%d/%d/%s", s.HostURI, remoteID, remoteVersionID, i, chunkHash)
-		body, err := s.RunAuthRequest(target, "PUT", s.AuthToken, cryptoBytes)
-		if err != nil {
-			return false, err
-		}
-
-		var resp models.FileChunkPutResponse
-		err = json.Unmarshal(body, &resp)
-		if err != nil || resp.Status == false {
-			return false, fmt.Errorf("Failed to upload the chunk to the server: %v", err)
-		}
-
-		s.Printf("%s +++ %d / %d\n", remoteFilepath, i+1, localChunkCount)
-		uploadCount++
+	return s.uploadChunks(remoteID, remoteVersionID, filename, remoteFilepath, localChunkCount, "+++", nil)
+}
 
-		return true, nil
-	})
+// uploadSize returns the number of bytes the encrypted chunks of the local
+// file take, which the server reserves from the quota while they're uploaded.
+// Zero, which reserves nothing, is returned for directories and files that
+// can't be read.
+func uploadSize(filename string, isDir bool, chunkCount int) int64 {
+	if isDir {
+		return 0
+	}
+	info, err := os.Stat(filename)
 	if err != nil {
-		return uploadCount, fmt.Errorf("Failed to upload the local file chunk for %s: %v", filename, err)
+		return 0
 	}
-
-	return uploadCount, nil
+	return info.Size() + int64(chunkCount)*cryptoOverhead
 }
 
 func (s *State) syncUploadNewer(remoteFileID int, filename string, remoteFilepath string, isDir bool, localPermissions uint32, localLastMod int64, localChunkCount int, localHash string) (uploadCount int, e error) {
+	// don't add a version that would conflict with another device's edits
+	err := s.checkFileLock(remoteFileID, remoteFilepath)
+	if err != nil {
+		return 0, err
+	}
+
+	device, err := s.encryptedDevice()
+	if err != nil {
+		return 0, err
+	}
+
 	// tag a new version for the file
 	var postReq models.NewFileVersionRequest
 	postReq.LastMod = localLastMod
 	postReq.Permissions = localPermissions
 	postReq.ChunkCount = localChunkCount
 	postReq.FileHash = localHash
+	postReq.Device = device
+	postReq.Size = uploadSize(filename, isDir, localChunkCount)
 	target := fmt.Sprintf("%s/api/file/%d/version", s.HostURI, remoteFileID)
-	body, err := s.RunAuthRequest(target, "POST", s.AuthToken, postReq)
+	body, err := s.RunIdempotentRequest(target, "POST", s.AuthToken, postReq)
 	if err != nil {
 		return 0, fmt.Errorf("Failed to tag a new version for the file %d: %v", remoteFileID, err)
 	}
@@ -413,43 +574,7 @@ func (s *State) syncUploadNewer(remoteFileID int, filename string, remoteFilepat
 	}
 
 	fi := &postResp.FileInfo
-
-	// upload each chunk
-	err = forEachChunk(int(s.ServerCapabilities.ChunkSize), filename, localChunkCount, func(i int, b []byte) (bool, error) {
-		// hash the chunk
-		hasher := sha1.New()
-		hasher.Write(b)
-		hash := hasher.Sum(nil)
-		chunkHash := base64.URLEncoding.EncodeToString(hash)
-
-		cryptoBytes, err := s.encryptBytes(b)
-		if err != nil {
-			return false, fmt.Errorf("Failed to encrypt chunk before sending to the server: %v", err)
-		}
-
-		target = fmt.Sprintf("%s/api/chunk/%d/%d/%d/%s", s.HostURI, fi.FileID, fi.CurrentVersion.VersionID, i, chunkHash)
-		body, err = s.RunAuthRequest(target, "PUT", s.AuthToken, cryptoBytes)
-		if err != nil {
-			return false, err
-		}
-
-		var resp models.FileChunkPutResponse
-		err = json.Unmarshal(body, &resp)
-		if err != nil || resp.Status == false {
-			return false, fmt.Errorf("Failed to upload the chunk to the server: %v", err)
-		}
-
-		s.Printf("%s >>> %d / %d\n", remoteFilepath, i+1, localChunkCount)
-		uploadCount++
-
-		return true, nil
-	})
-
-	if err != nil {
-		return uploadCount, fmt.Errorf("Failed to upload the local file chunk for %s: %v", filename, err)
-	}
-
-	return uploadCount, nil
+	return s.uploadChunks(fi.FileID, fi.CurrentVersion.VersionID, filename, remoteFilepath, localChunkCount, ">>>", nil)
 }
 
 func (s *State) syncUploadNew(filename string, remoteFilepath string, isDir bool, localPermissions uint32, localLastMod int64, localChunkCount int, localHash string) (uploadCount int, e error) {
@@ -467,8 +592,13 @@ func (s *State) syncUploadNew(filename string, remoteFilepath string, isDir bool
 	putReq.LastMod = localLastMod
 	putReq.ChunkCount = localChunkCount
 	putReq.FileHash = localHash
+	putReq.Size = uploadSize(filename, isDir, localChunkCount)
+	putReq.Device, err = s.encryptedDevice()
+	if err != nil {
+		return 0, err
+	}
 	target := fmt.Sprintf("%s/api/files", s.HostURI)
-	body, err := s.RunAuthRequest(target, "POST", s.AuthToken, putReq)
+	body, err := s.RunIdempotentRequest(target, "POST", s.AuthToken, putReq)
 	if err != nil {
 		return 0, err
 	}
@@ -496,77 +626,192 @@ func (s *State) syncUploadNew(filename string, remoteFilepath string, isDir bool
 
 	remoteID := putResp.FileID
 	remoteVersionID := getFileInfoResp.CurrentVersion.VersionID
+	uploadCount, err = s.uploadChunks(remoteID, remoteVersionID, filename, remoteFilepath, localChunkCount, ">>>", nil)
+	if err != nil {
+		return uploadCount, err
+	}
 
-	// upload each chunk
-	err = forEachChunk(int(s.ServerCapabilities.ChunkSize), filename, localChunkCount, func(i int, b []byte) (bool, error) {
-		// hash the chunk
+	s.Printf("%s ==> uploaded\n", remoteFilepath)
+	return uploadCount, nil
+}
+
+// uploadChunks encrypts and uploads each chunk of the local file to the file
+// version on the server. Chunks are sent in batches that are sized by how
+// quickly the previous batches completed. The marker is printed with the
+// progress of each chunk. If only isn't nil just the chunk numbers in it are
+// uploaded.
+//
+// With a SpoolDir each encrypted chunk is written to the spool before it's
+// sent. If a batch fails the remaining chunks are only spooled so that the
+// whole version can be pushed by FlushSpool.
+func (s *State) uploadChunks(remoteID int, remoteVersionID int, filename string, remoteFilepath string, localChunkCount int, marker string, only map[int]bool) (uploadCount int, e error) {
+	var batch []func() error
+	var uploadErr error
+	batchSize := s.transferBatchSize()
+	sendBatch := func() (bool, error) {
+		err := s.runTransfers(batch)
+		if err != nil {
+			if s.SpoolDir == "" {
+				return false, err
+			}
+			uploadErr = err
+			return true, nil
+		}
+		uploadCount += len(batch)
+		batch = nil
+		batchSize = s.transferBatchSize()
+		return true, nil
+	}
+	err := forEachChunk(s.chunking(), int(s.ServerCapabilities.ChunkSize), filename, localChunkCount, func(i int, b []byte) (bool, error) {
+		if only != nil && !only[i] {
+			if len(batch) > 0 && i+1 == localChunkCount {
+				return sendBatch()
+			}
+			return true, nil
+		}
+
+		// hash the chunk with unencrypted data
 		hasher := sha1.New()
 		hasher.Write(b)
 		hash := hasher.Sum(nil)
 		chunkHash := base64.URLEncoding.EncodeToString(hash)
 
+		// encrypting makes a copy of the chunk, so the buffer that forEachChunk
+		// reuses is free to be overwritten while the batch is collected
 		cryptoBytes, err := s.encryptBytes(b)
 		if err != nil {
 			return false, fmt.Errorf("Failed to encrypt chunk before sending to the server: %v", err)
 		}
 
-		target = fmt.Sprintf("%s/api/chunk/%d/%d/%d/%s", s.HostURI, remoteID, remoteVersionID, i, chunkHash)
-		body, err = s.RunAuthRequest(target, "PUT", s.AuthToken, cryptoBytes)
-		if err != nil {
-			return false, err
-		}
+		chunkNumber := i
+		var spooled SpooledChunk
+		if s.SpoolDir != "" {
+			spooled, err = s.spoolChunk(SpooledChunk{
+				HostURI:        s.HostURI,
+				FileID:         remoteID,
+				VersionID:      remoteVersionID,
+				ChunkNumber:    chunkNumber,
+				ChunkCount:     localChunkCount,
+				ChunkHash:      chunkHash,
+				RemoteFilepath: remoteFilepath,
+			}, cryptoBytes)
+			if err != nil {
+				return false, err
+			}
 
-		var resp models.FileChunkPutResponse
-		err = json.Unmarshal(body, &resp)
-		if err != nil || resp.Status == false {
-			return false, fmt.Errorf("Failed to upload the chunk to the server: %v", err)
+			// once an upload has failed the rest of the chunks are only spooled
+			if uploadErr != nil {
+				return true, nil
+			}
 		}
 
-		s.Printf("%s >>> %d / %d\n", remoteFilepath, i+1, localChunkCount)
-		uploadCount++
+		target := fmt.Sprintf("%s/api/chunk/%d/%d/%d/%s", s.HostURI, remoteID, remoteVersionID, chunkNumber, chunkHash)
+		batch = append(batch, func() error {
+			body, err := s.RunAuthRequest(target, "PUT", s.AuthToken, cryptoBytes)
+			if err != nil {
+				return err
+			}
 
-		return true, nil
+			var resp models.FileChunkPutResponse
+			err = json.Unmarshal(body, &resp)
+			if err != nil || resp.Status == false {
+				return fmt.Errorf("Failed to upload the chunk to the server: %v", err)
+			}
+			s.Stats.addUpload(len(cryptoBytes))
+			s.unspoolChunk(spooled)
+
+			s.Printf("%s %s %d / %d\n", remoteFilepath, marker, chunkNumber+1, localChunkCount)
+			return nil
+		})
+		if len(batch) < batchSize && i+1 < localChunkCount {
+			return true, nil
+		}
+		return sendBatch()
 	})
+	if err == nil && uploadErr != nil {
+		s.Printf("%s ==> the chunks that didn't upload are kept in the spool until flushed\n", remoteFilepath)
+		err = uploadErr
+	}
 	if err != nil {
 		return uploadCount, fmt.Errorf("Failed to upload the local file chunk for %s: %v", filename, err)
 	}
 
-	s.Printf("%s ==> uploaded\n", remoteFilepath)
 	return uploadCount, nil
 }
 
+// syncDownload downloads the file version into the local filename. If a Scanner
+// is configured the version is downloaded to a temporary file next to filename
+// and only moved into place once the scanner passes it.
 func (s *State) syncDownload(remoteID int, remoteVersionID int, filename string, remoteFilepath string, chunkCount int) (downloadCount int, e error) {
+	if s.Scanner != "" {
+		return s.scanDownload(remoteID, remoteVersionID, filename, remoteFilepath, chunkCount)
+	}
+
 	localFile, err := os.OpenFile(filename, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, os.ModePerm)
 	if err != nil {
 		return 0, fmt.Errorf("Failed to open local file (%s) for writing: %v", filename, err)
 	}
 	defer localFile.Close()
 
-	// download each chunk and write it out to the file
+	return s.downloadVersion(localFile, remoteID, remoteVersionID, remoteFilepath, chunkCount)
+}
+
+// downloadVersion downloads and decrypts each chunk of the file version and
+// writes them in order to w. Chunks are fetched in batches that are sized by
+// how quickly the previous batches completed.
+func (s *State) downloadVersion(w io.Writer, remoteID int, remoteVersionID int, remoteFilepath string, chunkCount int) (downloadCount int, e error) {
 	chunksWritten := 0
-	for i := 0; i < chunkCount; i++ {
-		target := fmt.Sprintf("%s/api/chunk/%d/%d/%d", s.HostURI, remoteID, remoteVersionID, i)
-		body, err := s.RunAuthRequest(target, "GET", s.AuthToken, nil)
-		if err != nil {
-			return chunksWritten, fmt.Errorf("Failed to get the file chunk #%d for file id%d: %v", i, remoteID, err)
+	for chunksWritten < chunkCount {
+		batchSize := s.transferBatchSize()
+		if chunksWritten+batchSize > chunkCount {
+			batchSize = chunkCount - chunksWritten
 		}
 
-		// write out the chunk that was downloaded
-		chunk := body
-		uncryptoBytes, err := s.decryptBytes(chunk)
-		if err != nil {
-			return chunksWritten, fmt.Errorf("Failed to decrypt the the chunk bytes: %v", err)
+		// download the batch of chunks
+		chunks := make([][]byte, batchSize)
+		batch := make([]func() error, batchSize)
+		for j := range batch {
+			j := j
+			batch[j] = func() error {
+				uncryptoBytes, err := s.downloadChunk(remoteID, remoteVersionID, chunksWritten+j)
+				chunks[j] = uncryptoBytes
+				return err
+			}
 		}
-
-		_, err = localFile.Write(uncryptoBytes)
+		err := s.runTransfers(batch)
 		if err != nil {
-			return chunksWritten, fmt.Errorf("Failed to write to the #%d chunk to the local file %s: %v", i, filename, err)
+			return chunksWritten, err
 		}
 
-		s.Printf("%s <<< %d / %d\n", remoteFilepath, i+1, chunkCount)
-		chunksWritten++
+		// write out the chunks that were downloaded
+		for _, uncryptoBytes := range chunks {
+			_, err = w.Write(uncryptoBytes)
+			if err != nil {
+				return chunksWritten, fmt.Errorf("Failed to write to the #%d chunk for %s: %v", chunksWritten, remoteFilepath, err)
+			}
+
+			s.Printf("%s <<< %d / %d\n", remoteFilepath, chunksWritten+1, chunkCount)
+			chunksWritten++
+		}
 	}
 
 	s.Printf("%s <== downloaded\n", remoteFilepath)
 	return chunksWritten, nil
 }
+
+// downloadChunk downloads a single chunk of a file version and returns the decrypted bytes.
+func (s *State) downloadChunk(remoteID int, remoteVersionID int, chunkNumber int) ([]byte, error) {
+	target := fmt.Sprintf("%s/api/chunk/%d/%d/%d", s.HostURI, remoteID, remoteVersionID, chunkNumber)
+	body, err := s.RunAuthRequest(target, "GET", s.AuthToken, nil)
+	if err != nil {
+		return nil, fmt.Errorf("Failed to get the file chunk #%d for file id%d: %w", chunkNumber, remoteID, err)
+	}
+	s.Stats.addDownload(len(body))
+
+	uncryptoBytes, err := s.decryptBytes(body)
+	if err != nil {
+		return nil, fmt.Errorf("Failed to decrypt the the chunk bytes: %v", err)
+	}
+
+	return uncryptoBytes, nil
+}
@@ -0,0 +1,211 @@
+// Copyright 2017, Timothy Bogdala <tdb@animal-machine.com>
+// See the LICENSE file for more details.
+
+package command
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	"github.com/marcoziti/gringotts"
+)
+
+// SyncDirBothWays syncs localDir with the files under remoteDir on the server in
+// both directions. Files on both sides are synced by SyncFile, so a file changed
+// on both sides since the last sync is merged or kept as a conflicted copy. A file
+// on only one side is copied to the other unless it was synced before, in which
+// case it was removed from the other side since and is removed from this one too.
+// A removed file that was changed on the side it's left on is copied back instead,
+// so no change is lost. Directories are created on both sides but never removed.
+// Files matched by the patterns in the IgnoreFileName files are left alone on both
+// sides.
+//
+// The SyncStateFile is what tells new files apart from removed ones, so it's
+// required. The total number of changed chunks is returned.
+func (s *State) SyncDirBothWays(localDir string, remoteDir string) (changeCount int, e error) {
+	if s.SyncStateFile == "" {
+		return 0, fmt.Errorf("A two-way sync needs a sync state file to tell new files from removed ones")
+	}
+	if len(localDir) > 1 {
+		localDir = strings.TrimSuffix(localDir, "/")
+	}
+	if len(remoteDir) > 1 {
+		remoteDir = strings.TrimSuffix(remoteDir, "/")
+	}
+	statePath, _ := filepath.Abs(s.SyncStateFile)
+
+	// the local files, keyed by their path under localDir, without the ones
+	// ignored by the ignore files loaded along the way
+	local := make(map[string]syncItem)
+	ignore := new(IgnoreMatcher)
+	var processDir func(dir string, rel string) error
+	processDir = func(dir string, rel string) error {
+		err := ignore.loadIgnoreFile(localDir, strings.TrimSuffix(rel, "/"))
+		if err != nil {
+			return err
+		}
+		localFileInfos, err := ioutil.ReadDir(dir)
+		if err != nil {
+			return fmt.Errorf("Failed to get a list of local file names: %v", err)
+		}
+		for _, localFileInfo := range localFileInfos {
+			localFileName := dir + "/" + localFileInfo.Name()
+			fileRel := rel + localFileInfo.Name()
+			if s.excluded(localDir, localFileName, remoteDir+"/"+fileRel) || ignore.Match(fileRel, localFileInfo.IsDir()) {
+				continue
+			}
+
+			// the sync state may be kept in the directory being synced
+			if absName, _ := filepath.Abs(localFileName); absName == statePath {
+				continue
+			}
+
+			if localFileInfo.IsDir() {
+				err = processDir(localFileName, fileRel+"/")
+				if err != nil {
+					return err
+				}
+			}
+			local[fileRel] = syncItem{
+				localName:  localFileName,
+				remoteName: remoteDir + "/" + fileRel,
+				isDir:      localFileInfo.IsDir(),
+				size:       localFileInfo.Size(),
+				lastMod:    localFileInfo.ModTime().Unix(),
+			}
+		}
+		return nil
+	}
+	if _, err := os.Stat(localDir); err == nil {
+		e = processDir(localDir, "")
+		if e != nil {
+			return 0, e
+		}
+	}
+
+	// the remote files under remoteDir, keyed the same way
+	remoteFileHashes, err := s.GetAllFileHashes()
+	if err != nil {
+		return 0, fmt.Errorf("Failed to get a list of remote file hashes: %v", err)
+	}
+	remote := make(map[string]filefreezer.FileInfo)
+	for _, remoteFileHash := range remoteFileHashes {
+		remoteFileName, err := s.DecryptString(remoteFileHash.FileName)
+		if err != nil {
+			return 0, fmt.Errorf("Failed to decrypt remote file name for file id %d: %v", remoteFileHash.FileID, err)
+		}
+		if !strings.HasPrefix(remoteFileName, remoteDir+"/") {
+			continue
+		}
+		fileRel := remoteFileName[len(remoteDir)+1:]
+		if s.excluded(localDir, localDir+"/"+fileRel, remoteFileName) || ignore.Match(fileRel, remoteFileHash.IsDir) {
+			continue
+		}
+		remote[fileRel] = remoteFileHash
+	}
+
+	// go through the files on either side in order, so that directories come
+	// before the files in them
+	var paths []string
+	for fileRel := range local {
+		paths = append(paths, fileRel)
+	}
+	for fileRel := range remote {
+		if _, found := local[fileRel]; !found {
+			paths = append(paths, fileRel)
+		}
+	}
+	sort.Strings(paths)
+
+	// local files are read from a snapshot, if one is wanted, while they're synced
+	endSnapshot, err := s.beginSnapshot(localDir)
+	if err != nil {
+		return 0, err
+	}
+	defer endSnapshot()
+
+	for _, fileRel := range paths {
+		localName := localDir + "/" + fileRel
+		remoteName := remoteDir + "/" + fileRel
+		item, isLocal := local[fileRel]
+		remoteFile, isRemote := remote[fileRel]
+
+		var changes int
+		switch {
+		case isLocal && (isRemote || item.isDir):
+			_, changes, err = s.SyncFile(localName, remoteName, SyncCurrentVersion)
+		case isLocal:
+			changes, err = s.syncLocalOnly(localName, remoteName)
+		default:
+			changes, err = s.syncRemoteOnly(remoteFile, localName, remoteName)
+		}
+		changeCount += changes
+		if err != nil {
+			return changeCount, fmt.Errorf("Failed to sync the local file (%s) with the remote file (%s): %v", localName, remoteName, err)
+		}
+	}
+
+	return changeCount, nil
+}
+
+// syncLocalOnly syncs a local file that isn't on the server. A file that was
+// synced before was removed from the server since, so it's removed locally
+// too unless it was changed since, which uploads it again.
+func (s *State) syncLocalOnly(localFilename string, remoteFilepath string) (changeCount int, e error) {
+	last, tracked, err := s.lastSynced(localFilename, remoteFilepath)
+	if err != nil {
+		return 0, err
+	}
+	if tracked {
+		info, err := os.Stat(localFilename)
+		if err != nil {
+			return 0, err
+		}
+		if info.ModTime().Unix() == last.LastMod && info.Size() == last.Size {
+			err = os.Remove(localFilename)
+			if err != nil {
+				return 0, fmt.Errorf("Failed to remove the local file %s: %v", localFilename, err)
+			}
+			s.Printf("%s xxx removed locally\n", remoteFilepath)
+			return 0, s.forgetSynced(localFilename)
+		}
+		s.Printf("%s !!! removed from the server but changed locally; uploading it again\n", remoteFilepath)
+	}
+
+	_, changeCount, e = s.SyncFile(localFilename, remoteFilepath, SyncCurrentVersion)
+	return changeCount, e
+}
+
+// syncRemoteOnly syncs a remote file that isn't in the local directory. A file
+// that was synced before was removed locally since, so it's removed from the
+// server too unless a new version was uploaded since, which downloads it again.
+func (s *State) syncRemoteOnly(remote filefreezer.FileInfo, localFilename string, remoteFilepath string) (changeCount int, e error) {
+	last, tracked, err := s.lastSynced(localFilename, remoteFilepath)
+	if err != nil {
+		return 0, err
+	}
+	if tracked {
+		if last.VersionID == remote.CurrentVersion.VersionID || last.Hash == remote.CurrentVersion.FileHash {
+			target := fmt.Sprintf("%s/api/file/%d", s.HostURI, remote.FileID)
+			_, err = s.RunIdempotentRequest(target, "DELETE", s.AuthToken, nil)
+			if err != nil {
+				return 0, fmt.Errorf("Failed to remove the file %s: %v", remoteFilepath, err)
+			}
+			s.Printf("%s xxx removed from the server\n", remoteFilepath)
+			return 0, s.forgetSynced(localFilename)
+		}
+		s.Printf("%s !!! removed locally but changed on the server; downloading it again\n", remoteFilepath)
+	}
+
+	// the directory may have been removed along with the file
+	err = os.MkdirAll(filepath.Dir(localFilename), 0777)
+	if err != nil {
+		return 0, fmt.Errorf("Failed to create the local directory for %s: %v", localFilename, err)
+	}
+	_, changeCount, e = s.SyncFile(localFilename, remoteFilepath, SyncCurrentVersion)
+	return changeCount, e
+}
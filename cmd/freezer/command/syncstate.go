@@ -0,0 +1,168 @@
+// Copyright 2017, Timothy Bogdala <tdb@animal-machine.com>
+// See the LICENSE file for more details.
+
+package command
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+
+	"github.com/marcoziti/gringotts"
+)
+
+// SyncedFile is what a local file and its remote version were the last time
+// they were synced, as kept in the SyncStateFile.
+type SyncedFile struct {
+	// RemotePath is the file path on the server the local file was synced with.
+	RemotePath string
+
+	// VersionID and VersionNumber identify the version that both sides had.
+	VersionID     int
+	VersionNumber int
+
+	// Hash is the hash of the file's data on both sides.
+	Hash string
+
+	// LastMod and Size are from the local file once it was synced, which
+	// tells whether it was changed since without hashing it.
+	LastMod int64
+	Size    int64
+}
+
+// loadSyncState reads the last synced state of the files from the
+// SyncStateFile, once. A missing file has no state.
+func (s *State) loadSyncState() error {
+	if s.syncState != nil {
+		return nil
+	}
+	s.syncState = make(map[string]map[string]SyncedFile)
+	data, err := ioutil.ReadFile(s.SyncStateFile)
+	if os.IsNotExist(err) {
+		return nil
+	} else if err != nil {
+		return fmt.Errorf("Failed to read the sync state: %v", err)
+	}
+	err = json.Unmarshal(data, &s.syncState)
+	if err != nil {
+		return fmt.Errorf("Failed to read the sync state: %v", err)
+	}
+	return nil
+}
+
+// lastSynced returns the state of the local file the last time it was synced
+// with the remote file, if the SyncStateFile has it.
+func (s *State) lastSynced(localFilename string, remoteFilepath string) (SyncedFile, bool, error) {
+	if s.SyncStateFile == "" {
+		return SyncedFile{}, false, nil
+	}
+	localPath, err := filepath.Abs(localFilename)
+	if err != nil {
+		return SyncedFile{}, false, err
+	}
+
+	s.syncStateLock.Lock()
+	defer s.syncStateLock.Unlock()
+	err = s.loadSyncState()
+	if err != nil {
+		return SyncedFile{}, false, err
+	}
+	synced, found := s.syncState[s.HostURI][localPath]
+	if !found || synced.RemotePath != remoteFilepath {
+		return SyncedFile{}, false, nil
+	}
+	return synced, true, nil
+}
+
+// recordSynced saves the state of the local file after it was synced with
+// the version of the remote file to the SyncStateFile, if one is set. If the
+// version isn't known it's looked up, and only the hash is kept if the server's
+// current version doesn't match it.
+func (s *State) recordSynced(localFilename string, remoteFilepath string, hash string, version *filefreezer.FileVersionInfo) error {
+	if s.SyncStateFile == "" {
+		return nil
+	}
+	localPath, err := filepath.Abs(localFilename)
+	if err != nil {
+		return err
+	}
+	info, err := os.Stat(localFilename)
+	if err != nil {
+		return fmt.Errorf("Failed to record the sync state of %s: %v", localFilename, err)
+	}
+
+	synced := SyncedFile{
+		RemotePath: remoteFilepath,
+		Hash:       hash,
+		LastMod:    info.ModTime().Unix(),
+		Size:       info.Size(),
+	}
+	if version == nil {
+		fi, err := s.GetFileInfoByFilename(remoteFilepath)
+		if err == nil && fi.CurrentVersion.FileHash == hash {
+			version = &fi.CurrentVersion
+		}
+	}
+	if version != nil {
+		synced.VersionID = version.VersionID
+		synced.VersionNumber = version.VersionNumber
+	}
+
+	s.syncStateLock.Lock()
+	defer s.syncStateLock.Unlock()
+	err = s.loadSyncState()
+	if err != nil {
+		return err
+	}
+	files := s.syncState[s.HostURI]
+	if files == nil {
+		files = make(map[string]SyncedFile)
+		s.syncState[s.HostURI] = files
+	}
+	if files[localPath] == synced {
+		return nil
+	}
+	files[localPath] = synced
+	return s.saveSyncState()
+}
+
+// forgetSynced removes the local file from the SyncStateFile, if one is set,
+// such as once the file was removed on both sides.
+func (s *State) forgetSynced(localFilename string) error {
+	if s.SyncStateFile == "" {
+		return nil
+	}
+	localPath, err := filepath.Abs(localFilename)
+	if err != nil {
+		return err
+	}
+
+	s.syncStateLock.Lock()
+	defer s.syncStateLock.Unlock()
+	err = s.loadSyncState()
+	if err != nil {
+		return err
+	}
+	files := s.syncState[s.HostURI]
+	if _, found := files[localPath]; !found {
+		return nil
+	}
+	delete(files, localPath)
+	return s.saveSyncState()
+}
+
+// saveSyncState writes the sync state to the SyncStateFile; syncStateLock
+// must be held.
+func (s *State) saveSyncState() error {
+	data, err := json.MarshalIndent(s.syncState, "", "  ")
+	if err != nil {
+		return err
+	}
+	err = writeFileAtomic(s.SyncStateFile, data)
+	if err != nil {
+		return fmt.Errorf("Failed to write the sync state: %v", err)
+	}
+	return nil
+}
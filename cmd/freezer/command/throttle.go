@@ -0,0 +1,127 @@
+// Copyright 2017, Timothy Bogdala <tdb@animal-machine.com>
+// See the LICENSE file for more details.
+
+package command
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// BandwidthRule limits the bandwidth used during a window of the day.
+type BandwidthRule struct {
+	// Start and End are the offsets from local midnight that the rule applies
+	// between; an End before Start makes the window wrap past midnight.
+	Start time.Duration
+	End   time.Duration
+
+	// Limit is the bytes per second allowed during the window; zero is unlimited
+	Limit int64
+}
+
+// ParseBandwidth parses a number of bytes per second with an optional K, M or G
+// suffix, such as "512K" or "1M".
+func ParseBandwidth(value string) (int64, error) {
+	value = strings.ToUpper(strings.TrimSpace(value))
+	value = strings.TrimSuffix(strings.TrimSuffix(value, "/S"), "B")
+	multiplier := int64(1)
+	switch {
+	case strings.HasSuffix(value, "K"):
+		multiplier = 1024
+	case strings.HasSuffix(value, "M"):
+		multiplier = 1024 * 1024
+	case strings.HasSuffix(value, "G"):
+		multiplier = 1024 * 1024 * 1024
+	}
+	if multiplier != 1 {
+		value = value[:len(value)-1]
+	}
+
+	n, err := strconv.ParseFloat(value, 64)
+	if err != nil || n < 0 {
+		return 0, fmt.Errorf("invalid bandwidth %q", value)
+	}
+	return int64(n * float64(multiplier)), nil
+}
+
+// ParseBandwidthRule parses a rule written as "HH:MM-HH:MM=limit", such as
+// "01:00-07:00=0" for unlimited bandwidth overnight.
+func ParseBandwidthRule(rule string) (BandwidthRule, error) {
+	var r BandwidthRule
+	parts := strings.SplitN(rule, "=", 2)
+	times := strings.SplitN(parts[0], "-", 2)
+	if len(parts) != 2 || len(times) != 2 {
+		return r, fmt.Errorf("the bandwidth rule %q should look like HH:MM-HH:MM=limit", rule)
+	}
+
+	var err error
+	r.Start, err = parseTimeOfDay(times[0])
+	if err != nil {
+		return r, err
+	}
+	r.End, err = parseTimeOfDay(times[1])
+	if err != nil {
+		return r, err
+	}
+	r.Limit, err = ParseBandwidth(parts[1])
+	if err != nil {
+		return r, err
+	}
+	return r, nil
+}
+
+// parseTimeOfDay parses "HH:MM" into the offset from midnight.
+func parseTimeOfDay(value string) (time.Duration, error) {
+	t, err := time.Parse("15:04", strings.TrimSpace(value))
+	if err != nil {
+		return 0, fmt.Errorf("invalid time of day %q: %v", value, err)
+	}
+	return time.Duration(t.Hour())*time.Hour + time.Duration(t.Minute())*time.Minute, nil
+}
+
+// contains returns true if the time of day falls within the rule's window.
+func (r BandwidthRule) contains(offset time.Duration) bool {
+	if r.Start <= r.End {
+		return offset >= r.Start && offset < r.End
+	}
+	return offset >= r.Start || offset < r.End
+}
+
+// bandwidthLimit returns the bytes per second allowed at the time given: the
+// limit of the first schedule rule covering it, otherwise BandwidthLimit.
+func (s *State) bandwidthLimit(now time.Time) int64 {
+	offset := time.Duration(now.Hour())*time.Hour + time.Duration(now.Minute())*time.Minute
+	for _, r := range s.BandwidthSchedule {
+		if r.contains(offset) {
+			return r.Limit
+		}
+	}
+	return s.BandwidthLimit
+}
+
+// throttle sleeps as long as needed to keep the transfer of byteCount more
+// bytes within the current bandwidth limit. It's safe to call from the
+// goroutines transferring chunks concurrently.
+func (s *State) throttle(byteCount int) {
+	now := time.Now()
+	limit := s.bandwidthLimit(now)
+
+	s.throttleLock.Lock()
+	if limit <= 0 {
+		s.throttleNext = time.Time{}
+		s.throttleLock.Unlock()
+		return
+	}
+
+	// throttleNext is when the bytes already sent would be paid off at the limit
+	if s.throttleNext.Before(now) {
+		s.throttleNext = now
+	}
+	s.throttleNext = s.throttleNext.Add(time.Duration(float64(byteCount) / float64(limit) * float64(time.Second)))
+	wait := s.throttleNext.Sub(now)
+	s.throttleLock.Unlock()
+
+	time.Sleep(wait)
+}
@@ -0,0 +1,105 @@
+// Copyright 2017, Timothy Bogdala <tdb@animal-machine.com>
+// See the LICENSE file for more details.
+
+package command
+
+import (
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"sort"
+	"strings"
+	"time"
+)
+
+// Verbosity levels for State.Verbosity, set with -v, -vv and -vvv.
+const (
+	VerbosityRequests = 1 // log each request to the server and its status
+	VerbosityDebug    = 2 // also log retries, token renewals and other decisions
+	VerbosityWire     = 3 // also log the headers of each request and response
+)
+
+// redactedHeaders are the headers that are never logged since they carry
+// credentials.
+var redactedHeaders = map[string]bool{
+	"Authorization": true,
+	"Cookie":        true,
+	"Set-Cookie":    true,
+}
+
+// tracef writes the message to the TraceOutput, or stderr if it's nil, when
+// the Verbosity is at the level or higher. The output is separate from
+// Printf so that it isn't silenced by --quiet.
+func (s *State) tracef(level int, format string, v ...interface{}) {
+	if s.Verbosity < level {
+		return
+	}
+	var w io.Writer = os.Stderr
+	if s.TraceOutput != nil {
+		w = s.TraceOutput
+	}
+	fmt.Fprintf(w, format, v...)
+}
+
+// traceTransport logs the requests made through it according to the State's
+// Verbosity. The bodies are never logged, only their sizes, so that file data
+// and keys don't end up in the logs.
+type traceTransport struct {
+	s    *State
+	next http.RoundTripper
+}
+
+// traceHTTP wraps the transport so that requests through it are logged if the
+// State's Verbosity asks for it.
+func (s *State) traceHTTP(next http.RoundTripper) http.RoundTripper {
+	if s.Verbosity < VerbosityRequests {
+		return next
+	}
+	if next == nil {
+		next = http.DefaultTransport
+	}
+	return &traceTransport{s: s, next: next}
+}
+
+// RoundTrip implements http.RoundTripper.
+func (t *traceTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	target := req.URL.Scheme + "://" + req.URL.Host + req.URL.Path
+	if t.s.Verbosity >= VerbosityWire {
+		t.s.tracef(VerbosityWire, "> %s %s (%d bytes)\n%s", req.Method, target, req.ContentLength, sanitizedHeaders("> ", req.Header))
+	}
+
+	start := time.Now()
+	resp, err := t.next.RoundTrip(req)
+	elapsed := time.Since(start).Round(time.Millisecond)
+	if err != nil {
+		t.s.tracef(VerbosityRequests, "%s %s failed after %s: %v\n", req.Method, target, elapsed, err)
+		return nil, err
+	}
+
+	t.s.tracef(VerbosityRequests, "%s %s -> %s (%s)\n", req.Method, target, resp.Status, elapsed)
+	if t.s.Verbosity >= VerbosityWire {
+		t.s.tracef(VerbosityWire, "< %s (%d bytes)\n%s", resp.Proto, resp.ContentLength, sanitizedHeaders("< ", resp.Header))
+	}
+	return resp, nil
+}
+
+// sanitizedHeaders formats the headers one per line, sorted and with each
+// line starting with prefix, replacing the values of redactedHeaders.
+func sanitizedHeaders(prefix string, header http.Header) string {
+	var names []string
+	for name := range header {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	var lines strings.Builder
+	for _, name := range names {
+		value := strings.Join(header[name], ", ")
+		if redactedHeaders[http.CanonicalHeaderKey(name)] {
+			value = "[redacted]"
+		}
+		fmt.Fprintf(&lines, "%s%s: %s\n", prefix, name, value)
+	}
+	return lines.String()
+}
@@ -0,0 +1,131 @@
+// Copyright 2017, Timothy Bogdala <tdb@animal-machine.com>
+// See the LICENSE file for more details.
+
+package command
+
+import (
+	"errors"
+	"io"
+	"net"
+	"sync"
+	"time"
+)
+
+const (
+	// transferSlowdown is how many times slower than the fastest transfer seen
+	// a batch can get before the window is considered congested.
+	transferSlowdown = 2
+)
+
+// transferWindow tunes the number of chunks transferred at once with additive
+// increase and multiplicative decrease: the window grows by one after each
+// batch that completes without errors or a rise in latency, and is halved
+// otherwise. This finds the concurrency that high-latency links benefit from
+// without overwhelming small servers.
+type transferWindow struct {
+	max      int
+	size     float64
+	baseline time.Duration
+}
+
+// batchSize returns the number of chunks to transfer in the next batch.
+func (tw *transferWindow) batchSize() int {
+	n := int(tw.size)
+	if n < 1 {
+		n = 1
+	}
+	if n > tw.max {
+		n = tw.max
+	}
+	return n
+}
+
+// update adjusts the window after a batch given its slowest transfer and
+// whether all of the transfers in it succeeded.
+func (tw *transferWindow) update(latency time.Duration, ok bool) {
+	if ok && (tw.baseline == 0 || latency < tw.baseline) {
+		tw.baseline = latency
+	}
+
+	if !ok || latency > transferSlowdown*tw.baseline {
+		tw.size /= 2
+		if tw.size < 1 {
+			tw.size = 1
+		}
+		return
+	}
+
+	tw.size++
+	if tw.size > float64(tw.max) {
+		tw.size = float64(tw.max)
+	}
+}
+
+// transferBatchSize returns the number of chunks to transfer at once based on
+// how the previous batches went.
+func (s *State) transferBatchSize() int {
+	if s.transfers == nil || s.transfers.max != s.MaxTransfers {
+		max := s.MaxTransfers
+		if max < 1 {
+			max = 1
+		}
+		s.transfers = &transferWindow{max: max, size: 1}
+	}
+	return s.transfers.batchSize()
+}
+
+// runTransfers runs a batch of chunk transfers concurrently and feeds how they
+// went back into the transfer window. Transfers that fail in a way that may be
+// temporary are tried once more on their own, after the window has shrunk,
+// before giving up.
+func (s *State) runTransfers(batch []func() error) error {
+	s.transferBatchSize()
+
+	errs := make([]error, len(batch))
+	latencies := make([]time.Duration, len(batch))
+	var wg sync.WaitGroup
+	for i, transfer := range batch {
+		wg.Add(1)
+		go func(i int, transfer func() error) {
+			defer wg.Done()
+			start := time.Now()
+			errs[i] = transfer()
+			latencies[i] = time.Since(start)
+		}(i, transfer)
+	}
+	wg.Wait()
+
+	var slowest time.Duration
+	ok := true
+	for i := range batch {
+		if latencies[i] > slowest {
+			slowest = latencies[i]
+		}
+		if errs[i] != nil {
+			ok = false
+		}
+	}
+	s.transfers.update(slowest, ok)
+
+	for i, err := range errs {
+		if err != nil && transientError(err) {
+			err = batch[i]()
+		}
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// transientError returns true if a transfer failed in a way that may not happen
+// again, such as a dropped connection or a server error. Errors the server
+// answered with otherwise, such as a bad login or a rejected chunk, are final.
+func transientError(err error) bool {
+	var statusErr *StatusError
+	if errors.As(err, &statusErr) {
+		return statusErr.StatusCode >= 500
+	}
+	var netErr net.Error
+	return errors.As(err, &netErr) || errors.Is(err, io.ErrUnexpectedEOF)
+}
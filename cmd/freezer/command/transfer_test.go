@@ -0,0 +1,87 @@
+// Copyright 2017, Timothy Bogdala <tdb@animal-machine.com>
+// See the LICENSE file for more details.
+
+package command
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"testing"
+	"time"
+)
+
+// windowStep is a batch fed to a transfer window and the batch size expected after it.
+type windowStep struct {
+	latency time.Duration
+	ok      bool
+	size    int
+}
+
+func TestTransferWindow(t *testing.T) {
+	ms := time.Millisecond
+	tests := []struct {
+		name  string
+		max   int
+		steps []windowStep
+	}{
+		{"clean batches grow to the max", 4, []windowStep{
+			{10 * ms, true, 2}, {10 * ms, true, 3}, {10 * ms, true, 4}, {10 * ms, true, 4}, {12 * ms, true, 4},
+		}},
+		{"an error halves the window", 8, []windowStep{
+			{10 * ms, true, 2}, {10 * ms, true, 3}, {10 * ms, true, 4}, {10 * ms, true, 5},
+			{10 * ms, false, 2}, {10 * ms, true, 3},
+		}},
+		{"a slowdown past the baseline halves the window", 8, []windowStep{
+			{10 * ms, true, 2}, {10 * ms, true, 3}, {10 * ms, true, 4}, {10 * ms, true, 5},
+			{transferSlowdown * 10 * ms, true, 6}, {transferSlowdown*10*ms + ms, true, 3},
+		}},
+		{"a faster batch lowers the baseline", 8, []windowStep{
+			{10 * ms, true, 2}, {4 * ms, true, 3}, {9 * ms, true, 1},
+		}},
+		{"the window never drops below one", 4, []windowStep{
+			{10 * ms, false, 1}, {10 * ms, false, 1}, {10 * ms, true, 2}, {time.Second, true, 1},
+		}},
+	}
+
+	for _, test := range tests {
+		tw := &transferWindow{max: test.max, size: 1}
+		for i, step := range test.steps {
+			tw.update(step.latency, step.ok)
+			if got := tw.batchSize(); got != step.size {
+				t.Fatalf("%s: expected a batch size of %d after batch #%d but got %d.", test.name, step.size, i+1, got)
+			}
+		}
+	}
+
+	// a state without a transfer limit still transfers a chunk at a time
+	s := NewState()
+	s.MaxTransfers = 0
+	if got := s.transferBatchSize(); got != 1 {
+		t.Fatalf("Expected a batch size of 1 without a transfer limit but got %d.", got)
+	}
+}
+
+func TestTransientError(t *testing.T) {
+	tests := []struct {
+		err       error
+		transient bool
+	}{
+		{&StatusError{StatusCode: http.StatusInternalServerError}, true},
+		{&StatusError{StatusCode: http.StatusServiceUnavailable}, true},
+		{fmt.Errorf("Failed to get the file chunk: %w", &StatusError{StatusCode: http.StatusBadGateway}), true},
+		{&StatusError{StatusCode: http.StatusUnauthorized}, false},
+		{&StatusError{StatusCode: http.StatusBadRequest}, false},
+		{&StatusError{StatusCode: http.StatusNotFound}, false},
+		{fmt.Errorf("Failed to make the HTTP PUT request: %w", &net.OpError{Op: "dial", Err: errors.New("connection refused")}), true},
+		{fmt.Errorf("Failed to read the response body: %w", io.ErrUnexpectedEOF), true},
+		{errors.New("Failed to decrypt the the chunk bytes"), false},
+	}
+	for _, test := range tests {
+		if got := transientError(test.err); got != test.transient {
+			t.Fatalf("Expected transientError to be %v for %v.", test.transient, test.err)
+		}
+	}
+}
@@ -0,0 +1,218 @@
+// Copyright 2017, Timothy Bogdala <tdb@animal-machine.com>
+// See the LICENSE file for more details.
+
+package command
+
+import (
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path"
+	"path/filepath"
+	"regexp"
+	"strings"
+)
+
+// Transform is an external command pair that changes file data on its way to
+// and from the server, such as for custom compression or redaction. Each command
+// reads the data on stdin and writes the transformed data to stdout.
+//
+// Sync compares the transformed data with the server, so the Upload command
+// must give the same output for the same input or every sync will upload a new
+// version.
+type Transform struct {
+	// Pattern selects the remote file paths the transform applies to
+	Pattern *regexp.Regexp
+
+	// Upload is run on the local file before it's sent to the server
+	Upload string
+
+	// Download is run on the data from the server before it's written to the
+	// local file; if it's empty the transform is one-way and downloads fail
+	Download string
+}
+
+// ParseTransform parses a transform written as "pattern=upload command" or
+// "pattern=upload command|download command", such as
+// `\.csv$=gzip -n|gunzip`. The commands are split on spaces and aren't run
+// through a shell. Files in formats that are already compressed, like JPEG or
+// ZIP, skip the transform and are stored as they are. A DictionaryPlaceholder in the commands is replaced with
+// the dictionary trained for the file's directory.
+func ParseTransform(rule string) (Transform, error) {
+	var t Transform
+	parts := strings.SplitN(rule, "=", 2)
+	if len(parts) != 2 {
+		return t, fmt.Errorf("invalid transform %q; expected pattern=upload command|download command", rule)
+	}
+
+	var err error
+	t.Pattern, err = regexp.Compile(parts[0])
+	if err != nil {
+		return t, fmt.Errorf("invalid pattern for the transform %q: %v", rule, err)
+	}
+
+	t.Upload, t.Download = parseTransformCommands(parts[1])
+	if t.Upload == "" {
+		return t, fmt.Errorf("the transform %q has no upload command", rule)
+	}
+	return t, nil
+}
+
+// parseTransformCommands splits "upload command|download command" into the
+// two commands; the download command is empty if there isn't one.
+func parseTransformCommands(commands string) (upload string, download string) {
+	parts := strings.SplitN(commands, "|", 2)
+	upload = strings.TrimSpace(parts[0])
+	if len(parts) == 2 {
+		download = strings.TrimSpace(parts[1])
+	}
+	return upload, download
+}
+
+// transformFor returns the transform of the policy for the remote file path if
+// it sets one, and otherwise the first transform matching the path or nil if
+// there isn't one. Dictionaries are never transformed.
+func (s *State) transformFor(remoteFilepath string) *Transform {
+	if path.Base(remoteFilepath) == DictionaryName {
+		return nil
+	}
+	if p := s.policyFor(remoteFilepath); p != nil && p.Transform != "" {
+		return p.transform
+	}
+	for i := range s.Transforms {
+		if s.Transforms[i].Pattern.MatchString(remoteFilepath) {
+			return &s.Transforms[i]
+		}
+	}
+	return nil
+}
+
+// syncTransformed syncs a local file through a transform. The Upload command's
+// output is staged in a temporary directory with the local file's permissions and
+// modification time and that staged file is what gets synced with the server.
+// If the server's version is newer it is downloaded to the staged file and the
+// Download command's output replaces the local file.
+func (s *State) syncTransformed(t *Transform, localFilename string, remoteFilepath string, versionNum int) (status int, changeCount int, e error) {
+	tmpDir, err := ioutil.TempDir("", "freezer-transform")
+	if err != nil {
+		return 0, 0, fmt.Errorf("Failed to create a temporary directory to transform %s: %v", localFilename, err)
+	}
+	defer os.RemoveAll(tmpDir)
+	staged := filepath.Join(tmpDir, filepath.Base(localFilename))
+
+	upload, err := s.expandTransform(t.Upload, remoteFilepath, tmpDir)
+	if err != nil {
+		return 0, 0, err
+	}
+	download, err := s.expandTransform(t.Download, remoteFilepath, tmpDir)
+	if err != nil {
+		return 0, 0, err
+	}
+
+	localInfo, err := os.Stat(localFilename)
+	if err == nil {
+		if isCompressedFormat(localFilename) {
+			err = copyFile(localFilename, staged)
+		} else {
+			err = runTransform(upload, localFilename, staged)
+		}
+		if err != nil {
+			return 0, 0, fmt.Errorf("Failed to transform %s for upload: %v", localFilename, err)
+		}
+		os.Chmod(staged, localInfo.Mode().Perm())
+		os.Chtimes(staged, localInfo.ModTime(), localInfo.ModTime())
+	}
+
+	status, changeCount, err = s.syncFile(staged, remoteFilepath, versionNum)
+	if err != nil || status != SyncStatusRemoteNewer {
+		return status, changeCount, err
+	}
+
+	// the server had the newer data, so turn it back into the local file
+	stagedInfo, err := os.Stat(staged)
+	if err != nil {
+		return status, changeCount, err
+	}
+	if stagedInfo.IsDir() {
+		return status, changeCount, os.MkdirAll(localFilename, stagedInfo.Mode())
+	}
+	if isCompressedFormat(staged) {
+		// stored as it is since it skipped the transform when uploaded
+		err = moveFile(staged, localFilename)
+		if err != nil {
+			return status, changeCount, fmt.Errorf("Failed to move the download into place as %s: %v", localFilename, err)
+		}
+		return status, changeCount, nil
+	}
+	if t.Download == "" {
+		return status, changeCount, fmt.Errorf("%s can't be downloaded because its transform has no download command", remoteFilepath)
+	}
+	restored := staged + ".restored"
+	err = runTransform(download, staged, restored)
+	if err != nil {
+		return status, changeCount, fmt.Errorf("Failed to transform the download of %s: %v", remoteFilepath, err)
+	}
+	os.Chmod(restored, stagedInfo.Mode().Perm())
+	err = moveFile(restored, localFilename)
+	if err != nil {
+		return status, changeCount, fmt.Errorf("Failed to move the transformed download into place as %s: %v", localFilename, err)
+	}
+
+	s.Printf("%s <== transformed\n", remoteFilepath)
+	return status, changeCount, nil
+}
+
+// runTransform runs the command with the input file on stdin, writing stdout
+// to the output file.
+func runTransform(command string, input string, output string) error {
+	args := strings.Fields(command)
+	in, err := os.Open(input)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+	out, err := os.OpenFile(output, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0600)
+	if err != nil {
+		return err
+	}
+	defer out.Close()
+
+	var stderr bytes.Buffer
+	cmd := exec.Command(args[0], args[1:]...)
+	cmd.Stdin = in
+	cmd.Stdout = out
+	cmd.Stderr = &stderr
+	err = cmd.Run()
+	if err != nil {
+		return fmt.Errorf("%s: %s", err, strings.TrimSpace(stderr.String()))
+	}
+	return out.Close()
+}
+
+// moveFile renames src to dst, falling back to a copy when they're on
+// different file systems.
+func moveFile(src string, dst string) error {
+	if os.Rename(src, dst) == nil {
+		return nil
+	}
+	err := copyFile(src, dst)
+	if err != nil {
+		return err
+	}
+	return os.Remove(src)
+}
+
+// copyFile writes a copy of src to dst with the same permissions.
+func copyFile(src string, dst string) error {
+	data, err := ioutil.ReadFile(src)
+	if err != nil {
+		return err
+	}
+	info, err := os.Stat(src)
+	if err != nil {
+		return err
+	}
+	return ioutil.WriteFile(dst, data, info.Mode().Perm())
+}
@@ -0,0 +1,134 @@
+// Copyright 2017, Timothy Bogdala <tdb@animal-machine.com>
+// See the LICENSE file for more details.
+
+package command
+
+import (
+	"fmt"
+	"io"
+	"sort"
+	"strings"
+)
+
+// TreeNode is a file or directory in the tree of remote file names.
+type TreeNode struct {
+	// Name is the last element of the path
+	Name string
+
+	// IsDir is true for directories, which have Children
+	IsDir    bool
+	Children []*TreeNode
+
+	// Files is the number of files in the node, which is one for a file
+	Files int
+
+	// Size is the number of bytes stored for the current versions of the files
+	Size int64
+}
+
+// child returns the directory named under the node, creating it if needed.
+func (n *TreeNode) child(name string) *TreeNode {
+	for _, c := range n.Children {
+		if c.Name == name {
+			return c
+		}
+	}
+	c := &TreeNode{Name: name, IsDir: true}
+	n.Children = append(n.Children, c)
+	return c
+}
+
+// sort orders the children of the node and of all of its directories, with
+// directories first and then by name.
+func (n *TreeNode) sort() {
+	sort.Slice(n.Children, func(i, j int) bool {
+		a, b := n.Children[i], n.Children[j]
+		if a.IsDir != b.IsDir {
+			return a.IsDir
+		}
+		return a.Name < b.Name
+	})
+	for _, c := range n.Children {
+		c.sort()
+	}
+}
+
+// GetTree builds the tree of the authenticated user's files under prefix,
+// which covers all files if it's empty. Directory sizes and file counts
+// include everything below them.
+func (s *State) GetTree(prefix string) (*TreeNode, error) {
+	files, err := s.getAllFilesByName()
+	if err != nil {
+		return nil, err
+	}
+
+	prefix = strings.Trim(prefix, "/")
+	root := &TreeNode{Name: prefix, IsDir: true}
+	if prefix == "" {
+		root.Name = "."
+	}
+
+	found := false
+	for name, fi := range files {
+		rel := strings.Trim(name, "/")
+		if prefix != "" {
+			if rel != prefix && !strings.HasPrefix(rel, prefix+"/") {
+				continue
+			}
+			rel = strings.TrimPrefix(strings.TrimPrefix(rel, prefix), "/")
+		}
+		found = true
+		if rel == "" {
+			continue
+		}
+
+		// walk down to the parent directory, adding the file to each one on the way
+		parts := strings.Split(rel, "/")
+		node := root
+		for _, dir := range parts[:len(parts)-1] {
+			if !fi.IsDir {
+				node.Files++
+				node.Size += fi.CurrentVersion.Size
+			}
+			node = node.child(dir)
+		}
+
+		last := parts[len(parts)-1]
+		if fi.IsDir {
+			node.child(last)
+			continue
+		}
+		node.Files++
+		node.Size += fi.CurrentVersion.Size
+		node.Children = append(node.Children, &TreeNode{Name: last, Files: 1, Size: fi.CurrentVersion.Size})
+	}
+
+	if !found && prefix != "" {
+		return nil, fmt.Errorf("no files were found on the server under %s", prefix)
+	}
+
+	root.sort()
+	return root, nil
+}
+
+// WriteTree renders the node and everything below it as an indented tree with
+// the size of each file and directory.
+func (n *TreeNode) WriteTree(w io.Writer) {
+	fmt.Fprintf(w, "%s [%d bytes]\n", n.Name, n.Size)
+	n.writeChildren(w, "")
+}
+
+func (n *TreeNode) writeChildren(w io.Writer, indent string) {
+	for i, c := range n.Children {
+		branch, nextIndent := "├── ", "│   "
+		if i == len(n.Children)-1 {
+			branch, nextIndent = "└── ", "    "
+		}
+		name := c.Name
+		if c.IsDir {
+			name += "/"
+		}
+		fmt.Fprintf(w, "%s%s%s [%d bytes]\n", indent, branch, name, c.Size)
+		c.writeChildren(w, indent+nextIndent)
+	}
+}
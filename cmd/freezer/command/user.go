@@ -13,7 +13,7 @@ import (
 
 // AddUser adds a user to the database using the username, password and quota provided.
 // The store object will take care of generating the salt and salted password.
-func (s *State) AddUser(store *filefreezer.Storage, username string, password string, quota int) (*filefreezer.User, error) {
+func (s *State) AddUser(store filefreezer.UserStore, username string, password string, quota int) (*filefreezer.User, error) {
 	// generate the salt and salted login password hash
 	salt, saltedPass, err := filefreezer.GenLoginPasswordHash(password)
 	if err != nil {
@@ -32,7 +32,7 @@ func (s *State) AddUser(store *filefreezer.Storage, username string, password st
 }
 
 // RmUser removes a user from the database using the username as akey.
-func (s *State) RmUser(store *filefreezer.Storage, username string) error {
+func (s *State) RmUser(store filefreezer.UserStore, username string) error {
 	// add the user to the database
 	err := store.RemoveUser(username)
 	if err != nil {
@@ -45,7 +45,7 @@ func (s *State) RmUser(store *filefreezer.Storage, username string) error {
 
 // ModUser modifies a user in the database. if the newQuota, newUsername or newPassword
 // fields are non-nil then their values are updated in the database.
-func (s *State) ModUser(store *filefreezer.Storage, username string, newQuota int, newUsername string, newPassword string) error {
+func (s *State) ModUser(store filefreezer.UserStore, username string, newQuota int, newUsername string, newPassword string) error {
 	// get existing user
 	user, err := store.GetUser(username)
 	if err != nil {
@@ -86,6 +86,57 @@ func (s *State) ModUser(store *filefreezer.Storage, username string, newQuota in
 	return nil
 }
 
+// SetUserMaxVersions sets the number of versions of each file the server
+// keeps for the user; zero makes the user use the server's setting.
+func (s *State) SetUserMaxVersions(store filefreezer.UserStore, username string, maxVersions int) error {
+	user, err := store.GetUser(username)
+	if err != nil {
+		return fmt.Errorf("Failed to get an existing user with the name %s: %v", username, err)
+	}
+
+	err = store.SetUserMaxVersions(user.ID, maxVersions)
+	if err != nil {
+		return fmt.Errorf("Failed to set the maximum versions for the user %s: %v", username, err)
+	}
+
+	s.Printf("Maximum versions for %s set to %d\n", username, maxVersions)
+	return nil
+}
+
+// SetUserMaxEgress sets the number of bytes the user can download each month;
+// zero makes the user use the server's setting.
+func (s *State) SetUserMaxEgress(store filefreezer.UserStore, username string, maxEgress int64) error {
+	user, err := store.GetUser(username)
+	if err != nil {
+		return fmt.Errorf("Failed to get an existing user with the name %s: %v", username, err)
+	}
+
+	err = store.SetUserMaxEgress(user.ID, maxEgress)
+	if err != nil {
+		return fmt.Errorf("Failed to set the maximum egress for the user %s: %v", username, err)
+	}
+
+	s.Printf("Maximum egress for %s set to %d bytes a month\n", username, maxEgress)
+	return nil
+}
+
+// UnfreezeUser lifts a freeze on file and version removal for the user
+// which the server sets when it detects suspicious activity on the account.
+func (s *State) UnfreezeUser(store filefreezer.UserStore, username string) error {
+	user, err := store.GetUser(username)
+	if err != nil {
+		return fmt.Errorf("Failed to get an existing user with the name %s: %v", username, err)
+	}
+
+	err = store.UnfreezeUserPruning(user.ID)
+	if err != nil {
+		return fmt.Errorf("Failed to unfreeze the user %s: %v", username, err)
+	}
+
+	s.Println("User unfrozen successfully")
+	return nil
+}
+
 // GetUserStats returns a UserStats object for the authenticated user
 // in the command State. A non-nil error value is returned on failure.
 func (s *State) GetUserStats() (stats filefreezer.UserStats, e error) {
@@ -102,11 +153,60 @@ func (s *State) GetUserStats() (stats filefreezer.UserStats, e error) {
 	s.Printf("Quota:     %v\n", r.Stats.Quota)
 	s.Printf("Allocated: %v\n", r.Stats.Allocated)
 	s.Printf("Revision:  %v\n", r.Stats.Revision)
+	s.Printf("Logical:   %v\n", r.LogicalSize)
+	s.Printf("Physical:  %v\n", r.PhysicalSize)
+	s.Printf("Files:     %v (%v versions)\n", r.FileCount, r.VersionCount)
+	if r.UsageRevision < r.Stats.Revision {
+		s.Printf("The sizes and counts are from revision %v and are being updated.\n", r.UsageRevision)
+	}
+	if r.Stats.MaxVersions > 0 {
+		s.Printf("Max Versions: %v\n", r.Stats.MaxVersions)
+	}
+	if r.EgressLimit > 0 {
+		s.Printf("Egress:    %v of %v this month\n", r.Egress, r.EgressLimit)
+	} else {
+		s.Printf("Egress:    %v this month\n", r.Egress)
+	}
+	if r.PruningFrozen {
+		s.Printf("WARNING: file and version removal is frozen for this account: %s\n", r.FrozenReason)
+	}
 
 	stats = r.Stats
 	return
 }
 
+// GetUserBandwidth returns the authenticated user's bandwidth for each of the
+// last days, including today, and prints it with the totals. Days without
+// requests are left out.
+func (s *State) GetUserBandwidth(days int) ([]filefreezer.BandwidthDay, error) {
+	if err := s.requireFeature(models.FeatureBandwidth); err != nil {
+		return nil, err
+	}
+
+	target := fmt.Sprintf("%s/api/user/bandwidth?days=%d", s.HostURI, days)
+	body, err := s.RunAuthRequest(target, "GET", s.AuthToken, nil)
+	if err != nil {
+		return nil, fmt.Errorf("Failed to get the user bandwidth: %v", err)
+	}
+	var r models.UserBandwidthGetResponse
+	err = json.Unmarshal(body, &r)
+	if err != nil {
+		return nil, fmt.Errorf("Failed to read the user bandwidth: %v", err)
+	}
+
+	var total filefreezer.BandwidthDay
+	s.Printf("%-10s %10s %14s %14s\n", "Day", "Requests", "Uploaded", "Downloaded")
+	for _, day := range r.Days {
+		s.Printf("%-10s %10d %14d %14d\n", day.Day, day.Requests, day.Uploaded, day.Downloaded)
+		total.Requests += day.Requests
+		total.Uploaded += day.Uploaded
+		total.Downloaded += day.Downloaded
+	}
+	s.Printf("%-10s %10d %14d %14d\n", "Total", total.Requests, total.Uploaded, total.Downloaded)
+
+	return r.Days, nil
+}
+
 // GetAllFileHashes returns a slice of FileInfo objects for all files registered
 // to the authenticated user in the command State. A non-nil error value is
 // returned on failure.
@@ -126,6 +226,26 @@ func (s *State) GetAllFileHashes() ([]filefreezer.FileInfo, error) {
 	return allFiles.Files, nil
 }
 
+// getAllFilesByName returns all of the files registered to the authenticated
+// user keyed by their decrypted file names.
+func (s *State) getAllFilesByName() (map[string]filefreezer.FileInfo, error) {
+	allFileInfos, err := s.GetAllFileHashes()
+	if err != nil {
+		return nil, err
+	}
+
+	files := make(map[string]filefreezer.FileInfo)
+	for _, fi := range allFileInfos {
+		name, err := s.DecryptString(fi.FileName)
+		if err != nil {
+			return nil, fmt.Errorf("Failed to decrypt remote file name for file id %d: %v", fi.FileID, err)
+		}
+		files[name] = fi
+	}
+
+	return files, nil
+}
+
 // SetCryptoHashForPassword sets the hash of the hash of the plaintext password on
 // the server for the authenticated user in the command State. This can then
 // be used to ensure the plaintext password entered by a user is the correct one
@@ -0,0 +1,49 @@
+// Copyright 2017, Timothy Bogdala <tdb@animal-machine.com>
+// See the LICENSE file for more details.
+
+package command
+
+import (
+	"encoding/json"
+	"fmt"
+
+	"github.com/marcoziti/gringotts/cmd/freezer/models"
+)
+
+// Version is the version of this client, which is sent to the server with
+// every request so that it can turn away clients it no longer supports.
+const Version = "0.2.0"
+
+// checkLatestVersion records the newest client version a server named and
+// sends a notice the first time it's newer than this client.
+func (s *State) checkLatestVersion(latest string) {
+	if latest == "" || models.CompareVersions(latest, Version) <= 0 || latest == s.UpgradeAvailable {
+		return
+	}
+	s.UpgradeAvailable = latest
+	s.notify(fmt.Sprintf("An upgrade is available: version %s of the client can be installed to replace version %s.", latest, Version))
+}
+
+// notify sends the notice to the Notices channel if one is set and otherwise
+// prints it.
+func (s *State) notify(notice string) {
+	if s.Notices == nil {
+		s.Println(notice)
+		return
+	}
+	select {
+	case s.Notices <- notice:
+	default:
+	}
+}
+
+// upgradeRequiredError describes a request that the server turned away for
+// coming from a client that's too old.
+func upgradeRequiredError(hostURI string, body []byte) error {
+	var resp models.ErrorResponse
+	json.Unmarshal(body, &resp)
+	if resp.MinClientVersion == "" {
+		return fmt.Errorf("the server at %s no longer supports this version of the client (%s); please upgrade it", hostURI, Version)
+	}
+	return fmt.Errorf("the server at %s needs version %s of the client or newer but this is version %s; please upgrade it", hostURI, resp.MinClientVersion, Version)
+}
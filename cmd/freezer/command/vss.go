@@ -0,0 +1,73 @@
+// Copyright 2017, Timothy Bogdala <tdb@animal-machine.com>
+// See the LICENSE file for more details.
+
+package command
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// shadowCopy is a read-only snapshot of a volume that files are read from
+// while syncing so that files which are open or locked are read as they were
+// at a single point in time.
+type shadowCopy struct {
+	// the ID used to delete the snapshot
+	id string
+
+	// the volume the snapshot was taken of, such as "C:"
+	volume string
+
+	// the device path the snapshot's files are found under, such as
+	// \\?\GLOBALROOT\Device\HarddiskVolumeShadowCopy1
+	device string
+}
+
+// beginSnapshot takes a shadow copy of the volume holding localDir if
+// UseSnapshot is set. The returned function deletes it again and must be
+// called once the sync is done.
+func (s *State) beginSnapshot(localDir string) (func(), error) {
+	if !s.UseSnapshot {
+		return func() {}, nil
+	}
+
+	absDir, err := filepath.Abs(localDir)
+	if err != nil {
+		return nil, fmt.Errorf("Failed to get the absolute path for %s: %v", localDir, err)
+	}
+	volume := filepath.VolumeName(absDir)
+	snapshot, err := createShadowCopy(volume)
+	if err != nil {
+		return nil, err
+	}
+	s.Printf("Reading files from a snapshot of %s\n", volume)
+	s.snapshot = snapshot
+	return func() {
+		s.snapshot = nil
+		err := deleteShadowCopy(snapshot)
+		if err != nil {
+			s.Printf("%v\n", err)
+		}
+	}, nil
+}
+
+// snapshotPath returns the path that the local file is read from while
+// syncing: the file in the current snapshot if there is one and it has the
+// file, otherwise the local file itself. Files are always written to their
+// local path.
+func (s *State) snapshotPath(localFilename string) string {
+	if s.snapshot == nil {
+		return localFilename
+	}
+	absFilename, err := filepath.Abs(localFilename)
+	if err != nil || !strings.EqualFold(filepath.VolumeName(absFilename), s.snapshot.volume) {
+		return localFilename
+	}
+	snapshotFilename := s.snapshot.device + absFilename[len(s.snapshot.volume):]
+	if _, err := os.Lstat(snapshotFilename); err != nil {
+		return localFilename
+	}
+	return snapshotFilename
+}
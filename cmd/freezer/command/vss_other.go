@@ -0,0 +1,24 @@
+// Copyright 2017, Timothy Bogdala <tdb@animal-machine.com>
+// See the LICENSE file for more details.
+
+//go:build !windows
+// +build !windows
+
+package command
+
+import (
+	"fmt"
+	"runtime"
+)
+
+// createShadowCopy takes a snapshot of the volume, which is only supported
+// by the Volume Shadow Copy Service on Windows.
+func createShadowCopy(volume string) (*shadowCopy, error) {
+	return nil, fmt.Errorf("Reading files from a snapshot isn't supported on %s", runtime.GOOS)
+}
+
+// deleteShadowCopy removes the snapshot, which can't have been taken on
+// this platform.
+func deleteShadowCopy(snapshot *shadowCopy) error {
+	return nil
+}
@@ -0,0 +1,38 @@
+// Copyright 2017, Timothy Bogdala <tdb@animal-machine.com>
+// See the LICENSE file for more details.
+
+package command
+
+import (
+	"fmt"
+	"os/exec"
+	"strings"
+)
+
+// createShadowCopy asks the Volume Shadow Copy Service, through WMI, for a
+// snapshot of the volume. This needs the process to run as an administrator.
+func createShadowCopy(volume string) (*shadowCopy, error) {
+	script := fmt.Sprintf("$r = Invoke-CimMethod -ClassName Win32_ShadowCopy -MethodName Create -Arguments @{Volume='%s\\'; Context='ClientAccessible'}; "+
+		"if ($r.ReturnValue -ne 0) { Write-Output $r.ReturnValue; exit 1 }; "+
+		"Get-CimInstance -ClassName Win32_ShadowCopy | Where-Object { $_.ID -eq $r.ShadowID } | ForEach-Object { $_.ID; $_.DeviceObject }", volume)
+	output, err := exec.Command("powershell", "-NoProfile", "-Command", script).Output()
+	if err != nil {
+		return nil, fmt.Errorf("Failed to create a shadow copy of %s; it needs to run as an administrator (%s): %v", volume, strings.TrimSpace(string(output)), err)
+	}
+	fields := strings.Fields(string(output))
+	if len(fields) < 2 {
+		return nil, fmt.Errorf("Failed to find the shadow copy created of %s", volume)
+	}
+	return &shadowCopy{id: fields[0], volume: volume, device: fields[1]}, nil
+}
+
+// deleteShadowCopy removes the snapshot so that it doesn't keep using space
+// on the volume.
+func deleteShadowCopy(snapshot *shadowCopy) error {
+	script := fmt.Sprintf("Get-CimInstance -ClassName Win32_ShadowCopy | Where-Object { $_.ID -eq '%s' } | Remove-CimInstance", snapshot.id)
+	err := exec.Command("powershell", "-NoProfile", "-Command", script).Run()
+	if err != nil {
+		return fmt.Errorf("Failed to delete the shadow copy %s of %s: %v", snapshot.id, snapshot.volume, err)
+	}
+	return nil
+}
@@ -0,0 +1,183 @@
+// Copyright 2017, Timothy Bogdala <tdb@animal-machine.com>
+// See the LICENSE file for more details.
+
+// Package freezertest runs filefreezer servers with in-memory storage for
+// integration tests of code using the client in the command package.
+//
+// A typical test looks like:
+//
+//	srv := freezertest.NewServer(t)
+//	defer srv.Close()
+//	client := srv.NewUser(t, "alice", "secret", "crypto secret")
+//	status, _, err := client.SyncFile(localPath, "docs/a.txt", command.SyncCurrentVersion)
+package freezertest
+
+import (
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"sync/atomic"
+	"testing"
+
+	"github.com/marcoziti/gringotts"
+	"github.com/marcoziti/gringotts/cmd/freezer/command"
+	"github.com/marcoziti/gringotts/cmd/freezer/server"
+)
+
+const (
+	// DefaultChunkSize is the chunk size used by servers from NewServer, which
+	// is kept small so that tests can cover multi-chunk files cheaply.
+	DefaultChunkSize = 64 * 1024
+
+	// DefaultQuota is the quota given to users created with NewUser.
+	DefaultQuota = 1 << 30
+
+	// memoryURL is the base URL of servers that are only reachable in memory.
+	memoryURL = "http://freezertest.invalid"
+)
+
+// serverCount makes the in-memory database of each server unique.
+var serverCount int64
+
+// Server is a filefreezer server with an in-memory database and a temporary
+// directory for the local files of the test. It either listens on a local
+// port or, when created by NewMemoryServer, is only reachable through Transport.
+type Server struct {
+	// URL is the base URL of the server, such as http://127.0.0.1:1234
+	URL string
+
+	// Transport is set for servers without a listener and is used by the
+	// clients from NewClient to reach the server in memory.
+	Transport http.RoundTripper
+
+	// Dir is a temporary directory removed by Close that tests can use
+	// for the local files they sync.
+	Dir string
+
+	// Server is the filefreezer server being served; its Storage can be
+	// used to inspect or change the data directly.
+	*server.Server
+
+	httpServer *httptest.Server
+}
+
+// NewServer starts a server with the default configuration, failing the test
+// if it can't be started. Close should be deferred by the caller.
+func NewServer(t testing.TB) *Server {
+	return NewServerWithConfig(t, server.Config{
+		ChunkSize:    DefaultChunkSize,
+		PublicShares: true,
+	})
+}
+
+// NewServerWithConfig starts a server with the configuration supplied, failing
+// the test if it can't be started. The DatabasePath is replaced with a new
+// in-memory database and a zero ChunkSize is replaced with DefaultChunkSize.
+func NewServerWithConfig(t testing.TB, config server.Config) *Server {
+	s := newServer(t, config)
+	s.httpServer = httptest.NewServer(s.Handler())
+	s.URL = s.httpServer.URL
+	return s
+}
+
+// NewMemoryServer creates a server with the default configuration that doesn't
+// listen on any port. Clients from NewClient send their requests through a
+// HandlerTransport instead, so no sockets are used and each request is handled
+// in the goroutine that sent it.
+func NewMemoryServer(t testing.TB) *Server {
+	s := newServer(t, server.Config{
+		ChunkSize:    DefaultChunkSize,
+		PublicShares: true,
+	})
+	s.URL = memoryURL
+	s.Transport = &HandlerTransport{Handler: s.Handler()}
+	return s
+}
+
+// newServer creates the server and temporary directory for the test.
+func newServer(t testing.TB, config server.Config) *Server {
+	config.DatabasePath = fmt.Sprintf("file:freezertest%d?mode=memory&cache=shared", atomic.AddInt64(&serverCount, 1))
+	if config.ChunkSize == 0 {
+		config.ChunkSize = DefaultChunkSize
+	}
+	if config.Logf == nil {
+		config.Logf = t.Logf
+	}
+
+	dir, err := ioutil.TempDir("", "freezertest")
+	if err != nil {
+		t.Fatalf("Failed to create a temporary directory for the test server: %v", err)
+	}
+
+	srv, err := server.New(config)
+	if err != nil {
+		os.RemoveAll(dir)
+		t.Fatalf("Failed to create the test server: %v", err)
+	}
+
+	return &Server{
+		Dir:    dir,
+		Server: srv,
+	}
+}
+
+// Close shuts down the server, discards the database and removes Dir.
+func (s *Server) Close() {
+	if s.httpServer != nil {
+		s.httpServer.Close()
+	}
+	s.Server.Close()
+	os.RemoveAll(s.Dir)
+}
+
+// AddUser adds a user with DefaultQuota directly to the storage.
+func (s *Server) AddUser(username string, password string) (*filefreezer.User, error) {
+	state := command.NewState()
+	return state.AddUser(s.Storage, username, password, DefaultQuota)
+}
+
+// NewClient returns a client authenticated as an existing user with its crypto
+// key ready for use. If the user doesn't have a crypto password yet it gets set
+// to cryptoPassword.
+func (s *Server) NewClient(username string, password string, cryptoPassword string) (*command.State, error) {
+	state := command.NewState()
+	state.SetQuiet(true)
+	state.Transport = s.Transport
+
+	err := state.Authenticate(s.URL, username, password)
+	if err != nil {
+		return nil, err
+	}
+
+	if len(state.CryptoHash) == 0 {
+		err = state.SetCryptoHashForPassword(cryptoPassword)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	state.CryptoKey, err = filefreezer.VerifyCryptoPassword(cryptoPassword, string(state.CryptoHash))
+	if err != nil {
+		return nil, err
+	}
+
+	return state, nil
+}
+
+// NewUser adds a user and returns a client authenticated as them, failing
+// the test on any error.
+func (s *Server) NewUser(t testing.TB, username string, password string, cryptoPassword string) *command.State {
+	_, err := s.AddUser(username, password)
+	if err != nil {
+		t.Fatalf("Failed to add the test user %s: %v", username, err)
+	}
+
+	state, err := s.NewClient(username, password, cryptoPassword)
+	if err != nil {
+		t.Fatalf("Failed to create a client for the test user %s: %v", username, err)
+	}
+
+	return state
+}
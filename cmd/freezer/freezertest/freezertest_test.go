@@ -0,0 +1,71 @@
+// Copyright 2017, Timothy Bogdala <tdb@animal-machine.com>
+// See the LICENSE file for more details.
+
+package freezertest
+
+import (
+	"bytes"
+	"io/ioutil"
+	"path/filepath"
+	"testing"
+
+	"github.com/marcoziti/gringotts/cmd/freezer/command"
+)
+
+func TestServerRoundTrip(t *testing.T) {
+	srv := NewServer(t)
+	defer srv.Close()
+	testRoundTrip(t, srv)
+
+	// each server gets its own database
+	srv2 := NewServer(t)
+	defer srv2.Close()
+	_, err := srv2.Storage.GetUser("alice")
+	if err == nil {
+		t.Fatal("Expected a new server to have an empty database.")
+	}
+}
+
+func TestMemoryServerRoundTrip(t *testing.T) {
+	srv := NewMemoryServer(t)
+	defer srv.Close()
+	if srv.Transport == nil {
+		t.Fatal("Expected a memory server to supply a transport.")
+	}
+	testRoundTrip(t, srv)
+}
+
+// testRoundTrip uploads a file with one client and downloads it with another.
+func testRoundTrip(t *testing.T, srv *Server) {
+	client := srv.NewUser(t, "alice", "1234", "beavers_and_ducks")
+	if client.ServerCapabilities.ChunkSize != DefaultChunkSize {
+		t.Fatalf("Expected the chunk size %d from the server but got %d.", DefaultChunkSize, client.ServerCapabilities.ChunkSize)
+	}
+
+	// upload a file that spans a few chunks
+	data := bytes.Repeat([]byte("filefreezer"), DefaultChunkSize/4)
+	localPath := filepath.Join(srv.Dir, "upload.dat")
+	err := ioutil.WriteFile(localPath, data, 0644)
+	if err != nil {
+		t.Fatalf("Failed to write the test file: %v", err)
+	}
+	status, _, err := client.SyncFile(localPath, "docs/upload.dat", command.SyncCurrentVersion)
+	if err != nil || status != command.SyncStatusLocalNewer {
+		t.Fatalf("Failed to upload the test file (status %d): %v", status, err)
+	}
+
+	// a second client for the same user should be able to decrypt it
+	other, err := srv.NewClient("alice", "1234", "beavers_and_ducks")
+	if err != nil {
+		t.Fatalf("Failed to create a second client: %v", err)
+	}
+	downloadPath := filepath.Join(srv.Dir, "download.dat")
+	status, _, err = other.SyncFile(downloadPath, "docs/upload.dat", command.SyncCurrentVersion)
+	if err != nil || status != command.SyncStatusRemoteNewer {
+		t.Fatalf("Failed to download the test file (status %d): %v", status, err)
+	}
+	downloaded, err := ioutil.ReadFile(downloadPath)
+	if err != nil || !bytes.Equal(downloaded, data) {
+		t.Fatalf("The downloaded file didn't match the uploaded one (%v).", err)
+	}
+}
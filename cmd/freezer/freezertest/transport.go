@@ -0,0 +1,40 @@
+// Copyright 2017, Timothy Bogdala <tdb@animal-machine.com>
+// See the LICENSE file for more details.
+
+package freezertest
+
+import (
+	"net/http"
+	"net/http/httptest"
+)
+
+// HandlerTransport is an http.RoundTripper that serves each request with
+// Handler in memory instead of over a network connection. Requests are
+// handled one at a time in the calling goroutine, which keeps tests of the
+// client deterministic. Setting it as the Transport of a command.State sends
+// all of the client's requests to the handler.
+type HandlerTransport struct {
+	Handler http.Handler
+}
+
+// RoundTrip serves the request with the Handler and returns the recorded response.
+func (t *HandlerTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	// the handler gets a copy with the fields a server would fill in
+	serverReq := new(http.Request)
+	*serverReq = *req
+	serverReq.RemoteAddr = "127.0.0.1:1"
+	serverReq.RequestURI = req.URL.RequestURI()
+	if serverReq.Body == nil {
+		serverReq.Body = http.NoBody
+	}
+	if serverReq.ContentLength == 0 && serverReq.Body != http.NoBody {
+		serverReq.ContentLength = -1
+	}
+
+	recorder := httptest.NewRecorder()
+	t.Handler.ServeHTTP(recorder, serverReq)
+
+	resp := recorder.Result()
+	resp.Request = req
+	return resp, nil
+}
@@ -7,17 +7,26 @@ import (
 	"bufio"
 	"bytes"
 	"fmt"
+	"io/ioutil"
 	"math/rand"
+	"net/http"
 	"os"
+	"path/filepath"
+	"runtime"
+	"runtime/debug"
 	"runtime/pprof"
 	"strconv"
+	"text/tabwriter"
 	"time"
 
 	"github.com/marcoziti/gringotts"
 	"github.com/marcoziti/gringotts/cmd/freezer/command"
+	"github.com/marcoziti/gringotts/cmd/freezer/models"
+	"github.com/marcoziti/gringotts/cmd/freezer/server"
 
 	"strings"
 
+	"golang.org/x/crypto/ssh"
 	kingpin "gopkg.in/alecthomas/kingpin.v2"
 )
 
@@ -28,17 +37,80 @@ var (
 	flagTLSKey       = appFlags.Flag("tlskey", "The HTTPS TLS private key file to be used by the server.").String()
 	flagTLSCrt       = appFlags.Flag("tlscert", "The HTTPS TLS public crt file to be used by the server.").String()
 	flagExtraStrict  = appFlags.Flag("xs", "File checking should be extra strict on file sync comparisons.").Default("true").Bool()
+	flagVSS          = appFlags.Flag("vss", "Read the files synced by syncdir from a Volume Shadow Copy snapshot so open and locked files can be backed up; Windows only.").Bool()
 	flagUserName     = appFlags.Flag("user", "The username for user.").Short('u').String()
 	flagUserPass     = appFlags.Flag("pass", "The password for user.").Short('p').String()
 	flagCryptoPass   = appFlags.Flag("crypt", "The passwod used for cryptography.").Short('s').String()
 	flagHost         = appFlags.Flag("host", "The host URL for the server to contact.").Short('h').String()
 	flagCPUProfile   = appFlags.Flag("cpuprofile", "Turns on cpu profiling and stores the result in the file specified by this flag.").String()
 	flagQuiet        = appFlags.Flag("quiet", "Turns off non-fatal error console output for the command.").Bool()
+	flagVerbose      = appFlags.Flag("verbose", "Logs the requests made to the server to stderr; -vv adds retries and other decisions and -vvv the headers, without credentials or file data.").Short('v').Counter()
+	flagScanner      = appFlags.Flag("scanner", "A command, such as 'clamscan --no-summary', run on each downloaded file before it's moved into place.").String()
+	flagQuarantine   = appFlags.Flag("quarantine", "The directory that downloaded files failing the scanner are moved into.").Default(filepath.Join(os.TempDir(), "freezer-quarantine")).String()
+	flagMetered      = appFlags.Flag("metered", "Whether the connection is metered: 'auto' asks the OS, 'yes' or 'no' override it.").Default(command.MeteredAuto).Enum(command.MeteredAuto, command.MeteredYes, command.MeteredNo)
+	flagPriority     = appFlags.Flag("priority", "The order syncdir syncs files in: 'name' follows the directories, 'small' goes smallest first and 'recent' goes most recently modified first.").Default(command.SyncPriorityName).Enum(command.SyncPriorityName, command.SyncPrioritySmall, command.SyncPriorityRecent)
+	flagBWLimit      = appFlags.Flag("bwlimit", "The bytes per second to limit transfers to, such as 1M; 0 is unlimited.").Default("0").String()
+	flagBWSchedule   = appFlags.Flag("bwschedule", "A time of day window with its own limit as HH:MM-HH:MM=limit, such as 01:00-07:00=0; can be repeated.").Strings()
+	flagTransfers    = appFlags.Flag("transfers", "The most chunks to transfer at once; fewer are used if the server or link slows down.").Default("4").Int()
+	flagDeferSize    = appFlags.Flag("defersize", "Uploads of files larger than this many bytes wait for an unmetered connection or AC power; 0 never waits.").Default("104857600").Int64()
+	flagPower        = appFlags.Flag("power", "Whether the computer is on battery: 'auto' asks the OS, 'battery' or 'ac' override it.").Default(command.PowerAuto).Enum(command.PowerAuto, command.PowerBattery, command.PowerAC)
+	flagBattery      = appFlags.Flag("battery", "Large uploads wait for AC power while on battery with this charge, in percent, or less; 0 never waits.").Default("20").Int()
+	flagTransforms   = appFlags.Flag("transform", "Commands run on synced files matching a pattern as pattern=upload command|download command, such as '\\.csv$=gzip -n|gunzip'; can be repeated.").Strings()
+	flagPolicies     = appFlags.Flag("policies", "A JSON file of per-path sync policies setting the versions to keep and the transform for files matching a glob.").String()
+	flagExcludes     = appFlags.Flag("default-excludes", "Skip the caches, trash and other junk in the home directory when syncing it; a policy marked Include syncs them anyway.").Default("true").Bool()
+	flagDevice       = appFlags.Flag("device", "The name recorded with uploaded file versions; defaults to the host name.").String()
+	flagStrictLogin  = appFlags.Flag("strictlogin", "Never send the plaintext password to log in, even to servers or for accounts that predate derived login passwords.").Bool()
+	flagQueue        = appFlags.Flag("queue", "A file that file removals and renames are queued in when the server can't be reached; see the replay command.").String()
+	flagSpool        = appFlags.Flag("spool", "A directory that encrypted chunks are staged in while uploading; chunks that fail to upload stay there for the flush command.").String()
+	flagCPULimit     = appFlags.Flag("cpu-limit", "The most CPUs used at once for hashing, encrypting and other work; 0 uses all of them.").Default("0").Int()
+	flagLowPriority  = appFlags.Flag("low-priority", "Runs at a lower process priority, as do transforms, and uses one CPU unless --cpu-limit is set, so that background syncs don't slow down the computer.").Bool()
+	flagSyncState    = appFlags.Flag("syncstate", "A file recording the hash of each file when it's synced so that files changed both locally and on the server are kept as conflicted copies.").String()
 
 	// Server commands
-	cmdServe           = appFlags.Command("serve", "Adds a new user to the storage.")
-	argServeListenAddr = cmdServe.Arg("http", "The net address to listen to").Default(":8080").String()
-	flagServeChunkSize = cmdServe.Flag("cs", "The number of bytes contained in one chunk.").Default("4194304").Int64() // 4 MB
+	cmdServe                  = appFlags.Command("serve", "Adds a new user to the storage.")
+	argServeListenAddr        = cmdServe.Arg("http", "The net address to listen to").Default(":8080").String()
+	flagServeChunkSize        = cmdServe.Flag("cs", "The number of bytes contained in one chunk.").Default("4194304").Int64() // 4 MB
+	flagServeChunking         = cmdServe.Flag("chunking", "How clients split files into chunks: 'fixed' cuts every --cs bytes and 'fastcdc' cuts by content, averaging a quarter of --cs, so that edits only change the chunks around them.").Default(filefreezer.ChunkingFixed).Enum(filefreezer.ChunkingFixed, filefreezer.ChunkingFastCDC)
+	flagServeReportTo         = cmdServe.Flag("reportto", "An admin email address to send usage reports to; can be specified multiple times.").Strings()
+	flagServeReportInt        = cmdServe.Flag("reportinterval", "The time between usage report emails.").Default("168h").Duration()
+	flagServeReportFrm        = cmdServe.Flag("reportfrom", "The sender address for usage report emails.").Default("freezer@localhost").String()
+	flagServeSMTPAddr         = cmdServe.Flag("smtp", "The SMTP server (host:port) used to send usage report emails.").Default("localhost:25").String()
+	flagServeSMTPUser         = cmdServe.Flag("smtpuser", "The username used to authenticate with the SMTP server.").String()
+	flagServeSMTPPass         = cmdServe.Flag("smtppass", "The password used to authenticate with the SMTP server.").String()
+	flagServeFreezeCount      = cmdServe.Flag("freezecount", "The number of new file versions within the freeze window that will freeze pruning for an account (0 disables).").Default("1000").Int()
+	flagServeFreezeWindow     = cmdServe.Flag("freezewindow", "The length of the window used to count new file versions for freezing pruning.").Default("1h").Duration()
+	flagServePublic           = cmdServe.Flag("public", "Allow anonymous read-only access to shared files under /public/<username>/.").Bool()
+	flagServeNoPlainLogin     = cmdServe.Flag("noplainlogin", "Reject logins that send the plaintext password instead of one derived from it.").Bool()
+	flagServeMinClient        = cmdServe.Flag("minclient", "The oldest client version allowed to use the API, such as 0.2.0; older clients are told to upgrade.").String()
+	flagServeLatestClient     = cmdServe.Flag("latestclient", "The newest client version, which older clients tell their users is available.").String()
+	flagServeMaxTransfers     = cmdServe.Flag("maxtransfers", "The most chunk transfers and uploads in flight on the server at once (0 disables).").Default("64").Int()
+	flagServeMaxUserTransfers = cmdServe.Flag("maxusertransfers", "The most chunk transfers in flight at once for a single user (0 disables).").Default("16").Int()
+	flagServeDeletionGrace    = cmdServe.Flag("deletiongrace", "The time between users confirming the erasure of their account and the server erasing it.").Default("168h").Duration()
+	flagServeMaxVersions      = cmdServe.Flag("maxversions", "The number of versions of each file kept for users without their own limit; older versions are pruned (0 keeps all).").Default("0").Int()
+	flagServeMaxEgress        = cmdServe.Flag("maxegress", "The bytes users without their own limit can download each month, such as 50G; further downloads are refused until the next month.").String()
+	flagServeLowMemory        = cmdServe.Flag("lowmemory", "Runs with a smaller database cache, fewer transfers in flight and more frequent garbage collection for devices with little memory.").Bool()
+	flagServeFaultRate        = cmdServe.Flag("faultrate", "DEBUG: the fraction of chunk requests to delay, drop or fail for testing clients (0 disables).").Default("0").Float64()
+	flagServeFaultDelay       = cmdServe.Flag("faultdelay", "DEBUG: the longest time a chunk request is delayed by fault injection.").Default("1s").Duration()
+	flagServeFaultSeed        = cmdServe.Flag("faultseed", "DEBUG: the seed used to pick the chunk requests and faults to inject.").Default("1").Int64()
+	flagServeTraceEndpoint    = cmdServe.Flag("traceendpoint", "The host:port of an OTLP/HTTP collector, such as Jaeger on localhost:4318, to export spans of the requests and storage calls to.").String()
+	flagServeTraceInsecure    = cmdServe.Flag("traceinsecure", "Exports the spans over plain HTTP instead of HTTPS.").Bool()
+	flagServeTraceSample      = cmdServe.Flag("tracesample", "The fraction of requests that are traced (0 traces all of them).").Default("0").Float64()
+	flagServeSlowRequest      = cmdServe.Flag("slowrequest", "Logs the requests that take longer than this to handle, such as 500ms (0 disables).").Default("0").Duration()
+	flagServeSlowQuery        = cmdServe.Flag("slowquery", "Logs the database queries that take longer than this to run, such as 100ms (0 disables).").Default("0").Duration()
+	flagServeBackend          = cmdServe.Flag("backend", "The name of the storage backend that the --db data source is opened with.").Default(filefreezer.DefaultBackend).String()
+	flagServeChunkStores      = cmdServe.Flag("chunkstore", "The URL of a store to keep chunk data in instead of the database (file:///path, azure://account/container, gs://bucket or b2://bucket); repeat it to mirror the chunks.").Strings()
+	flagServeChunkStoreCheck  = cmdServe.Flag("chunkstorecheck", "How often mirrored chunk stores are checked for health.").Default("1m").Duration()
+	flagServeChunkKeys        = cmdServe.Flag("chunkkeys", "A file of 'id base64key' lines whose keys encrypt the chunk stores at rest; a store's ?key=id picks one, otherwise the last is used.").String()
+	flagServeReplSecret       = cmdServe.Flag("replicationsecret", "The secret shared by a primary server and its secondaries that signs replication requests; setting it serves the /replication routes.").String()
+	flagServeReplFrom         = cmdServe.Flag("replicatefrom", "The URL of a primary server to replicate the accounts of as a warm standby; needs --replicationsecret.").String()
+	flagServeReadOnly         = cmdServe.Flag("readonly", "Serves listings and downloads but refuses uploads and other changes, such as for a replica used to restore files while the primary is rebuilt.").Bool()
+	flagServeAdminToken       = cmdServe.Flag("admintoken", "The bearer token required by the /admin routes, such as /admin/snapshot; the routes are only served when it's set.").String()
+	flagServeSnapshotDir      = cmdServe.Flag("snapshotdir", "The directory that /admin/snapshot writes database snapshots and their chunk manifests to.").String()
+	flagServeReplInterval     = cmdServe.Flag("replicationinterval", "How often a secondary pulls the changes from its primary.").Default("1m").Duration()
+	flagServeQuotaWarn        = cmdServe.Flag("quotawarn", "A percentage of their quota at which users are warned; repeat it for more thresholds.").Default("80", "95").Ints()
+	flagServeQuotaWebhook     = cmdServe.Flag("quotawebhook", "A URL that a JSON warning is posted to when a user crosses a quota warning threshold.").String()
+	flagServeRechunkInterval  = cmdServe.Flag("rechunkinterval", "How often a shared file whose chunks don't match --cs is rechunked, such as after the chunk size was changed (0 disables).").Default("0").Duration()
+	flagServeUsageInterval    = cmdServe.Flag("usageinterval", "How often the files, versions and bytes of the users that changed anything are recounted for the stats they're shown.").Default("1m").Duration()
 
 	// User sub-commands
 	cmdUser = appFlags.Command("user", "User management command.")
@@ -52,21 +124,101 @@ var (
 	flagUserModQuota = cmdUserMod.Flag("quota", "New quota size in bytes.").Int()
 	flagUserModName  = cmdUserMod.Flag("name", "New username for the user being modified.").String()
 	flagUserModPass  = cmdUserMod.Flag("password", "New quota size in bytes.").String()
+	flagUserModMaxV  = cmdUserMod.Flag("maxversions", "The number of versions of each file kept for the user (0 uses the server's setting).").Default("-1").Int()
+	flagUserModMaxE  = cmdUserMod.Flag("maxegress", "The bytes the user can download each month, such as 50G (0 uses the server's setting).").String()
 
 	cmdUserStats = cmdUser.Command("stats", "Displays the quota, allocation and revision counts for the user.")
 
+	cmdUserBandwidth      = cmdUser.Command("bandwidth", "Displays the requests and bytes uploaded and downloaded by the user for each day.")
+	flagUserBandwidthDays = cmdUserBandwidth.Flag("days", "The number of days to display, including today.").Default("30").Int()
+
+	cmdUserUnfreeze = cmdUser.Command("unfreeze", "Lifts a freeze on file and version removal for the user.")
+
+	cmdUserSupport          = cmdUser.Command("support", "Makes a support token for reading the user's metadata on the server.")
+	flagUserSupportDuration = cmdUserSupport.Flag("duration", "How long the support token lasts.").Default("1h").Duration()
+	flagUserSupportReason   = cmdUserSupport.Flag("reason", "Why the support token is needed, which the user can see.").String()
+	flagUserSupportBreak    = cmdUserSupport.Flag("breakglass", "Makes the token without the user's consent; a reason is required.").Bool()
+
 	cmdUserCryptoPass    = cmdUser.Command("cryptopass", "Sets the cryptography password for the client.")
 	flagUserCryptoPassPW = cmdUserCryptoPass.Arg("pasword", "New cryptography password.").String()
 
+	// Storage check command
+	cmdFsck             = appFlags.Command("fsck", "Checks the file metadata in the storage against the chunks and their data, optionally repairing the problems found.")
+	flagFsckRepair      = cmdFsck.Flag("repair", "Repairs the problems found; chunks with missing or corrupt data are removed so that clients upload them again.").Bool()
+	flagFsckQuick       = cmdFsck.Flag("quick", "Only checks the metadata without reading the data of every chunk.").Bool()
+	flagFsckChunkStores = cmdFsck.Flag("chunkstore", "The URL of a store the server keeps chunk data in; repeat it for mirrored stores.").Strings()
+	flagFsckChunkKeys   = cmdFsck.Flag("chunkkeys", "A file of 'id base64key' lines whose keys encrypt the chunk stores at rest.").String()
+
 	// File sub-commands
 	cmdFile = appFlags.Command("file", "Basic file management command.")
 
-	cmdFileList = cmdFile.Command("ls", "Lists all files for a user in storage.")
-
-	cmdFileRm        = cmdFile.Command("rm", "Remove a file from storage.")
-	argFileRmPath    = cmdFileRm.Arg("filename", "The file to remove on the server.").Required().String()
-	flagFileRmRegex  = cmdFileRm.Flag("regex", "Indicates the filename is a regular expression filter to match files to remove on the server.").Bool()
-	flagFileRmDryRun = cmdFileRm.Flag("dryrun", "Whether or not the file(s) should actually be removed on match.").Bool()
+	cmdFileList         = cmdFile.Command("ls", "Lists all files for a user in storage.")
+	flagFileListSince   = cmdFileList.Flag("since", "Only list files modified since a date (2017-06-30), a date and time (2017-06-30 18:00) or a duration ago (36h).").String()
+	flagFileListMinSize = cmdFileList.Flag("minsize", "Only list files with at least this many bytes stored for their current version, such as 10M.").String()
+	flagFileListSort    = cmdFileList.Flag("sort", "The column to sort by: name, size, versions or modified.").Default(command.SortByName).Enum(command.SortByName, command.SortBySize, command.SortByVersions, command.SortByModified)
+	flagFileListReverse = cmdFileList.Flag("reverse", "Reverse the order of the sort.").Bool()
+	flagFileListLong    = cmdFileList.Flag("long", "Use a long listing format with file ids, permissions and the size of all versions.").Short('l').Bool()
+
+	cmdFileRm         = cmdFile.Command("rm", "Remove a file from storage.")
+	argFileRmPath     = cmdFileRm.Arg("filename", "The file to remove on the server.").Required().String()
+	flagFileRmRegex   = cmdFileRm.Flag("regex", "Indicates the filename is a regular expression filter to match files to remove on the server.").Bool()
+	flagFileRmDryRun  = cmdFileRm.Flag("dryrun", "Whether or not the file(s) should actually be removed on match.").Bool()
+	flagFileRmNoCase  = cmdFileRm.Flag("ignorecase", "Match the regular expression regardless of case.").Bool()
+	flagFileRmAnchor  = cmdFileRm.Flag("anchor", "The regular expression has to match the whole file path.").Bool()
+	flagFileRmInvert  = cmdFileRm.Flag("invert", "Remove the files that don't match the regular expression.").Bool()
+	flagFileRmIgnored = cmdFileRm.Flag("ignored", "Remove the files under the path on the server that the .freezerignore files in this local directory ignore, such as build artifacts uploaded before they were ignored.").String()
+
+	cmdMvRx         = appFlags.Command("mvrx", "Renames the files on the server matching a regular expression.")
+	argMvRxPattern  = cmdMvRx.Arg("pattern", "The regular expression to match against the file names on the server.").Required().String()
+	argMvRxReplace  = cmdMvRx.Arg("replacement", "The replacement for the matched text, which can use capture groups such as $1.").Required().String()
+	flagMvRxDryRun  = cmdMvRx.Flag("dryrun", "Only show the renames without making them.").Bool()
+	flagMvRxConfirm = cmdMvRx.Flag("yes", "Rename the files without asking for confirmation.").Bool()
+	flagMvRxNoCase  = cmdMvRx.Flag("ignorecase", "Match the regular expression regardless of case.").Bool()
+	flagMvRxAnchor  = cmdMvRx.Flag("anchor", "The regular expression has to match the whole file path.").Bool()
+
+	cmdDu       = appFlags.Command("du", "Shows the bytes stored on the server for the files under a path.")
+	argDuTarget = cmdDu.Arg("target", "The directory path on the server to total up; all files if it's omitted.").String()
+
+	cmdTree       = appFlags.Command("tree", "Shows the files on the server as a tree with the size of each directory.")
+	argTreePrefix = cmdTree.Arg("prefix", "The directory path on the server to show; all files if it's omitted.").String()
+
+	cmdManifest        = appFlags.Command("manifest", "Writes a SHA256SUMS manifest of the current versions of the files under a path on the server.")
+	argManifestPrefix  = cmdManifest.Arg("prefix", "The directory path on the server to checksum; all files if it's omitted.").String()
+	flagManifestOutput = cmdManifest.Flag("output", "The file to write the manifest to instead of stdout.").String()
+	flagManifestVerify = cmdManifest.Flag("verify", "A local directory to check against the manifest instead of writing it.").String()
+
+	cmdDupes = appFlags.Command("dupes", "Lists the files on the server that have the same content.")
+
+	cmdRechunk       = appFlags.Command("rechunk", "Re-uploads the files on the server whose chunks don't match the server's chunk size, such as after it was changed, as new versions in the new size.")
+	flagRechunkPause = cmdRechunk.Flag("pause", "The time to wait between files to keep the load on the server down.").Default("0s").Duration()
+
+	cmdChunks        = appFlags.Command("chunks", "Lists the chunks stored for a version of a file with their hashes and sizes.")
+	argChunksTarget  = cmdChunks.Arg("target", "The file path on the server, optionally followed by @ and a version number; the current version if it's omitted.").Required().String()
+	flagChunksVerify = cmdChunks.Flag("verify", "A local file to compare with the chunks of the version.").String()
+
+	cmdEstimate       = appFlags.Command("estimate", "Shows how many chunks and bytes a sync of a path would transfer without transferring any file data.")
+	argEstimatePath   = cmdEstimate.Arg("filepath", "The local file or directory to estimate a sync of.").Required().String()
+	argEstimateTarget = cmdEstimate.Arg("target", "The path on the server to sync with; defaults to the same as the filepath arg.").Default("").String()
+	flagEstimateFiles = cmdEstimate.Flag("files", "Also list the files that would change.").Bool()
+
+	cmdPatch       = appFlags.Command("patch", "Uploads a new version of a file that only sends the chunks changed since its current version.")
+	argPatchFile   = cmdPatch.Arg("filepath", "The local file to upload.").Required().String()
+	argPatchTarget = cmdPatch.Arg("target", "The file path on the server to patch; defaults to the same as the filepath arg.").Default("").String()
+
+	cmdTrainDict       = appFlags.Command("train-dict", "Trains a zstd dictionary on the small files of a directory and stores it on the server for transforms to use with {dict}.")
+	argTrainDictPath   = cmdTrainDict.Arg("dirpath", "The local directory with the files to train the dictionary on.").Required().String()
+	argTrainDictTarget = cmdTrainDict.Arg("target", "The directory on the server the dictionary is for; defaults to the same as the dirpath arg.").Default("").String()
+	flagTrainDictSize  = cmdTrainDict.Flag("maxsize", "The largest file in bytes that the dictionary is trained on.").Default("65536").Int64()
+
+	cmdLock     = appFlags.Command("lock", "Takes or renews an advisory lock on a file so that the user's other devices don't upload conflicting versions of it.")
+	argLockFile = cmdLock.Arg("file", "The file path on the server to lock.").Required().String()
+	flagLockTTL = cmdLock.Flag("ttl", "How long the lock is held before it expires.").Default("10m").Duration()
+
+	cmdUnlock       = appFlags.Command("unlock", "Releases the advisory lock on a file.")
+	argUnlockFile   = cmdUnlock.Arg("file", "The file path on the server to unlock.").Required().String()
+	flagUnlockForce = cmdUnlock.Flag("force", "Release the lock even if another device holds it.").Bool()
+
+	cmdLocks = appFlags.Command("locks", "Lists the advisory locks on the user's files.")
 
 	// Version sub-commands
 	cmdVersions = appFlags.Command("versions", "Version management command.")
@@ -80,16 +232,173 @@ var (
 	argVersionsRmTarget  = cmdVersionsRm.Arg("target", "The file to remove on the server.").Required().String()
 	flagVersionsRmRegex  = cmdVersionsRm.Flag("regex", "Indicates the filename is a regular expression filter to match files to remove versions on the server.").Bool()
 	flagVersionsRmDryRun = cmdVersionsRm.Flag("dryrun", "Whether or not the versions should actually be removed on match.").Bool()
+	flagVersionsRmNoCase = cmdVersionsRm.Flag("ignorecase", "Match the regular expression regardless of case.").Bool()
+	flagVersionsRmAnchor = cmdVersionsRm.Flag("anchor", "The regular expression has to match the whole file path.").Bool()
+	flagVersionsRmInvert = cmdVersionsRm.Flag("invert", "Remove versions from the files that don't match the regular expression.").Bool()
 
 	// Sync commands
 	cmdSync         = appFlags.Command("sync", "Synchronizes a path with the server.")
 	flagSyncVersion = cmdSync.Flag("version", "Specifies a version number to sync instead of the current version").Int()
+	flagSyncMeta    = cmdSync.Flag("metadata-only", "Lists the files that a sync would change without transferring any file data; exits with an error if there are any.").Bool()
 	argSyncPath     = cmdSync.Arg("filepath", "The file to sync with the server.").Required().String()
 	argSyncTarget   = cmdSync.Arg("target", "The file path to sync to on the server; defaults to the same as the filename arg.").Default("").String()
 
 	cmdSyncDir       = appFlags.Command("syncdir", "Synchronizes a directory with the server.")
 	argSyncDirPath   = cmdSyncDir.Arg("dirpath", "The directory to sync with the server.").Required().String()
 	argSyncDirTarget = cmdSyncDir.Arg("target", "The directory path to sync to on the server; defaults to the same as the filename arg.").Default("").String()
+
+	cmdSyncDirBoth       = appFlags.Command("sync-dir", "Synchronizes a directory with the server in both directions, removing the files removed on either side since the last sync; uses --syncstate or ~/.freezer-syncstate.json.")
+	argSyncDirBothPath   = cmdSyncDirBoth.Arg("dirpath", "The directory to sync with the server.").Required().String()
+	argSyncDirBothTarget = cmdSyncDirBoth.Arg("target", "The directory path to sync with on the server; defaults to the same as the dirpath arg.").Default("").String()
+
+	cmdGetDir       = appFlags.Command("getdir", "Restores a directory from the server, resuming an interrupted restore into the same local directory.")
+	argGetDirRemote = cmdGetDir.Arg("remotedir", "The directory on the server to restore.").Required().String()
+	argGetDirLocal  = cmdGetDir.Arg("localdir", "The local directory to restore into; defaults to the same path as the remotedir arg.").Default("").String()
+
+	cmdPrune        = appFlags.Command("prune", "Removes the versions of files older than the ones kept by their --policies.")
+	flagPruneDryRun = cmdPrune.Flag("dryrun", "Lists the versions that would be removed without removing them.").Bool()
+
+	cmdTime = appFlags.Command("time", "Shows the server's clock and how far it is from this device's clock.")
+
+	cmdReplay       = appFlags.Command("replay", "Applies the file removals and renames queued in the --queue file while the server couldn't be reached.")
+	flagReplayList  = cmdReplay.Flag("list", "Lists the queued operations instead of applying them.").Bool()
+	flagReplayForce = cmdReplay.Flag("force", "Apply operations even if the files they change got new versions after they were queued.").Bool()
+
+	cmdFlush      = appFlags.Command("flush", "Uploads the chunks left in the --spool directory by uploads that failed.")
+	flagFlushList = cmdFlush.Flag("list", "Lists the spooled chunks instead of uploading them.").Bool()
+
+	cmdSelfUpdate       = appFlags.Command("selfupdate", "Replaces this program with the newest signed release from a release endpoint.")
+	flagSelfUpdateURL   = cmdSelfUpdate.Flag("url", "The release endpoint that describes the newest release.").Required().String()
+	flagSelfUpdateKey   = cmdSelfUpdate.Flag("key", "A PEM file with the public key releases are signed with; defaults to the key built into this program.").String()
+	flagSelfUpdateCheck = cmdSelfUpdate.Flag("check", "Only check whether a newer release is available.").Bool()
+
+	// Export commands
+	cmdExportHistory       = appFlags.Command("export-history", "Downloads every stored version of a file into timestamped local files.")
+	argExportHistoryTarget = cmdExportHistory.Arg("target", "The file path on the server to export the versions of.").Required().String()
+	argExportHistoryDir    = cmdExportHistory.Arg("dir", "The local directory to write the exported versions to.").Required().String()
+
+	// Agent commands
+	cmdAgent          = appFlags.Command("agent", "Runs unattended, syncing directories on a schedule and serving its status over HTTP.")
+	flagAgentInterval = cmdAgent.Flag("interval", "The time between the start of each sync of the directories.").Default("1h").Duration()
+	flagAgentStatus   = cmdAgent.Flag("status", "The net address to serve /status, /healthz and the pause, resume and sync controls on; empty disables it.").Default(":8090").String()
+	flagAgentNotify   = cmdAgent.Flag("notify", "Show desktop notifications for finished syncs, conflicts, failures and quota warnings.").Bool()
+	argAgentPaths     = cmdAgent.Arg("paths", "The directories to sync as 'localdir:remotedir' or just 'localdir' to use the same path on the server.").Required().Strings()
+
+	// Agent control commands
+	cmdStatus       = appFlags.Command("status", "Reports the status of a running agent.")
+	flagStatusAddr  = cmdStatus.Flag("agent", "The net address the agent serves its status on.").Default("localhost:8090").String()
+	cmdPause        = appFlags.Command("pause", "Pauses the scheduled syncs of a running agent.")
+	flagPauseAddr   = cmdPause.Flag("agent", "The net address the agent serves its status on.").Default("localhost:8090").String()
+	cmdResume       = appFlags.Command("resume", "Resumes the scheduled syncs of a paused agent.")
+	flagResumeAddr  = cmdResume.Flag("agent", "The net address the agent serves its status on.").Default("localhost:8090").String()
+	cmdSyncNow      = appFlags.Command("sync-now", "Makes a running agent sync right away, even if it's paused.")
+	flagSyncNowAddr = cmdSyncNow.Flag("agent", "The net address the agent serves its status on.").Default("localhost:8090").String()
+	cmdTray         = appFlags.Command("tray", "Shows a running agent's status and controls in the system tray; needs a build with the tray tag.")
+	flagTrayAddr    = cmdTray.Flag("agent", "The net address the agent serves its status on.").Default("localhost:8090").String()
+
+	// Support commands
+	cmdDebugBundle       = appFlags.Command("debug-bundle", "Collects the version, settings with secrets redacted, logs and a connection test into a tarball to attach to bug reports.")
+	flagDebugBundleOut   = cmdDebugBundle.Flag("output", "The file to write the tarball to; defaults to freezer-debug-<time>.tar.gz.").String()
+	flagDebugBundleLogs  = cmdDebugBundle.Flag("log", "A log file, such as the agent's output, whose last megabyte is included; can be repeated.").Strings()
+	flagDebugBundleAgent = cmdDebugBundle.Flag("agent", "The net address of a running agent whose status is included; empty skips it.").Default("localhost:8090").String()
+
+	// Load testing commands
+	cmdBench          = appFlags.Command("bench", "Simulates many clients uploading and downloading synthetic files to measure server capacity.")
+	flagBenchClients  = cmdBench.Flag("clients", "The number of clients to simulate at once.").Default("8").Int()
+	flagBenchFiles    = cmdBench.Flag("files", "The number of files each client uploads and downloads.").Default("4").Int()
+	flagBenchFileSize = cmdBench.Flag("filesize", "The size in bytes of each synthetic file.").Default("10485760").Int64()
+
+	// Bridge commands
+	cmdBridge               = appFlags.Command("bridge", "Exposes the user's files through other protocols.")
+	cmdBridgeHTTP           = cmdBridge.Command("http", "Serves the user's files as a plain HTTP directory index that rclone's http backend can read.")
+	argBridgeHTTPListenAddr = cmdBridgeHTTP.Arg("http", "The net address to listen to, on the loopback interface unless a host is given; anyone who can reach it has access to the user's files.").Default("localhost:8081").String()
+
+	cmdBridgeSFTP           = cmdBridge.Command("sftp", "Serves the user's files over SFTP; clients log in with the same username and password.")
+	flagBridgeSFTPHostKey   = cmdBridgeSFTP.Flag("hostkey", "The PEM encoded private key file to use as the SSH host key.").Required().String()
+	argBridgeSFTPListenAddr = cmdBridgeSFTP.Arg("addr", "The net address to listen to.").Default("localhost:2022").String()
+
+	cmdBridgeRestic           = cmdBridge.Command("restic", "Serves a restic repository using the REST backend protocol.")
+	flagBridgeResticPrefix    = cmdBridgeRestic.Flag("prefix", "The directory path on the server to store the repository in.").Default("restic").String()
+	argBridgeResticListenAddr = cmdBridgeRestic.Arg("http", "The net address to listen to, on the loopback interface unless a host is given; anyone who can reach it has access to the repository.").Default("localhost:8000").String()
+
+	// git-lfs commands
+	cmdLFSTransfer        = appFlags.Command("lfs-transfer", "Acts as a git-lfs custom transfer agent storing objects on the server.")
+	flagLFSTransferPrefix = cmdLFSTransfer.Flag("prefix", "The directory path on the server to store the git-lfs objects in.").Default("lfs").String()
+
+	// Docker commands
+	cmdDocker              = appFlags.Command("docker", "Backs up and restores Docker named volumes.")
+	flagDockerPrefix       = cmdDocker.Flag("prefix", "The directory path on the server to store the volume archives in.").Default("docker").String()
+	cmdDockerBackup        = cmdDocker.Command("backup", "Archives a Docker named volume and uploads it as a dated file.")
+	argDockerBackupVolume  = cmdDockerBackup.Arg("volume", "The name of the Docker volume to back up.").Required().String()
+	cmdDockerRestore       = cmdDocker.Command("restore", "Downloads a volume archive and extracts it into a Docker named volume.")
+	argDockerRestoreVolume = cmdDockerRestore.Arg("volume", "The name of the Docker volume to restore into.").Required().String()
+	argDockerRestoreTarget = cmdDockerRestore.Arg("archive", "The archive file path on the server; defaults to the latest archive for the volume.").Default("").String()
+
+	// Database commands
+	cmdPGDump          = appFlags.Command("pgdump", "Streams a pg_dump of a PostgreSQL database to the server.")
+	flagPGDumpDB       = cmdPGDump.Flag("db", "The name of the database to dump.").Required().String()
+	flagPGDumpArgs     = cmdPGDump.Flag("arg", "An extra argument to pass to pg_dump; can be specified multiple times.").Strings()
+	argPGDumpTarget    = cmdPGDump.Arg("target", "The file path on the server to store the dump as.").Required().String()
+	cmdPGRestore       = appFlags.Command("pgrestore", "Streams a dump from the server into psql to restore a PostgreSQL database.")
+	flagPGRestoreDB    = cmdPGRestore.Flag("db", "The name of the database to restore into.").Required().String()
+	flagPGRestoreArgs  = cmdPGRestore.Flag("arg", "An extra argument to pass to psql; can be specified multiple times.").Strings()
+	argPGRestoreTarget = cmdPGRestore.Arg("target", "The file path of the dump on the server.").Required().String()
+
+	cmdMySQLDump          = appFlags.Command("mysqldump", "Streams a mysqldump of a MySQL database to the server.")
+	flagMySQLDumpDB       = cmdMySQLDump.Flag("db", "The name of the database to dump.").Required().String()
+	flagMySQLDumpArgs     = cmdMySQLDump.Flag("arg", "An extra argument to pass to mysqldump; can be specified multiple times.").Strings()
+	argMySQLDumpTarget    = cmdMySQLDump.Arg("target", "The file path on the server to store the dump as.").Required().String()
+	cmdMySQLRestore       = appFlags.Command("mysqlrestore", "Streams a dump from the server into mysql to restore a MySQL database.")
+	flagMySQLRestoreDB    = cmdMySQLRestore.Flag("db", "The name of the database to restore into.").Required().String()
+	flagMySQLRestoreArgs  = cmdMySQLRestore.Flag("arg", "An extra argument to pass to mysql; can be specified multiple times.").Strings()
+	argMySQLRestoreTarget = cmdMySQLRestore.Arg("target", "The file path of the dump on the server.").Required().String()
+
+	// Import commands
+	cmdImportHistory         = appFlags.Command("import-history", "Imports a directory of dated snapshot directories as historical versions.")
+	flagImportHistoryLayout  = cmdImportHistory.Flag("layout", "The Go time layout used to parse the snapshot directory names.").Default("2006-01-02").String()
+	flagImportHistoryDirTime = cmdImportHistory.Flag("dirmtime", "Use the modification time of the snapshot directories instead of parsing their names.").Bool()
+	argImportHistoryDir      = cmdImportHistory.Arg("dir", "The local directory containing the dated snapshot directories.").Required().String()
+	argImportHistoryTarget   = cmdImportHistory.Arg("target", "The directory path to import to on the server.").Default("").String()
+
+	// Share commands
+	cmdShare          = appFlags.Command("share", "Manages the files shared publicly on servers that allow anonymous access.")
+	cmdShareAdd       = cmdShare.Command("add", "Shares an unencrypted copy of the current version of a file or directory.")
+	argShareAddTarget = cmdShareAdd.Arg("target", "The file or directory path on the server to share.").Required().String()
+	argShareAddName   = cmdShareAdd.Arg("name", "The public name to share it as; defaults to the target path.").Default("").String()
+	flagShareAddType  = cmdShareAdd.Flag("type", "The MIME type to serve the shared files as; detected if not set.").String()
+	flagShareAddPass  = cmdShareAdd.Flag("password", "A password required to download the shared files.").String()
+	flagShareAddMax   = cmdShareAdd.Flag("maxdownloads", "The number of times each shared file can be downloaded (0 for no limit).").Int()
+	flagShareAddQR    = cmdShareAdd.Flag("qr", "Prints a QR code of the share URL to the terminal.").Bool()
+	flagShareAddQRPNG = cmdShareAdd.Flag("qrpng", "Writes a QR code of the share URL to the PNG file given.").String()
+	cmdShareRm        = cmdShare.Command("rm", "Stops sharing a file.")
+	argShareRmName    = cmdShareRm.Arg("name", "The public name of the shared file.").Required().String()
+	cmdShareLs        = cmdShare.Command("ls", "Lists the files being shared.")
+
+	// Drop commands
+	cmdDrop             = appFlags.Command("drop", "Manages upload-only links that let others add files to a folder.")
+	cmdDropCreate       = cmdDrop.Command("create", "Creates an upload-only link for a folder on the server.")
+	flagDropCreateSize  = cmdDropCreate.Flag("maxsize", "The largest file in bytes that can be uploaded with the link.").Default("104857600").Int64()
+	flagDropCreateFiles = cmdDropCreate.Flag("maxfiles", "The number of files that can be uploaded with the link (0 for no limit).").Default("10").Int()
+	argDropCreateFolder = cmdDropCreate.Arg("folder", "The directory path on the server that uploaded files are collected into.").Required().String()
+	cmdDropLs           = cmdDrop.Command("ls", "Lists the upload-only links.")
+	cmdDropRm           = cmdDrop.Command("rm", "Revokes an upload-only link.")
+	argDropRmToken      = cmdDropRm.Arg("token", "The token of the link to revoke.").Required().String()
+	cmdDropCollect      = cmdDrop.Command("collect", "Encrypts the files uploaded with links into their folders.")
+
+	// Account commands
+	cmdAccount               = appFlags.Command("account", "Exports or erases the account.")
+	cmdAccountExport         = cmdAccount.Command("export", "Writes all of the account's metadata and a chunk download manifest to a JSON file.")
+	argAccountExportFile     = cmdAccountExport.Arg("file", "The file to write the export to.").Required().String()
+	cmdAccountDelete         = cmdAccount.Command("delete", "Asks the server to erase the account and everything in it.")
+	flagAccountDeleteConfirm = cmdAccountDelete.Flag("confirm", "The confirmation token from asking to erase the account.").String()
+	cmdAccountCancel         = cmdAccount.Command("cancel", "Cancels the erasure of the account.")
+
+	// Support commands
+	cmdSupport               = appFlags.Command("support", "Manages admin access to the account's metadata for support.")
+	cmdSupportGrant          = cmdSupport.Command("grant", "Lets admins make support tokens for the account.")
+	flagSupportGrantDuration = cmdSupportGrant.Flag("duration", "How long support tokens can be made for.").Default("24h").Duration()
+	cmdSupportRevoke         = cmdSupport.Command("revoke", "Withdraws consent to support access.")
+	cmdSupportAudit          = cmdSupport.Command("audit", "Shows the consent to support access and everything done with support tokens.")
 )
 
 func fmtPrintln(v ...interface{}) {
@@ -264,6 +573,16 @@ func interactiveFirstTimeSetCryptoPassword() string {
 	return password1
 }
 
+// interactiveConfirm asks the question on the terminal and returns true only
+// if the user answers yes.
+func interactiveConfirm(question string) bool {
+	reader := bufio.NewReader(os.Stdin)
+	fmt.Printf("%s [y/N]: ", question)
+	answer, _ := reader.ReadString('\n')
+	answer = strings.ToLower(strings.TrimSpace(answer))
+	return answer == "y" || answer == "yes"
+}
+
 func interactiveGetHost() string {
 	var host string
 
@@ -285,7 +604,27 @@ func interactiveGetHost() string {
 	return host
 }
 
+// limitCPU lowers the process priority if lowPriority is set, which also
+// limits the process to one CPU unless cpuLimit is set, and then limits the
+// number of CPUs used at once to cpuLimit if it's set.
+func limitCPU(lowPriority bool, cpuLimit int) error {
+	if lowPriority {
+		err := command.SetBackgroundPriority()
+		if err != nil {
+			return err
+		}
+		if cpuLimit == 0 {
+			cpuLimit = 1
+		}
+	}
+	if cpuLimit > 0 {
+		runtime.GOMAXPROCS(cpuLimit)
+	}
+	return nil
+}
+
 func main() {
+	appFlags.Version(command.Version)
 	parsedFlags := kingpin.MustParse(appFlags.Parse(os.Args[1:]))
 	rand.Seed(time.Now().UnixNano())
 
@@ -293,9 +632,62 @@ func main() {
 	cmdState.TLSKey = *flagTLSKey
 	cmdState.TLSCrt = *flagTLSCrt
 	cmdState.ExtraStrict = *flagExtraStrict
+	cmdState.UseSnapshot = *flagVSS
+	cmdState.Scanner = *flagScanner
+	cmdState.QuarantineDir = *flagQuarantine
+	cmdState.Metered = *flagMetered
+	cmdState.SyncPriority = *flagPriority
+	cmdState.DeferSize = *flagDeferSize
+	cmdState.Power = *flagPower
+	cmdState.BatteryThreshold = *flagBattery
+	cmdState.MaxTransfers = *flagTransfers
+	cmdState.Device = *flagDevice
+	cmdState.SpoolDir = *flagSpool
+	cmdState.QueueFile = *flagQueue
+	cmdState.SyncStateFile = *flagSyncState
+	cmdState.StrictLogin = *flagStrictLogin
+	bwLimit, err := command.ParseBandwidth(*flagBWLimit)
+	if err != nil {
+		fmt.Printf("Failed to parse the bandwidth limit: %v", err)
+		return
+	}
+	cmdState.BandwidthLimit = bwLimit
+	for _, rule := range *flagBWSchedule {
+		r, err := command.ParseBandwidthRule(rule)
+		if err != nil {
+			fmt.Printf("Failed to parse the bandwidth schedule: %v", err)
+			return
+		}
+		cmdState.BandwidthSchedule = append(cmdState.BandwidthSchedule, r)
+	}
+	for _, rule := range *flagTransforms {
+		t, err := command.ParseTransform(rule)
+		if err != nil {
+			fmt.Printf("Failed to parse the transform: %v", err)
+			return
+		}
+		cmdState.Transforms = append(cmdState.Transforms, t)
+	}
+	if *flagPolicies != "" {
+		cmdState.Policies, err = command.LoadSyncPolicies(*flagPolicies)
+		if err != nil {
+			fmt.Printf("%v", err)
+			return
+		}
+	}
+	if *flagExcludes {
+		cmdState.Exclusions = command.DefaultExclusions(runtime.GOOS)
+		cmdState.HomeDir, _ = os.UserHomeDir()
+	}
+	err = limitCPU(*flagLowPriority, *flagCPULimit)
+	if err != nil {
+		fmt.Printf("%v", err)
+		return
+	}
 	if *flagQuiet {
 		cmdState.SetQuiet(true)
 	}
+	cmdState.Verbosity = *flagVerbose
 
 	cmdState.Println("Filefreezer (Alpha-1) Copyright (C) 2017 by Timothy Bogdala <tdb@animal-machine.com>")
 	cmdState.Println("This program comes with ABSOLUTELY NO WARRANTY. This is free software")
@@ -319,15 +711,30 @@ func main() {
 
 	switch parsedFlags {
 	case cmdServe.FullCommand():
-		// setup a new server state or exit out on failure
-		state, err := newState()
+		// setup a new server or exit out on failure
+		if *flagServeLowMemory {
+			// collect garbage when the heap grows by half instead of doubling
+			debug.SetGCPercent(lowMemoryGCPercent)
+		}
+
+		config := newServerConfig()
+		if *flagServeMaxEgress != "" {
+			var err error
+			config.MaxEgress, err = command.ParseSize(*flagServeMaxEgress)
+			if err != nil {
+				fmt.Printf("Failed to parse the --maxegress flag: %v", err)
+				return
+			}
+		}
+
+		srv, err := server.New(config)
 		if err != nil {
 			fmt.Printf("Unable to initialize the server: %v", err)
 			return
 		}
-		defer state.close()
-		state.Storage.ChunkSize = *flagServeChunkSize
-		quitCh := state.serve(nil)
+		defer srv.Close()
+
+		quitCh := serve(srv, nil)
 
 		// wait until server shutdown to Exit out
 		for {
@@ -378,6 +785,79 @@ func main() {
 			fmt.Printf("Failed to change the user properties: %v", err)
 			return
 		}
+		if *flagUserModMaxV >= 0 {
+			err = cmdState.SetUserMaxVersions(store, username, *flagUserModMaxV)
+			if err != nil {
+				fmt.Printf("Failed to change the user properties: %v", err)
+				return
+			}
+		}
+		if *flagUserModMaxE != "" {
+			maxEgress, err := command.ParseSize(*flagUserModMaxE)
+			if err != nil {
+				fmt.Printf("Failed to parse the --maxegress flag: %v", err)
+				return
+			}
+			err = cmdState.SetUserMaxEgress(store, username, maxEgress)
+			if err != nil {
+				fmt.Printf("Failed to change the user properties: %v", err)
+				return
+			}
+		}
+
+	case cmdUserUnfreeze.FullCommand():
+		store, err := openStorage()
+		if err != nil {
+			fmt.Printf("Failed to open the storage database: %v", err)
+			return
+		}
+		username := interactiveGetLoginUser()
+		err = cmdState.UnfreezeUser(store, username)
+		if err != nil {
+			fmt.Printf("Failed to unfreeze the user: %v", err)
+			return
+		}
+
+	case cmdUserSupport.FullCommand():
+		store, err := openStorage()
+		if err != nil {
+			fmt.Printf("Failed to open the storage database: %v", err)
+			return
+		}
+		username := interactiveGetLoginUser()
+		st, err := cmdState.CreateSupportToken(store, username, *flagUserSupportReason, *flagUserSupportBreak, *flagUserSupportDuration)
+		if err != nil {
+			fmt.Printf("Failed to make the support token: %v", err)
+			return
+		}
+		cmdState.Printf("Support token for %s until %s: %s\n", username, time.Unix(st.Expires, 0).Format(time.RFC1123), st.Token)
+		cmdState.Printf("The user's metadata can be read from /support/%s/stats, /files, /file/<id>/versions and /chunk/<id>/<version>.\n", st.Token)
+
+	case cmdFsck.FullCommand():
+		store, err := openStorage()
+		if err != nil {
+			fmt.Printf("Failed to open the storage database: %v", err)
+			return
+		}
+		if len(*flagFsckChunkStores) > 0 {
+			store.Blobs, err = server.OpenChunkStores(server.Config{
+				ChunkStores:   *flagFsckChunkStores,
+				ChunkKeysPath: *flagFsckChunkKeys,
+				Logf:          fmtPrintf,
+			})
+			if err != nil {
+				fmt.Printf("Failed to open the chunk stores: %v", err)
+				return
+			}
+		}
+		_, err = cmdState.Fsck(store, filefreezer.CheckOptions{
+			Repair:   *flagFsckRepair,
+			SkipData: *flagFsckQuick,
+		})
+		if err != nil {
+			fmt.Printf("%v", err)
+			return
+		}
 
 	case cmdUserCryptoPass.FullCommand():
 		username := interactiveGetLoginUser()
@@ -413,37 +893,56 @@ func main() {
 			return
 		}
 
-		allFiles, err := cmdState.GetAllFileHashes()
+		var filter command.FileFilter
+		if *flagFileListSince != "" {
+			filter.ModifiedSince, err = command.ParseSince(*flagFileListSince, time.Now())
+			if err != nil {
+				fmt.Printf("Failed to parse the --since flag: %v", err)
+				return
+			}
+		}
+		if *flagFileListMinSize != "" {
+			filter.MinSize, err = command.ParseSize(*flagFileListMinSize)
+			if err != nil {
+				fmt.Printf("Failed to parse the --minsize flag: %v", err)
+				return
+			}
+		}
+
+		entries, err := cmdState.ListFiles(filter)
 		if err != nil {
 			fmt.Printf("Failed to get all of the files for the user %s from the storage server %s: %v", username, host, err)
 			return
 		}
+		command.SortListEntries(entries, *flagFileListSort, *flagFileListReverse)
 
-		fmtPrintf("Registered files for %s:\n", username)
-		fmtPrintln(strings.Repeat("=", 22+len(username)))
-		fmtPrintln("FileID   | VerNum   | Flags    | Filename")
-		fmtPrintln(strings.Repeat("-", 41))
+		cmdState.Printf("Registered files for %s:\n", username)
+		cmdState.Println(strings.Repeat("=", 22+len(username)))
 
-		var builder bytes.Buffer
-		for _, fi := range allFiles {
-			builder.Reset()
-			builder.WriteString(fmt.Sprintf("%08d | %08d | ", fi.FileID, fi.CurrentVersion.VersionNumber))
-			if fi.IsDir {
-				builder.WriteString("D        | ")
-			} else {
-				builder.WriteString("F        | ")
+		var table bytes.Buffer
+		tw := tabwriter.NewWriter(&table, 0, 8, 2, ' ', 0)
+		if *flagFileListLong {
+			fmt.Fprintln(tw, "MODE\tFILE ID\tVERSIONS\tSIZE\tALL VERSIONS\tMODIFIED\tNAME")
+		} else {
+			fmt.Fprintln(tw, "VERSIONS\tSIZE\tMODIFIED\tNAME")
+		}
+		for _, entry := range entries {
+			modified := time.Unix(entry.CurrentVersion.LastMod, 0).Format("2006-01-02 15:04")
+			if !*flagFileListLong {
+				fmt.Fprintf(tw, "%d\t%d\t%s\t%s\n", entry.CurrentVersion.VersionNumber, entry.CurrentVersion.Size, modified, entry.Name)
+				continue
 			}
-
-			decryptedFilename, err := cmdState.DecryptString(fi.FileName)
-			if err != nil {
-				fmtPrintf("Failed to decrypt filename for file id %d: %v", fi.FileID, err)
+			mode := os.FileMode(entry.CurrentVersion.Permissions).Perm()
+			if entry.IsDir {
+				mode |= os.ModeDir
 			}
-
-			builder.WriteString(fmt.Sprintf("%s", decryptedFilename))
-			fmtPrintln(builder.String())
+			fmt.Fprintf(tw, "%s\t%d\t%d\t%d\t%d\t%s\t%s\n", mode, entry.FileID, entry.CurrentVersion.VersionNumber,
+				entry.CurrentVersion.Size, entry.Size, modified, entry.Name)
 		}
+		tw.Flush()
+		cmdState.Printf("%s", table.String())
 
-	case cmdVersionsList.FullCommand():
+	case cmdDu.FullCommand():
 		username := interactiveGetLoginUser()
 		password := interactiveGetLoginPassword()
 		host := interactiveGetHost()
@@ -460,23 +959,55 @@ func main() {
 			return
 		}
 
-		versions, err := cmdState.GetFileVersions(*argVersionsListTarget)
+		entries, total, err := cmdState.GetDiskUsage(*argDuTarget)
 		if err != nil {
-			fmt.Printf("Failed to get the file versions for the user %s from the storage server %s: %v", username, host, err)
+			fmt.Printf("Failed to get the disk usage: %v", err)
 			return
 		}
 
-		cmdState.Printf("Registered versions for %s:\n", *argVersionsListTarget)
-		cmdState.Println(strings.Repeat("=", 25+len(*argVersionsListTarget)))
+		var table bytes.Buffer
+		tw := tabwriter.NewWriter(&table, 0, 8, 2, ' ', tabwriter.AlignRight)
+		fmt.Fprintln(tw, "FILES\tCURRENT\tALL VERSIONS\t\tNAME")
+		for _, du := range entries {
+			fmt.Fprintf(tw, "%d\t%d\t%d\t\t%s\n", du.Files, du.Current, du.Total, du.Name)
+		}
+		totalName := total.Name
+		if totalName == "" {
+			totalName = "(all files)"
+		}
+		fmt.Fprintf(tw, "%d\t%d\t%d\t\t%s total\n", total.Files, total.Current, total.Total, totalName)
+		tw.Flush()
+		cmdState.Printf("%s", table.String())
 
-		// loop through all of the results and print them
-		for _, version := range versions {
-			modTime := time.Unix(version.LastMod, 0)
-			cmdState.Printf("Version ID: %d\t\tNumber: %d\t\tLastMod: %s\n",
-				version.VersionID, version.VersionNumber, modTime.Format(time.UnixDate))
+	case cmdTree.FullCommand():
+		username := interactiveGetLoginUser()
+		password := interactiveGetLoginPassword()
+		host := interactiveGetHost()
+
+		err := cmdState.Authenticate(host, username, password)
+		if err != nil {
+			fmt.Printf("Failed to authenticate to the server %s: %v", host, err)
+			return
 		}
 
-	case cmdVersionsRm.FullCommand():
+		err = initCrypto(cmdState)
+		if err != nil {
+			fmt.Printf("Failed to initialize cryptography: %v", err)
+			return
+		}
+
+		tree, err := cmdState.GetTree(*argTreePrefix)
+		if err != nil {
+			fmt.Printf("Failed to get the file tree: %v", err)
+			return
+		}
+
+		var out bytes.Buffer
+		tree.WriteTree(&out)
+		cmdState.Printf("%s", out.String())
+		cmdState.Printf("%d files\n", tree.Files)
+
+	case cmdManifest.FullCommand():
 		username := interactiveGetLoginUser()
 		password := interactiveGetLoginPassword()
 		host := interactiveGetHost()
@@ -493,38 +1024,47 @@ func main() {
 			return
 		}
 
-		// attempt to remove the file versions
-		if !*flagVersionsRmRegex {
-			var maxVersion int
-			if *argVersionsRmMax == "H~" {
-				fi, err := cmdState.GetFileInfoByFilename(*argVersionsRmTarget)
-				if err != nil {
-					fmt.Printf("Failed to get the file information for %s: %v", *argVersionsRmTarget, err)
-					return
-				}
-				maxVersion = fi.CurrentVersion.VersionNumber - 1
-			} else {
-				maxVersion, err = strconv.Atoi(*argVersionsRmMax)
-				if err != nil {
-					fmt.Printf("Failed to parse the supplied max version as a number: %v", err)
-					return
-				}
-			}
+		// keep the download progress out of a manifest written to stdout
+		toStdout := *flagManifestOutput == "" && *flagManifestVerify == ""
+		if toStdout {
+			cmdState.SetQuiet(true)
+		}
+		entries, err := cmdState.BuildManifest(*argManifestPrefix)
+		if err != nil {
+			fmt.Printf("Failed to build the manifest: %v", err)
+			return
+		}
 
-			err = cmdState.RmFileVersions(*argVersionsRmTarget, *argVersionsRmMin, maxVersion, *flagVersionsRmDryRun)
+		if *flagManifestVerify != "" {
+			failed, err := command.VerifyManifest(entries, *flagManifestVerify)
 			if err != nil {
-				cmdState.Printf("Failed to remove the versions: %v\n", err)
-			} else {
-				cmdState.Printf("Successfully removed versions %d to %d.\n", *argVersionsRmMin, maxVersion)
+				fmt.Printf("Failed to verify the local files: %v", err)
+				return
 			}
-		} else {
-			err = cmdState.RmRxFileVersions(*argVersionsRmTarget, *argVersionsRmMin, *argVersionsRmMax, *flagVersionsRmDryRun)
-			if err != nil {
-				cmdState.Printf("Failed to remove the versions: %v\n", err)
+			for _, line := range failed {
+				fmt.Println(line)
+			}
+			if len(failed) > 0 {
+				fmt.Printf("%d of %d files did not match the manifest.\n", len(failed), len(entries))
+				os.Exit(1)
 			}
+			cmdState.Printf("All %d files match the manifest.\n", len(entries))
+			return
 		}
 
-	case cmdFileRm.FullCommand():
+		if toStdout {
+			err = command.WriteManifest(os.Stdout, entries)
+		} else {
+			var manifest bytes.Buffer
+			command.WriteManifest(&manifest, entries)
+			err = ioutil.WriteFile(*flagManifestOutput, manifest.Bytes(), 0644)
+		}
+		if err != nil {
+			fmt.Printf("Failed to write the manifest: %v", err)
+			return
+		}
+
+	case cmdDupes.FullCommand():
 		username := interactiveGetLoginUser()
 		password := interactiveGetLoginPassword()
 		host := interactiveGetHost()
@@ -541,21 +1081,28 @@ func main() {
 			return
 		}
 
-		if !*flagFileRmRegex {
-			err = cmdState.RmFile(*argFileRmPath, *flagFileRmDryRun)
-			if err != nil {
-				fmt.Printf("Failed to remove file from the server %s: %v", host, err)
-				return
-			}
-		} else {
-			err = cmdState.RmRxFiles(*argFileRmPath, *flagFileRmDryRun)
-			if err != nil {
-				fmt.Printf("Failed to remove files: %v", err)
-				return
+		dupes, err := cmdState.GetDuplicateFiles()
+		if err != nil {
+			fmt.Printf("Failed to get the duplicate files: %v", err)
+			return
+		}
+
+		if len(dupes) == 0 {
+			cmdState.Printf("No duplicate files were found.\n")
+			return
+		}
+
+		var redundant int64
+		for _, df := range dupes {
+			cmdState.Printf("%d files with %d bytes each:\n", len(df.FileNames), df.Size)
+			for _, name := range df.FileNames {
+				cmdState.Printf("    %s\n", name)
 			}
+			redundant += df.Size * int64(len(df.FileNames)-1)
 		}
+		cmdState.Printf("%d bytes are stored for redundant copies.\n", redundant)
 
-	case cmdSync.FullCommand():
+	case cmdRechunk.FullCommand():
 		username := interactiveGetLoginUser()
 		password := interactiveGetLoginPassword()
 		host := interactiveGetHost()
@@ -572,25 +1119,91 @@ func main() {
 			return
 		}
 
-		filepath := *argSyncPath
-		remoteFilepath := *argSyncTarget
-		if len(remoteFilepath) < 1 {
-			remoteFilepath = filepath
+		_, err = cmdState.Rechunk(*flagRechunkPause)
+		if err != nil {
+			fmt.Printf("Failed to rechunk the files: %v", err)
+			return
 		}
 
-		// check to see if a flag was specified to sync a particular version number
-		syncVersion := *flagSyncVersion
-		if syncVersion <= 0 {
-			syncVersion = command.SyncCurrentVersion
+	case cmdChunks.FullCommand():
+		username := interactiveGetLoginUser()
+		password := interactiveGetLoginPassword()
+		host := interactiveGetHost()
+
+		err := cmdState.Authenticate(host, username, password)
+		if err != nil {
+			fmt.Printf("Failed to authenticate to the server %s: %v", host, err)
+			return
 		}
 
-		_, _, err = cmdState.SyncFile(filepath, remoteFilepath, syncVersion)
+		err = initCrypto(cmdState)
 		if err != nil {
-			fmt.Printf("Failed to synchronize the path %s: %v", filepath, err)
+			fmt.Printf("Failed to initialize cryptography: %v", err)
 			return
 		}
 
-	case cmdSyncDir.FullCommand():
+		remoteFilepath, versionNumber := command.ParseVersionSpec(*argChunksTarget)
+		version, chunks, err := cmdState.GetVersionChunks(remoteFilepath, versionNumber)
+		if err != nil {
+			fmt.Printf("Failed to get the chunks: %v", err)
+			return
+		}
+
+		var statuses []string
+		if *flagChunksVerify != "" {
+			statuses, err = cmdState.CompareChunks(*flagChunksVerify, chunks, version.ChunkCount)
+			if err != nil {
+				fmt.Printf("Failed to compare the chunks with %s: %v", *flagChunksVerify, err)
+				return
+			}
+		}
+
+		cmdState.Printf("Chunks of version %d of %s (hash %s):\n", version.VersionNumber, remoteFilepath, version.FileHash)
+
+		// loop through all of the chunks and print them as a table
+		var table bytes.Buffer
+		tw := tabwriter.NewWriter(&table, 0, 8, 2, ' ', 0)
+		if statuses != nil {
+			fmt.Fprintln(tw, "CHUNK\tSTORED\tHASH\tLOCAL")
+		} else {
+			fmt.Fprintln(tw, "CHUNK\tSTORED\tHASH")
+		}
+		byNumber := make(map[int]filefreezer.FileChunk)
+		for _, c := range chunks {
+			byNumber[c.ChunkNumber] = c
+		}
+		rows := version.ChunkCount
+		if len(statuses) > rows {
+			rows = len(statuses)
+		}
+		mismatches := 0
+		for i := 0; i < rows; i++ {
+			stored, hash := "-", "-"
+			if c, found := byNumber[i]; found {
+				stored = strconv.FormatInt(c.Length, 10)
+				hash = c.ChunkHash
+			}
+			if statuses != nil {
+				fmt.Fprintf(tw, "%d\t%s\t%s\t%s\n", i, stored, hash, statuses[i])
+				if statuses[i] != command.ChunkMatches {
+					mismatches++
+				}
+			} else {
+				fmt.Fprintf(tw, "%d\t%s\t%s\n", i, stored, hash)
+			}
+		}
+		tw.Flush()
+		cmdState.Printf("%s", table.String())
+
+		if statuses != nil {
+			if mismatches > 0 {
+				fmt.Printf("%d of %d chunks don't match %s.\n", mismatches, rows, *flagChunksVerify)
+				os.Exit(1)
+			}
+			cmdState.Printf("All %d chunks match %s.\n", rows, *flagChunksVerify)
+		}
+
+	case cmdEstimate.FullCommand():
 		username := interactiveGetLoginUser()
 		password := interactiveGetLoginPassword()
 		host := interactiveGetHost()
@@ -607,18 +1220,32 @@ func main() {
 			return
 		}
 
-		filepath := *argSyncDirPath
-		remoteFilepath := *argSyncDirTarget
+		remoteFilepath := *argEstimateTarget
 		if len(remoteFilepath) < 1 {
-			remoteFilepath = filepath
+			remoteFilepath = *argEstimatePath
 		}
-		_, err = cmdState.SyncDirectory(filepath, remoteFilepath)
+		estimate, diffs, err := cmdState.EstimateSync(*argEstimatePath, remoteFilepath)
 		if err != nil {
-			fmt.Printf("Failed to synchronize the directory %s: %v", filepath, err)
+			fmt.Printf("Failed to estimate the sync: %v", err)
 			return
 		}
 
-	case cmdUserStats.FullCommand():
+		if *flagEstimateFiles && len(diffs) > 0 {
+			var table bytes.Buffer
+			tw := tabwriter.NewWriter(&table, 0, 8, 2, ' ', 0)
+			fmt.Fprintln(tw, "STATUS\tFILE")
+			for _, diff := range diffs {
+				fmt.Fprintf(tw, "%s\t%s\n", diff.Status, diff.RemotePath)
+			}
+			tw.Flush()
+			cmdState.Printf("%s\n", table.String())
+		}
+		cmdState.Printf("Files to sync: %d\n", estimate.Files)
+		cmdState.Printf("Upload:        %d chunks, %d bytes\n", estimate.UploadChunks, estimate.UploadBytes)
+		cmdState.Printf("Download:      %d chunks, %d bytes\n", estimate.DownloadChunks, estimate.DownloadBytes)
+		cmdState.Printf("Total:         %d bytes\n", estimate.UploadBytes+estimate.DownloadBytes)
+
+	case cmdTrainDict.FullCommand():
 		username := interactiveGetLoginUser()
 		password := interactiveGetLoginPassword()
 		host := interactiveGetHost()
@@ -629,9 +1256,1523 @@ func main() {
 			return
 		}
 
-		_, err = cmdState.GetUserStats()
+		err = initCrypto(cmdState)
 		if err != nil {
-			fmt.Printf("Failed to get the user stats from the server %s: %v", host, err)
+			fmt.Printf("Failed to initialize cryptography: %v", err)
+			return
+		}
+
+		remoteDir := *argTrainDictTarget
+		if len(remoteDir) < 1 {
+			remoteDir = *argTrainDictPath
+		}
+		samples, err := cmdState.TrainDictionary(*argTrainDictPath, remoteDir, *flagTrainDictSize)
+		if err != nil {
+			fmt.Printf("%v", err)
+			return
+		}
+		cmdState.Printf("Trained the dictionary for %s on %d files.\n", remoteDir, samples)
+
+	case cmdPatch.FullCommand():
+		username := interactiveGetLoginUser()
+		password := interactiveGetLoginPassword()
+		host := interactiveGetHost()
+
+		err := cmdState.Authenticate(host, username, password)
+		if err != nil {
+			fmt.Printf("Failed to authenticate to the server %s: %v", host, err)
+			return
+		}
+
+		err = initCrypto(cmdState)
+		if err != nil {
+			fmt.Printf("Failed to initialize cryptography: %v", err)
+			return
+		}
+
+		remoteFilepath := *argPatchTarget
+		if len(remoteFilepath) < 1 {
+			remoteFilepath = *argPatchFile
+		}
+		_, err = cmdState.PatchFile(*argPatchFile, remoteFilepath)
+		if err != nil {
+			fmt.Printf("Failed to patch the file: %v", err)
+			return
+		}
+
+	case cmdLock.FullCommand():
+		username := interactiveGetLoginUser()
+		password := interactiveGetLoginPassword()
+		host := interactiveGetHost()
+
+		err := cmdState.Authenticate(host, username, password)
+		if err != nil {
+			fmt.Printf("Failed to authenticate to the server %s: %v", host, err)
+			return
+		}
+
+		err = initCrypto(cmdState)
+		if err != nil {
+			fmt.Printf("Failed to initialize cryptography: %v", err)
+			return
+		}
+
+		_, err = cmdState.LockFile(*argLockFile, *flagLockTTL)
+		if err != nil {
+			fmt.Printf("Failed to lock the file: %v", err)
+			os.Exit(1)
+		}
+
+	case cmdUnlock.FullCommand():
+		username := interactiveGetLoginUser()
+		password := interactiveGetLoginPassword()
+		host := interactiveGetHost()
+
+		err := cmdState.Authenticate(host, username, password)
+		if err != nil {
+			fmt.Printf("Failed to authenticate to the server %s: %v", host, err)
+			return
+		}
+
+		err = initCrypto(cmdState)
+		if err != nil {
+			fmt.Printf("Failed to initialize cryptography: %v", err)
+			return
+		}
+
+		err = cmdState.UnlockFile(*argUnlockFile, *flagUnlockForce)
+		if err != nil {
+			fmt.Printf("Failed to unlock the file: %v", err)
+			os.Exit(1)
+		}
+
+	case cmdLocks.FullCommand():
+		username := interactiveGetLoginUser()
+		password := interactiveGetLoginPassword()
+		host := interactiveGetHost()
+
+		err := cmdState.Authenticate(host, username, password)
+		if err != nil {
+			fmt.Printf("Failed to authenticate to the server %s: %v", host, err)
+			return
+		}
+
+		err = initCrypto(cmdState)
+		if err != nil {
+			fmt.Printf("Failed to initialize cryptography: %v", err)
+			return
+		}
+
+		locks, err := cmdState.GetFileLocks()
+		if err != nil {
+			fmt.Printf("Failed to get the file locks: %v", err)
+			return
+		}
+		if len(locks) == 0 {
+			cmdState.Println("No files are locked.")
+			return
+		}
+
+		var table bytes.Buffer
+		tw := tabwriter.NewWriter(&table, 0, 8, 2, ' ', 0)
+		fmt.Fprintln(tw, "FILE\tHOLDER\tLOCKED\tEXPIRES")
+		for _, lock := range locks {
+			holder := lock.Holder
+			if lock.Mine {
+				holder += " (this device)"
+			}
+			fmt.Fprintf(tw, "%s\t%s\t%s\t%s\n", lock.FileName, holder,
+				time.Unix(lock.Created, 0).Format("2006-01-02 15:04:05"),
+				time.Unix(lock.Expires, 0).Format("2006-01-02 15:04:05"))
+		}
+		tw.Flush()
+		cmdState.Printf("%s", table.String())
+
+	case cmdVersionsList.FullCommand():
+		username := interactiveGetLoginUser()
+		password := interactiveGetLoginPassword()
+		host := interactiveGetHost()
+
+		err := cmdState.Authenticate(host, username, password)
+		if err != nil {
+			fmt.Printf("Failed to authenticate to the server %s: %v", host, err)
+			return
+		}
+
+		err = initCrypto(cmdState)
+		if err != nil {
+			fmt.Printf("Failed to initialize cryptography: %v", err)
+			return
+		}
+
+		versions, err := cmdState.GetFileVersions(*argVersionsListTarget)
+		if err != nil {
+			fmt.Printf("Failed to get the file versions for the user %s from the storage server %s: %v", username, host, err)
+			return
+		}
+
+		cmdState.Printf("Registered versions for %s:\n", *argVersionsListTarget)
+		cmdState.Println(strings.Repeat("=", 25+len(*argVersionsListTarget)))
+
+		// loop through all of the results and print them as a table
+		var table bytes.Buffer
+		tw := tabwriter.NewWriter(&table, 0, 8, 2, ' ', 0)
+		fmt.Fprintln(tw, "VERSION\tID\tCREATED\tMODIFIED\tSIZE\tCHUNKS\tDEVICE")
+		for _, version := range versions {
+			created := "unknown"
+			if version.Created > 0 {
+				created = time.Unix(version.Created, 0).Format("2006-01-02 15:04:05")
+			}
+			device := version.Device
+			if device == "" {
+				device = "unknown"
+			}
+			fmt.Fprintf(tw, "%d\t%d\t%s\t%s\t%d\t%d\t%s\n", version.VersionNumber, version.VersionID, created,
+				time.Unix(version.LastMod, 0).Format("2006-01-02 15:04:05"), version.Size, version.ChunkCount, device)
+		}
+		tw.Flush()
+		cmdState.Printf("%s", table.String())
+
+	case cmdVersionsRm.FullCommand():
+		username := interactiveGetLoginUser()
+		password := interactiveGetLoginPassword()
+		host := interactiveGetHost()
+
+		err := cmdState.Authenticate(host, username, password)
+		if err != nil {
+			fmt.Printf("Failed to authenticate to the server %s: %v", host, err)
+			return
+		}
+
+		err = initCrypto(cmdState)
+		if err != nil {
+			fmt.Printf("Failed to initialize cryptography: %v", err)
+			return
+		}
+
+		// attempt to remove the file versions
+		if !*flagVersionsRmRegex {
+			var maxVersion int
+			if *argVersionsRmMax == "H~" {
+				fi, err := cmdState.GetFileInfoByFilename(*argVersionsRmTarget)
+				if err != nil {
+					fmt.Printf("Failed to get the file information for %s: %v", *argVersionsRmTarget, err)
+					return
+				}
+				maxVersion = fi.CurrentVersion.VersionNumber - 1
+			} else {
+				maxVersion, err = strconv.Atoi(*argVersionsRmMax)
+				if err != nil {
+					fmt.Printf("Failed to parse the supplied max version as a number: %v", err)
+					return
+				}
+			}
+
+			err = cmdState.RmFileVersions(*argVersionsRmTarget, *argVersionsRmMin, maxVersion, *flagVersionsRmDryRun)
+			if err != nil {
+				cmdState.Printf("Failed to remove the versions: %v\n", err)
+			} else {
+				cmdState.Printf("Successfully removed versions %d to %d.\n", *argVersionsRmMin, maxVersion)
+			}
+		} else {
+			opts := command.MatchOptions{
+				IgnoreCase: *flagVersionsRmNoCase,
+				Anchored:   *flagVersionsRmAnchor,
+				Invert:     *flagVersionsRmInvert,
+			}
+			err = cmdState.RmRxFileVersions(*argVersionsRmTarget, opts, *argVersionsRmMin, *argVersionsRmMax, *flagVersionsRmDryRun)
+			if err != nil {
+				cmdState.Printf("Failed to remove the versions: %v\n", err)
+			}
+		}
+
+	case cmdFileRm.FullCommand():
+		username := interactiveGetLoginUser()
+		password := interactiveGetLoginPassword()
+		host := interactiveGetHost()
+
+		if cmdState.QueueFile != "" && !*flagFileRmDryRun && *flagFileRmIgnored == "" && !cmdState.ServerReachable(host) {
+			err := cmdState.QueueOp(host, command.QueuedOp{
+				Op:      command.QueuedRm,
+				Pattern: *argFileRmPath,
+				Regex:   *flagFileRmRegex,
+				Options: command.MatchOptions{
+					IgnoreCase: *flagFileRmNoCase,
+					Anchored:   *flagFileRmAnchor,
+					Invert:     *flagFileRmInvert,
+				},
+			})
+			if err != nil {
+				fmt.Printf("Failed to queue the removal: %v", err)
+			}
+			return
+		}
+
+		err := cmdState.Authenticate(host, username, password)
+		if err != nil {
+			fmt.Printf("Failed to authenticate to the server %s: %v", host, err)
+			return
+		}
+
+		err = initCrypto(cmdState)
+		if err != nil {
+			fmt.Printf("Failed to initialize cryptography: %v", err)
+			return
+		}
+
+		if *flagFileRmIgnored != "" {
+			err = cmdState.RmIgnoredFiles(*flagFileRmIgnored, *argFileRmPath, *flagFileRmDryRun)
+			if err != nil {
+				fmt.Printf("Failed to remove the ignored files: %v", err)
+				return
+			}
+		} else if !*flagFileRmRegex {
+			err = cmdState.RmFile(*argFileRmPath, *flagFileRmDryRun)
+			if err != nil {
+				fmt.Printf("Failed to remove file from the server %s: %v", host, err)
+				return
+			}
+		} else {
+			opts := command.MatchOptions{
+				IgnoreCase: *flagFileRmNoCase,
+				Anchored:   *flagFileRmAnchor,
+				Invert:     *flagFileRmInvert,
+			}
+			err = cmdState.RmRxFiles(*argFileRmPath, opts, *flagFileRmDryRun)
+			if err != nil {
+				fmt.Printf("Failed to remove files: %v", err)
+				return
+			}
+		}
+
+	case cmdMvRx.FullCommand():
+		username := interactiveGetLoginUser()
+		password := interactiveGetLoginPassword()
+		host := interactiveGetHost()
+
+		if cmdState.QueueFile != "" && !*flagMvRxDryRun && !cmdState.ServerReachable(host) {
+			err := cmdState.QueueOp(host, command.QueuedOp{
+				Op:          command.QueuedMv,
+				Pattern:     *argMvRxPattern,
+				Replacement: *argMvRxReplace,
+				Regex:       true,
+				Options: command.MatchOptions{
+					IgnoreCase: *flagMvRxNoCase,
+					Anchored:   *flagMvRxAnchor,
+				},
+			})
+			if err != nil {
+				fmt.Printf("Failed to queue the renames: %v", err)
+			}
+			return
+		}
+
+		err := cmdState.Authenticate(host, username, password)
+		if err != nil {
+			fmt.Printf("Failed to authenticate to the server %s: %v", host, err)
+			return
+		}
+
+		err = initCrypto(cmdState)
+		if err != nil {
+			fmt.Printf("Failed to initialize cryptography: %v", err)
+			return
+		}
+
+		opts := command.MatchOptions{
+			IgnoreCase: *flagMvRxNoCase,
+			Anchored:   *flagMvRxAnchor,
+		}
+		renames, err := cmdState.PlanRxRenames(*argMvRxPattern, *argMvRxReplace, opts)
+		if err != nil {
+			fmt.Printf("Failed to plan the renames: %v", err)
+			return
+		}
+		if len(renames) == 0 {
+			cmdState.Printf("No files need to be renamed.\n")
+			return
+		}
+
+		for _, r := range renames {
+			cmdState.Printf("%s -> %s\n", r.From, r.To)
+		}
+		if *flagMvRxDryRun {
+			return
+		}
+		if !*flagMvRxConfirm && !interactiveConfirm(fmt.Sprintf("Rename %d files?", len(renames))) {
+			cmdState.Printf("No files were renamed.\n")
+			return
+		}
+
+		err = cmdState.RenameFiles(renames)
+		if err != nil {
+			fmt.Printf("Failed to rename the files: %v", err)
+			return
+		}
+
+	case cmdSync.FullCommand():
+		username := interactiveGetLoginUser()
+		password := interactiveGetLoginPassword()
+		host := interactiveGetHost()
+
+		err := cmdState.Authenticate(host, username, password)
+		if err != nil {
+			fmt.Printf("Failed to authenticate to the server %s: %v", host, err)
+			return
+		}
+
+		err = initCrypto(cmdState)
+		if err != nil {
+			fmt.Printf("Failed to initialize cryptography: %v", err)
+			return
+		}
+
+		filepath := *argSyncPath
+		remoteFilepath := *argSyncTarget
+		if len(remoteFilepath) < 1 {
+			remoteFilepath = filepath
+		}
+
+		if *flagSyncMeta {
+			diffs, err := cmdState.CheckSync(filepath, remoteFilepath)
+			if err != nil {
+				fmt.Printf("Failed to check the path %s: %v", filepath, err)
+				return
+			}
+			if len(diffs) == 0 {
+				cmdState.Printf("%s is up to date with %s.\n", filepath, remoteFilepath)
+				return
+			}
+
+			var table bytes.Buffer
+			tw := tabwriter.NewWriter(&table, 0, 8, 2, ' ', 0)
+			fmt.Fprintln(tw, "STATUS\tFILE")
+			for _, diff := range diffs {
+				fmt.Fprintf(tw, "%s\t%s\n", diff.Status, diff.RemotePath)
+			}
+			tw.Flush()
+			cmdState.Printf("%s", table.String())
+			fmt.Printf("%d files differ from the server.\n", len(diffs))
+			os.Exit(1)
+		}
+
+		// check to see if a flag was specified to sync a particular version number
+		syncVersion := *flagSyncVersion
+		if syncVersion <= 0 {
+			syncVersion = command.SyncCurrentVersion
+		}
+
+		_, _, err = cmdState.SyncFile(filepath, remoteFilepath, syncVersion)
+		if err != nil {
+			fmt.Printf("Failed to synchronize the path %s: %v", filepath, err)
+			return
+		}
+
+	case cmdSyncDir.FullCommand():
+		username := interactiveGetLoginUser()
+		password := interactiveGetLoginPassword()
+		host := interactiveGetHost()
+
+		err := cmdState.Authenticate(host, username, password)
+		if err != nil {
+			fmt.Printf("Failed to authenticate to the server %s: %v", host, err)
+			return
+		}
+
+		err = initCrypto(cmdState)
+		if err != nil {
+			fmt.Printf("Failed to initialize cryptography: %v", err)
+			return
+		}
+
+		filepath := *argSyncDirPath
+		remoteFilepath := *argSyncDirTarget
+		if len(remoteFilepath) < 1 {
+			remoteFilepath = filepath
+		}
+		_, err = cmdState.SyncDirectory(filepath, remoteFilepath)
+		if err != nil {
+			fmt.Printf("Failed to synchronize the directory %s: %v", filepath, err)
+			return
+		}
+
+	case cmdSyncDirBoth.FullCommand():
+		username := interactiveGetLoginUser()
+		password := interactiveGetLoginPassword()
+		host := interactiveGetHost()
+
+		err := cmdState.Authenticate(host, username, password)
+		if err != nil {
+			fmt.Printf("Failed to authenticate to the server %s: %v", host, err)
+			return
+		}
+
+		err = initCrypto(cmdState)
+		if err != nil {
+			fmt.Printf("Failed to initialize cryptography: %v", err)
+			return
+		}
+
+		// removed files can only be told from new ones with a sync state
+		if cmdState.SyncStateFile == "" {
+			home, err := os.UserHomeDir()
+			if err != nil {
+				fmt.Printf("Failed to find the home directory for the sync state; use --syncstate: %v", err)
+				return
+			}
+			cmdState.SyncStateFile = filepath.Join(home, ".freezer-syncstate.json")
+		}
+
+		remoteDir := *argSyncDirBothTarget
+		if len(remoteDir) < 1 {
+			remoteDir = *argSyncDirBothPath
+		}
+		_, err = cmdState.SyncDirBothWays(*argSyncDirBothPath, remoteDir)
+		if err != nil {
+			fmt.Printf("Failed to synchronize the directory %s: %v", *argSyncDirBothPath, err)
+			return
+		}
+
+	case cmdGetDir.FullCommand():
+		username := interactiveGetLoginUser()
+		password := interactiveGetLoginPassword()
+		host := interactiveGetHost()
+
+		err := cmdState.Authenticate(host, username, password)
+		if err != nil {
+			fmt.Printf("Failed to authenticate to the server %s: %v", host, err)
+			return
+		}
+
+		err = initCrypto(cmdState)
+		if err != nil {
+			fmt.Printf("Failed to initialize cryptography: %v", err)
+			return
+		}
+
+		localDir := *argGetDirLocal
+		if len(localDir) < 1 {
+			localDir = *argGetDirRemote
+		}
+		count, err := cmdState.GetDirectory(*argGetDirRemote, localDir)
+		if err != nil {
+			fmt.Printf("Failed to restore the directory %s (%d files downloaded); run the command again to resume: %v", *argGetDirRemote, count, err)
+			return
+		}
+		cmdState.Printf("Restored %s into %s (%d files downloaded).\n", *argGetDirRemote, localDir, count)
+
+	case cmdPrune.FullCommand():
+		if len(cmdState.Policies) == 0 {
+			fmt.Printf("Sync policies must be specified with --policies.")
+			return
+		}
+		username := interactiveGetLoginUser()
+		password := interactiveGetLoginPassword()
+		host := interactiveGetHost()
+
+		err := cmdState.Authenticate(host, username, password)
+		if err != nil {
+			fmt.Printf("Failed to authenticate to the server %s: %v", host, err)
+			return
+		}
+
+		err = initCrypto(cmdState)
+		if err != nil {
+			fmt.Printf("Failed to initialize cryptography: %v", err)
+			return
+		}
+
+		count, err := cmdState.PruneVersions(*flagPruneDryRun)
+		if err != nil {
+			fmt.Printf("Failed to prune the file versions (%d files pruned): %v", count, err)
+			return
+		}
+		cmdState.Printf("Pruned the versions of %d files.\n", count)
+
+	case cmdTime.FullCommand():
+		cmdState.HostURI = interactiveGetHost()
+		serverTime, err := cmdState.ServerTime()
+		if err != nil {
+			fmt.Printf("Failed to get the server's time: %v", err)
+			return
+		}
+		cmdState.Printf("Server time: %s\n", serverTime.Format(time.RFC3339Nano))
+		cmdState.Printf("Local time:  %s\n", time.Now().Format(time.RFC3339Nano))
+		cmdState.Printf("The server's clock is %v ahead of this device's clock.\n", cmdState.ClockSkew)
+
+	case cmdReplay.FullCommand():
+		if cmdState.QueueFile == "" {
+			fmt.Printf("A queue file must be specified with --queue.")
+			return
+		}
+		if *flagReplayList {
+			ops, err := cmdState.LoadOpQueue()
+			if err != nil {
+				fmt.Printf("Failed to read the queue: %v", err)
+				return
+			}
+			for _, op := range ops {
+				fmt.Printf("%s\t%s\t%s\n", time.Unix(op.Queued, 0).Format("2006-01-02 15:04:05"), op.HostURI, op)
+			}
+			return
+		}
+
+		username := interactiveGetLoginUser()
+		password := interactiveGetLoginPassword()
+		host := interactiveGetHost()
+
+		err := cmdState.Authenticate(host, username, password)
+		if err != nil {
+			fmt.Printf("Failed to authenticate to the server %s: %v", host, err)
+			return
+		}
+
+		err = initCrypto(cmdState)
+		if err != nil {
+			fmt.Printf("Failed to initialize cryptography: %v", err)
+			return
+		}
+
+		applied, conflicts, err := cmdState.ReplayOpQueue(*flagReplayForce)
+		for _, conflict := range conflicts {
+			cmdState.Printf("Conflict, left in the queue: %s\n", conflict)
+		}
+		if err != nil {
+			fmt.Printf("Failed to replay the queue (%d applied): %v", applied, err)
+			return
+		}
+		cmdState.Printf("Applied %d queued operations.\n", applied)
+
+	case cmdFlush.FullCommand():
+		if cmdState.SpoolDir == "" {
+			fmt.Printf("A spool directory must be specified with --spool.")
+			return
+		}
+		host := interactiveGetHost()
+		if *flagFlushList {
+			cmdState.HostURI = host
+			chunks, err := cmdState.SpooledChunks()
+			if err != nil {
+				fmt.Printf("Failed to read the spool: %v", err)
+				return
+			}
+			for _, sc := range chunks {
+				fmt.Printf("%s\tversion %d\tchunk %d / %d\n", sc.RemoteFilepath, sc.VersionID, sc.ChunkNumber+1, sc.ChunkCount)
+			}
+			return
+		}
+
+		username := interactiveGetLoginUser()
+		password := interactiveGetLoginPassword()
+		err := cmdState.Authenticate(host, username, password)
+		if err != nil {
+			fmt.Printf("Failed to authenticate to the server %s: %v", host, err)
+			return
+		}
+
+		// the spooled chunks are already encrypted so the crypto password isn't needed
+		count, err := cmdState.FlushSpool()
+		if err != nil {
+			fmt.Printf("Failed to flush every spooled chunk (%d uploaded): %v", count, err)
+			return
+		}
+		cmdState.Printf("Uploaded %d spooled chunks.\n", count)
+
+	case cmdSelfUpdate.FullCommand():
+		if *flagSelfUpdateCheck {
+			release, _, err := cmdState.CheckRelease(*flagSelfUpdateURL)
+			if err != nil {
+				fmt.Printf("%v", err)
+				return
+			}
+			if models.CompareVersions(release.Version, command.Version) > 0 {
+				cmdState.Printf("Version %s is available (this is version %s).\n", release.Version, command.Version)
+			} else {
+				cmdState.Printf("Version %s is the newest release.\n", command.Version)
+			}
+			return
+		}
+
+		keyPEM := []byte(command.ReleaseKey)
+		if *flagSelfUpdateKey != "" {
+			var err error
+			keyPEM, err = ioutil.ReadFile(*flagSelfUpdateKey)
+			if err != nil {
+				fmt.Printf("Failed to read the release key: %v", err)
+				return
+			}
+		}
+		if len(keyPEM) == 0 {
+			fmt.Printf("No release key is built into this program; one must be specified with --key.")
+			return
+		}
+		key, err := command.ParseReleaseKey(keyPEM)
+		if err != nil {
+			fmt.Printf("%v", err)
+			return
+		}
+
+		exePath, err := os.Executable()
+		if err == nil {
+			exePath, err = filepath.EvalSymlinks(exePath)
+		}
+		if err != nil {
+			fmt.Printf("Failed to find this program's executable: %v", err)
+			return
+		}
+
+		version, updated, err := cmdState.SelfUpdate(*flagSelfUpdateURL, key, exePath)
+		if err != nil {
+			fmt.Printf("%v", err)
+			return
+		}
+		if updated {
+			cmdState.Printf("Updated %s from version %s to version %s.\n", exePath, command.Version, version)
+		} else {
+			cmdState.Printf("Version %s is the newest release.\n", command.Version)
+		}
+
+	case cmdExportHistory.FullCommand():
+		username := interactiveGetLoginUser()
+		password := interactiveGetLoginPassword()
+		host := interactiveGetHost()
+
+		err := cmdState.Authenticate(host, username, password)
+		if err != nil {
+			fmt.Printf("Failed to authenticate to the server %s: %v", host, err)
+			return
+		}
+
+		err = initCrypto(cmdState)
+		if err != nil {
+			fmt.Printf("Failed to initialize cryptography: %v", err)
+			return
+		}
+
+		count, err := cmdState.ExportHistory(*argExportHistoryTarget, *argExportHistoryDir)
+		if err != nil {
+			fmt.Printf("Failed to export the version history of %s: %v", *argExportHistoryTarget, err)
+			return
+		}
+		cmdState.Printf("Exported %d versions of %s to %s.\n", count, *argExportHistoryTarget, *argExportHistoryDir)
+
+	case cmdImportHistory.FullCommand():
+		username := interactiveGetLoginUser()
+		password := interactiveGetLoginPassword()
+		host := interactiveGetHost()
+
+		err := cmdState.Authenticate(host, username, password)
+		if err != nil {
+			fmt.Printf("Failed to authenticate to the server %s: %v", host, err)
+			return
+		}
+
+		err = initCrypto(cmdState)
+		if err != nil {
+			fmt.Printf("Failed to initialize cryptography: %v", err)
+			return
+		}
+
+		layout := *flagImportHistoryLayout
+		if *flagImportHistoryDirTime {
+			layout = ""
+		}
+		_, err = cmdState.ImportHistory(*argImportHistoryDir, *argImportHistoryTarget, layout)
+		if err != nil {
+			fmt.Printf("Failed to import the snapshots in %s: %v", *argImportHistoryDir, err)
+			return
+		}
+
+	case cmdAgent.FullCommand():
+		username := interactiveGetLoginUser()
+		password := interactiveGetLoginPassword()
+		host := interactiveGetHost()
+
+		// notices, like quota warnings, are shown on the desktop by the agent
+		if *flagAgentNotify {
+			cmdState.Notices = make(chan string, 8)
+		}
+
+		err := cmdState.Authenticate(host, username, password)
+		if err != nil {
+			fmt.Printf("Failed to authenticate to the server %s: %v", host, err)
+			return
+		}
+
+		err = initCrypto(cmdState)
+		if err != nil {
+			fmt.Printf("Failed to initialize cryptography: %v", err)
+			return
+		}
+
+		var paths []command.AgentPath
+		for _, p := range *argAgentPaths {
+			parts := strings.SplitN(p, ":", 2)
+			if len(parts) == 1 {
+				parts = append(parts, parts[0])
+			}
+			paths = append(paths, command.AgentPath{LocalDir: parts[0], RemoteDir: parts[1]})
+		}
+
+		agent := command.NewAgent(cmdState, username, password, paths, *flagAgentInterval)
+		if *flagAgentNotify {
+			agent.Notify = func(title string, message string) {
+				err := command.DesktopNotify(title, message)
+				if err != nil {
+					cmdState.Printf("%v\n", err)
+				}
+			}
+		}
+		if *flagAgentStatus == "" {
+			agent.Run(nil)
+			return
+		}
+
+		go agent.Run(nil)
+		cmdState.Printf("Serving the agent status on %s\n", *flagAgentStatus)
+		err = http.ListenAndServe(*flagAgentStatus, agent)
+		if err != nil {
+			fmt.Printf("Failed to serve the agent status: %v", err)
+			return
+		}
+
+	case cmdStatus.FullCommand():
+		status, err := command.GetAgentStatus(*flagStatusAddr)
+		if err != nil {
+			fmt.Printf("Failed to get the agent status: %v", err)
+			return
+		}
+
+		cmdState.Printf("Healthy:           %v\n", status.Healthy)
+		cmdState.Printf("Paused:            %v\n", status.Paused)
+		cmdState.Printf("Syncing:           %v (%d paths queued)\n", status.Syncing, status.QueueDepth)
+		if status.SyncCount > 0 {
+			cmdState.Printf("Last sync:         %s (%s, %d chunks changed)\n",
+				status.LastSyncEnd.Format(time.RFC3339), status.LastSyncEnd.Sub(status.LastSyncStart), status.LastChangeCount)
+		} else {
+			cmdState.Printf("Last sync:         never\n")
+		}
+		cmdState.Printf("Pending conflicts: %d\n", status.PendingConflicts)
+		cmdState.Printf("Deferred uploads:  %d\n", status.DeferredUploads)
+		cmdState.Printf("Low battery:       %v\n", status.LowBattery)
+		cmdState.Printf("Transfer rates:    %.0f B/s up, %.0f B/s down\n", status.UploadRate, status.DownloadRate)
+		cmdState.Printf("Transferred:       %d bytes up, %d bytes down\n", status.Totals.BytesUploaded, status.Totals.BytesDownloaded)
+		if status.LastError != "" {
+			cmdState.Printf("Last error:        %s\n", status.LastError)
+		}
+
+	case cmdBench.FullCommand():
+		username := interactiveGetLoginUser()
+		password := interactiveGetLoginPassword()
+		host := interactiveGetHost()
+
+		err := cmdState.Authenticate(host, username, password)
+		if err != nil {
+			fmt.Printf("Failed to authenticate to the server %s: %v", host, err)
+			return
+		}
+
+		err = initCrypto(cmdState)
+		if err != nil {
+			fmt.Printf("Failed to initialize cryptography: %v", err)
+			return
+		}
+
+		opts := command.BenchOptions{
+			Clients:  *flagBenchClients,
+			Files:    *flagBenchFiles,
+			FileSize: *flagBenchFileSize,
+		}
+		cmdState.Printf("Running %d clients with %d files of %d bytes each ...\n", opts.Clients, opts.Files, opts.FileSize)
+		result, err := cmdState.RunBench(opts)
+		if err != nil {
+			fmt.Printf("Failed to run the benchmark: %v", err)
+			return
+		}
+
+		cmdState.Printf("Duration:    %s\n", result.Duration)
+		for _, op := range []struct {
+			name      string
+			latencies command.BenchLatencies
+		}{{"Uploads", result.Uploads}, {"Downloads", result.Downloads}} {
+			l := op.latencies
+			cmdState.Printf("%-12s %d files; p50 %s, p90 %s, p99 %s, max %s\n", op.name+":", l.Count, l.P50, l.P90, l.P99, l.Max)
+		}
+		cmdState.Printf("Throughput:  %.0f B/s up, %.0f B/s down\n", result.UploadThroughput(), result.DownloadThroughput())
+		if result.Errors > 0 {
+			cmdState.Printf("Errors:      %d (first: %v)\n", result.Errors, result.FirstError)
+		}
+
+	case cmdPause.FullCommand():
+		err := command.ControlAgent(*flagPauseAddr, "pause")
+		if err != nil {
+			fmt.Printf("Failed to pause the agent: %v", err)
+			return
+		}
+		cmdState.Println("Agent paused")
+
+	case cmdResume.FullCommand():
+		err := command.ControlAgent(*flagResumeAddr, "resume")
+		if err != nil {
+			fmt.Printf("Failed to resume the agent: %v", err)
+			return
+		}
+		cmdState.Println("Agent resumed")
+
+	case cmdSyncNow.FullCommand():
+		err := command.ControlAgent(*flagSyncNowAddr, "sync")
+		if err != nil {
+			fmt.Printf("Failed to start a sync on the agent: %v", err)
+			return
+		}
+		cmdState.Println("Agent sync started")
+
+	case cmdDebugBundle.FullCommand():
+		// every global flag is included since any of them could matter, but
+		// nothing is asked for interactively
+		settings := make(map[string]string)
+		for _, f := range appFlags.Model().Flags {
+			settings[f.Name] = f.Value.String()
+		}
+		if *flagHost != "" {
+			cmdState.HostURI = interactiveGetHost()
+		}
+
+		output := *flagDebugBundleOut
+		if output == "" {
+			output = fmt.Sprintf("freezer-debug-%s.tar.gz", time.Now().Format("20060102-150405"))
+		}
+		f, err := os.Create(output)
+		if err != nil {
+			fmt.Printf("Failed to create the debug bundle: %v", err)
+			return
+		}
+		err = cmdState.WriteDebugBundle(f, command.DebugBundle{
+			Settings:  settings,
+			LogFiles:  *flagDebugBundleLogs,
+			AgentAddr: *flagDebugBundleAgent,
+			Username:  *flagUserName,
+			Password:  *flagUserPass,
+		})
+		if closeErr := f.Close(); err == nil {
+			err = closeErr
+		}
+		if err != nil {
+			fmt.Printf("Failed to write the debug bundle: %v", err)
+			return
+		}
+		cmdState.Printf("Wrote the debug bundle to %s; check it before attaching it to a bug report.\n", output)
+
+	case cmdTray.FullCommand():
+		err := runTray(*flagTrayAddr)
+		if err != nil {
+			fmt.Printf("Failed to show the agent in the system tray: %v", err)
+			return
+		}
+
+	case cmdBridgeHTTP.FullCommand():
+		username := interactiveGetLoginUser()
+		password := interactiveGetLoginPassword()
+		host := interactiveGetHost()
+
+		err := cmdState.Authenticate(host, username, password)
+		if err != nil {
+			fmt.Printf("Failed to authenticate to the server %s: %v", host, err)
+			return
+		}
+
+		err = initCrypto(cmdState)
+		if err != nil {
+			fmt.Printf("Failed to initialize cryptography: %v", err)
+			return
+		}
+
+		bridge := command.NewBridge(cmdState, username, password)
+		listenAddr := command.LocalListenAddr(*argBridgeHTTPListenAddr)
+		cmdState.Printf("Serving the files for %s over HTTP on %s\n", username, listenAddr)
+		err = http.ListenAndServe(listenAddr, bridge)
+		if err != nil {
+			fmt.Printf("Failed to serve the HTTP bridge: %v", err)
+			return
+		}
+
+	case cmdBridgeSFTP.FullCommand():
+		username := interactiveGetLoginUser()
+		password := interactiveGetLoginPassword()
+		host := interactiveGetHost()
+
+		keyBytes, err := ioutil.ReadFile(*flagBridgeSFTPHostKey)
+		if err != nil {
+			fmt.Printf("Failed to read the SSH host key file %s: %v", *flagBridgeSFTPHostKey, err)
+			return
+		}
+		hostKey, err := ssh.ParsePrivateKey(keyBytes)
+		if err != nil {
+			fmt.Printf("Failed to parse the SSH host key: %v", err)
+			return
+		}
+
+		err = cmdState.Authenticate(host, username, password)
+		if err != nil {
+			fmt.Printf("Failed to authenticate to the server %s: %v", host, err)
+			return
+		}
+
+		err = initCrypto(cmdState)
+		if err != nil {
+			fmt.Printf("Failed to initialize cryptography: %v", err)
+			return
+		}
+
+		bridge := command.NewBridge(cmdState, username, password)
+		cmdState.Printf("Serving the files for %s over SFTP on %s\n", username, *argBridgeSFTPListenAddr)
+		err = bridge.ServeSFTP(*argBridgeSFTPListenAddr, hostKey)
+		if err != nil {
+			fmt.Printf("Failed to serve the SFTP bridge: %v", err)
+			return
+		}
+
+	case cmdBridgeRestic.FullCommand():
+		username := interactiveGetLoginUser()
+		password := interactiveGetLoginPassword()
+		host := interactiveGetHost()
+
+		err := cmdState.Authenticate(host, username, password)
+		if err != nil {
+			fmt.Printf("Failed to authenticate to the server %s: %v", host, err)
+			return
+		}
+
+		err = initCrypto(cmdState)
+		if err != nil {
+			fmt.Printf("Failed to initialize cryptography: %v", err)
+			return
+		}
+
+		bridge := command.NewBridge(cmdState, username, password)
+		listenAddr := command.LocalListenAddr(*argBridgeResticListenAddr)
+		cmdState.Printf("Serving a restic repository for %s on %s\n", username, listenAddr)
+		err = http.ListenAndServe(listenAddr, bridge.ResticHandler(*flagBridgeResticPrefix))
+		if err != nil {
+			fmt.Printf("Failed to serve the restic bridge: %v", err)
+			return
+		}
+
+	case cmdLFSTransfer.FullCommand():
+		// stdin and stdout are used for the transfer protocol so nothing can be
+		// prompted for, all other output is suppressed and errors go to stderr.
+		if *flagUserName == "" || *flagUserPass == "" || *flagHost == "" || *flagCryptoPass == "" {
+			fmt.Fprintln(os.Stderr, "The user, password, host and cryptography password flags are required for lfs-transfer.")
+			os.Exit(1)
+		}
+		cmdState.SetQuiet(true)
+		username := interactiveGetLoginUser()
+		password := interactiveGetLoginPassword()
+		host := interactiveGetHost()
+
+		err := cmdState.Authenticate(host, username, password)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Failed to authenticate to the server %s: %v", host, err)
+			os.Exit(1)
+		}
+
+		err = initCrypto(cmdState)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Failed to initialize cryptography: %v", err)
+			os.Exit(1)
+		}
+
+		bridge := command.NewBridge(cmdState, username, password)
+		err = bridge.ServeLFSTransfer(os.Stdin, os.Stdout, *flagLFSTransferPrefix)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Failed to run the git-lfs transfer: %v", err)
+			os.Exit(1)
+		}
+
+	case cmdDockerBackup.FullCommand():
+		username := interactiveGetLoginUser()
+		password := interactiveGetLoginPassword()
+		host := interactiveGetHost()
+
+		err := cmdState.Authenticate(host, username, password)
+		if err != nil {
+			fmt.Printf("Failed to authenticate to the server %s: %v", host, err)
+			return
+		}
+
+		err = initCrypto(cmdState)
+		if err != nil {
+			fmt.Printf("Failed to initialize cryptography: %v", err)
+			return
+		}
+
+		remoteFilepath, err := cmdState.DockerBackup(*argDockerBackupVolume, *flagDockerPrefix)
+		if err != nil {
+			fmt.Printf("Failed to back up the Docker volume %s: %v", *argDockerBackupVolume, err)
+			return
+		}
+		cmdState.Printf("Backed up the Docker volume %s to %s.\n", *argDockerBackupVolume, remoteFilepath)
+
+	case cmdDockerRestore.FullCommand():
+		username := interactiveGetLoginUser()
+		password := interactiveGetLoginPassword()
+		host := interactiveGetHost()
+
+		err := cmdState.Authenticate(host, username, password)
+		if err != nil {
+			fmt.Printf("Failed to authenticate to the server %s: %v", host, err)
+			return
+		}
+
+		err = initCrypto(cmdState)
+		if err != nil {
+			fmt.Printf("Failed to initialize cryptography: %v", err)
+			return
+		}
+
+		err = cmdState.DockerRestore(*argDockerRestoreVolume, *flagDockerPrefix, *argDockerRestoreTarget)
+		if err != nil {
+			fmt.Printf("Failed to restore the Docker volume %s: %v", *argDockerRestoreVolume, err)
+			return
+		}
+
+	case cmdPGDump.FullCommand():
+		username := interactiveGetLoginUser()
+		password := interactiveGetLoginPassword()
+		host := interactiveGetHost()
+
+		err := cmdState.Authenticate(host, username, password)
+		if err != nil {
+			fmt.Printf("Failed to authenticate to the server %s: %v", host, err)
+			return
+		}
+
+		err = initCrypto(cmdState)
+		if err != nil {
+			fmt.Printf("Failed to initialize cryptography: %v", err)
+			return
+		}
+
+		args := append(*flagPGDumpArgs, "--dbname", *flagPGDumpDB)
+		err = cmdState.DumpDatabase("pg_dump", args, *argPGDumpTarget)
+		if err != nil {
+			fmt.Printf("Failed to dump the database %s: %v", *flagPGDumpDB, err)
+			return
+		}
+
+	case cmdPGRestore.FullCommand():
+		username := interactiveGetLoginUser()
+		password := interactiveGetLoginPassword()
+		host := interactiveGetHost()
+
+		err := cmdState.Authenticate(host, username, password)
+		if err != nil {
+			fmt.Printf("Failed to authenticate to the server %s: %v", host, err)
+			return
+		}
+
+		err = initCrypto(cmdState)
+		if err != nil {
+			fmt.Printf("Failed to initialize cryptography: %v", err)
+			return
+		}
+
+		args := append(*flagPGRestoreArgs, "--dbname", *flagPGRestoreDB)
+		err = cmdState.RestoreDatabase("psql", args, *argPGRestoreTarget)
+		if err != nil {
+			fmt.Printf("Failed to restore the database %s: %v", *flagPGRestoreDB, err)
+			return
+		}
+
+	case cmdMySQLDump.FullCommand():
+		username := interactiveGetLoginUser()
+		password := interactiveGetLoginPassword()
+		host := interactiveGetHost()
+
+		err := cmdState.Authenticate(host, username, password)
+		if err != nil {
+			fmt.Printf("Failed to authenticate to the server %s: %v", host, err)
+			return
+		}
+
+		err = initCrypto(cmdState)
+		if err != nil {
+			fmt.Printf("Failed to initialize cryptography: %v", err)
+			return
+		}
+
+		args := append(*flagMySQLDumpArgs, "--single-transaction", *flagMySQLDumpDB)
+		err = cmdState.DumpDatabase("mysqldump", args, *argMySQLDumpTarget)
+		if err != nil {
+			fmt.Printf("Failed to dump the database %s: %v", *flagMySQLDumpDB, err)
+			return
+		}
+
+	case cmdMySQLRestore.FullCommand():
+		username := interactiveGetLoginUser()
+		password := interactiveGetLoginPassword()
+		host := interactiveGetHost()
+
+		err := cmdState.Authenticate(host, username, password)
+		if err != nil {
+			fmt.Printf("Failed to authenticate to the server %s: %v", host, err)
+			return
+		}
+
+		err = initCrypto(cmdState)
+		if err != nil {
+			fmt.Printf("Failed to initialize cryptography: %v", err)
+			return
+		}
+
+		args := append(*flagMySQLRestoreArgs, *flagMySQLRestoreDB)
+		err = cmdState.RestoreDatabase("mysql", args, *argMySQLRestoreTarget)
+		if err != nil {
+			fmt.Printf("Failed to restore the database %s: %v", *flagMySQLRestoreDB, err)
+			return
+		}
+
+	case cmdShareAdd.FullCommand():
+		username := interactiveGetLoginUser()
+		password := interactiveGetLoginPassword()
+		host := interactiveGetHost()
+
+		err := cmdState.Authenticate(host, username, password)
+		if err != nil {
+			fmt.Printf("Failed to authenticate to the server %s: %v", host, err)
+			return
+		}
+
+		err = initCrypto(cmdState)
+		if err != nil {
+			fmt.Printf("Failed to initialize cryptography: %v", err)
+			return
+		}
+
+		shares, err := cmdState.ShareFiles(*argShareAddTarget, *argShareAddName, command.ShareOptions{
+			ContentType:  *flagShareAddType,
+			Password:     *flagShareAddPass,
+			MaxDownloads: *flagShareAddMax,
+		})
+		if err != nil {
+			fmt.Printf("Failed to share %s: %v", *argShareAddTarget, err)
+			return
+		}
+		for _, share := range shares {
+			cmdState.Printf("%s/public/%s/%s\n", host, username, share.Name)
+		}
+
+		// a directory gets a code for its listing instead of one per file
+		if *flagShareAddQR || *flagShareAddQRPNG != "" {
+			shareName := *argShareAddName
+			if shareName == "" {
+				shareName = *argShareAddTarget
+			}
+			shareName = strings.Trim(shareName, "/")
+			if shares[0].Name != shareName {
+				shareName += "/"
+			}
+			shareURL := fmt.Sprintf("%s/public/%s/%s", host, username, shareName)
+			if *flagShareAddQR {
+				err = cmdState.PrintQRCode(shareURL)
+				if err != nil {
+					fmt.Printf("Failed to print the QR code: %v", err)
+					return
+				}
+			}
+			if *flagShareAddQRPNG != "" {
+				err = cmdState.WriteQRCodePNG(shareURL, *flagShareAddQRPNG)
+				if err != nil {
+					fmt.Printf("Failed to write the QR code: %v", err)
+					return
+				}
+			}
+		}
+
+	case cmdShareRm.FullCommand():
+		username := interactiveGetLoginUser()
+		password := interactiveGetLoginPassword()
+		host := interactiveGetHost()
+
+		err := cmdState.Authenticate(host, username, password)
+		if err != nil {
+			fmt.Printf("Failed to authenticate to the server %s: %v", host, err)
+			return
+		}
+
+		err = cmdState.RmShare(*argShareRmName)
+		if err != nil {
+			fmt.Printf("Failed to stop sharing %s: %v", *argShareRmName, err)
+			return
+		}
+
+	case cmdShareLs.FullCommand():
+		username := interactiveGetLoginUser()
+		password := interactiveGetLoginPassword()
+		host := interactiveGetHost()
+
+		err := cmdState.Authenticate(host, username, password)
+		if err != nil {
+			fmt.Printf("Failed to authenticate to the server %s: %v", host, err)
+			return
+		}
+
+		shares, err := cmdState.GetShares()
+		if err != nil {
+			fmt.Printf("Failed to get the list of shares: %v", err)
+			return
+		}
+		for _, share := range shares {
+			cmdState.Printf("%s/public/%s/%s\n", host, username, share.Name)
+		}
+
+	case cmdDropCreate.FullCommand():
+		username := interactiveGetLoginUser()
+		password := interactiveGetLoginPassword()
+		host := interactiveGetHost()
+
+		err := cmdState.Authenticate(host, username, password)
+		if err != nil {
+			fmt.Printf("Failed to authenticate to the server %s: %v", host, err)
+			return
+		}
+
+		err = initCrypto(cmdState)
+		if err != nil {
+			fmt.Printf("Failed to initialize cryptography: %v", err)
+			return
+		}
+
+		dt, err := cmdState.CreateDrop(*argDropCreateFolder, *flagDropCreateSize, *flagDropCreateFiles)
+		if err != nil {
+			fmt.Printf("Failed to create the upload link: %v", err)
+			return
+		}
+		cmdState.Printf("Files can be uploaded with: curl -T <file> %s/drop/%s/\n", host, dt.Token)
+
+	case cmdDropLs.FullCommand():
+		username := interactiveGetLoginUser()
+		password := interactiveGetLoginPassword()
+		host := interactiveGetHost()
+
+		err := cmdState.Authenticate(host, username, password)
+		if err != nil {
+			fmt.Printf("Failed to authenticate to the server %s: %v", host, err)
+			return
+		}
+
+		err = initCrypto(cmdState)
+		if err != nil {
+			fmt.Printf("Failed to initialize cryptography: %v", err)
+			return
+		}
+
+		drops, err := cmdState.GetDrops()
+		if err != nil {
+			fmt.Printf("Failed to get the upload links: %v", err)
+			return
+		}
+		for _, dt := range drops {
+			cmdState.Printf("%s/drop/%s/ -> %s (%d of %d files, max %d bytes)\n",
+				host, dt.Token, dt.Folder, dt.FileCount, dt.MaxFiles, dt.MaxFileSize)
+		}
+
+	case cmdDropRm.FullCommand():
+		username := interactiveGetLoginUser()
+		password := interactiveGetLoginPassword()
+		host := interactiveGetHost()
+
+		err := cmdState.Authenticate(host, username, password)
+		if err != nil {
+			fmt.Printf("Failed to authenticate to the server %s: %v", host, err)
+			return
+		}
+
+		err = initCrypto(cmdState)
+		if err != nil {
+			fmt.Printf("Failed to initialize cryptography: %v", err)
+			return
+		}
+
+		err = cmdState.RmDrop(*argDropRmToken)
+		if err != nil {
+			fmt.Printf("Failed to revoke the upload link: %v", err)
+			return
+		}
+
+	case cmdDropCollect.FullCommand():
+		username := interactiveGetLoginUser()
+		password := interactiveGetLoginPassword()
+		host := interactiveGetHost()
+
+		err := cmdState.Authenticate(host, username, password)
+		if err != nil {
+			fmt.Printf("Failed to authenticate to the server %s: %v", host, err)
+			return
+		}
+
+		err = initCrypto(cmdState)
+		if err != nil {
+			fmt.Printf("Failed to initialize cryptography: %v", err)
+			return
+		}
+
+		collectCount, err := cmdState.CollectDrops()
+		if err != nil {
+			fmt.Printf("Failed to collect the uploaded files: %v", err)
+			return
+		}
+		cmdState.Printf("Collected %d uploaded files.\n", collectCount)
+
+	case cmdAccountExport.FullCommand():
+		username := interactiveGetLoginUser()
+		password := interactiveGetLoginPassword()
+		host := interactiveGetHost()
+
+		err := cmdState.Authenticate(host, username, password)
+		if err != nil {
+			fmt.Printf("Failed to authenticate to the server %s: %v", host, err)
+			return
+		}
+
+		export, err := cmdState.ExportAccount(*argAccountExportFile)
+		if err != nil {
+			fmt.Printf("Failed to export the account: %v", err)
+			return
+		}
+		cmdState.Printf("Exported %d files to %s.\n", len(export.Files), *argAccountExportFile)
+
+	case cmdAccountDelete.FullCommand():
+		username := interactiveGetLoginUser()
+		password := interactiveGetLoginPassword()
+		host := interactiveGetHost()
+
+		err := cmdState.Authenticate(host, username, password)
+		if err != nil {
+			fmt.Printf("Failed to authenticate to the server %s: %v", host, err)
+			return
+		}
+
+		resp, err := cmdState.DeleteAccount(*flagAccountDeleteConfirm)
+		if err != nil {
+			fmt.Printf("Failed to request the account deletion: %v", err)
+			return
+		}
+		if resp.DeleteAt > 0 {
+			cmdState.Printf("The account will be erased at %s unless cancelled with 'account cancel'.\n", time.Unix(resp.DeleteAt, 0).Format(time.RFC1123))
+		} else {
+			cmdState.Printf("To erase the account and everything in it, run this before %s:\n", time.Unix(resp.ConfirmBy, 0).Format(time.RFC1123))
+			cmdState.Printf("  freezer account delete --confirm %s\n", resp.ConfirmToken)
+		}
+
+	case cmdAccountCancel.FullCommand():
+		username := interactiveGetLoginUser()
+		password := interactiveGetLoginPassword()
+		host := interactiveGetHost()
+
+		err := cmdState.Authenticate(host, username, password)
+		if err != nil {
+			fmt.Printf("Failed to authenticate to the server %s: %v", host, err)
+			return
+		}
+
+		err = cmdState.CancelAccountDeletion()
+		if err != nil {
+			fmt.Printf("Failed to cancel the account deletion: %v", err)
+			return
+		}
+
+	case cmdSupportGrant.FullCommand():
+		username := interactiveGetLoginUser()
+		password := interactiveGetLoginPassword()
+		host := interactiveGetHost()
+
+		err := cmdState.Authenticate(host, username, password)
+		if err != nil {
+			fmt.Printf("Failed to authenticate to the server %s: %v", host, err)
+			return
+		}
+
+		expires, err := cmdState.GrantSupport(*flagSupportGrantDuration)
+		if err != nil {
+			fmt.Printf("Failed to consent to support access: %v", err)
+			return
+		}
+		cmdState.Printf("Admins can make support tokens for the account until %s.\n", expires.Format(time.RFC1123))
+
+	case cmdSupportRevoke.FullCommand():
+		username := interactiveGetLoginUser()
+		password := interactiveGetLoginPassword()
+		host := interactiveGetHost()
+
+		err := cmdState.Authenticate(host, username, password)
+		if err != nil {
+			fmt.Printf("Failed to authenticate to the server %s: %v", host, err)
+			return
+		}
+
+		err = cmdState.RevokeSupport()
+		if err != nil {
+			fmt.Printf("Failed to withdraw the consent to support access: %v", err)
+			return
+		}
+
+	case cmdSupportAudit.FullCommand():
+		username := interactiveGetLoginUser()
+		password := interactiveGetLoginPassword()
+		host := interactiveGetHost()
+
+		err := cmdState.Authenticate(host, username, password)
+		if err != nil {
+			fmt.Printf("Failed to authenticate to the server %s: %v", host, err)
+			return
+		}
+
+		support, err := cmdState.GetSupport()
+		if err != nil {
+			fmt.Printf("Failed to get the support access audit: %v", err)
+			return
+		}
+		if support.ConsentExpires > 0 {
+			cmdState.Printf("Consent to support access until %s.\n", time.Unix(support.ConsentExpires, 0).Format(time.RFC1123))
+		} else {
+			cmdState.Println("No consent to support access.")
+		}
+		for _, entry := range support.Audit {
+			cmdState.Printf("%s  token %d  %s\n", time.Unix(entry.Time, 0).Format(time.RFC1123), entry.SupportID, entry.Action)
+		}
+
+	case cmdUserStats.FullCommand():
+		username := interactiveGetLoginUser()
+		password := interactiveGetLoginPassword()
+		host := interactiveGetHost()
+
+		err := cmdState.Authenticate(host, username, password)
+		if err != nil {
+			fmt.Printf("Failed to authenticate to the server %s: %v", host, err)
+			return
+		}
+
+		_, err = cmdState.GetUserStats()
+		if err != nil {
+			fmt.Printf("Failed to get the user stats from the server %s: %v", host, err)
+			return
+		}
+
+	case cmdUserBandwidth.FullCommand():
+		username := interactiveGetLoginUser()
+		password := interactiveGetLoginPassword()
+		host := interactiveGetHost()
+
+		err := cmdState.Authenticate(host, username, password)
+		if err != nil {
+			fmt.Printf("Failed to authenticate to the server %s: %v", host, err)
+			return
+		}
+
+		_, err = cmdState.GetUserBandwidth(*flagUserBandwidthDays)
+		if err != nil {
+			fmt.Printf("Failed to get the user bandwidth from the server %s: %v", host, err)
 			return
 		}
 
@@ -0,0 +1,70 @@
+// Copyright 2017, Timothy Bogdala <tdb@animal-machine.com>
+// See the LICENSE file for more details.
+
+//go:build gofuzz
+// +build gofuzz
+
+package models
+
+import (
+	"encoding/json"
+	"strings"
+)
+
+// Fuzz is the entry point for go-fuzz (github.com/dvyukov/go-fuzz) covering
+// the parsing of request parameters and bodies:
+//
+//	go-fuzz-build github.com/marcoziti/gringotts/cmd/freezer/models
+//	go-fuzz -bin=models-fuzz.zip -workdir=fuzz
+//
+// It panics if a parser accepts a value that breaks the guarantees it makes.
+// The parameter parsers also have native fuzz targets in params_test.go,
+// which go test runs with their seeds:
+//
+//	go test -fuzz FuzzCleanName ./cmd/freezer/models
+func Fuzz(data []byte) int {
+	value := string(data)
+	interesting := 0
+
+	if id, err := ParseID(value); err == nil {
+		if id < 1 {
+			panic("ParseID accepted a non-positive id")
+		}
+		interesting = 1
+	}
+	if n, err := ParseChunkNumber(value); err == nil {
+		if n < 0 {
+			panic("ParseChunkNumber accepted a negative chunk number")
+		}
+		interesting = 1
+	}
+	if name, err := CleanName(value); err == nil {
+		for _, element := range strings.Split(name, "/") {
+			if element == "" || element == "." || element == ".." {
+				panic("CleanName accepted a name that can escape a directory")
+			}
+		}
+		interesting = 1
+	}
+
+	var requests = []Validator{
+		&NewFileVersionRequest{},
+		&FilePatchRequest{},
+		&FileVersionUpdateRequest{},
+		&FileDeleteVersionsRequest{},
+		&FilePutRequest{},
+		&ShareAddRequest{},
+		&DropCreateRequest{},
+		&SupportConsentRequest{},
+		&AccountDeleteRequest{},
+		&FileLockRequest{},
+		&FileUnlockRequest{},
+	}
+	for _, req := range requests {
+		if json.Unmarshal(data, req) == nil && req.Validate() == nil {
+			interesting = 1
+		}
+	}
+
+	return interesting
+}
@@ -6,9 +6,129 @@ package models
 import "github.com/marcoziti/gringotts"
 
 // ServerCapabilities gets returned to the user to describe the features
-// that the server has to the client.
+// that the server has to the client. Clients check them when they log in so
+// that a server missing something they need is reported up front instead of
+// failing part way through an operation.
 type ServerCapabilities struct {
+	// ChunkSize is the number of bytes of file data in each chunk
 	ChunkSize int64
+
+	// LoginVersion is the newest login protocol the server supports; see
+	// LoginParamsResponse.
+	LoginVersion int
+
+	// ProtocolVersion is the version of these capabilities; it's zero for
+	// servers from before they were negotiated, which only report ChunkSize.
+	ProtocolVersion int
+
+	// MaxChunkUpload is the most bytes accepted for one encrypted chunk
+	MaxChunkUpload int64
+
+	// HashAlgorithms are the hashes the server accepts for files and chunks
+	HashAlgorithms []string
+
+	// CryptoVersions are the client encryption formats the server stores
+	CryptoVersions []int
+
+	// Features are the optional features the server has enabled
+	Features []string
+
+	// Chunking is how clients split files into chunks, one of the
+	// filefreezer.Chunking methods; it's empty for servers from before it
+	// was configurable, which means filefreezer.ChunkingFixed.
+	Chunking string
+}
+
+// Supports returns true if the server has the optional feature. Servers from
+// before capabilities were negotiated are assumed to have it since they can't
+// say otherwise.
+func (c ServerCapabilities) Supports(feature string) bool {
+	if c.ProtocolVersion == 0 {
+		return true
+	}
+	for _, f := range c.Features {
+		if f == feature {
+			return true
+		}
+	}
+	return false
+}
+
+const (
+	// ProtocolVersion is the version of ServerCapabilities described here
+	ProtocolVersion = 1
+
+	// HashSHA1 is the SHA-1 hash, URL base64 encoded, used for file and chunk hashes
+	HashSHA1 = "sha1"
+
+	// CryptoAESGCM is the encryption format with an AES-256-GCM nonce followed by
+	// the sealed data
+	CryptoAESGCM = 1
+)
+
+// The optional features a server can list in ServerCapabilities.Features.
+const (
+	FeatureRename       = "rename"
+	FeatureDuplicates   = "duplicates"
+	FeatureStreaming    = "streaming"
+	FeatureShares       = "shares"
+	FeaturePublicShares = "publicshares"
+	FeatureDrops        = "drops"
+	FeatureServerTime   = "time"
+	FeatureSupport      = "support"
+	FeatureReadOnly     = "readonly"
+	FeatureBandwidth    = "bandwidth"
+	FeatureRechunk      = "rechunk"
+	FeatureLocks        = "locks"
+	FeaturePatch        = "patch"
+	FeatureIdempotency  = "idempotency"
+)
+
+const (
+	// LoginPlaintext sends the plaintext password to log in.
+	LoginPlaintext = 1
+
+	// LoginDerived sends the password derived from the plaintext password with
+	// filefreezer.DeriveLoginPassword and the user's salt.
+	LoginDerived = 2
+)
+
+// QuotaWarningHeader is the response header servers set on the responses to
+// a user over one of the quota warning thresholds. Its value is the highest
+// threshold crossed, in percent of the quota.
+const QuotaWarningHeader = "X-Freezer-Quota-Warning"
+
+// EgressResetHeader is the response header servers set when turning away a
+// download from a user over their monthly egress limit. Its value is when the
+// limit resets, in Unix seconds.
+const EgressResetHeader = "X-Freezer-Egress-Reset"
+
+// FileLockedHeader is the response header servers set when a file lock
+// request conflicts with the lock of another client. Its value is when that
+// lock expires, in Unix seconds.
+const FileLockedHeader = "X-Freezer-File-Locked"
+
+// IdempotencyKeyHeader is the request header clients set to a unique key on
+// the requests that create or remove file versions. A server that lists
+// FeatureIdempotency answers a repeat of the request with the same key, such
+// as a retry after a timeout, with the response to the first one instead of
+// running it again.
+const IdempotencyKeyHeader = "Idempotency-Key"
+
+// IdempotentReplayHeader is the response header servers set on a response
+// that was stored for an earlier request with the same idempotency key.
+const IdempotentReplayHeader = "X-Freezer-Idempotent-Replay"
+
+// LoginParamsResponse is the JSON serializable response given by the
+// /api/users/login/params GET handler with what a client needs to log in.
+type LoginParamsResponse struct {
+	// Salt is the user's salt for deriving the login password
+	Salt string
+
+	// LoginVersion is the login protocol the server supports. It's the same for
+	// every user, so accounts made by older versions need one plaintext login
+	// after a derived login fails, which upgrades them.
+	LoginVersion int
 }
 
 // UserLoginResponse is the JSON serializable response given by the
@@ -17,6 +137,21 @@ type UserLoginResponse struct {
 	Token        string
 	CryptoHash   []byte
 	Capabilities ServerCapabilities
+
+	// ServerTime is the server's clock when the token was made (time in
+	// nanoseconds since 1/1/1970) so that clients can measure their skew.
+	ServerTime int64
+
+	// ExpiresAt is when the token expires by the server's clock (time in
+	// seconds since 1/1/1970).
+	ExpiresAt int64
+}
+
+// ServerTimeResponse is the JSON serializable response given by the
+// /api/time GET handler.
+type ServerTimeResponse struct {
+	// Time is the server's clock (time in nanoseconds since 1/1/1970)
+	Time int64
 }
 
 // UserCryptoHashUpdateRequest is the JSON serializable request sent to the
@@ -35,6 +170,37 @@ type UserCryptoHashUpdateResponse struct {
 // /api/user/stats GET handler.
 type UserStatsGetResponse struct {
 	Stats filefreezer.UserStats
+
+	// LogicalSize is the bytes of chunk data in all versions of the user's
+	// files and PhysicalSize is the bytes of the unique chunks among them.
+	// They're counted in the background along with FileCount and
+	// VersionCount, and UsageRevision is the revision they were counted at,
+	// which trails Stats.Revision until the server recounts them.
+	LogicalSize   int
+	PhysicalSize  int
+	FileCount     int
+	VersionCount  int
+	UsageRevision int
+
+	// Egress is the bytes downloaded this month and EgressLimit is the most
+	// the user can download each month, or zero if there's no limit.
+	Egress      int64
+	EgressLimit int64
+
+	// VersionLimit is the number of versions of each file kept for the user,
+	// from the user's or the server's limit, or zero if all are kept.
+	VersionLimit int
+
+	// PruningFrozen is true if file and version removal has been frozen
+	// for the account and FrozenReason will describe why.
+	PruningFrozen bool
+	FrozenReason  string
+}
+
+// UserBandwidthGetResponse is the JSON serializable response given by the
+// /api/user/bandwidth GET handler. Days without requests are left out.
+type UserBandwidthGetResponse struct {
+	Days []filefreezer.BandwidthDay
 }
 
 // AllFilesGetResponse is the JSON serializable response given by the
@@ -43,6 +209,13 @@ type AllFilesGetResponse struct {
 	Files []filefreezer.FileInfo
 }
 
+// DuplicateFilesGetResponse is the JSON serializable response given by the
+// /api/files/duplicates GET handler. Each group holds the files whose current
+// versions have the same content hash.
+type DuplicateFilesGetResponse struct {
+	Groups [][]filefreezer.FileInfo
+}
+
 // FileGetResponse is the JSON serializable response given by the
 // /api/file/{id} GET handlder.
 type FileGetResponse struct {
@@ -51,12 +224,58 @@ type FileGetResponse struct {
 }
 
 // NewFileVersionRequest is the JSON serializable request object sent to the
-// /api/file/{fileid}/version POST handler.
+// /api/file/{fileid}/version POST handler. Size, if set, is the number of
+// chunk bytes the client will upload for the version, which the server
+// reserves from the user's quota until they arrive.
 type NewFileVersionRequest struct {
 	Permissions uint32
 	LastMod     int64
 	ChunkCount  int
 	FileHash    string
+	Device      string
+	Size        int64
+}
+
+// FilePatchRequest is the JSON serializable request object sent to the
+// /api/file/{fileid}/patch POST handler. The new version keeps the chunks of
+// the base version except for the ones listed in Chunks, which the client
+// uploads afterwards along with any past the base version's chunk count.
+//
+// Sources, if set, is used instead of Chunks for files whose chunks move
+// around, such as with ChunkingFastCDC after bytes were inserted: it has the
+// base chunk number copied into each chunk number of the new version, or -1
+// for the chunks the client uploads.
+type FilePatchRequest struct {
+	BaseVersionID int
+	Permissions   uint32
+	LastMod       int64
+	ChunkCount    int
+	FileHash      string
+	Device        string
+	Chunks        []int
+	Sources       []int
+}
+
+// PatchSources returns the base chunk number copied into each chunk number of
+// the new version for the request, or -1 for the ones the client uploads, for
+// a base version with baseChunkCount chunks.
+func (r *FilePatchRequest) PatchSources(baseChunkCount int) []int {
+	if r.Sources != nil {
+		return r.Sources
+	}
+	if baseChunkCount > r.ChunkCount {
+		baseChunkCount = r.ChunkCount
+	}
+	sources := make([]int, baseChunkCount)
+	for i := range sources {
+		sources[i] = i
+	}
+	for _, n := range r.Chunks {
+		if n < len(sources) {
+			sources[n] = -1
+		}
+	}
+	return sources
 }
 
 // NewFileVersionResponse is the  JSON serializable response given by the
@@ -66,6 +285,20 @@ type NewFileVersionResponse struct {
 	Status bool
 }
 
+// FileVersionUpdateRequest is the JSON serializable request object sent to the
+// /api/file/{fileid}/version/{versionid} PUT handler to finalize a version once
+// all of its chunks have been uploaded.
+type FileVersionUpdateRequest struct {
+	ChunkCount int
+	FileHash   string
+}
+
+// FileVersionUpdateResponse is the JSON serializable response given by the
+// /api/file/{fileid}/version/{versionid} PUT handler.
+type FileVersionUpdateResponse struct {
+	Status bool
+}
+
 // FileGetAllVersionsResponse is the  JSON serializable response given by the
 // /api/file/{fileid}/versions GET handler.
 type FileGetAllVersionsResponse struct {
@@ -110,7 +343,9 @@ type FilePutResponse struct {
 }
 
 // FilePutRequest is the JSON serializable request object sent to the
-// /api/files PUT handlder.
+// /api/files PUT handlder. Size, if set, is the number of chunk bytes the
+// client will upload for the file, which the server reserves from the user's
+// quota until they arrive.
 type FilePutRequest struct {
 	FileName    string
 	IsDir       bool
@@ -118,6 +353,8 @@ type FilePutRequest struct {
 	LastMod     int64
 	ChunkCount  int
 	FileHash    string
+	Device      string
+	Size        int64
 }
 
 // FileDeleteRequest is the JSON serializable request object sent to the
@@ -131,3 +368,323 @@ type FileDeleteRequest struct {
 type FileDeleteResponse struct {
 	Success bool
 }
+
+// FileRenameRequest is the JSON serializable request object sent to the
+// /api/file/{id} PUT handler.
+type FileRenameRequest struct {
+	FileName string
+}
+
+// FileRenameResponse is the JSON serializable response object from
+// /api/file/{id} PUT handler.
+type FileRenameResponse struct {
+	Success bool
+}
+
+// ShareAddRequest is the JSON serializable request object sent to the
+// /api/shares POST handler to publish an unencrypted copy of a file.
+type ShareAddRequest struct {
+	Name        string
+	LastMod     int64
+	ChunkCount  int
+	FileHash    string
+	ContentType string
+
+	// Password is required to download the share if it isn't empty
+	Password string
+
+	// MaxDownloads limits the number of downloads if it isn't zero
+	MaxDownloads int
+}
+
+// ShareAddResponse is the JSON serializable response given by the
+// /api/shares POST handler.
+type ShareAddResponse struct {
+	filefreezer.Share
+}
+
+// SharesGetResponse is the JSON serializable response given by the
+// /api/shares GET handler.
+type SharesGetResponse struct {
+	Shares []filefreezer.Share
+}
+
+// ShareChunkPutResponse is the JSON serializable response given by the
+// /api/share/{shareid}/{chunknum} PUT handler.
+type ShareChunkPutResponse struct {
+	Status bool
+}
+
+// ShareDeleteResponse is the JSON serializable response given by the
+// /api/share/{shareid} DELETE handler.
+type ShareDeleteResponse struct {
+	Success bool
+}
+
+// PublicShareEntry is a single file in a public share listing.
+type PublicShareEntry struct {
+	Name        string
+	LastMod     int64
+	ChunkCount  int
+	ContentType string
+	Protected   bool
+	Size        int64
+}
+
+// PublicShareListResponse is the JSON serializable response given by the
+// anonymous /public/{username}/{prefix}/ GET handler.
+type PublicShareListResponse struct {
+	Files []PublicShareEntry
+}
+
+// DropCreateRequest is the JSON serializable request object sent to the
+// /api/drops POST handler to create an upload-only drop token.
+type DropCreateRequest struct {
+	Folder      string
+	MaxFileSize int64
+	MaxFiles    int
+}
+
+// DropCreateResponse is the JSON serializable response given by the
+// /api/drops POST handler.
+type DropCreateResponse struct {
+	filefreezer.DropToken
+}
+
+// DropsGetResponse is the JSON serializable response given by the
+// /api/drops GET handler.
+type DropsGetResponse struct {
+	Drops []filefreezer.DropToken
+}
+
+// DropDeleteResponse is the JSON serializable response given by the
+// /api/drop/{dropid} DELETE handler.
+type DropDeleteResponse struct {
+	Success bool
+}
+
+// DropFilesGetResponse is the JSON serializable response given by the
+// /api/dropfiles GET handler.
+type DropFilesGetResponse struct {
+	Files []filefreezer.DropFile
+}
+
+// DropFileDeleteResponse is the JSON serializable response given by the
+// /api/dropfile/{dropfileid} DELETE handler.
+type DropFileDeleteResponse struct {
+	Success bool
+}
+
+// FileLockRequest is the JSON serializable request object sent to the
+// /api/file/{fileid}/lock PUT handler to take or renew the lock on a file.
+type FileLockRequest struct {
+	// Token identifies the client taking the lock and Holder describes it
+	// to the other clients
+	Token  string
+	Holder string
+
+	// Seconds is how long the lock is held for unless it's renewed
+	Seconds int64
+}
+
+// FileUnlockRequest is the JSON serializable request object sent to the
+// /api/file/{fileid}/lock DELETE handler. The lock is only released if Token
+// holds it, unless Force is set.
+type FileUnlockRequest struct {
+	Token string
+	Force bool
+}
+
+// FileLockResponse is the JSON serializable response given by the
+// /api/file/{fileid}/lock handlers. A request that conflicts with the lock
+// of another client gets 409 Conflict along with that lock. Locked is false
+// if the file isn't locked, in which case Lock is empty.
+type FileLockResponse struct {
+	Lock   filefreezer.FileLock
+	Locked bool
+}
+
+// FileLocksGetResponse is the JSON serializable response given by the
+// /api/locks GET handler.
+type FileLocksGetResponse struct {
+	Locks []filefreezer.FileLock
+}
+
+// SupportConsentRequest is the JSON serializable request object sent to the
+// /api/user/support PUT handler.
+type SupportConsentRequest struct {
+	// Seconds is how long support tokens can be made for the account
+	Seconds int64
+}
+
+// SupportConsentResponse is the JSON serializable response given by the
+// /api/user/support PUT handler.
+type SupportConsentResponse struct {
+	// Expires is when the consent runs out in Unix seconds
+	Expires int64
+}
+
+// SupportGetResponse is the JSON serializable response given by the
+// /api/user/support GET handler.
+type SupportGetResponse struct {
+	// ConsentExpires is when the user's consent to support access runs out in
+	// Unix seconds, or zero if the user hasn't consented.
+	ConsentExpires int64
+
+	// Audit has every support token made for the account and every request
+	// made with them, oldest first.
+	Audit []filefreezer.SupportAudit
+}
+
+// SupportDeleteResponse is the JSON serializable response given by the
+// /api/user/support DELETE handler.
+type SupportDeleteResponse struct {
+	Success bool
+}
+
+// AccountExportResponse is the JSON serializable response given by the
+// /api/users/self/export GET handler. File names, devices and chunk data stay
+// encrypted; the chunks of every version are listed with the API path that
+// downloads them so that a client can fetch and decrypt the whole account.
+type AccountExportResponse struct {
+	// Exported is when the export was made in Unix seconds
+	Exported int64
+
+	Username     string
+	Stats        filefreezer.UserStats
+	Files        []AccountExportFile
+	Shares       []filefreezer.Share
+	Drops        []filefreezer.DropToken
+	SupportAudit []filefreezer.SupportAudit
+}
+
+// AccountExportFile is a file in an AccountExportResponse with all of its versions.
+type AccountExportFile struct {
+	filefreezer.FileInfo
+	Versions []AccountExportVersion
+}
+
+// AccountExportVersion is a file version in an AccountExportResponse with its chunks.
+type AccountExportVersion struct {
+	filefreezer.FileVersionInfo
+	Chunks []AccountExportChunk
+}
+
+// AccountExportChunk is a chunk of a file version in an AccountExportResponse.
+type AccountExportChunk struct {
+	ChunkNumber int
+	ChunkHash   string
+
+	// Path is the API path, such as /api/chunk/1/2/0, that the chunk's
+	// encrypted data is downloaded from.
+	Path string
+}
+
+// AccountDeleteRequest is the JSON serializable request object sent to the
+// /api/users/self/delete POST handler. Without a token it asks for the account
+// to be erased; the token from that response confirms it.
+type AccountDeleteRequest struct {
+	Confirm string
+}
+
+// AccountDeleteResponse is the JSON serializable response given by the
+// /api/users/self/delete handlers.
+type AccountDeleteResponse struct {
+	// ConfirmToken has to be sent back before ConfirmBy, in Unix seconds, to
+	// schedule the erasure; both are empty once it's scheduled.
+	ConfirmToken string
+	ConfirmBy    int64
+
+	// DeleteAt is when the account gets erased in Unix seconds, or zero if
+	// the erasure hasn't been scheduled.
+	DeleteAt int64
+}
+
+// DropUploadResponse is the JSON serializable response given by the
+// anonymous /drop/{token}/{filename} PUT handler.
+type DropUploadResponse struct {
+	Status bool
+	Name   string
+	Size   int64
+}
+
+// ErrorResponse is the JSON serializable response given when a request is
+// rejected before it gets handled, such as for being too large or invalid.
+type ErrorResponse struct {
+	Status int
+	Error  string
+
+	// Field is the name of the request field that failed validation, if any
+	Field string `json:",omitempty"`
+
+	// MinClientVersion is the oldest client version the server accepts; it's
+	// only set when the request was rejected for coming from an older client.
+	MinClientVersion string `json:",omitempty"`
+}
+
+// ReplicationUsersResponse is the JSON serializable response given by the
+// /replication/users GET handler that secondary servers poll to find the
+// accounts that changed on the primary.
+type ReplicationUsersResponse struct {
+	Users []ReplicationUser
+}
+
+// ReplicationUser is a user in a ReplicationUsersResponse along with the
+// revision of their account, which changes whenever its metadata does.
+type ReplicationUser struct {
+	UserID   int
+	Name     string
+	Revision int
+}
+
+// ReplicationUserResponse is the JSON serializable response given by the
+// /replication/user/:userid GET handler.
+type ReplicationUserResponse struct {
+	Replica filefreezer.UserReplica
+}
+
+// SnapshotManifest is written next to each database snapshot made with the
+// /admin/snapshot POST handler. It ties the snapshot to the exact set of
+// chunks it references so that a backup can be checked for completeness.
+type SnapshotManifest struct {
+	// Created is when the snapshot was made in Unix seconds
+	Created int64
+
+	// Database is the file name of the database snapshot in the same directory
+	Database string
+
+	DBVersion int
+	Chunks    []filefreezer.SnapshotChunk
+}
+
+// SnapshotResponse is the JSON serializable response given by the
+// /admin/snapshot POST handler.
+type SnapshotResponse struct {
+	Created int64
+
+	// Database and Manifest are the paths on the server of the database
+	// snapshot and its manifest.
+	Database string
+	Manifest string
+
+	// ChunkCount and ChunkBytes total up the chunks in the manifest.
+	ChunkCount int
+	ChunkBytes int64
+}
+
+// QuotaWarning is the JSON serializable body posted to the quota webhook when
+// a user crosses one of the quota warning thresholds.
+type QuotaWarning struct {
+	UserID    int
+	Name      string
+	Allocated int
+	Quota     int
+
+	// Percent is the part of the quota used and Threshold is the highest
+	// warning threshold it crossed.
+	Percent   int
+	Threshold int
+
+	// Time is when the threshold was crossed in Unix seconds
+	Time int64
+}
@@ -0,0 +1,82 @@
+// Copyright 2017, Timothy Bogdala <tdb@animal-machine.com>
+// See the LICENSE file for more details.
+
+package models
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"unicode/utf8"
+)
+
+const (
+	// MaxNameLength is the longest file, share or drop file name accepted.
+	MaxNameLength = 4096
+
+	// MaxLockSeconds is the longest a file lock can be taken for at once.
+	MaxLockSeconds = 24 * 60 * 60
+
+	// MaxDeviceLength is the longest device name accepted for a file version,
+	// which leaves room for the client encrypting a name of a few hundred bytes.
+	MaxDeviceLength = 1024
+
+	// MaxSharePasswordLength is the longest share password accepted, which is
+	// the most bytes that bcrypt hashes.
+	MaxSharePasswordLength = 72
+)
+
+// ParseID parses a database ID from a request. IDs are always positive and are
+// parsed as 32 bits so that they can't overflow an int on any platform.
+func ParseID(value string) (int, error) {
+	id, err := strconv.ParseInt(value, 10, 32)
+	if err != nil {
+		return 0, fmt.Errorf("%q is not a valid id", value)
+	}
+	if id < 1 {
+		return 0, fmt.Errorf("%q is not a valid id; ids are positive", value)
+	}
+	return int(id), nil
+}
+
+// ParseChunkNumber parses a chunk number from a request. Chunk numbers start at
+// zero and are parsed as 32 bits so that they can't overflow an int on any platform.
+func ParseChunkNumber(value string) (int, error) {
+	n, err := strconv.ParseInt(value, 10, 32)
+	if err != nil {
+		return 0, fmt.Errorf("%q is not a valid chunk number", value)
+	}
+	if n < 0 {
+		return 0, fmt.Errorf("%q is not a valid chunk number; chunk numbers are not negative", value)
+	}
+	return int(n), nil
+}
+
+// CleanName checks a plaintext name, such as a share name, and returns it
+// without leading or trailing slashes. Names must be valid UTF-8 without
+// control characters or backslashes, and none of their path elements can be
+// empty, "." or "..", so that they can't be used to escape a directory when
+// they are written to a filesystem.
+func CleanName(name string) (string, error) {
+	name = strings.Trim(name, "/")
+	if name == "" {
+		return "", fmt.Errorf("the name is empty")
+	}
+	if len(name) > MaxNameLength {
+		return "", fmt.Errorf("the name is longer than %d bytes", MaxNameLength)
+	}
+	if !utf8.ValidString(name) {
+		return "", fmt.Errorf("the name is not valid UTF-8")
+	}
+	for _, r := range name {
+		if r < 0x20 || r == 0x7f || r == '\\' {
+			return "", fmt.Errorf("the name contains a control character or backslash")
+		}
+	}
+	for _, element := range strings.Split(name, "/") {
+		if element == "" || element == "." || element == ".." {
+			return "", fmt.Errorf("the name has an empty, '.' or '..' path element")
+		}
+	}
+	return name, nil
+}
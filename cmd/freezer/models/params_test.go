@@ -0,0 +1,83 @@
+// Copyright 2017, Timothy Bogdala <tdb@animal-machine.com>
+// See the LICENSE file for more details.
+
+package models
+
+import (
+	"path"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"testing"
+)
+
+// parseSeeds are the values used to seed the id and chunk number fuzz targets.
+var parseSeeds = []string{
+	"0", "1", "42", "-1", "-0", "+7", "007", " 1", "1 ", "",
+	"2147483647", "2147483648", "-2147483648", "9223372036854775807",
+	"9223372036854775808", "18446744073709551616", "1e3", "0x10", "١",
+}
+
+func FuzzParseID(f *testing.F) {
+	for _, seed := range parseSeeds {
+		f.Add(seed)
+	}
+	f.Fuzz(func(t *testing.T, value string) {
+		id, err := ParseID(value)
+		if err != nil {
+			return
+		}
+		if id < 1 {
+			t.Fatalf("ParseID accepted the non-positive id %d from %q.", id, value)
+		}
+		if parsed, err := strconv.ParseInt(value, 10, 64); err != nil || parsed != int64(id) || parsed > 1<<31-1 {
+			t.Fatalf("ParseID returned %d for %q, which doesn't fit in 32 bits.", id, value)
+		}
+	})
+}
+
+func FuzzParseChunkNumber(f *testing.F) {
+	for _, seed := range parseSeeds {
+		f.Add(seed)
+	}
+	f.Fuzz(func(t *testing.T, value string) {
+		n, err := ParseChunkNumber(value)
+		if err != nil {
+			return
+		}
+		if n < 0 {
+			t.Fatalf("ParseChunkNumber accepted the negative chunk number %d from %q.", n, value)
+		}
+		if parsed, err := strconv.ParseInt(value, 10, 64); err != nil || parsed != int64(n) || parsed > 1<<31-1 {
+			t.Fatalf("ParseChunkNumber returned %d for %q, which doesn't fit in 32 bits.", n, value)
+		}
+	})
+}
+
+func FuzzCleanName(f *testing.F) {
+	for _, seed := range []string{
+		"file.txt", "/docs/report.pdf/", "a/b/c", "", "/", "//",
+		".", "..", "../etc/passwd", "a/../../b", "a/./b", "a//b", "./a",
+		"/etc/passwd", "C:/Windows", "C:\\Windows", "..\\..\\x", "\\\\server\\share",
+		"a\x00b", "a\nb", "\xff\xfe", "名前/ファイル", strings.Repeat("a", MaxNameLength+1),
+	} {
+		f.Add(seed)
+	}
+	f.Fuzz(func(t *testing.T, name string) {
+		cleaned, err := CleanName(name)
+		if err != nil {
+			return
+		}
+		if cleaned == "" || strings.HasPrefix(cleaned, "/") || path.Clean(cleaned) != cleaned {
+			t.Fatalf("CleanName returned %q for %q, which isn't a clean relative path.", cleaned, name)
+		}
+
+		// the name has to stay under the directory it gets written to
+		root := filepath.Join("tmp", "root")
+		joined := filepath.Join(root, filepath.FromSlash(cleaned))
+		rel, err := filepath.Rel(root, joined)
+		if err != nil || rel == "." || rel == ".." || strings.HasPrefix(rel, ".."+string(filepath.Separator)) || filepath.IsAbs(rel) {
+			t.Fatalf("CleanName returned %q for %q, which escapes the root as %q.", cleaned, name, joined)
+		}
+	})
+}
@@ -0,0 +1,199 @@
+// Copyright 2017, Timothy Bogdala <tdb@animal-machine.com>
+// See the LICENSE file for more details.
+
+package models
+
+import "fmt"
+
+// Validator is implemented by request objects that can check their own fields
+// before they get handled.
+type Validator interface {
+	Validate() error
+}
+
+// ValidationError describes a field of a request that failed validation.
+type ValidationError struct {
+	Field   string
+	Message string
+}
+
+// Error returns the field and the reason it failed validation.
+func (e *ValidationError) Error() string {
+	return fmt.Sprintf("%s %s", e.Field, e.Message)
+}
+
+// invalid returns a new ValidationError for the field.
+func invalid(field string, message string) error {
+	return &ValidationError{Field: field, Message: message}
+}
+
+// Validate checks the UserCryptoHashUpdateRequest fields.
+func (r *UserCryptoHashUpdateRequest) Validate() error {
+	if len(r.CryptoHash) == 0 {
+		return invalid("CryptoHash", "is required")
+	}
+	return nil
+}
+
+// Validate checks the NewFileVersionRequest fields.
+func (r *NewFileVersionRequest) Validate() error {
+	if r.ChunkCount < 0 {
+		return invalid("ChunkCount", "must not be negative")
+	}
+	if r.Size < 0 {
+		return invalid("Size", "must not be negative")
+	}
+	if len(r.Device) > MaxDeviceLength {
+		return invalid("Device", "is too long")
+	}
+	return nil
+}
+
+// Validate checks the FilePatchRequest fields.
+func (r *FilePatchRequest) Validate() error {
+	if r.ChunkCount < 0 {
+		return invalid("ChunkCount", "must not be negative")
+	}
+	if len(r.Device) > MaxDeviceLength {
+		return invalid("Device", "is too long")
+	}
+	for _, n := range r.Chunks {
+		if n < 0 || n >= r.ChunkCount {
+			return invalid("Chunks", "must be chunk numbers of the new version")
+		}
+	}
+	if len(r.Sources) > r.ChunkCount {
+		return invalid("Sources", "must not have more than ChunkCount entries")
+	}
+	for _, n := range r.Sources {
+		if n < -1 {
+			return invalid("Sources", "must be base chunk numbers or -1")
+		}
+	}
+	return nil
+}
+
+// Validate checks the FileVersionUpdateRequest fields.
+func (r *FileVersionUpdateRequest) Validate() error {
+	if r.ChunkCount < 0 {
+		return invalid("ChunkCount", "must not be negative")
+	}
+	return nil
+}
+
+// Validate checks the FileDeleteVersionsRequest fields. An empty range where
+// MaxVersion is less than MinVersion is allowed and removes nothing.
+func (r *FileDeleteVersionsRequest) Validate() error {
+	if r.MinVersion < 0 {
+		return invalid("MinVersion", "must not be negative")
+	}
+	if r.MaxVersion < 0 {
+		return invalid("MaxVersion", "must not be negative")
+	}
+	return nil
+}
+
+// Validate checks the FilePutRequest fields.
+func (r *FilePutRequest) Validate() error {
+	if r.FileName == "" {
+		return invalid("FileName", "is required")
+	}
+	if len(r.FileName) > 2*MaxNameLength {
+		// names are encrypted by the client, which makes them longer than the plaintext
+		return invalid("FileName", "is too long")
+	}
+	if r.ChunkCount < 0 {
+		return invalid("ChunkCount", "must not be negative")
+	}
+	if r.IsDir && r.ChunkCount != 0 {
+		return invalid("ChunkCount", "must be zero for a directory")
+	}
+	if r.Size < 0 {
+		return invalid("Size", "must not be negative")
+	}
+	if len(r.Device) > MaxDeviceLength {
+		return invalid("Device", "is too long")
+	}
+	return nil
+}
+
+// Validate checks the FileRenameRequest fields.
+func (r *FileRenameRequest) Validate() error {
+	if r.FileName == "" {
+		return invalid("FileName", "is required")
+	}
+	if len(r.FileName) > 2*MaxNameLength {
+		// names are encrypted by the client, which makes them longer than the plaintext
+		return invalid("FileName", "is too long")
+	}
+	return nil
+}
+
+// Validate checks the ShareAddRequest fields.
+func (r *ShareAddRequest) Validate() error {
+	if _, err := CleanName(r.Name); err != nil {
+		return invalid("Name", "is not valid: "+err.Error())
+	}
+	if r.ChunkCount < 0 {
+		return invalid("ChunkCount", "must not be negative")
+	}
+	if len(r.Password) > MaxSharePasswordLength {
+		return invalid("Password", "is too long")
+	}
+	if r.MaxDownloads < 0 {
+		return invalid("MaxDownloads", "must not be negative")
+	}
+	return nil
+}
+
+// Validate checks the DropCreateRequest fields.
+func (r *DropCreateRequest) Validate() error {
+	if r.Folder == "" {
+		return invalid("Folder", "is required")
+	}
+	if r.MaxFileSize <= 0 {
+		return invalid("MaxFileSize", "must be positive")
+	}
+	if r.MaxFiles < 0 {
+		return invalid("MaxFiles", "must not be negative")
+	}
+	return nil
+}
+
+// Validate checks the FileLockRequest fields.
+func (r *FileLockRequest) Validate() error {
+	if r.Token == "" {
+		return invalid("Token", "is required")
+	}
+	if len(r.Token) > MaxNameLength {
+		return invalid("Token", "is too long")
+	}
+	if len(r.Holder) > MaxDeviceLength {
+		return invalid("Holder", "is too long")
+	}
+	if r.Seconds <= 0 || r.Seconds > MaxLockSeconds {
+		return invalid("Seconds", fmt.Sprintf("must be between 1 and %d", MaxLockSeconds))
+	}
+	return nil
+}
+
+// Validate checks the FileUnlockRequest fields.
+func (r *FileUnlockRequest) Validate() error {
+	if r.Token == "" && !r.Force {
+		return invalid("Token", "is required unless the unlock is forced")
+	}
+	return nil
+}
+
+// Validate checks the SupportConsentRequest fields.
+func (r *SupportConsentRequest) Validate() error {
+	if r.Seconds <= 0 {
+		return invalid("Seconds", "must be positive")
+	}
+	return nil
+}
+
+// Validate checks the AccountDeleteRequest fields; an empty token is a new request.
+func (r *AccountDeleteRequest) Validate() error {
+	return nil
+}
@@ -0,0 +1,65 @@
+// Copyright 2017, Timothy Bogdala <tdb@animal-machine.com>
+// See the LICENSE file for more details.
+
+package models
+
+import (
+	"strconv"
+	"strings"
+)
+
+const (
+	// ClientVersionHeader is the request header clients send their version in.
+	ClientVersionHeader = "X-Freezer-Client"
+
+	// LatestClientHeader is the response header servers name the newest
+	// client version in, if they were configured with one.
+	LatestClientHeader = "X-Freezer-Latest-Client"
+)
+
+// CompareVersions compares two dotted version numbers such as 1.2.10 and
+// returns -1, 0 or 1 if a is older, the same as or newer than b. Missing parts
+// count as zero and anything after a dash, such as 1.2.0-beta, is ignored.
+// An empty version is older than any other.
+func CompareVersions(a, b string) int {
+	if a == "" || b == "" {
+		switch {
+		case a == b:
+			return 0
+		case a == "":
+			return -1
+		default:
+			return 1
+		}
+	}
+
+	aParts := versionParts(a)
+	bParts := versionParts(b)
+	for i := 0; i < len(aParts) || i < len(bParts); i++ {
+		var x, y int
+		if i < len(aParts) {
+			x = aParts[i]
+		}
+		if i < len(bParts) {
+			y = bParts[i]
+		}
+		if x < y {
+			return -1
+		} else if x > y {
+			return 1
+		}
+	}
+	return 0
+}
+
+func versionParts(v string) []int {
+	if i := strings.IndexByte(v, '-'); i >= 0 {
+		v = v[:i]
+	}
+	fields := strings.Split(strings.TrimPrefix(v, "v"), ".")
+	parts := make([]int, len(fields))
+	for i, f := range fields {
+		parts[i], _ = strconv.Atoi(f)
+	}
+	return parts
+}
@@ -0,0 +1,128 @@
+// Copyright 2017, Timothy Bogdala <tdb@animal-machine.com>
+// See the LICENSE file for more details.
+
+package main
+
+import (
+	"context"
+	"log"
+	"os"
+	"os/signal"
+	"syscall"
+	"time"
+
+	// register the cloud chunk stores
+	_ "github.com/marcoziti/gringotts/blobstore"
+	"github.com/marcoziti/gringotts/cmd/freezer/server"
+)
+
+// lowMemoryGCPercent is the garbage collection target used by serve --lowmemory.
+const lowMemoryGCPercent = 50
+
+// newServerConfig builds the server configuration from the command line flags.
+func newServerConfig() server.Config {
+	config := server.Config{
+		Backend:                 *flagServeBackend,
+		DatabasePath:            *flagDatabasePath,
+		ChunkStores:             *flagServeChunkStores,
+		ChunkStoreCheckInterval: *flagServeChunkStoreCheck,
+		ChunkKeysPath:           *flagServeChunkKeys,
+		ChunkSize:               *flagServeChunkSize,
+		Chunking:                *flagServeChunking,
+		JWTSecret:               []byte(*flagCryptoPass),
+		FreezeCount:             *flagServeFreezeCount,
+		FreezeWindow:            *flagServeFreezeWindow,
+		PublicShares:            *flagServePublic,
+		NoPlainLogin:            *flagServeNoPlainLogin,
+		MinClientVersion:        *flagServeMinClient,
+		LatestClientVersion:     *flagServeLatestClient,
+		MaxTransfers:            *flagServeMaxTransfers,
+		MaxUserTransfers:        *flagServeMaxUserTransfers,
+		MaxVersions:             *flagServeMaxVersions,
+		DeletionGrace:           *flagServeDeletionGrace,
+		LowMemory:               *flagServeLowMemory,
+		ReplicationSecret:       []byte(*flagServeReplSecret),
+		ReplicateFrom:           *flagServeReplFrom,
+		ReplicationInterval:     *flagServeReplInterval,
+		ReadOnly:                *flagServeReadOnly,
+		AdminToken:              *flagServeAdminToken,
+		SnapshotDir:             *flagServeSnapshotDir,
+		QuotaWarnings:           *flagServeQuotaWarn,
+		QuotaWebhook:            *flagServeQuotaWebhook,
+		RechunkInterval:         *flagServeRechunkInterval,
+		UsageInterval:           *flagServeUsageInterval,
+		SlowRequest:             *flagServeSlowRequest,
+		SlowQuery:               *flagServeSlowQuery,
+		Faults: server.FaultConfig{
+			Rate:  *flagServeFaultRate,
+			Delay: *flagServeFaultDelay,
+			Seed:  *flagServeFaultSeed,
+		},
+		Tracing: server.TracingConfig{
+			Endpoint:   *flagServeTraceEndpoint,
+			Insecure:   *flagServeTraceInsecure,
+			SampleRate: *flagServeTraceSample,
+		},
+		Logf: fmtPrintf,
+	}
+
+	// email usage reports if any admin addresses were supplied
+	if len(*flagServeReportTo) > 0 {
+		config.AdminEmail = &server.UsageReportConfig{
+			SMTPAddr: *flagServeSMTPAddr,
+			SMTPUser: *flagServeSMTPUser,
+			SMTPPass: *flagServeSMTPPass,
+			From:     *flagServeReportFrm,
+			To:       *flagServeReportTo,
+			Interval: *flagServeReportInt,
+		}
+	}
+
+	return config
+}
+
+// serve listens on the address from the command line, using TLS if the key and
+// certificate flags were set, and serves the filefreezer API until an interrupt
+// signal is received. The quit channel returned gets a message once the server
+// has been shut down or if it couldn't be started.
+func serve(srv *server.Server, readyCh chan bool) (quitCh chan bool) {
+	quitCh = make(chan bool, 1)
+
+	var err error
+	if len(*flagTLSCrt) < 1 || len(*flagTLSKey) < 1 {
+		fmtPrintf("Starting http server on %s ...", *argServeListenAddr)
+		err = srv.Start(*argServeListenAddr)
+	} else {
+		fmtPrintf("Starting https server on %s ...", *argServeListenAddr)
+		err = srv.StartTLS(*argServeListenAddr, *flagTLSCrt, *flagTLSKey)
+	}
+	if err != nil {
+		fmtPrintln(err)
+		quitCh <- true
+	} else {
+		// attempt to listen to the interrupt signal to signal the stop
+		// chan in a goroutine to call server shutdown.
+		// NOTE: doesn't appear to work on windows
+		stop := make(chan os.Signal)
+		signal.Notify(stop, os.Interrupt, syscall.SIGTERM)
+		go func() {
+			<-stop
+			ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+			defer cancel()
+			fmtPrintln("Shutting down server...")
+			if err := srv.Stop(ctx); err != nil {
+				log.Fatalf("could not shutdown: %v", err)
+			}
+
+			// pass the message on the quit channel that the server was stopped
+			quitCh <- true
+		}()
+	}
+
+	// now that the listener is up, send out the ready signal
+	if readyCh != nil {
+		readyCh <- true
+	}
+
+	return quitCh
+}
@@ -0,0 +1,253 @@
+// Copyright 2017, Timothy Bogdala <tdb@animal-machine.com>
+// See the LICENSE file for more details.
+
+package server
+
+import (
+	"crypto/rand"
+	"crypto/subtle"
+	"encoding/base64"
+	"fmt"
+	"net/http"
+	"time"
+
+	jwt "github.com/dgrijalva/jwt-go"
+	"github.com/labstack/echo"
+
+	"github.com/marcoziti/gringotts/cmd/freezer/models"
+)
+
+const (
+	// defaultDeletionGrace is the time between a user confirming the erasure
+	// of their account and the server erasing it.
+	defaultDeletionGrace = 7 * 24 * time.Hour
+
+	// deletionConfirmWindow is how long the token from an account deletion
+	// request can be used to confirm it.
+	deletionConfirmWindow = time.Hour
+)
+
+// startAccountDeletions launches a goroutine that erases the accounts whose
+// deletion grace period has ended every interval until the server is closed.
+func (state *serverState) startAccountDeletions(interval time.Duration) {
+	go func() {
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ticker.C:
+				state.eraseDueAccounts()
+			case <-state.quit:
+				return
+			}
+		}
+	}()
+}
+
+// eraseDueAccounts removes the users, with all of their files and chunks, whose
+// confirmed account deletions are due. Accounts with pruning frozen are kept
+// until an admin lifts the freeze, since the deletion may have been made with
+// stolen credentials.
+func (state *serverState) eraseDueAccounts() {
+	due, err := state.Storage.GetDueAccountDeletions(time.Now().UTC().Unix())
+	if err != nil {
+		state.printf("Failed to get the account deletions: %v\n", err)
+		return
+	}
+	if len(due) == 0 {
+		return
+	}
+
+	users, err := state.Storage.GetAllUsers()
+	if err != nil {
+		state.printf("Failed to get the users for the account deletions: %v\n", err)
+		return
+	}
+	names := make(map[int]string)
+	for _, user := range users {
+		names[user.ID] = user.Name
+	}
+
+	for _, deletion := range due {
+		name, found := names[deletion.UserID]
+		if !found {
+			state.Storage.RemoveAccountDeletion(deletion.UserID)
+			continue
+		}
+		frozen, _, _, err := state.Storage.GetUserPruningFreeze(deletion.UserID)
+		if err != nil || frozen {
+			continue
+		}
+
+		state.writeLock.RLock()
+		err = state.Storage.RemoveUser(name)
+		state.writeLock.RUnlock()
+		if err != nil {
+			state.printf("Failed to erase the account of %s: %v\n", name, err)
+			continue
+		}
+		state.printf("Erased the account of %s as they requested.\n", name)
+	}
+}
+
+// handleExportAccount returns all of the authenticated user's metadata along
+// with the paths to download every chunk of every file version.
+func handleExportAccount(state *serverState) echo.HandlerFunc {
+	return func(c echo.Context) error {
+		jwtToken := c.Get(jwtContextName).(*jwt.Token)
+		claims := jwtToken.Claims.(*jwtCustomClaims)
+
+		export := models.AccountExportResponse{
+			Exported: time.Now().UTC().Unix(),
+			Username: claims.Username,
+		}
+
+		stats, err := state.Storage.GetUserStats(claims.UserID)
+		if err != nil {
+			return c.String(http.StatusInternalServerError, "Failed to get the user stats for the export.")
+		}
+		export.Stats = *stats
+
+		fileInfos, err := state.Storage.GetAllUserFileInfos(claims.UserID)
+		if err != nil {
+			return c.String(http.StatusInternalServerError, "Failed to get the files for the export.")
+		}
+		for _, fi := range fileInfos {
+			file := models.AccountExportFile{FileInfo: fi}
+			versions, err := state.Storage.GetFileVersions(fi.FileID)
+			if err != nil {
+				return c.String(http.StatusInternalServerError, "Failed to get the file versions for the export.")
+			}
+			for _, version := range versions {
+				exportVersion := models.AccountExportVersion{FileVersionInfo: version}
+				chunks, err := state.Storage.GetFileChunkInfos(claims.UserID, fi.FileID, version.VersionID)
+				if err != nil {
+					return c.String(http.StatusInternalServerError, "Failed to get the file chunks for the export.")
+				}
+				for _, chunk := range chunks {
+					exportVersion.Chunks = append(exportVersion.Chunks, models.AccountExportChunk{
+						ChunkNumber: chunk.ChunkNumber,
+						ChunkHash:   chunk.ChunkHash,
+						Path:        fmt.Sprintf("/api/chunk/%d/%d/%d", fi.FileID, version.VersionID, chunk.ChunkNumber),
+					})
+				}
+				file.Versions = append(file.Versions, exportVersion)
+			}
+			export.Files = append(export.Files, file)
+		}
+
+		export.Shares, err = state.Storage.GetShares(claims.UserID)
+		if err != nil {
+			return c.String(http.StatusInternalServerError, "Failed to get the shares for the export.")
+		}
+		export.Drops, err = state.Storage.GetDropTokens(claims.UserID)
+		if err != nil {
+			return c.String(http.StatusInternalServerError, "Failed to get the drop tokens for the export.")
+		}
+		export.SupportAudit, err = state.Storage.GetSupportAudit(claims.UserID)
+		if err != nil {
+			return c.String(http.StatusInternalServerError, "Failed to get the support audit for the export.")
+		}
+
+		return c.JSON(http.StatusOK, &export)
+	}
+}
+
+// handleGetAccountDeletion returns the state of the authenticated user's
+// request to erase their account.
+func handleGetAccountDeletion(state *serverState) echo.HandlerFunc {
+	return func(c echo.Context) error {
+		jwtToken := c.Get(jwtContextName).(*jwt.Token)
+		claims := jwtToken.Claims.(*jwtCustomClaims)
+
+		deletion, err := state.Storage.GetAccountDeletion(claims.UserID)
+		if err != nil {
+			return c.String(http.StatusInternalServerError, "Failed to get the account deletion for the user.")
+		}
+
+		var resp models.AccountDeleteResponse
+		if deletion != nil {
+			resp.DeleteAt = deletion.DeleteAt
+		}
+		return c.JSON(http.StatusOK, &resp)
+	}
+}
+
+// handleDeleteAccount asks for the authenticated user's account to be erased.
+// A request without a token returns one that has to be sent back within
+// deletionConfirmWindow, which then schedules the erasure for when the grace
+// period ends. Requests for an account whose erasure is already scheduled
+// return the schedule unchanged.
+func handleDeleteAccount(state *serverState) echo.HandlerFunc {
+	return func(c echo.Context) error {
+		jwtToken := c.Get(jwtContextName).(*jwt.Token)
+		claims := jwtToken.Claims.(*jwtCustomClaims)
+
+		var req models.AccountDeleteRequest
+		err := bindRequest(c, &req)
+		if err != nil {
+			return sendRequestError(c, err)
+		}
+
+		deletion, err := state.Storage.GetAccountDeletion(claims.UserID)
+		if err != nil {
+			return c.String(http.StatusInternalServerError, "Failed to get the account deletion for the user.")
+		}
+		if deletion != nil && deletion.DeleteAt > 0 {
+			return c.JSON(http.StatusOK, &models.AccountDeleteResponse{DeleteAt: deletion.DeleteAt})
+		}
+
+		now := time.Now().UTC()
+		if req.Confirm == "" {
+			var randoms [24]byte
+			_, err = rand.Read(randoms[:])
+			if err != nil {
+				return c.String(http.StatusInternalServerError, "Failed to generate the confirmation token.")
+			}
+			token := base64.RawURLEncoding.EncodeToString(randoms[:])
+
+			err = state.Storage.SetAccountDeletion(claims.UserID, token, 0)
+			if err != nil {
+				return c.String(http.StatusInternalServerError, "Failed to request the account deletion: "+err.Error())
+			}
+			return c.JSON(http.StatusOK, &models.AccountDeleteResponse{
+				ConfirmToken: token,
+				ConfirmBy:    now.Add(deletionConfirmWindow).Unix(),
+			})
+		}
+
+		if deletion == nil || subtle.ConstantTimeCompare([]byte(req.Confirm), []byte(deletion.Token)) != 1 {
+			return c.String(http.StatusBadRequest, "The confirmation token doesn't match the account deletion request.")
+		}
+		if now.Unix() > deletion.Requested+int64(deletionConfirmWindow/time.Second) {
+			return c.String(http.StatusBadRequest, "The confirmation token has expired; request the account deletion again.")
+		}
+
+		deleteAt := now.Add(state.DeletionGrace).Unix()
+		err = state.Storage.SetAccountDeletion(claims.UserID, deletion.Token, deleteAt)
+		if err != nil {
+			return c.String(http.StatusInternalServerError, "Failed to schedule the account deletion: "+err.Error())
+		}
+		state.printf("The account of %s will be erased at %s.\n", claims.Username, time.Unix(deleteAt, 0).Format(time.RFC1123))
+
+		return c.JSON(http.StatusOK, &models.AccountDeleteResponse{
+			DeleteAt: deleteAt,
+		})
+	}
+}
+
+// handleCancelAccountDeletion cancels the authenticated user's request to
+// erase their account, whether or not it was confirmed.
+func handleCancelAccountDeletion(state *serverState) echo.HandlerFunc {
+	return func(c echo.Context) error {
+		jwtToken := c.Get(jwtContextName).(*jwt.Token)
+		claims := jwtToken.Claims.(*jwtCustomClaims)
+
+		err := state.Storage.RemoveAccountDeletion(claims.UserID)
+		if err != nil {
+			return c.String(http.StatusInternalServerError, "Failed to cancel the account deletion: "+err.Error())
+		}
+
+		return c.JSON(http.StatusOK, &models.AccountDeleteResponse{})
+	}
+}
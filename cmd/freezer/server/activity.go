@@ -0,0 +1,103 @@
+// Copyright 2017, Timothy Bogdala <tdb@animal-machine.com>
+// See the LICENSE file for more details.
+
+package server
+
+import (
+	"fmt"
+	"sync"
+	"time"
+)
+
+// activityMonitor watches the rate at which each user replaces files with new
+// versions. File data is encrypted client-side so the server cannot measure the
+// entropy of the content; instead a burst of replaced files within the window is
+// treated as the signature of ransomware rewriting a synced tree. When the
+// threshold is crossed, version pruning gets frozen for the account so that the
+// older, good versions cannot be removed until an admin lifts the freeze.
+type activityMonitor struct {
+	state *serverState
+
+	// Threshold is the number of new versions within Window that trips the monitor;
+	// a value less than one disables the monitor.
+	Threshold int
+
+	// Window is the length of the sliding window used to count new versions
+	Window time.Duration
+
+	lock   sync.Mutex
+	events map[int][]time.Time
+}
+
+// newActivityMonitor creates a new activity monitor for the server state.
+func newActivityMonitor(state *serverState, threshold int, window time.Duration) *activityMonitor {
+	m := new(activityMonitor)
+	m.state = state
+	m.Threshold = threshold
+	m.Window = window
+	m.events = make(map[int][]time.Time)
+	return m
+}
+
+// recordNewVersion logs a new file version for the user and freezes pruning
+// for the account if the threshold has been crossed.
+func (m *activityMonitor) recordNewVersion(userID int, username string) {
+	if m == nil || m.Threshold < 1 {
+		return
+	}
+
+	now := time.Now()
+	m.lock.Lock()
+
+	// drop any of the events that have fallen out of the window
+	cutoff := now.Add(-m.Window)
+	events := m.events[userID]
+	firstValid := 0
+	for firstValid < len(events) && events[firstValid].Before(cutoff) {
+		firstValid++
+	}
+	events = append(events[firstValid:], now)
+
+	tripped := len(events) >= m.Threshold
+	if tripped {
+		// reset the window so that the alert isn't repeated for every new version
+		events = nil
+	}
+	m.events[userID] = events
+	m.lock.Unlock()
+
+	if tripped {
+		m.freezeAccount(userID, username)
+	}
+}
+
+// freezeAccount freezes pruning for the user and alerts the admins.
+func (m *activityMonitor) freezeAccount(userID int, username string) {
+	frozen, _, _, err := m.state.Storage.GetUserPruningFreeze(userID)
+	if err != nil {
+		m.state.printf("Failed to check the pruning freeze for user %s: %v\n", username, err)
+		return
+	}
+	if frozen {
+		return
+	}
+
+	reason := fmt.Sprintf("%d or more file versions were created within %v, which matches the pattern "+
+		"of ransomware replacing files", m.Threshold, m.Window)
+	err = m.state.Storage.FreezeUserPruning(userID, reason)
+	if err != nil {
+		m.state.printf("Failed to freeze pruning for user %s: %v\n", username, err)
+		return
+	}
+	m.state.printf("Pruning frozen for user %s: %s\n", username, reason)
+
+	if m.state.AdminEmail != nil {
+		text := fmt.Sprintf("Version pruning and file removal have been frozen for the account %s.\n\n"+
+			"Reason: %s.\n\nOnce the account has been checked the freeze can be lifted with:\n"+
+			"    freezer user unfreeze -u %s\n", username, reason, username)
+		err = sendAdminEmail(*m.state.AdminEmail, "Filefreezer alert: pruning frozen for "+username, text)
+		if err != nil {
+			m.state.printf("Failed to email the admins about the pruning freeze for user %s: %v\n", username, err)
+		}
+	}
+}
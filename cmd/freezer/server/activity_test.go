@@ -0,0 +1,140 @@
+// Copyright 2017, Timothy Bogdala <tdb@animal-machine.com>
+// See the LICENSE file for more details.
+
+package server
+
+import (
+	"bufio"
+	"net"
+	"strings"
+	"testing"
+	"time"
+)
+
+// fakeSMTPServer accepts mail on a local port until the listener returned is
+// closed and sends the data of each message it receives to the channel.
+func fakeSMTPServer(t *testing.T) (net.Listener, <-chan string) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Failed to listen for SMTP: %v", err)
+	}
+	messages := make(chan string, 10)
+	go func() {
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+			go serveFakeSMTP(conn, messages)
+		}
+	}()
+	return l, messages
+}
+
+func serveFakeSMTP(conn net.Conn, messages chan<- string) {
+	defer conn.Close()
+	r := bufio.NewReader(conn)
+	conn.Write([]byte("220 localhost\r\n"))
+	for {
+		line, err := r.ReadString('\n')
+		if err != nil {
+			return
+		}
+		switch cmd := strings.ToUpper(strings.TrimSpace(line)); {
+		case strings.HasPrefix(cmd, "DATA"):
+			conn.Write([]byte("354 Go ahead\r\n"))
+			var data strings.Builder
+			for {
+				line, err = r.ReadString('\n')
+				if err != nil {
+					return
+				}
+				if line == ".\r\n" {
+					break
+				}
+				data.WriteString(line)
+			}
+			messages <- data.String()
+			conn.Write([]byte("250 OK\r\n"))
+		case strings.HasPrefix(cmd, "QUIT"):
+			conn.Write([]byte("221 Bye\r\n"))
+			return
+		default:
+			conn.Write([]byte("250 OK\r\n"))
+		}
+	}
+}
+
+func TestActivityMonitor(t *testing.T) {
+	smtp, messages := fakeSMTPServer(t)
+	defer smtp.Close()
+	srv, err := New(Config{
+		DatabasePath: "file:activitymonitor?mode=memory&cache=shared",
+		ChunkSize:    1024,
+		FreezeCount:  3,
+		FreezeWindow: time.Minute,
+		AdminEmail: &UsageReportConfig{
+			SMTPAddr: smtp.Addr().String(),
+			From:     "freezer@example.com",
+			To:       []string{"admin@example.com"},
+			Interval: time.Hour,
+		},
+	})
+	if err != nil {
+		t.Fatalf("Failed to create the server: %v", err)
+	}
+	defer srv.Close()
+
+	user, err := srv.Storage.AddUser("alice", "salt", []byte("saltedhash"), 1e6)
+	if err != nil {
+		t.Fatalf("Failed to add a user: %v", err)
+	}
+	monitor := srv.state.Activity
+
+	// versions that fell out of the window don't count towards the burst
+	old := time.Now().Add(-2 * time.Minute)
+	monitor.events[user.ID] = []time.Time{old, old}
+	monitor.recordNewVersion(user.ID, "alice")
+	monitor.recordNewVersion(user.ID, "alice")
+	if frozen, _, _, err := srv.Storage.GetUserPruningFreeze(user.ID); err != nil || frozen {
+		t.Fatalf("Expected pruning not to be frozen below the threshold: %v", err)
+	}
+
+	// the burst freezes pruning and alerts the admins
+	monitor.recordNewVersion(user.ID, "alice")
+	frozen, _, reason, err := srv.Storage.GetUserPruningFreeze(user.ID)
+	if err != nil || !frozen || !strings.Contains(reason, "3 or more file versions") {
+		t.Fatalf("Expected pruning to be frozen after the burst (%q): %v", reason, err)
+	}
+	if len(monitor.events[user.ID]) != 0 {
+		t.Fatalf("Expected the window to be reset after the freeze but it has %d events.", len(monitor.events[user.ID]))
+	}
+	select {
+	case msg := <-messages:
+		if !strings.Contains(msg, "Subject: Filefreezer alert: pruning frozen for alice") ||
+			!strings.Contains(msg, "freezer user unfreeze -u alice") {
+			t.Fatalf("The admin alert doesn't describe the freeze:\n%s", msg)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("Expected the admins to be emailed about the freeze.")
+	}
+
+	// another burst on a frozen account doesn't alert the admins again
+	for i := 0; i < 3; i++ {
+		monitor.recordNewVersion(user.ID, "alice")
+	}
+	select {
+	case msg := <-messages:
+		t.Fatalf("Expected no second alert for a frozen account:\n%s", msg)
+	case <-time.After(100 * time.Millisecond):
+	}
+
+	// a monitor without a threshold never trips
+	disabled := newActivityMonitor(srv.state, 0, time.Minute)
+	for i := 0; i < 10; i++ {
+		disabled.recordNewVersion(user.ID, "alice")
+	}
+	if len(disabled.events) != 0 {
+		t.Fatal("Expected a disabled monitor not to record versions.")
+	}
+}
@@ -0,0 +1,96 @@
+// Copyright 2017, Timothy Bogdala <tdb@animal-machine.com>
+// See the LICENSE file for more details.
+
+package server
+
+import (
+	"io"
+	"net/http"
+	"strconv"
+	"time"
+
+	jwt "github.com/dgrijalva/jwt-go"
+	"github.com/labstack/echo"
+	"github.com/marcoziti/gringotts"
+
+	"github.com/marcoziti/gringotts/cmd/freezer/models"
+)
+
+const (
+	// defaultBandwidthDays is how many days of bandwidth are returned when
+	// the request doesn't say.
+	defaultBandwidthDays = 30
+
+	// maxBandwidthDays is the most days of bandwidth a request can ask for.
+	maxBandwidthDays = 366
+)
+
+// countingReader counts the bytes read through it.
+type countingReader struct {
+	io.ReadCloser
+	count int64
+}
+
+func (r *countingReader) Read(p []byte) (int, error) {
+	n, err := r.ReadCloser.Read(p)
+	r.count += int64(n)
+	return n, err
+}
+
+// meterBandwidth is middleware for the authenticated routes that adds every
+// request to the user's bandwidth for the day, counting the bytes of the
+// request body that were read and of the response body that was written.
+func meterBandwidth(state *serverState) echo.MiddlewareFunc {
+	return func(next echo.HandlerFunc) echo.HandlerFunc {
+		return func(c echo.Context) error {
+			jwtToken, ok := c.Get(jwtContextName).(*jwt.Token)
+			if !ok {
+				return next(c)
+			}
+			claims := jwtToken.Claims.(*jwtCustomClaims)
+
+			req := c.Request()
+			body := &countingReader{ReadCloser: req.Body}
+			if req.Body != nil {
+				req.Body = body
+			}
+
+			err := next(c)
+
+			day := time.Now().UTC().Format(filefreezer.BandwidthDayFormat)
+			bwErr := state.Storage.AddUserBandwidth(claims.UserID, day, body.count, c.Response().Size)
+			if bwErr != nil {
+				state.printf("Failed to record the bandwidth for user %s: %v\n", claims.Username, bwErr)
+			}
+			return err
+		}
+	}
+}
+
+// handleGetUserBandwidth returns the authenticated user's bandwidth for each
+// of the last days, which defaults to defaultBandwidthDays, including today.
+func handleGetUserBandwidth(state *serverState) echo.HandlerFunc {
+	return func(c echo.Context) error {
+		jwtToken := c.Get(jwtContextName).(*jwt.Token)
+		claims := jwtToken.Claims.(*jwtCustomClaims)
+
+		days := defaultBandwidthDays
+		if param := c.QueryParam("days"); param != "" {
+			var err error
+			days, err = strconv.Atoi(param)
+			if err != nil || days < 1 || days > maxBandwidthDays {
+				return c.String(http.StatusBadRequest, "The days must be a number from 1 to "+strconv.Itoa(maxBandwidthDays)+".")
+			}
+		}
+
+		since := time.Now().UTC().AddDate(0, 0, 1-days).Format(filefreezer.BandwidthDayFormat)
+		bandwidth, err := state.Storage.GetUserBandwidth(claims.UserID, since)
+		if err != nil {
+			return c.String(http.StatusInternalServerError, "Failed to get the bandwidth for the authenticated user.")
+		}
+
+		return c.JSON(http.StatusOK, &models.UserBandwidthGetResponse{
+			Days: bandwidth,
+		})
+	}
+}
@@ -0,0 +1,45 @@
+// Copyright 2017, Timothy Bogdala <tdb@animal-machine.com>
+// See the LICENSE file for more details.
+
+package server
+
+import (
+	"fmt"
+	"net/http"
+	"strings"
+
+	"github.com/labstack/echo"
+
+	"github.com/marcoziti/gringotts/cmd/freezer/models"
+)
+
+// checkClientVersion is middleware for the API routes that rejects clients
+// older than MinClientVersion with 426 Upgrade Required and names the newest
+// client in a header of every response so that clients can tell their users
+// about it. Clients from before versions were sent are treated as older than
+// any version.
+func checkClientVersion(state *serverState) echo.MiddlewareFunc {
+	return func(next echo.HandlerFunc) echo.HandlerFunc {
+		return func(c echo.Context) error {
+			if !strings.HasPrefix(c.Request().URL.Path, "/api/") {
+				return next(c)
+			}
+			if state.LatestClientVersion != "" {
+				c.Response().Header().Set(models.LatestClientHeader, state.LatestClientVersion)
+			}
+
+			version := c.Request().Header.Get(models.ClientVersionHeader)
+			if state.MinClientVersion != "" && models.CompareVersions(version, state.MinClientVersion) < 0 {
+				if version == "" {
+					version = "unknown"
+				}
+				return c.JSON(http.StatusUpgradeRequired, &models.ErrorResponse{
+					Status:           http.StatusUpgradeRequired,
+					Error:            fmt.Sprintf("Client version %s is older than the oldest version this server supports (%s).", version, state.MinClientVersion),
+					MinClientVersion: state.MinClientVersion,
+				})
+			}
+			return next(c)
+		}
+	}
+}
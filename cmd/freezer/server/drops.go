@@ -0,0 +1,194 @@
+// Copyright 2017, Timothy Bogdala <tdb@animal-machine.com>
+// See the LICENSE file for more details.
+
+package server
+
+import (
+	"crypto/rand"
+	"encoding/base64"
+	"errors"
+	"net/http"
+	"strconv"
+	"strings"
+
+	jwt "github.com/dgrijalva/jwt-go"
+	"github.com/labstack/echo"
+
+	"github.com/marcoziti/gringotts"
+	"github.com/marcoziti/gringotts/cmd/freezer/models"
+)
+
+const (
+	// maxDropFileSize is the largest file that can be uploaded with a drop token,
+	// which matches the default maximum BLOB size for sqlite.
+	maxDropFileSize = 1000000000
+)
+
+// handleCreateDrop creates a new upload-only drop token for the authenticated user.
+// The folder is stored as given, which the client encrypts like any other file name.
+func handleCreateDrop(state *serverState) echo.HandlerFunc {
+	return func(c echo.Context) error {
+		jwtToken := c.Get(jwtContextName).(*jwt.Token)
+		claims := jwtToken.Claims.(*jwtCustomClaims)
+
+		var postReq models.DropCreateRequest
+		err := bindRequest(c, &postReq)
+		if err != nil {
+			return sendRequestError(c, err)
+		}
+		if postReq.Folder == "" || postReq.MaxFiles < 0 {
+			return c.String(http.StatusBadRequest, "A valid folder and file count limit are required.")
+		}
+		if postReq.MaxFileSize <= 0 || postReq.MaxFileSize > maxDropFileSize {
+			return c.String(http.StatusBadRequest, "The file size limit must be between 1 and "+strconv.Itoa(maxDropFileSize)+" bytes.")
+		}
+
+		var randoms [24]byte
+		_, err = rand.Read(randoms[:])
+		if err != nil {
+			return c.String(http.StatusInternalServerError, "Failed to generate the drop token.")
+		}
+		token := base64.RawURLEncoding.EncodeToString(randoms[:])
+
+		dt, err := state.Storage.AddDropToken(claims.UserID, token, postReq.Folder, postReq.MaxFileSize, postReq.MaxFiles)
+		if err != nil {
+			return c.String(http.StatusInternalServerError, "Failed to add the drop token: "+err.Error())
+		}
+
+		return c.JSON(http.StatusOK, &models.DropCreateResponse{
+			DropToken: *dt,
+		})
+	}
+}
+
+// handleGetDrops returns all of the drop tokens for the authenticated user.
+func handleGetDrops(state *serverState) echo.HandlerFunc {
+	return func(c echo.Context) error {
+		jwtToken := c.Get(jwtContextName).(*jwt.Token)
+		claims := jwtToken.Claims.(*jwtCustomClaims)
+
+		drops, err := state.Storage.GetDropTokens(claims.UserID)
+		if err != nil {
+			return c.String(http.StatusNotFound, "Failed to get the drop tokens for the user.")
+		}
+
+		return c.JSON(http.StatusOK, &models.DropsGetResponse{
+			Drops: drops,
+		})
+	}
+}
+
+// handleDeleteDrop revokes a drop token for the authenticated user.
+func handleDeleteDrop(state *serverState) echo.HandlerFunc {
+	return func(c echo.Context) error {
+		jwtToken := c.Get(jwtContextName).(*jwt.Token)
+		claims := jwtToken.Claims.(*jwtCustomClaims)
+
+		dropID, err := models.ParseID(c.Param("dropid"))
+		if err != nil {
+			return c.String(http.StatusBadRequest, "A valid integer was not used for the drop id in the URI.")
+		}
+
+		err = state.Storage.RemoveDropToken(claims.UserID, dropID)
+		if err != nil {
+			return c.String(http.StatusNotFound, "Failed to remove the drop token: "+err.Error())
+		}
+
+		return c.JSON(http.StatusOK, &models.DropDeleteResponse{
+			Success: true,
+		})
+	}
+}
+
+// handleGetDropFiles returns the files uploaded with the authenticated user's drop
+// tokens that haven't been collected yet.
+func handleGetDropFiles(state *serverState) echo.HandlerFunc {
+	return func(c echo.Context) error {
+		jwtToken := c.Get(jwtContextName).(*jwt.Token)
+		claims := jwtToken.Claims.(*jwtCustomClaims)
+
+		files, err := state.Storage.GetDropFiles(claims.UserID)
+		if err != nil {
+			return c.String(http.StatusNotFound, "Failed to get the drop files for the user.")
+		}
+
+		return c.JSON(http.StatusOK, &models.DropFilesGetResponse{
+			Files: files,
+		})
+	}
+}
+
+// handleGetDropFile returns the raw bytes of an uncollected drop file.
+func handleGetDropFile(state *serverState) echo.HandlerFunc {
+	return func(c echo.Context) error {
+		jwtToken := c.Get(jwtContextName).(*jwt.Token)
+		claims := jwtToken.Claims.(*jwtCustomClaims)
+
+		dropFileID, err := models.ParseID(c.Param("dropfileid"))
+		if err != nil {
+			return c.String(http.StatusBadRequest, "A valid integer was not used for the drop file id in the URI.")
+		}
+
+		data, err := state.Storage.GetDropFileData(claims.UserID, dropFileID)
+		if err != nil {
+			return c.String(http.StatusNotFound, "Failed to get the drop file.")
+		}
+
+		return c.Blob(http.StatusOK, "application/octet-stream", data)
+	}
+}
+
+// handleDeleteDropFile removes an uncollected drop file for the authenticated user.
+func handleDeleteDropFile(state *serverState) echo.HandlerFunc {
+	return func(c echo.Context) error {
+		jwtToken := c.Get(jwtContextName).(*jwt.Token)
+		claims := jwtToken.Claims.(*jwtCustomClaims)
+
+		dropFileID, err := models.ParseID(c.Param("dropfileid"))
+		if err != nil {
+			return c.String(http.StatusBadRequest, "A valid integer was not used for the drop file id in the URI.")
+		}
+
+		err = state.Storage.RemoveDropFile(claims.UserID, dropFileID)
+		if err != nil {
+			return c.String(http.StatusNotFound, "Failed to remove the drop file: "+err.Error())
+		}
+
+		return c.JSON(http.StatusOK, &models.DropFileDeleteResponse{
+			Success: true,
+		})
+	}
+}
+
+// handleDropUpload accepts an anonymous upload of a file with a drop token. The
+// token only grants the ability to add files, so nothing about the account is
+// revealed to the uploader. The file is held unencrypted on the server until the
+// owning user collects it with the client, which encrypts it into their storage.
+func handleDropUpload(state *serverState) echo.HandlerFunc {
+	return func(c echo.Context) error {
+		dt, err := state.Storage.GetDropTokenByToken(c.Param("token"))
+		if err != nil {
+			return c.String(http.StatusNotFound, "Not found.")
+		}
+
+		name, err := models.CleanName(c.Param("filename"))
+		if err != nil || strings.Contains(name, "/") {
+			return c.String(http.StatusBadRequest, "A valid file name is required.")
+		}
+
+		// the body is stored as it's read so that uploads don't hold whole
+		// files in memory
+		df, err := state.Storage.AddDropFile(dt.Token, name, c.Request().Body)
+		if errors.Is(err, filefreezer.ErrDropFileTooLarge) {
+			return c.String(http.StatusRequestEntityTooLarge, "The file is larger than the limit for this drop link.")
+		} else if err != nil {
+			return c.String(http.StatusForbidden, "Failed to accept the file: "+err.Error())
+		}
+
+		return c.JSON(http.StatusOK, &models.DropUploadResponse{
+			Status: true,
+			Name:   df.Name,
+			Size:   df.Size,
+		})
+	}
+}
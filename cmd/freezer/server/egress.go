@@ -0,0 +1,73 @@
+// Copyright 2017, Timothy Bogdala <tdb@animal-machine.com>
+// See the LICENSE file for more details.
+
+package server
+
+import (
+	"fmt"
+	"net/http"
+	"strconv"
+	"time"
+
+	jwt "github.com/dgrijalva/jwt-go"
+	"github.com/labstack/echo"
+	"github.com/marcoziti/gringotts"
+
+	"github.com/marcoziti/gringotts/cmd/freezer/models"
+)
+
+// monthStart returns the start of the calendar month, in UTC, that t is in.
+func monthStart(t time.Time) time.Time {
+	t = t.UTC()
+	return time.Date(t.Year(), t.Month(), 1, 0, 0, 0, 0, time.UTC)
+}
+
+// userEgress returns the bytes the user has downloaded this month and their
+// monthly limit, which is zero if they don't have one.
+func userEgress(state *serverState, userID int) (used int64, limit int64, e error) {
+	stats, err := state.Storage.GetUserStats(userID)
+	if err != nil {
+		return 0, 0, err
+	}
+	limit = stats.MaxEgress
+	if limit <= 0 {
+		limit = state.MaxEgress
+	}
+
+	since := monthStart(time.Now()).Format(filefreezer.BandwidthDayFormat)
+	days, err := state.Storage.GetUserBandwidth(userID, since)
+	if err != nil {
+		return 0, 0, err
+	}
+	for _, day := range days {
+		used += day.Downloaded
+	}
+	return used, limit, nil
+}
+
+// limitEgress is middleware for the download routes that turns away users who
+// have reached their monthly egress limit with 429 Too Many Requests until the
+// next month starts, which is sent in models.EgressResetHeader. The download
+// that crosses the limit is still served, so users can go over it by a chunk.
+func limitEgress(state *serverState) echo.MiddlewareFunc {
+	return func(next echo.HandlerFunc) echo.HandlerFunc {
+		return func(c echo.Context) error {
+			claims := c.Get(jwtContextName).(*jwt.Token).Claims.(*jwtCustomClaims)
+			used, limit, err := userEgress(state, claims.UserID)
+			if err != nil {
+				return c.String(http.StatusInternalServerError, "Failed to get the egress for the authenticated user.")
+			}
+			if limit <= 0 || used < limit {
+				return next(c)
+			}
+
+			reset := monthStart(time.Now()).AddDate(0, 1, 0)
+			c.Response().Header().Set(models.EgressResetHeader, strconv.FormatInt(reset.Unix(), 10))
+			return c.JSON(http.StatusTooManyRequests, &models.ErrorResponse{
+				Status: http.StatusTooManyRequests,
+				Error: fmt.Sprintf("The monthly download limit of %d bytes for the account has been reached; downloads resume on %s.",
+					limit, reset.Format("2006-01-02")),
+			})
+		}
+	}
+}
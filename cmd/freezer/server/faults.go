@@ -0,0 +1,113 @@
+// Copyright 2017, Timothy Bogdala <tdb@animal-machine.com>
+// See the LICENSE file for more details.
+
+package server
+
+import (
+	"math/rand"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/labstack/echo"
+)
+
+// The kinds of faults that can be injected into a chunk request.
+const (
+	faultNone = iota
+	faultDelay
+	faultDrop
+	faultError
+)
+
+// FaultConfig configures the injection of faults into chunk requests so that
+// the retry and resume logic of clients can be exercised. It is meant for
+// debugging and tests only.
+type FaultConfig struct {
+	// Rate is the fraction of chunk requests, from 0 to 1, that get a fault;
+	// zero disables fault injection.
+	Rate float64
+
+	// Delay is the longest a delayed request is held before being handled;
+	// zero uses one second.
+	Delay time.Duration
+
+	// Seed seeds the choice of requests and faults so that a sequence of
+	// requests gets the same faults every run.
+	Seed int64
+}
+
+// faultInjector decides which chunk requests get a fault. Each faulty request
+// is either delayed, dropped by closing the connection without a response or
+// answered with 500 Internal Server Error, with equal odds.
+type faultInjector struct {
+	config FaultConfig
+
+	lock sync.Mutex
+	rng  *rand.Rand
+}
+
+// newFaultInjector creates a new fault injector, or returns nil if the
+// configuration disables it.
+func newFaultInjector(config FaultConfig) *faultInjector {
+	if config.Rate <= 0 {
+		return nil
+	}
+	if config.Delay <= 0 {
+		config.Delay = time.Second
+	}
+
+	fi := new(faultInjector)
+	fi.config = config
+	fi.rng = rand.New(rand.NewSource(config.Seed))
+	return fi
+}
+
+// next returns the kind of fault for the next request and how long to delay
+// it if the fault is a delay.
+func (fi *faultInjector) next() (int, time.Duration) {
+	fi.lock.Lock()
+	defer fi.lock.Unlock()
+
+	if fi.rng.Float64() >= fi.config.Rate {
+		return faultNone, 0
+	}
+
+	fault := faultDelay + fi.rng.Intn(3)
+	if fault == faultDelay {
+		return fault, time.Duration(fi.rng.Int63n(int64(fi.config.Delay))) + 1
+	}
+	return fault, 0
+}
+
+// injectFaults is route middleware that delays, drops or fails a fraction of
+// the requests when fault injection is configured for the server.
+func injectFaults(state *serverState) echo.MiddlewareFunc {
+	return func(next echo.HandlerFunc) echo.HandlerFunc {
+		return func(c echo.Context) error {
+			if state.Faults == nil {
+				return next(c)
+			}
+
+			fault, delay := state.Faults.next()
+			switch fault {
+			case faultDelay:
+				time.Sleep(delay)
+			case faultDrop:
+				hijacker, ok := c.Response().Writer.(http.Hijacker)
+				if ok {
+					conn, _, err := hijacker.Hijack()
+					if err == nil {
+						conn.Close()
+						return nil
+					}
+				}
+				return c.String(http.StatusInternalServerError, "Injected fault: dropped request.")
+			case faultError:
+				return c.String(http.StatusInternalServerError, "Injected fault: server error.")
+			}
+
+			return next(c)
+		}
+	}
+}
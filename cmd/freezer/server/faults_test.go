@@ -0,0 +1,49 @@
+// Copyright 2017, Timothy Bogdala <tdb@animal-machine.com>
+// See the LICENSE file for more details.
+
+package server
+
+import (
+	"testing"
+	"time"
+)
+
+func TestFaultInjection(t *testing.T) {
+	if newFaultInjector(FaultConfig{}) != nil {
+		t.Fatal("Expected fault injection to be disabled by the zero config.")
+	}
+
+	// the same seed must give the same faults so that tests are repeatable
+	config := FaultConfig{Rate: 0.5, Delay: 10 * time.Millisecond, Seed: 42}
+	a := newFaultInjector(config)
+	b := newFaultInjector(config)
+	counts := make(map[int]int)
+	for i := 0; i < 1000; i++ {
+		faultA, delayA := a.next()
+		faultB, delayB := b.next()
+		if faultA != faultB || delayA != delayB {
+			t.Fatalf("Request %d got different faults for the same seed.", i)
+		}
+		if faultA == faultDelay && (delayA <= 0 || delayA > config.Delay) {
+			t.Fatalf("Request %d got a delay of %v which is outside of the limit.", i, delayA)
+		}
+		counts[faultA]++
+	}
+
+	// roughly half of the requests should be faulty with all kinds of faults
+	if counts[faultNone] < 400 || counts[faultNone] > 600 {
+		t.Fatalf("Expected about half of the requests to be left alone but got %d.", counts[faultNone])
+	}
+	for _, fault := range []int{faultDelay, faultDrop, faultError} {
+		if counts[fault] == 0 {
+			t.Fatalf("Expected some requests to get fault kind %d.", fault)
+		}
+	}
+
+	always := newFaultInjector(FaultConfig{Rate: 1})
+	for i := 0; i < 100; i++ {
+		if fault, _ := always.next(); fault == faultNone {
+			t.Fatal("Expected every request to get a fault with a rate of 1.")
+		}
+	}
+}
@@ -0,0 +1,186 @@
+// Copyright 2017, Timothy Bogdala <tdb@animal-machine.com>
+// See the LICENSE file for more details.
+
+package server
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/labstack/echo"
+
+	"github.com/marcoziti/gringotts/cmd/freezer/models"
+)
+
+const (
+	// idempotencyTTL is how long the response to a request with an
+	// idempotency key is kept for its retries.
+	idempotencyTTL = 24 * time.Hour
+
+	// maxIdempotencyKeyLength is the longest idempotency key accepted.
+	maxIdempotencyKeyLength = 255
+)
+
+// idempotentResponse is the response to a request with an idempotency key.
+// done is closed once the first request with the key finished, after which
+// the other fields are set; the response isn't kept if stored is false.
+type idempotentResponse struct {
+	fingerprint [sha256.Size]byte
+	done        chan struct{}
+	stored      bool
+	expires     time.Time
+
+	status      int
+	contentType string
+	body        []byte
+}
+
+// idempotencyCache keeps the responses to the requests with idempotency keys
+// so that a retry of a request that creates or removes file versions, such as
+// after the client timed out waiting for it, gets the response to the first
+// request instead of adding another version or removing something else. Keys
+// are scoped to their user and only kept in memory.
+type idempotencyCache struct {
+	lock      sync.Mutex
+	responses map[string]*idempotentResponse
+	lastPrune time.Time
+}
+
+// newIdempotencyCache creates a new cache with no responses.
+func newIdempotencyCache() *idempotencyCache {
+	return &idempotencyCache{
+		responses: make(map[string]*idempotentResponse),
+	}
+}
+
+// begin returns the response for the key and true if there's one from an
+// earlier request, which may still be running; otherwise it adds one for the
+// request to finish.
+func (ic *idempotencyCache) begin(key string, fingerprint [sha256.Size]byte) (*idempotentResponse, bool) {
+	ic.lock.Lock()
+	defer ic.lock.Unlock()
+
+	now := time.Now()
+	if now.Sub(ic.lastPrune) > time.Minute {
+		ic.lastPrune = now
+		for k, r := range ic.responses {
+			if r.stored && now.After(r.expires) {
+				delete(ic.responses, k)
+			}
+		}
+	}
+
+	r, found := ic.responses[key]
+	if found && (!r.stored || now.Before(r.expires)) {
+		return r, true
+	}
+	r = &idempotentResponse{fingerprint: fingerprint, done: make(chan struct{})}
+	ic.responses[key] = r
+	return r, false
+}
+
+// finish stores the response of the request that began it or, if store is
+// false, forgets it so that a retry runs the request again.
+func (ic *idempotencyCache) finish(key string, r *idempotentResponse, store bool) {
+	ic.lock.Lock()
+	if store {
+		r.stored = true
+		r.expires = time.Now().Add(idempotencyTTL)
+	} else {
+		delete(ic.responses, key)
+	}
+	ic.lock.Unlock()
+	close(r.done)
+}
+
+// teeWriter copies the response body written through it.
+type teeWriter struct {
+	http.ResponseWriter
+	body bytes.Buffer
+}
+
+func (w *teeWriter) Write(p []byte) (int, error) {
+	w.body.Write(p)
+	return w.ResponseWriter.Write(p)
+}
+
+// idempotent is middleware for the routes that create or remove file versions
+// that answers a request with the IdempotencyKeyHeader of an earlier one with
+// the earlier response, waiting for it if the earlier request is still running.
+// Reusing a key for a different request is refused. Responses to requests that
+// failed on the server, or that didn't write a response, aren't kept so that
+// retrying runs them again.
+func idempotent(state *serverState) echo.MiddlewareFunc {
+	return func(next echo.HandlerFunc) echo.HandlerFunc {
+		return func(c echo.Context) error {
+			key := c.Request().Header.Get(models.IdempotencyKeyHeader)
+			if key == "" {
+				return next(c)
+			}
+			if len(key) > maxIdempotencyKeyLength {
+				return c.String(http.StatusBadRequest, "The idempotency key is too long.")
+			}
+			claims, ok := requestClaims(c)
+			if !ok {
+				return next(c)
+			}
+
+			// the request is told apart from other ones with the key by its
+			// method, path and body, which is read here and put back
+			req := c.Request()
+			var reqBytes []byte
+			if req.Body != nil {
+				var err error
+				reqBytes, err = ioutil.ReadAll(req.Body)
+				if err != nil {
+					return c.String(http.StatusBadRequest, "Failed to read the request body.")
+				}
+				req.Body = ioutil.NopCloser(bytes.NewReader(reqBytes))
+			}
+			fingerprint := sha256.Sum256(append([]byte(req.Method+" "+req.URL.Path+"\n"), reqBytes...))
+
+			cacheKey := fmt.Sprintf("%d:%s", claims.UserID, key)
+			r, found := state.idempotency.begin(cacheKey, fingerprint)
+			if found {
+				if r.fingerprint != fingerprint {
+					return c.String(http.StatusUnprocessableEntity, "The idempotency key was already used for a different request.")
+				}
+				select {
+				case <-r.done:
+				case <-req.Context().Done():
+					return req.Context().Err()
+				}
+				if !r.stored {
+					return c.String(http.StatusConflict, "The earlier request with the idempotency key failed; retry it with the same key.")
+				}
+				c.Response().Header().Set(models.IdempotentReplayHeader, "true")
+				return c.Blob(r.status, r.contentType, r.body)
+			}
+
+			// the requests waiting for this one are let go even if it panics
+			store := false
+			defer func() {
+				state.idempotency.finish(cacheKey, r, store)
+			}()
+
+			tee := &teeWriter{ResponseWriter: c.Response().Writer}
+			c.Response().Writer = tee
+			err := next(c)
+			c.Response().Writer = tee.ResponseWriter
+
+			res := c.Response()
+			store = err == nil && res.Committed && res.Status < http.StatusInternalServerError
+			if store {
+				r.status = res.Status
+				r.contentType = res.Header().Get(echo.HeaderContentType)
+				r.body = tee.body.Bytes()
+			}
+			return err
+		}
+	}
+}
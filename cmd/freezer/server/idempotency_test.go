@@ -0,0 +1,95 @@
+// Copyright 2017, Timothy Bogdala <tdb@animal-machine.com>
+// See the LICENSE file for more details.
+
+package server
+
+import (
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	jwt "github.com/dgrijalva/jwt-go"
+
+	"github.com/marcoziti/gringotts/cmd/freezer/models"
+)
+
+func TestIdempotencyKeys(t *testing.T) {
+	srv, err := New(Config{
+		DatabasePath: "file:idempotency?mode=memory&cache=shared",
+		ChunkSize:    1024,
+	})
+	if err != nil {
+		t.Fatalf("Failed to create the server: %v", err)
+	}
+	defer srv.Close()
+
+	user, err := srv.Storage.AddUser("alice", "salt", []byte("saltedhash"), 1e6)
+	if err != nil {
+		t.Fatalf("Failed to add a user: %v", err)
+	}
+	fi, err := srv.Storage.AddFileInfo(user.ID, "file", false, 0644, 100, 0, "hash", "")
+	if err != nil {
+		t.Fatalf("Failed to add a file: %v", err)
+	}
+	token, err := jwt.NewWithClaims(jwt.SigningMethodHS256, &jwtCustomClaims{
+		user.Name,
+		user.ID,
+		jwt.StandardClaims{ExpiresAt: time.Now().Add(time.Hour).Unix()},
+	}).SignedString(srv.state.JWTSecretBytes)
+	if err != nil {
+		t.Fatalf("Failed to sign a token: %v", err)
+	}
+	send := func(method string, path string, body string, key string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(method, path, strings.NewReader(body))
+		req.Header.Set("Authorization", "Bearer "+token)
+		req.Header.Set("Content-Type", "application/json")
+		if key != "" {
+			req.Header.Set(models.IdempotencyKeyHeader, key)
+		}
+		rec := httptest.NewRecorder()
+		srv.Handler().ServeHTTP(rec, req)
+		return rec
+	}
+
+	// a retried version is only tagged once and gets the first response
+	versionPath := fmt.Sprintf("/api/file/%d/version", fi.FileID)
+	versionBody := `{"LastMod": 200, "FileHash": "hash2"}`
+	first := send("POST", versionPath, versionBody, "tag-1")
+	if first.Code != http.StatusOK || first.Header().Get(models.IdempotentReplayHeader) != "" {
+		t.Fatalf("Failed to tag a version: %d %s", first.Code, first.Body.String())
+	}
+	retry := send("POST", versionPath, versionBody, "tag-1")
+	if retry.Code != http.StatusOK || retry.Header().Get(models.IdempotentReplayHeader) == "" || retry.Body.String() != first.Body.String() {
+		t.Fatalf("Expected the first response to be replayed but got: %d %s", retry.Code, retry.Body.String())
+	}
+	versions, err := srv.Storage.GetFileVersions(fi.FileID)
+	if err != nil || len(versions) != 2 {
+		t.Fatalf("Expected the retry not to tag another version but found %d versions: %v", len(versions), err)
+	}
+
+	// the key can't be reused for a different request, while requests
+	// without a key run every time
+	if rec := send("POST", versionPath, `{"LastMod": 300, "FileHash": "hash3"}`, "tag-1"); rec.Code != http.StatusUnprocessableEntity {
+		t.Fatalf("Expected the reused key to be refused but got: %d %s", rec.Code, rec.Body.String())
+	}
+	send("POST", versionPath, versionBody, "")
+	send("POST", versionPath, versionBody, "")
+	if versions, _ = srv.Storage.GetFileVersions(fi.FileID); len(versions) != 4 {
+		t.Fatalf("Expected requests without keys to tag a version each but found %d versions.", len(versions))
+	}
+
+	// a retried removal succeeds like the first one did
+	filePath := fmt.Sprintf("/api/file/%d", fi.FileID)
+	if rec := send("DELETE", filePath, "", "rm-1"); rec.Code != http.StatusOK {
+		t.Fatalf("Failed to remove the file: %d %s", rec.Code, rec.Body.String())
+	}
+	if rec := send("DELETE", filePath, "", "rm-1"); rec.Code != http.StatusOK {
+		t.Fatalf("Expected the retried removal to be replayed but got: %d %s", rec.Code, rec.Body.String())
+	}
+	if rec := send("DELETE", filePath, "", ""); rec.Code == http.StatusOK {
+		t.Fatal("Expected removing the removed file again without the key to fail.")
+	}
+}
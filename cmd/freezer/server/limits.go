@@ -0,0 +1,191 @@
+// Copyright 2017, Timothy Bogdala <tdb@animal-machine.com>
+// See the LICENSE file for more details.
+
+package server
+
+import (
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+
+	jwt "github.com/dgrijalva/jwt-go"
+	"github.com/labstack/echo"
+)
+
+const (
+	// transferRetryAfter is the number of seconds clients are told to wait
+	// before trying again when the transfer limits are reached.
+	transferRetryAfter = 1
+
+	// sharePasswordFailures is the number of wrong share passwords a client can
+	// send within sharePasswordWindow before it is turned away until the window
+	// has passed.
+	sharePasswordFailures = 10
+	sharePasswordWindow   = time.Minute
+)
+
+// transferLimiter caps the number of chunk transfers and uploads in flight on
+// the server as a whole and for each user, so that one greedy client can't
+// exhaust the memory and connections of a small server. Requests over either
+// limit are turned away with 429 Too Many Requests.
+type transferLimiter struct {
+	// Global is the most transfers in flight at once; a value less than one
+	// disables the limit.
+	Global int
+
+	// PerUser is the most transfers in flight at once for a single user; a
+	// value less than one disables the limit. Anonymous transfers only count
+	// against the global limit.
+	PerUser int
+
+	lock   sync.Mutex
+	total  int
+	byUser map[int]int
+}
+
+// newTransferLimiter creates a new transfer limiter with the limits given.
+func newTransferLimiter(global int, perUser int) *transferLimiter {
+	l := new(transferLimiter)
+	l.Global = global
+	l.PerUser = perUser
+	l.byUser = make(map[int]int)
+	return l
+}
+
+// acquire reserves a transfer for the user, or for an anonymous request if
+// userID is zero, and returns false if a limit has been reached.
+func (l *transferLimiter) acquire(userID int) bool {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+
+	if l.Global > 0 && l.total >= l.Global {
+		return false
+	}
+	if userID != 0 && l.PerUser > 0 && l.byUser[userID] >= l.PerUser {
+		return false
+	}
+
+	l.total++
+	if userID != 0 {
+		l.byUser[userID]++
+	}
+	return true
+}
+
+// release returns a transfer reserved with acquire.
+func (l *transferLimiter) release(userID int) {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+
+	l.total--
+	if userID != 0 {
+		l.byUser[userID]--
+		if l.byUser[userID] <= 0 {
+			delete(l.byUser, userID)
+		}
+	}
+}
+
+// limitTransfers is route middleware that holds a transfer for the duration of
+// the request. On restricted routes it must run after the JWT middleware so
+// that the transfer is counted against the authenticated user.
+func limitTransfers(state *serverState) echo.MiddlewareFunc {
+	return func(next echo.HandlerFunc) echo.HandlerFunc {
+		return func(c echo.Context) error {
+			if state.Transfers == nil {
+				return next(c)
+			}
+
+			userID := 0
+			if jwtToken, ok := c.Get(jwtContextName).(*jwt.Token); ok {
+				if claims, ok := jwtToken.Claims.(*jwtCustomClaims); ok {
+					userID = claims.UserID
+				}
+			}
+
+			if !state.Transfers.acquire(userID) {
+				c.Response().Header().Set("Retry-After", strconv.Itoa(transferRetryAfter))
+				return c.String(http.StatusTooManyRequests, "Too many transfers are in progress; try again later.")
+			}
+			defer state.Transfers.release(userID)
+
+			return next(c)
+		}
+	}
+}
+
+// failureLimiter counts the failed attempts of each client, such as guessing a
+// share password, and turns the client away once it has failed too many times
+// within the window. Each check that fails costs the server a password hash, so
+// this keeps anonymous clients from using them to tie up the CPU.
+type failureLimiter struct {
+	// Max is the number of failures allowed within Window; a value less than
+	// one disables the limit.
+	Max int
+
+	// Window is the length of the sliding window used to count failures
+	Window time.Duration
+
+	lock     sync.Mutex
+	failures map[string][]time.Time
+}
+
+// newFailureLimiter creates a new failure limiter with the limit given.
+func newFailureLimiter(max int, window time.Duration) *failureLimiter {
+	l := new(failureLimiter)
+	l.Max = max
+	l.Window = window
+	l.failures = make(map[string][]time.Time)
+	return l
+}
+
+// blocked returns true if the client has reached the limit of failures within
+// the window.
+func (l *failureLimiter) blocked(client string) bool {
+	if l == nil || l.Max < 1 {
+		return false
+	}
+
+	l.lock.Lock()
+	defer l.lock.Unlock()
+	return len(l.recent(client, time.Now())) >= l.Max
+}
+
+// fail records a failed attempt by the client.
+func (l *failureLimiter) fail(client string) {
+	if l == nil || l.Max < 1 {
+		return
+	}
+
+	now := time.Now()
+	l.lock.Lock()
+	defer l.lock.Unlock()
+
+	// forget the clients whose failures have all expired when a new one shows
+	// up so that the map doesn't grow with every address that ever failed
+	if _, found := l.failures[client]; !found {
+		for other := range l.failures {
+			l.recent(other, now)
+		}
+	}
+	l.failures[client] = append(l.recent(client, now), now)
+}
+
+// recent drops the failures of the client that have fallen out of the window
+// and returns the ones left. The lock must be held.
+func (l *failureLimiter) recent(client string, now time.Time) []time.Time {
+	cutoff := now.Add(-l.Window)
+	failures := l.failures[client]
+	firstValid := 0
+	for firstValid < len(failures) && failures[firstValid].Before(cutoff) {
+		firstValid++
+	}
+	failures = failures[firstValid:]
+	if len(failures) == 0 {
+		delete(l.failures, client)
+		return nil
+	}
+	l.failures[client] = failures
+	return failures
+}
@@ -0,0 +1,81 @@
+// Copyright 2017, Timothy Bogdala <tdb@animal-machine.com>
+// See the LICENSE file for more details.
+
+package server
+
+import (
+	"testing"
+	"time"
+)
+
+func TestTransferLimits(t *testing.T) {
+	limiter := newTransferLimiter(3, 2)
+	if !limiter.acquire(1) || !limiter.acquire(1) {
+		t.Fatal("Expected the first two transfers for a user to be allowed.")
+	}
+	if limiter.acquire(1) {
+		t.Fatal("Expected the per-user transfer limit to be enforced.")
+	}
+	if !limiter.acquire(2) {
+		t.Fatal("Expected another user to be allowed a transfer.")
+	}
+	if limiter.acquire(0) || limiter.acquire(3) {
+		t.Fatal("Expected the global transfer limit to be enforced.")
+	}
+
+	limiter.release(1)
+	if !limiter.acquire(0) {
+		t.Fatal("Expected an anonymous transfer to be allowed after one was released.")
+	}
+}
+
+func TestFailureLimits(t *testing.T) {
+	limiter := newFailureLimiter(2, 50*time.Millisecond)
+	limiter.fail("10.0.0.1")
+	if limiter.blocked("10.0.0.1") {
+		t.Fatal("Expected a client to be allowed after a single failure.")
+	}
+	limiter.fail("10.0.0.1")
+	if !limiter.blocked("10.0.0.1") {
+		t.Fatal("Expected a client to be blocked after reaching the failure limit.")
+	}
+	if limiter.blocked("10.0.0.2") {
+		t.Fatal("Expected another client to be allowed.")
+	}
+
+	// the failures expire with the window and the client is forgotten
+	time.Sleep(60 * time.Millisecond)
+	if limiter.blocked("10.0.0.1") {
+		t.Fatal("Expected the client to be allowed again after the window passed.")
+	}
+	limiter.fail("10.0.0.2")
+	if len(limiter.failures) != 1 {
+		t.Fatalf("Expected only the client with recent failures to be tracked but got %d.", len(limiter.failures))
+	}
+
+	var disabled *failureLimiter
+	disabled.fail("10.0.0.1")
+	if disabled.blocked("10.0.0.1") {
+		t.Fatal("Expected a nil failure limiter to allow everything.")
+	}
+}
+
+func TestLowMemory(t *testing.T) {
+	srv, err := New(Config{
+		DatabasePath:     "file:lowmemory?mode=memory&cache=shared",
+		ChunkSize:        1024,
+		LowMemory:        true,
+		MaxTransfers:     64,
+		MaxUserTransfers: 1,
+	})
+	if err != nil {
+		t.Fatalf("Failed to create a server in low memory mode: %v", err)
+	}
+	defer srv.Close()
+
+	transfers := srv.state.Transfers
+	if transfers.Global != lowMemoryTransfers || transfers.PerUser != 1 {
+		t.Fatalf("Expected the transfer limits to be capped in low memory mode but got %d (%d per user).",
+			transfers.Global, transfers.PerUser)
+	}
+}
@@ -0,0 +1,133 @@
+// Copyright 2017, Timothy Bogdala <tdb@animal-machine.com>
+// See the LICENSE file for more details.
+
+package server
+
+import (
+	"net/http"
+	"strconv"
+	"time"
+
+	jwt "github.com/dgrijalva/jwt-go"
+	"github.com/labstack/echo"
+
+	"github.com/marcoziti/gringotts"
+	"github.com/marcoziti/gringotts/cmd/freezer/models"
+)
+
+// handlePutFileLock takes or renews the advisory lock on a file for the
+// authenticated user's client. The locks aren't enforced by the server; they
+// let the clients of a user hold off on changing a file that another one of
+// them is editing.
+func handlePutFileLock(state *serverState) echo.HandlerFunc {
+	return func(c echo.Context) error {
+		jwtToken := c.Get(jwtContextName).(*jwt.Token)
+		claims := jwtToken.Claims.(*jwtCustomClaims)
+
+		fileID, err := models.ParseID(c.Param("fileid"))
+		if err != nil {
+			return c.String(http.StatusBadRequest, "A valid integer was not used for the file id in the URI.")
+		}
+
+		var req models.FileLockRequest
+		err = bindRequest(c, &req)
+		if err != nil {
+			return sendRequestError(c, err)
+		}
+
+		expires := time.Now().UTC().Unix() + req.Seconds
+		lock, acquired, err := state.Storage.LockFile(claims.UserID, fileID, req.Token, req.Holder, expires)
+		if err != nil {
+			return c.String(http.StatusNotFound, "Failed to lock the file for the user.")
+		}
+		if !acquired {
+			return sendLockConflict(c, lock)
+		}
+
+		return c.JSON(http.StatusOK, &models.FileLockResponse{Lock: *lock, Locked: true})
+	}
+}
+
+// handleGetFileLock returns the lock on a file of the authenticated user.
+func handleGetFileLock(state *serverState) echo.HandlerFunc {
+	return func(c echo.Context) error {
+		jwtToken := c.Get(jwtContextName).(*jwt.Token)
+		claims := jwtToken.Claims.(*jwtCustomClaims)
+
+		fileID, err := models.ParseID(c.Param("fileid"))
+		if err != nil {
+			return c.String(http.StatusBadRequest, "A valid integer was not used for the file id in the URI.")
+		}
+
+		lock, err := state.Storage.GetFileLock(claims.UserID, fileID)
+		if err != nil {
+			return c.String(http.StatusInternalServerError, "Failed to get the lock on the file.")
+		}
+		if lock == nil {
+			return c.JSON(http.StatusOK, &models.FileLockResponse{})
+		}
+
+		return c.JSON(http.StatusOK, &models.FileLockResponse{Lock: *lock, Locked: true})
+	}
+}
+
+// handleDeleteFileLock releases the lock on a file of the authenticated user
+// if the request's token holds it or the release is forced, and returns the
+// lock that was released.
+func handleDeleteFileLock(state *serverState) echo.HandlerFunc {
+	return func(c echo.Context) error {
+		jwtToken := c.Get(jwtContextName).(*jwt.Token)
+		claims := jwtToken.Claims.(*jwtCustomClaims)
+
+		fileID, err := models.ParseID(c.Param("fileid"))
+		if err != nil {
+			return c.String(http.StatusBadRequest, "A valid integer was not used for the file id in the URI.")
+		}
+
+		var req models.FileUnlockRequest
+		err = bindRequest(c, &req)
+		if err != nil {
+			return sendRequestError(c, err)
+		}
+
+		lock, err := state.Storage.GetFileLock(claims.UserID, fileID)
+		if err != nil {
+			return c.String(http.StatusInternalServerError, "Failed to get the lock on the file.")
+		}
+		if lock == nil {
+			return c.String(http.StatusNotFound, "The file isn't locked.")
+		}
+		if !req.Force && lock.Token != req.Token {
+			return sendLockConflict(c, lock)
+		}
+
+		_, err = state.Storage.UnlockFile(claims.UserID, fileID, lock.Token)
+		if err != nil {
+			return c.String(http.StatusInternalServerError, "Failed to release the lock on the file.")
+		}
+
+		return c.JSON(http.StatusOK, &models.FileLockResponse{Lock: *lock, Locked: true})
+	}
+}
+
+// handleGetFileLocks returns all of the locks on the authenticated user's files.
+func handleGetFileLocks(state *serverState) echo.HandlerFunc {
+	return func(c echo.Context) error {
+		jwtToken := c.Get(jwtContextName).(*jwt.Token)
+		claims := jwtToken.Claims.(*jwtCustomClaims)
+
+		locks, err := state.Storage.GetFileLocks(claims.UserID)
+		if err != nil {
+			return c.String(http.StatusInternalServerError, "Failed to get the locks on the user's files.")
+		}
+
+		return c.JSON(http.StatusOK, &models.FileLocksGetResponse{Locks: locks})
+	}
+}
+
+// sendLockConflict responds with 409 Conflict and the lock held by another
+// client, setting models.FileLockedHeader to when it expires.
+func sendLockConflict(c echo.Context, lock *filefreezer.FileLock) error {
+	c.Response().Header().Set(models.FileLockedHeader, strconv.FormatInt(lock.Expires, 10))
+	return c.JSON(http.StatusConflict, &models.FileLockResponse{Lock: *lock, Locked: true})
+}
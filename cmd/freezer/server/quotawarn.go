@@ -0,0 +1,152 @@
+// Copyright 2017, Timothy Bogdala <tdb@animal-machine.com>
+// See the LICENSE file for more details.
+
+package server
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/labstack/echo"
+
+	"github.com/marcoziti/gringotts/cmd/freezer/models"
+)
+
+// quotaWebhookTimeout is the longest a post to the quota webhook can take.
+const quotaWebhookTimeout = 30 * time.Second
+
+// quotaWarner warns users that are close to their quota so that they can
+// clean up before uploads start getting rejected. Responses to a user over a
+// threshold carry models.QuotaWarningHeader, and the first time a user crosses
+// each threshold the webhook and the admins are told. Which thresholds were
+// reported is only kept in memory, so they're reported again after a restart.
+type quotaWarner struct {
+	state      *serverState
+	thresholds []int
+	webhook    string
+	client     *http.Client
+
+	lock     sync.Mutex
+	reported map[int]int
+}
+
+// newQuotaWarner creates a new quota warner for the thresholds, in percent of
+// the quota, or returns nil if there are none.
+func newQuotaWarner(state *serverState, thresholds []int, webhook string) *quotaWarner {
+	var valid []int
+	for _, t := range thresholds {
+		if t > 0 {
+			valid = append(valid, t)
+		}
+	}
+	if len(valid) == 0 {
+		return nil
+	}
+	sort.Ints(valid)
+
+	return &quotaWarner{
+		state:      state,
+		thresholds: valid,
+		webhook:    webhook,
+		client:     &http.Client{Timeout: quotaWebhookTimeout},
+		reported:   make(map[int]int),
+	}
+}
+
+// quotaThreshold returns the highest of the sorted thresholds that the
+// allocation has reached, in percent of the quota, along with the percent
+// used. Zero is returned for the threshold if none were reached or the quota
+// is unlimited.
+func quotaThreshold(thresholds []int, allocated int, quota int) (threshold int, percent int) {
+	if quota <= 0 {
+		return 0, 0
+	}
+	percent = int(int64(allocated) * 100 / int64(quota))
+	for _, t := range thresholds {
+		if percent >= t {
+			threshold = t
+		}
+	}
+	return threshold, percent
+}
+
+// check sets the quota warning header on the response if the user is over a
+// threshold and reports the user if the threshold wasn't reported yet. It
+// must be called before the response is written.
+func (w *quotaWarner) check(c echo.Context, userID int, username string) {
+	stats, err := w.state.Storage.GetUserStats(userID)
+	if err != nil {
+		return
+	}
+	threshold, percent := quotaThreshold(w.thresholds, stats.Allocated, stats.Quota)
+	if threshold > 0 {
+		c.Response().Header().Set(models.QuotaWarningHeader, strconv.Itoa(threshold))
+	}
+
+	// users that clean up below a threshold are reported again if they
+	// cross it later
+	w.lock.Lock()
+	crossed := threshold > w.reported[userID]
+	w.reported[userID] = threshold
+	w.lock.Unlock()
+	if !crossed {
+		return
+	}
+
+	go w.report(models.QuotaWarning{
+		UserID:    userID,
+		Name:      username,
+		Allocated: stats.Allocated,
+		Quota:     stats.Quota,
+		Percent:   percent,
+		Threshold: threshold,
+		Time:      time.Now().UTC().Unix(),
+	})
+}
+
+// report posts the warning to the webhook and emails it to the admins if
+// either is configured.
+func (w *quotaWarner) report(warning models.QuotaWarning) {
+	w.state.printf("User %s has used %d%% of their quota.\n", warning.Name, warning.Percent)
+
+	if w.webhook != "" {
+		err := w.postWebhook(warning)
+		if err != nil {
+			w.state.printf("Failed to post the quota warning for user %s: %v\n", warning.Name, err)
+		}
+	}
+
+	if w.state.AdminEmail != nil {
+		text := fmt.Sprintf("The account %s has used %d%% of its quota (%d of %d bytes), crossing the %d%% "+
+			"warning threshold.\n\nUploads will be rejected once the quota is full. The quota can be raised with:\n"+
+			"    freezer user mod -u %s --quota <bytes>\n",
+			warning.Name, warning.Percent, warning.Allocated, warning.Quota, warning.Threshold, warning.Name)
+		err := sendAdminEmail(*w.state.AdminEmail, fmt.Sprintf("Filefreezer alert: %s is over %d%% of their quota", warning.Name, warning.Threshold), text)
+		if err != nil {
+			w.state.printf("Failed to email the admins about the quota of user %s: %v\n", warning.Name, err)
+		}
+	}
+}
+
+// postWebhook posts the warning as JSON to the webhook.
+func (w *quotaWarner) postWebhook(warning models.QuotaWarning) error {
+	body, err := json.Marshal(&warning)
+	if err != nil {
+		return err
+	}
+	resp, err := w.client.Post(w.webhook, "application/json", bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return fmt.Errorf("the webhook returned %s", resp.Status)
+	}
+	return nil
+}
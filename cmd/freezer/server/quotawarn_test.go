@@ -0,0 +1,36 @@
+// Copyright 2017, Timothy Bogdala <tdb@animal-machine.com>
+// See the LICENSE file for more details.
+
+package server
+
+import "testing"
+
+func TestQuotaThreshold(t *testing.T) {
+	if newQuotaWarner(nil, []int{0, -5}, "") != nil {
+		t.Fatal("Expected quota warnings to be disabled without positive thresholds.")
+	}
+	w := newQuotaWarner(nil, []int{95, 80}, "")
+	if w == nil || w.thresholds[0] != 80 || w.thresholds[1] != 95 {
+		t.Fatalf("Expected the thresholds to be sorted: %v", w)
+	}
+
+	tests := []struct {
+		allocated, quota   int
+		threshold, percent int
+	}{
+		{0, 1000, 0, 0},
+		{799, 1000, 0, 79},
+		{800, 1000, 80, 80},
+		{949, 1000, 80, 94},
+		{950, 1000, 95, 95},
+		{1200, 1000, 95, 120},
+		{1000, 0, 0, 0},
+	}
+	for _, test := range tests {
+		threshold, percent := quotaThreshold(w.thresholds, test.allocated, test.quota)
+		if threshold != test.threshold || percent != test.percent {
+			t.Fatalf("Expected %d of %d bytes to be %d%% over the %d%% threshold but got %d%% over %d%%.",
+				test.allocated, test.quota, test.percent, test.threshold, percent, threshold)
+		}
+	}
+}
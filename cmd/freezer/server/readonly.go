@@ -0,0 +1,35 @@
+// Copyright 2017, Timothy Bogdala <tdb@animal-machine.com>
+// See the LICENSE file for more details.
+
+package server
+
+import (
+	"net/http"
+
+	"github.com/labstack/echo"
+
+	"github.com/marcoziti/gringotts/cmd/freezer/models"
+)
+
+// rejectWrites is middleware for servers in read-only mode that refuses every
+// request that could change the data with 403 Forbidden, so that users can
+// list and download their files from a replica without it drifting from the
+// primary. Logging in is still allowed since it only reads the user.
+func rejectWrites(state *serverState) echo.MiddlewareFunc {
+	return func(next echo.HandlerFunc) echo.HandlerFunc {
+		return func(c echo.Context) error {
+			req := c.Request()
+			switch {
+			case req.Method == http.MethodGet, req.Method == http.MethodHead, req.Method == http.MethodOptions:
+				return next(c)
+			case req.Method == http.MethodPost && req.URL.Path == "/api/users/login":
+				return next(c)
+			}
+
+			return c.JSON(http.StatusForbidden, &models.ErrorResponse{
+				Status: http.StatusForbidden,
+				Error:  "This server is a read-only replica; files can be listed and downloaded but not changed.",
+			})
+		}
+	}
+}
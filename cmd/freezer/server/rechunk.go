@@ -0,0 +1,62 @@
+// Copyright 2017, Timothy Bogdala <tdb@animal-machine.com>
+// See the LICENSE file for more details.
+
+package server
+
+import (
+	"time"
+)
+
+// startRechunking starts rechunking one share each interval whose chunks
+// don't match the server's chunk size, such as after the chunk size was
+// changed, until state.quit is closed. Shares are stored unencrypted so the
+// server can do it on its own; private files are encrypted by the clients and
+// get rechunked with the rechunk command instead. Each share is replaced in
+// one transaction, so the shares left to do are the only progress that needs
+// to be tracked and the job picks up where it left off after a restart.
+func (state *serverState) startRechunking(interval time.Duration) {
+	go func() {
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		done := false
+		for {
+			select {
+			case <-ticker.C:
+				done = state.rechunkNextShare(done)
+			case <-state.quit:
+				return
+			}
+		}
+	}()
+}
+
+// rechunkNextShare rechunks the first share that needs it and returns true
+// if none are left. wasDone is the result of the previous call so that the
+// job finishing is only logged once.
+func (state *serverState) rechunkNextShare(wasDone bool) bool {
+	chunkSize := state.Storage.MaxChunkSize()
+	shares, err := state.Storage.GetSharesToRechunk(chunkSize)
+	if err != nil {
+		state.printf("Failed to get the shares to rechunk: %v\n", err)
+		return false
+	}
+	if len(shares) == 0 {
+		if !wasDone {
+			state.printf("All shares are chunked in %d byte chunks.\n", chunkSize)
+		}
+		return true
+	}
+
+	share := shares[0]
+	state.writeLock.RLock()
+	count, err := state.Storage.RechunkShare(share.UserID, share.ShareID, chunkSize)
+	state.writeLock.RUnlock()
+	if err != nil {
+		state.printf("Failed to rechunk share %d: %v\n", share.ShareID, err)
+		return false
+	}
+
+	state.printf("Rechunked share %d from %d to %d chunks; %d shares left to rechunk.\n",
+		share.ShareID, share.ChunkCount, count, len(shares)-1)
+	return false
+}
@@ -0,0 +1,275 @@
+// Copyright 2017, Timothy Bogdala <tdb@animal-machine.com>
+// See the LICENSE file for more details.
+
+package server
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/labstack/echo"
+	"github.com/marcoziti/gringotts"
+
+	"github.com/marcoziti/gringotts/cmd/freezer/models"
+)
+
+const (
+	// replicationURLLifetime is how long the signed URLs a secondary makes
+	// for the primary's replication routes stay valid.
+	replicationURLLifetime = 5 * time.Minute
+
+	// replicationTimeout is the longest a request to the primary can take.
+	replicationTimeout = 5 * time.Minute
+)
+
+// signReplication returns the signature for a request to a replication route
+// that expires at the Unix time given. It's an HMAC-SHA256 of the method, path
+// and expiry keyed with the secret shared by the primary and its secondaries.
+func signReplication(secret []byte, method string, path string, expires int64) string {
+	mac := hmac.New(sha256.New, secret)
+	fmt.Fprintf(mac, "%s\n%s\n%d", method, path, expires)
+	return base64.RawURLEncoding.EncodeToString(mac.Sum(nil))
+}
+
+// checkReplicationSignature is middleware for the /replication routes that
+// only lets through requests whose expires and sig query parameters were made
+// by signReplication with the server's replication secret and haven't expired.
+func checkReplicationSignature(state *serverState) echo.MiddlewareFunc {
+	return func(next echo.HandlerFunc) echo.HandlerFunc {
+		return func(c echo.Context) error {
+			expires, err := strconv.ParseInt(c.QueryParam("expires"), 10, 64)
+			if err != nil {
+				return c.String(http.StatusUnauthorized, "The replication request is not signed.")
+			}
+
+			// URLs that expire too far in the future are refused so that a
+			// leaked one can't be used for long
+			now := time.Now().UTC().Unix()
+			if now > expires || expires > now+int64(2*replicationURLLifetime/time.Second) {
+				return c.String(http.StatusUnauthorized, "The replication signature has expired.")
+			}
+
+			req := c.Request()
+			expected := signReplication(state.ReplicationSecret, req.Method, req.URL.Path, expires)
+			if !hmac.Equal([]byte(expected), []byte(c.QueryParam("sig"))) {
+				return c.String(http.StatusUnauthorized, "The replication signature is not valid.")
+			}
+
+			return next(c)
+		}
+	}
+}
+
+// handleGetReplicationUsers returns every user with the revision of their
+// account so that secondaries can tell which accounts changed.
+func handleGetReplicationUsers(state *serverState) echo.HandlerFunc {
+	return func(c echo.Context) error {
+		users, err := state.store(c).GetAllUsers()
+		if err != nil {
+			return c.String(http.StatusInternalServerError, "Failed to get the users.")
+		}
+
+		var resp models.ReplicationUsersResponse
+		for _, user := range users {
+			stats, err := state.store(c).GetUserStats(user.ID)
+			if err != nil {
+				return c.String(http.StatusInternalServerError, "Failed to get the user stats for "+user.Name+".")
+			}
+			resp.Users = append(resp.Users, models.ReplicationUser{
+				UserID:   user.ID,
+				Name:     user.Name,
+				Revision: stats.Revision,
+			})
+		}
+
+		return c.JSON(http.StatusOK, &resp)
+	}
+}
+
+// handleGetReplicationUser returns the metadata of a user's account for a
+// secondary to apply.
+func handleGetReplicationUser(state *serverState) echo.HandlerFunc {
+	return func(c echo.Context) error {
+		userID, err := models.ParseID(c.Param("userid"))
+		if err != nil {
+			return c.String(http.StatusBadRequest, "A valid integer was not used for the user id in the URI.")
+		}
+
+		sqlStore, ok := state.Storage.(*filefreezer.Storage)
+		if !ok {
+			return c.String(http.StatusNotImplemented, "The storage backend doesn't support replication.")
+		}
+		span := state.startSpan(c, "storage.GetUserReplica")
+		replica, err := sqlStore.GetUserReplica(userID)
+		end(span, err)
+		if err != nil {
+			return c.String(http.StatusNotFound, "Failed to get the user for replication.")
+		}
+
+		return c.JSON(http.StatusOK, &models.ReplicationUserResponse{
+			Replica: *replica,
+		})
+	}
+}
+
+// handleGetReplicationChunk returns the raw bytes of a chunk for a secondary.
+func handleGetReplicationChunk(state *serverState) echo.HandlerFunc {
+	return func(c echo.Context) error {
+		fileID, err := models.ParseID(c.Param("fileid"))
+		if err != nil {
+			return c.String(http.StatusBadRequest, "A valid integer was not used for the file id in the URI.")
+		}
+		versionID, err := models.ParseID(c.Param("versionid"))
+		if err != nil {
+			return c.String(http.StatusBadRequest, "A valid integer was not used for the version id in the URI.")
+		}
+		chunkNumber, err := models.ParseChunkNumber(c.Param("chunknumber"))
+		if err != nil {
+			return c.String(http.StatusBadRequest, "A valid integer was not used for the chunk number in the URI.")
+		}
+
+		chunk, err := state.store(c).GetFileChunk(fileID, chunkNumber, versionID)
+		if err != nil {
+			return c.String(http.StatusNotFound, "Failed to get the chunk for the file id and chunk number in the URI.")
+		}
+
+		return c.Blob(http.StatusOK, "application/octet-stream", chunk.Chunk)
+	}
+}
+
+// startReplication launches a goroutine that pulls the changes from the
+// primary every interval until the server is closed.
+func (state *serverState) startReplication(interval time.Duration) {
+	go func() {
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ticker.C:
+				err := state.replicate()
+				if err != nil {
+					state.printf("Failed to replicate from %s: %v\n", state.ReplicateFrom, err)
+				}
+			case <-state.quit:
+				return
+			}
+		}
+	}()
+}
+
+// replicate makes the accounts on this server match the primary's: users the
+// primary no longer has are removed and the accounts whose revision differs
+// are pulled with their new chunks. An account that fails is retried on the
+// next pass while the rest carry on; the first error is returned.
+func (state *serverState) replicate() error {
+	state.replicationLock.Lock()
+	defer state.replicationLock.Unlock()
+
+	sqlStore := state.Storage.(*filefreezer.Storage)
+
+	body, err := state.getFromPrimary("/replication/users")
+	if err != nil {
+		return err
+	}
+	var primary models.ReplicationUsersResponse
+	err = json.Unmarshal(body, &primary)
+	if err != nil {
+		return fmt.Errorf("failed to read the users from the primary: %v", err)
+	}
+
+	// users are removed first so that a name reused on the primary for a new
+	// user doesn't collide with the old one
+	primaryIDs := make(map[int]bool)
+	for _, user := range primary.Users {
+		primaryIDs[user.UserID] = true
+	}
+	localUsers, err := state.Storage.GetAllUsers()
+	if err != nil {
+		return fmt.Errorf("failed to get the local users: %v", err)
+	}
+	localNames := make(map[int]string)
+	var firstErr error
+	for _, user := range localUsers {
+		if primaryIDs[user.ID] {
+			localNames[user.ID] = user.Name
+			continue
+		}
+		state.writeLock.RLock()
+		err = state.Storage.RemoveUser(user.Name)
+		state.writeLock.RUnlock()
+		if err != nil && firstErr == nil {
+			firstErr = err
+		}
+	}
+
+	for _, user := range primary.Users {
+		if name, found := localNames[user.UserID]; found && name == user.Name {
+			stats, err := state.Storage.GetUserStats(user.UserID)
+			if err == nil && stats.Revision == user.Revision {
+				continue
+			}
+		}
+
+		err = state.replicateUser(sqlStore, user.UserID)
+		if err != nil {
+			err = fmt.Errorf("failed to replicate the user %s: %v", user.Name, err)
+			if firstErr == nil {
+				firstErr = err
+			}
+			continue
+		}
+		state.printf("Replicated the account of %s at revision %d.\n", user.Name, user.Revision)
+	}
+
+	return firstErr
+}
+
+// replicateUser pulls a user's account from the primary and applies it.
+func (state *serverState) replicateUser(sqlStore *filefreezer.Storage, userID int) error {
+	body, err := state.getFromPrimary(fmt.Sprintf("/replication/user/%d", userID))
+	if err != nil {
+		return err
+	}
+	var resp models.ReplicationUserResponse
+	err = json.Unmarshal(body, &resp)
+	if err != nil {
+		return fmt.Errorf("failed to read the account from the primary: %v", err)
+	}
+
+	state.writeLock.RLock()
+	defer state.writeLock.RUnlock()
+	return sqlStore.ApplyUserReplica(&resp.Replica, func(chunk filefreezer.ReplicaChunk) ([]byte, error) {
+		return state.getFromPrimary(fmt.Sprintf("/replication/chunk/%d/%d/%d", chunk.FileID, chunk.VersionID, chunk.ChunkNumber))
+	})
+}
+
+// getFromPrimary sends a signed GET request for the path to the primary and
+// returns the response body.
+func (state *serverState) getFromPrimary(path string) ([]byte, error) {
+	expires := time.Now().UTC().Add(replicationURLLifetime).Unix()
+	target := fmt.Sprintf("%s%s?expires=%d&sig=%s", state.ReplicateFrom, path, expires,
+		signReplication(state.ReplicationSecret, "GET", path, expires))
+
+	resp, err := state.replicationClient.Get(target)
+	if err != nil {
+		return nil, fmt.Errorf("failed to reach the primary: %v", err)
+	}
+	defer resp.Body.Close()
+
+	body, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read the response from the primary: %v", err)
+	}
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("the primary returned %s for %s: %s", resp.Status, path, body)
+	}
+
+	return body, nil
+}
@@ -0,0 +1,54 @@
+// Copyright 2017, Timothy Bogdala <tdb@animal-machine.com>
+// See the LICENSE file for more details.
+
+package server
+
+import (
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/labstack/echo"
+)
+
+func TestReplicationSignature(t *testing.T) {
+	state := &serverState{ReplicationSecret: []byte("secret")}
+	e := echo.New()
+	e.GET("/replication/users", func(c echo.Context) error {
+		return c.String(http.StatusOK, "ok")
+	}, checkReplicationSignature(state))
+
+	get := func(path string, expires int64, sig string) int {
+		req := httptest.NewRequest("GET", fmt.Sprintf("%s?expires=%d&sig=%s", path, expires, sig), nil)
+		rec := httptest.NewRecorder()
+		e.ServeHTTP(rec, req)
+		return rec.Code
+	}
+
+	now := time.Now().UTC().Unix()
+	expires := now + 60
+	sig := signReplication(state.ReplicationSecret, "GET", "/replication/users", expires)
+	if code := get("/replication/users", expires, sig); code != http.StatusOK {
+		t.Fatalf("Expected a signed request to be allowed but got %d.", code)
+	}
+
+	// signatures are bound to the secret, expiry and path
+	otherSig := signReplication([]byte("other"), "GET", "/replication/users", expires)
+	if code := get("/replication/users", expires, otherSig); code != http.StatusUnauthorized {
+		t.Fatalf("Expected a request signed with another secret to be refused but got %d.", code)
+	}
+	if code := get("/replication/users", expires+1, sig); code != http.StatusUnauthorized {
+		t.Fatalf("Expected a request with a changed expiry to be refused but got %d.", code)
+	}
+	pastSig := signReplication(state.ReplicationSecret, "GET", "/replication/users", now-1)
+	if code := get("/replication/users", now-1, pastSig); code != http.StatusUnauthorized {
+		t.Fatalf("Expected an expired request to be refused but got %d.", code)
+	}
+	farExpires := now + int64(time.Hour/time.Second)
+	farSig := signReplication(state.ReplicationSecret, "GET", "/replication/users", farExpires)
+	if code := get("/replication/users", farExpires, farSig); code != http.StatusUnauthorized {
+		t.Fatalf("Expected a request expiring too far ahead to be refused but got %d.", code)
+	}
+}
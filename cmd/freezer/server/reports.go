@@ -0,0 +1,202 @@
+// Copyright 2017, Timothy Bogdala <tdb@animal-machine.com>
+// See the LICENSE file for more details.
+
+package server
+
+import (
+	"bytes"
+	"fmt"
+	"net"
+	"net/smtp"
+	"strings"
+	"time"
+)
+
+const (
+	// reportDeletionRatio is the fraction of a user's allocation that has to
+	// disappear between two reports for it to be flagged as a mass deletion.
+	reportDeletionRatio = 0.5
+
+	// reportSpikeRatio is the growth factor of a user's allocation between two
+	// reports that gets flagged as an upload spike.
+	reportSpikeRatio = 2.0
+
+	// reportSpikeMinBytes is the minimum growth in bytes needed before an upload
+	// spike is flagged so that small accounts don't generate noise.
+	reportSpikeMinBytes = 100 * 1024 * 1024
+)
+
+// UsageReportConfig holds the settings used to email usage reports to the admins.
+type UsageReportConfig struct {
+	// SMTPAddr is the host:port of the mail server to send reports through
+	SMTPAddr string
+
+	// SMTPUser and SMTPPass are used for PLAIN authentication if SMTPUser is set
+	SMTPUser string
+	SMTPPass string
+
+	// From is the sender address for the report emails
+	From string
+
+	// To is the list of admin addresses to send the reports to
+	To []string
+
+	// Interval is the time between reports
+	Interval time.Duration
+}
+
+// userUsage is a snapshot of a single user's usage at the time of a report.
+type userUsage struct {
+	Name      string
+	Quota     int
+	Allocated int
+	Physical  int
+	Revision  int
+}
+
+// usageReporter periodically builds usage reports for all users and compares
+// them against the previous report to flag anomalies. Previous snapshots are
+// only kept in memory so the first report after a restart never flags anomalies.
+type usageReporter struct {
+	state    *serverState
+	config   UsageReportConfig
+	previous map[int]userUsage
+}
+
+// startUsageReports launches a goroutine that will email a usage report to the
+// configured admins every interval until the server is closed.
+func (state *serverState) startUsageReports(config UsageReportConfig) {
+	reporter := &usageReporter{
+		state:    state,
+		config:   config,
+		previous: make(map[int]userUsage),
+	}
+
+	go func() {
+		ticker := time.NewTicker(config.Interval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ticker.C:
+				err := reporter.sendReport()
+				if err != nil {
+					state.printf("Failed to send the usage report: %v\n", err)
+				}
+			case <-state.quit:
+				return
+			}
+		}
+	}()
+}
+
+// buildReport gathers the current usage for all users and returns the text of
+// the report along with the number of anomalies that were flagged.
+func (r *usageReporter) buildReport() (string, int, error) {
+	users, err := r.state.Storage.GetAllUsers()
+	if err != nil {
+		return "", 0, err
+	}
+
+	var report bytes.Buffer
+	var anomalies bytes.Buffer
+	anomalyCount := 0
+	current := make(map[int]userUsage)
+
+	report.WriteString(fmt.Sprintf("Filefreezer usage report for %s\n\n", time.Now().Format(time.RFC1123)))
+	report.WriteString(fmt.Sprintf("%-24s %14s %14s %14s %7s %10s\n", "User", "Allocated", "Physical", "Quota", "Used", "Revision"))
+	report.WriteString(strings.Repeat("-", 88) + "\n")
+
+	for _, user := range users {
+		stats, err := r.state.Storage.GetUserStats(user.ID)
+		if err != nil {
+			return "", 0, fmt.Errorf("failed to get the stats for user %s: %v", user.Name, err)
+		}
+		_, physical, err := r.state.Storage.GetUserChunkUsage(user.ID)
+		if err != nil {
+			return "", 0, fmt.Errorf("failed to get the chunk usage for user %s: %v", user.Name, err)
+		}
+
+		usage := userUsage{
+			Name:      user.Name,
+			Quota:     stats.Quota,
+			Allocated: stats.Allocated,
+			Physical:  physical,
+			Revision:  stats.Revision,
+		}
+		current[user.ID] = usage
+
+		var usedPercent float64
+		if usage.Quota > 0 {
+			usedPercent = float64(usage.Allocated) / float64(usage.Quota) * 100.0
+		}
+		report.WriteString(fmt.Sprintf("%-24s %14d %14d %14d %6.1f%% %10d\n",
+			usage.Name, usage.Allocated, usage.Physical, usage.Quota, usedPercent, usage.Revision))
+
+		// compare against the last report to look for anomalies
+		prev, found := r.previous[user.ID]
+		if !found {
+			continue
+		}
+		if prev.Allocated > 0 && float64(prev.Allocated-usage.Allocated) >= float64(prev.Allocated)*reportDeletionRatio {
+			anomalyCount++
+			anomalies.WriteString(fmt.Sprintf("* %s: possible mass deletion; allocation dropped from %d to %d bytes\n",
+				usage.Name, prev.Allocated, usage.Allocated))
+		}
+		growth := usage.Allocated - prev.Allocated
+		if growth >= reportSpikeMinBytes && float64(usage.Allocated) >= float64(prev.Allocated)*reportSpikeRatio {
+			anomalyCount++
+			anomalies.WriteString(fmt.Sprintf("* %s: upload spike; allocation grew from %d to %d bytes\n",
+				usage.Name, prev.Allocated, usage.Allocated))
+		}
+	}
+
+	if anomalyCount > 0 {
+		report.WriteString("\nAnomalies since the last report:\n")
+		report.Write(anomalies.Bytes())
+	}
+
+	r.previous = current
+	return report.String(), anomalyCount, nil
+}
+
+// sendReport builds the usage report and emails it to the configured admins.
+func (r *usageReporter) sendReport() error {
+	text, anomalyCount, err := r.buildReport()
+	if err != nil {
+		return fmt.Errorf("failed to build the usage report: %v", err)
+	}
+
+	subject := "Filefreezer usage report"
+	if anomalyCount > 0 {
+		subject = fmt.Sprintf("Filefreezer usage report (%d anomalies)", anomalyCount)
+	}
+
+	return sendAdminEmail(r.config, subject, text)
+}
+
+// sendAdminEmail sends a plain text email with the subject and text supplied to
+// all of the admin addresses in the report configuration.
+func sendAdminEmail(config UsageReportConfig, subject string, text string) error {
+	var msg bytes.Buffer
+	msg.WriteString(fmt.Sprintf("From: %s\r\n", config.From))
+	msg.WriteString(fmt.Sprintf("To: %s\r\n", strings.Join(config.To, ", ")))
+	msg.WriteString(fmt.Sprintf("Subject: %s\r\n", subject))
+	msg.WriteString("Content-Type: text/plain; charset=UTF-8\r\n\r\n")
+	msg.WriteString(strings.Replace(text, "\n", "\r\n", -1))
+
+	var auth smtp.Auth
+	if config.SMTPUser != "" {
+		host, _, err := net.SplitHostPort(config.SMTPAddr)
+		if err != nil {
+			return fmt.Errorf("failed to parse the SMTP server address %s: %v", config.SMTPAddr, err)
+		}
+		auth = smtp.PlainAuth("", config.SMTPUser, config.SMTPPass, host)
+	}
+
+	err := smtp.SendMail(config.SMTPAddr, auth, config.From, config.To, msg.Bytes())
+	if err != nil {
+		return fmt.Errorf("failed to send the email to the admins: %v", err)
+	}
+
+	return nil
+}
@@ -0,0 +1,94 @@
+// Copyright 2017, Timothy Bogdala <tdb@animal-machine.com>
+// See the LICENSE file for more details.
+
+package server
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/marcoziti/gringotts"
+)
+
+func TestUsageReportAnomalies(t *testing.T) {
+	srv, err := New(Config{
+		DatabasePath: "file:usagereports?mode=memory&cache=shared",
+		ChunkSize:    1024,
+	})
+	if err != nil {
+		t.Fatalf("Failed to create the server: %v", err)
+	}
+	defer srv.Close()
+
+	// the allocations are set directly since the spikes are hundreds of megabytes
+	store := srv.Storage.(*filefreezer.Storage)
+	const quota = 1 << 30
+	allocations := map[string]int{
+		"alice": 1000,
+		"bob":   50 * 1024 * 1024,
+		"carol": 1024 * 1024,
+		"dave":  1000,
+	}
+	ids := make(map[string]int)
+	for name, allocated := range allocations {
+		user, err := srv.Storage.AddUser(name, "salt", []byte("saltedhash"), quota)
+		if err != nil {
+			t.Fatalf("Failed to add a user: %v", err)
+		}
+		ids[name] = user.ID
+		if err = store.SetUserStats(user.ID, quota, allocated, 1); err != nil {
+			t.Fatalf("Failed to set the allocation for %s: %v", name, err)
+		}
+	}
+	setAllocated := func(name string, allocated int) {
+		if err := store.SetUserStats(ids[name], quota, allocated, 2); err != nil {
+			t.Fatalf("Failed to set the allocation for %s: %v", name, err)
+		}
+	}
+
+	// the first report has nothing to compare against
+	reporter := &usageReporter{state: srv.state, previous: make(map[int]userUsage)}
+	text, anomalies, err := reporter.buildReport()
+	if err != nil || anomalies != 0 {
+		t.Fatalf("Expected no anomalies in the first report but got %d: %v", anomalies, err)
+	}
+	for name := range allocations {
+		if !strings.Contains(text, name) {
+			t.Fatalf("Expected the report to list %s:\n%s", name, text)
+		}
+	}
+
+	// losing half of the allocation is a mass deletion but a smaller drop isn't
+	setAllocated("alice", 400)
+	setAllocated("dave", 600)
+	text, anomalies, err = reporter.buildReport()
+	if err != nil || anomalies != 1 {
+		t.Fatalf("Expected one anomaly after the allocation dropped but got %d: %v\n%s", anomalies, err, text)
+	}
+	if !strings.Contains(text, "* alice: possible mass deletion; allocation dropped from 1000 to 400 bytes") {
+		t.Fatalf("Expected the report to flag the mass deletion:\n%s", text)
+	}
+	if strings.Contains(text, "* dave:") {
+		t.Fatalf("Expected the smaller drop not to be flagged:\n%s", text)
+	}
+
+	// a spike has to at least double the allocation and grow it by the minimum
+	setAllocated("bob", 50*1024*1024+reportSpikeMinBytes)
+	setAllocated("carol", 1024*1024+reportSpikeMinBytes-1)
+	text, anomalies, err = reporter.buildReport()
+	if err != nil || anomalies != 1 {
+		t.Fatalf("Expected one anomaly after the upload spike but got %d: %v\n%s", anomalies, err, text)
+	}
+	if !strings.Contains(text, "* bob: upload spike") {
+		t.Fatalf("Expected the report to flag the upload spike:\n%s", text)
+	}
+	if strings.Contains(text, "* carol:") || strings.Contains(text, "* alice:") {
+		t.Fatalf("Expected only the new upload spike to be flagged:\n%s", text)
+	}
+
+	// nothing changed since the last report
+	text, anomalies, err = reporter.buildReport()
+	if err != nil || anomalies != 0 || strings.Contains(text, "Anomalies") {
+		t.Fatalf("Expected no anomalies when nothing changed but got %d: %v\n%s", anomalies, err, text)
+	}
+}
@@ -0,0 +1,212 @@
+// Copyright 2017, Timothy Bogdala <tdb@animal-machine.com>
+// See the LICENSE file for more details.
+
+package server
+
+import (
+	"fmt"
+	"sync"
+	"time"
+)
+
+// reservationTTL is how long a reservation is kept after its last chunk
+// arrived, which releases the quota held by uploads that were abandoned.
+const reservationTTL = time.Hour
+
+// errQuotaReserved is returned when the user's quota is taken up by what's
+// allocated and reserved by the uploads in progress.
+type errQuotaReserved struct {
+	quota, allocated, reserved, wanted int64
+}
+
+func (e *errQuotaReserved) Error() string {
+	return fmt.Sprintf("not enough free allocation space (quota: %d ; current allocation %d ; reserved by uploads %d ; wanted %d)",
+		e.quota, e.allocated, e.reserved, e.wanted)
+}
+
+// reservation is the quota held for the chunks of a file version that
+// haven't been uploaded yet.
+type reservation struct {
+	fileID     int
+	bytes      int64
+	chunksLeft int
+	expires    time.Time
+}
+
+// userReservations are the reservations of a user's uploads in progress.
+// The lock is held while the quota is checked and a reservation is made or a
+// chunk is taken out of one, and the chunks being stored are counted as in
+// flight until they're allocated, so that checking the quota and using it
+// can't be interleaved with another upload.
+type userReservations struct {
+	lock     sync.Mutex
+	versions map[int]*reservation
+	inFlight int64
+}
+
+// quotaReserver reserves quota for uploads when their versions are tagged
+// and settles it as their chunks arrive. Storage checks each chunk against
+// the quota on its own, which lets two uploads started at the same time both
+// get going and then fail halfway once they run out; reserving the size of
+// the whole upload up front turns the second one away before any chunks are
+// sent. Reservations are only kept in memory.
+type quotaReserver struct {
+	state *serverState
+
+	lock  sync.Mutex
+	users map[int]*userReservations
+}
+
+// newQuotaReserver creates a new quota reserver with no reservations.
+func newQuotaReserver(state *serverState) *quotaReserver {
+	return &quotaReserver{
+		state: state,
+		users: make(map[int]*userReservations),
+	}
+}
+
+// user returns the reservations of the user, creating them if needed.
+func (q *quotaReserver) user(userID int) *userReservations {
+	q.lock.Lock()
+	defer q.lock.Unlock()
+	u, found := q.users[userID]
+	if !found {
+		u = &userReservations{versions: make(map[int]*reservation)}
+		q.users[userID] = u
+	}
+	return u
+}
+
+// reserved drops the expired reservations and returns the bytes held by the
+// rest and by the chunks in flight; u.lock must be held.
+func (u *userReservations) reserved(now time.Time) int64 {
+	total := u.inFlight
+	for versionID, r := range u.versions {
+		if now.After(r.expires) {
+			delete(u.versions, versionID)
+			continue
+		}
+		total += r.bytes
+	}
+	return total
+}
+
+// checkQuota returns an *errQuotaReserved if the bytes don't fit in the
+// user's quota next to what's allocated and reserved; u.lock must be held.
+func (q *quotaReserver) checkQuota(userID int, u *userReservations, bytes int64) error {
+	stats, err := q.state.Storage.GetUserStats(userID)
+	if err != nil {
+		return err
+	}
+	reserved := u.reserved(time.Now())
+	if int64(stats.Quota)-int64(stats.Allocated)-reserved < bytes {
+		return &errQuotaReserved{
+			quota:     int64(stats.Quota),
+			allocated: int64(stats.Allocated),
+			reserved:  reserved,
+			wanted:    bytes,
+		}
+	}
+	return nil
+}
+
+// reserve checks that the bytes of an upload of chunkCount chunks fit in the
+// user's quota and then calls tag to create the version they're for, holding
+// them for it if it succeeds. Nothing is reserved for empty uploads.
+func (q *quotaReserver) reserve(userID int, bytes int64, chunkCount int, tag func() (fileID int, versionID int, err error)) error {
+	if bytes <= 0 || chunkCount <= 0 {
+		_, _, err := tag()
+		return err
+	}
+
+	u := q.user(userID)
+	u.lock.Lock()
+	defer u.lock.Unlock()
+	err := q.checkQuota(userID, u, bytes)
+	if err != nil {
+		return err
+	}
+	fileID, versionID, err := tag()
+	if err != nil {
+		return err
+	}
+	u.versions[versionID] = &reservation{
+		fileID:     fileID,
+		bytes:      bytes,
+		chunksLeft: chunkCount,
+		expires:    time.Now().Add(reservationTTL),
+	}
+	return nil
+}
+
+// addChunk calls add to store a chunk of the bytes given for the version and
+// settles the version's reservation with it. The part of the chunk that its
+// version didn't reserve, which is all of it for versions without a
+// reservation, has to fit in the user's quota next to the other reservations.
+// The lock isn't held while the chunk is stored; its bytes count as in flight
+// instead until they're allocated.
+func (q *quotaReserver) addChunk(userID int, versionID int, bytes int64, add func() error) error {
+	u := q.user(userID)
+	u.lock.Lock()
+
+	// the chunk is taken out of the reservation before it's added so that the
+	// chunks of the version uploaded in parallel can't use the same bytes
+	r := u.versions[versionID]
+	var taken int64
+	if r != nil {
+		taken = bytes
+		if taken > r.bytes {
+			taken = r.bytes
+		}
+		r.bytes -= taken
+	}
+	if taken < bytes {
+		err := q.checkQuota(userID, u, bytes-taken)
+		if err != nil {
+			q.settle(u, versionID, r, taken, false)
+			u.lock.Unlock()
+			return err
+		}
+	}
+	u.inFlight += bytes
+	u.lock.Unlock()
+
+	err := add()
+
+	u.lock.Lock()
+	u.inFlight -= bytes
+	q.settle(u, versionID, r, taken, err == nil)
+	u.lock.Unlock()
+	return err
+}
+
+// settle finishes with the bytes taken from the version's reservation for a
+// chunk, giving them back if it wasn't added, and drops the reservation once
+// all of its chunks arrived; u.lock must be held.
+func (q *quotaReserver) settle(u *userReservations, versionID int, r *reservation, taken int64, added bool) {
+	if r == nil {
+		return
+	}
+	if !added {
+		r.bytes += taken
+		return
+	}
+	r.chunksLeft--
+	r.expires = time.Now().Add(reservationTTL)
+	if r.chunksLeft <= 0 {
+		delete(u.versions, versionID)
+	}
+}
+
+// releaseFile drops the reservations for the versions of a file, such as
+// once the file was removed.
+func (q *quotaReserver) releaseFile(userID int, fileID int) {
+	u := q.user(userID)
+	u.lock.Lock()
+	defer u.lock.Unlock()
+	for versionID, r := range u.versions {
+		if r.fileID == fileID {
+			delete(u.versions, versionID)
+		}
+	}
+}
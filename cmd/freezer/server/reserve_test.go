@@ -0,0 +1,204 @@
+// Copyright 2017, Timothy Bogdala <tdb@animal-machine.com>
+// See the LICENSE file for more details.
+
+package server
+
+import (
+	"fmt"
+	"sync"
+	"testing"
+	"time"
+)
+
+// reserveFile reserves the bytes of an upload with the server's reserver
+// while creating the file for it.
+func reserveFile(srv *Server, userID int, name string, bytes int64, chunkCount int) (fileID int, versionID int, err error) {
+	err = srv.state.Reservations.reserve(userID, bytes, chunkCount, func() (int, int, error) {
+		fi, err := srv.Storage.AddFileInfo(userID, name, false, 0644, 100, chunkCount, name, "")
+		if err != nil {
+			return 0, 0, err
+		}
+		fileID, versionID = fi.FileID, fi.CurrentVersion.VersionID
+		return fileID, versionID, nil
+	})
+	return
+}
+
+// storeChunk returns a function that stores a chunk of the length given for
+// the reserver to call.
+func storeChunk(srv *Server, userID, fileID, versionID, number, length int) func() error {
+	return func() error {
+		_, err := srv.Storage.AddFileChunk(userID, fileID, versionID, number, fmt.Sprintf("chunk%d", number), make([]byte, length))
+		return err
+	}
+}
+
+func TestQuotaReserver(t *testing.T) {
+	srv, err := New(Config{
+		DatabasePath: "file:quotareserver?mode=memory&cache=shared",
+		ChunkSize:    1024,
+	})
+	if err != nil {
+		t.Fatalf("Failed to create the server: %v", err)
+	}
+	defer srv.Close()
+
+	user, err := srv.Storage.AddUser("alice", "salt", []byte("saltedhash"), 1000)
+	if err != nil {
+		t.Fatalf("Failed to add a user: %v", err)
+	}
+	reserver := srv.state.Reservations
+	addFile := func(name string, bytes int64, chunkCount int) (int, int, error) {
+		return reserveFile(srv, user.ID, name, bytes, chunkCount)
+	}
+	addChunk := func(fileID, versionID, number, length int) error {
+		return reserver.addChunk(user.ID, versionID, int64(length), storeChunk(srv, user.ID, fileID, versionID, number, length))
+	}
+
+	// the second upload doesn't fit next to the first one's reservation and
+	// isn't created
+	fileA, versionA, err := addFile("a", 800, 2)
+	if err != nil {
+		t.Fatalf("Failed to reserve the first upload: %v", err)
+	}
+	_, _, err = addFile("b", 300, 1)
+	if _, full := err.(*errQuotaReserved); !full {
+		t.Fatalf("Expected the second upload to be turned away but got: %v", err)
+	}
+	if fis, _ := srv.Storage.GetAllUserFileInfos(user.ID); len(fis) != 1 {
+		t.Fatalf("Expected only the first file to be created but found %d files.", len(fis))
+	}
+
+	// chunks without a reservation can't use the reserved bytes either
+	fileC, versionC, err := addFile("c", 0, 1)
+	if err != nil {
+		t.Fatalf("Failed to add a file without a reservation: %v", err)
+	}
+	if err = addChunk(fileC, versionC, 0, 300); err == nil {
+		t.Fatal("Expected a chunk that doesn't fit next to the reservation to fail.")
+	}
+
+	// the reserved chunks settle the reservation as they arrive
+	if err = addChunk(fileA, versionA, 0, 400); err != nil {
+		t.Fatalf("Failed to add a reserved chunk: %v", err)
+	}
+	if err = addChunk(fileA, versionA, 1, 400); err != nil {
+		t.Fatalf("Failed to add a reserved chunk: %v", err)
+	}
+	if len(reserver.user(user.ID).versions) != 0 {
+		t.Fatal("Expected the reservation to be dropped once all of its chunks arrived.")
+	}
+	if err = addChunk(fileC, versionC, 0, 200); err != nil {
+		t.Fatalf("Failed to add a chunk in the remaining quota: %v", err)
+	}
+
+	// removing a file releases what it reserved
+	if err = srv.Storage.RemoveFile(user.ID, fileA); err != nil {
+		t.Fatalf("Failed to remove the file: %v", err)
+	}
+	fileD, _, err := addFile("d", 500, 1)
+	if err != nil {
+		t.Fatalf("Failed to reserve an upload: %v", err)
+	}
+	reserver.releaseFile(user.ID, fileD)
+	if len(reserver.user(user.ID).versions) != 0 {
+		t.Fatal("Expected the reservation of a removed file to be released.")
+	}
+}
+
+func TestQuotaReserverConcurrent(t *testing.T) {
+	srv, err := New(Config{
+		DatabasePath: "file:quotareserverconcurrent?mode=memory&cache=shared",
+		ChunkSize:    1024,
+	})
+	if err != nil {
+		t.Fatalf("Failed to create the server: %v", err)
+	}
+	defer srv.Close()
+
+	user, err := srv.Storage.AddUser("alice", "salt", []byte("saltedhash"), 1000)
+	if err != nil {
+		t.Fatalf("Failed to add a user: %v", err)
+	}
+	reserver := srv.state.Reservations
+
+	// a reserved chunk being stored still holds its bytes, and the user isn't
+	// locked out while it's stored
+	fileA, versionA, err := reserveFile(srv, user.ID, "a", 800, 2)
+	if err != nil {
+		t.Fatalf("Failed to reserve the first upload: %v", err)
+	}
+	storing, release, added := make(chan struct{}), make(chan struct{}), make(chan error)
+	go func() {
+		added <- reserver.addChunk(user.ID, versionA, 400, func() error {
+			close(storing)
+			<-release
+			return storeChunk(srv, user.ID, fileA, versionA, 0, 400)()
+		})
+	}()
+	<-storing
+	reserved := make(chan error)
+	go func() {
+		_, _, err := reserveFile(srv, user.ID, "b", 300, 1)
+		reserved <- err
+	}()
+	select {
+	case err = <-reserved:
+		if _, full := err.(*errQuotaReserved); !full {
+			t.Fatalf("Expected an upload not to fit next to the chunk being stored but got: %v", err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("Timed out reserving an upload while a chunk was being stored.")
+	}
+	close(release)
+	if err = <-added; err != nil {
+		t.Fatalf("Failed to add the reserved chunk: %v", err)
+	}
+	if err = reserver.addChunk(user.ID, versionA, 400, storeChunk(srv, user.ID, fileA, versionA, 1, 400)); err != nil {
+		t.Fatalf("Failed to add the reserved chunk: %v", err)
+	}
+
+	// uploads started at the same time never reserve more than the quota, so
+	// each one that's reserved can add all of its chunks
+	var wg sync.WaitGroup
+	var lock sync.Mutex
+	reservedCount := 0
+	for i := 0; i < 10; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			fileID, versionID, err := reserveFile(srv, user.ID, fmt.Sprintf("concurrent%d", i), 100, 2)
+			if err != nil {
+				return
+			}
+			lock.Lock()
+			reservedCount++
+			lock.Unlock()
+
+			var chunks sync.WaitGroup
+			for number := 0; number < 2; number++ {
+				chunks.Add(1)
+				go func(number int) {
+					defer chunks.Done()
+					err := reserver.addChunk(user.ID, versionID, 50, storeChunk(srv, user.ID, fileID, versionID, number, 50))
+					if err != nil {
+						t.Errorf("Failed to add a chunk of a reserved upload: %v", err)
+					}
+				}(number)
+			}
+			chunks.Wait()
+		}(i)
+	}
+	wg.Wait()
+
+	stats, err := srv.Storage.GetUserStats(user.ID)
+	if err != nil {
+		t.Fatalf("Failed to get the user stats: %v", err)
+	}
+	if reservedCount != 2 || stats.Allocated != 1000 {
+		t.Fatalf("Expected 2 uploads to fill the quota but %d were reserved and %d bytes allocated.", reservedCount, stats.Allocated)
+	}
+	if len(reserver.user(user.ID).versions) != 0 || reserver.user(user.ID).inFlight != 0 {
+		t.Fatal("Expected nothing to be left reserved once the uploads finished.")
+	}
+}
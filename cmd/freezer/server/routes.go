@@ -0,0 +1,1003 @@
+// Copyright 2017, Timothy Bogdala <tdb@animal-machine.com>
+// See the LICENSE file for more details.
+
+package server
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"net/http"
+	"time"
+
+	jwt "github.com/dgrijalva/jwt-go"
+	"github.com/labstack/echo"
+	"github.com/labstack/echo/middleware"
+
+	"github.com/marcoziti/gringotts"
+	"github.com/marcoziti/gringotts/cmd/freezer/models"
+)
+
+const (
+	jwtClaimUserName = "Username"
+	jwtClaimUserID   = "UserID"
+	jwtContextName   = "JwtToken"
+
+	// jwtLifetime is how long an authentication token is valid for
+	jwtLifetime = 15 * time.Minute
+)
+
+type jwtCustomClaims struct {
+	Username string `json:"Username"`
+	UserID   int    `json:"UserID"`
+	jwt.StandardClaims
+}
+
+// initRoutes creates the routing multiplexer for the server
+func initRoutes(state *serverState, e *echo.Echo) {
+	// trace each request and the storage calls made for it
+	if state.tracer != nil {
+		e.Use(traceRequests(state))
+	}
+
+	// log the requests that take too long
+	if state.SlowRequest > 0 {
+		e.Use(logSlowRequests(state, state.SlowRequest))
+	}
+
+	// keep JSON and form bodies small; chunk routes set their own limits
+	e.Use(limitJSONBodies())
+
+	// turn away clients that are too old and tell the rest about new versions
+	e.Use(checkClientVersion(state))
+
+	// let snapshots wait for the requests changing data to finish
+	e.Use(holdWrites(state))
+
+	// refuse anything that would change the data on a read-only replica
+	if state.ReadOnly {
+		e.Use(rejectWrites(state))
+	}
+
+	// setup the user login handler
+	e.POST("/api/users/login", handleUsersLogin(state))
+	e.GET("/api/users/login/params", handleGetLoginParams(state))
+
+	// returns the server's clock so that clients can measure their skew
+	e.GET("/api/time", handleGetTime(state))
+
+	restricted := e.Group("/api")
+	jwtConfig := middleware.JWTConfig{
+		Claims:     &jwtCustomClaims{},
+		ContextKey: "JwtToken",
+		SigningKey: state.JWTSecretBytes,
+	}
+	restricted.Use(middleware.JWTWithConfig(jwtConfig))
+
+	// count the traffic of every authenticated request against the user
+	restricted.Use(meterBandwidth(state))
+
+	// returns the authenticated users's current stats such as quota, allocation and revision counts
+	restricted.GET("/user/stats", handleGetUserStats(state))
+
+	// returns the authenticated user's bandwidth for each of the last days
+	restricted.GET("/user/bandwidth", handleGetUserBandwidth(state))
+
+	// updates the user's crypto hash used to verify the user-entered password client-side.
+	restricted.PUT("/user/cryptohash", handlePutUserCryptoHash(state))
+
+	// returns all files and their whole-file hash
+	restricted.GET("/files", handleGetAllFiles(state))
+
+	// handles registering a file to a user; this and the other routes creating
+	// or removing file versions accept idempotency keys so retries are safe
+	restricted.POST("/files", handlePutFile(state), idempotent(state))
+
+	// returns groups of files whose current versions have the same content
+	restricted.GET("/files/duplicates", handleGetDuplicateFiles(state))
+
+	// handles registering a new file version for a given file id
+	restricted.POST("/file/:fileid/version", handleNewFileVersion(state), idempotent(state))
+
+	// registers a new file version that copies the unchanged chunks of a previous one
+	restricted.POST("/file/:fileid/patch", handlePatchFileVersion(state), idempotent(state))
+
+	// finalizes the chunk count and hash of a version after streaming its chunks
+	restricted.PUT("/file/:fileid/version/:versionid", handleUpdateFileVersion(state))
+
+	// returns a file information response with missing chunk list
+	restricted.GET("/file/:fileid", handleGetFile(state))
+
+	// handles registering a new file version for a given file id
+	restricted.GET("/file/:fileid/versions", handleGetAllFileVersion(state))
+
+	// handles registering a new file version for a given file id
+	restricted.DELETE("/file/:fileid/versions", handleDeleteFileVersions(state), idempotent(state))
+
+	// renames a file, keeping its versions
+	restricted.PUT("/file/:fileid", handleRenameFile(state))
+
+	// deletes a file
+	restricted.DELETE("/file/:fileid", handleDeleteFile(state), idempotent(state))
+
+	// takes, shows and releases the advisory lock on a file
+	restricted.PUT("/file/:fileid/lock", handlePutFileLock(state))
+	restricted.GET("/file/:fileid/lock", handleGetFileLock(state))
+	restricted.DELETE("/file/:fileid/lock", handleDeleteFileLock(state))
+
+	// returns the locks on all of the user's files
+	restricted.GET("/locks", handleGetFileLocks(state))
+
+	// put a file chunk
+	restricted.PUT("/chunk/:fileid/:versionID/:chunknumber/:chunkhash", handlePutFileChunk(state),
+		limitTransfers(state), injectFaults(state), limitBody(state.Storage.MaxChunkSize()+ChunkOverhead))
+
+	// get a file chunk and returns the raw bytes of the encrypted chunk data
+	restricted.GET("/chunk/:fileid/:versionID/:chunknumber", handleGetFileChunk(state), limitEgress(state), limitTransfers(state), injectFaults(state))
+
+	// get all known file chunks (except the chunks themselves)
+	restricted.GET("/chunk/:fileid/:versionID", handleGetFileChunks(state))
+
+	// registers a file to be shared publicly in unencrypted form
+	restricted.POST("/shares", handleAddShare(state))
+
+	// returns all of the user's public shares
+	restricted.GET("/shares", handleGetShares(state))
+
+	// put an unencrypted chunk for a public share
+	restricted.PUT("/share/:shareid/:chunknumber", handlePutShareChunk(state),
+		limitTransfers(state), injectFaults(state), limitBody(state.Storage.MaxChunkSize()))
+
+	// deletes a public share
+	restricted.DELETE("/share/:shareid", handleDeleteShare(state))
+
+	// creates an upload-only drop token
+	restricted.POST("/drops", handleCreateDrop(state))
+
+	// returns all of the user's drop tokens
+	restricted.GET("/drops", handleGetDrops(state))
+
+	// revokes a drop token
+	restricted.DELETE("/drop/:dropid", handleDeleteDrop(state))
+
+	// returns the files uploaded with drop tokens that haven't been collected
+	restricted.GET("/dropfiles", handleGetDropFiles(state))
+
+	// returns the raw bytes of an uncollected drop file
+	restricted.GET("/dropfile/:dropfileid", handleGetDropFile(state), limitEgress(state), limitTransfers(state))
+
+	// deletes an uncollected drop file
+	restricted.DELETE("/dropfile/:dropfileid", handleDeleteDropFile(state))
+
+	// anonymous uploads using a drop token
+	e.PUT("/drop/:token/:filename", handleDropUpload(state), limitTransfers(state))
+
+	// snapshots for backup tools, which need the admin token
+	if state.AdminToken != "" {
+		e.POST("/admin/snapshot", handlePostSnapshot(state), checkAdminToken(state))
+	}
+
+	// signed routes that secondary servers pull accounts and chunks from
+	if len(state.ReplicationSecret) > 0 {
+		e.GET("/replication/users", handleGetReplicationUsers(state), checkReplicationSignature(state))
+		e.GET("/replication/user/:userid", handleGetReplicationUser(state), checkReplicationSignature(state))
+		e.GET("/replication/chunk/:fileid/:versionid/:chunknumber", handleGetReplicationChunk(state), checkReplicationSignature(state))
+	}
+
+	// read-only access to a user's metadata for admins holding a support token
+	e.GET("/support/:token/stats", handleGetUserStats(state), checkSupportToken(state))
+	e.GET("/support/:token/files", handleGetAllFiles(state), checkSupportToken(state))
+	e.GET("/support/:token/file/:fileid/versions", handleGetAllFileVersion(state), checkSupportToken(state))
+	e.GET("/support/:token/chunk/:fileid/:versionID", handleGetFileChunks(state), checkSupportToken(state))
+
+	// exports all of the authenticated user's metadata with a chunk download manifest
+	restricted.GET("/users/self/export", handleExportAccount(state))
+
+	// requests, confirms, shows and cancels the erasure of the authenticated user's account
+	restricted.GET("/users/self/delete", handleGetAccountDeletion(state))
+	restricted.POST("/users/self/delete", handleDeleteAccount(state))
+	restricted.DELETE("/users/self/delete", handleCancelAccountDeletion(state))
+
+	// consent to support access and its audit for the authenticated user
+	restricted.GET("/user/support", handleGetSupport(state))
+	restricted.PUT("/user/support", handlePutSupportConsent(state))
+	restricted.DELETE("/user/support", handleDeleteSupportConsent(state))
+
+	// anonymous read-only access to shared files is only enabled on request
+	if state.PublicShares {
+		e.GET("/public/:username/*", handleGetPublicShare(state), limitTransfers(state))
+		e.HEAD("/public/:username/*", handleGetPublicShare(state), limitTransfers(state))
+	}
+}
+
+// handleUsersLogin handles the incoming POST /api/users/login
+func handleUsersLogin(state *serverState) echo.HandlerFunc {
+	return func(c echo.Context) error {
+		username := c.FormValue("user")
+		password := c.FormValue("password")
+		derived := c.FormValue("derived")
+		if username == "" || (password == "" && derived == "") {
+			return c.String(http.StatusBadRequest, "Both user and password were not supplied.")
+		}
+		if derived == "" && state.NoPlainLogin {
+			return c.String(http.StatusUnauthorized, "Logins with the plaintext password are disabled on this server.")
+		}
+
+		// check the username and password
+		user, err := state.store(c).GetUser(username)
+		if err != nil {
+			return c.String(http.StatusUnauthorized, "Could not find user in the database.")
+		}
+
+		var verified bool
+		if derived != "" {
+			verified = filefreezer.VerifyDerivedLoginPassword(derived, user.SaltedHash)
+		} else {
+			verified = filefreezer.VerifyLoginPassword(password, user.Salt, user.SaltedHash)
+		}
+		if !verified {
+			return c.String(http.StatusUnauthorized, "Could not verify the user against the stored salted hash.")
+		}
+
+		if err != nil || user == nil {
+			return c.String(http.StatusUnauthorized, "Failed to log in with the data provided.")
+		}
+
+		// hashes of the plaintext password are upgraded so that the next
+		// login doesn't have to send it; read-only replicas leave that to the primary
+		if !filefreezer.IsDerivedLoginHash(user.SaltedHash) && !state.ReadOnly {
+			err = upgradeLoginHash(c, state, user, password)
+			if err != nil {
+				state.printf("Failed to upgrade the login hash for %s: %v\n", user.Name, err)
+			}
+		}
+
+		// Set claims
+		now := time.Now()
+		claims := &jwtCustomClaims{
+			user.Name,
+			user.ID,
+			jwt.StandardClaims{
+				ExpiresAt: now.Add(jwtLifetime).Unix(),
+			},
+		}
+
+		// generate the authentication token
+		token := jwt.NewWithClaims(jwt.SigningMethodHS256, claims)
+
+		// Generate encoded token and send it as response.
+		t, err := token.SignedString(state.JWTSecretBytes)
+		if err != nil {
+			return err
+		}
+		if state.QuotaWarnings != nil {
+			state.QuotaWarnings.check(c, user.ID, user.Name)
+		}
+		return c.JSON(http.StatusOK, &models.UserLoginResponse{
+			Token:        t,
+			CryptoHash:   user.CryptoHash,
+			Capabilities: serverCapabilities(state),
+			ServerTime:   now.UnixNano(),
+			ExpiresAt:    claims.ExpiresAt,
+		})
+	}
+}
+
+// serverCapabilities describes what the server supports to clients logging in.
+func serverCapabilities(state *serverState) models.ServerCapabilities {
+	caps := models.ServerCapabilities{
+		ChunkSize:       state.Storage.MaxChunkSize(),
+		LoginVersion:    models.LoginDerived,
+		ProtocolVersion: models.ProtocolVersion,
+		MaxChunkUpload:  state.Storage.MaxChunkSize() + ChunkOverhead,
+		HashAlgorithms:  []string{models.HashSHA1},
+		CryptoVersions:  []int{models.CryptoAESGCM},
+		Features: []string{
+			models.FeatureRename,
+			models.FeatureDuplicates,
+			models.FeatureStreaming,
+			models.FeatureShares,
+			models.FeatureDrops,
+			models.FeatureServerTime,
+			models.FeatureSupport,
+			models.FeatureBandwidth,
+			models.FeatureRechunk,
+			models.FeatureLocks,
+			models.FeaturePatch,
+			models.FeatureIdempotency,
+		},
+		Chunking: state.Chunking,
+	}
+	if state.PublicShares {
+		caps.Features = append(caps.Features, models.FeaturePublicShares)
+	}
+	if state.ReadOnly {
+		caps.Features = append(caps.Features, models.FeatureReadOnly)
+	}
+	return caps
+}
+
+// handleGetLoginParams handles the incoming GET /api/users/login/params which
+// returns the salt a client needs to derive its login password. Unknown users
+// get a salt made from their name so that the response doesn't tell whether
+// the user exists.
+func handleGetLoginParams(state *serverState) echo.HandlerFunc {
+	return func(c echo.Context) error {
+		username := c.QueryParam("user")
+		if username == "" {
+			return c.String(http.StatusBadRequest, "The user was not supplied.")
+		}
+
+		// every user gets the same login version, including those whose hash is
+		// still of the plaintext password, so that the response doesn't reveal
+		// which accounts exist; clients fall back to the plaintext password for those
+		params := models.LoginParamsResponse{LoginVersion: models.LoginDerived}
+		user, err := state.store(c).GetUser(username)
+		if err == nil {
+			params.Salt = user.Salt
+		} else {
+			mac := hmac.New(sha256.New, state.JWTSecretBytes)
+			mac.Write([]byte("login salt:" + username))
+			params.Salt = base64.URLEncoding.EncodeToString(mac.Sum(nil))
+		}
+
+		return c.JSON(http.StatusOK, &params)
+	}
+}
+
+// upgradeLoginHash replaces a user's hash of the plaintext password with one
+// of the derived password, keeping the salt.
+func upgradeLoginHash(c echo.Context, state *serverState, user *filefreezer.User, password string) error {
+	saltedHash, err := filefreezer.GenDerivedLoginHash(password, user.Salt)
+	if err != nil {
+		return err
+	}
+	stats, err := state.store(c).GetUserStats(user.ID)
+	if err != nil {
+		return err
+	}
+	return state.store(c).UpdateUser(user.ID, user.Name, user.Salt, saltedHash, user.CryptoHash, stats.Quota)
+}
+
+// handleGetTime handles the incoming GET /api/time
+func handleGetTime(state *serverState) echo.HandlerFunc {
+	return func(c echo.Context) error {
+		return c.JSON(http.StatusOK, &models.ServerTimeResponse{
+			Time: time.Now().UnixNano(),
+		})
+	}
+}
+
+// handlePutUserCryptoHash updates a user's crypto hash which can be used to verify a
+// client side entered password.
+func handlePutUserCryptoHash(state *serverState) echo.HandlerFunc {
+	return func(c echo.Context) error {
+		jwtToken := c.Get(jwtContextName).(*jwt.Token)
+		claims := jwtToken.Claims.(*jwtCustomClaims)
+		userID := claims.UserID
+
+		// deserialize the JSON object that should be in the request body
+		var req models.UserCryptoHashUpdateRequest
+		err := bindRequest(c, &req)
+		if err != nil {
+			return sendRequestError(c, err)
+		}
+
+		// set the new crypto hash for the user
+		err = state.Storage.UpdateUserCryptoHash(userID, req.CryptoHash)
+		if err != nil {
+			return c.String(http.StatusInternalServerError, "Failed to update the user's crypto hash information for the authenticated user.")
+		}
+
+		return c.JSON(http.StatusOK, &models.UserCryptoHashUpdateResponse{
+			Status: true,
+		})
+	}
+}
+
+// handleGetUserStats returns a JSON object with the authenticated user's current
+// stats susch as the quota, allocated byte count and current revision number.
+func handleGetUserStats(state *serverState) echo.HandlerFunc {
+	return func(c echo.Context) error {
+		jwtToken := c.Get(jwtContextName).(*jwt.Token)
+		claims := jwtToken.Claims.(*jwtCustomClaims)
+
+		stats, err := state.Storage.GetUserStats(claims.UserID)
+		if err != nil {
+			return c.String(http.StatusBadRequest, "Failed to get the user stats information for the authenticated user.")
+		}
+
+		frozen, _, reason, err := state.Storage.GetUserPruningFreeze(claims.UserID)
+		if err != nil {
+			return c.String(http.StatusInternalServerError, "Failed to get the pruning freeze information for the authenticated user.")
+		}
+
+		usage, err := state.usage.get(claims.UserID, stats.Revision)
+		if err != nil {
+			return c.String(http.StatusInternalServerError, "Failed to get the storage used by the authenticated user.")
+		}
+
+		egress, maxEgress, err := userEgress(state, claims.UserID)
+		if err != nil {
+			return c.String(http.StatusInternalServerError, "Failed to get the egress for the authenticated user.")
+		}
+
+		versionLimit := stats.MaxVersions
+		if versionLimit <= 0 {
+			versionLimit = state.MaxVersions
+		}
+
+		return c.JSON(http.StatusOK, &models.UserStatsGetResponse{
+			Stats: filefreezer.UserStats{
+				Quota:       stats.Quota,
+				Allocated:   stats.Allocated,
+				Revision:    stats.Revision,
+				MaxVersions: stats.MaxVersions,
+				MaxEgress:   stats.MaxEgress,
+			},
+			LogicalSize:   usage.LogicalSize,
+			PhysicalSize:  usage.PhysicalSize,
+			FileCount:     usage.FileCount,
+			VersionCount:  usage.VersionCount,
+			UsageRevision: usage.Revision,
+			Egress:        egress,
+			EgressLimit:   maxEgress,
+			VersionLimit:  versionLimit,
+			PruningFrozen: frozen,
+			FrozenReason:  reason,
+		})
+	}
+}
+
+// handleGetAllFiles returns a JSON object with all of the FileInfo objects in Storage
+// that are bound to the user id authorized in the context of the call.
+func handleGetAllFiles(state *serverState) echo.HandlerFunc {
+	return func(c echo.Context) error {
+		jwtToken := c.Get(jwtContextName).(*jwt.Token)
+		claims := jwtToken.Claims.(*jwtCustomClaims)
+
+		// pull down all the fileinfo objects for a user
+		allFileInfos, err := state.Storage.GetAllUserFileInfos(claims.UserID)
+		if err != nil {
+			return c.String(http.StatusNotFound, "Failed to get files for the user.")
+		}
+
+		return c.JSON(http.StatusOK, &models.AllFilesGetResponse{
+			Files: allFileInfos,
+		})
+	}
+}
+
+// handleGetDuplicateFiles returns a JSON object with the groups of files bound to
+// the user id authorized in the context of the call that have the same content hash
+// for their current versions.
+func handleGetDuplicateFiles(state *serverState) echo.HandlerFunc {
+	return func(c echo.Context) error {
+		jwtToken := c.Get(jwtContextName).(*jwt.Token)
+		claims := jwtToken.Claims.(*jwtCustomClaims)
+
+		groups, err := state.Storage.GetDuplicateFileInfos(claims.UserID)
+		if err != nil {
+			return c.String(http.StatusNotFound, "Failed to get the duplicate files for the user.")
+		}
+
+		return c.JSON(http.StatusOK, &models.DuplicateFilesGetResponse{
+			Groups: groups,
+		})
+	}
+}
+
+func handleNewFileVersion(state *serverState) echo.HandlerFunc {
+	return func(c echo.Context) error {
+		jwtToken := c.Get(jwtContextName).(*jwt.Token)
+		claims := jwtToken.Claims.(*jwtCustomClaims)
+
+		// deserialize the JSON object that should be in the request body
+		var req models.NewFileVersionRequest
+		err := bindRequest(c, &req)
+		if err != nil {
+			return sendRequestError(c, err)
+		}
+
+		// pull the file id from the URI matched by the mux
+		fileID, err := models.ParseID(c.Param("fileid"))
+		if err != nil {
+			return c.String(http.StatusBadRequest, "A valid integer was not used for the file id in the URI.")
+		}
+
+		// pull down the fileinfo object for a file ID
+		fi, err := state.store(c).GetFileInfo(claims.UserID, fileID)
+		if err != nil {
+			return c.String(http.StatusNotFound, "Failed to get file for the user.")
+		}
+
+		// create new file version with its size reserved from the user's quota
+		err = state.Reservations.reserve(claims.UserID, req.Size, req.ChunkCount, func() (int, int, error) {
+			var err error
+			fi, err = state.store(c).TagNewFileVersion(claims.UserID, fileID, req.Permissions, req.LastMod, req.ChunkCount, req.FileHash, req.Device)
+			if err != nil {
+				return 0, 0, err
+			}
+			return fi.FileID, fi.CurrentVersion.VersionID, nil
+		})
+		if _, full := err.(*errQuotaReserved); full {
+			return c.String(http.StatusInsufficientStorage, "Failed to reserve space for the new version of the file: "+err.Error())
+		}
+		if err != nil {
+			return c.String(http.StatusInternalServerError, "Failed to tag a new version of the file for the user: "+err.Error())
+		}
+		state.Activity.recordNewVersion(claims.UserID, claims.Username)
+		enforceMaxVersions(c, state, claims.UserID, claims.Username, fi)
+
+		return c.JSON(http.StatusOK, &models.NewFileVersionResponse{
+			FileInfo: *fi,
+			Status:   true,
+		})
+	}
+}
+
+func handlePatchFileVersion(state *serverState) echo.HandlerFunc {
+	return func(c echo.Context) error {
+		jwtToken := c.Get(jwtContextName).(*jwt.Token)
+		claims := jwtToken.Claims.(*jwtCustomClaims)
+
+		// deserialize the JSON object that should be in the request body
+		var req models.FilePatchRequest
+		err := bindRequest(c, &req)
+		if err != nil {
+			return sendRequestError(c, err)
+		}
+
+		// pull the file id from the URI matched by the mux
+		fileID, err := models.ParseID(c.Param("fileid"))
+		if err != nil {
+			return c.String(http.StatusBadRequest, "A valid integer was not used for the file id in the URI.")
+		}
+
+		// pull down the fileinfo object for a file ID
+		_, err = state.Storage.GetFileInfo(claims.UserID, fileID)
+		if err != nil {
+			return c.String(http.StatusNotFound, "Failed to get file for the user.")
+		}
+
+		// the base version's chunk count bounds the chunks copied for
+		// clients that list the replaced chunks
+		versions, err := state.Storage.GetFileVersions(fileID)
+		if err != nil {
+			return c.String(http.StatusNotFound, "Failed to get the versions of the file for the user.")
+		}
+		baseChunkCount := 0
+		for _, v := range versions {
+			if v.VersionID == req.BaseVersionID {
+				baseChunkCount = v.ChunkCount
+			}
+		}
+
+		// create the new file version with the unchanged chunks copied over
+		fi, err := state.Storage.PatchFileVersion(claims.UserID, fileID, req.BaseVersionID, req.Permissions,
+			req.LastMod, req.ChunkCount, req.FileHash, req.Device, req.PatchSources(baseChunkCount))
+		if err != nil {
+			return c.String(http.StatusBadRequest, "Failed to patch the file for the user: "+err.Error())
+		}
+		state.Activity.recordNewVersion(claims.UserID, claims.Username)
+		enforceMaxVersions(c, state, claims.UserID, claims.Username, fi)
+
+		return c.JSON(http.StatusOK, &models.NewFileVersionResponse{
+			FileInfo: *fi,
+			Status:   true,
+		})
+	}
+}
+
+func handleUpdateFileVersion(state *serverState) echo.HandlerFunc {
+	return func(c echo.Context) error {
+		jwtToken := c.Get(jwtContextName).(*jwt.Token)
+		claims := jwtToken.Claims.(*jwtCustomClaims)
+
+		// deserialize the JSON object that should be in the request body
+		var req models.FileVersionUpdateRequest
+		err := bindRequest(c, &req)
+		if err != nil {
+			return sendRequestError(c, err)
+		}
+
+		// pull the file and version ids from the URI matched by the mux
+		fileID, err := models.ParseID(c.Param("fileid"))
+		if err != nil {
+			return c.String(http.StatusBadRequest, "A valid integer was not used for the file id in the URI.")
+		}
+		versionID, err := models.ParseID(c.Param("versionid"))
+		if err != nil {
+			return c.String(http.StatusBadRequest, "A valid integer was not used for the version id in the URI.")
+		}
+
+		err = state.Storage.UpdateFileVersionChunks(claims.UserID, fileID, versionID, req.ChunkCount, req.FileHash)
+		if errors.Is(err, filefreezer.ErrVersionFinalized) {
+			return c.String(http.StatusConflict, "Failed to update the file version for the user: "+err.Error())
+		}
+		if err != nil {
+			return c.String(http.StatusBadRequest, "Failed to update the file version for the user: "+err.Error())
+		}
+
+		return c.JSON(http.StatusOK, &models.FileVersionUpdateResponse{
+			Status: true,
+		})
+	}
+}
+
+func handleGetAllFileVersion(state *serverState) echo.HandlerFunc {
+	return func(c echo.Context) error {
+		jwtToken := c.Get(jwtContextName).(*jwt.Token)
+		claims := jwtToken.Claims.(*jwtCustomClaims)
+
+		// pull the file id from the URI matched by the mux
+		fileID, err := models.ParseID(c.Param("fileid"))
+		if err != nil {
+			return c.String(http.StatusBadRequest, "A valid integer was not used for the file id in the URI.")
+		}
+
+		// make sure the file belongs to the user
+		_, err = state.Storage.GetFileInfo(claims.UserID, fileID)
+		if err != nil {
+			return c.String(http.StatusNotFound, "Failed to get file for the user.")
+		}
+
+		// get all the versions associated with the file in storage
+		versions, err := state.Storage.GetFileVersions(fileID)
+		if err != nil {
+			return c.String(http.StatusNotFound, "Failed to get file versions for the user.")
+		}
+
+		return c.JSON(http.StatusOK, &models.FileGetAllVersionsResponse{
+			Versions: versions,
+		})
+	}
+}
+
+func handleDeleteFileVersions(state *serverState) echo.HandlerFunc {
+	return func(c echo.Context) error {
+		jwtToken := c.Get(jwtContextName).(*jwt.Token)
+		claims := jwtToken.Claims.(*jwtCustomClaims)
+
+		// pull the file id from the URI matched by the mux
+		fileID, err := models.ParseID(c.Param("fileid"))
+		if err != nil {
+			return c.String(http.StatusBadRequest, "A valid integer was not used for the file id in the URI.")
+		}
+
+		// deserialize the JSON object that should be in the request body
+		var req models.FileDeleteVersionsRequest
+		err = bindRequest(c, &req)
+		if err != nil {
+			return sendRequestError(c, err)
+		}
+
+		if locked, err := checkPruningFreeze(c, state, claims.UserID); locked {
+			return err
+		}
+
+		err = state.Storage.RemoveFileVersions(claims.UserID, fileID, req.MinVersion, req.MaxVersion)
+		if err != nil {
+			return c.String(http.StatusBadRequest, "Failed to remove file versions for the file: "+err.Error())
+		}
+
+		return c.JSON(http.StatusOK, &models.FileDeleteVersionsResponse{
+			Status: true,
+		})
+	}
+}
+
+// handleGetFile returns a JSON object with all of the FileInfo data for the file in Storage
+// as well as a slice of missing chunks, if any.
+func handleGetFile(state *serverState) echo.HandlerFunc {
+	return func(c echo.Context) error {
+		jwtToken := c.Get(jwtContextName).(*jwt.Token)
+		claims := jwtToken.Claims.(*jwtCustomClaims)
+
+		// pull the file id from the URI matched by the mux
+		fileID, err := models.ParseID(c.Param("fileid"))
+		if err != nil {
+			return c.String(http.StatusBadRequest, "A valid integer was not used for the file id in the URI.")
+		}
+
+		// pull down the fileinfo object for a file ID
+		fi, err := state.store(c).GetFileInfo(claims.UserID, fileID)
+		if err != nil {
+			return c.String(http.StatusNotFound, "Failed to get file for the user.")
+		}
+
+		// get all of the missing chunks
+		missingChunks, err := state.store(c).GetMissingChunkNumbersForFile(claims.UserID, fi.FileID)
+		if err != nil {
+			return c.String(http.StatusBadRequest, "Failed to get the missing chunks for the file.")
+		}
+
+		return c.JSON(http.StatusOK, &models.FileGetResponse{
+			FileInfo:      *fi,
+			MissingChunks: missingChunks,
+		})
+	}
+}
+
+// handlePutFileChunk reads a chunk from the request body and attempts to store it given the
+// file ID, chunk number and hash supplied in parameters. A Status boolean is returned to
+// indicate the success of the operation.
+func handlePutFileChunk(state *serverState) echo.HandlerFunc {
+	return func(c echo.Context) error {
+		jwtToken := c.Get(jwtContextName).(*jwt.Token)
+		claims := jwtToken.Claims.(*jwtCustomClaims)
+
+		// pull the file id from the URI matched by the mux
+		fileID, err := models.ParseID(c.Param("fileid"))
+		if err != nil {
+			return c.String(http.StatusBadRequest, "A valid integer was not used for the file id in the URI.")
+		}
+		versionID, err := models.ParseID(c.Param("versionID"))
+		if err != nil {
+			return c.String(http.StatusBadRequest, "A valid string was not used for the version id in the URI.")
+		}
+		chunkNumber, err := models.ParseChunkNumber(c.Param("chunknumber"))
+		if err != nil {
+			return c.String(http.StatusBadRequest, "A valid integer was not used for the chunk number in the URI.")
+		}
+		chunkHash := c.Param("chunkhash")
+		if chunkHash == "" {
+			return c.String(http.StatusBadRequest, "A valid string was not used for the chunk hash.")
+		}
+
+		// the route limits the body to the maximum chunk size supported by Storage
+		// plus a little extra space for cryptography information; the time it
+		// takes to arrive is traced apart from the time spent storing it
+		span := state.startSpan(c, "read chunk")
+		chunk, err := readBody(c)
+		span.End()
+		if err != nil {
+			return sendRequestError(c, err)
+		}
+
+		// AddFileChunk does verify that the user ID owns the fild ID so we don't need
+		// to replicate that work here, just add the chunk and settle the space
+		// reserved for it.
+		err = state.Reservations.addChunk(claims.UserID, versionID, int64(len(chunk)), func() error {
+			fc, err := state.store(c).AddFileChunk(claims.UserID, fileID, versionID, chunkNumber, chunkHash, chunk)
+			if err == nil && fc == nil {
+				err = fmt.Errorf("no chunk was added")
+			}
+			return err
+		})
+		if _, full := err.(*errQuotaReserved); full {
+			return c.String(http.StatusInsufficientStorage, "Failed to add the chunk to storage: "+err.Error())
+		}
+		if err != nil {
+			return c.String(http.StatusInternalServerError, "Failed to add the chunk to storage: "+err.Error())
+		}
+		if state.QuotaWarnings != nil {
+			state.QuotaWarnings.check(c, claims.UserID, claims.Username)
+		}
+
+		return c.JSON(http.StatusOK, &models.FileChunkPutResponse{
+			Status: true,
+		})
+	}
+}
+
+// handleGetFile returns a JSON object with all of the FileInfo data for the file in Storage
+// as well as a slice of missing chunks, if any.
+func handleGetFileChunks(state *serverState) echo.HandlerFunc {
+	return func(c echo.Context) error {
+		jwtToken := c.Get(jwtContextName).(*jwt.Token)
+		claims := jwtToken.Claims.(*jwtCustomClaims)
+
+		// pull the file id from the URI matched by the mux
+		fileID, err := models.ParseID(c.Param("fileid"))
+		if err != nil {
+			return c.String(http.StatusBadRequest, "A valid integer was not used for the file id in the URI.")
+		}
+		versionID, err := models.ParseID(c.Param("versionID"))
+		if err != nil {
+			return c.String(http.StatusBadRequest, "A valid string was not used for the version id in the URI.")
+		}
+
+		chunks, err := state.store(c).GetFileChunkInfos(claims.UserID, fileID, versionID)
+		if err != nil {
+			return c.String(http.StatusBadRequest, "Failed to get the chunk informations for the file id in the URI.")
+		}
+
+		return c.JSON(http.StatusOK, &models.FileChunksGetResponse{
+			Chunks: chunks,
+		})
+	}
+}
+
+// handleGetFile returns a JSON object with all of the FileInfo data for the file in Storage
+// as well as a slice of missing chunks, if any.
+func handleGetFileChunk(state *serverState) echo.HandlerFunc {
+	return func(c echo.Context) error {
+		jwtToken := c.Get(jwtContextName).(*jwt.Token)
+		claims := jwtToken.Claims.(*jwtCustomClaims)
+
+		// pull the file id from the URI matched by the mux
+		fileID, err := models.ParseID(c.Param("fileid"))
+		if err != nil {
+			return c.String(http.StatusBadRequest, "A valid integer was not used for the file id in the URI.")
+		}
+		versionID, err := models.ParseID(c.Param("versionID"))
+		if err != nil {
+			return c.String(http.StatusBadRequest, "A valid string was not used for the version id in the URI.")
+		}
+		chunkNumber, err := models.ParseChunkNumber(c.Param("chunknumber"))
+		if err != nil {
+			return c.String(http.StatusBadRequest, "A valid integer was not used for the chunk number in the URI.")
+		}
+
+		// get the file info first to ensure ownership
+		fi, err := state.store(c).GetFileInfo(claims.UserID, fileID)
+		if err != nil {
+			return c.String(http.StatusBadRequest, "Failed to get the file information for the file id in the URI.")
+		}
+		if fi.UserID != claims.UserID {
+			return c.String(http.StatusForbidden, "Access denied.")
+		}
+
+		chunk, err := state.store(c).GetFileChunk(fileID, chunkNumber, versionID)
+		if err != nil {
+			return c.String(http.StatusBadRequest, "Failed to get the chunk information for the file id and chunk number in the URI.")
+		}
+
+		return c.Blob(http.StatusOK, "application/octet-stream", chunk.Chunk)
+	}
+}
+
+// handlePutFile registers a file for a given user.
+func handlePutFile(state *serverState) echo.HandlerFunc {
+	return func(c echo.Context) error {
+		jwtToken := c.Get(jwtContextName).(*jwt.Token)
+		claims := jwtToken.Claims.(*jwtCustomClaims)
+
+		// deserialize the JSON object that should be in the request body
+		var req models.FilePutRequest
+		err := bindRequest(c, &req)
+		if err != nil {
+			return sendRequestError(c, err)
+		}
+
+		// sanity check some input
+		if len(req.FileName) < 1 {
+			return c.String(http.StatusBadRequest, "fileName must be supplied in the request")
+		}
+		if req.LastMod < 1 {
+			return c.String(http.StatusBadRequest, "lastMod time must be supplied in the request")
+		}
+		if req.ChunkCount < 0 {
+			return c.String(http.StatusBadRequest, "chunkCount must be supplied in the request")
+		}
+		// a file without chunks or a hash is an unfinished stream that gets
+		// both when its version is finalized
+		if len(req.FileHash) < 1 && !req.IsDir && req.ChunkCount != 0 {
+			return c.String(http.StatusBadRequest, "fileHash must be supplied in the request")
+		}
+
+		// register a new file in storage with the information and its size
+		// reserved from the user's quota
+		var fi *filefreezer.FileInfo
+		err = state.Reservations.reserve(claims.UserID, req.Size, req.ChunkCount, func() (int, int, error) {
+			var err error
+			fi, err = state.store(c).AddFileInfo(claims.UserID, req.FileName, req.IsDir, req.Permissions, req.LastMod, req.ChunkCount, req.FileHash, req.Device)
+			if err != nil {
+				return 0, 0, err
+			}
+			return fi.FileID, fi.CurrentVersion.VersionID, nil
+		})
+		if _, full := err.(*errQuotaReserved); full {
+			return c.String(http.StatusInsufficientStorage, "Failed to reserve space for the new file: "+err.Error())
+		}
+		if err != nil {
+			return c.String(http.StatusConflict, "Failed to put a new file in storage for the user. "+err.Error())
+		}
+
+		return c.JSON(http.StatusOK, &models.FilePutResponse{
+			FileInfo: *fi,
+		})
+	}
+}
+
+// handleRenameFile handles the incoming PUT /api/file/:fileid which sets a new
+// (encrypted) name for the file.
+func handleRenameFile(state *serverState) echo.HandlerFunc {
+	return func(c echo.Context) error {
+		jwtToken := c.Get(jwtContextName).(*jwt.Token)
+		claims := jwtToken.Claims.(*jwtCustomClaims)
+
+		// pull the file id from the URI matched by the mux
+		fileID, err := models.ParseID(c.Param("fileid"))
+		if err != nil {
+			return c.String(http.StatusBadRequest, "A valid integer was not used for the file id in the URI.")
+		}
+
+		// deserialize the JSON object that should be in the request body
+		var req models.FileRenameRequest
+		err = bindRequest(c, &req)
+		if err != nil {
+			return sendRequestError(c, err)
+		}
+
+		err = state.Storage.RenameFile(claims.UserID, fileID, req.FileName)
+		if err != nil {
+			return c.String(http.StatusConflict, "Failed to rename a file in storage for the user. "+err.Error())
+		}
+
+		return c.JSON(http.StatusOK, &models.FileRenameResponse{Success: true})
+	}
+}
+
+func handleDeleteFile(state *serverState) echo.HandlerFunc {
+	return func(c echo.Context) error {
+		jwtToken := c.Get(jwtContextName).(*jwt.Token)
+		claims := jwtToken.Claims.(*jwtCustomClaims)
+
+		// pull the file id from the URI matched by the mux
+		fileID, err := models.ParseID(c.Param("fileid"))
+		if err != nil {
+			return c.String(http.StatusBadRequest, "A valid integer was not used for the file id in the URI.")
+		}
+
+		if locked, err := checkPruningFreeze(c, state, claims.UserID); locked {
+			return err
+		}
+
+		// delete a file from storage with the information
+		err = state.Storage.RemoveFile(claims.UserID, fileID)
+		if err != nil {
+			return c.String(http.StatusConflict, "Failed to remove a file in storage for the user. "+err.Error())
+		}
+		state.Reservations.releaseFile(claims.UserID, fileID)
+
+		return c.JSON(http.StatusOK, &models.FileDeleteResponse{Success: true})
+	}
+}
+
+// enforceMaxVersions removes the oldest versions of the file beyond the user's
+// maximum versions, or the server's if the user doesn't have one. Nothing is
+// removed while the user's pruning is frozen. Failures are only logged since
+// the new version was already tagged.
+func enforceMaxVersions(c echo.Context, state *serverState, userID int, username string, fi *filefreezer.FileInfo) {
+	stats, err := state.store(c).GetUserStats(userID)
+	if err != nil {
+		state.printf("Failed to get the maximum versions for %s: %v\n", username, err)
+		return
+	}
+	limit := stats.MaxVersions
+	if limit <= 0 {
+		limit = state.MaxVersions
+	}
+	if limit <= 0 || fi.CurrentVersion.VersionNumber <= limit {
+		return
+	}
+
+	frozen, _, _, err := state.store(c).GetUserPruningFreeze(userID)
+	if err != nil || frozen {
+		return
+	}
+
+	maxVersion := fi.CurrentVersion.VersionNumber - limit
+	err = state.store(c).RemoveFileVersions(userID, fi.FileID, 0, maxVersion)
+	if err != nil {
+		state.printf("Failed to prune the versions of file %d for %s: %v\n", fi.FileID, username, err)
+	}
+}
+
+// checkPruningFreeze returns true if the user's account has pruning frozen, in which
+// case the error from writing the response to the context is also returned.
+func checkPruningFreeze(c echo.Context, state *serverState, userID int) (bool, error) {
+	frozen, _, reason, err := state.Storage.GetUserPruningFreeze(userID)
+	if err != nil {
+		return true, c.String(http.StatusInternalServerError, "Failed to check the pruning freeze for the user.")
+	}
+	if frozen {
+		return true, c.String(http.StatusLocked, "File and version removal is frozen for this account: "+reason)
+	}
+
+	return false, nil
+}
@@ -0,0 +1,695 @@
+// Copyright 2017, Timothy Bogdala <tdb@animal-machine.com>
+// See the LICENSE file for more details.
+
+// Package server implements the filefreezer HTTP API so that it can be served
+// by the freezer command or embedded in other Go programs and tests.
+package server
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/tls"
+	"fmt"
+	"net"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/labstack/echo"
+	"go.opentelemetry.io/otel/trace"
+
+	"github.com/marcoziti/gringotts"
+)
+
+const (
+	// lowMemoryCacheKiB is the SQLite page cache size used in low memory mode.
+	lowMemoryCacheKiB = 2048
+
+	// lowMemoryTransfers and lowMemoryUserTransfers cap the transfer limits in
+	// low memory mode; with 4 MB chunks they keep the chunk buffers in flight
+	// to a few dozen megabytes.
+	lowMemoryTransfers     = 4
+	lowMemoryUserTransfers = 2
+)
+
+// Config is the configuration used to create a new Server.
+type Config struct {
+	// Backend is the name of the registered storage backend to use; an
+	// empty name uses the SQLite backend
+	Backend string
+
+	// DatabasePath is the data source handed to the storage backend, which for
+	// the SQLite backend is the file path or DSN of the database
+	DatabasePath string
+
+	// ChunkStores, if set, are the URLs of the filefreezer.BlobStores that keep
+	// the chunk data instead of the database, such as azure://account/container
+	// or gs://bucket; only the SQLite backend supports them. More than one store
+	// mirrors the chunks with failover between them.
+	ChunkStores []string
+
+	// ChunkStoreCheckInterval is how often mirrored chunk stores are checked
+	// for health; it defaults to a minute.
+	ChunkStoreCheckInterval time.Duration
+
+	// ChunkKeysPath, if set, is a key file read with filefreezer.LoadChunkKeyring
+	// whose keys encrypt the data in the chunk stores at rest. A store uses the
+	// key named by a key parameter in its URL, such as gs://bucket?key=cold1,
+	// and otherwise the last key in the file.
+	ChunkKeysPath string
+
+	// ChunkSize is the number of bytes contained in one chunk
+	ChunkSize int64
+
+	// Chunking is how clients are told to split files into chunks, one of
+	// the filefreezer.Chunking methods; it defaults to ChunkingFixed. With
+	// ChunkingFastCDC chunks vary in size up to ChunkSize.
+	Chunking string
+
+	// JWTSecret is used to sign the authentication tokens; if it's empty a
+	// random secret is generated which makes tokens only valid for this Server.
+	JWTSecret []byte
+
+	// FreezeCount is the number of new file versions within FreezeWindow that
+	// freezes pruning for an account; a value less than one disables it.
+	FreezeCount int
+
+	// FreezeWindow is the length of the window used to count new file versions
+	FreezeWindow time.Duration
+
+	// PublicShares enables anonymous read-only access to the files that
+	// users have shared.
+	PublicShares bool
+
+	// NoPlainLogin rejects logins that send the plaintext password instead of
+	// the derived one, which also stops accounts with hashes from older
+	// versions from being upgraded.
+	NoPlainLogin bool
+
+	// MinClientVersion, if set, is the oldest client version whose API requests
+	// are accepted; older clients get 426 Upgrade Required.
+	MinClientVersion string
+
+	// LatestClientVersion, if set, is sent with every API response so that
+	// older clients can tell their users an upgrade is available.
+	LatestClientVersion string
+
+	// MaxTransfers and MaxUserTransfers limit the chunk transfers in flight for
+	// the server and for each user; zero disables the limit.
+	MaxTransfers     int
+	MaxUserTransfers int
+
+	// MaxVersions is the number of versions of each file kept for users that
+	// don't have their own limit; older versions are pruned when a new one is
+	// tagged. Zero keeps every version.
+	MaxVersions int
+
+	// MaxEgress is the number of bytes users without their own limit can
+	// download each calendar month (UTC) before their downloads are turned
+	// away; zero is unlimited.
+	MaxEgress int64
+
+	// DeletionGrace is the time between a user confirming the erasure of
+	// their account and the server erasing it; it defaults to a week.
+	DeletionGrace time.Duration
+
+	// DeletionCheckInterval is how often the server looks for accounts to
+	// erase; it defaults to a minute.
+	DeletionCheckInterval time.Duration
+
+	// UsageInterval is how often the server recounts the files, versions
+	// and chunk bytes of the users that changed anything, which the stats
+	// requests report; it defaults to a minute.
+	UsageInterval time.Duration
+
+	// RechunkInterval is how often the server rechunks one of the shares
+	// whose chunks don't match ChunkSize, such as after it was changed;
+	// zero disables rechunking.
+	RechunkInterval time.Duration
+
+	// ReplicationSecret, if set, is the secret shared with secondary servers
+	// that signs their requests to the /replication routes, which are only
+	// served when it's set. Replication needs the SQLite backend.
+	ReplicationSecret []byte
+
+	// ReplicateFrom, if set, is the URL of a primary server whose accounts
+	// this server pulls as a warm standby using the ReplicationSecret.
+	ReplicateFrom string
+
+	// ReplicationInterval is how often a secondary pulls the changes from its
+	// primary; it defaults to a minute.
+	ReplicationInterval time.Duration
+
+	// AdminToken, if set, is the bearer token required by the /admin routes,
+	// which are only served when it's set.
+	AdminToken string
+
+	// SnapshotDir is the directory that database snapshots and their chunk
+	// manifests are written to by the /admin/snapshot route.
+	SnapshotDir string
+
+	// ReadOnly refuses every request that would change the data, such as
+	// uploads, removals and account changes, so that a replica can serve
+	// restores while the primary is being rebuilt. Replication from a primary
+	// and logging in still work, but accounts aren't erased.
+	ReadOnly bool
+
+	// QuotaWarnings are the percentages of their quota at which users are
+	// warned, such as 80 and 95; none disables the warnings. Responses to a
+	// user over one carry models.QuotaWarningHeader, and the first time a user
+	// crosses each one it's posted to QuotaWebhook and emailed to the admins.
+	QuotaWarnings []int
+
+	// QuotaWebhook, if set, is the URL that a models.QuotaWarning is posted to
+	// as JSON when a user crosses a quota warning threshold.
+	QuotaWebhook string
+
+	// LowMemory runs the server in a profile meant for devices with around
+	// 512 MB of memory, such as NAS boxes and Raspberry Pis: the SQLite page
+	// cache is kept small, memory mapping is off and the transfer limits are
+	// capped at lowMemoryTransfers and lowMemoryUserTransfers.
+	LowMemory bool
+
+	// AdminEmail is the configuration used to email usage reports and alerts
+	// to the admins; nil if no admin addresses were configured.
+	AdminEmail *UsageReportConfig
+
+	// Faults injects delays, dropped connections and errors into a fraction
+	// of the chunk requests for testing clients; the zero value disables it.
+	Faults FaultConfig
+
+	// SlowRequest, if set, logs the requests that take longer to handle.
+	SlowRequest time.Duration
+
+	// SlowQuery, if set, logs the storage queries that take longer to run;
+	// only the SQLite backend supports it.
+	SlowQuery time.Duration
+
+	// Tracing exports OpenTelemetry spans of the requests and the storage
+	// calls made for them; the zero value disables it.
+	Tracing TracingConfig
+
+	// Logf is used to log messages from the server; nil discards them.
+	Logf func(format string, v ...interface{})
+}
+
+// Server is a filefreezer server. Its Handler can be served with any
+// net/http server, or Start can be used to serve it on an address so that
+// other Go programs can embed a server without running the freezer command.
+type Server struct {
+	// Storage is the filefreezer storage backend used to keep data
+	Storage filefreezer.Backend
+
+	state   *serverState
+	handler http.Handler
+
+	lock       sync.Mutex
+	httpServer *http.Server
+	listener   net.Listener
+	closeOnce  sync.Once
+}
+
+// serverState represents the server state and includes configuration flags.
+type serverState struct {
+	// DatabasePath is the file path to the database used for storage
+	DatabasePath string
+
+	// Storage is the filefreezer storage backend used to keep data
+	Storage filefreezer.Backend
+
+	// JWTSecretBytes is the slice used to authenticate JWT tokens for this
+	// server instance.
+	JWTSecretBytes []byte
+
+	// AdminEmail is the configuration used to email the admins; nil if
+	// no admin addresses were configured.
+	AdminEmail *UsageReportConfig
+
+	// Activity watches for bursts of new file versions and freezes pruning
+	// for accounts that look like they're being rewritten by ransomware.
+	Activity *activityMonitor
+
+	// PublicShares enables anonymous read-only access to the files that
+	// users have shared.
+	PublicShares bool
+
+	// Chunking is how clients split files into chunks.
+	Chunking string
+
+	// NoPlainLogin rejects logins that send the plaintext password.
+	NoPlainLogin bool
+
+	// MinClientVersion and LatestClientVersion are the oldest client version
+	// accepted and the newest one available; either can be empty.
+	MinClientVersion    string
+	LatestClientVersion string
+
+	// MaxVersions is the number of versions of each file kept for users
+	// without their own limit; zero keeps every version.
+	MaxVersions int
+
+	// MaxEgress is the number of bytes users without their own limit can
+	// download each month; zero is unlimited.
+	MaxEgress int64
+
+	// DeletionGrace is the time between a user confirming the erasure of
+	// their account and the server erasing it.
+	DeletionGrace time.Duration
+
+	// Transfers limits the chunk transfers in flight for the server and each user.
+	Transfers *transferLimiter
+
+	// ShareFailures limits the wrong passwords each client can send for
+	// protected shares.
+	ShareFailures *failureLimiter
+
+	// ReplicationSecret signs the requests to the /replication routes and
+	// ReplicateFrom is the URL of the primary this server replicates, if any.
+	ReplicationSecret []byte
+	ReplicateFrom     string
+
+	// ReadOnly refuses the requests that would change the data.
+	ReadOnly bool
+
+	// AdminToken is required by the /admin routes and SnapshotDir is where
+	// snapshots are written.
+	AdminToken  string
+	SnapshotDir string
+
+	// writeLock is held for reading while data is changed and for writing
+	// while a snapshot is made.
+	writeLock sync.RWMutex
+
+	replicationClient *http.Client
+	replicationLock   sync.Mutex
+
+	// QuotaWarnings warns users close to their quota; nil when disabled.
+	QuotaWarnings *quotaWarner
+
+	// Faults injects faults into chunk requests; nil when disabled.
+	Faults *faultInjector
+
+	// usage keeps the counts of what each user has stored.
+	usage *usageCounter
+
+	// Reservations holds the quota of the uploads in progress.
+	Reservations *quotaReserver
+
+	// idempotency keeps the responses to requests with idempotency keys.
+	idempotency *idempotencyCache
+
+	// SlowRequest is the time after which requests are logged as slow;
+	// zero disables it.
+	SlowRequest time.Duration
+
+	// tracer starts the spans of requests; nil when tracing is disabled.
+	// stopTracing flushes the spans that haven't been exported yet.
+	tracer      trace.Tracer
+	stopTracing func()
+
+	logf func(format string, v ...interface{})
+	quit chan struct{}
+}
+
+// New opens the storage database, creating the tables if needed, and sets up
+// the routes for a new Server. Close should be called once it's no longer served.
+func New(config Config) (*Server, error) {
+	s := new(serverState)
+	s.DatabasePath = config.DatabasePath
+	s.logf = config.Logf
+	s.quit = make(chan struct{})
+
+	switch config.Chunking {
+	case "":
+		config.Chunking = filefreezer.ChunkingFixed
+	case filefreezer.ChunkingFixed, filefreezer.ChunkingFastCDC:
+	default:
+		return nil, fmt.Errorf("unknown chunking method: %s", config.Chunking)
+	}
+
+	// attempt to open the storage database
+	s.printf("Opening database: %s\n", s.DatabasePath)
+	store, err := filefreezer.OpenBackend(config.Backend, s.DatabasePath, config.ChunkSize)
+	if err != nil {
+		return nil, fmt.Errorf("Failed to open the database using the path specified (%s): %v", s.DatabasePath, err)
+	}
+	s.Storage = store
+
+	if len(config.ChunkStores) > 0 {
+		sqlStore, ok := store.(*filefreezer.Storage)
+		if !ok {
+			store.Close()
+			return nil, fmt.Errorf("the %s backend keeps its own chunks and can't use a chunk store", config.Backend)
+		}
+		sqlStore.Blobs, err = s.openChunkStores(config)
+		if err != nil {
+			store.Close()
+			return nil, err
+		}
+	}
+
+	if config.SlowQuery > 0 {
+		sqlStore, ok := store.(*filefreezer.Storage)
+		if !ok {
+			store.Close()
+			return nil, fmt.Errorf("the %s backend doesn't support logging slow queries", config.Backend)
+		}
+		sqlStore.LogSlowQueries(config.SlowQuery, s.printf)
+	}
+
+	// generate a random passphrase for signing JWT if something wasn't specified
+	// in the configuration; this will make the tokens only valid between the
+	// same running instance of the server
+	s.JWTSecretBytes = config.JWTSecret
+	if len(s.JWTSecretBytes) < 1 {
+		var randoms [32]byte
+		_, err = rand.Read(randoms[:])
+		if err != nil {
+			store.Close()
+			return nil, fmt.Errorf("A JWT secret was not supplied and random generation failed: %v", err)
+		}
+		s.JWTSecretBytes = randoms[:]
+		s.printf("JWT random passphrase generated.\n")
+	}
+
+	s.Activity = newActivityMonitor(s, config.FreezeCount, config.FreezeWindow)
+	s.PublicShares = config.PublicShares
+	s.Chunking = config.Chunking
+	s.NoPlainLogin = config.NoPlainLogin
+	s.MinClientVersion = config.MinClientVersion
+	s.LatestClientVersion = config.LatestClientVersion
+	s.MaxVersions = config.MaxVersions
+	s.MaxEgress = config.MaxEgress
+	s.ReadOnly = config.ReadOnly
+	s.AdminToken = config.AdminToken
+	s.SnapshotDir = config.SnapshotDir
+	s.SlowRequest = config.SlowRequest
+	s.DeletionGrace = config.DeletionGrace
+	if s.DeletionGrace <= 0 {
+		s.DeletionGrace = defaultDeletionGrace
+	}
+	if config.LowMemory {
+		err = s.useLowMemory(&config)
+		if err != nil {
+			store.Close()
+			return nil, err
+		}
+	}
+	s.Transfers = newTransferLimiter(config.MaxTransfers, config.MaxUserTransfers)
+	s.ShareFailures = newFailureLimiter(sharePasswordFailures, sharePasswordWindow)
+	s.Faults = newFaultInjector(config.Faults)
+	if s.Faults != nil {
+		s.printf("WARNING: injecting faults into %.0f%% of chunk requests.\n", config.Faults.Rate*100)
+	}
+	s.QuotaWarnings = newQuotaWarner(s, config.QuotaWarnings, config.QuotaWebhook)
+	s.usage = newUsageCounter(s)
+	s.Reservations = newQuotaReserver(s)
+	s.idempotency = newIdempotencyCache()
+	s.tracer, s.stopTracing, err = newTracer(config.Tracing)
+	if err != nil {
+		store.Close()
+		return nil, err
+	}
+	if s.tracer != nil && config.Tracing.Endpoint != "" {
+		s.printf("Exporting traces to %s.\n", config.Tracing.Endpoint)
+	}
+
+	// pull the accounts from the primary if this server is a secondary
+	err = s.setupReplication(config)
+	if err != nil {
+		s.stopTracing()
+		store.Close()
+		return nil, err
+	}
+
+	// keep the users' usage counts up to date in the background
+	usageInterval := config.UsageInterval
+	if usageInterval <= 0 {
+		usageInterval = time.Minute
+	}
+	s.usage.start(usageInterval)
+
+	// erase the accounts whose deletion grace period has ended; a read-only
+	// replica leaves that to its primary
+	if s.ReadOnly {
+		s.printf("Serving in read-only mode.\n")
+	} else {
+		deletionInterval := config.DeletionCheckInterval
+		if deletionInterval <= 0 {
+			deletionInterval = time.Minute
+		}
+		s.startAccountDeletions(deletionInterval)
+		if config.RechunkInterval > 0 {
+			s.startRechunking(config.RechunkInterval)
+		}
+	}
+
+	// start emailing usage reports if any admin addresses were supplied
+	if config.AdminEmail != nil && len(config.AdminEmail.To) > 0 {
+		s.AdminEmail = config.AdminEmail
+		s.startUsageReports(*s.AdminEmail)
+	}
+
+	e := echo.New()
+	initRoutes(s, e)
+
+	s.printf("Database opened: %s\n", s.DatabasePath)
+	return &Server{
+		Storage: store,
+		state:   s,
+		handler: e,
+	}, nil
+}
+
+// setupReplication checks the replication configuration and, for a secondary,
+// starts pulling the accounts from the primary.
+func (state *serverState) setupReplication(config Config) error {
+	if len(config.ReplicationSecret) == 0 && config.ReplicateFrom == "" {
+		return nil
+	}
+	if _, ok := state.Storage.(*filefreezer.Storage); !ok {
+		return fmt.Errorf("the %s backend doesn't support replication", config.Backend)
+	}
+	state.ReplicationSecret = config.ReplicationSecret
+	if config.ReplicateFrom == "" {
+		return nil
+	}
+	if len(config.ReplicationSecret) == 0 {
+		return fmt.Errorf("a replication secret is needed to replicate from %s", config.ReplicateFrom)
+	}
+
+	state.ReplicateFrom = strings.TrimRight(config.ReplicateFrom, "/")
+	state.replicationClient = &http.Client{Timeout: replicationTimeout}
+	interval := config.ReplicationInterval
+	if interval <= 0 {
+		interval = time.Minute
+	}
+	state.startReplication(interval)
+	state.printf("Replicating from %s every %s.\n", state.ReplicateFrom, interval)
+	return nil
+}
+
+// useLowMemory applies the low memory profile to the storage and caps the
+// transfer limits of the configuration.
+func (state *serverState) useLowMemory(config *Config) error {
+	if sqlStore, ok := state.Storage.(*filefreezer.Storage); ok {
+		err := sqlStore.LimitMemory(lowMemoryCacheKiB)
+		if err != nil {
+			return fmt.Errorf("Failed to limit the memory used by the database: %v", err)
+		}
+	}
+	if config.MaxTransfers < 1 || config.MaxTransfers > lowMemoryTransfers {
+		config.MaxTransfers = lowMemoryTransfers
+	}
+	if config.MaxUserTransfers < 1 || config.MaxUserTransfers > lowMemoryUserTransfers {
+		config.MaxUserTransfers = lowMemoryUserTransfers
+	}
+	state.printf("Low memory mode: at most %d transfers (%d per user).\n", config.MaxTransfers, config.MaxUserTransfers)
+	return nil
+}
+
+// openChunkStores opens the chunk stores of the configuration. More than one
+// store is mirrored, with health checks running until the server is closed.
+func (state *serverState) openChunkStores(config Config) (filefreezer.BlobStore, error) {
+	store, err := OpenChunkStores(config)
+	if err != nil {
+		return nil, err
+	}
+	for _, storeURL := range config.ChunkStores {
+		state.printf("Storing chunks in: %s\n", storeURL)
+	}
+
+	if mirror, ok := store.(*filefreezer.MirroredBlobStore); ok {
+		mirror.CheckHealth()
+		interval := config.ChunkStoreCheckInterval
+		if interval <= 0 {
+			interval = time.Minute
+		}
+		mirror.StartHealthChecks(interval, state.quit)
+	}
+	return store, nil
+}
+
+// OpenChunkStores opens the chunk stores of the configuration, encrypted with
+// the keys from ChunkKeysPath if it's set, for tools that work on the storage
+// without serving it. More than one store is mirrored without health checks.
+func OpenChunkStores(config Config) (filefreezer.BlobStore, error) {
+	var keyring *filefreezer.ChunkKeyring
+	if config.ChunkKeysPath != "" {
+		var err error
+		keyring, err = filefreezer.LoadChunkKeyring(config.ChunkKeysPath)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	var stores []filefreezer.BlobStore
+	for _, storeURL := range config.ChunkStores {
+		store, err := openChunkStore(storeURL, keyring)
+		if err != nil {
+			return nil, fmt.Errorf("Failed to open the chunk store %s: %v", storeURL, err)
+		}
+		stores = append(stores, store)
+	}
+	if len(stores) == 1 {
+		return stores[0], nil
+	}
+
+	mirror := filefreezer.NewMirroredBlobStore(config.ChunkStores, stores)
+	mirror.Logf = config.Logf
+	return mirror, nil
+}
+
+// openChunkStore opens the chunk store at the URL, encrypting it with a key from
+// the keyring if there is one. The key parameter of the URL picks the key.
+func openChunkStore(storeURL string, keyring *filefreezer.ChunkKeyring) (filefreezer.BlobStore, error) {
+	u, err := url.Parse(storeURL)
+	if err != nil {
+		return nil, err
+	}
+	query := u.Query()
+	keyID := query.Get("key")
+	query.Del("key")
+	u.RawQuery = query.Encode()
+	if keyring == nil && keyID != "" {
+		return nil, fmt.Errorf("the key %s was given but no chunk keys were loaded", keyID)
+	}
+
+	store, err := filefreezer.OpenBlobStore(u.String())
+	if err != nil || keyring == nil {
+		return store, err
+	}
+	if keyID == "" {
+		keyID = keyring.Latest
+	}
+	return filefreezer.NewEncryptedBlobStore(store, keyring, keyID)
+}
+
+// Handler returns the http.Handler that serves the filefreezer API.
+func (srv *Server) Handler() http.Handler {
+	return srv.handler
+}
+
+// Replicate pulls the accounts that changed on the primary set by
+// Config.ReplicateFrom right away instead of waiting for the next interval.
+func (srv *Server) Replicate() error {
+	if srv.state.ReplicateFrom == "" {
+		return fmt.Errorf("the server isn't replicating from a primary")
+	}
+	return srv.state.replicate()
+}
+
+// Start listens on the TCP address, such as ":8080" or "127.0.0.1:0", and
+// serves the API over HTTP in the background until Stop is called. Errors
+// listening on the address are returned; use Addr to get the address that
+// was picked for a zero port.
+func (srv *Server) Start(addr string) error {
+	return srv.start(addr, "", "")
+}
+
+// StartTLS is like Start but serves HTTPS using the certificate and private
+// key files.
+func (srv *Server) StartTLS(addr string, certFile string, keyFile string) error {
+	return srv.start(addr, certFile, keyFile)
+}
+
+// start listens on the address and serves the API in a new goroutine, using
+// TLS if the certificate and key files are set.
+func (srv *Server) start(addr string, certFile string, keyFile string) error {
+	srv.lock.Lock()
+	defer srv.lock.Unlock()
+	if srv.httpServer != nil {
+		return fmt.Errorf("the server has already been started on %s", srv.listener.Addr())
+	}
+
+	listener, err := net.Listen("tcp", addr)
+	if err != nil {
+		return fmt.Errorf("Failed to listen on %s: %v", addr, err)
+	}
+	httpServer := &http.Server{Handler: srv.handler}
+	if certFile != "" || keyFile != "" {
+		cert, err := tls.LoadX509KeyPair(certFile, keyFile)
+		if err != nil {
+			listener.Close()
+			return fmt.Errorf("Failed to load the TLS certificate and key: %v", err)
+		}
+		httpServer.TLSConfig = &tls.Config{Certificates: []tls.Certificate{cert}}
+		listener = tls.NewListener(listener, httpServer.TLSConfig)
+	}
+
+	srv.httpServer = httpServer
+	srv.listener = listener
+	go func() {
+		err := httpServer.Serve(listener)
+		if err != nil && err != http.ErrServerClosed {
+			srv.state.printf("Stopped serving on %s: %v\n", listener.Addr(), err)
+		}
+	}()
+	return nil
+}
+
+// Addr returns the address the server is listening on, or nil if it hasn't
+// been started.
+func (srv *Server) Addr() net.Addr {
+	srv.lock.Lock()
+	defer srv.lock.Unlock()
+	if srv.listener == nil {
+		return nil
+	}
+	return srv.listener.Addr()
+}
+
+// Stop gracefully shuts down a server started with Start, waiting for the
+// requests being handled to finish until the context is done, and then
+// closes it like Close.
+func (srv *Server) Stop(ctx context.Context) error {
+	srv.lock.Lock()
+	httpServer := srv.httpServer
+	srv.lock.Unlock()
+
+	var err error
+	if httpServer != nil {
+		err = httpServer.Shutdown(ctx)
+	}
+	srv.Close()
+	return err
+}
+
+// Close stops the background tasks of the server and closes the storage. It
+// can be called more than once but the server can't be used afterwards.
+func (srv *Server) Close() {
+	srv.closeOnce.Do(func() {
+		close(srv.state.quit)
+		srv.state.stopTracing()
+		srv.Storage.Close()
+	})
+}
+
+// printf logs the message with the configured Logf function, if any.
+func (state *serverState) printf(format string, v ...interface{}) {
+	if state.logf != nil {
+		state.logf(format, v...)
+	}
+}
@@ -0,0 +1,54 @@
+// Copyright 2017, Timothy Bogdala <tdb@animal-machine.com>
+// See the LICENSE file for more details.
+
+package server
+
+import (
+	"context"
+	"net/http"
+	"testing"
+	"time"
+)
+
+func TestStartStop(t *testing.T) {
+	srv, err := New(Config{
+		DatabasePath: "file:startstop?mode=memory&cache=shared",
+		ChunkSize:    1024,
+	})
+	if err != nil {
+		t.Fatalf("Failed to create the server: %v", err)
+	}
+	defer srv.Close()
+
+	if srv.Addr() != nil {
+		t.Fatal("Expected a server that wasn't started to have no address.")
+	}
+	err = srv.Start("127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Failed to start the server: %v", err)
+	}
+	if srv.Start("127.0.0.1:0") == nil {
+		t.Fatal("Expected starting the server twice to fail.")
+	}
+
+	timeURL := "http://" + srv.Addr().String() + "/api/time"
+	resp, err := http.Get(timeURL)
+	if err != nil {
+		t.Fatalf("Failed to reach the started server: %v", err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("Expected the started server to serve the API but got status %d.", resp.StatusCode)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	err = srv.Stop(ctx)
+	if err != nil {
+		t.Fatalf("Failed to stop the server: %v", err)
+	}
+	_, err = http.Get(timeURL)
+	if err == nil {
+		t.Fatal("Expected the stopped server to stop listening.")
+	}
+}
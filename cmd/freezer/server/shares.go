@@ -0,0 +1,450 @@
+// Copyright 2017, Timothy Bogdala <tdb@animal-machine.com>
+// See the LICENSE file for more details.
+
+package server
+
+import (
+	"bytes"
+	"fmt"
+	"html/template"
+	"io"
+	"mime"
+	"net"
+	"net/http"
+	"net/url"
+	"path"
+	"strconv"
+	"strings"
+	"time"
+
+	jwt "github.com/dgrijalva/jwt-go"
+	"github.com/labstack/echo"
+
+	"github.com/marcoziti/gringotts"
+	"github.com/marcoziti/gringotts/cmd/freezer/models"
+)
+
+// handleAddShare registers a new public share for the authenticated user, replacing
+// any existing share with the same name. Shares are stored unencrypted since they
+// are meant to be downloaded by anyone, so the client decrypts the file and uploads
+// the plaintext chunks afterwards.
+func handleAddShare(state *serverState) echo.HandlerFunc {
+	return func(c echo.Context) error {
+		jwtToken := c.Get(jwtContextName).(*jwt.Token)
+		claims := jwtToken.Claims.(*jwtCustomClaims)
+
+		var putReq models.ShareAddRequest
+		err := bindRequest(c, &putReq)
+		if err != nil {
+			return sendRequestError(c, err)
+		}
+
+		// the name, chunk count and download limit were checked by bindRequest
+		name := strings.Trim(putReq.Name, "/")
+
+		// use the type declared by the client, falling back to the file extension;
+		// otherwise it gets detected from the data when the first chunk is uploaded
+		contentType := putReq.ContentType
+		if contentType == "" {
+			contentType = mime.TypeByExtension(path.Ext(name))
+		}
+
+		var passwordHash []byte
+		if putReq.Password != "" {
+			passwordHash, err = filefreezer.GenSharePasswordHash(putReq.Password)
+			if err != nil {
+				return c.String(http.StatusInternalServerError, "Failed to hash the share password.")
+			}
+		}
+
+		share, err := state.Storage.AddShare(claims.UserID, name, putReq.LastMod, putReq.ChunkCount, putReq.FileHash, contentType,
+			passwordHash, putReq.MaxDownloads)
+		if err != nil {
+			return c.String(http.StatusConflict, "Failed to add the share: "+err.Error())
+		}
+
+		return c.JSON(http.StatusOK, &models.ShareAddResponse{
+			Share: *share,
+		})
+	}
+}
+
+// handleGetShares returns all of the public shares for the authenticated user.
+func handleGetShares(state *serverState) echo.HandlerFunc {
+	return func(c echo.Context) error {
+		jwtToken := c.Get(jwtContextName).(*jwt.Token)
+		claims := jwtToken.Claims.(*jwtCustomClaims)
+
+		shares, err := state.Storage.GetShares(claims.UserID)
+		if err != nil {
+			return c.String(http.StatusNotFound, "Failed to get the shares for the user.")
+		}
+
+		return c.JSON(http.StatusOK, &models.SharesGetResponse{
+			Shares: shares,
+		})
+	}
+}
+
+// handlePutShareChunk reads an unencrypted chunk from the request body and stores it
+// for the share id and chunk number supplied in parameters.
+func handlePutShareChunk(state *serverState) echo.HandlerFunc {
+	return func(c echo.Context) error {
+		jwtToken := c.Get(jwtContextName).(*jwt.Token)
+		claims := jwtToken.Claims.(*jwtCustomClaims)
+
+		shareID, err := models.ParseID(c.Param("shareid"))
+		if err != nil {
+			return c.String(http.StatusBadRequest, "A valid integer was not used for the share id in the URI.")
+		}
+		chunkNumber, err := models.ParseChunkNumber(c.Param("chunknumber"))
+		if err != nil {
+			return c.String(http.StatusBadRequest, "A valid integer was not used for the chunk number in the URI.")
+		}
+
+		// shared chunks are plaintext so the route limits them to the chunk size exactly
+		chunk, err := readBody(c)
+		if err != nil {
+			return sendRequestError(c, err)
+		}
+
+		// AddShareChunk verifies that the user owns the share
+		err = state.Storage.AddShareChunk(claims.UserID, shareID, chunkNumber, chunk)
+		if err != nil {
+			return c.String(http.StatusInternalServerError, "Failed to add the share chunk to storage: "+err.Error())
+		}
+
+		// shares are unencrypted so the type can be sniffed from the start of the file
+		if chunkNumber == 0 {
+			err = state.Storage.SetShareContentType(claims.UserID, shareID, http.DetectContentType(chunk))
+			if err != nil {
+				return c.String(http.StatusInternalServerError, "Failed to set the share content type: "+err.Error())
+			}
+		}
+
+		return c.JSON(http.StatusOK, &models.ShareChunkPutResponse{
+			Status: true,
+		})
+	}
+}
+
+// handleDeleteShare removes a public share and its chunks for the authenticated user.
+func handleDeleteShare(state *serverState) echo.HandlerFunc {
+	return func(c echo.Context) error {
+		jwtToken := c.Get(jwtContextName).(*jwt.Token)
+		claims := jwtToken.Claims.(*jwtCustomClaims)
+
+		shareID, err := models.ParseID(c.Param("shareid"))
+		if err != nil {
+			return c.String(http.StatusBadRequest, "A valid integer was not used for the share id in the URI.")
+		}
+
+		err = state.Storage.RemoveShare(claims.UserID, shareID)
+		if err != nil {
+			return c.String(http.StatusNotFound, "Failed to remove the share: "+err.Error())
+		}
+
+		return c.JSON(http.StatusOK, &models.ShareDeleteResponse{
+			Success: true,
+		})
+	}
+}
+
+// handleGetPublicShare serves a user's shared files without authentication. A path
+// that is empty or ends with a slash returns a JSON listing of the shared files
+// under that prefix; otherwise the contents of the shared file are returned.
+// This route is only registered when the server was started with public access enabled.
+func handleGetPublicShare(state *serverState) echo.HandlerFunc {
+	return func(c echo.Context) error {
+		user, err := state.Storage.GetUser(c.Param("username"))
+		if err != nil {
+			return c.String(http.StatusNotFound, "Not found.")
+		}
+
+		sharePath := strings.TrimPrefix(c.Param("*"), "/")
+		if sharePath == "" || strings.HasSuffix(sharePath, "/") {
+			return servePublicListing(c, state, user.ID, user.Name, sharePath)
+		}
+
+		share, err := state.Storage.GetShareByName(user.ID, sharePath)
+		if err != nil {
+			return c.String(http.StatusNotFound, "Not found.")
+		}
+
+		// make sure all of the chunks were uploaded before serving anything
+		// so that a partial file isn't sent with a success status
+		sizes, err := state.Storage.GetShareChunkSizes(share.ShareID)
+		if err != nil || len(sizes) < share.ChunkCount {
+			return c.String(http.StatusServiceUnavailable, "The shared file has not finished uploading.")
+		}
+
+		// clients that keep sending wrong passwords are turned away before the
+		// password gets hashed so that guessing can't tie up the server
+		if share.Protected {
+			client := remoteHost(c.Request())
+			if state.ShareFailures.blocked(client) {
+				c.Response().Header().Set("Retry-After", strconv.Itoa(int(sharePasswordWindow/time.Second)))
+				return c.String(http.StatusTooManyRequests, "Too many wrong passwords; try again later.")
+			}
+
+			_, password, ok := c.Request().BasicAuth()
+			passwordHash, err := state.Storage.GetSharePassword(share.ShareID)
+			if !ok || err != nil || !filefreezer.VerifySharePassword(password, passwordHash) {
+				if ok {
+					state.ShareFailures.fail(client)
+				}
+				c.Response().Header().Set(echo.HeaderWWWAuthenticate, "Basic realm=\"freezer share\"")
+				return c.String(http.StatusUnauthorized, "A password is required to download this file.")
+			}
+		}
+
+		// every GET counts as a download, including ranged resumes, so that ranges
+		// can't be used to keep reading the file once its limit has been reached
+		if share.MaxDownloads > 0 && c.Request().Method == "GET" {
+			counted, err := state.Storage.CountShareDownload(share.ShareID)
+			if err != nil {
+				return c.String(http.StatusInternalServerError, "Failed to count the download.")
+			}
+			if !counted {
+				return c.String(http.StatusGone, "This file has reached its download limit.")
+			}
+		}
+
+		contentType := share.ContentType
+		if contentType == "" {
+			contentType = "application/octet-stream"
+		}
+
+		// browsers render the file with its real type, but sandboxed and without
+		// sniffing so that a shared page can't act on behalf of the server's origin
+		res := c.Response()
+		res.Header().Set(echo.HeaderContentType, contentType)
+		res.Header().Set("X-Content-Type-Options", "nosniff")
+		res.Header().Set("Content-Security-Policy", "sandbox")
+
+		// the file hash changes whenever the share is replaced, so it makes a strong
+		// ETag that lets download managers safely resume with If-Range
+		if share.FileHash != "" {
+			res.Header().Set("ETag", "\""+share.FileHash+"\"")
+		}
+
+		// ServeContent handles the Range, If-Range and conditional requests
+		reader := &shareReader{storage: state.Storage, shareID: share.ShareID, sizes: sizes[:share.ChunkCount]}
+		http.ServeContent(res, c.Request(), path.Base(share.Name), time.Unix(share.LastMod, 0), reader)
+		return nil
+	}
+}
+
+// servePublicListing responds with the shared files under the prefix. Browsers
+// asking for HTML, or requests with format=html, get a page listing the immediate
+// folders and files that works on small screens; otherwise all of the files
+// under the prefix are returned as JSON.
+func servePublicListing(c echo.Context, state *serverState, userID int, username string, prefix string) error {
+	shares, err := state.Storage.GetShares(userID)
+	if err != nil {
+		return c.String(http.StatusInternalServerError, "Failed to get the shared files.")
+	}
+
+	var listing models.PublicShareListResponse
+	listing.Files = []models.PublicShareEntry{}
+	for _, share := range shares {
+		if strings.HasPrefix(share.Name, prefix) {
+			listing.Files = append(listing.Files, models.PublicShareEntry{
+				Name:        share.Name,
+				LastMod:     share.LastMod,
+				ChunkCount:  share.ChunkCount,
+				ContentType: share.ContentType,
+				Protected:   share.Protected,
+				Size:        share.Size,
+			})
+		}
+	}
+
+	format := c.QueryParam("format")
+	if format == "json" || (format != "html" && !strings.Contains(c.Request().Header.Get("Accept"), "text/html")) {
+		return c.JSON(http.StatusOK, &listing)
+	}
+
+	// group the files into the immediate folders and files under the prefix
+	page := publicListingPage{Title: username + "/" + prefix}
+	if prefix != "" {
+		parent := path.Dir(strings.TrimSuffix(prefix, "/"))
+		if parent == "." {
+			parent = ""
+		} else {
+			parent += "/"
+		}
+		page.Parent = publicShareURL(username, parent)
+	}
+	seenFolders := make(map[string]bool)
+	for _, f := range listing.Files {
+		rest := strings.TrimPrefix(f.Name, prefix)
+		slash := strings.Index(rest, "/")
+		if slash >= 0 {
+			folder := rest[:slash]
+			if !seenFolders[folder] {
+				seenFolders[folder] = true
+				page.Folders = append(page.Folders, publicListingItem{
+					Name: folder,
+					URL:  publicShareURL(username, prefix+folder+"/"),
+				})
+			}
+			continue
+		}
+
+		page.Files = append(page.Files, publicListingItem{
+			Name:      rest,
+			URL:       publicShareURL(username, f.Name),
+			Size:      formatShareSize(f.Size),
+			LastMod:   time.Unix(f.LastMod, 0).UTC().Format("2006-01-02 15:04"),
+			Protected: f.Protected,
+		})
+	}
+
+	var buf bytes.Buffer
+	err = publicListingTemplate.Execute(&buf, &page)
+	if err != nil {
+		return c.String(http.StatusInternalServerError, "Failed to render the listing.")
+	}
+	return c.HTML(http.StatusOK, buf.String())
+}
+
+// publicShareURL returns the escaped URL path for a shared name.
+func publicShareURL(username string, name string) string {
+	return (&url.URL{Path: "/public/" + username + "/" + name}).EscapedPath()
+}
+
+// formatShareSize returns the size in bytes in a short human readable form.
+func formatShareSize(size int64) string {
+	const unit = 1024
+	if size < unit {
+		return fmt.Sprintf("%d B", size)
+	}
+	div, exp := int64(unit), 0
+	for n := size / unit; n >= unit; n /= unit {
+		div *= unit
+		exp++
+	}
+	return fmt.Sprintf("%.1f %cB", float64(size)/float64(div), "KMGTPE"[exp])
+}
+
+// publicListingItem is a folder or file shown on the HTML listing page.
+type publicListingItem struct {
+	Name      string
+	URL       string
+	Size      string
+	LastMod   string
+	Protected bool
+}
+
+// publicListingPage is the data for the HTML listing page template.
+type publicListingPage struct {
+	Title   string
+	Parent  string
+	Folders []publicListingItem
+	Files   []publicListingItem
+}
+
+// publicListingTemplate is a small page with no external resources that is
+// readable on a phone.
+var publicListingTemplate = template.Must(template.New("listing").Parse(`<!DOCTYPE html>
+<html><head>
+<meta charset="utf-8">
+<meta name="viewport" content="width=device-width, initial-scale=1">
+<title>{{.Title}}</title>
+<style>
+body { font-family: sans-serif; margin: 0 auto; max-width: 48em; padding: 0.5em; }
+h1 { font-size: 1.2em; word-break: break-all; }
+ul { list-style: none; padding: 0; }
+li a { display: block; padding: 0.8em 0.5em; border-bottom: 1px solid #ddd; text-decoration: none; word-break: break-all; }
+li small { display: block; color: #777; }
+</style>
+</head><body>
+<h1>{{.Title}}</h1>
+<ul>
+{{if .Parent}}<li><a href="{{.Parent}}">..</a></li>{{end}}
+{{range .Folders}}<li><a href="{{.URL}}">{{.Name}}/</a></li>
+{{end}}{{range .Files}}<li><a href="{{.URL}}">{{.Name}}{{if .Protected}} &#128274;{{end}}<small>{{.Size}} &middot; {{.LastMod}} UTC</small></a></li>
+{{end}}</ul>
+</body></html>
+`))
+
+// remoteHost returns the address of the client that sent the request without
+// its port. Forwarding headers are ignored since clients can set them freely.
+func remoteHost(r *http.Request) string {
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		return r.RemoteAddr
+	}
+	return host
+}
+
+// shareReader is an io.ReadSeeker over the chunks of a share that only loads
+// the chunk containing the current offset, so that ranges of large files can
+// be served without reading the whole file.
+type shareReader struct {
+	storage filefreezer.ShareStore
+	shareID int
+	sizes   []int64
+	offset  int64
+
+	chunkStart int64
+	chunk      []byte
+}
+
+// size returns the total size of the shared file.
+func (r *shareReader) size() int64 {
+	var total int64
+	for _, size := range r.sizes {
+		total += size
+	}
+	return total
+}
+
+// Read implements io.Reader.
+func (r *shareReader) Read(p []byte) (int, error) {
+	if r.offset >= r.size() {
+		return 0, io.EOF
+	}
+
+	// load the chunk containing the offset if it isn't already
+	if r.chunk == nil || r.offset < r.chunkStart || r.offset >= r.chunkStart+int64(len(r.chunk)) {
+		var start int64
+		chunkNumber := 0
+		for ; chunkNumber < len(r.sizes); chunkNumber++ {
+			if r.offset < start+r.sizes[chunkNumber] {
+				break
+			}
+			start += r.sizes[chunkNumber]
+		}
+
+		chunk, err := r.storage.GetShareChunk(r.shareID, chunkNumber)
+		if err != nil {
+			return 0, err
+		}
+		r.chunkStart = start
+		r.chunk = chunk
+	}
+
+	n := copy(p, r.chunk[r.offset-r.chunkStart:])
+	r.offset += int64(n)
+	return n, nil
+}
+
+// Seek implements io.Seeker.
+func (r *shareReader) Seek(offset int64, whence int) (int64, error) {
+	switch whence {
+	case io.SeekStart:
+	case io.SeekCurrent:
+		offset += r.offset
+	case io.SeekEnd:
+		offset += r.size()
+	default:
+		return 0, fmt.Errorf("invalid whence")
+	}
+	if offset < 0 {
+		return 0, fmt.Errorf("negative position")
+	}
+	r.offset = offset
+	return offset, nil
+}
@@ -0,0 +1,40 @@
+// Copyright 2017, Timothy Bogdala <tdb@animal-machine.com>
+// See the LICENSE file for more details.
+
+package server
+
+import (
+	"time"
+
+	"github.com/labstack/echo"
+)
+
+// logSlowRequests is middleware that logs the requests taking longer than
+// the threshold along with who made them and how big they were, so that
+// patterns like large accounts listing all of their files stand out.
+func logSlowRequests(state *serverState, threshold time.Duration) echo.MiddlewareFunc {
+	return func(next echo.HandlerFunc) echo.HandlerFunc {
+		return func(c echo.Context) error {
+			start := time.Now()
+			err := next(c)
+			elapsed := time.Since(start)
+			if elapsed < threshold {
+				return err
+			}
+
+			status := c.Response().Status
+			if he, ok := err.(*echo.HTTPError); ok {
+				status = he.Code
+			}
+			user := "anonymous"
+			if claims, ok := requestClaims(c); ok {
+				user = claims.Username
+			}
+			r := c.Request()
+			state.printf("Slow request (%s): %s %s (route %s) by %s from %s; status %d, %d bytes in, %d bytes out\n",
+				elapsed.Round(time.Millisecond), r.Method, r.URL.Path, c.Path(), user, c.RealIP(),
+				status, r.ContentLength, c.Response().Size)
+			return err
+		}
+	}
+}
@@ -0,0 +1,54 @@
+// Copyright 2017, Timothy Bogdala <tdb@animal-machine.com>
+// See the LICENSE file for more details.
+
+package server
+
+import (
+	"fmt"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestSlowLogging(t *testing.T) {
+	var lock sync.Mutex
+	var logged []string
+	srv, err := New(Config{
+		DatabasePath: "file:slowlog?mode=memory&cache=shared",
+		ChunkSize:    1024,
+		SlowRequest:  time.Nanosecond,
+		SlowQuery:    time.Nanosecond,
+		Logf: func(format string, v ...interface{}) {
+			lock.Lock()
+			logged = append(logged, fmt.Sprintf(format, v...))
+			lock.Unlock()
+		},
+	})
+	if err != nil {
+		t.Fatalf("Failed to create a server with slow logging: %v", err)
+	}
+	defer srv.Close()
+
+	srv.Handler().ServeHTTP(httptest.NewRecorder(), httptest.NewRequest("GET", "/api/time", nil))
+	srv.state.Storage.GetFileInfo(1, 1)
+
+	lock.Lock()
+	defer lock.Unlock()
+	var sawRequest, sawQuery bool
+	for _, line := range logged {
+		if strings.HasPrefix(line, "Slow request") && strings.Contains(line, "GET /api/time") {
+			sawRequest = true
+		}
+		if strings.HasPrefix(line, "Slow query") && strings.Contains(line, "[1]") {
+			sawQuery = true
+		}
+	}
+	if !sawRequest {
+		t.Fatalf("Expected the request to be logged as slow but got %v.", logged)
+	}
+	if !sawQuery {
+		t.Fatalf("Expected the query to be logged as slow but got %v.", logged)
+	}
+}
@@ -0,0 +1,111 @@
+// Copyright 2017, Timothy Bogdala <tdb@animal-machine.com>
+// See the LICENSE file for more details.
+
+package server
+
+import (
+	"crypto/subtle"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/labstack/echo"
+	"github.com/marcoziti/gringotts"
+
+	"github.com/marcoziti/gringotts/cmd/freezer/models"
+)
+
+// checkAdminToken is middleware for the /admin routes that only lets through
+// requests with the server's admin token as a bearer token.
+func checkAdminToken(state *serverState) echo.MiddlewareFunc {
+	return func(next echo.HandlerFunc) echo.HandlerFunc {
+		return func(c echo.Context) error {
+			auth := c.Request().Header.Get("Authorization")
+			token := strings.TrimPrefix(auth, "Bearer ")
+			if token == auth || subtle.ConstantTimeCompare([]byte(token), []byte(state.AdminToken)) != 1 {
+				return c.String(http.StatusUnauthorized, "A valid admin token is required.")
+			}
+			return next(c)
+		}
+	}
+}
+
+// holdWrites is middleware that lets snapshots quiesce the server: requests
+// that could change the data hold the write lock for reading while they run,
+// so a snapshot taking it for writing waits for them to finish and keeps new
+// ones waiting until it's done. The /admin routes are left out so that a
+// snapshot doesn't wait on itself.
+func holdWrites(state *serverState) echo.MiddlewareFunc {
+	return func(next echo.HandlerFunc) echo.HandlerFunc {
+		return func(c echo.Context) error {
+			req := c.Request()
+			if req.Method == http.MethodGet || req.Method == http.MethodHead || strings.HasPrefix(req.URL.Path, "/admin/") {
+				return next(c)
+			}
+
+			state.writeLock.RLock()
+			defer state.writeLock.RUnlock()
+			return next(c)
+		}
+	}
+}
+
+// handlePostSnapshot quiesces writes, writes a consistent copy of the database
+// to the snapshot directory along with a manifest of the chunks it references,
+// and returns where they were written. Backup tools can then copy the snapshot
+// and the chunk data it lists at their own pace while the server carries on.
+func handlePostSnapshot(state *serverState) echo.HandlerFunc {
+	return func(c echo.Context) error {
+		if state.SnapshotDir == "" {
+			return c.String(http.StatusNotImplemented, "No snapshot directory is configured on the server.")
+		}
+		sqlStore, ok := state.Storage.(*filefreezer.Storage)
+		if !ok {
+			return c.String(http.StatusNotImplemented, "The storage backend doesn't support snapshots.")
+		}
+
+		now := time.Now().UTC()
+		name := fmt.Sprintf("snapshot-%s", now.Format("20060102T150405Z"))
+		manifest := models.SnapshotManifest{
+			Created:  now.Unix(),
+			Database: name + ".db",
+		}
+		dbPath := filepath.Join(state.SnapshotDir, manifest.Database)
+
+		start := time.Now()
+		state.writeLock.Lock()
+		snap, err := sqlStore.Snapshot(dbPath)
+		state.writeLock.Unlock()
+		if err != nil {
+			return c.String(http.StatusInternalServerError, "Failed to make the snapshot: "+err.Error())
+		}
+		state.printf("Wrote the database snapshot %s with writes held for %s.\n", dbPath, time.Since(start))
+
+		manifest.DBVersion = snap.DBVersion
+		manifest.Chunks = snap.Chunks
+		resp := models.SnapshotResponse{
+			Created:    manifest.Created,
+			Database:   dbPath,
+			Manifest:   filepath.Join(state.SnapshotDir, name+".json"),
+			ChunkCount: len(snap.Chunks),
+		}
+		for _, chunk := range snap.Chunks {
+			resp.ChunkBytes += chunk.Length
+		}
+
+		data, err := json.MarshalIndent(&manifest, "", "  ")
+		if err != nil {
+			return c.String(http.StatusInternalServerError, "Failed to encode the snapshot manifest.")
+		}
+		err = ioutil.WriteFile(resp.Manifest, data, 0600)
+		if err != nil {
+			return c.String(http.StatusInternalServerError, "Failed to write the snapshot manifest: "+err.Error())
+		}
+
+		return c.JSON(http.StatusOK, &resp)
+	}
+}
@@ -0,0 +1,141 @@
+// Copyright 2017, Timothy Bogdala <tdb@animal-machine.com>
+// See the LICENSE file for more details.
+
+package server
+
+import (
+	"net/http"
+	"strings"
+	"time"
+
+	jwt "github.com/dgrijalva/jwt-go"
+	"github.com/labstack/echo"
+
+	"github.com/marcoziti/gringotts/cmd/freezer/models"
+)
+
+const (
+	// maxSupportConsent is the longest a user can consent to support access for
+	// at once.
+	maxSupportConsent = 30 * 24 * time.Hour
+)
+
+// checkSupportToken is middleware for the /support routes that lets an admin
+// holding a support token read a user's metadata. The token has to exist and
+// not be expired, and unless it was made with break-glass the user has to still
+// consent to support access. Each request is recorded in the user's support
+// audit before it's handled, and it's refused if it can't be recorded. The
+// handlers behind it see the token's user as the authenticated user.
+func checkSupportToken(state *serverState) echo.MiddlewareFunc {
+	return func(next echo.HandlerFunc) echo.HandlerFunc {
+		return func(c echo.Context) error {
+			token := c.Param("token")
+			st, err := state.Storage.GetSupportTokenByToken(token)
+			if err != nil {
+				return c.String(http.StatusNotFound, "The support token was not found.")
+			}
+
+			now := time.Now().UTC().Unix()
+			if now >= st.Expires {
+				return c.String(http.StatusUnauthorized, "The support token has expired.")
+			}
+			if !st.BreakGlass {
+				consent, err := state.Storage.GetSupportConsent(st.UserID)
+				if err != nil {
+					return c.String(http.StatusInternalServerError, "Failed to check the user's consent to support access.")
+				}
+				if now >= consent {
+					return c.String(http.StatusForbidden, "The user no longer consents to support access.")
+				}
+			}
+
+			// the token is left out of the audit so that users reading it can't reuse it
+			action := c.Request().Method + " " + strings.Replace(c.Request().URL.Path, "/support/"+token, "/support", 1)
+			err = state.Storage.AddSupportAudit(st.UserID, st.SupportID, action)
+			if err != nil {
+				return c.String(http.StatusInternalServerError, "Failed to record the support access.")
+			}
+			state.printf("Support access %d for user %d: %s\n", st.SupportID, st.UserID, action)
+
+			c.Set(jwtContextName, &jwt.Token{
+				Claims: &jwtCustomClaims{UserID: st.UserID},
+				Valid:  true,
+			})
+			return next(c)
+		}
+	}
+}
+
+// handleGetSupport returns the authenticated user's consent to support access
+// along with the audit of the support tokens made for the account.
+func handleGetSupport(state *serverState) echo.HandlerFunc {
+	return func(c echo.Context) error {
+		jwtToken := c.Get(jwtContextName).(*jwt.Token)
+		claims := jwtToken.Claims.(*jwtCustomClaims)
+
+		expires, err := state.Storage.GetSupportConsent(claims.UserID)
+		if err != nil {
+			return c.String(http.StatusInternalServerError, "Failed to get the support consent for the user.")
+		}
+		if expires <= time.Now().UTC().Unix() {
+			expires = 0
+		}
+
+		audit, err := state.Storage.GetSupportAudit(claims.UserID)
+		if err != nil {
+			return c.String(http.StatusInternalServerError, "Failed to get the support audit for the user.")
+		}
+
+		return c.JSON(http.StatusOK, &models.SupportGetResponse{
+			ConsentExpires: expires,
+			Audit:          audit,
+		})
+	}
+}
+
+// handlePutSupportConsent lets support tokens be made for the authenticated
+// user's account for the duration requested, replacing any earlier consent.
+func handlePutSupportConsent(state *serverState) echo.HandlerFunc {
+	return func(c echo.Context) error {
+		jwtToken := c.Get(jwtContextName).(*jwt.Token)
+		claims := jwtToken.Claims.(*jwtCustomClaims)
+
+		var putReq models.SupportConsentRequest
+		err := bindRequest(c, &putReq)
+		if err != nil {
+			return sendRequestError(c, err)
+		}
+		duration := time.Duration(putReq.Seconds) * time.Second
+		if duration <= 0 || duration > maxSupportConsent {
+			return c.String(http.StatusBadRequest, "The consent must last between a second and "+maxSupportConsent.String()+".")
+		}
+
+		expires := time.Now().UTC().Add(duration).Unix()
+		err = state.Storage.SetSupportConsent(claims.UserID, expires)
+		if err != nil {
+			return c.String(http.StatusInternalServerError, "Failed to set the support consent: "+err.Error())
+		}
+
+		return c.JSON(http.StatusOK, &models.SupportConsentResponse{
+			Expires: expires,
+		})
+	}
+}
+
+// handleDeleteSupportConsent withdraws the authenticated user's consent to
+// support access, which also stops the support tokens made with it from working.
+func handleDeleteSupportConsent(state *serverState) echo.HandlerFunc {
+	return func(c echo.Context) error {
+		jwtToken := c.Get(jwtContextName).(*jwt.Token)
+		claims := jwtToken.Claims.(*jwtCustomClaims)
+
+		err := state.Storage.RemoveSupportConsent(claims.UserID)
+		if err != nil {
+			return c.String(http.StatusInternalServerError, "Failed to remove the support consent: "+err.Error())
+		}
+
+		return c.JSON(http.StatusOK, &models.SupportDeleteResponse{
+			Success: true,
+		})
+	}
+}
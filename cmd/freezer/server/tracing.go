@@ -0,0 +1,274 @@
+// Copyright 2017, Timothy Bogdala <tdb@animal-machine.com>
+// See the LICENSE file for more details.
+
+package server
+
+import (
+	"context"
+	"fmt"
+	"strconv"
+
+	jwt "github.com/dgrijalva/jwt-go"
+	"github.com/labstack/echo"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/exporters/otlp/otlptrace/otlptracehttp"
+	"go.opentelemetry.io/otel/propagation"
+	"go.opentelemetry.io/otel/sdk/resource"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/trace"
+
+	"github.com/marcoziti/gringotts"
+)
+
+// defaultTraceServiceName is the service the spans are reported under.
+const defaultTraceServiceName = "filefreezer"
+
+// TracingConfig is the configuration for exporting OpenTelemetry spans of
+// the requests handled by the server and the storage calls made for them.
+type TracingConfig struct {
+	// Endpoint is the host and port of an OTLP/HTTP collector, such as
+	// localhost:4318; Jaeger accepts OTLP directly. Empty disables tracing.
+	Endpoint string
+
+	// Insecure sends the spans over plain HTTP instead of HTTPS.
+	Insecure bool
+
+	// SampleRate is the fraction of requests that are traced; zero traces
+	// all of them. Requests from a sampled parent span are always traced.
+	SampleRate float64
+
+	// ServiceName is the service the spans are reported under; it defaults
+	// to filefreezer.
+	ServiceName string
+
+	// exporter replaces the OTLP exporter, such as with one that keeps the
+	// spans in memory for tests, and is sent each span as soon as it ends
+	exporter sdktrace.SpanExporter
+}
+
+// newTracer creates the tracer for the configuration along with a function
+// that flushes the spans and stops it. The tracer is nil if tracing is
+// disabled.
+func newTracer(config TracingConfig) (trace.Tracer, func(), error) {
+	exporter := config.exporter
+	processor := sdktrace.WithSyncer(exporter)
+	if exporter == nil {
+		if config.Endpoint == "" {
+			return nil, func() {}, nil
+		}
+		options := []otlptracehttp.Option{otlptracehttp.WithEndpoint(config.Endpoint)}
+		if config.Insecure {
+			options = append(options, otlptracehttp.WithInsecure())
+		}
+		var err error
+		exporter, err = otlptracehttp.New(context.Background(), options...)
+		if err != nil {
+			return nil, nil, fmt.Errorf("Failed to create the trace exporter for %s: %v", config.Endpoint, err)
+		}
+		processor = sdktrace.WithBatcher(exporter)
+	}
+
+	serviceName := config.ServiceName
+	if serviceName == "" {
+		serviceName = defaultTraceServiceName
+	}
+	sampler := sdktrace.AlwaysSample()
+	if config.SampleRate > 0 && config.SampleRate < 1 {
+		sampler = sdktrace.ParentBased(sdktrace.TraceIDRatioBased(config.SampleRate))
+	}
+	provider := sdktrace.NewTracerProvider(
+		processor,
+		sdktrace.WithSampler(sampler),
+		sdktrace.WithResource(resource.NewSchemaless(attribute.String("service.name", serviceName))),
+	)
+	stop := func() {
+		provider.Shutdown(context.Background())
+	}
+	return provider.Tracer("github.com/marcoziti/gringotts/cmd/freezer/server"), stop, nil
+}
+
+// traceRequests is middleware that starts a span for each request, continuing
+// the trace of the caller if it sent a traceparent header, and puts it in the
+// request's context for the spans of the storage calls made by the handlers.
+func traceRequests(state *serverState) echo.MiddlewareFunc {
+	propagator := propagation.TraceContext{}
+	return func(next echo.HandlerFunc) echo.HandlerFunc {
+		return func(c echo.Context) error {
+			r := c.Request()
+			ctx := propagator.Extract(r.Context(), propagation.HeaderCarrier(r.Header))
+			ctx, span := state.tracer.Start(ctx, r.Method+" "+c.Path(), trace.WithSpanKind(trace.SpanKindServer),
+				trace.WithAttributes(
+					attribute.String("http.method", r.Method),
+					attribute.String("http.route", c.Path()),
+					attribute.Int64("http.request_content_length", r.ContentLength),
+				))
+			defer span.End()
+			c.SetRequest(r.WithContext(ctx))
+
+			err := next(c)
+			status := c.Response().Status
+			if he, ok := err.(*echo.HTTPError); ok {
+				status = he.Code
+			}
+			span.SetAttributes(attribute.Int("http.status_code", status))
+			if claims, ok := requestClaims(c); ok {
+				span.SetAttributes(attribute.Int("freezer.user_id", claims.UserID))
+			}
+			if status >= 500 || err != nil {
+				span.SetStatus(codes.Error, strconv.Itoa(status))
+			}
+			return err
+		}
+	}
+}
+
+// requestClaims returns the claims of the authenticated user making the
+// request, if there is one.
+func requestClaims(c echo.Context) (*jwtCustomClaims, bool) {
+	token, ok := c.Get(jwtContextName).(*jwt.Token)
+	if !ok {
+		return nil, false
+	}
+	claims, ok := token.Claims.(*jwtCustomClaims)
+	return claims, ok
+}
+
+// startSpan starts a child span of the request's span, which does nothing
+// when tracing is disabled.
+func (state *serverState) startSpan(c echo.Context, name string) trace.Span {
+	if state.tracer == nil {
+		return trace.SpanFromContext(context.Background())
+	}
+	_, span := state.tracer.Start(c.Request().Context(), name)
+	return span
+}
+
+// store returns the storage to use for the request: the server's Storage
+// with a span around the calls that logins, uploads, downloads and
+// replication spend their time in when tracing is enabled.
+func (state *serverState) store(c echo.Context) filefreezer.Backend {
+	if state.tracer == nil {
+		return state.Storage
+	}
+	return &tracedBackend{Backend: state.Storage, ctx: c.Request().Context(), tracer: state.tracer}
+}
+
+// tracedBackend wraps the storage calls made while handling logins, chunk and
+// file version requests and replication in child spans of the request's span
+// so that the time
+// spent in the database, and the chunk stores behind it, can be told apart
+// from the time spent reading the request. Other calls go straight to the
+// Backend.
+type tracedBackend struct {
+	filefreezer.Backend
+	ctx    context.Context
+	tracer trace.Tracer
+}
+
+// span starts the span of a storage call.
+func (b *tracedBackend) span(name string) trace.Span {
+	_, span := b.tracer.Start(b.ctx, "storage."+name, trace.WithSpanKind(trace.SpanKindClient))
+	return span
+}
+
+// end records the error of the storage call, if any, and ends its span.
+func end(span trace.Span, err error) {
+	if err != nil {
+		span.RecordError(err)
+		span.SetStatus(codes.Error, err.Error())
+	}
+	span.End()
+}
+
+func (b *tracedBackend) AddFileInfo(userID int, filename string, isDir bool, permissions uint32, lastMod int64, chunkCount int, fileHash string, device string) (*filefreezer.FileInfo, error) {
+	span := b.span("AddFileInfo")
+	fi, err := b.Backend.AddFileInfo(userID, filename, isDir, permissions, lastMod, chunkCount, fileHash, device)
+	end(span, err)
+	return fi, err
+}
+
+func (b *tracedBackend) GetFileInfo(userID int, fileID int) (*filefreezer.FileInfo, error) {
+	span := b.span("GetFileInfo")
+	fi, err := b.Backend.GetFileInfo(userID, fileID)
+	end(span, err)
+	return fi, err
+}
+
+func (b *tracedBackend) TagNewFileVersion(userID int, fileID int, permissions uint32, lastMod int64, chunkCount int, fileHash string, device string) (*filefreezer.FileInfo, error) {
+	span := b.span("TagNewFileVersion")
+	fi, err := b.Backend.TagNewFileVersion(userID, fileID, permissions, lastMod, chunkCount, fileHash, device)
+	end(span, err)
+	return fi, err
+}
+
+func (b *tracedBackend) AddFileChunk(userID int, fileID int, versionID int, chunkNumber int, chunkHash string, chunk []byte) (*filefreezer.FileChunk, error) {
+	span := b.span("AddFileChunk")
+	span.SetAttributes(attribute.Int("freezer.chunk_bytes", len(chunk)))
+	fc, err := b.Backend.AddFileChunk(userID, fileID, versionID, chunkNumber, chunkHash, chunk)
+	end(span, err)
+	return fc, err
+}
+
+func (b *tracedBackend) GetFileChunk(fileID int, chunkNumber int, versionID int) (*filefreezer.FileChunk, error) {
+	span := b.span("GetFileChunk")
+	fc, err := b.Backend.GetFileChunk(fileID, chunkNumber, versionID)
+	end(span, err)
+	return fc, err
+}
+
+func (b *tracedBackend) GetFileChunkInfos(userID int, fileID int, versionID int) ([]filefreezer.FileChunk, error) {
+	span := b.span("GetFileChunkInfos")
+	chunks, err := b.Backend.GetFileChunkInfos(userID, fileID, versionID)
+	end(span, err)
+	return chunks, err
+}
+
+func (b *tracedBackend) GetMissingChunkNumbersForFile(userID int, fileID int) ([]int, error) {
+	span := b.span("GetMissingChunkNumbersForFile")
+	missing, err := b.Backend.GetMissingChunkNumbersForFile(userID, fileID)
+	end(span, err)
+	return missing, err
+}
+
+func (b *tracedBackend) GetUser(username string) (*filefreezer.User, error) {
+	span := b.span("GetUser")
+	user, err := b.Backend.GetUser(username)
+	end(span, err)
+	return user, err
+}
+
+func (b *tracedBackend) GetAllUsers() ([]filefreezer.User, error) {
+	span := b.span("GetAllUsers")
+	users, err := b.Backend.GetAllUsers()
+	end(span, err)
+	return users, err
+}
+
+func (b *tracedBackend) UpdateUser(userID int, name string, salt string, saltedHash []byte, cryptoHash []byte, quota int) error {
+	span := b.span("UpdateUser")
+	err := b.Backend.UpdateUser(userID, name, salt, saltedHash, cryptoHash, quota)
+	end(span, err)
+	return err
+}
+
+func (b *tracedBackend) GetUserStats(userID int) (*filefreezer.UserStats, error) {
+	span := b.span("GetUserStats")
+	stats, err := b.Backend.GetUserStats(userID)
+	end(span, err)
+	return stats, err
+}
+
+func (b *tracedBackend) GetUserPruningFreeze(userID int) (bool, int64, string, error) {
+	span := b.span("GetUserPruningFreeze")
+	frozen, frozenAt, reason, err := b.Backend.GetUserPruningFreeze(userID)
+	end(span, err)
+	return frozen, frozenAt, reason, err
+}
+
+func (b *tracedBackend) RemoveFileVersions(userID int, fileID int, minVersion int, maxVersion int) error {
+	span := b.span("RemoveFileVersions")
+	err := b.Backend.RemoveFileVersions(userID, fileID, minVersion, maxVersion)
+	end(span, err)
+	return err
+}
@@ -0,0 +1,71 @@
+// Copyright 2017, Timothy Bogdala <tdb@animal-machine.com>
+// See the LICENSE file for more details.
+
+package server
+
+import (
+	"context"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/labstack/echo"
+	"go.opentelemetry.io/otel/sdk/trace/tracetest"
+)
+
+func TestTracing(t *testing.T) {
+	exporter := tracetest.NewInMemoryExporter()
+	srv, err := New(Config{
+		DatabasePath: "file:tracing?mode=memory&cache=shared",
+		ChunkSize:    1024,
+		Tracing:      TracingConfig{exporter: exporter},
+	})
+	if err != nil {
+		t.Fatalf("Failed to create a server with tracing: %v", err)
+	}
+	defer srv.Close()
+
+	// a request continuing a caller's trace
+	req := httptest.NewRequest("GET", "/api/time", nil)
+	req.Header.Set("traceparent", "00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01")
+	srv.Handler().ServeHTTP(httptest.NewRecorder(), req)
+
+	// so is a login, along with the lookup of the user
+	req = httptest.NewRequest("POST", "/api/users/login", strings.NewReader("user=nobody&derived=x"))
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	srv.Handler().ServeHTTP(httptest.NewRecorder(), req)
+
+	// a storage call made while handling a request is a child of its span
+	ctx, span := srv.state.tracer.Start(context.Background(), "GET /api/file/:fileid")
+	c := echo.New().NewContext(httptest.NewRequest("GET", "/api/file/1", nil).WithContext(ctx), httptest.NewRecorder())
+	srv.state.store(c).GetFileInfo(1, 1)
+	span.End()
+
+	// the test exporter gets each span as it ends
+	spans := exporter.GetSpans()
+	byName := make(map[string]tracetest.SpanStub)
+	for _, s := range spans {
+		byName[s.Name] = s
+	}
+
+	timeSpan, ok := byName["GET /api/time"]
+	if !ok {
+		t.Fatalf("Expected a span for the request but got %v.", spans)
+	}
+	if timeSpan.SpanContext.TraceID().String() != "4bf92f3577b34da6a3ce929d0e0e4736" {
+		t.Fatalf("Expected the request to continue the caller's trace but got %s.", timeSpan.SpanContext.TraceID())
+	}
+
+	storageSpan, ok := byName["storage.GetFileInfo"]
+	if !ok {
+		t.Fatalf("Expected a span for the storage call but got %v.", spans)
+	}
+	if storageSpan.Parent.SpanID() != byName["GET /api/file/:fileid"].SpanContext.SpanID() {
+		t.Fatal("Expected the storage span to be a child of the request's span.")
+	}
+
+	userSpan, ok := byName["storage.GetUser"]
+	if !ok || userSpan.Parent.SpanID() != byName["POST /api/users/login"].SpanContext.SpanID() {
+		t.Fatalf("Expected a span for looking up the user logging in but got %v.", spans)
+	}
+}
@@ -0,0 +1,117 @@
+// Copyright 2017, Timothy Bogdala <tdb@animal-machine.com>
+// See the LICENSE file for more details.
+
+package server
+
+import (
+	"sync"
+	"time"
+
+	"github.com/marcoziti/gringotts"
+)
+
+// usageCounter keeps a count of what each user has stored so that the stats
+// requests don't total up all of a large account's files and chunks. A
+// background job recounts the users whose revision changed since their last
+// count, which is every user that wrote anything since every write bumps the
+// revision. The counts are only kept in memory and users are counted on
+// their first request after a restart.
+type usageCounter struct {
+	state *serverState
+
+	lock  sync.Mutex
+	users map[int]filefreezer.UserUsage
+}
+
+// newUsageCounter creates a new usage counter with no counts.
+func newUsageCounter(state *serverState) *usageCounter {
+	return &usageCounter{
+		state: state,
+		users: make(map[int]filefreezer.UserUsage),
+	}
+}
+
+// get returns the last count of the usage of the user at the revision, which
+// may be from an older revision. Users that were never counted are counted
+// now, as are users whose count is from a newer revision, which happens when
+// a removed user's id is reused.
+func (u *usageCounter) get(userID int, revision int) (filefreezer.UserUsage, error) {
+	u.lock.Lock()
+	usage, found := u.users[userID]
+	u.lock.Unlock()
+	if found && usage.Revision <= revision {
+		return usage, nil
+	}
+	return u.count(userID)
+}
+
+// count counts the user's usage and keeps it for later requests.
+func (u *usageCounter) count(userID int) (filefreezer.UserUsage, error) {
+	usage, err := u.state.Storage.GetUserUsage(userID)
+	if err != nil {
+		return filefreezer.UserUsage{}, err
+	}
+	u.lock.Lock()
+	u.users[userID] = *usage
+	u.lock.Unlock()
+	return *usage, nil
+}
+
+// start recounts the changed users each interval until state.quit is closed.
+func (u *usageCounter) start(interval time.Duration) {
+	go func() {
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ticker.C:
+				u.recount()
+			case <-u.state.quit:
+				return
+			}
+		}
+	}()
+}
+
+// recount counts the users whose revision changed since their last count.
+// Users that were never counted are left until they ask for their stats, and
+// users that were removed are forgotten.
+func (u *usageCounter) recount() {
+	users, err := u.state.Storage.GetAllUsers()
+	if err != nil {
+		u.state.printf("Failed to get the users to count the usage of: %v\n", err)
+		return
+	}
+
+	existing := make(map[int]bool, len(users))
+	for _, user := range users {
+		existing[user.ID] = true
+		u.lock.Lock()
+		usage, found := u.users[user.ID]
+		u.lock.Unlock()
+		if !found {
+			continue
+		}
+
+		stats, err := u.state.Storage.GetUserStats(user.ID)
+		if err != nil {
+			u.state.printf("Failed to get the stats of user %s: %v\n", user.Name, err)
+			continue
+		}
+		if stats.Revision == usage.Revision {
+			continue
+		}
+		_, err = u.count(user.ID)
+		if err != nil {
+			u.state.printf("Failed to count the usage of user %s: %v\n", user.Name, err)
+		}
+	}
+
+	u.lock.Lock()
+	for userID := range u.users {
+		if !existing[userID] {
+			delete(u.users, userID)
+		}
+	}
+	u.lock.Unlock()
+}
@@ -0,0 +1,60 @@
+// Copyright 2017, Timothy Bogdala <tdb@animal-machine.com>
+// See the LICENSE file for more details.
+
+package server
+
+import (
+	"testing"
+)
+
+func TestUsageCounter(t *testing.T) {
+	srv, err := New(Config{
+		DatabasePath: "file:usagecounter?mode=memory&cache=shared",
+		ChunkSize:    1024,
+	})
+	if err != nil {
+		t.Fatalf("Failed to create the server: %v", err)
+	}
+	defer srv.Close()
+
+	user, err := srv.Storage.AddUser("alice", "salt", []byte("saltedhash"), 1e6)
+	if err != nil {
+		t.Fatalf("Failed to add a user: %v", err)
+	}
+	usage, err := srv.state.usage.get(user.ID, 0)
+	if err != nil || usage.FileCount != 0 {
+		t.Fatalf("Expected a new user to have no files but got %+v: %v", usage, err)
+	}
+
+	// the count is kept until the background job sees that the user changed
+	fi, err := srv.Storage.AddFileInfo(user.ID, "file", false, 0644, 100, 1, "hash", "")
+	if err != nil {
+		t.Fatalf("Failed to add a file: %v", err)
+	}
+	if _, err = srv.Storage.TagNewFileVersion(user.ID, fi.FileID, 0644, 200, 1, "hash2", ""); err != nil {
+		t.Fatalf("Failed to tag a version: %v", err)
+	}
+	stats, err := srv.Storage.GetUserStats(user.ID)
+	if err != nil {
+		t.Fatalf("Failed to get the user stats: %v", err)
+	}
+	usage, err = srv.state.usage.get(user.ID, stats.Revision)
+	if err != nil || usage.FileCount != 0 || usage.Revision >= stats.Revision {
+		t.Fatalf("Expected the old count until the users are recounted but got %+v: %v", usage, err)
+	}
+
+	srv.state.usage.recount()
+	usage, err = srv.state.usage.get(user.ID, stats.Revision)
+	if err != nil || usage.FileCount != 1 || usage.VersionCount != 2 || usage.Revision != stats.Revision {
+		t.Fatalf("Expected one file with two versions at revision %d but got %+v: %v", stats.Revision, usage, err)
+	}
+
+	// a removed user is forgotten
+	if err = srv.Storage.RemoveUser("alice"); err != nil {
+		t.Fatalf("Failed to remove the user: %v", err)
+	}
+	srv.state.usage.recount()
+	if _, found := srv.state.usage.users[user.ID]; found {
+		t.Fatal("Expected the count of a removed user to be forgotten.")
+	}
+}
@@ -0,0 +1,140 @@
+// Copyright 2017, Timothy Bogdala <tdb@animal-machine.com>
+// See the LICENSE file for more details.
+
+package server
+
+import (
+	"encoding/json"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"strings"
+
+	"github.com/labstack/echo"
+
+	"github.com/marcoziti/gringotts/cmd/freezer/models"
+)
+
+const (
+	// maxJSONBodySize is the largest JSON or form request body accepted.
+	maxJSONBodySize = 1 << 20 // 1 MB
+
+	// ChunkOverhead is the extra space allowed on top of the chunk size for
+	// the nonce and authentication tag that the client adds when encrypting.
+	ChunkOverhead = 128
+)
+
+// requestError is a request that was rejected before it got handled.
+type requestError struct {
+	status  int
+	message string
+	field   string
+}
+
+// Error returns the reason the request was rejected.
+func (e *requestError) Error() string {
+	return e.message
+}
+
+// sendRequestError writes the error as a structured JSON response. Errors that
+// aren't a *requestError are sent as a bad request.
+func sendRequestError(c echo.Context, err error) error {
+	rerr, ok := err.(*requestError)
+	if !ok {
+		rerr = &requestError{status: http.StatusBadRequest, message: err.Error()}
+	}
+	return c.JSON(rerr.status, &models.ErrorResponse{
+		Status: rerr.status,
+		Error:  rerr.message,
+		Field:  rerr.field,
+	})
+}
+
+// limitBody is route middleware that rejects request bodies larger than maxSize
+// with 413 before any of it is read, and otherwise caps the body reader so that
+// a client lying about the length can't send more.
+func limitBody(maxSize int64) echo.MiddlewareFunc {
+	return func(next echo.HandlerFunc) echo.HandlerFunc {
+		return func(c echo.Context) error {
+			r := c.Request()
+			if r.ContentLength > maxSize {
+				return sendRequestError(c, &requestError{status: http.StatusRequestEntityTooLarge, message: "The request body is too large."})
+			}
+			r.Body = http.MaxBytesReader(c.Response().Writer, r.Body, maxSize)
+			return next(c)
+		}
+	}
+}
+
+// limitJSONBodies is middleware for all routes that applies the maxJSONBodySize
+// limit to JSON and form requests. Other bodies, such as chunk data, are left
+// to the limits of their routes.
+func limitJSONBodies() echo.MiddlewareFunc {
+	limit := limitBody(maxJSONBodySize)
+	return func(next echo.HandlerFunc) echo.HandlerFunc {
+		limited := limit(next)
+		return func(c echo.Context) error {
+			contentType := c.Request().Header.Get(echo.HeaderContentType)
+			if strings.HasPrefix(contentType, echo.MIMEApplicationJSON) || strings.HasPrefix(contentType, echo.MIMEApplicationForm) {
+				return limited(c)
+			}
+			return next(c)
+		}
+	}
+}
+
+// readBody reads the whole request body, which should already be capped with
+// limitBody. Since that rejects declared lengths over the limit, a body with a
+// length is read into a buffer allocated once instead of one grown as it
+// arrives, which would hold up to twice the chunk size in memory.
+// Errors are returned as a *requestError to be sent with sendRequestError.
+func readBody(c echo.Context) ([]byte, error) {
+	r := c.Request()
+	var body []byte
+	var err error
+	if r.ContentLength > 0 {
+		body = make([]byte, r.ContentLength)
+		_, err = io.ReadFull(r.Body, body)
+	} else {
+		body, err = ioutil.ReadAll(r.Body)
+	}
+	if err != nil {
+		if strings.Contains(err.Error(), "request body too large") {
+			return nil, &requestError{status: http.StatusRequestEntityTooLarge, message: "The request body is too large."}
+		}
+		return nil, &requestError{status: http.StatusBadRequest, message: "Failed to read the request body: " + err.Error()}
+	}
+	return body, nil
+}
+
+// bindRequest decodes the JSON request body into req and validates it. Errors
+// are returned as a *requestError to be sent with sendRequestError.
+func bindRequest(c echo.Context, req models.Validator) error {
+	r := c.Request()
+	if !strings.HasPrefix(r.Header.Get(echo.HeaderContentType), echo.MIMEApplicationJSON) {
+		return &requestError{status: http.StatusUnsupportedMediaType, message: "The request body must be JSON."}
+	}
+
+	decoder := json.NewDecoder(r.Body)
+	err := decoder.Decode(req)
+	if err != nil {
+		if strings.Contains(err.Error(), "request body too large") {
+			return &requestError{status: http.StatusRequestEntityTooLarge, message: "The request body is too large."}
+		}
+		return &requestError{status: http.StatusBadRequest, message: "Failed to read the request body: " + err.Error()}
+	}
+	if decoder.More() {
+		return &requestError{status: http.StatusBadRequest, message: "The request body has data after the JSON object."}
+	}
+
+	err = req.Validate()
+	if err != nil {
+		rerr := &requestError{status: http.StatusBadRequest, message: err.Error()}
+		if verr, ok := err.(*models.ValidationError); ok {
+			rerr.field = verr.Field
+		}
+		return rerr
+	}
+
+	return nil
+}
@@ -0,0 +1,172 @@
+// Copyright 2017, Timothy Bogdala <tdb@animal-machine.com>
+// See the LICENSE file for more details.
+
+//go:build tray
+// +build tray
+
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"image"
+	"image/color"
+	"image/png"
+	"runtime"
+	"time"
+
+	"github.com/getlantern/systray"
+	"github.com/marcoziti/gringotts/cmd/freezer/command"
+)
+
+// trayPollInterval is how often the tray asks the agent for its status.
+const trayPollInterval = 5 * time.Second
+
+// trayRecentItems is the number of recent sync passes listed in the menu.
+const trayRecentItems = 5
+
+// runTray shows an icon in the system tray with the status and recent
+// activity of the agent serving its status on addr along with controls to
+// pause, resume and sync it. It returns once Quit is picked from the menu.
+func runTray(addr string) error {
+	systray.Run(func() { trayReady(addr) }, func() {})
+	return nil
+}
+
+// trayReady builds the tray menu and keeps it up to date with the agent.
+func trayReady(addr string) {
+	systray.SetIcon(trayIcon())
+	systray.SetTooltip("Filefreezer")
+
+	statusItem := systray.AddMenuItem("Connecting to the agent...", "")
+	statusItem.Disable()
+	lastItem := systray.AddMenuItem("", "")
+	lastItem.Disable()
+	recentMenu := systray.AddMenuItem("Recent activity", "The last few sync passes")
+	var recentItems []*systray.MenuItem
+	for i := 0; i < trayRecentItems; i++ {
+		item := recentMenu.AddSubMenuItem("", "")
+		item.Disable()
+		item.Hide()
+		recentItems = append(recentItems, item)
+	}
+	systray.AddSeparator()
+	pauseItem := systray.AddMenuItem("Pause", "Pause the scheduled syncs")
+	syncItem := systray.AddMenuItem("Sync now", "Sync right away, even if paused")
+	systray.AddSeparator()
+	quitItem := systray.AddMenuItem("Quit", "Close the tray; the agent keeps running")
+
+	paused := false
+	refresh := func() {
+		status, err := command.GetAgentStatus(addr)
+		if err != nil {
+			statusItem.SetTitle("The agent isn't running")
+			lastItem.Hide()
+			pauseItem.Disable()
+			syncItem.Disable()
+			return
+		}
+		pauseItem.Enable()
+		syncItem.Enable()
+
+		paused = status.Paused
+		switch {
+		case status.Syncing:
+			statusItem.SetTitle(fmt.Sprintf("Syncing (%d paths queued)", status.QueueDepth))
+		case status.Paused:
+			statusItem.SetTitle("Paused")
+		case !status.Healthy:
+			statusItem.SetTitle("Needs attention")
+		default:
+			statusItem.SetTitle("Up to date")
+		}
+		if paused {
+			pauseItem.SetTitle("Resume")
+		} else {
+			pauseItem.SetTitle("Pause")
+		}
+
+		lastItem.Show()
+		if status.SyncCount > 0 {
+			lastItem.SetTitle("Last sync: " + status.LastSyncEnd.Format("Jan 2 15:04"))
+		} else {
+			lastItem.SetTitle("Last sync: never")
+		}
+		for i, item := range recentItems {
+			if i >= len(status.Recent) {
+				item.Hide()
+				continue
+			}
+			item.SetTitle(trayPassTitle(status.Recent[i]))
+			item.Show()
+		}
+	}
+
+	go func() {
+		ticker := time.NewTicker(trayPollInterval)
+		defer ticker.Stop()
+		refresh()
+		for {
+			var err error
+			select {
+			case <-ticker.C:
+			case <-pauseItem.ClickedCh:
+				if paused {
+					err = command.ControlAgent(addr, "resume")
+				} else {
+					err = command.ControlAgent(addr, "pause")
+				}
+			case <-syncItem.ClickedCh:
+				err = command.ControlAgent(addr, "sync")
+			case <-quitItem.ClickedCh:
+				systray.Quit()
+				return
+			}
+			if err != nil {
+				statusItem.SetTitle(err.Error())
+				continue
+			}
+			refresh()
+		}
+	}()
+}
+
+// trayPassTitle describes a sync pass in the recent activity menu.
+func trayPassTitle(pass command.AgentPass) string {
+	when := pass.End.Format("Jan 2 15:04")
+	if pass.Error != "" {
+		return when + ": failed"
+	}
+	return fmt.Sprintf("%s: %d chunks changed", when, pass.ChangeCount)
+}
+
+// trayIcon draws the tray icon: a light blue square with a white border. It's
+// a PNG, or an ICO wrapping the PNG on Windows.
+func trayIcon() []byte {
+	const size = 32
+	img := image.NewRGBA(image.Rect(0, 0, size, size))
+	for y := 0; y < size; y++ {
+		for x := 0; x < size; x++ {
+			c := color.RGBA{0x4a, 0x9b, 0xd9, 0xff}
+			if x < 3 || y < 3 || x >= size-3 || y >= size-3 {
+				c = color.RGBA{0xff, 0xff, 0xff, 0xff}
+			}
+			img.Set(x, y, c)
+		}
+	}
+	var pngData bytes.Buffer
+	png.Encode(&pngData, img)
+	if runtime.GOOS != "windows" {
+		return pngData.Bytes()
+	}
+
+	// an ICO header and a single directory entry pointing at the PNG
+	var ico bytes.Buffer
+	binary.Write(&ico, binary.LittleEndian, []uint16{0, 1, 1})
+	ico.Write([]byte{size, size, 0, 0})
+	binary.Write(&ico, binary.LittleEndian, []uint16{1, 32})
+	binary.Write(&ico, binary.LittleEndian, []uint32{uint32(pngData.Len()), 22})
+	ico.Write(pngData.Bytes())
+	return ico.Bytes()
+}
@@ -0,0 +1,15 @@
+// Copyright 2017, Timothy Bogdala <tdb@animal-machine.com>
+// See the LICENSE file for more details.
+
+//go:build !tray
+// +build !tray
+
+package main
+
+import "fmt"
+
+// runTray would show the agent in the system tray, but the tray needs cgo on
+// most platforms so it's only built with the tray tag.
+func runTray(addr string) error {
+	return fmt.Errorf("The system tray isn't included in this build; build freezer with -tags tray")
+}
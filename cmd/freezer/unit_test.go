@@ -4,11 +4,32 @@
 package main
 
 import (
+	"archive/tar"
+	"compress/gzip"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/elliptic"
+	crand "crypto/rand"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/hex"
 	"encoding/json"
+	"encoding/pem"
+	"errors"
 	"fmt"
+	"image/png"
+	"io"
 	"log"
 	"math/rand"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
 	"os"
+	"os/exec"
+	"path/filepath"
+	"runtime"
 	"testing"
 	"time"
 
@@ -18,10 +39,16 @@ import (
 
 	"strings"
 
+	"github.com/pkg/sftp"
+	qrcode "github.com/skip2/go-qrcode"
 	"github.com/spf13/afero"
+	"golang.org/x/crypto/bcrypt"
+	"golang.org/x/crypto/ssh"
 	"github.com/marcoziti/gringotts"
 	"github.com/marcoziti/gringotts/cmd/freezer/command"
+	"github.com/marcoziti/gringotts/cmd/freezer/freezertest"
 	"github.com/marcoziti/gringotts/cmd/freezer/models"
+	"github.com/marcoziti/gringotts/cmd/freezer/server"
 )
 
 const (
@@ -38,7 +65,7 @@ const (
 )
 
 var (
-	state    *serverState
+	state    *server.Server
 	testHost string
 	AppFs    = afero.NewOsFs()
 )
@@ -70,6 +97,12 @@ func setupHTTPTestFlags() {
 }
 
 func TestMain(m *testing.M) {
+	// TestCPULimit runs itself in a copy of the test binary, which doesn't
+	// need the test server
+	if os.Getenv(lowPriorityTestEnv) != "" {
+		os.Exit(m.Run())
+	}
+
 	// instead of using command line flags for the unit test, we'll just
 	// override the flag values right here
 	*flagDatabasePath = "file::memory:?mode=memory&cache=shared"
@@ -77,6 +110,7 @@ func TestMain(m *testing.M) {
 	*flagExtraStrict = true
 	*argServeListenAddr = testServerAddr
 	*flagCryptoPass = "beavers_and_ducks"
+	*flagServePublic = true
 
 	if useHTTPS {
 		setupHTTPSTestFlags()
@@ -99,15 +133,15 @@ func TestMain(m *testing.M) {
 
 	// run a new state in a server
 	var err error
-	state, err = newState()
+	state, err = server.New(newServerConfig())
 	if err != nil {
 		log.Fatalf("Unable to initialize the server: %v", err)
 	}
-	defer state.close()
+	defer state.Close()
 
 	// this new server will run in a separate goroutine
 	readyCh := make(chan bool)
-	go state.serve(readyCh)
+	go serve(state, readyCh)
 
 	<-readyCh
 	os.Exit(m.Run())
@@ -522,6 +556,7 @@ func TestEverything(t *testing.T) {
 	}
 
 	// run a sync across the whole testdir directory
+	countsBefore := cmdState.Stats.Counts()
 	syncdirCount, err := cmdState.SyncDirectory(testDataDir, testDataDir)
 	if err != nil {
 		t.Fatalf("Failed to run the syncdir command for the testdata directory: %v", err)
@@ -529,6 +564,10 @@ func TestEverything(t *testing.T) {
 	if syncdirCount != 10 {
 		t.Fatalf("Expected to upload 10 chunks worth of data, but only uploaded %d.", syncdirCount)
 	}
+	countsAfter := cmdState.Stats.Counts()
+	if countsAfter.ChunksUploaded-countsBefore.ChunksUploaded != 10 || countsAfter.BytesUploaded <= countsBefore.BytesUploaded {
+		t.Fatalf("Expected the sync stats to count the 10 uploaded chunks but got %+v.", countsAfter)
+	}
 
 	// wipe out the files that are in storage to start the syncdir operation with a clean state
 	err = removeAllFilesFromStorage(cmdState)
@@ -649,7 +688,9 @@ func TestEverything(t *testing.T) {
 func TestFileVersioning(t *testing.T) {
 	bytesAllocated := 0
 
+	// transfer chunks concurrently to exercise the batching
 	cmdState := command.NewState()
+	cmdState.MaxTransfers = 4
 
 	// recreate a test user
 	username := "admin"
@@ -746,8 +787,17 @@ func TestFileVersioning(t *testing.T) {
 	rando1[3] = 0xEF
 	ioutil.WriteFile(testFilename1, rando1, os.ModePerm)
 
+	// on a metered connection the large upload should be deferred
+	cmdState.Metered = command.MeteredYes
+	cmdState.DeferSize = int64(len(rando1) - 1)
+	status, changeCount, err := cmdState.SyncFile(filename, filename, command.SyncCurrentVersion)
+	if err != nil || status != command.SyncStatusDeferred || changeCount != 0 {
+		t.Fatalf("Expected the upload to be deferred on a metered connection but got status %d (%v).", status, err)
+	}
+	cmdState.Metered = command.MeteredNo
+
 	// upload a newer version of the file
-	status, _, err := cmdState.SyncFile(filename, filename, command.SyncCurrentVersion)
+	status, _, err = cmdState.SyncFile(filename, filename, command.SyncCurrentVersion)
 	if err != nil {
 		t.Fatalf("Error while updating file to a newer version via sync: %v", err)
 	}
@@ -930,6 +980,25 @@ func TestFileVersioning(t *testing.T) {
 		t.Fatal("Differences were found in the local file with respect to previous version when they should have been the same")
 	}
 
+	// export the full history and make sure a file was written for each version
+	exportDir, err := ioutil.TempDir("", "freezer-export")
+	if err != nil {
+		t.Fatalf("Failed to create a temporary directory for the export: %v", err)
+	}
+	defer os.RemoveAll(exportDir)
+	exportCount, err := cmdState.ExportHistory(filename, exportDir)
+	if err != nil {
+		t.Fatalf("Failed to export the version history of the test file: %v", err)
+	}
+	exportedFiles, err := ioutil.ReadDir(exportDir)
+	if err != nil {
+		t.Fatalf("Failed to read the export directory: %v", err)
+	}
+	if exportCount != 5 || len(exportedFiles) != 5 {
+		t.Fatalf("Expected to export five versions of the test file but exported %d and found %d files.",
+			exportCount, len(exportedFiles))
+	}
+
 	// at this point we have five versions. attempt to delete the first three
 	err = cmdState.RmFileVersions(filename, 1, 3, false)
 	if err != nil {
@@ -950,7 +1019,7 @@ func TestFileVersioning(t *testing.T) {
 	}
 
 	// attempt removal of a version by regular expression
-	err = cmdState.RmRxFileVersions(testRegex, 1, "H~", false)
+	err = cmdState.RmRxFileVersions(testRegex, command.MatchOptions{}, 1, "H~", false)
 	if err != nil {
 		t.Fatalf("Error while attempting to remove one version of the test file by regex: %v", err)
 	}
@@ -990,7 +1059,7 @@ func TestFileVersioning(t *testing.T) {
 	originalCount := len(allFiles)
 
 	// attempt a dry run of the pattern match and ensure no files were deleted
-	err = cmdState.RmRxFiles(testRegex, true)
+	err = cmdState.RmRxFiles(testRegex, command.MatchOptions{}, true)
 	if err != nil {
 		t.Fatalf("Failed to remove files based on the regular expression: %v", err)
 	}
@@ -1004,7 +1073,7 @@ func TestFileVersioning(t *testing.T) {
 	}
 
 	// now actually remove the files
-	err = cmdState.RmRxFiles(testRegex, false)
+	err = cmdState.RmRxFiles(testRegex, command.MatchOptions{}, false)
 	if err != nil {
 		t.Fatalf("Failed to remove files based on the regular expression: %v", err)
 	}
@@ -1017,6 +1086,74 @@ func TestFileVersioning(t *testing.T) {
 		t.Fatalf("RmRx operation did not delete the expected number of files %d (got: %d).",
 			originalCount-2, originalCount-len(allFiles))
 	}
+
+	// stream data of an unknown length up twice, creating two versions, then stream it back down
+	const streamFilename = "streamed.dat"
+	for i := 0; i < 2; i++ {
+		streamed := genRandomBytes(int(*flagServeChunkSize)*2 + 17 + i)
+		chunkCount, err := cmdState.UploadStream(bytes.NewReader(streamed), streamFilename)
+		if err != nil || chunkCount != 3 {
+			t.Fatalf("Failed to upload the stream (%d chunks): %v", chunkCount, err)
+		}
+
+		var downloaded bytes.Buffer
+		_, err = cmdState.DownloadStream(&downloaded, streamFilename)
+		if err != nil {
+			t.Fatalf("Failed to download the stream: %v", err)
+		}
+		if !bytes.Equal(streamed, downloaded.Bytes()) {
+			t.Fatal("The streamed data that was downloaded didn't match what was uploaded.")
+		}
+	}
+	versions, err = cmdState.GetFileVersions(streamFilename)
+	if err != nil || len(versions) != 2 {
+		t.Fatalf("Expected two versions of the streamed file but got %d: %v", len(versions), err)
+	}
+
+	// downloads that fail the scanner get quarantined instead of moved into place
+	scannedFilename := testDataDir2 + "/" + streamFilename
+	cmdState.Scanner = "false"
+	cmdState.QuarantineDir = testDataDir2 + "/quarantine"
+	_, _, err = cmdState.SyncFile(scannedFilename, streamFilename, command.SyncCurrentVersion)
+	if err == nil {
+		t.Fatal("Expected the download that failed the scanner to return an error.")
+	}
+	if _, err = os.Stat(scannedFilename); !os.IsNotExist(err) {
+		t.Fatal("The download that failed the scanner was moved into place.")
+	}
+	quarantined, _ := ioutil.ReadDir(cmdState.QuarantineDir)
+	if len(quarantined) != 1 {
+		t.Fatalf("Expected one quarantined file but found %d.", len(quarantined))
+	}
+
+	cmdState.Scanner = "true"
+	_, _, err = cmdState.SyncFile(scannedFilename, streamFilename, command.SyncCurrentVersion)
+	cmdState.Scanner = ""
+	if err != nil {
+		t.Fatalf("Failed to download the file that passed the scanner: %v", err)
+	}
+	if _, err = os.Stat(scannedFilename); err != nil {
+		t.Fatalf("The download that passed the scanner wasn't moved into place: %v", err)
+	}
+
+	// invalid requests should be rejected with a structured error naming the field
+	var badFile models.FilePutRequest
+	badFile.ChunkCount = -1
+	_, err = cmdState.RunAuthRequest(testHost+"/api/files", "POST", cmdState.AuthToken, badFile)
+	if err == nil || !strings.Contains(err.Error(), `"Field":"FileName"`) {
+		t.Fatalf("Expected the file without a name to be rejected: %v", err)
+	}
+
+	// chunks larger than the chunk size plus the encryption overhead should be rejected
+	fi, err := cmdState.GetFileInfoByFilename(streamFilename)
+	if err != nil {
+		t.Fatalf("Failed to get the file info for the stream file: %v", err)
+	}
+	target := fmt.Sprintf("%s/api/chunk/%d/%d/0/abc", testHost, fi.FileID, fi.CurrentVersion.VersionID)
+	_, err = cmdState.RunAuthRequest(target, "PUT", cmdState.AuthToken, genRandomBytes(int(*flagServeChunkSize)+server.ChunkOverhead+1))
+	if err == nil || !strings.Contains(err.Error(), "413") {
+		t.Fatalf("Expected the oversized chunk to be rejected as too large: %v", err)
+	}
 }
 
 func removeAllFilesFromStorage(cmdState *command.State) error {
@@ -1036,3 +1173,4014 @@ func removeAllFilesFromStorage(cmdState *command.State) error {
 
 	return nil
 }
+
+func TestImportHistory(t *testing.T) {
+	srv := freezertest.NewServer(t)
+	defer srv.Close()
+	cmdState := srv.NewUser(t, "importer", "1234", *flagCryptoPass)
+
+	// three dated snapshots where the notes only change in the last one, and
+	// a directory that doesn't match the layout
+	snapshotsDir := filepath.Join(srv.Dir, "snapshots")
+	first, last := genRandomBytes(1000), genRandomBytes(2000)
+	snapshots := map[string][]byte{"2017-01-01": first, "2017-02-01": first, "2017-03-01": last, "latest": last}
+	for name, data := range snapshots {
+		os.MkdirAll(filepath.Join(snapshotsDir, name, "docs"), 0755)
+		ioutil.WriteFile(filepath.Join(snapshotsDir, name, "docs", "notes.txt"), data, 0644)
+	}
+
+	_, err := cmdState.ImportHistory(snapshotsDir, "backup", "2006-01-02")
+	if err != nil {
+		t.Fatalf("Failed to import the snapshots: %v", err)
+	}
+
+	// unchanged files don't get a version and each version is dated by its snapshot
+	versions, err := cmdState.GetFileVersions("backup/docs/notes.txt")
+	if err != nil || len(versions) != 2 {
+		t.Fatalf("Expected two versions of the imported file but got %d: %v", len(versions), err)
+	}
+	for i, date := range []string{"2017-01-01", "2017-03-01"} {
+		snapshotTime, _ := time.ParseInLocation("2006-01-02", date, time.Local)
+		if versions[i].LastMod != snapshotTime.Unix() {
+			t.Fatalf("Expected version %d to be dated %s but it's %s.", versions[i].VersionNumber, date,
+				time.Unix(versions[i].LastMod, 0))
+		}
+	}
+
+	// exporting the history gets the snapshots back
+	exportDir := filepath.Join(srv.Dir, "exported")
+	exportCount, err := cmdState.ExportHistory("backup/docs/notes.txt", exportDir)
+	if err != nil || exportCount != 2 {
+		t.Fatalf("Expected two versions to be exported but got %d: %v", exportCount, err)
+	}
+	for i, data := range [][]byte{first, last} {
+		exportName := fmt.Sprintf("notes.%s.v%d.txt",
+			time.Unix(versions[i].LastMod, 0).UTC().Format("2006-01-02T150405"), versions[i].VersionNumber)
+		exported, err := ioutil.ReadFile(filepath.Join(exportDir, exportName))
+		if err != nil || !bytes.Equal(exported, data) {
+			t.Fatalf("The exported %s doesn't match its snapshot: %v", exportName, err)
+		}
+	}
+
+	if _, err = cmdState.ImportHistory(filepath.Join(srv.Dir, "exported"), "", "2006-01-02"); err == nil {
+		t.Fatal("Expected an import without dated snapshot directories to fail.")
+	}
+}
+
+func TestBandwidthSchedule(t *testing.T) {
+	limit, err := command.ParseBandwidth("1.5M")
+	if err != nil || limit != 1024*1024*3/2 {
+		t.Fatalf("Expected 1.5M to parse as %d bytes per second but got %d (%v).", 1024*1024*3/2, limit, err)
+	}
+
+	rule, err := command.ParseBandwidthRule("23:30-07:00=512K")
+	if err != nil || rule.Start != 23*time.Hour+30*time.Minute || rule.End != 7*time.Hour || rule.Limit != 512*1024 {
+		t.Fatalf("Failed to parse a bandwidth rule wrapping past midnight: %+v (%v).", rule, err)
+	}
+
+	for _, bad := range []string{"01:00=0", "01:00-07:00", "25:00-07:00=0", "01:00-07:00=fast"} {
+		_, err = command.ParseBandwidthRule(bad)
+		if err == nil {
+			t.Fatalf("Expected the bandwidth rule %q to be rejected.", bad)
+		}
+	}
+}
+
+func TestFileFilters(t *testing.T) {
+	now := time.Date(2017, 7, 1, 12, 0, 0, 0, time.Local)
+	since, err := command.ParseSince("36h", now)
+	if err != nil || !since.Equal(now.Add(-36*time.Hour)) {
+		t.Fatalf("Failed to parse a duration for --since: %v (%v).", since, err)
+	}
+	since, err = command.ParseSince("2017-06-30", now)
+	if err != nil || !since.Equal(time.Date(2017, 6, 30, 0, 0, 0, 0, time.Local)) {
+		t.Fatalf("Failed to parse a date for --since: %v (%v).", since, err)
+	}
+	_, err = command.ParseSince("yesterday", now)
+	if err == nil {
+		t.Fatal("Expected an unknown --since value to be rejected.")
+	}
+	minSize, err := command.ParseSize("10K")
+	if err != nil || minSize != 10*1024 {
+		t.Fatalf("Failed to parse a size for --minsize: %d (%v).", minSize, err)
+	}
+
+	files := make([]filefreezer.FileInfo, 3)
+	files[0].FileID = 1
+	files[0].CurrentVersion.LastMod = since.Unix() - 1
+	files[0].CurrentVersion.Size = minSize
+	files[1].FileID = 2
+	files[1].CurrentVersion.LastMod = since.Unix()
+	files[1].CurrentVersion.Size = minSize - 1
+	files[2].FileID = 3
+	files[2].IsDir = true
+	files[2].CurrentVersion.LastMod = since.Unix()
+
+	if len(command.FilterFiles(files, command.FileFilter{})) != 3 {
+		t.Fatal("Expected an empty filter to keep every file.")
+	}
+	recent := command.FilterFiles(files, command.FileFilter{ModifiedSince: since})
+	if len(recent) != 2 || recent[0].FileID != 2 || recent[1].FileID != 3 {
+		t.Fatalf("Expected the files modified since %v but got %+v.", since, recent)
+	}
+	large := command.FilterFiles(files, command.FileFilter{MinSize: minSize})
+	if len(large) != 1 || large[0].FileID != 1 {
+		t.Fatalf("Expected only the file with %d bytes but got %+v.", minSize, large)
+	}
+
+	// listings sort by name by default and the other columns put the largest first
+	entries := []command.ListEntry{
+		{FileInfo: files[0], Name: "c.txt"},
+		{FileInfo: files[1], Name: "a.txt"},
+		{FileInfo: files[2], Name: "b"},
+	}
+	sortedNames := func() string {
+		var names []string
+		for _, e := range entries {
+			names = append(names, e.Name)
+		}
+		return strings.Join(names, ",")
+	}
+	command.SortListEntries(entries, command.SortByName, false)
+	if sortedNames() != "a.txt,b,c.txt" {
+		t.Fatalf("Unexpected order when sorting by name: %s", sortedNames())
+	}
+	command.SortListEntries(entries, command.SortBySize, false)
+	if sortedNames() != "c.txt,a.txt,b" {
+		t.Fatalf("Unexpected order when sorting by size: %s", sortedNames())
+	}
+	command.SortListEntries(entries, command.SortByModified, true)
+	if sortedNames() != "c.txt,b,a.txt" {
+		t.Fatalf("Unexpected order when reverse sorting by modification time: %s", sortedNames())
+	}
+	err = command.SortListEntries(entries, "color", false)
+	if err == nil {
+		t.Fatal("Expected an unknown sort column to be rejected.")
+	}
+}
+
+func TestBench(t *testing.T) {
+	srv := freezertest.NewServer(t)
+	defer srv.Close()
+	cmdState := srv.NewUser(t, "bench", "1234", *flagCryptoPass)
+
+	result, err := cmdState.RunBench(command.BenchOptions{
+		Clients:  3,
+		Files:    2,
+		FileSize: freezertest.DefaultChunkSize*2 + 42,
+	})
+	if err != nil {
+		t.Fatalf("Failed to run the benchmark: %v", err)
+	}
+	if result.Errors != 0 {
+		t.Fatalf("Expected the benchmark to run without errors but got %d: %v", result.Errors, result.FirstError)
+	}
+	if result.Uploads.Count != 6 || result.Downloads.Count != 6 {
+		t.Fatalf("Expected 6 uploads and downloads but got %d and %d.", result.Uploads.Count, result.Downloads.Count)
+	}
+	if result.Uploads.P50 > result.Uploads.P99 || result.Uploads.P99 > result.Uploads.Max {
+		t.Fatalf("The upload latency percentiles are out of order: %+v", result.Uploads)
+	}
+	if result.BytesDownloaded != 6*(freezertest.DefaultChunkSize*2+42) {
+		t.Fatalf("Expected all of the synthetic data to be downloaded but got %d bytes.", result.BytesDownloaded)
+	}
+
+	// the clients clean up after themselves
+	files, err := cmdState.GetAllFileHashes()
+	if err != nil {
+		t.Fatalf("Failed to get the files after the benchmark: %v", err)
+	}
+	for _, fi := range files {
+		if !fi.IsDir {
+			t.Fatalf("Expected the benchmark files to be removed but found file id %d.", fi.FileID)
+		}
+	}
+}
+
+func TestRenameFiles(t *testing.T) {
+	srv := freezertest.NewServer(t)
+	defer srv.Close()
+	cmdState := srv.NewUser(t, "renamer", "1234", *flagCryptoPass)
+
+	localPath := srv.Dir + "/rename.dat"
+	err := ioutil.WriteFile(localPath, []byte("rename me"), 0644)
+	if err != nil {
+		t.Fatalf("Failed to write the test file: %v", err)
+	}
+	for _, remote := range []string{"photos/2016/a.jpg", "photos/2016/b.jpg", "photos/2017/c.jpg", "keep.txt"} {
+		_, _, err = cmdState.SyncFile(localPath, remote, command.SyncCurrentVersion)
+		if err != nil {
+			t.Fatalf("Failed to upload %s: %v", remote, err)
+		}
+	}
+
+	// renames that would clobber another file are refused
+	_, err = cmdState.PlanRxRenames("^photos/2016/a.jpg$", "keep.txt", command.MatchOptions{})
+	if err == nil {
+		t.Fatal("Expected a rename onto an existing file to fail.")
+	}
+	_, err = cmdState.PlanRxRenames("^photos/2016/.*$", "photos/one.jpg", command.MatchOptions{})
+	if err == nil {
+		t.Fatal("Expected renaming two files to the same name to fail.")
+	}
+
+	// anchored patterns have to match the whole path and case can be ignored
+	renames, err := cmdState.PlanRxRenames("photos/2016", "x", command.MatchOptions{Anchored: true})
+	if err != nil || len(renames) != 0 {
+		t.Fatalf("Expected an anchored pattern to only match whole paths: %+v (%v)", renames, err)
+	}
+	renames, err = cmdState.PlanRxRenames("PHOTOS/2017/.*", "c.jpg", command.MatchOptions{Anchored: true, IgnoreCase: true})
+	if err != nil || len(renames) != 1 || renames[0].To != "c.jpg" {
+		t.Fatalf("Expected a case-insensitive pattern to match one file: %+v (%v)", renames, err)
+	}
+	_, err = cmdState.PlanRxRenames("photos", "x", command.MatchOptions{Invert: true})
+	if err == nil {
+		t.Fatal("Expected an inverted pattern to be refused for renames.")
+	}
+
+	renames, err = cmdState.PlanRxRenames(`^photos/(\d+)/`, "archive/$1/", command.MatchOptions{})
+	if err != nil {
+		t.Fatalf("Failed to plan the renames: %v", err)
+	}
+	if len(renames) != 3 || renames[0].From != "photos/2016/a.jpg" || renames[0].To != "archive/2016/a.jpg" {
+		t.Fatalf("Unexpected renames were planned: %+v", renames)
+	}
+	err = cmdState.RenameFiles(renames)
+	if err != nil {
+		t.Fatalf("Failed to rename the files: %v", err)
+	}
+
+	// the file keeps its versions under the new name
+	_, err = cmdState.GetFileInfoByFilename("photos/2017/c.jpg")
+	if err == nil {
+		t.Fatal("Expected the old file name to be gone after the rename.")
+	}
+	versions, err := cmdState.GetFileVersions("archive/2017/c.jpg")
+	if err != nil || len(versions) != 1 {
+		t.Fatalf("Expected the renamed file to have its version but got %d: %v", len(versions), err)
+	}
+}
+
+func TestFileTree(t *testing.T) {
+	srv := freezertest.NewMemoryServer(t)
+	defer srv.Close()
+	cmdState := srv.NewUser(t, "tree", "1234", *flagCryptoPass)
+
+	localPath := srv.Dir + "/tree.dat"
+	err := ioutil.WriteFile(localPath, []byte("0123456789"), 0644)
+	if err != nil {
+		t.Fatalf("Failed to write the test file: %v", err)
+	}
+	for _, remote := range []string{"docs/a.txt", "docs/old/b.txt", "top.txt"} {
+		_, _, err = cmdState.SyncFile(localPath, remote, command.SyncCurrentVersion)
+		if err != nil {
+			t.Fatalf("Failed to upload %s: %v", remote, err)
+		}
+	}
+
+	tree, err := cmdState.GetTree("")
+	if err != nil {
+		t.Fatalf("Failed to get the file tree: %v", err)
+	}
+	if tree.Files != 3 || len(tree.Children) != 2 || tree.Children[0].Name != "docs" || tree.Children[1].Name != "top.txt" {
+		t.Fatalf("Unexpected root of the file tree: %+v", tree)
+	}
+	docs := tree.Children[0]
+	if !docs.IsDir || docs.Files != 2 || docs.Size != 2*tree.Children[1].Size {
+		t.Fatalf("Expected docs to total up both of its files: %+v", docs)
+	}
+
+	tree, err = cmdState.GetTree("docs/old")
+	if err != nil || tree.Files != 1 || len(tree.Children) != 1 || tree.Children[0].Name != "b.txt" {
+		t.Fatalf("Unexpected tree for a prefix: %+v (%v)", tree, err)
+	}
+	var out bytes.Buffer
+	tree.WriteTree(&out)
+	if !strings.Contains(out.String(), "└── b.txt") {
+		t.Fatalf("Unexpected rendering of the tree:\n%s", out.String())
+	}
+
+	_, err = cmdState.GetTree("missing")
+	if err == nil {
+		t.Fatal("Expected a prefix without files to fail.")
+	}
+}
+
+func TestManifest(t *testing.T) {
+	srv := freezertest.NewMemoryServer(t)
+	defer srv.Close()
+	cmdState := srv.NewUser(t, "manifest", "1234", *flagCryptoPass)
+
+	// upload a small tree that also gets restored locally
+	localDir := srv.Dir + "/local"
+	contents := map[string]string{
+		"a.txt":     "hello",
+		"sub/b.txt": strings.Repeat("filefreezer", freezertest.DefaultChunkSize/8),
+	}
+	for rel, data := range contents {
+		localPath := localDir + "/" + rel
+		os.MkdirAll(localPath[:strings.LastIndex(localPath, "/")], 0755)
+		err := ioutil.WriteFile(localPath, []byte(data), 0644)
+		if err != nil {
+			t.Fatalf("Failed to write the test file: %v", err)
+		}
+		_, _, err = cmdState.SyncFile(localPath, "backup/"+rel, command.SyncCurrentVersion)
+		if err != nil {
+			t.Fatalf("Failed to upload %s: %v", rel, err)
+		}
+	}
+
+	entries, err := cmdState.BuildManifest("backup")
+	if err != nil {
+		t.Fatalf("Failed to build the manifest: %v", err)
+	}
+	var manifest bytes.Buffer
+	command.WriteManifest(&manifest, entries)
+	expected := "2cf24dba5fb0a30e26e83b2ac5b9e29e1b161e5c1fa7425e73043362938b9824  a.txt\n"
+	if len(entries) != 2 || !strings.HasPrefix(manifest.String(), expected) || entries[1].Path != "sub/b.txt" {
+		t.Fatalf("Unexpected manifest:\n%s", manifest.String())
+	}
+
+	failed, err := command.VerifyManifest(entries, localDir)
+	if err != nil || len(failed) != 0 {
+		t.Fatalf("Expected the local tree to match the manifest: %v (%v)", failed, err)
+	}
+
+	// changed and missing files are both reported
+	ioutil.WriteFile(localDir+"/a.txt", []byte("changed"), 0644)
+	os.Remove(localDir + "/sub/b.txt")
+	failed, err = command.VerifyManifest(entries, localDir)
+	if err != nil || len(failed) != 2 || failed[0] != "a.txt: FAILED" || failed[1] != "sub/b.txt: MISSING" {
+		t.Fatalf("Expected a failed and a missing file: %v (%v)", failed, err)
+	}
+}
+
+func TestTransforms(t *testing.T) {
+	srv := freezertest.NewMemoryServer(t)
+	defer srv.Close()
+	cmdState := srv.NewUser(t, "transform", "1234", *flagCryptoPass)
+
+	upper, err := command.ParseTransform(`\.txt$=tr a-z A-Z|tr A-Z a-z`)
+	if err != nil || upper.Upload != "tr a-z A-Z" || upper.Download != "tr A-Z a-z" {
+		t.Fatalf("Failed to parse a transform: %+v (%v)", upper, err)
+	}
+	redact, err := command.ParseTransform(`\.log$=sed s/secret/XXXXXX/`)
+	if err != nil || redact.Download != "" {
+		t.Fatalf("Failed to parse a one-way transform: %+v (%v)", redact, err)
+	}
+	_, err = command.ParseTransform("no commands")
+	if err == nil {
+		t.Fatal("Expected a transform without commands to be rejected.")
+	}
+	cmdState.Transforms = []command.Transform{upper, redact}
+
+	// the server gets the transformed data and a download reverses it
+	localPath := srv.Dir + "/hello.txt"
+	ioutil.WriteFile(localPath, []byte("hello"), 0644)
+	_, _, err = cmdState.SyncFile(localPath, "hello.txt", command.SyncCurrentVersion)
+	if err != nil {
+		t.Fatalf("Failed to sync a transformed file: %v", err)
+	}
+	var stored bytes.Buffer
+	_, err = cmdState.DownloadStream(&stored, "hello.txt")
+	if err != nil || stored.String() != "HELLO" {
+		t.Fatalf("Expected the server to store the transformed data but got %q (%v).", stored.String(), err)
+	}
+	status, _, err := cmdState.SyncFile(localPath, "hello.txt", command.SyncCurrentVersion)
+	if err != nil || status != command.SyncStatusSame {
+		t.Fatalf("Expected an unchanged file to stay the same after the transform (status %d): %v", status, err)
+	}
+	restoredPath := srv.Dir + "/restored.txt"
+	_, _, err = cmdState.SyncFile(restoredPath, "hello.txt", command.SyncCurrentVersion)
+	restored, _ := ioutil.ReadFile(restoredPath)
+	if err != nil || string(restored) != "hello" {
+		t.Fatalf("Expected the download to be transformed back but got %q (%v).", restored, err)
+	}
+
+	// one-way transforms can upload but not download
+	logPath := srv.Dir + "/app.log"
+	ioutil.WriteFile(logPath, []byte("the secret is out"), 0644)
+	_, _, err = cmdState.SyncFile(logPath, "app.log", command.SyncCurrentVersion)
+	if err != nil {
+		t.Fatalf("Failed to sync a redacted file: %v", err)
+	}
+	stored.Reset()
+	cmdState.DownloadStream(&stored, "app.log")
+	if stored.String() != "the XXXXXX is out" {
+		t.Fatalf("Expected the server to store the redacted data but got %q.", stored.String())
+	}
+	_, _, err = cmdState.SyncFile(srv.Dir+"/other.log", "app.log", command.SyncCurrentVersion)
+	if err == nil {
+		t.Fatal("Expected a download through a one-way transform to fail.")
+	}
+}
+
+func TestResticBridge(t *testing.T) {
+	cmdState := command.NewState()
+
+	// recreate a test user
+	username := "admin"
+	password := "1234"
+	user, err := state.Storage.GetUser(username)
+	if user != nil {
+		cmdState.RmUser(state.Storage, username)
+	}
+	user, err = cmdState.AddUser(state.Storage, username, password, int(1e9))
+	if user == nil || err != nil {
+		t.Fatalf("Failed to add the test user (%s) to Storage", username)
+	}
+	err = cmdState.Authenticate(testHost, username, password)
+	if err != nil {
+		t.Fatalf("Failed to authenticate as the test user: %v", err)
+	}
+	err = cmdState.SetCryptoHashForPassword(*flagCryptoPass)
+	if err != nil {
+		t.Fatalf("Failed to set the crypto password for the test user: %v", err)
+	}
+	cmdState.CryptoKey, err = filefreezer.VerifyCryptoPassword(*flagCryptoPass, string(cmdState.CryptoHash))
+	if err != nil {
+		t.Fatalf("Failed to set the crypto key for the test user: %v", err)
+	}
+
+	bridge := command.NewBridge(cmdState, username, password)
+	ts := httptest.NewServer(bridge.ResticHandler("restictest"))
+	defer ts.Close()
+
+	// save an object spanning more than one chunk
+	blob := genRandomBytes(int(*flagServeChunkSize) + 100)
+	resp, err := http.Post(ts.URL+"/data/abcdef", "application/octet-stream", bytes.NewReader(blob))
+	if err != nil || resp.StatusCode != http.StatusOK {
+		t.Fatalf("Failed to save an object through the restic bridge: %v", err)
+	}
+	resp.Body.Close()
+
+	// the object should be listed
+	resp, err = http.Get(ts.URL + "/data/")
+	if err != nil {
+		t.Fatalf("Failed to list the objects through the restic bridge: %v", err)
+	}
+	var names []string
+	err = json.NewDecoder(resp.Body).Decode(&names)
+	resp.Body.Close()
+	if err != nil || len(names) != 1 || names[0] != "abcdef" {
+		t.Fatalf("Expected the restic bridge to list the saved object but got %v (%v).", names, err)
+	}
+
+	// read back a range that crosses the chunk boundary
+	req, _ := http.NewRequest("GET", ts.URL+"/data/abcdef", nil)
+	offset := int(*flagServeChunkSize) - 10
+	req.Header.Set("Range", fmt.Sprintf("bytes=%d-%d", offset, offset+49))
+	resp, err = http.DefaultClient.Do(req)
+	if err != nil || resp.StatusCode != http.StatusPartialContent {
+		t.Fatalf("Failed to load a range of the object through the restic bridge: %v", err)
+	}
+	rangeBytes, err := ioutil.ReadAll(resp.Body)
+	resp.Body.Close()
+	if err != nil || !bytes.Equal(rangeBytes, blob[offset:offset+50]) {
+		t.Fatal("The range loaded through the restic bridge did not match the saved object.")
+	}
+
+	// remove the object
+	req, _ = http.NewRequest("DELETE", ts.URL+"/data/abcdef", nil)
+	resp, err = http.DefaultClient.Do(req)
+	if err != nil || resp.StatusCode != http.StatusOK {
+		t.Fatalf("Failed to delete the object through the restic bridge: %v", err)
+	}
+	resp.Body.Close()
+}
+
+func TestHTTPBridge(t *testing.T) {
+	srv := freezertest.NewServer(t)
+	defer srv.Close()
+	cmdState := srv.NewUser(t, "bridger", "1234", *flagCryptoPass)
+	bridge := command.NewBridge(cmdState, "bridger", "1234")
+
+	serve := func(method string, target string, body []byte) *httptest.ResponseRecorder {
+		rec := httptest.NewRecorder()
+		bridge.ServeHTTP(rec, httptest.NewRequest(method, target, bytes.NewReader(body)))
+		return rec
+	}
+
+	// uploads are read back with GET and HEAD
+	data := genRandomBytes(freezertest.DefaultChunkSize + 100)
+	if rec := serve("PUT", "/docs/report.txt", data); rec.Code != http.StatusCreated {
+		t.Fatalf("Failed to upload through the bridge (%d): %s", rec.Code, rec.Body.String())
+	}
+	if rec := serve("GET", "/docs/report.txt", nil); rec.Code != http.StatusOK || !bytes.Equal(rec.Body.Bytes(), data) {
+		t.Fatalf("Expected the uploaded file back from the bridge but got status %d.", rec.Code)
+	}
+	if rec := serve("HEAD", "/docs/report.txt", nil); rec.Code != http.StatusOK || rec.Body.Len() != 0 || rec.Header().Get("Last-Modified") == "" {
+		t.Fatalf("Expected the headers of the file without its data but got status %d.", rec.Code)
+	}
+
+	// dot segments are resolved instead of ending up in the remote name
+	if rec := serve("PUT", "/docs/../notes.txt", []byte("notes")); rec.Code != http.StatusCreated {
+		t.Fatalf("Failed to upload a path with dot segments (%d): %s", rec.Code, rec.Body.String())
+	}
+	if _, err := cmdState.GetFileInfoByFilename("notes.txt"); err != nil {
+		t.Fatalf("Expected the upload to be stored as notes.txt: %v", err)
+	}
+	if rec := serve("PUT", "/docs/", []byte("notes")); rec.Code != http.StatusBadRequest {
+		t.Fatalf("Expected an upload to a directory path to be refused but got status %d.", rec.Code)
+	}
+	if rec := serve("PUT", "/..", []byte("notes")); rec.Code != http.StatusBadRequest {
+		t.Fatalf("Expected an upload to the root to be refused but got status %d.", rec.Code)
+	}
+
+	// directories are listed with links to their children
+	rec := serve("GET", "/", nil)
+	if rec.Code != http.StatusOK || !strings.Contains(rec.Body.String(), `<a href="/docs/">docs/</a>`) ||
+		!strings.Contains(rec.Body.String(), `<a href="/notes.txt">notes.txt</a>`) {
+		t.Fatalf("Expected the root listing to link the directory and the file:\n%s", rec.Body.String())
+	}
+	rec = serve("GET", "/docs/", nil)
+	if rec.Code != http.StatusOK || !strings.Contains(rec.Body.String(), `<a href="/docs/report.txt">report.txt</a>`) ||
+		strings.Contains(rec.Body.String(), "notes.txt") {
+		t.Fatalf("Expected the directory listing to only link its own file:\n%s", rec.Body.String())
+	}
+	if rec = serve("GET", "/docs", nil); rec.Code != http.StatusMovedPermanently || rec.Header().Get("Location") != "/docs/" {
+		t.Fatalf("Expected a directory without a trailing slash to be redirected but got status %d.", rec.Code)
+	}
+	if rec = serve("GET", "/docs/report.txt/", nil); rec.Code != http.StatusMovedPermanently || rec.Header().Get("Location") != "/docs/report.txt" {
+		t.Fatalf("Expected a file with a trailing slash to be redirected but got status %d.", rec.Code)
+	}
+	if rec = serve("GET", "/missing/", nil); rec.Code != http.StatusNotFound {
+		t.Fatalf("Expected a missing path to be not found but got status %d.", rec.Code)
+	}
+	if rec = serve("DELETE", "/notes.txt", nil); rec.Code != http.StatusMethodNotAllowed {
+		t.Fatalf("Expected DELETE to be refused but got status %d.", rec.Code)
+	}
+
+	// addresses without a host only listen on the loopback interface
+	for addr, expected := range map[string]string{
+		":8081":          "127.0.0.1:8081",
+		"localhost:8081": "localhost:8081",
+		"0.0.0.0:8081":   "0.0.0.0:8081",
+	} {
+		if listenAddr := command.LocalListenAddr(addr); listenAddr != expected {
+			t.Fatalf("Expected %s to listen on %s but got %s.", addr, expected, listenAddr)
+		}
+	}
+}
+
+func TestSFTPBridge(t *testing.T) {
+	srv := freezertest.NewServer(t)
+	defer srv.Close()
+	cmdState := srv.NewUser(t, "sftper", "1234", *flagCryptoPass)
+	bridge := command.NewBridge(cmdState, "sftper", "1234")
+
+	_, key, err := ed25519.GenerateKey(nil)
+	if err != nil {
+		t.Fatalf("Failed to generate the host key: %v", err)
+	}
+	hostKey, err := ssh.NewSignerFromKey(key)
+	if err != nil {
+		t.Fatalf("Failed to create the host key signer: %v", err)
+	}
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Failed to listen for SFTP: %v", err)
+	}
+	go bridge.ServeSFTPListener(listener, hostKey)
+	defer listener.Close()
+
+	// the bridge only accepts the user's own password
+	dial := func(password string) (*ssh.Client, error) {
+		return ssh.Dial("tcp", listener.Addr().String(), &ssh.ClientConfig{
+			User:            "sftper",
+			Auth:            []ssh.AuthMethod{ssh.Password(password)},
+			HostKeyCallback: ssh.InsecureIgnoreHostKey(),
+		})
+	}
+	if _, err = dial("wrong"); err == nil {
+		t.Fatal("Expected the SFTP bridge to refuse the wrong password.")
+	}
+	sshClient, err := dial("1234")
+	if err != nil {
+		t.Fatalf("Failed to connect to the SFTP bridge: %v", err)
+	}
+	defer sshClient.Close()
+	client, err := sftp.NewClient(sshClient)
+	if err != nil {
+		t.Fatalf("Failed to start the SFTP session: %v", err)
+	}
+	defer client.Close()
+
+	// files written over SFTP are uploaded when they're closed
+	data := genRandomBytes(freezertest.DefaultChunkSize + 100)
+	f, err := client.Create("/backups/db.dump")
+	if err != nil {
+		t.Fatalf("Failed to create a file over SFTP: %v", err)
+	}
+	if _, err = f.Write(data); err != nil {
+		t.Fatalf("Failed to write the file over SFTP: %v", err)
+	}
+	if err = f.Close(); err != nil {
+		t.Fatalf("Failed to upload the file over SFTP: %v", err)
+	}
+	if _, err = cmdState.GetFileInfoByFilename("backups/db.dump"); err != nil {
+		t.Fatalf("Expected the file to be stored on the server: %v", err)
+	}
+
+	// and read back, listed and stat'd
+	f, err = client.Open("/backups/db.dump")
+	if err != nil {
+		t.Fatalf("Failed to open the file over SFTP: %v", err)
+	}
+	read, err := ioutil.ReadAll(f)
+	f.Close()
+	if err != nil || !bytes.Equal(read, data) {
+		t.Fatalf("Expected the uploaded data back over SFTP: %v", err)
+	}
+	infos, err := client.ReadDir("/")
+	if err != nil || len(infos) != 1 || infos[0].Name() != "backups" || !infos[0].IsDir() {
+		t.Fatalf("Expected the root to list the implied backups directory (%v): %v", infos, err)
+	}
+	info, err := client.Stat("/backups/db.dump")
+	if err != nil || info.IsDir() || info.Name() != "db.dump" {
+		t.Fatalf("Expected to stat the uploaded file (%v): %v", info, err)
+	}
+	if _, err = client.Stat("/missing"); err == nil {
+		t.Fatal("Expected stat on a missing file to fail.")
+	}
+	if err = client.Rename("/backups/db.dump", "/db.dump"); err == nil {
+		t.Fatal("Expected renames to be unsupported by the SFTP bridge.")
+	}
+
+	// removing the file removes it from the server
+	if err = client.Remove("/backups/db.dump"); err != nil {
+		t.Fatalf("Failed to remove the file over SFTP: %v", err)
+	}
+	if _, err = cmdState.GetFileInfoByFilename("backups/db.dump"); !errors.Is(err, command.ErrFileNotFound) {
+		t.Fatalf("Expected the file to be removed from the server: %v", err)
+	}
+}
+
+func TestLFSTransfer(t *testing.T) {
+	srv := freezertest.NewServer(t)
+	defer srv.Close()
+	cmdState := srv.NewUser(t, "lfser", "1234", *flagCryptoPass)
+	bridge := command.NewBridge(cmdState, "lfser", "1234")
+
+	object := genRandomBytes(freezertest.DefaultChunkSize + 100)
+	objectPath := filepath.Join(srv.Dir, "object")
+	ioutil.WriteFile(objectPath, object, 0644)
+
+	requests := strings.Join([]string{
+		`{"event":"init","operation":"upload","remote":"origin","concurrent":false}`,
+		fmt.Sprintf(`{"event":"upload","oid":"abc123","size":%d,"path":%q}`, len(object), objectPath),
+		`{"event":"download","oid":"abc123","size":0}`,
+		`{"event":"download","oid":"missing","size":0}`,
+		`{"event":"terminate"}`,
+		`{"event":"download","oid":"abc123","size":0}`,
+	}, "\n")
+	var responses bytes.Buffer
+	err := bridge.ServeLFSTransfer(strings.NewReader(requests), &responses, "/objects/")
+	if err != nil {
+		t.Fatalf("Failed to serve the git-lfs transfer: %v", err)
+	}
+
+	// one response for the init and each transfer, and none after terminate
+	type lfsResponse struct {
+		Event string
+		Oid   string
+		Path  string
+		Error *struct {
+			Code    int
+			Message string
+		}
+	}
+	var got []lfsResponse
+	decoder := json.NewDecoder(&responses)
+	for decoder.More() {
+		var resp lfsResponse
+		if err = decoder.Decode(&resp); err != nil {
+			t.Fatalf("Failed to parse the git-lfs response: %v", err)
+		}
+		got = append(got, resp)
+	}
+	if len(got) != 4 || got[0].Event != "" {
+		t.Fatalf("Expected an empty init response and three transfers but got %+v.", got)
+	}
+
+	// the object is stored under the prefix and downloads to a temporary file
+	if got[1].Event != "complete" || got[1].Oid != "abc123" || got[1].Error != nil {
+		t.Fatalf("Expected the upload to complete: %+v", got[1])
+	}
+	if _, err = cmdState.GetFileInfoByFilename("objects/abc123"); err != nil {
+		t.Fatalf("Expected the object to be stored under the prefix: %v", err)
+	}
+	downloaded, err := ioutil.ReadFile(got[2].Path)
+	os.Remove(got[2].Path)
+	if got[2].Error != nil || err != nil || !bytes.Equal(downloaded, object) {
+		t.Fatalf("Expected the download to complete with the object (%+v): %v", got[2], err)
+	}
+	if got[3].Error == nil || got[3].Error.Code != 2 || got[3].Path != "" {
+		t.Fatalf("Expected the download of a missing object to fail: %+v", got[3])
+	}
+
+	if err = bridge.ServeLFSTransfer(strings.NewReader("not json\n"), &responses, "objects"); err == nil {
+		t.Fatal("Expected a malformed request to fail.")
+	}
+}
+
+// fakeDocker is a stand-in for `docker run --rm -v volume:/volume -v dir:/backup
+// alpine tar ...` that runs tar on the host with the mounts mapped to local
+// directories, keeping the volumes under $FREEZER_TEST_VOLUMES.
+const fakeDocker = `#!/bin/sh
+volume="$FREEZER_TEST_VOLUMES/$(echo "$4" | cut -d: -f1)"
+backup="$(echo "$6" | cut -d: -f1)"
+shift 8
+mkdir -p "$volume"
+for arg in "$@"; do
+	case "$arg" in
+	/volume*) arg="$volume${arg#/volume}" ;;
+	/backup*) arg="$backup${arg#/backup}" ;;
+	esac
+	set -- "$@" "$arg"
+	shift
+done
+exec tar "$@"
+`
+
+func TestDockerVolumes(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("The fake docker command is a shell script.")
+	}
+	if _, err := exec.LookPath("tar"); err != nil {
+		t.Skip("tar isn't installed")
+	}
+	srv := freezertest.NewServer(t)
+	defer srv.Close()
+	cmdState := srv.NewUser(t, "docker", "1234", *flagCryptoPass)
+
+	binDir := filepath.Join(srv.Dir, "bin")
+	os.MkdirAll(binDir, 0755)
+	ioutil.WriteFile(filepath.Join(binDir, "docker"), []byte(fakeDocker), 0755)
+	oldPath := os.Getenv("PATH")
+	os.Setenv("PATH", binDir+string(os.PathListSeparator)+oldPath)
+	defer os.Setenv("PATH", oldPath)
+	volumesDir := filepath.Join(srv.Dir, "volumes")
+	os.Setenv("FREEZER_TEST_VOLUMES", volumesDir)
+	defer os.Unsetenv("FREEZER_TEST_VOLUMES")
+
+	volumeDir := filepath.Join(volumesDir, "pgdata")
+	os.MkdirAll(filepath.Join(volumeDir, "base"), 0755)
+	config, table := genRandomBytes(100), genRandomBytes(freezertest.DefaultChunkSize+100)
+	ioutil.WriteFile(filepath.Join(volumeDir, "postgresql.conf"), config, 0644)
+	ioutil.WriteFile(filepath.Join(volumeDir, "base", "table"), table, 0644)
+
+	remoteFilepath, err := cmdState.DockerBackup("pgdata", "/docker/")
+	if err != nil {
+		t.Fatalf("Failed to back up the volume: %v", err)
+	}
+	if !strings.HasPrefix(remoteFilepath, "docker/pgdata/pgdata-") || !strings.HasSuffix(remoteFilepath, ".tar.gz") {
+		t.Fatalf("Expected a dated archive for the volume but got %s.", remoteFilepath)
+	}
+
+	// restoring overwrites the archived files and leaves the others in place
+	ioutil.WriteFile(filepath.Join(volumeDir, "postgresql.conf"), []byte("changed"), 0644)
+	os.RemoveAll(filepath.Join(volumeDir, "base"))
+	ioutil.WriteFile(filepath.Join(volumeDir, "extra"), []byte("extra"), 0644)
+	if err = cmdState.DockerRestore("pgdata", "docker", ""); err != nil {
+		t.Fatalf("Failed to restore the latest archive of the volume: %v", err)
+	}
+	for name, data := range map[string][]byte{"postgresql.conf": config, "base/table": table, "extra": []byte("extra")} {
+		restored, err := ioutil.ReadFile(filepath.Join(volumeDir, name))
+		if err != nil || !bytes.Equal(restored, data) {
+			t.Fatalf("Expected %s to hold its data after the restore: %v", name, err)
+		}
+	}
+
+	// an archive can be picked by name and volumes without archives fail
+	if err = cmdState.DockerRestore("restored", "docker", remoteFilepath); err != nil {
+		t.Fatalf("Failed to restore the archive into another volume: %v", err)
+	}
+	if restored, _ := ioutil.ReadFile(filepath.Join(volumesDir, "restored", "base", "table")); !bytes.Equal(restored, table) {
+		t.Fatal("Expected the archive to be restored into the other volume.")
+	}
+	if err = cmdState.DockerRestore("redis", "docker", ""); err == nil {
+		t.Fatal("Expected restoring a volume without archives to fail.")
+	}
+	if err = cmdState.DockerRestore("pgdata", "docker", "docker/pgdata/missing.tar.gz"); err == nil {
+		t.Fatal("Expected restoring a missing archive to fail.")
+	}
+}
+
+func TestPublicShares(t *testing.T) {
+	cmdState := command.NewState()
+
+	// recreate a test user
+	username := "admin"
+	password := "1234"
+	user, err := state.Storage.GetUser(username)
+	if user != nil {
+		cmdState.RmUser(state.Storage, username)
+	}
+	user, err = cmdState.AddUser(state.Storage, username, password, int(1e9))
+	if user == nil || err != nil {
+		t.Fatalf("Failed to add the test user (%s) to Storage", username)
+	}
+	err = cmdState.Authenticate(testHost, username, password)
+	if err != nil {
+		t.Fatalf("Failed to authenticate as the test user: %v", err)
+	}
+	err = cmdState.SetCryptoHashForPassword(*flagCryptoPass)
+	if err != nil {
+		t.Fatalf("Failed to set the crypto password for the test user: %v", err)
+	}
+	cmdState.CryptoKey, err = filefreezer.VerifyCryptoPassword(*flagCryptoPass, string(cmdState.CryptoHash))
+	if err != nil {
+		t.Fatalf("Failed to set the crypto key for the test user: %v", err)
+	}
+
+	// upload a file and then share it
+	_, _, err = cmdState.SyncFile(testFilename2, "private/"+testFilename2, command.SyncCurrentVersion)
+	if err != nil {
+		t.Fatalf("Failed to sync the file to share: %v", err)
+	}
+	shares, err := cmdState.ShareFiles("private/"+testFilename2, "pub/data.dat", command.ShareOptions{})
+	if err != nil || len(shares) != 1 || shares[0].Name != "pub/data.dat" {
+		t.Fatalf("Failed to share the file: %v", err)
+	}
+
+	// the public copy should be readable without authentication
+	resp, err := http.Get(testHost + "/public/" + username + "/pub/data.dat")
+	if err != nil || resp.StatusCode != http.StatusOK {
+		t.Fatalf("Failed to download the shared file anonymously: %v", err)
+	}
+	if resp.Header.Get("Content-Type") != "application/octet-stream" {
+		t.Fatalf("Expected the random shared data to be detected as binary but got %s.", resp.Header.Get("Content-Type"))
+	}
+	sharedBytes, err := ioutil.ReadAll(resp.Body)
+	resp.Body.Close()
+	originalBytes, _ := ioutil.ReadFile(testFilename2)
+	if err != nil || !bytes.Equal(sharedBytes, originalBytes) {
+		t.Fatal("The shared file downloaded anonymously did not match the original file.")
+	}
+
+	// a range crossing the chunk boundary can be requested to resume a download
+	offset := int(*flagServeChunkSize) - 10
+	req, _ := http.NewRequest("GET", testHost+"/public/"+username+"/pub/data.dat", nil)
+	req.Header.Set("Range", fmt.Sprintf("bytes=%d-", offset))
+	resp, err = http.DefaultClient.Do(req)
+	if err != nil || resp.StatusCode != http.StatusPartialContent {
+		t.Fatalf("Failed to download a range of the shared file: %v", err)
+	}
+	rangeBytes, err := ioutil.ReadAll(resp.Body)
+	resp.Body.Close()
+	if err != nil || !bytes.Equal(rangeBytes, originalBytes[offset:]) {
+		t.Fatal("The range of the shared file did not match the original file.")
+	}
+
+	// a declared content type is used when the file is served
+	_, err = cmdState.ShareFiles("private/"+testFilename2, "pub/data.txt", command.ShareOptions{ContentType: "text/plain; charset=utf-8"})
+	if err != nil {
+		t.Fatalf("Failed to share the file with a content type: %v", err)
+	}
+	resp, err = http.Get(testHost + "/public/" + username + "/pub/data.txt")
+	if err != nil || resp.StatusCode != http.StatusOK || resp.Header.Get("Content-Type") != "text/plain; charset=utf-8" {
+		t.Fatalf("Expected the shared file to be served with the declared content type: %v", err)
+	}
+	resp.Body.Close()
+	err = cmdState.RmShare("pub/data.txt")
+	if err != nil {
+		t.Fatalf("Failed to remove the share: %v", err)
+	}
+
+	// password protected shares with a download limit
+	_, err = cmdState.ShareFiles("private/"+testFilename2, "locked/data.dat", command.ShareOptions{Password: "sesame", MaxDownloads: 1})
+	if err != nil {
+		t.Fatalf("Failed to share the file with a password: %v", err)
+	}
+	lockedURL := testHost + "/public/" + username + "/locked/data.dat"
+	resp, err = http.Get(lockedURL)
+	if err != nil || resp.StatusCode != http.StatusUnauthorized {
+		t.Fatalf("Expected the password protected share to require a password: %v", err)
+	}
+	resp.Body.Close()
+	for i, expected := range []int{http.StatusOK, http.StatusGone} {
+		req, _ = http.NewRequest("GET", lockedURL, nil)
+		req.SetBasicAuth("", "sesame")
+		resp, err = http.DefaultClient.Do(req)
+		if err != nil || resp.StatusCode != expected {
+			t.Fatalf("Expected status %d for download #%d of the limited share: %v", expected, i+1, err)
+		}
+		resp.Body.Close()
+	}
+
+	// a range that doesn't start at the beginning can't get past the limit either
+	req, _ = http.NewRequest("GET", lockedURL, nil)
+	req.SetBasicAuth("", "sesame")
+	req.Header.Set("Range", "bytes=1-")
+	resp, err = http.DefaultClient.Do(req)
+	if err != nil || resp.StatusCode != http.StatusGone {
+		t.Fatalf("Expected a ranged download of the limited share to be refused after the limit: %v", err)
+	}
+	resp.Body.Close()
+	err = cmdState.RmShare("locked/data.dat")
+	if err != nil {
+		t.Fatalf("Failed to remove the share: %v", err)
+	}
+
+	// the prefix listing should include the shared file
+	resp, err = http.Get(testHost + "/public/" + username + "/pub/")
+	if err != nil || resp.StatusCode != http.StatusOK {
+		t.Fatalf("Failed to list the shared files anonymously: %v", err)
+	}
+	var listing models.PublicShareListResponse
+	err = json.NewDecoder(resp.Body).Decode(&listing)
+	resp.Body.Close()
+	if err != nil || len(listing.Files) != 1 || listing.Files[0].Name != "pub/data.dat" {
+		t.Fatalf("Expected the public listing to include the shared file but got %v (%v).", listing.Files, err)
+	}
+	if listing.Files[0].Size != int64(len(originalBytes)) {
+		t.Fatalf("Expected the public listing to report a size of %d but got %d.", len(originalBytes), listing.Files[0].Size)
+	}
+
+	// browsers should get an HTML page with links to the files
+	req, _ = http.NewRequest("GET", testHost+"/public/"+username+"/pub/", nil)
+	req.Header.Set("Accept", "text/html,application/xhtml+xml")
+	resp, err = http.DefaultClient.Do(req)
+	if err != nil || resp.StatusCode != http.StatusOK {
+		t.Fatalf("Failed to get the HTML listing of the shared files: %v", err)
+	}
+	page, err := ioutil.ReadAll(resp.Body)
+	resp.Body.Close()
+	if err != nil || !strings.HasPrefix(resp.Header.Get("Content-Type"), "text/html") ||
+		!strings.Contains(string(page), `href="/public/`+username+`/pub/data.dat"`) {
+		t.Fatalf("Expected an HTML listing linking to the shared file but got %s (%v).", page, err)
+	}
+
+	// after removing the share it should no longer be available
+	err = cmdState.RmShare("pub/data.dat")
+	if err != nil {
+		t.Fatalf("Failed to remove the share: %v", err)
+	}
+	resp, err = http.Get(testHost + "/public/" + username + "/pub/data.dat")
+	if err != nil || resp.StatusCode != http.StatusNotFound {
+		t.Fatalf("Expected the removed share to be not found: %v", err)
+	}
+	resp.Body.Close()
+}
+
+func TestQRCodes(t *testing.T) {
+	cmdState := command.NewState()
+	var printed bytes.Buffer
+	cmdState.Printf = func(format string, v ...interface{}) {
+		fmt.Fprintf(&printed, format, v...)
+	}
+
+	// each line draws two rows of the code with the light modules filled in
+	shareURL := "https://freezer.example.com/public/alice/photos/"
+	err := cmdState.PrintQRCode(shareURL)
+	if err != nil {
+		t.Fatalf("Failed to print the QR code: %v", err)
+	}
+	qr, err := qrcode.New(shareURL, qrcode.Medium)
+	if err != nil {
+		t.Fatalf("Failed to generate the expected QR code: %v", err)
+	}
+	bitmap := qr.Bitmap()
+	lines := strings.Split(strings.TrimSuffix(printed.String(), "\n"), "\n")
+	if len(lines) != (len(bitmap)+1)/2 {
+		t.Fatalf("Expected %d lines for a %d module code but got %d.", (len(bitmap)+1)/2, len(bitmap), len(lines))
+	}
+	for i, line := range lines {
+		cells := []rune(line)
+		if len(cells) != len(bitmap) {
+			t.Fatalf("Expected line %d to be %d cells wide but it's %d.", i, len(bitmap), len(cells))
+		}
+		for x, cell := range cells {
+			top := !bitmap[2*i][x]
+			bottom := 2*i+1 < len(bitmap) && !bitmap[2*i+1][x]
+			if (cell == '█' || cell == '▀') != top || (cell == '█' || cell == '▄') != bottom {
+				t.Fatalf("The cell at %d,%d doesn't match the code: %q", x, i, cell)
+			}
+		}
+	}
+
+	// the PNG is a square of the full size
+	pngPath := filepath.Join(testDataDir2, "share.png")
+	err = cmdState.WriteQRCodePNG(shareURL, pngPath)
+	if err != nil {
+		t.Fatalf("Failed to write the QR code PNG: %v", err)
+	}
+	defer os.Remove(pngPath)
+	f, err := os.Open(pngPath)
+	if err != nil {
+		t.Fatalf("Failed to open the QR code PNG: %v", err)
+	}
+	defer f.Close()
+	img, err := png.Decode(f)
+	if err != nil {
+		t.Fatalf("Failed to decode the QR code PNG: %v", err)
+	}
+	if bounds := img.Bounds(); bounds.Dx() != 512 || bounds.Dy() != 512 {
+		t.Fatalf("Expected a 512x512 PNG but got %v.", bounds)
+	}
+
+	// content too long for a code and unwritable files fail
+	if err = cmdState.PrintQRCode(strings.Repeat("a", 4000)); err == nil {
+		t.Fatal("Expected printing a QR code of too much content to fail.")
+	}
+	if err = cmdState.WriteQRCodePNG(shareURL, filepath.Join(testDataDir2, "missing", "share.png")); err == nil {
+		t.Fatal("Expected writing a QR code PNG into a missing directory to fail.")
+	}
+}
+
+func TestDropUploads(t *testing.T) {
+	cmdState := command.NewState()
+
+	// recreate a test user
+	username := "admin"
+	password := "1234"
+	user, err := state.Storage.GetUser(username)
+	if user != nil {
+		cmdState.RmUser(state.Storage, username)
+	}
+	user, err = cmdState.AddUser(state.Storage, username, password, int(1e9))
+	if user == nil || err != nil {
+		t.Fatalf("Failed to add the test user (%s) to Storage", username)
+	}
+	err = cmdState.Authenticate(testHost, username, password)
+	if err != nil {
+		t.Fatalf("Failed to authenticate as the test user: %v", err)
+	}
+	err = cmdState.SetCryptoHashForPassword(*flagCryptoPass)
+	if err != nil {
+		t.Fatalf("Failed to set the crypto password for the test user: %v", err)
+	}
+	cmdState.CryptoKey, err = filefreezer.VerifyCryptoPassword(*flagCryptoPass, string(cmdState.CryptoHash))
+	if err != nil {
+		t.Fatalf("Failed to set the crypto key for the test user: %v", err)
+	}
+
+	dt, err := cmdState.CreateDrop("inbox", 1024, 1)
+	if err != nil {
+		t.Fatalf("Failed to create the drop token: %v", err)
+	}
+
+	// drop files are stored in chunks as they're read
+	storage := state.Storage.(*filefreezer.Storage)
+	chunkSize := storage.ChunkSize
+	storage.ChunkSize = 256
+
+	// anonymous uploads over the size limit are rejected
+	dropURL := testHost + "/drop/" + dt.Token + "/"
+	req, _ := http.NewRequest("PUT", dropURL+"big.dat", bytes.NewReader(genRandomBytes(2048)))
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil || resp.StatusCode != http.StatusRequestEntityTooLarge {
+		t.Fatalf("Expected the oversized drop upload to be rejected: %v", err)
+	}
+	resp.Body.Close()
+
+	// the first file is accepted and the second hits the count limit
+	dropped := genRandomBytes(1000)
+	req, _ = http.NewRequest("PUT", dropURL+"report.dat", bytes.NewReader(dropped))
+	resp, err = http.DefaultClient.Do(req)
+	if err != nil || resp.StatusCode != http.StatusOK {
+		t.Fatalf("Failed to upload a file with the drop token: %v", err)
+	}
+	resp.Body.Close()
+	req, _ = http.NewRequest("PUT", dropURL+"another.dat", bytes.NewReader(dropped))
+	resp, err = http.DefaultClient.Do(req)
+	if err != nil || resp.StatusCode != http.StatusForbidden {
+		t.Fatalf("Expected the drop upload past the file count limit to be rejected: %v", err)
+	}
+	resp.Body.Close()
+	storage.ChunkSize = chunkSize
+
+	// collecting moves the file into the folder encrypted
+	collectCount, err := cmdState.CollectDrops()
+	if err != nil || collectCount != 1 {
+		t.Fatalf("Failed to collect the drop files (%d): %v", collectCount, err)
+	}
+	var collected bytes.Buffer
+	_, err = cmdState.DownloadStream(&collected, "inbox/report.dat")
+	if err != nil || !bytes.Equal(collected.Bytes(), dropped) {
+		t.Fatalf("The collected drop file did not match the uploaded file: %v", err)
+	}
+
+	// nothing is left to collect and revoked tokens no longer accept files
+	collectCount, err = cmdState.CollectDrops()
+	if err != nil || collectCount != 0 {
+		t.Fatalf("Expected no drop files left to collect (%d): %v", collectCount, err)
+	}
+	err = cmdState.RmDrop(dt.Token)
+	if err != nil {
+		t.Fatalf("Failed to revoke the drop token: %v", err)
+	}
+	req, _ = http.NewRequest("PUT", dropURL+"late.dat", bytes.NewReader(dropped))
+	resp, err = http.DefaultClient.Do(req)
+	if err != nil || resp.StatusCode != http.StatusNotFound {
+		t.Fatalf("Expected the revoked drop token to be not found: %v", err)
+	}
+	resp.Body.Close()
+}
+
+// failingTransport fails chunk uploads while Down is set to act like a server
+// that has become unreachable.
+type failingTransport struct {
+	http.RoundTripper
+	Down bool
+}
+
+func (f *failingTransport) RoundTrip(r *http.Request) (*http.Response, error) {
+	if f.Down && r.Method == "PUT" && strings.Contains(r.URL.Path, "/api/chunk/") {
+		return nil, fmt.Errorf("the server is unreachable")
+	}
+	return f.RoundTripper.RoundTrip(r)
+}
+
+func TestUploadSpool(t *testing.T) {
+	srv := freezertest.NewMemoryServer(t)
+	defer srv.Close()
+	cmdState := srv.NewUser(t, "spool", "1234", *flagCryptoPass)
+	transport := &failingTransport{RoundTripper: cmdState.Transport, Down: true}
+	cmdState.Transport = transport
+	cmdState.SpoolDir = srv.Dir + "/spool"
+
+	// chunks that fail to upload stay in the spool
+	localPath := srv.Dir + "/spooled.dat"
+	data := genRandomBytes(freezertest.DefaultChunkSize*2 + 42)
+	ioutil.WriteFile(localPath, data, 0644)
+	_, _, err := cmdState.SyncFile(localPath, "spooled.dat", command.SyncCurrentVersion)
+	if err == nil {
+		t.Fatal("Expected the sync to fail while chunk uploads fail.")
+	}
+	chunks, err := cmdState.SpooledChunks()
+	if err != nil || len(chunks) == 0 {
+		t.Fatalf("Expected the failed chunks to be spooled but found %d: %v", len(chunks), err)
+	}
+	for _, sc := range chunks {
+		if sc.RemoteFilepath != "spooled.dat" || sc.ChunkCount != 3 {
+			t.Fatalf("The spooled chunk doesn't describe the upload: %+v", sc)
+		}
+	}
+
+	// flushing pushes the pending chunks and empties the spool
+	transport.Down = false
+	count, err := cmdState.FlushSpool()
+	if err != nil || count != len(chunks) {
+		t.Fatalf("Failed to flush the spool (%d of %d uploaded): %v", count, len(chunks), err)
+	}
+	chunks, err = cmdState.SpooledChunks()
+	if err != nil || len(chunks) != 0 {
+		t.Fatalf("Expected the spool to be empty after flushing but found %d: %v", len(chunks), err)
+	}
+	var stored bytes.Buffer
+	_, err = cmdState.DownloadStream(&stored, "spooled.dat")
+	if err != nil || !bytes.Equal(stored.Bytes(), data) {
+		t.Fatalf("The flushed file doesn't match the local file: %v", err)
+	}
+
+	// chunks that upload straight away don't stay in the spool
+	ioutil.WriteFile(localPath, genRandomBytes(42), 0644)
+	_, _, err = cmdState.SyncFile(localPath, "spooled.dat", command.SyncCurrentVersion)
+	if err != nil {
+		t.Fatalf("Failed to sync the changed file: %v", err)
+	}
+	chunks, _ = cmdState.SpooledChunks()
+	if len(chunks) != 0 {
+		t.Fatalf("Expected uploaded chunks to be removed from the spool but found %d.", len(chunks))
+	}
+}
+
+func TestOpQueue(t *testing.T) {
+	srv := freezertest.NewMemoryServer(t)
+	defer srv.Close()
+	cmdState := srv.NewUser(t, "queue", "1234", *flagCryptoPass)
+	cmdState.QueueFile = srv.Dir + "/queue.json"
+
+	offline := command.NewState()
+	if offline.ServerReachable("http://127.0.0.1:1") {
+		t.Fatal("Expected a server that isn't listening to be unreachable.")
+	}
+	if !cmdState.ServerReachable(cmdState.HostURI) {
+		t.Fatal("Expected the test server to be reachable.")
+	}
+
+	for _, name := range []string{"a.txt", "b.txt", "c.txt"} {
+		localPath := srv.Dir + "/" + name
+		ioutil.WriteFile(localPath, []byte(name), 0644)
+		_, _, err := cmdState.SyncFile(localPath, name, command.SyncCurrentVersion)
+		if err != nil {
+			t.Fatalf("Failed to sync %s: %v", name, err)
+		}
+	}
+
+	ops := []command.QueuedOp{
+		{Op: command.QueuedRm, Pattern: "a.txt"},
+		{Op: command.QueuedMv, Pattern: `^b\.txt$`, Replacement: "renamed.txt", Regex: true},
+		{Op: command.QueuedRm, Pattern: "c.txt"},
+	}
+	for _, op := range ops {
+		if err := cmdState.QueueOp(cmdState.HostURI, op); err != nil {
+			t.Fatalf("Failed to queue an operation: %v", err)
+		}
+	}
+
+	// make the removal of c.txt look like it was queued before its current version
+	queued, err := cmdState.LoadOpQueue()
+	if err != nil || len(queued) != 3 {
+		t.Fatalf("Expected three queued operations but got %d: %v", len(queued), err)
+	}
+	queued[2].Queued -= 3600
+	data, _ := json.Marshal(queued)
+	ioutil.WriteFile(cmdState.QueueFile, data, 0600)
+
+	applied, conflicts, err := cmdState.ReplayOpQueue(false)
+	if err != nil || applied != 2 || len(conflicts) != 1 || !strings.Contains(conflicts[0], "c.txt") {
+		t.Fatalf("Expected two operations applied and a conflict for c.txt (%d, %v): %v", applied, conflicts, err)
+	}
+	if _, err = cmdState.GetFileInfoByFilename("a.txt"); err == nil {
+		t.Fatal("Expected the queued removal of a.txt to be replayed.")
+	}
+	if _, err = cmdState.GetFileInfoByFilename("renamed.txt"); err != nil {
+		t.Fatalf("Expected the queued rename of b.txt to be replayed: %v", err)
+	}
+	if _, err = cmdState.GetFileInfoByFilename("c.txt"); err != nil {
+		t.Fatalf("Expected the conflicting removal of c.txt to be skipped: %v", err)
+	}
+
+	// forcing applies the conflict and empties the queue
+	applied, conflicts, err = cmdState.ReplayOpQueue(true)
+	if err != nil || applied != 1 || len(conflicts) != 0 {
+		t.Fatalf("Expected the forced replay to apply the conflict (%d, %v): %v", applied, conflicts, err)
+	}
+	if _, err = os.Stat(cmdState.QueueFile); !os.IsNotExist(err) {
+		t.Fatalf("Expected the empty queue file to be removed: %v", err)
+	}
+}
+
+func TestClockSkew(t *testing.T) {
+	srv := freezertest.NewMemoryServer(t)
+	defer srv.Close()
+	cmdState := srv.NewUser(t, "clock", "1234", *flagCryptoPass)
+
+	// the server and client share a clock in the test
+	if cmdState.ClockSkew > time.Second || cmdState.ClockSkew < -time.Second {
+		t.Fatalf("Expected no clock skew to be measured when logging in but got %v.", cmdState.ClockSkew)
+	}
+	serverTime, err := cmdState.ServerTime()
+	if err != nil {
+		t.Fatalf("Failed to get the server's time: %v", err)
+	}
+	if d := time.Since(serverTime); d > time.Second || d < -time.Second {
+		t.Fatalf("The server's time is %v off from the local time.", d)
+	}
+
+	// a rejected token is renewed with the credentials used to log in
+	cmdState.AuthToken = "expired"
+	_, err = cmdState.GetAllFileHashes()
+	if err != nil {
+		t.Fatalf("Expected the login to be renewed after the token was rejected: %v", err)
+	}
+	if cmdState.AuthToken == "expired" {
+		t.Fatal("Expected a new token after the login was renewed.")
+	}
+}
+
+func TestDerivedLogin(t *testing.T) {
+	// the derived password alone is hashed since with the salt it'd be past
+	// the 72 bytes that bcrypt accepts
+	salt, hash, err := filefreezer.GenLoginPasswordHash("1234")
+	if err != nil {
+		t.Fatalf("Failed to generate a login hash: %v", err)
+	}
+	derived, err := filefreezer.DeriveLoginPassword("1234", salt)
+	if err != nil || len(derived) > 72 {
+		t.Fatalf("Expected a derived password bcrypt can hash but got %d bytes: %v", len(derived), err)
+	}
+	if !filefreezer.VerifyDerivedLoginPassword(derived, hash) || !filefreezer.VerifyLoginPassword("1234", salt, hash) {
+		t.Fatal("Failed to verify the password against a login hash with a real salt.")
+	}
+	if filefreezer.VerifyLoginPassword("4321", salt, hash) {
+		t.Fatal("Expected the wrong password not to verify against the login hash.")
+	}
+	otherSalt, _, _ := filefreezer.GenLoginPasswordHash("1234")
+	if filefreezer.VerifyLoginPassword("1234", otherSalt, hash) {
+		t.Fatal("Expected the password with another salt not to verify against the login hash.")
+	}
+
+	srv := freezertest.NewMemoryServer(t)
+	defer srv.Close()
+
+	// new users can log in without sending the plaintext password
+	srv.NewUser(t, "derived", "1234", *flagCryptoPass)
+	cmdState := command.NewState()
+	cmdState.SetQuiet(true)
+	cmdState.Transport = srv.Transport
+	cmdState.StrictLogin = true
+	err = cmdState.Authenticate(srv.URL, "derived", "1234")
+	if err != nil {
+		t.Fatalf("Failed to log in with a derived password: %v", err)
+	}
+	if cmdState.ServerCapabilities.LoginVersion != models.LoginDerived {
+		t.Fatalf("Expected the server to support derived logins but got version %d.", cmdState.ServerCapabilities.LoginVersion)
+	}
+	if err = cmdState.Authenticate(srv.URL, "derived", "wrong"); err == nil {
+		t.Fatal("Expected a login with the wrong password to fail.")
+	}
+
+	// the remembered derived password isn't reused once the salt has changed
+	if err = cmdState.Authenticate(srv.URL, "derived", "1234"); err != nil {
+		t.Fatalf("Failed to log in again: %v", err)
+	}
+	if err = srv.Storage.RemoveUser("derived"); err != nil {
+		t.Fatalf("Failed to remove the user: %v", err)
+	}
+	if _, err = srv.AddUser("derived", "1234"); err != nil {
+		t.Fatalf("Failed to add the user again: %v", err)
+	}
+	if err = cmdState.Authenticate(srv.URL, "derived", "1234"); err != nil {
+		t.Fatalf("Failed to log in after the salt changed: %v", err)
+	}
+
+	// hashes of the plaintext password from older versions need one plaintext
+	// login, which upgrades them
+	user, err := srv.AddUser("legacy", "1234")
+	if err != nil {
+		t.Fatalf("Failed to add a user: %v", err)
+	}
+	legacyHash, _ := bcrypt.GenerateFromPassword([]byte("1234"+user.Salt), bcrypt.MinCost)
+	err = srv.Storage.UpdateUser(user.ID, user.Name, user.Salt, legacyHash, nil, freezertest.DefaultQuota)
+	if err != nil {
+		t.Fatalf("Failed to set a legacy login hash: %v", err)
+	}
+
+	// the login params don't tell those accounts apart from users that don't exist
+	client := &http.Client{Transport: srv.Transport}
+	for _, name := range []string{"legacy", "nobody"} {
+		resp, err := client.Get(srv.URL + "/api/users/login/params?user=" + name)
+		if err != nil {
+			t.Fatalf("Failed to get the login params for %s: %v", name, err)
+		}
+		var params models.LoginParamsResponse
+		err = json.NewDecoder(resp.Body).Decode(&params)
+		resp.Body.Close()
+		if err != nil || params.LoginVersion != models.LoginDerived || params.Salt == "" {
+			t.Fatalf("Expected the same login version for %s as any other user but got %+v (%v).", name, params, err)
+		}
+	}
+
+	if err = cmdState.Authenticate(srv.URL, "legacy", "1234"); err == nil {
+		t.Fatal("Expected a strict login to refuse sending the plaintext password.")
+	}
+	cmdState.StrictLogin = false
+	if err = cmdState.Authenticate(srv.URL, "legacy", "1234"); err != nil {
+		t.Fatalf("Failed to log in with the plaintext password: %v", err)
+	}
+	user, _ = srv.Storage.GetUser("legacy")
+	if !filefreezer.IsDerivedLoginHash(user.SaltedHash) {
+		t.Fatal("Expected the plaintext login to upgrade the login hash.")
+	}
+	cmdState.StrictLogin = true
+	if err = cmdState.Authenticate(srv.URL, "legacy", "1234"); err != nil {
+		t.Fatalf("Failed to log in with a derived password after the upgrade: %v", err)
+	}
+}
+
+// roundTripFunc is an http.RoundTripper made from a function.
+type roundTripFunc func(*http.Request) (*http.Response, error)
+
+func (f roundTripFunc) RoundTrip(r *http.Request) (*http.Response, error) {
+	return f(r)
+}
+
+func TestCapabilities(t *testing.T) {
+	srv := freezertest.NewMemoryServer(t)
+	defer srv.Close()
+	cmdState := srv.NewUser(t, "caps", "1234", *flagCryptoPass)
+
+	caps := cmdState.ServerCapabilities
+	if caps.ProtocolVersion != models.ProtocolVersion || caps.MaxChunkUpload <= caps.ChunkSize {
+		t.Fatalf("The server's capabilities weren't negotiated: %+v", caps)
+	}
+	if !caps.Supports(models.FeatureDrops) || caps.Supports("teleport") {
+		t.Fatalf("The server's features are wrong: %v", caps.Features)
+	}
+	legacy := models.ServerCapabilities{ChunkSize: caps.ChunkSize}
+	if !legacy.Supports(models.FeatureDrops) {
+		t.Fatal("Servers that predate negotiation should be assumed to support features.")
+	}
+
+	// commands needing a feature the server lacks fail before doing anything
+	cmdState.ServerCapabilities.Features = nil
+	_, err := cmdState.GetDrops()
+	if err == nil || !strings.Contains(err.Error(), models.FeatureDrops) {
+		t.Fatalf("Expected listing drops to fail for a server without them: %v", err)
+	}
+
+	// logging in to a server that can't store this client's hashes fails up front
+	client := command.NewState()
+	client.SetQuiet(true)
+	client.Transport = roundTripFunc(func(r *http.Request) (*http.Response, error) {
+		resp, err := srv.Transport.RoundTrip(r)
+		if err != nil || r.URL.Path != "/api/users/login" {
+			return resp, err
+		}
+		var login models.UserLoginResponse
+		json.NewDecoder(resp.Body).Decode(&login)
+		resp.Body.Close()
+		login.Capabilities.HashAlgorithms = []string{"blake2b"}
+		body, _ := json.Marshal(login)
+		resp.Body = ioutil.NopCloser(bytes.NewReader(body))
+		resp.ContentLength = int64(len(body))
+		return resp, nil
+	})
+	err = client.Authenticate(srv.URL, "caps", "1234")
+	if err == nil || !strings.Contains(err.Error(), "sha1") {
+		t.Fatalf("Expected the login to fail for a server without sha1 hashes: %v", err)
+	}
+}
+
+func TestClientVersion(t *testing.T) {
+	for _, c := range []struct {
+		a, b string
+		cmp  int
+	}{
+		{"0.2.0", "0.2.0", 0}, {"0.2", "0.2.0", 0}, {"0.10.0", "0.9.1", 1},
+		{"1.0.0-beta", "1.0.0", 0}, {"", "0.1.0", -1}, {"v1.2.3", "1.2.4", -1},
+	} {
+		if cmp := models.CompareVersions(c.a, c.b); cmp != c.cmp {
+			t.Fatalf("Expected comparing %q to %q to give %d but got %d.", c.a, c.b, c.cmp, cmp)
+		}
+	}
+
+	srv := freezertest.NewServerWithConfig(t, server.Config{
+		MinClientVersion:    command.Version,
+		LatestClientVersion: "99.0.0",
+	})
+	defer srv.Close()
+	_, err := srv.AddUser("versions", "1234")
+	if err != nil {
+		t.Fatalf("Failed to add a user: %v", err)
+	}
+
+	// current clients log in and hear about the newer version
+	cmdState := command.NewState()
+	cmdState.SetQuiet(true)
+	cmdState.Notices = make(chan string, 1)
+	err = cmdState.Authenticate(srv.URL, "versions", "1234")
+	if err != nil {
+		t.Fatalf("Failed to log in with the current client: %v", err)
+	}
+	if cmdState.UpgradeAvailable != "99.0.0" {
+		t.Fatalf("Expected an upgrade to be available but got %q.", cmdState.UpgradeAvailable)
+	}
+	select {
+	case notice := <-cmdState.Notices:
+		if !strings.Contains(notice, "99.0.0") {
+			t.Fatalf("The upgrade notice doesn't name the new version: %s", notice)
+		}
+	default:
+		t.Fatal("Expected an upgrade notice to be sent.")
+	}
+
+	// clients from before versions were sent get a structured error
+	resp, err := http.PostForm(srv.URL+"/api/users/login", url.Values{"user": {"versions"}, "password": {"1234"}})
+	if err != nil {
+		t.Fatalf("Failed to post a login: %v", err)
+	}
+	var errResp models.ErrorResponse
+	json.NewDecoder(resp.Body).Decode(&errResp)
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusUpgradeRequired || errResp.MinClientVersion != command.Version {
+		t.Fatalf("Expected an old client to be told to upgrade (status %d): %+v", resp.StatusCode, errResp)
+	}
+
+	// clients older than the minimum are told which version they need
+	newer := freezertest.NewServerWithConfig(t, server.Config{MinClientVersion: "99.0.0"})
+	defer newer.Close()
+	newer.AddUser("versions", "1234")
+	err = cmdState.Authenticate(newer.URL, "versions", "1234")
+	if err == nil || !strings.Contains(err.Error(), "99.0.0") {
+		t.Fatalf("Expected the login to fail naming the minimum version: %v", err)
+	}
+}
+
+func TestSelfUpdate(t *testing.T) {
+	privKey, err := ecdsa.GenerateKey(elliptic.P256(), crand.Reader)
+	if err != nil {
+		t.Fatalf("Failed to generate a release key: %v", err)
+	}
+	pubBytes, err := x509.MarshalPKIXPublicKey(&privKey.PublicKey)
+	if err != nil {
+		t.Fatalf("Failed to marshal the release key: %v", err)
+	}
+	key, err := command.ParseReleaseKey(pem.EncodeToMemory(&pem.Block{Type: "PUBLIC KEY", Bytes: pubBytes}))
+	if err != nil {
+		t.Fatalf("Failed to parse the release key: %v", err)
+	}
+
+	newBinary := []byte("#!/bin/sh\necho the new release\n")
+	hash := sha256.Sum256(newBinary)
+	sign := func(version string, platform string) string {
+		manifestHash := sha256.Sum256(command.ReleaseManifest(version, platform, hex.EncodeToString(hash[:])))
+		sig, err := privKey.Sign(crand.Reader, manifestHash[:], nil)
+		if err != nil {
+			t.Fatalf("Failed to sign the release: %v", err)
+		}
+		return base64.StdEncoding.EncodeToString(sig)
+	}
+	binary := command.ReleaseBinary{
+		URL:       "freezer.bin",
+		SHA256:    hex.EncodeToString(hash[:]),
+		Signature: sign("99.0.0", command.ReleasePlatform()),
+	}
+	release := command.Release{
+		Version:  "99.0.0",
+		Binaries: map[string]command.ReleaseBinary{command.ReleasePlatform(): binary},
+	}
+	served := newBinary
+	releaseServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/release.json":
+			json.NewEncoder(w).Encode(release)
+		case "/freezer.bin":
+			w.Write(served)
+		default:
+			http.NotFound(w, r)
+		}
+	}))
+	defer releaseServer.Close()
+	releaseURL := releaseServer.URL + "/release.json"
+
+	dir, err := ioutil.TempDir("", "freezer-selfupdate")
+	if err != nil {
+		t.Fatalf("Failed to create a temporary directory: %v", err)
+	}
+	defer os.RemoveAll(dir)
+	exePath := filepath.Join(dir, "freezer")
+	oldBinary := []byte("#!/bin/sh\necho the old release\n")
+	err = ioutil.WriteFile(exePath, oldBinary, 0755)
+	if err != nil {
+		t.Fatalf("Failed to write the old executable: %v", err)
+	}
+
+	cmdState := command.NewState()
+	cmdState.SetQuiet(true)
+
+	// a binary that doesn't match the release is never installed
+	served = []byte("#!/bin/sh\necho something else\n")
+	_, updated, err := cmdState.SelfUpdate(releaseURL, key, exePath)
+	if err == nil || updated {
+		t.Fatal("Expected a binary that doesn't match the release's hash to be rejected.")
+	}
+	served = newBinary
+
+	// neither is one signed with another key
+	otherKey, _ := ecdsa.GenerateKey(elliptic.P256(), crand.Reader)
+	_, updated, err = cmdState.SelfUpdate(releaseURL, &otherKey.PublicKey, exePath)
+	if err == nil || updated {
+		t.Fatal("Expected a release signed with another key to be rejected.")
+	}
+
+	// or one whose signature was made for another version or platform
+	forged := binary
+	forged.Signature = sign("98.0.0", command.ReleasePlatform())
+	release.Binaries[command.ReleasePlatform()] = forged
+	_, updated, err = cmdState.SelfUpdate(releaseURL, key, exePath)
+	if err == nil || updated {
+		t.Fatal("Expected a binary signed for another version to be rejected.")
+	}
+	forged.Signature = sign("99.0.0", "plan9-mips")
+	release.Binaries[command.ReleasePlatform()] = forged
+	_, updated, err = cmdState.SelfUpdate(releaseURL, key, exePath)
+	if err == nil || updated {
+		t.Fatal("Expected a binary signed for another platform to be rejected.")
+	}
+	release.Binaries[command.ReleasePlatform()] = binary
+	data, _ := ioutil.ReadFile(exePath)
+	if !bytes.Equal(data, oldBinary) {
+		t.Fatal("The executable was changed by a failed update.")
+	}
+
+	version, updated, err := cmdState.SelfUpdate(releaseURL, key, exePath)
+	if err != nil || !updated || version != "99.0.0" {
+		t.Fatalf("Failed to update to the new release (version %s, updated %v): %v", version, updated, err)
+	}
+	data, _ = ioutil.ReadFile(exePath)
+	if !bytes.Equal(data, newBinary) {
+		t.Fatal("The executable wasn't replaced with the new release.")
+	}
+	info, _ := os.Stat(exePath)
+	if info.Mode().Perm() != 0755 {
+		t.Fatalf("Expected the new executable to keep its permissions but it has %v.", info.Mode().Perm())
+	}
+
+	// releases that aren't newer are left alone
+	release.Version = command.Version
+	_, updated, err = cmdState.SelfUpdate(releaseURL, key, exePath)
+	if err != nil || updated {
+		t.Fatalf("Expected the current version not to be installed again: %v", err)
+	}
+}
+
+func TestGetDirectory(t *testing.T) {
+	srv := freezertest.NewMemoryServer(t)
+	defer srv.Close()
+	cmdState := srv.NewUser(t, "getdir", "1234", *flagCryptoPass)
+
+	srcDir := filepath.Join(srv.Dir, "src")
+	os.MkdirAll(filepath.Join(srcDir, "sub"), 0755)
+	contents := map[string][]byte{
+		"a.dat":     genRandomBytes(100),
+		"c.dat":     genRandomBytes(int(*flagServeChunkSize) + 7),
+		"sub/b.dat": genRandomBytes(200),
+	}
+	for name, data := range contents {
+		ioutil.WriteFile(filepath.Join(srcDir, filepath.FromSlash(name)), data, 0644)
+	}
+	_, err := cmdState.SyncDirectory(srcDir, "backup")
+	if err != nil {
+		t.Fatalf("Failed to sync the directory: %v", err)
+	}
+
+	// interrupt the restore after the first file
+	inner := cmdState.Transport
+	chunkGets, maxChunkGets := 0, 1
+	cmdState.Transport = roundTripFunc(func(r *http.Request) (*http.Response, error) {
+		if r.Method == "GET" && strings.Count(r.URL.Path, "/") == 5 && strings.HasPrefix(r.URL.Path, "/api/chunk/") {
+			chunkGets++
+			if maxChunkGets > 0 && chunkGets > maxChunkGets {
+				return nil, fmt.Errorf("the connection was lost")
+			}
+		}
+		return inner.RoundTrip(r)
+	})
+
+	restoreDir := filepath.Join(srv.Dir, "restore")
+	count, err := cmdState.GetDirectory("backup", restoreDir)
+	if err == nil || count != 1 {
+		t.Fatalf("Expected the restore to be interrupted after one file but %d were downloaded: %v", count, err)
+	}
+	manifestPath := filepath.Join(restoreDir, command.RestoreManifestName)
+	if _, err = os.Stat(manifestPath); err != nil {
+		t.Fatalf("Expected the interrupted restore to leave a manifest: %v", err)
+	}
+	if _, err = os.Stat(filepath.Join(restoreDir, "c.dat.part")); !os.IsNotExist(err) {
+		t.Fatal("Expected the partial download to be removed.")
+	}
+
+	// resuming only downloads the files that weren't restored
+	maxChunkGets = 0
+	count, err = cmdState.GetDirectory("backup", restoreDir)
+	if err != nil || count != 2 {
+		t.Fatalf("Expected the resumed restore to download the two remaining files but it downloaded %d: %v", count, err)
+	}
+	for name, data := range contents {
+		restored, err := ioutil.ReadFile(filepath.Join(restoreDir, filepath.FromSlash(name)))
+		if err != nil || !bytes.Equal(restored, data) {
+			t.Fatalf("The restored file %s doesn't match the original: %v", name, err)
+		}
+	}
+	if _, err = os.Stat(manifestPath); !os.IsNotExist(err) {
+		t.Fatal("Expected the manifest to be removed once the restore finished.")
+	}
+}
+
+func TestSyncPriority(t *testing.T) {
+	srv := freezertest.NewMemoryServer(t)
+	defer srv.Close()
+	cmdState := srv.NewUser(t, "priority", "1234", *flagCryptoPass)
+
+	// the biggest file is the oldest and the smallest is in between
+	srcDir := filepath.Join(srv.Dir, "src")
+	os.MkdirAll(srcDir, 0755)
+	now := time.Now()
+	files := []struct {
+		name string
+		size int
+		age  time.Duration
+	}{
+		{"a-archive.dat", int(*flagServeChunkSize)*2 + 1, 72 * time.Hour},
+		{"b-notes.txt", 10, 24 * time.Hour},
+		{"c-report.doc", 1000, time.Hour},
+	}
+	for _, f := range files {
+		localPath := filepath.Join(srcDir, f.name)
+		ioutil.WriteFile(localPath, genRandomBytes(f.size), 0644)
+		modTime := now.Add(-f.age)
+		os.Chtimes(localPath, modTime, modTime)
+	}
+
+	// chunkOrder records the order files are first seen in chunk transfers
+	var chunkOrder []string
+	transferOrder := func(state *command.State, method string) {
+		inner := state.Transport
+		seen := make(map[string]bool)
+		state.Transport = roundTripFunc(func(r *http.Request) (*http.Response, error) {
+			parts := strings.Split(r.URL.Path, "/")
+			if r.Method == method && len(parts) >= 6 && parts[2] == "chunk" && !seen[parts[3]] {
+				seen[parts[3]] = true
+				chunkOrder = append(chunkOrder, parts[3])
+			}
+			return inner.RoundTrip(r)
+		})
+	}
+	fileIDs := func(names ...string) []string {
+		var ids []string
+		for _, name := range names {
+			fi, err := cmdState.GetFileInfoByFilename("docs/" + name)
+			if err != nil {
+				t.Fatalf("Failed to get the file info for %s: %v", name, err)
+			}
+			ids = append(ids, fmt.Sprintf("%d", fi.FileID))
+		}
+		return ids
+	}
+
+	// smallest files are uploaded first
+	cmdState.SyncPriority = command.SyncPrioritySmall
+	transferOrder(cmdState, "PUT")
+	_, err := cmdState.SyncDirectory(srcDir, "docs")
+	if err != nil {
+		t.Fatalf("Failed to sync the directory: %v", err)
+	}
+	expected := fileIDs("b-notes.txt", "c-report.doc", "a-archive.dat")
+	if strings.Join(chunkOrder, ",") != strings.Join(expected, ",") {
+		t.Fatalf("Expected the smallest files to be uploaded first (%v) but got %v.", expected, chunkOrder)
+	}
+
+	// most recently modified files are downloaded first
+	client, err := srv.NewClient("priority", "1234", *flagCryptoPass)
+	if err != nil {
+		t.Fatalf("Failed to log in a second client: %v", err)
+	}
+	client.SyncPriority = command.SyncPriorityRecent
+	chunkOrder = nil
+	transferOrder(client, "GET")
+	_, err = client.SyncDirectory(filepath.Join(srv.Dir, "restore"), "docs")
+	if err != nil {
+		t.Fatalf("Failed to sync the directory into an empty one: %v", err)
+	}
+	expected = fileIDs("c-report.doc", "b-notes.txt", "a-archive.dat")
+	if strings.Join(chunkOrder, ",") != strings.Join(expected, ",") {
+		t.Fatalf("Expected the most recent files to be downloaded first (%v) but got %v.", expected, chunkOrder)
+	}
+}
+
+func TestSyncPolicies(t *testing.T) {
+	srv := freezertest.NewMemoryServer(t)
+	defer srv.Close()
+	cmdState := srv.NewUser(t, "policies", "1234", *flagCryptoPass)
+
+	policyPath := filepath.Join(srv.Dir, "policies.json")
+	ioutil.WriteFile(policyPath, []byte(`[
+		{"Pattern": "*.log", "Keep": 2},
+		{"Pattern": "media/**", "Transform": "none"}
+	]`), 0644)
+	policies, err := command.LoadSyncPolicies(policyPath)
+	if err != nil {
+		t.Fatalf("Failed to load the sync policies: %v", err)
+	}
+	for _, c := range []struct {
+		policy  int
+		name    string
+		matches bool
+	}{
+		{0, "server.log", true}, {0, "logs/server.log", true}, {0, "server.log.gz", false},
+		{1, "media/a.dat", true}, {1, "media/2017/b.dat", true}, {1, "mediaxyz/a.dat", false},
+	} {
+		if policies[c.policy].Matches(c.name) != c.matches {
+			t.Fatalf("Expected the pattern %s matching %s to be %v.", policies[c.policy].Pattern, c.name, c.matches)
+		}
+	}
+	ioutil.WriteFile(policyPath, []byte(`[{"Pattern": "[*.log", "Keep": 2}]`), 0644)
+	if _, err = command.LoadSyncPolicies(policyPath); err == nil {
+		t.Fatal("Expected a policy with an invalid pattern to be rejected.")
+	}
+	cmdState.Policies = policies
+
+	// the policy turns off the transform that would fail the upload
+	transform, _ := command.ParseTransform(`\.dat$=false`)
+	cmdState.Transforms = []command.Transform{transform}
+	os.MkdirAll(filepath.Join(srv.Dir, "media"), 0755)
+	mediaPath := filepath.Join(srv.Dir, "media", "a.dat")
+	ioutil.WriteFile(mediaPath, genRandomBytes(100), 0644)
+	_, _, err = cmdState.SyncFile(mediaPath, "media/a.dat", command.SyncCurrentVersion)
+	if err != nil {
+		t.Fatalf("Expected the policy to turn off the transform: %v", err)
+	}
+
+	// new versions of the log are pruned to the ones the policy keeps
+	logPath := filepath.Join(srv.Dir, "server.log")
+	for i := 0; i < 4; i++ {
+		ioutil.WriteFile(logPath, genRandomBytes(100), 0644)
+		modTime := time.Now().Add(time.Duration(i-10) * time.Minute)
+		os.Chtimes(logPath, modTime, modTime)
+		_, _, err = cmdState.SyncFile(logPath, "server.log", command.SyncCurrentVersion)
+		if err != nil {
+			t.Fatalf("Failed to sync version %d of the log: %v", i+1, err)
+		}
+	}
+	versions, err := cmdState.GetFileVersions("server.log")
+	if err != nil || len(versions) != 2 {
+		t.Fatalf("Expected the policy to keep 2 versions of the log but found %d: %v", len(versions), err)
+	}
+
+	// pruning applies a policy that changed after the versions were uploaded
+	cmdState.Policies[0].Keep = 1
+	count, err := cmdState.PruneVersions(true)
+	if err != nil || count != 1 {
+		t.Fatalf("Expected a dry run to find one file to prune but found %d: %v", count, err)
+	}
+	versions, _ = cmdState.GetFileVersions("server.log")
+	if len(versions) != 2 {
+		t.Fatalf("Expected a dry run not to remove versions but %d are left.", len(versions))
+	}
+	count, err = cmdState.PruneVersions(false)
+	if err != nil || count != 1 {
+		t.Fatalf("Failed to prune the log (%d files pruned): %v", count, err)
+	}
+	versions, _ = cmdState.GetFileVersions("server.log")
+	if len(versions) != 1 || versions[0].VersionNumber != 4 {
+		t.Fatalf("Expected only the current version of the log to be left but found %+v.", versions)
+	}
+}
+
+func TestMaxVersions(t *testing.T) {
+	srv := freezertest.NewServerWithConfig(t, server.Config{MaxVersions: 3})
+	defer srv.Close()
+	cmdState := srv.NewUser(t, "maxversions", "1234", *flagCryptoPass)
+
+	// each version is newer than the last one synced, by any earlier call too
+	synced := 0
+	syncVersions := func(filename string, count int) {
+		localPath := filepath.Join(srv.Dir, filename)
+		for i := 0; i < count; i++ {
+			ioutil.WriteFile(localPath, genRandomBytes(100), 0644)
+			modTime := time.Now().Add(time.Duration(synced-100) * time.Minute)
+			synced++
+			os.Chtimes(localPath, modTime, modTime)
+			_, _, err := cmdState.SyncFile(localPath, filename, command.SyncCurrentVersion)
+			if err != nil {
+				t.Fatalf("Failed to sync version %d of %s: %v", i+1, filename, err)
+			}
+		}
+	}
+
+	// the server prunes the oldest versions beyond its maximum
+	syncVersions("server.dat", 5)
+	versions, err := cmdState.GetFileVersions("server.dat")
+	if err != nil || len(versions) != 3 {
+		t.Fatalf("Expected the server to keep 3 versions but found %d: %v", len(versions), err)
+	}
+	for _, v := range versions {
+		if v.VersionNumber < 3 {
+			t.Fatalf("Expected the oldest versions to be pruned but found version %d.", v.VersionNumber)
+		}
+	}
+
+	// a user's own maximum overrides the server's
+	user, err := srv.Storage.GetUser("maxversions")
+	if err != nil {
+		t.Fatalf("Failed to get the user: %v", err)
+	}
+	err = cmdState.SetUserMaxVersions(srv.Storage, "maxversions", 1)
+	if err != nil {
+		t.Fatalf("Failed to set the user's maximum versions: %v", err)
+	}
+	stats, err := cmdState.GetUserStats()
+	if err != nil || stats.MaxVersions != 1 {
+		t.Fatalf("Expected the user stats to have the user's maximum versions (%d): %v", stats.MaxVersions, err)
+	}
+	syncVersions("user.dat", 3)
+	versions, _ = cmdState.GetFileVersions("user.dat")
+	if len(versions) != 1 || versions[0].VersionNumber != 3 {
+		t.Fatalf("Expected only the current version to be kept but found %+v.", versions)
+	}
+
+	// nothing is pruned while pruning is frozen
+	srv.Storage.FreezeUserPruning(user.ID, "test")
+	syncVersions("user.dat", 2)
+	versions, _ = cmdState.GetFileVersions("user.dat")
+	if len(versions) != 3 {
+		t.Fatalf("Expected no versions to be pruned while frozen but found %d.", len(versions))
+	}
+}
+
+func TestChunkUsage(t *testing.T) {
+	srv := freezertest.NewMemoryServer(t)
+	defer srv.Close()
+	cmdState := srv.NewUser(t, "usage", "1234", *flagCryptoPass)
+
+	// two files with the same content take up one file's worth of unique chunks
+	data := genRandomBytes(freezertest.DefaultChunkSize * 2)
+	for _, name := range []string{"a.dat", "b.dat"} {
+		localPath := filepath.Join(srv.Dir, name)
+		ioutil.WriteFile(localPath, data, 0644)
+		_, _, err := cmdState.SyncFile(localPath, name, command.SyncCurrentVersion)
+		if err != nil {
+			t.Fatalf("Failed to sync %s: %v", name, err)
+		}
+	}
+
+	user, err := srv.Storage.GetUser("usage")
+	if err != nil {
+		t.Fatalf("Failed to get the user: %v", err)
+	}
+	stats, err := cmdState.GetUserStats()
+	if err != nil {
+		t.Fatalf("Failed to get the user stats: %v", err)
+	}
+	logical, physical, err := srv.Storage.GetUserChunkUsage(user.ID)
+	if err != nil {
+		t.Fatalf("Failed to get the chunk usage: %v", err)
+	}
+	if logical != stats.Allocated || physical*2 != logical {
+		t.Fatalf("Expected the logical size to be the allocation (%d) and twice the physical size but got %d and %d.", stats.Allocated, logical, physical)
+	}
+}
+
+func TestSupportAccess(t *testing.T) {
+	srv := freezertest.NewMemoryServer(t)
+	defer srv.Close()
+	cmdState := srv.NewUser(t, "support", "1234", *flagCryptoPass)
+	other := srv.NewUser(t, "other", "1234", *flagCryptoPass)
+
+	localPath := filepath.Join(srv.Dir, "secret.txt")
+	ioutil.WriteFile(localPath, genRandomBytes(100), 0644)
+	if _, _, err := cmdState.SyncFile(localPath, "secret.txt", command.SyncCurrentVersion); err != nil {
+		t.Fatalf("Failed to sync the file: %v", err)
+	}
+	if _, _, err := other.SyncFile(localPath, "secret.txt", command.SyncCurrentVersion); err != nil {
+		t.Fatalf("Failed to sync the other user's file: %v", err)
+	}
+	otherFile, err := other.GetFileInfoByFilename("secret.txt")
+	if err != nil {
+		t.Fatalf("Failed to get the other user's file: %v", err)
+	}
+
+	client := &http.Client{Transport: srv.Transport}
+	get := func(token string, route string) (int, []byte) {
+		resp, err := client.Get(srv.URL + "/support/" + token + route)
+		if err != nil {
+			t.Fatalf("Failed to request %s: %v", route, err)
+		}
+		defer resp.Body.Close()
+		body, _ := ioutil.ReadAll(resp.Body)
+		return resp.StatusCode, body
+	}
+
+	// tokens need the user's consent or a break-glass reason
+	if _, err = cmdState.CreateSupportToken(srv.Storage, "support", "", false, time.Hour); err == nil {
+		t.Fatal("Expected a support token to need the user's consent.")
+	}
+	if _, err = cmdState.CreateSupportToken(srv.Storage, "support", "", true, time.Hour); err == nil {
+		t.Fatal("Expected a break-glass support token to need a reason.")
+	}
+	expires, err := cmdState.GrantSupport(time.Hour)
+	if err != nil {
+		t.Fatalf("Failed to consent to support access: %v", err)
+	}
+	st, err := cmdState.CreateSupportToken(srv.Storage, "support", "sync stuck", false, 2*time.Hour)
+	if err != nil {
+		t.Fatalf("Failed to make a support token: %v", err)
+	}
+	if st.Expires > expires.Unix() {
+		t.Fatal("Expected the support token not to outlast the consent.")
+	}
+
+	// the token reads the metadata with the file names still encrypted
+	status, body := get(st.Token, "/files")
+	var files models.AllFilesGetResponse
+	json.Unmarshal(body, &files)
+	if status != http.StatusOK || len(files.Files) != 1 || files.Files[0].FileName == "secret.txt" {
+		t.Fatalf("Expected the support token to list one encrypted file name (%d): %s", status, body)
+	}
+	fileInfo := files.Files[0]
+	route := fmt.Sprintf("/chunk/%d/%d", fileInfo.FileID, fileInfo.CurrentVersion.VersionID)
+	if status, body = get(st.Token, route); status != http.StatusOK {
+		t.Fatalf("Expected the support token to list the chunk hashes (%d): %s", status, body)
+	}
+	if status, _ = get(st.Token, route+"/0"); status == http.StatusOK {
+		t.Fatal("Expected the support token not to get chunk data.")
+	}
+	if status, _ = get(st.Token, fmt.Sprintf("/file/%d/versions", otherFile.FileID)); status == http.StatusOK {
+		t.Fatal("Expected the support token not to read another user's versions.")
+	}
+	if status, _ = get("unknown", "/files"); status != http.StatusNotFound {
+		t.Fatalf("Expected an unknown support token to be rejected but got %d.", status)
+	}
+
+	// withdrawing consent stops the token but not a break-glass one
+	if err = cmdState.RevokeSupport(); err != nil {
+		t.Fatalf("Failed to withdraw the consent: %v", err)
+	}
+	if status, _ = get(st.Token, "/stats"); status != http.StatusForbidden {
+		t.Fatalf("Expected the support token to stop working without consent but got %d.", status)
+	}
+	breakGlass, err := cmdState.CreateSupportToken(srv.Storage, "support", "data loss investigation", true, time.Hour)
+	if err != nil {
+		t.Fatalf("Failed to make a break-glass support token: %v", err)
+	}
+	if status, body = get(breakGlass.Token, "/stats"); status != http.StatusOK {
+		t.Fatalf("Expected the break-glass token to work (%d): %s", status, body)
+	}
+
+	// the user can see everything that was done without the tokens themselves
+	support, err := cmdState.GetSupport()
+	if err != nil || support.ConsentExpires != 0 {
+		t.Fatalf("Expected the consent to be withdrawn (%v): %v", support, err)
+	}
+	var sawBreakGlass bool
+	for _, entry := range support.Audit {
+		if strings.Contains(entry.Action, st.Token) || strings.Contains(entry.Action, breakGlass.Token) {
+			t.Fatalf("The audit shouldn't include support tokens: %s", entry.Action)
+		}
+		if strings.Contains(entry.Action, "data loss investigation") {
+			sawBreakGlass = true
+		}
+	}
+	if len(support.Audit) != 6 || !sawBreakGlass {
+		t.Fatalf("Expected the audit to record the tokens and their requests but got %+v.", support.Audit)
+	}
+}
+
+func TestAccountExportDelete(t *testing.T) {
+	srv := freezertest.NewServerWithConfig(t, server.Config{
+		DeletionGrace:         time.Second,
+		DeletionCheckInterval: 50 * time.Millisecond,
+	})
+	defer srv.Close()
+	cmdState := srv.NewUser(t, "leaving", "1234", *flagCryptoPass)
+
+	for i, name := range []string{"small.dat", "large.dat"} {
+		localPath := filepath.Join(srv.Dir, name)
+		ioutil.WriteFile(localPath, genRandomBytes(freezertest.DefaultChunkSize*i+100), 0644)
+		if _, _, err := cmdState.SyncFile(localPath, name, command.SyncCurrentVersion); err != nil {
+			t.Fatalf("Failed to sync %s: %v", name, err)
+		}
+	}
+
+	// the export lists every chunk with a path that downloads it
+	exportPath := filepath.Join(srv.Dir, "export.json")
+	export, err := cmdState.ExportAccount(exportPath)
+	if err != nil || export.Username != "leaving" || len(export.Files) != 2 {
+		t.Fatalf("Expected the export to have both files (%+v): %v", export, err)
+	}
+	if _, err = os.Stat(exportPath); err != nil {
+		t.Fatalf("The export wasn't written: %v", err)
+	}
+	for _, file := range export.Files {
+		if len(file.Versions) != 1 || len(file.Versions[0].Chunks) != file.Versions[0].ChunkCount {
+			t.Fatalf("Expected the export to list every chunk of %s: %+v", file.FileName, file.Versions)
+		}
+		for _, chunk := range file.Versions[0].Chunks {
+			data, err := cmdState.RunAuthRequest(srv.URL+chunk.Path, "GET", cmdState.AuthToken, nil)
+			if err != nil || len(data) == 0 {
+				t.Fatalf("Failed to download %s from the export: %v", chunk.Path, err)
+			}
+		}
+	}
+
+	// the deletion has to be confirmed with the token it returns
+	if _, err = cmdState.DeleteAccount("guess"); err == nil {
+		t.Fatal("Expected confirming a deletion that wasn't requested to fail.")
+	}
+	resp, err := cmdState.DeleteAccount("")
+	if err != nil || resp.ConfirmToken == "" || resp.DeleteAt != 0 {
+		t.Fatalf("Expected a confirmation token for the deletion (%+v): %v", resp, err)
+	}
+	if _, err = cmdState.DeleteAccount("guess"); err == nil {
+		t.Fatal("Expected a wrong confirmation token to fail.")
+	}
+	resp, err = cmdState.DeleteAccount(resp.ConfirmToken)
+	if err != nil || resp.DeleteAt == 0 {
+		t.Fatalf("Expected the confirmation to schedule the deletion (%+v): %v", resp, err)
+	}
+
+	// cancelling keeps the account
+	if err = cmdState.CancelAccountDeletion(); err != nil {
+		t.Fatalf("Failed to cancel the deletion: %v", err)
+	}
+	user, err := srv.Storage.GetUser("leaving")
+	if err != nil {
+		t.Fatalf("Failed to get the user: %v", err)
+	}
+	if deletion, _ := srv.Storage.GetAccountDeletion(user.ID); deletion != nil {
+		t.Fatal("Expected the deletion to be cancelled.")
+	}
+
+	// a frozen account isn't erased until the freeze is lifted
+	resp, _ = cmdState.DeleteAccount("")
+	if _, err = cmdState.DeleteAccount(resp.ConfirmToken); err != nil {
+		t.Fatalf("Failed to confirm the deletion again: %v", err)
+	}
+	srv.Storage.FreezeUserPruning(user.ID, "test")
+	time.Sleep(2500 * time.Millisecond)
+	if _, err = srv.Storage.GetUser("leaving"); err != nil {
+		t.Fatal("Expected a frozen account not to be erased.")
+	}
+	srv.Storage.UnfreezeUserPruning(user.ID)
+	for i := 0; i < 100; i++ {
+		if _, err = srv.Storage.GetUser("leaving"); err != nil {
+			break
+		}
+		time.Sleep(50 * time.Millisecond)
+	}
+	if err == nil {
+		t.Fatal("Expected the account to be erased once the grace period ended.")
+	}
+	logical, _, _ := srv.Storage.GetUserChunkUsage(user.ID)
+	if logical != 0 {
+		t.Fatalf("Expected the erased account's chunks to be removed but %d bytes are left.", logical)
+	}
+}
+
+func TestReplication(t *testing.T) {
+	secret := []byte("replication secret")
+	primary := freezertest.NewServerWithConfig(t, server.Config{ReplicationSecret: secret})
+	defer primary.Close()
+	secondary := freezertest.NewServerWithConfig(t, server.Config{
+		ReplicationSecret:   secret,
+		ReplicateFrom:       primary.URL,
+		ReplicationInterval: time.Hour,
+	})
+	defer secondary.Close()
+
+	// the replication routes only answer signed requests
+	resp, err := http.Get(primary.URL + "/replication/users")
+	if err != nil || resp.StatusCode != http.StatusUnauthorized {
+		t.Fatalf("Expected an unsigned replication request to be refused (%v): %v", resp, err)
+	}
+	resp.Body.Close()
+
+	cmdState := primary.NewUser(t, "standby", "1234", *flagCryptoPass)
+	original := genRandomBytes(freezertest.DefaultChunkSize*2 + 100)
+	for _, name := range []string{"keep.dat", "drop.dat"} {
+		localPath := filepath.Join(primary.Dir, name)
+		ioutil.WriteFile(localPath, original, 0644)
+		if _, _, err := cmdState.SyncFile(localPath, name, command.SyncCurrentVersion); err != nil {
+			t.Fatalf("Failed to sync %s: %v", name, err)
+		}
+	}
+
+	if err = secondary.Replicate(); err != nil {
+		t.Fatalf("Failed to replicate from the primary: %v", err)
+	}
+
+	// the user can log in to the secondary and restore the file with the same IDs
+	standbyState, err := secondary.NewClient("standby", "1234", *flagCryptoPass)
+	if err != nil {
+		t.Fatalf("Failed to log in to the secondary: %v", err)
+	}
+	primaryInfo, err := cmdState.GetFileInfoByFilename("keep.dat")
+	if err != nil {
+		t.Fatalf("Failed to get the file from the primary: %v", err)
+	}
+	standbyInfo, err := standbyState.GetFileInfoByFilename("keep.dat")
+	if err != nil || standbyInfo.FileID != primaryInfo.FileID || standbyInfo.CurrentVersion.VersionID != primaryInfo.CurrentVersion.VersionID {
+		t.Fatalf("Expected the secondary to have the file with the primary's IDs (%+v): %v", standbyInfo, err)
+	}
+	restorePath := filepath.Join(secondary.Dir, "keep.dat")
+	if _, _, err = standbyState.SyncFile(restorePath, "keep.dat", command.SyncCurrentVersion); err != nil {
+		t.Fatalf("Failed to restore the file from the secondary: %v", err)
+	}
+	restored, err := ioutil.ReadFile(restorePath)
+	if err != nil || !bytes.Equal(restored, original) {
+		t.Fatalf("The file restored from the secondary doesn't match the original: %v", err)
+	}
+
+	// removals on the primary are replicated too
+	if err = cmdState.RmFile("drop.dat", false); err != nil {
+		t.Fatalf("Failed to remove the file on the primary: %v", err)
+	}
+	if err = secondary.Replicate(); err != nil {
+		t.Fatalf("Failed to replicate the removal from the primary: %v", err)
+	}
+	if _, err = standbyState.GetFileInfoByFilename("drop.dat"); err == nil {
+		t.Fatal("Expected the removed file to be gone from the secondary.")
+	}
+	primaryStats, _ := primary.Storage.GetUserStats(primaryInfo.UserID)
+	standbyStats, err := secondary.Storage.GetUserStats(primaryInfo.UserID)
+	if err != nil || *standbyStats != *primaryStats {
+		t.Fatalf("Expected the secondary's stats (%+v) to match the primary's (%+v): %v", standbyStats, primaryStats, err)
+	}
+
+	if err = primary.Storage.RemoveUser("standby"); err != nil {
+		t.Fatalf("Failed to remove the user on the primary: %v", err)
+	}
+	if err = secondary.Replicate(); err != nil {
+		t.Fatalf("Failed to replicate the user removal from the primary: %v", err)
+	}
+	if _, err = secondary.Storage.GetUser("standby"); err == nil {
+		t.Fatal("Expected the removed user to be gone from the secondary.")
+	}
+}
+
+func TestReadOnlyReplica(t *testing.T) {
+	secret := []byte("replication secret")
+	primary := freezertest.NewServerWithConfig(t, server.Config{ReplicationSecret: secret})
+	defer primary.Close()
+	replica := freezertest.NewServerWithConfig(t, server.Config{
+		ReplicationSecret:   secret,
+		ReplicateFrom:       primary.URL,
+		ReplicationInterval: time.Hour,
+		ReadOnly:            true,
+	})
+	defer replica.Close()
+
+	cmdState := primary.NewUser(t, "restorer", "1234", *flagCryptoPass)
+	original := genRandomBytes(freezertest.DefaultChunkSize + 100)
+	localPath := filepath.Join(primary.Dir, "photo.jpg")
+	ioutil.WriteFile(localPath, original, 0644)
+	if _, _, err := cmdState.SyncFile(localPath, "photo.jpg", command.SyncCurrentVersion); err != nil {
+		t.Fatalf("Failed to sync the file to the primary: %v", err)
+	}
+	if err := replica.Replicate(); err != nil {
+		t.Fatalf("Failed to replicate from the primary: %v", err)
+	}
+
+	replicaState, err := replica.NewClient("restorer", "1234", *flagCryptoPass)
+	if err != nil {
+		t.Fatalf("Failed to log in to the read-only replica: %v", err)
+	}
+	if !replicaState.ServerCapabilities.Supports(models.FeatureReadOnly) {
+		t.Fatal("Expected the replica to report that it's read-only.")
+	}
+
+	// listings and downloads work
+	files, err := replicaState.GetAllFileHashes()
+	if err != nil || len(files) != 1 {
+		t.Fatalf("Expected to list the replicated file (%d): %v", len(files), err)
+	}
+	restorePath := filepath.Join(replica.Dir, "photo.jpg")
+	if _, _, err = replicaState.SyncFile(restorePath, "photo.jpg", command.SyncCurrentVersion); err != nil {
+		t.Fatalf("Failed to restore the file from the replica: %v", err)
+	}
+	restored, err := ioutil.ReadFile(restorePath)
+	if err != nil || !bytes.Equal(restored, original) {
+		t.Fatalf("The file restored from the replica doesn't match the original: %v", err)
+	}
+
+	// changes are refused
+	newPath := filepath.Join(replica.Dir, "new.txt")
+	ioutil.WriteFile(newPath, []byte("new"), 0644)
+	if _, _, err = replicaState.SyncFile(newPath, "new.txt", command.SyncCurrentVersion); err == nil {
+		t.Fatal("Expected uploading a new file to the replica to fail.")
+	}
+	if err = replicaState.RmFile("photo.jpg", false); err == nil {
+		t.Fatal("Expected removing a file on the replica to fail.")
+	}
+	if files, _ = replicaState.GetAllFileHashes(); len(files) != 1 {
+		t.Fatalf("Expected the replica to still have only the replicated file but it has %d.", len(files))
+	}
+}
+
+func TestSnapshot(t *testing.T) {
+	snapshotDir, err := ioutil.TempDir("", "freezersnapshot")
+	if err != nil {
+		t.Fatalf("Failed to create the snapshot directory: %v", err)
+	}
+	defer os.RemoveAll(snapshotDir)
+
+	srv := freezertest.NewServerWithConfig(t, server.Config{
+		AdminToken:  "admin secret",
+		SnapshotDir: snapshotDir,
+	})
+	defer srv.Close()
+	cmdState := srv.NewUser(t, "backedup", "1234", *flagCryptoPass)
+
+	localPath := filepath.Join(srv.Dir, "data.bin")
+	ioutil.WriteFile(localPath, genRandomBytes(freezertest.DefaultChunkSize*2+100), 0644)
+	if _, _, err = cmdState.SyncFile(localPath, "data.bin", command.SyncCurrentVersion); err != nil {
+		t.Fatalf("Failed to sync the file: %v", err)
+	}
+
+	snapshot := func(token string) (*http.Response, error) {
+		req, _ := http.NewRequest("POST", srv.URL+"/admin/snapshot", nil)
+		req.Header.Set("Authorization", "Bearer "+token)
+		return http.DefaultClient.Do(req)
+	}
+
+	resp, err := snapshot("guess")
+	if err != nil || resp.StatusCode != http.StatusUnauthorized {
+		t.Fatalf("Expected a snapshot without the admin token to be refused (%v): %v", resp, err)
+	}
+	resp.Body.Close()
+
+	resp, err = snapshot("admin secret")
+	if err != nil || resp.StatusCode != http.StatusOK {
+		t.Fatalf("Failed to make a snapshot (%v): %v", resp, err)
+	}
+	var snap models.SnapshotResponse
+	err = json.NewDecoder(resp.Body).Decode(&snap)
+	resp.Body.Close()
+	if err != nil || snap.ChunkCount != 3 {
+		t.Fatalf("Expected the snapshot to reference the 3 chunks of the file (%+v): %v", snap, err)
+	}
+
+	// the manifest ties the database copy to the chunks
+	data, err := ioutil.ReadFile(snap.Manifest)
+	if err != nil {
+		t.Fatalf("Failed to read the snapshot manifest: %v", err)
+	}
+	var manifest models.SnapshotManifest
+	if err = json.Unmarshal(data, &manifest); err != nil || len(manifest.Chunks) != 3 || manifest.DBVersion != filefreezer.CurrentDBVersion {
+		t.Fatalf("The snapshot manifest doesn't match the snapshot (%+v): %v", manifest, err)
+	}
+	if filepath.Join(snapshotDir, manifest.Database) != snap.Database {
+		t.Fatalf("The manifest names %s but the snapshot is %s.", manifest.Database, snap.Database)
+	}
+
+	// the copy can be opened on its own and has the same chunks
+	copied, err := filefreezer.NewStorage(snap.Database)
+	if err != nil {
+		t.Fatalf("Failed to open the database snapshot: %v", err)
+	}
+	defer copied.Close()
+	user, err := copied.GetUser("backedup")
+	if err != nil {
+		t.Fatalf("Failed to get the user from the database snapshot: %v", err)
+	}
+	logical, _, err := copied.GetUserChunkUsage(user.ID)
+	if err != nil || int64(logical) != snap.ChunkBytes {
+		t.Fatalf("Expected the snapshot to hold %d bytes of chunks but it has %d: %v", snap.ChunkBytes, logical, err)
+	}
+}
+
+func TestFsck(t *testing.T) {
+	chunkDir, err := ioutil.TempDir("", "freezerfsck")
+	if err != nil {
+		t.Fatalf("Failed to create the chunk store directory: %v", err)
+	}
+	defer os.RemoveAll(chunkDir)
+
+	srv := freezertest.NewServerWithConfig(t, server.Config{
+		ChunkStores: []string{"file://" + filepath.ToSlash(chunkDir)},
+	})
+	defer srv.Close()
+	cmdState := srv.NewUser(t, "checked", "1234", *flagCryptoPass)
+	store := srv.Storage.(*filefreezer.Storage)
+
+	localPath := filepath.Join(srv.Dir, "data.bin")
+	ioutil.WriteFile(localPath, genRandomBytes(freezertest.DefaultChunkSize*2+100), 0644)
+	if _, _, err = cmdState.SyncFile(localPath, "data.bin", command.SyncCurrentVersion); err != nil {
+		t.Fatalf("Failed to sync the file: %v", err)
+	}
+	fi, err := cmdState.GetFileInfoByFilename("data.bin")
+	if err != nil {
+		t.Fatalf("Failed to get the file info: %v", err)
+	}
+
+	report, err := cmdState.Fsck(store, filefreezer.CheckOptions{})
+	if err != nil || len(report.Problems) != 0 || report.Chunks != 3 {
+		t.Fatalf("Expected a clean check of 3 chunks (%+v): %v", report, err)
+	}
+
+	// lose the data of the first chunk and corrupt the second
+	chunkPath := func(n int) string {
+		return filepath.Join(chunkDir, "chunks", fmt.Sprintf("%d", fi.FileID), fmt.Sprintf("%d", fi.CurrentVersion.VersionID), fmt.Sprintf("%d", n))
+	}
+	if err = os.Remove(chunkPath(0)); err != nil {
+		t.Fatalf("Failed to remove the chunk data: %v", err)
+	}
+	data, err := ioutil.ReadFile(chunkPath(1))
+	if err != nil {
+		t.Fatalf("Failed to read the chunk data: %v", err)
+	}
+	data[0] ^= 0xff
+	ioutil.WriteFile(chunkPath(1), data, 0600)
+
+	report, err = cmdState.Fsck(store, filefreezer.CheckOptions{SkipData: true})
+	if err != nil || len(report.Problems) != 0 {
+		t.Fatalf("Expected a quick check not to read the chunk data (%+v): %v", report, err)
+	}
+
+	report, err = cmdState.Fsck(store, filefreezer.CheckOptions{})
+	if err != nil || len(report.Problems) != 2 {
+		t.Fatalf("Expected the missing and corrupt chunks to be found (%+v): %v", report, err)
+	}
+	if report.Problems[0].Kind != filefreezer.CheckMissingData || report.Problems[1].Kind != filefreezer.CheckCorruptData || report.Problems[0].Repaired {
+		t.Fatalf("Unexpected problems found: %+v", report.Problems)
+	}
+
+	report, err = cmdState.Fsck(store, filefreezer.CheckOptions{Repair: true})
+	if err != nil || len(report.Problems) != 2 || !report.Problems[0].Repaired || !report.Problems[1].Repaired {
+		t.Fatalf("Expected the chunks to be repaired (%+v): %v", report, err)
+	}
+
+	// the bad chunks are gone so the next sync uploads them again
+	report, err = cmdState.Fsck(store, filefreezer.CheckOptions{})
+	if err != nil || len(report.Problems) != 0 || report.Chunks != 1 {
+		t.Fatalf("Expected a clean check after the repair (%+v): %v", report, err)
+	}
+}
+
+func TestQuotaWarnings(t *testing.T) {
+	warnings := make(chan models.QuotaWarning, 4)
+	webhook := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var warning models.QuotaWarning
+		json.NewDecoder(r.Body).Decode(&warning)
+		warnings <- warning
+	}))
+	defer webhook.Close()
+
+	srv := freezertest.NewServerWithConfig(t, server.Config{
+		QuotaWarnings: []int{50, 90},
+		QuotaWebhook:  webhook.URL,
+	})
+	defer srv.Close()
+	cmdState := srv.NewUser(t, "nearlyfull", "1234", *flagCryptoPass)
+	cmdState.Notices = make(chan string, 4)
+	user, err := srv.Storage.GetUser("nearlyfull")
+	if err != nil {
+		t.Fatalf("Failed to get the user: %v", err)
+	}
+	err = srv.Storage.SetUserQuota(user.ID, freezertest.DefaultChunkSize*4)
+	if err != nil {
+		t.Fatalf("Failed to set the user's quota: %v", err)
+	}
+
+	// a little over half of the quota crosses the first threshold
+	localPath := filepath.Join(srv.Dir, "data.bin")
+	ioutil.WriteFile(localPath, genRandomBytes(freezertest.DefaultChunkSize*2+100), 0644)
+	if _, _, err = cmdState.SyncFile(localPath, "data.bin", command.SyncCurrentVersion); err != nil {
+		t.Fatalf("Failed to sync the file: %v", err)
+	}
+	if cmdState.QuotaWarning != 50 {
+		t.Fatalf("Expected the client to be warned about the 50%% threshold but got %d.", cmdState.QuotaWarning)
+	}
+	select {
+	case notice := <-cmdState.Notices:
+		if !strings.Contains(notice, "50%") {
+			t.Fatalf("Unexpected quota notice: %s", notice)
+		}
+	default:
+		t.Fatal("Expected a notice about the quota.")
+	}
+
+	select {
+	case warning := <-warnings:
+		if warning.Name != "nearlyfull" || warning.Threshold != 50 || warning.Percent < 50 {
+			t.Fatalf("Unexpected quota warning posted to the webhook: %+v", warning)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("Expected the quota warning to be posted to the webhook.")
+	}
+
+	// logging in again warns the client without reporting the user again
+	cmdState2, err := srv.NewClient("nearlyfull", "1234", *flagCryptoPass)
+	if err != nil {
+		t.Fatalf("Failed to log in again: %v", err)
+	}
+	if cmdState2.QuotaWarning != 50 {
+		t.Fatalf("Expected the login to carry the quota warning but got %d.", cmdState2.QuotaWarning)
+	}
+	select {
+	case warning := <-warnings:
+		t.Fatalf("Expected the threshold to only be reported once but got %+v", warning)
+	case <-time.After(100 * time.Millisecond):
+	}
+}
+
+func TestUserBandwidth(t *testing.T) {
+	srv := freezertest.NewServer(t)
+	defer srv.Close()
+	cmdState := srv.NewUser(t, "metered", "1234", *flagCryptoPass)
+	cmdState.Printf = t.Logf
+
+	size := freezertest.DefaultChunkSize*2 + 100
+	localPath := filepath.Join(srv.Dir, "data.bin")
+	ioutil.WriteFile(localPath, genRandomBytes(size), 0644)
+	if _, _, err := cmdState.SyncFile(localPath, "data.bin", command.SyncCurrentVersion); err != nil {
+		t.Fatalf("Failed to sync the file: %v", err)
+	}
+	os.Remove(localPath)
+	if _, _, err := cmdState.SyncFile(localPath, "data.bin", command.SyncCurrentVersion); err != nil {
+		t.Fatalf("Failed to download the file: %v", err)
+	}
+
+	// the encrypted chunks are a little larger than the file both ways
+	days, err := cmdState.GetUserBandwidth(1)
+	if err != nil || len(days) != 1 {
+		t.Fatalf("Expected the bandwidth for today (%v): %v", days, err)
+	}
+	today := time.Now().UTC().Format(filefreezer.BandwidthDayFormat)
+	if days[0].Day != today || days[0].Requests < 4 || days[0].Uploaded < int64(size) || days[0].Downloaded < int64(size) {
+		t.Fatalf("Expected the upload and download of %d bytes on %s but got %+v.", size, today, days[0])
+	}
+}
+
+func TestEgressLimit(t *testing.T) {
+	srv := freezertest.NewServerWithConfig(t, server.Config{
+		MaxEgress: freezertest.DefaultChunkSize,
+	})
+	defer srv.Close()
+	cmdState := srv.NewUser(t, "downloader", "1234", *flagCryptoPass)
+	user, err := srv.Storage.GetUser("downloader")
+	if err != nil {
+		t.Fatalf("Failed to get the user: %v", err)
+	}
+
+	// uploads don't count against the limit
+	localPath := filepath.Join(srv.Dir, "data.bin")
+	ioutil.WriteFile(localPath, genRandomBytes(freezertest.DefaultChunkSize*2+100), 0644)
+	if _, _, err = cmdState.SyncFile(localPath, "data.bin", command.SyncCurrentVersion); err != nil {
+		t.Fatalf("Failed to sync the file: %v", err)
+	}
+
+	// the first chunk takes the user to the limit and the next is refused
+	os.Remove(localPath)
+	_, _, err = cmdState.SyncFile(localPath, "data.bin", command.SyncCurrentVersion)
+	if err == nil || !strings.Contains(err.Error(), "monthly download limit") {
+		t.Fatalf("Expected the download to be stopped by the egress limit: %v", err)
+	}
+
+	// the user's own limit replaces the server's
+	if err = srv.Storage.SetUserMaxEgress(user.ID, freezertest.DefaultChunkSize*10); err != nil {
+		t.Fatalf("Failed to set the user's egress limit: %v", err)
+	}
+	os.Remove(localPath)
+	if _, _, err = cmdState.SyncFile(localPath, "data.bin", command.SyncCurrentVersion); err != nil {
+		t.Fatalf("Failed to download the file with a larger limit: %v", err)
+	}
+}
+
+func TestRechunk(t *testing.T) {
+	srv := freezertest.NewServer(t)
+	defer srv.Close()
+	cmdState := srv.NewUser(t, "rechunker", "1234", *flagCryptoPass)
+	user, err := srv.Storage.GetUser("rechunker")
+	if err != nil {
+		t.Fatalf("Failed to get the user: %v", err)
+	}
+
+	data := genRandomBytes(freezertest.DefaultChunkSize*3 + freezertest.DefaultChunkSize/2)
+	localPath := filepath.Join(srv.Dir, "data.bin")
+	ioutil.WriteFile(localPath, data, 0644)
+	if _, _, err = cmdState.SyncFile(localPath, "data.bin", command.SyncCurrentVersion); err != nil {
+		t.Fatalf("Failed to sync the file: %v", err)
+	}
+	original, err := cmdState.GetFileInfoByFilename("data.bin")
+	if err != nil || original.CurrentVersion.ChunkCount != 4 {
+		t.Fatalf("Expected the file to be uploaded in 4 chunks (%+v): %v", original.CurrentVersion, err)
+	}
+
+	// nothing needs rechunking until the chunk size changes
+	if count, err := cmdState.Rechunk(0); err != nil || count != 0 {
+		t.Fatalf("Expected no files to be rechunked but got %d: %v", count, err)
+	}
+	srv.Storage.(*filefreezer.Storage).ChunkSize = freezertest.DefaultChunkSize / 2
+	cmdState, err = srv.NewClient("rechunker", "1234", *flagCryptoPass)
+	if err != nil {
+		t.Fatalf("Failed to log in again: %v", err)
+	}
+
+	count, err := cmdState.Rechunk(0)
+	if err != nil || count != 1 {
+		t.Fatalf("Expected the file to be rechunked but got %d: %v", count, err)
+	}
+	rechunked, err := cmdState.GetFileInfoByFilename("data.bin")
+	if err != nil || rechunked.CurrentVersion.ChunkCount != 7 || rechunked.CurrentVersion.VersionNumber != 2 {
+		t.Fatalf("Expected a second version with 7 chunks (%+v): %v", rechunked.CurrentVersion, err)
+	}
+	if rechunked.CurrentVersion.FileHash != original.CurrentVersion.FileHash || rechunked.CurrentVersion.LastMod != original.CurrentVersion.LastMod {
+		t.Fatalf("Rechunking shouldn't change the file hash or modification time (%+v).", rechunked.CurrentVersion)
+	}
+	if count, err = cmdState.Rechunk(0); err != nil || count != 0 {
+		t.Fatalf("Expected no files to be rechunked again but got %d: %v", count, err)
+	}
+
+	// an interrupted rechunk leaves a version without chunks that gets resumed
+	v := rechunked.CurrentVersion
+	_, err = srv.Storage.TagNewFileVersion(user.ID, rechunked.FileID, v.Permissions, v.LastMod, 0, "", "")
+	if err != nil {
+		t.Fatalf("Failed to tag an unfinished version: %v", err)
+	}
+	if count, err = cmdState.Rechunk(0); err != nil || count != 1 {
+		t.Fatalf("Expected the unfinished rechunk to be resumed but got %d: %v", count, err)
+	}
+	resumed, err := cmdState.GetFileInfoByFilename("data.bin")
+	if err != nil || resumed.CurrentVersion.ChunkCount != 7 || resumed.CurrentVersion.FileHash != original.CurrentVersion.FileHash {
+		t.Fatalf("Expected the resumed version to be finished (%+v): %v", resumed.CurrentVersion, err)
+	}
+
+	// the rechunked version downloads as the original data
+	os.Remove(localPath)
+	if _, _, err = cmdState.SyncFile(localPath, "data.bin", command.SyncCurrentVersion); err != nil {
+		t.Fatalf("Failed to download the rechunked file: %v", err)
+	}
+	downloaded, err := ioutil.ReadFile(localPath)
+	if err != nil || !bytes.Equal(downloaded, data) {
+		t.Fatalf("The rechunked file doesn't match the original: %v", err)
+	}
+}
+
+func TestRechunkShares(t *testing.T) {
+	srv := freezertest.NewServerWithConfig(t, server.Config{
+		ChunkSize:       8,
+		RechunkInterval: 10 * time.Millisecond,
+	})
+	defer srv.Close()
+	user, err := srv.AddUser("sharer", "1234")
+	if err != nil {
+		t.Fatalf("Failed to add the user: %v", err)
+	}
+
+	// the share was uploaded when the chunks were larger
+	share, err := srv.Storage.AddShare(user.ID, "shared.txt", 100, 2, "hash", "text/plain", nil, 0)
+	if err != nil {
+		t.Fatalf("Failed to add the share: %v", err)
+	}
+	srv.Storage.AddShareChunk(user.ID, share.ShareID, 0, []byte("0123456789abcdef"))
+	srv.Storage.AddShareChunk(user.ID, share.ShareID, 1, []byte("ghij"))
+
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		sizes, err := srv.Storage.GetShareChunkSizes(share.ShareID)
+		if err != nil {
+			t.Fatalf("Failed to get the share chunk sizes: %v", err)
+		}
+		if len(sizes) == 3 && sizes[0] == 8 && sizes[1] == 8 && sizes[2] == 4 {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("Expected the share to be rechunked but the chunk sizes are %v.", sizes)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	chunk, err := srv.Storage.GetShareChunk(share.ShareID, 1)
+	if err != nil || string(chunk) != "89abcdef" {
+		t.Fatalf("The rechunked share data doesn't match (%q): %v", chunk, err)
+	}
+}
+
+func TestVersionChunks(t *testing.T) {
+	srv := freezertest.NewServer(t)
+	defer srv.Close()
+	cmdState := srv.NewUser(t, "inspector", "1234", *flagCryptoPass)
+
+	for _, test := range []struct {
+		target  string
+		name    string
+		version int
+	}{
+		{"data.bin", "data.bin", 0},
+		{"data.bin@2", "data.bin", 2},
+		{"me@home.txt", "me@home.txt", 0},
+		{"me@home.txt@1", "me@home.txt", 1},
+		{"data.bin@0", "data.bin@0", 0},
+	} {
+		name, version := command.ParseVersionSpec(test.target)
+		if name != test.name || version != test.version {
+			t.Fatalf("Expected %s to parse as %s version %d but got %s version %d.", test.target, test.name, test.version, name, version)
+		}
+	}
+
+	data := genRandomBytes(freezertest.DefaultChunkSize*2 + 100)
+	localPath := filepath.Join(srv.Dir, "data.bin")
+	ioutil.WriteFile(localPath, data, 0644)
+	if _, _, err := cmdState.SyncFile(localPath, "data.bin", command.SyncCurrentVersion); err != nil {
+		t.Fatalf("Failed to sync the file: %v", err)
+	}
+
+	version, chunks, err := cmdState.GetVersionChunks("data.bin", 1)
+	if err != nil || version.VersionNumber != 1 || len(chunks) != 3 {
+		t.Fatalf("Expected the 3 chunks of version 1 (%+v): %v", chunks, err)
+	}
+	for i, c := range chunks {
+		if c.ChunkNumber != i || c.ChunkHash == "" || c.Length <= 0 {
+			t.Fatalf("Unexpected information for chunk #%d: %+v", i, c)
+		}
+	}
+	if _, _, err = cmdState.GetVersionChunks("data.bin", 5); err == nil {
+		t.Fatal("Expected an error for a version that doesn't exist.")
+	}
+
+	statuses, err := cmdState.CompareChunks(localPath, chunks, version.ChunkCount)
+	if err != nil || len(statuses) != 3 || statuses[0] != command.ChunkMatches || statuses[2] != command.ChunkMatches {
+		t.Fatalf("Expected every chunk to match the local file (%v): %v", statuses, err)
+	}
+
+	// change the middle chunk and add data past the end
+	data[freezertest.DefaultChunkSize+1]++
+	data = append(data, genRandomBytes(freezertest.DefaultChunkSize)...)
+	ioutil.WriteFile(localPath, data, 0644)
+	statuses, err = cmdState.CompareChunks(localPath, chunks, version.ChunkCount)
+	if err != nil || len(statuses) != 4 {
+		t.Fatalf("Expected a status for the 4 local chunks (%v): %v", statuses, err)
+	}
+	expected := []string{command.ChunkMatches, command.ChunkDiffers, command.ChunkDiffers, command.ChunkLocalOnly}
+	for i := range expected {
+		if statuses[i] != expected[i] {
+			t.Fatalf("Expected the statuses %v but got %v.", expected, statuses)
+		}
+	}
+}
+
+func TestFileLocks(t *testing.T) {
+	srv := freezertest.NewServer(t)
+	defer srv.Close()
+	laptop := srv.NewUser(t, "locker", "1234", *flagCryptoPass)
+	laptop.Device = "laptop"
+	desktop, err := srv.NewClient("locker", "1234", *flagCryptoPass)
+	if err != nil {
+		t.Fatalf("Failed to create a second client: %v", err)
+	}
+	desktop.Device = "desktop"
+
+	localPath := filepath.Join(srv.Dir, "notes.txt")
+	ioutil.WriteFile(localPath, genRandomBytes(100), 0644)
+	if _, _, err := laptop.SyncFile(localPath, "notes.txt", command.SyncCurrentVersion); err != nil {
+		t.Fatalf("Failed to sync the file: %v", err)
+	}
+
+	lock, err := laptop.LockFile("notes.txt", 10*time.Minute)
+	if err != nil || !lock.Mine || lock.Holder != "laptop" {
+		t.Fatalf("Expected the laptop to lock the file (%+v): %v", lock, err)
+	}
+
+	// the other device can't take the lock or release it
+	if _, err = desktop.LockFile("notes.txt", time.Minute); err == nil || !strings.Contains(err.Error(), "laptop") {
+		t.Fatalf("Expected the lock to be refused because the laptop holds it: %v", err)
+	}
+	if err = desktop.UnlockFile("notes.txt", false); err == nil {
+		t.Fatal("Expected the desktop to be unable to release the laptop's lock.")
+	}
+
+	// renewing keeps the lock with the laptop
+	renewed, err := laptop.LockFile("notes.txt", 20*time.Minute)
+	if err != nil || renewed.Created != lock.Created || renewed.Expires <= lock.Expires {
+		t.Fatalf("Expected the lock to be renewed (%+v): %v", renewed, err)
+	}
+
+	locks, err := desktop.GetFileLocks()
+	if err != nil || len(locks) != 1 || locks[0].FileName != "notes.txt" || locks[0].Holder != "laptop" || locks[0].Mine {
+		t.Fatalf("Expected the desktop to see the laptop's lock (%+v): %v", locks, err)
+	}
+
+	// syncing a change from the desktop is refused while the file is locked
+	ioutil.WriteFile(localPath, genRandomBytes(200), 0644)
+	later := time.Now().Add(time.Hour)
+	os.Chtimes(localPath, later, later)
+	if _, _, err = desktop.SyncFile(localPath, "notes.txt", command.SyncCurrentVersion); err == nil {
+		t.Fatal("Expected the desktop's sync to be refused while the file is locked.")
+	}
+	if _, _, err = laptop.SyncFile(localPath, "notes.txt", command.SyncCurrentVersion); err != nil {
+		t.Fatalf("Expected the lock holder to sync the file: %v", err)
+	}
+
+	// a forced unlock releases another device's lock
+	if err = desktop.UnlockFile("notes.txt", true); err != nil {
+		t.Fatalf("Failed to force the lock to be released: %v", err)
+	}
+	locks, err = laptop.GetFileLocks()
+	if err != nil || len(locks) != 0 {
+		t.Fatalf("Expected no locks after the forced unlock (%+v): %v", locks, err)
+	}
+	if err = laptop.UnlockFile("notes.txt", false); err == nil {
+		t.Fatal("Expected an error releasing a lock that isn't held.")
+	}
+}
+
+func TestSyncConflicts(t *testing.T) {
+	day := time.Date(2017, 5, 1, 12, 0, 0, 0, time.Local)
+	for _, test := range []struct {
+		name     string
+		n        int
+		expected string
+	}{
+		{"notes.txt", 1, "notes (conflicted copy from laptop 2017-05-01).txt"},
+		{"docs/notes.tar.gz", 2, "docs/notes.tar (conflicted copy 2 from laptop 2017-05-01).gz"},
+		{"docs/.bashrc", 1, "docs/.bashrc (conflicted copy from laptop 2017-05-01)"},
+		{"Makefile", 1, "Makefile (conflicted copy from laptop 2017-05-01)"},
+	} {
+		name := command.ConflictedCopyName(test.name, "laptop", day, test.n)
+		if name != test.expected {
+			t.Fatalf("Expected the conflicted copy of %s to be %s but got %s.", test.name, test.expected, name)
+		}
+	}
+
+	srv := freezertest.NewServer(t)
+	defer srv.Close()
+	laptop := srv.NewUser(t, "conflicted", "1234", *flagCryptoPass)
+	laptop.Device = "laptop"
+	laptop.SyncStateFile = filepath.Join(srv.Dir, "laptop.json")
+	desktop, err := srv.NewClient("conflicted", "1234", *flagCryptoPass)
+	if err != nil {
+		t.Fatalf("Failed to create a second client: %v", err)
+	}
+	desktop.Device = "desktop"
+	desktop.SyncStateFile = filepath.Join(srv.Dir, "desktop.json")
+
+	laptopPath := filepath.Join(srv.Dir, "laptop-notes.txt")
+	desktopPath := filepath.Join(srv.Dir, "desktop-notes.txt")
+	ioutil.WriteFile(laptopPath, genRandomBytes(100), 0644)
+	if _, _, err := laptop.SyncFile(laptopPath, "notes.txt", command.SyncCurrentVersion); err != nil {
+		t.Fatalf("Failed to sync the file from the laptop: %v", err)
+	}
+	if _, _, err := desktop.SyncFile(desktopPath, "notes.txt", command.SyncCurrentVersion); err != nil {
+		t.Fatalf("Failed to sync the file to the desktop: %v", err)
+	}
+
+	// the desktop's change reaches the server first
+	desktopData := genRandomBytes(200)
+	ioutil.WriteFile(desktopPath, desktopData, 0644)
+	later := time.Now().Add(time.Hour)
+	os.Chtimes(desktopPath, later, later)
+	status, _, err := desktop.SyncFile(desktopPath, "notes.txt", command.SyncCurrentVersion)
+	if err != nil || status != command.SyncStatusLocalNewer {
+		t.Fatalf("Expected the desktop's change to be uploaded (%d): %v", status, err)
+	}
+
+	// the laptop's change is newer but wasn't made to the desktop's version
+	laptopData := genRandomBytes(300)
+	ioutil.WriteFile(laptopPath, laptopData, 0644)
+	latest := time.Now().Add(2 * time.Hour)
+	os.Chtimes(laptopPath, latest, latest)
+	status, _, err = laptop.SyncFile(laptopPath, "notes.txt", command.SyncCurrentVersion)
+	if err != nil || status != command.SyncStatusConflict {
+		t.Fatalf("Expected the laptop's sync to find a conflict (%d): %v", status, err)
+	}
+
+	data, _ := ioutil.ReadFile(laptopPath)
+	if !bytes.Equal(data, desktopData) {
+		t.Fatal("Expected the laptop's file to have the desktop's data after the conflict.")
+	}
+	copyPath := command.ConflictedCopyName(laptopPath, "laptop", time.Now(), 1)
+	data, _ = ioutil.ReadFile(copyPath)
+	if !bytes.Equal(data, laptopData) {
+		t.Fatal("Expected the laptop's change to be kept in the local conflicted copy.")
+	}
+	remoteCopy := command.ConflictedCopyName("notes.txt", "laptop", time.Now(), 1)
+	downloadPath := filepath.Join(srv.Dir, "downloaded.txt")
+	if _, _, err = desktop.SyncFile(downloadPath, remoteCopy, command.SyncCurrentVersion); err != nil {
+		t.Fatalf("Failed to download the conflicted copy: %v", err)
+	}
+	data, _ = ioutil.ReadFile(downloadPath)
+	if !bytes.Equal(data, laptopData) {
+		t.Fatal("Expected the laptop's change to be kept in the conflicted copy on the server.")
+	}
+
+	// with the conflict resolved the next sync finds nothing to do
+	status, _, err = laptop.SyncFile(laptopPath, "notes.txt", command.SyncCurrentVersion)
+	if err != nil || status != command.SyncStatusSame {
+		t.Fatalf("Expected the file to be in sync after the conflict (%d): %v", status, err)
+	}
+}
+
+func TestSyncMerge(t *testing.T) {
+	srv := freezertest.NewServer(t)
+	defer srv.Close()
+	laptop := srv.NewUser(t, "merger", "1234", *flagCryptoPass)
+	laptop.Device = "laptop"
+	laptop.SyncStateFile = filepath.Join(srv.Dir, "laptop.json")
+	desktop, err := srv.NewClient("merger", "1234", *flagCryptoPass)
+	if err != nil {
+		t.Fatalf("Failed to create a second client: %v", err)
+	}
+	desktop.Device = "desktop"
+	desktop.SyncStateFile = filepath.Join(srv.Dir, "desktop.json")
+
+	laptopPath := filepath.Join(srv.Dir, "laptop-todo.txt")
+	desktopPath := filepath.Join(srv.Dir, "desktop-todo.txt")
+	lines := []string{"milk\n", "eggs\n", "bread\n", "flour\n", "sugar\n", "butter\n", "salt\n"}
+	ioutil.WriteFile(laptopPath, []byte(strings.Join(lines, "")), 0644)
+	if _, _, err := laptop.SyncFile(laptopPath, "todo.txt", command.SyncCurrentVersion); err != nil {
+		t.Fatalf("Failed to sync the file from the laptop: %v", err)
+	}
+	if _, _, err := desktop.SyncFile(desktopPath, "todo.txt", command.SyncCurrentVersion); err != nil {
+		t.Fatalf("Failed to sync the file to the desktop: %v", err)
+	}
+
+	// change different lines on each side
+	edit := func(path string, offset time.Duration, change func([]string) []string) {
+		edited := change(append([]string(nil), lines...))
+		ioutil.WriteFile(path, []byte(strings.Join(edited, "")), 0644)
+		when := time.Now().Add(offset)
+		os.Chtimes(path, when, when)
+	}
+	edit(desktopPath, time.Hour, func(l []string) []string {
+		l[1] = "a dozen eggs\n"
+		return l
+	})
+	status, _, err := desktop.SyncFile(desktopPath, "todo.txt", command.SyncCurrentVersion)
+	if err != nil || status != command.SyncStatusLocalNewer {
+		t.Fatalf("Expected the desktop's change to be uploaded (%d): %v", status, err)
+	}
+	edit(laptopPath, 2*time.Hour, func(l []string) []string {
+		return append(l[:6], "coffee\n", "salt\n")
+	})
+	status, _, err = laptop.SyncFile(laptopPath, "todo.txt", command.SyncCurrentVersion)
+	if err != nil || status != command.SyncStatusMerged {
+		t.Fatalf("Expected the laptop's sync to merge the changes (%d): %v", status, err)
+	}
+
+	expected := "milk\na dozen eggs\nbread\nflour\nsugar\nbutter\ncoffee\nsalt\n"
+	data, _ := ioutil.ReadFile(laptopPath)
+	if string(data) != expected {
+		t.Fatalf("Expected the merged file to have both changes but got:\n%s", data)
+	}
+	status, _, err = desktop.SyncFile(desktopPath, "todo.txt", command.SyncCurrentVersion)
+	data, _ = ioutil.ReadFile(desktopPath)
+	if err != nil || status != command.SyncStatusRemoteNewer || string(data) != expected {
+		t.Fatalf("Expected the desktop to download the merged version (%d): %v", status, err)
+	}
+
+	// changing the same line on both sides can't be merged
+	lines = strings.SplitAfter(expected, "\n")
+	lines = lines[:len(lines)-1]
+	edit(desktopPath, 3*time.Hour, func(l []string) []string {
+		l[0] = "oat milk\n"
+		return l
+	})
+	if _, _, err = desktop.SyncFile(desktopPath, "todo.txt", command.SyncCurrentVersion); err != nil {
+		t.Fatalf("Failed to sync the desktop's change: %v", err)
+	}
+	edit(laptopPath, 4*time.Hour, func(l []string) []string {
+		l[0] = "soy milk\n"
+		return l
+	})
+	status, _, err = laptop.SyncFile(laptopPath, "todo.txt", command.SyncCurrentVersion)
+	if err != nil || status != command.SyncStatusConflict {
+		t.Fatalf("Expected the laptop's sync to fall back to a conflicted copy (%d): %v", status, err)
+	}
+	data, _ = ioutil.ReadFile(command.ConflictedCopyName(laptopPath, "laptop", time.Now(), 1))
+	if !strings.HasPrefix(string(data), "soy milk\n") {
+		t.Fatalf("Expected the laptop's change to be kept in the conflicted copy but got:\n%s", data)
+	}
+}
+
+func TestSyncState(t *testing.T) {
+	srv := freezertest.NewServer(t)
+	defer srv.Close()
+	cmdState := srv.NewUser(t, "stateful", "1234", *flagCryptoPass)
+	cmdState.SyncStateFile = filepath.Join(srv.Dir, "state.json")
+
+	localPath := filepath.Join(srv.Dir, "report.txt")
+	ioutil.WriteFile(localPath, genRandomBytes(500), 0644)
+	modTime := time.Now().Add(-time.Hour).Truncate(time.Second)
+	os.Chtimes(localPath, modTime, modTime)
+	if _, _, err := cmdState.SyncFile(localPath, "report.txt", command.SyncCurrentVersion); err != nil {
+		t.Fatalf("Failed to sync the file: %v", err)
+	}
+
+	// the state is kept by the absolute path of the local file
+	data, err := ioutil.ReadFile(cmdState.SyncStateFile)
+	if err != nil {
+		t.Fatalf("Failed to read the sync state: %v", err)
+	}
+	var state map[string]map[string]command.SyncedFile
+	if err = json.Unmarshal(data, &state); err != nil {
+		t.Fatalf("Failed to parse the sync state: %v", err)
+	}
+	absPath, _ := filepath.Abs(localPath)
+	synced := state[cmdState.HostURI][absPath]
+	if synced.RemotePath != "report.txt" || synced.VersionNumber != 1 || synced.VersionID == 0 ||
+		synced.Hash == "" || synced.Size != 500 || synced.LastMod != modTime.Unix() {
+		t.Fatalf("Unexpected sync state for the file: %+v", synced)
+	}
+
+	// a file with the same size and modification time isn't hashed again, so
+	// a change that keeps both is only found once the file is touched
+	ioutil.WriteFile(localPath, genRandomBytes(500), 0644)
+	os.Chtimes(localPath, modTime, modTime)
+	status, _, err := cmdState.SyncFile(localPath, "report.txt", command.SyncCurrentVersion)
+	if err != nil || status != command.SyncStatusSame {
+		t.Fatalf("Expected the file to be trusted as unchanged (%d): %v", status, err)
+	}
+	touched := modTime.Add(time.Minute)
+	os.Chtimes(localPath, touched, touched)
+	status, _, err = cmdState.SyncFile(localPath, "report.txt", command.SyncCurrentVersion)
+	if err != nil || status != command.SyncStatusLocalNewer {
+		t.Fatalf("Expected the touched file to be hashed and uploaded (%d): %v", status, err)
+	}
+
+	// a new version on the server is noticed without the local file changing
+	fi, err := cmdState.GetFileInfoByFilename("report.txt")
+	if err != nil || fi.CurrentVersion.VersionNumber != 2 {
+		t.Fatalf("Expected the change to be uploaded as version 2 (%+v): %v", fi.CurrentVersion, err)
+	}
+	otherPath := filepath.Join(srv.Dir, "other-report.txt")
+	ioutil.WriteFile(otherPath, genRandomBytes(600), 0644)
+	later := time.Now().Add(time.Hour)
+	os.Chtimes(otherPath, later, later)
+	other, err := srv.NewClient("stateful", "1234", *flagCryptoPass)
+	if err != nil {
+		t.Fatalf("Failed to create a second client: %v", err)
+	}
+	if _, _, err = other.SyncFile(otherPath, "report.txt", command.SyncCurrentVersion); err != nil {
+		t.Fatalf("Failed to sync the other client's change: %v", err)
+	}
+	status, _, err = cmdState.SyncFile(localPath, "report.txt", command.SyncCurrentVersion)
+	if err != nil || status != command.SyncStatusRemoteNewer {
+		t.Fatalf("Expected the other client's change to be downloaded (%d): %v", status, err)
+	}
+}
+
+func TestCheckSync(t *testing.T) {
+	srv := freezertest.NewServer(t)
+	defer srv.Close()
+	cmdState := srv.NewUser(t, "checker", "1234", *flagCryptoPass)
+
+	localDir := filepath.Join(srv.Dir, "docs")
+	os.MkdirAll(localDir, 0755)
+	ioutil.WriteFile(filepath.Join(localDir, "a.txt"), genRandomBytes(100), 0644)
+	ioutil.WriteFile(filepath.Join(localDir, "b.txt"), genRandomBytes(100), 0644)
+	if _, err := cmdState.SyncDirectory(localDir, "docs"); err != nil {
+		t.Fatalf("Failed to sync the directory: %v", err)
+	}
+
+	diffs, err := cmdState.CheckSync(localDir, "docs")
+	if err != nil || len(diffs) != 0 {
+		t.Fatalf("Expected no differences after syncing (%+v): %v", diffs, err)
+	}
+
+	// change a file, add one locally and add one on the server
+	later := time.Now().Add(time.Hour)
+	ioutil.WriteFile(filepath.Join(localDir, "a.txt"), genRandomBytes(200), 0644)
+	os.Chtimes(filepath.Join(localDir, "a.txt"), later, later)
+	ioutil.WriteFile(filepath.Join(localDir, "c.txt"), genRandomBytes(100), 0644)
+	otherPath := filepath.Join(srv.Dir, "d.txt")
+	ioutil.WriteFile(otherPath, genRandomBytes(100), 0644)
+	if _, _, err = cmdState.SyncFile(otherPath, "docs/d.txt", command.SyncCurrentVersion); err != nil {
+		t.Fatalf("Failed to upload a file to the server: %v", err)
+	}
+
+	before := cmdState.Stats.Counts()
+	diffs, err = cmdState.CheckSync(localDir, "docs")
+	if err != nil {
+		t.Fatalf("Failed to check the directory: %v", err)
+	}
+	expected := []command.SyncDifference{
+		{LocalPath: filepath.Join(localDir, "a.txt"), RemotePath: "docs/a.txt", Status: command.SyncDiffLocalNewer},
+		{LocalPath: filepath.Join(localDir, "c.txt"), RemotePath: "docs/c.txt", Status: command.SyncDiffLocalOnly},
+		{LocalPath: filepath.Join(localDir, "d.txt"), RemotePath: "docs/d.txt", Status: command.SyncDiffRemoteOnly},
+	}
+	if len(diffs) != len(expected) {
+		t.Fatalf("Expected %d differences but got %+v", len(expected), diffs)
+	}
+	for i := range expected {
+		if diffs[i] != expected[i] {
+			t.Fatalf("Expected difference %+v but got %+v", expected[i], diffs[i])
+		}
+	}
+	if after := cmdState.Stats.Counts(); after != before {
+		t.Fatalf("Expected no chunks to be transferred while checking (%+v, %+v)", before, after)
+	}
+
+	// a single file can be checked too
+	diffs, err = cmdState.CheckSync(filepath.Join(localDir, "b.txt"), "docs/b.txt")
+	if err != nil || len(diffs) != 0 {
+		t.Fatalf("Expected the unchanged file to have no differences (%+v): %v", diffs, err)
+	}
+}
+
+func TestEstimateSync(t *testing.T) {
+	srv := freezertest.NewServer(t)
+	defer srv.Close()
+	cmdState := srv.NewUser(t, "estimator", "1234", *flagCryptoPass)
+
+	localDir := filepath.Join(srv.Dir, "photos")
+	os.MkdirAll(localDir, 0755)
+	ioutil.WriteFile(filepath.Join(localDir, "old.jpg"), genRandomBytes(100), 0644)
+	if _, err := cmdState.SyncDirectory(localDir, "photos"); err != nil {
+		t.Fatalf("Failed to sync the directory: %v", err)
+	}
+
+	estimate, diffs, err := cmdState.EstimateSync(localDir, "photos")
+	if err != nil || estimate.Files != 0 || len(diffs) != 0 || estimate.UploadBytes != 0 || estimate.DownloadBytes != 0 {
+		t.Fatalf("Expected nothing to transfer after syncing (%+v): %v", estimate, err)
+	}
+
+	// a new local file is uploaded in full and a new remote one downloaded
+	newSize := freezertest.DefaultChunkSize*2 + 10
+	ioutil.WriteFile(filepath.Join(localDir, "new.jpg"), genRandomBytes(newSize), 0644)
+	otherPath := filepath.Join(srv.Dir, "shared.jpg")
+	ioutil.WriteFile(otherPath, genRandomBytes(100), 0644)
+	if _, _, err = cmdState.SyncFile(otherPath, "photos/shared.jpg", command.SyncCurrentVersion); err != nil {
+		t.Fatalf("Failed to upload a file to the server: %v", err)
+	}
+
+	before := cmdState.Stats.Counts()
+	estimate, diffs, err = cmdState.EstimateSync(localDir, "photos")
+	if err != nil || estimate.Files != 2 || len(diffs) != 2 {
+		t.Fatalf("Expected two files to sync (%+v, %+v): %v", estimate, diffs, err)
+	}
+	if estimate.UploadChunks != 3 || estimate.UploadBytes <= int64(newSize) {
+		t.Fatalf("Expected the new local file's 3 chunks to be uploaded: %+v", estimate)
+	}
+	if estimate.DownloadChunks != 1 || estimate.DownloadBytes < 100 {
+		t.Fatalf("Expected the new remote file's chunk to be downloaded: %+v", estimate)
+	}
+	if after := cmdState.Stats.Counts(); after != before {
+		t.Fatalf("Expected no chunks to be transferred while estimating (%+v, %+v)", before, after)
+	}
+}
+
+func TestPatchFile(t *testing.T) {
+	srv := freezertest.NewServer(t)
+	defer srv.Close()
+	cmdState := srv.NewUser(t, "patcher", "1234", *flagCryptoPass)
+
+	localPath := filepath.Join(srv.Dir, "disk.img")
+	data := genRandomBytes(freezertest.DefaultChunkSize*4 + 10)
+	ioutil.WriteFile(localPath, data, 0644)
+	if _, _, err := cmdState.SyncFile(localPath, "disk.img", command.SyncCurrentVersion); err != nil {
+		t.Fatalf("Failed to upload the file: %v", err)
+	}
+
+	// change a byte in the second chunk and grow the file by one chunk
+	data[freezertest.DefaultChunkSize+5]++
+	data = append(data, genRandomBytes(freezertest.DefaultChunkSize)...)
+	ioutil.WriteFile(localPath, data, 0644)
+
+	before := cmdState.Stats.Counts()
+	uploaded, err := cmdState.PatchFile(localPath, "disk.img")
+	if err != nil {
+		t.Fatalf("Failed to patch the file: %v", err)
+	}
+	if after := cmdState.Stats.Counts(); uploaded != 3 || after.ChunksUploaded-before.ChunksUploaded != 3 {
+		t.Fatalf("Expected the changed chunk and the two last ones to be uploaded but %d were.", uploaded)
+	}
+
+	versions, err := cmdState.GetFileVersions("disk.img")
+	if err != nil || len(versions) != 2 {
+		t.Fatalf("Expected the patch to add a second version (%d versions): %v", len(versions), err)
+	}
+
+	// the patched version has the whole file
+	downloadPath := filepath.Join(srv.Dir, "disk.download")
+	if _, _, err = cmdState.SyncFile(downloadPath, "disk.img", command.SyncCurrentVersion); err != nil {
+		t.Fatalf("Failed to download the patched file: %v", err)
+	}
+	downloaded, err := ioutil.ReadFile(downloadPath)
+	if err != nil || !bytes.Equal(downloaded, data) {
+		t.Fatalf("The patched version doesn't match the local file: %v", err)
+	}
+
+	// patching an unchanged file does nothing
+	uploaded, err = cmdState.PatchFile(localPath, "disk.img")
+	if err != nil || uploaded != 0 {
+		t.Fatalf("Patching an unchanged file shouldn't upload anything (%d): %v", uploaded, err)
+	}
+}
+
+func TestSyncAppend(t *testing.T) {
+	srv := freezertest.NewServer(t)
+	defer srv.Close()
+	cmdState := srv.NewUser(t, "appender", "1234", *flagCryptoPass)
+	cmdState.Policies = []command.SyncPolicy{{Pattern: "*.log", Append: true}}
+
+	localPath := filepath.Join(srv.Dir, "server.log")
+	data := genRandomBytes(freezertest.DefaultChunkSize*2 + 100)
+	ioutil.WriteFile(localPath, data, 0644)
+	if _, _, err := cmdState.SyncFile(localPath, "server.log", command.SyncCurrentVersion); err != nil {
+		t.Fatalf("Failed to upload the log: %v", err)
+	}
+
+	// only the partial last chunk and the appended one are uploaded
+	data = append(data, genRandomBytes(freezertest.DefaultChunkSize)...)
+	ioutil.WriteFile(localPath, data, 0644)
+	later := time.Now().Add(time.Minute)
+	os.Chtimes(localPath, later, later)
+	status, changes, err := cmdState.SyncFile(localPath, "server.log", command.SyncCurrentVersion)
+	if err != nil || status != command.SyncStatusLocalNewer || changes != 2 {
+		t.Fatalf("Expected the two last chunks to be uploaded (status %d, %d chunks): %v", status, changes, err)
+	}
+
+	downloadPath := filepath.Join(srv.Dir, "server.download")
+	if _, _, err = cmdState.SyncFile(downloadPath, "server.log", command.SyncCurrentVersion); err != nil {
+		t.Fatalf("Failed to download the log: %v", err)
+	}
+	downloaded, err := ioutil.ReadFile(downloadPath)
+	if err != nil || !bytes.Equal(downloaded, data) {
+		t.Fatalf("The appended version doesn't match the local log: %v", err)
+	}
+
+	// a rotated log isn't an append and is uploaded in full
+	data = genRandomBytes(freezertest.DefaultChunkSize*3 + 10)
+	ioutil.WriteFile(localPath, data, 0644)
+	later = later.Add(time.Minute)
+	os.Chtimes(localPath, later, later)
+	status, changes, err = cmdState.SyncFile(localPath, "server.log", command.SyncCurrentVersion)
+	if err != nil || status != command.SyncStatusLocalNewer || changes != 4 {
+		t.Fatalf("Expected the rotated log to be uploaded in full (status %d, %d chunks): %v", status, changes, err)
+	}
+}
+
+func TestFastCDC(t *testing.T) {
+	srv := freezertest.NewServerWithConfig(t, server.Config{Chunking: filefreezer.ChunkingFastCDC})
+	defer srv.Close()
+	cmdState := srv.NewUser(t, "fastcdc", "1234", *flagCryptoPass)
+	cmdState.Policies = []command.SyncPolicy{{Pattern: "*.log", Append: true}}
+
+	localPath := filepath.Join(srv.Dir, "disk.img")
+	data := genRandomBytes(freezertest.DefaultChunkSize * 16)
+	ioutil.WriteFile(localPath, data, 0644)
+	if _, _, err := cmdState.SyncFile(localPath, "disk.img", command.SyncCurrentVersion); err != nil {
+		t.Fatalf("Failed to upload the file: %v", err)
+	}
+	fi, err := cmdState.GetFileInfoByFilename("disk.img")
+	if err != nil || fi.CurrentVersion.ChunkCount < 32 {
+		t.Fatalf("Expected the chunks to average well under the chunk size (%d chunks): %v", fi.CurrentVersion.ChunkCount, err)
+	}
+
+	// inserting bytes moves the chunks after them, which are copied anyway
+	data = append(data[:500000], append([]byte("inserted"), data[500000:]...)...)
+	ioutil.WriteFile(localPath, data, 0644)
+	uploaded, err := cmdState.PatchFile(localPath, "disk.img")
+	if err != nil || uploaded == 0 || uploaded > 3 {
+		t.Fatalf("Expected only the chunks around the insert to be uploaded but %d were: %v", uploaded, err)
+	}
+	downloadPath := filepath.Join(srv.Dir, "disk.download")
+	if _, _, err = cmdState.SyncFile(downloadPath, "disk.img", command.SyncCurrentVersion); err != nil {
+		t.Fatalf("Failed to download the patched file: %v", err)
+	}
+	downloaded, err := ioutil.ReadFile(downloadPath)
+	if err != nil || !bytes.Equal(downloaded, data) {
+		t.Fatalf("The patched version doesn't match the local file: %v", err)
+	}
+
+	// appending to a log only uploads the chunks at its end
+	logPath := filepath.Join(srv.Dir, "server.log")
+	logData := genRandomBytes(freezertest.DefaultChunkSize * 4)
+	ioutil.WriteFile(logPath, logData, 0644)
+	if _, _, err = cmdState.SyncFile(logPath, "server.log", command.SyncCurrentVersion); err != nil {
+		t.Fatalf("Failed to upload the log: %v", err)
+	}
+	logData = append(logData, genRandomBytes(1000)...)
+	ioutil.WriteFile(logPath, logData, 0644)
+	later := time.Now().Add(time.Minute)
+	os.Chtimes(logPath, later, later)
+	status, changes, err := cmdState.SyncFile(logPath, "server.log", command.SyncCurrentVersion)
+	if err != nil || status != command.SyncStatusLocalNewer || changes == 0 || changes > 2 {
+		t.Fatalf("Expected the last chunk or two to be uploaded (status %d, %d chunks): %v", status, changes, err)
+	}
+}
+
+func TestClientErrors(t *testing.T) {
+	srv := freezertest.NewServer(t)
+	defer srv.Close()
+	laptop := srv.NewUser(t, "errors", "1234", *flagCryptoPass)
+	laptop.Device = "laptop"
+	desktop, err := srv.NewClient("errors", "1234", *flagCryptoPass)
+	if err != nil {
+		t.Fatalf("Failed to create a second client: %v", err)
+	}
+	desktop.Device = "desktop"
+
+	// missing files can be told apart from other failures
+	if _, err = laptop.GetFileInfoByFilename("missing.txt"); !errors.Is(err, command.ErrFileNotFound) {
+		t.Fatalf("Expected ErrFileNotFound getting a missing file: %v", err)
+	}
+	if err = laptop.RmFile("missing.txt", false); !errors.Is(err, command.ErrFileNotFound) {
+		t.Fatalf("Expected ErrFileNotFound removing a missing file: %v", err)
+	}
+
+	// a lock held by another device is a conflict
+	localPath := filepath.Join(srv.Dir, "locked.txt")
+	ioutil.WriteFile(localPath, genRandomBytes(100), 0644)
+	if _, _, err = laptop.SyncFile(localPath, "locked.txt", command.SyncCurrentVersion); err != nil {
+		t.Fatalf("Failed to sync the file: %v", err)
+	}
+	if _, err = laptop.LockFile("locked.txt", time.Minute); err != nil {
+		t.Fatalf("Failed to lock the file: %v", err)
+	}
+	_, err = desktop.LockFile("locked.txt", time.Minute)
+	var lockedErr *command.FileLockedError
+	if !errors.Is(err, command.ErrConflict) || !errors.As(err, &lockedErr) || lockedErr.Holder != "laptop" {
+		t.Fatalf("Expected ErrConflict locking a file held by the laptop: %v", err)
+	}
+
+	// a bad token is unauthorized and keeps the status
+	_, err = laptop.RunAuthRequest(laptop.HostURI+"/api/files", "GET", "bogus", nil)
+	var statusErr *command.StatusError
+	if !errors.Is(err, command.ErrUnauthorized) || !errors.As(err, &statusErr) || statusErr.StatusCode != http.StatusUnauthorized {
+		t.Fatalf("Expected ErrUnauthorized for a bad token: %v", err)
+	}
+	if errors.Is(err, command.ErrFileNotFound) || errors.Is(err, command.ErrConflict) {
+		t.Fatalf("An unauthorized request shouldn't match the other errors: %v", err)
+	}
+}
+
+func TestDictionaryTransforms(t *testing.T) {
+	if _, err := exec.LookPath("zstd"); err != nil {
+		t.Skip("zstd isn't installed")
+	}
+	srv := freezertest.NewServer(t)
+	defer srv.Close()
+	cmdState := srv.NewUser(t, "dictionary", "1234", *flagCryptoPass)
+
+	localDir := filepath.Join(srv.Dir, "events")
+	os.MkdirAll(localDir, 0755)
+	for i := 0; i < 40; i++ {
+		event := fmt.Sprintf(`{"id": %d, "user": "user%d", "event": "login", "status": "ok", "agent": "Mozilla/5.0 (X11; Linux x86_64)"}`, i, i)
+		ioutil.WriteFile(filepath.Join(localDir, fmt.Sprintf("e%d.json", i)), []byte(event), 0644)
+	}
+
+	if _, err := cmdState.TrainDictionary(localDir, "nowhere", 10); err == nil {
+		t.Fatal("Training a dictionary without enough small files should fail.")
+	}
+	samples, err := cmdState.TrainDictionary(localDir, "events", 64*1024)
+	if err != nil || samples != 40 {
+		t.Fatalf("Failed to train the dictionary on the 40 files (%d): %v", samples, err)
+	}
+
+	transform, err := command.ParseTransform(`\.json$=zstd -q -D {dict}|zstd -q -d -D {dict}`)
+	if err != nil {
+		t.Fatalf("Failed to parse the transform: %v", err)
+	}
+	cmdState.Transforms = []command.Transform{transform}
+	if _, err = cmdState.SyncDirectory(localDir, "events"); err != nil {
+		t.Fatalf("Failed to sync the directory: %v", err)
+	}
+
+	original, _ := ioutil.ReadFile(filepath.Join(localDir, "e7.json"))
+	_, chunks, err := cmdState.GetVersionChunks("events/e7.json", 0)
+	if err != nil || len(chunks) != 1 || chunks[0].Length >= int64(len(original)) {
+		t.Fatalf("Expected the file to be stored compressed with the dictionary (%v): %v", chunks, err)
+	}
+
+	// a file outside of the directory has no dictionary to use
+	otherPath := filepath.Join(srv.Dir, "other.json")
+	ioutil.WriteFile(otherPath, original, 0644)
+	if _, _, err = cmdState.SyncFile(otherPath, "other/other.json", command.SyncCurrentVersion); err == nil {
+		t.Fatal("Syncing a file without a dictionary for its directory should fail.")
+	}
+
+	// the files are decompressed with the dictionary when they're downloaded
+	restoreDir := filepath.Join(srv.Dir, "restored")
+	if _, err = cmdState.SyncDirectory(restoreDir, "events"); err != nil {
+		t.Fatalf("Failed to download the directory: %v", err)
+	}
+	restored, err := ioutil.ReadFile(filepath.Join(restoreDir, "e7.json"))
+	if err != nil || !bytes.Equal(restored, original) {
+		t.Fatalf("The downloaded file doesn't match the original: %v", err)
+	}
+}
+
+func TestTransformSkipsCompressedFormats(t *testing.T) {
+	srv := freezertest.NewServer(t)
+	defer srv.Close()
+	cmdState := srv.NewUser(t, "photographer", "1234", *flagCryptoPass)
+
+	// the transform fails if it's ever run
+	transform, err := command.ParseTransform(`\.jpg$=false|false`)
+	if err != nil {
+		t.Fatalf("Failed to parse the transform: %v", err)
+	}
+	cmdState.Transforms = []command.Transform{transform}
+
+	photoPath := filepath.Join(srv.Dir, "photo.jpg")
+	photo := append([]byte{0xFF, 0xD8, 0xFF, 0xE0}, genRandomBytes(1000)...)
+	ioutil.WriteFile(photoPath, photo, 0644)
+	if _, _, err = cmdState.SyncFile(photoPath, "photo.jpg", command.SyncCurrentVersion); err != nil {
+		t.Fatalf("A JPEG should be uploaded without being transformed: %v", err)
+	}
+
+	downloadPath := filepath.Join(srv.Dir, "photo.download.jpg")
+	if _, _, err = cmdState.SyncFile(downloadPath, "photo.jpg", command.SyncCurrentVersion); err != nil {
+		t.Fatalf("A JPEG should be downloaded without being transformed: %v", err)
+	}
+	downloaded, err := ioutil.ReadFile(downloadPath)
+	if err != nil || !bytes.Equal(downloaded, photo) {
+		t.Fatalf("The downloaded JPEG doesn't match the original: %v", err)
+	}
+
+	// a file that only has the extension is still transformed
+	fakePath := filepath.Join(srv.Dir, "fake.jpg")
+	ioutil.WriteFile(fakePath, []byte("not a photo"), 0644)
+	if _, _, err = cmdState.SyncFile(fakePath, "fake.jpg", command.SyncCurrentVersion); err == nil {
+		t.Fatal("A file that isn't in a compressed format should go through the transform.")
+	}
+}
+
+// lowPriorityTestEnv is set when TestCPULimit runs a copy of the test binary to
+// lower its priority, since a lower priority can't always be raised again.
+const lowPriorityTestEnv = "FREEZER_TEST_LOW_PRIORITY"
+
+func TestCPULimit(t *testing.T) {
+	if os.Getenv(lowPriorityTestEnv) != "" {
+		err := limitCPU(true, 0)
+		if err != nil {
+			t.Fatalf("Failed to lower the priority: %v", err)
+		}
+		if procs := runtime.GOMAXPROCS(0); procs != 1 {
+			t.Fatalf("Expected low priority to use one CPU but it uses %d.", procs)
+		}
+
+		// every thread runs at the lower priority, as do the commands started
+		tasks, err := ioutil.ReadDir("/proc/self/task")
+		if err != nil {
+			t.Fatalf("Failed to list the threads: %v", err)
+		}
+		for _, task := range tasks {
+			// the nice value is the 19th field of the stat file, counting
+			// from the pid, and the command name before it may have spaces
+			stat, err := ioutil.ReadFile("/proc/self/task/" + task.Name() + "/stat")
+			if err != nil {
+				t.Fatalf("Failed to read the stats for thread %s: %v", task.Name(), err)
+			}
+			fields := strings.Fields(string(stat[bytes.LastIndexByte(stat, ')')+1:]))
+			if len(fields) < 17 || fields[16] != "10" {
+				t.Fatalf("Expected thread %s to have a nice value of 10: %s", task.Name(), stat)
+			}
+		}
+		out, err := exec.Command("sh", "-c", "nice").Output()
+		if err != nil || strings.TrimSpace(string(out)) != "10" {
+			t.Fatalf("Expected commands to inherit the nice value but got %q: %v", out, err)
+		}
+		return
+	}
+
+	// a CPU limit on its own doesn't change the priority
+	procs := runtime.GOMAXPROCS(0)
+	defer runtime.GOMAXPROCS(procs)
+	if err := limitCPU(false, 2); err != nil || runtime.GOMAXPROCS(0) != 2 {
+		t.Fatalf("Expected the CPU limit to be applied (%d CPUs): %v", runtime.GOMAXPROCS(0), err)
+	}
+	if err := limitCPU(false, 0); err != nil || runtime.GOMAXPROCS(0) != 2 {
+		t.Fatalf("Expected no CPU limit to leave the CPUs alone (%d CPUs): %v", runtime.GOMAXPROCS(0), err)
+	}
+
+	if runtime.GOOS != "linux" {
+		t.Skip("The priority of each thread is checked with /proc on linux.")
+	}
+	cmd := exec.Command(os.Args[0], "-test.run=^TestCPULimit$")
+	cmd.Env = append(os.Environ(), lowPriorityTestEnv+"=1")
+	out, err := cmd.CombinedOutput()
+	if err != nil {
+		t.Fatalf("The low priority check failed: %v\n%s", err, out)
+	}
+}
+
+func TestSyncDefersOnBattery(t *testing.T) {
+	srv := freezertest.NewServer(t)
+	defer srv.Close()
+	cmdState := srv.NewUser(t, "laptop", "1234", *flagCryptoPass)
+
+	localPath := filepath.Join(srv.Dir, "video.mp4")
+	ioutil.WriteFile(localPath, genRandomBytes(1000), 0644)
+	cmdState.DeferSize = 500
+	cmdState.BatteryThreshold = 20
+
+	// large uploads wait while the battery is low
+	cmdState.Power = command.PowerBattery
+	status, changeCount, err := cmdState.SyncFile(localPath, "video.mp4", command.SyncCurrentVersion)
+	if err != nil || status != command.SyncStatusDeferred || changeCount != 0 {
+		t.Fatalf("Expected the upload to be deferred on battery but got status %d (%v).", status, err)
+	}
+
+	// without a threshold the battery doesn't matter
+	cmdState.BatteryThreshold = 0
+	status, _, err = cmdState.SyncFile(localPath, "video.mp4", command.SyncCurrentVersion)
+	if err != nil || status != command.SyncStatusLocalNewer {
+		t.Fatalf("Expected the upload to go ahead without a battery threshold but got status %d (%v).", status, err)
+	}
+}
+
+func TestSyncDirectorySnapshotUnsupported(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("Volume Shadow Copy snapshots are supported on Windows.")
+	}
+	srv := freezertest.NewMemoryServer(t)
+	defer srv.Close()
+	cmdState := srv.NewUser(t, "vss", "1234", *flagCryptoPass)
+
+	srcDir := filepath.Join(srv.Dir, "profile")
+	os.MkdirAll(srcDir, 0755)
+	ioutil.WriteFile(filepath.Join(srcDir, "NTUSER.DAT"), genRandomBytes(100), 0644)
+
+	// asking for a snapshot where there's none to take fails the sync
+	// instead of quietly reading the live files
+	cmdState.UseSnapshot = true
+	_, err := cmdState.SyncDirectory(srcDir, "profile")
+	if err == nil {
+		t.Fatal("Expected the sync to fail without snapshot support.")
+	}
+	if _, err = cmdState.GetFileInfoByFilename("profile/NTUSER.DAT"); err == nil {
+		t.Fatal("Nothing should be uploaded when the snapshot can't be taken.")
+	}
+
+	cmdState.UseSnapshot = false
+	_, err = cmdState.SyncDirectory(srcDir, "profile")
+	if err != nil {
+		t.Fatalf("Failed to sync the directory without a snapshot: %v", err)
+	}
+}
+
+func TestSyncDirectoryDefaultExclusions(t *testing.T) {
+	srv := freezertest.NewMemoryServer(t)
+	defer srv.Close()
+	cmdState := srv.NewUser(t, "excludes", "1234", *flagCryptoPass)
+
+	homeDir := filepath.Join(srv.Dir, "home")
+	for _, name := range []string{"docs/a.txt", ".cache/fonts/b.bin", ".local/share/Trash/c.txt", ".thumbnails/d.png", "e.iso"} {
+		localPath := filepath.Join(homeDir, filepath.FromSlash(name))
+		os.MkdirAll(filepath.Dir(localPath), 0755)
+		ioutil.WriteFile(localPath, genRandomBytes(100), 0644)
+	}
+	cmdState.HomeDir = homeDir
+	cmdState.Exclusions = command.DefaultExclusions("linux")
+	cmdState.Policies = []command.SyncPolicy{
+		{Pattern: ".thumbnails", Include: true},
+		{Pattern: "*.iso", Exclude: true},
+	}
+
+	_, err := cmdState.SyncDirectory(homeDir, "home")
+	if err != nil {
+		t.Fatalf("Failed to sync the home directory: %v", err)
+	}
+	for name, synced := range map[string]bool{
+		"home/docs/a.txt":               true,
+		"home/.cache/fonts/b.bin":       false,
+		"home/.local/share/Trash/c.txt": false,
+		"home/.thumbnails/d.png":        true,
+		"home/e.iso":                    false,
+	} {
+		_, err = cmdState.GetFileInfoByFilename(name)
+		if (err == nil) != synced {
+			t.Fatalf("Expected %s to be synced (%v) but it wasn't: %v", name, synced, err)
+		}
+	}
+
+	// syncing an excluded directory itself syncs what's in it
+	_, err = cmdState.SyncDirectory(filepath.Join(homeDir, ".cache"), "cache")
+	if err != nil {
+		t.Fatalf("Failed to sync the cache directory: %v", err)
+	}
+	if _, err = cmdState.GetFileInfoByFilename("cache/fonts/b.bin"); err != nil {
+		t.Fatalf("Expected the cache to be synced when it's the directory given: %v", err)
+	}
+}
+
+func TestSyncDirectoryIgnoreFile(t *testing.T) {
+	srv := freezertest.NewMemoryServer(t)
+	defer srv.Close()
+	cmdState := srv.NewUser(t, "ignore", "1234", *flagCryptoPass)
+
+	srcDir := filepath.Join(srv.Dir, "proj")
+	for _, name := range []string{"src/main.go", "src/main.o", "keep.o", "build/out.bin", "cache/x.bin", "src/cache/y.bin", "sub/a.log", "sub/b.txt", "a.log"} {
+		localPath := filepath.Join(srcDir, filepath.FromSlash(name))
+		os.MkdirAll(filepath.Dir(localPath), 0755)
+		ioutil.WriteFile(localPath, genRandomBytes(100), 0644)
+	}
+	ioutil.WriteFile(filepath.Join(srcDir, command.IgnoreFileName), []byte("# build output\nbuild/\n*.o\n!keep.o\n/cache\n"), 0644)
+	ioutil.WriteFile(filepath.Join(srcDir, "sub", command.IgnoreFileName), []byte("*.log\n"), 0644)
+
+	_, err := cmdState.SyncDirectory(srcDir, "proj")
+	if err != nil {
+		t.Fatalf("Failed to sync the directory: %v", err)
+	}
+	for name, synced := range map[string]bool{
+		"proj/" + command.IgnoreFileName: true,
+		"proj/src/main.go":               true,
+		"proj/src/main.o":                false,
+		"proj/keep.o":                    true,
+		"proj/build":                     false,
+		"proj/build/out.bin":             false,
+		"proj/cache/x.bin":               false,
+		"proj/src/cache/y.bin":           true,
+		"proj/sub/a.log":                 false,
+		"proj/sub/b.txt":                 true,
+		"proj/a.log":                     true,
+	} {
+		_, err = cmdState.GetFileInfoByFilename(name)
+		if (err == nil) != synced {
+			t.Fatalf("Expected %s to be synced (%v) but it wasn't: %v", name, synced, err)
+		}
+	}
+
+	// ignored files already on the server aren't downloaded but can be removed
+	oldPath := filepath.Join(srv.Dir, "old.bin")
+	ioutil.WriteFile(oldPath, genRandomBytes(100), 0644)
+	if _, _, err = cmdState.SyncFile(oldPath, "proj/build/old.bin", command.SyncCurrentVersion); err != nil {
+		t.Fatalf("Failed to upload the file: %v", err)
+	}
+	if _, err = cmdState.SyncDirectory(srcDir, "proj"); err != nil {
+		t.Fatalf("Failed to sync the directory: %v", err)
+	}
+	if _, err = os.Stat(filepath.Join(srcDir, "build", "old.bin")); err == nil {
+		t.Fatal("Expected the ignored file on the server not to be downloaded.")
+	}
+	if err = cmdState.RmIgnoredFiles(srcDir, "proj", false); err != nil {
+		t.Fatalf("Failed to remove the ignored files: %v", err)
+	}
+	if _, err = cmdState.GetFileInfoByFilename("proj/build/old.bin"); err == nil {
+		t.Fatal("Expected the ignored file to be removed from the server.")
+	}
+	if _, err = cmdState.GetFileInfoByFilename("proj/src/main.go"); err != nil {
+		t.Fatalf("Expected the files that aren't ignored to be kept: %v", err)
+	}
+}
+
+func TestIgnoreMatcher(t *testing.T) {
+	m, err := command.NewIgnoreMatcher("node_modules/", "/dist", "docs/**/*.pdf", "**/tmp", "*.sw[op]", "!important.swp")
+	if err != nil {
+		t.Fatalf("Failed to parse the patterns: %v", err)
+	}
+	for _, c := range []struct {
+		path    string
+		isDir   bool
+		ignored bool
+	}{
+		{"node_modules", true, true},
+		{"web/node_modules/left-pad/index.js", false, true},
+		{"node_modules", false, false},
+		{"dist/app.js", false, true},
+		{"web/dist/app.js", false, false},
+		{"docs/a.pdf", false, true},
+		{"docs/x/y/a.pdf", false, true},
+		{"other/docs/a.pdf", false, false},
+		{"a/b/tmp/c.txt", false, true},
+		{".main.go.swp", false, true},
+		{"important.swp", false, false},
+		{"main.go", false, false},
+	} {
+		if m.Match(c.path, c.isDir) != c.ignored {
+			t.Errorf("Expected %s (dir %v) to be ignored (%v).", c.path, c.isDir, c.ignored)
+		}
+	}
+}
+
+// waitForAgent polls the agent's status until done returns true for it,
+// failing the test if that takes too long.
+func waitForAgent(t *testing.T, agent *command.Agent, what string, done func(command.AgentStatus) bool) command.AgentStatus {
+	deadline := time.Now().Add(10 * time.Second)
+	for {
+		status := agent.Status()
+		if done(status) {
+			return status
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("Timed out waiting for the agent %s (%+v).", what, status)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func TestAgentSchedule(t *testing.T) {
+	srv := freezertest.NewMemoryServer(t)
+	defer srv.Close()
+	cmdState := srv.NewUser(t, "agent", "1234", *flagCryptoPass)
+
+	localDir := filepath.Join(srv.Dir, "docs")
+	os.MkdirAll(localDir, 0755)
+	ioutil.WriteFile(filepath.Join(localDir, "a.txt"), genRandomBytes(100), 0644)
+
+	paths := []command.AgentPath{{LocalDir: localDir, RemoteDir: "docs"}}
+	agent := command.NewAgent(cmdState, "agent", "1234", paths, 100*time.Millisecond)
+	ts := httptest.NewServer(agent)
+	defer ts.Close()
+	addr := strings.TrimPrefix(ts.URL, "http://")
+
+	// an agent that hasn't finished a pass yet is healthy
+	resp, err := http.Get(ts.URL + "/healthz")
+	if err != nil || resp.StatusCode != http.StatusOK {
+		t.Fatalf("Expected a new agent to be healthy: %v", err)
+	}
+	resp.Body.Close()
+
+	// files added between passes are picked up by a later pass
+	stop, done := make(chan struct{}), make(chan struct{})
+	go func() {
+		agent.Run(stop)
+		close(done)
+	}()
+	first := waitForAgent(t, agent, "to sync", func(s command.AgentStatus) bool { return s.SyncCount >= 1 })
+	ioutil.WriteFile(filepath.Join(localDir, "b.txt"), genRandomBytes(100), 0644)
+	waitForAgent(t, agent, "to sync again", func(s command.AgentStatus) bool { return s.SyncCount >= first.SyncCount+2 })
+
+	status, err := command.GetAgentStatus(addr)
+	if err != nil {
+		t.Fatalf("Failed to get the agent status: %v", err)
+	}
+	if status.SyncCount < 3 || status.LastError != "" || status.Interval != "100ms" ||
+		len(status.Paths) != 1 || status.Paths[0].RemoteDir != "docs" {
+		t.Fatalf("Unexpected agent status: %+v", status)
+	}
+	close(stop)
+	<-done
+	for _, name := range []string{"docs/a.txt", "docs/b.txt"} {
+		if _, err = cmdState.GetFileInfoByFilename(name); err != nil {
+			t.Fatalf("Expected the agent to upload %s: %v", name, err)
+		}
+	}
+
+	// without a pass in two intervals the agent is no longer healthy
+	time.Sleep(250 * time.Millisecond)
+	resp, err = http.Get(ts.URL + "/healthz")
+	if err != nil || resp.StatusCode != http.StatusServiceUnavailable {
+		t.Fatalf("Expected a stalled agent to be unhealthy: %v", err)
+	}
+	resp.Body.Close()
+
+	// as is one whose last pass failed; with stop already closed Run returns
+	// after its first pass
+	offline := command.NewState()
+	offline.HostURI = "http://127.0.0.1:1"
+	failing := command.NewAgent(offline, "agent", "1234", paths, time.Hour)
+	stop = make(chan struct{})
+	close(stop)
+	failing.Run(stop)
+	if status := failing.Status(); status.SyncCount != 1 || status.LastError == "" || failing.Healthy() {
+		t.Fatalf("Expected the failed pass to make the agent unhealthy (%+v).", status)
+	}
+	if _, err = command.GetAgentStatus("127.0.0.1:1"); err == nil {
+		t.Fatal("Expected getting the status of an agent that isn't running to fail.")
+	}
+}
+
+func TestAgentControls(t *testing.T) {
+	srv := freezertest.NewMemoryServer(t)
+	defer srv.Close()
+	cmdState := srv.NewUser(t, "controls", "1234", *flagCryptoPass)
+
+	localDir := filepath.Join(srv.Dir, "docs")
+	os.MkdirAll(localDir, 0755)
+	paths := []command.AgentPath{{LocalDir: localDir, RemoteDir: "docs"}}
+	agent := command.NewAgent(cmdState, "controls", "1234", paths, 50*time.Millisecond)
+	ts := httptest.NewServer(agent)
+	defer ts.Close()
+	addr := strings.TrimPrefix(ts.URL, "http://")
+
+	stop, done := make(chan struct{}), make(chan struct{})
+	go func() {
+		agent.Run(stop)
+		close(done)
+	}()
+	defer func() {
+		close(stop)
+		<-done
+	}()
+	waitForAgent(t, agent, "to sync", func(s command.AgentStatus) bool { return s.SyncCount >= 1 })
+
+	// scheduled passes stop while the agent is paused
+	err := command.ControlAgent(addr, "pause")
+	if err != nil {
+		t.Fatalf("Failed to pause the agent: %v", err)
+	}
+	paused := waitForAgent(t, agent, "to finish its pass", func(s command.AgentStatus) bool { return s.Paused && !s.Syncing })
+	ioutil.WriteFile(filepath.Join(localDir, "metered.txt"), genRandomBytes(100), 0644)
+	time.Sleep(300 * time.Millisecond)
+	if status := agent.Status(); status.SyncCount > paused.SyncCount+1 {
+		t.Fatalf("Expected no scheduled passes while paused but %d ran.", status.SyncCount-paused.SyncCount)
+	}
+	if _, err = cmdState.GetFileInfoByFilename("docs/metered.txt"); err == nil {
+		t.Fatal("Expected the file not to be uploaded while the agent is paused.")
+	}
+
+	// a pass can still be forced while paused
+	before := agent.Status()
+	err = command.ControlAgent(addr, "sync")
+	if err != nil {
+		t.Fatalf("Failed to force a sync: %v", err)
+	}
+	waitForAgent(t, agent, "to run the forced pass", func(s command.AgentStatus) bool { return s.SyncCount > before.SyncCount && !s.Syncing })
+	if _, err = cmdState.GetFileInfoByFilename("docs/metered.txt"); err != nil {
+		t.Fatalf("Expected the forced pass to upload the file: %v", err)
+	}
+	if !agent.Status().Paused {
+		t.Fatal("Expected the agent to stay paused after a forced pass.")
+	}
+
+	// resuming restarts the scheduled passes
+	err = command.ControlAgent(addr, "resume")
+	if err != nil {
+		t.Fatalf("Failed to resume the agent: %v", err)
+	}
+	resumed := agent.Status()
+	if resumed.Paused {
+		t.Fatal("Expected the agent to be resumed.")
+	}
+	waitForAgent(t, agent, "to sync after resuming", func(s command.AgentStatus) bool { return s.SyncCount >= resumed.SyncCount+2 })
+
+	// the controls only accept POST requests and known actions
+	resp, err := http.Get(ts.URL + "/pause")
+	if err != nil || resp.StatusCode != http.StatusMethodNotAllowed || resp.Header.Get("Allow") != "POST" {
+		t.Fatalf("Expected a GET of a control to be rejected: %v", err)
+	}
+	resp.Body.Close()
+	if agent.Status().Paused {
+		t.Fatal("Expected a rejected request not to pause the agent.")
+	}
+	if err = command.ControlAgent(addr, "explode"); err == nil {
+		t.Fatal("Expected an unknown control to fail.")
+	}
+	if err = command.ControlAgent("127.0.0.1:1", "pause"); err == nil {
+		t.Fatal("Expected controlling an agent that isn't running to fail.")
+	}
+}
+
+func TestAgentNotify(t *testing.T) {
+	srv := freezertest.NewMemoryServer(t)
+	defer srv.Close()
+	cmdState := srv.NewUser(t, "notify", "1234", *flagCryptoPass)
+	cmdState.Notices = make(chan string, 1)
+	cmdState.Notices <- "Most of the storage quota is used."
+
+	localDir := filepath.Join(srv.Dir, "docs")
+	os.MkdirAll(localDir, 0755)
+	ioutil.WriteFile(filepath.Join(localDir, "a.txt"), genRandomBytes(100), 0644)
+
+	var titles []string
+	stop := make(chan struct{})
+	agent := command.NewAgent(cmdState, "notify", "1234", []command.AgentPath{{LocalDir: localDir, RemoteDir: "docs"}}, time.Hour)
+	agent.Notify = func(title string, message string) {
+		titles = append(titles, title)
+		if title == "Filefreezer" {
+			close(stop)
+		}
+	}
+	agent.Run(stop)
+
+	// the pass is reported first and then the notices sent during it
+	if len(titles) != 2 || titles[0] != "Sync complete" || titles[1] != "Filefreezer" {
+		t.Fatalf("Expected a notification for the sync and the notice but got %v.", titles)
+	}
+}
+
+func TestAgentRecentPasses(t *testing.T) {
+	srv := freezertest.NewMemoryServer(t)
+	defer srv.Close()
+	cmdState := srv.NewUser(t, "recent", "1234", *flagCryptoPass)
+
+	localDir := filepath.Join(srv.Dir, "docs")
+	os.MkdirAll(localDir, 0755)
+	ioutil.WriteFile(filepath.Join(localDir, "a.txt"), genRandomBytes(100), 0644)
+
+	stop := make(chan struct{})
+	agent := command.NewAgent(cmdState, "recent", "1234", []command.AgentPath{{LocalDir: localDir, RemoteDir: "docs"}}, time.Hour)
+	agent.Notify = func(title string, message string) { close(stop) }
+	agent.Run(stop)
+
+	// the tray reads the recent passes from the status API
+	rec := httptest.NewRecorder()
+	agent.ServeHTTP(rec, httptest.NewRequest("GET", "/status", nil))
+	var status command.AgentStatus
+	err := json.Unmarshal(rec.Body.Bytes(), &status)
+	if err != nil {
+		t.Fatalf("Failed to read the agent status: %v", err)
+	}
+	if len(status.Recent) != 1 || status.Recent[0].ChangeCount != status.LastChangeCount || status.Recent[0].Error != "" {
+		t.Fatalf("Expected the pass in the recent activity but got %+v.", status.Recent)
+	}
+}
+
+func TestVerboseWireLogging(t *testing.T) {
+	srv := freezertest.NewMemoryServer(t)
+	defer srv.Close()
+	cmdState := srv.NewUser(t, "verbose", "1234", *flagCryptoPass)
+
+	var trace bytes.Buffer
+	cmdState.TraceOutput = &trace
+	cmdState.Verbosity = command.VerbosityWire
+	_, err := cmdState.GetAllFileHashes()
+	if err != nil {
+		t.Fatalf("Failed to get the file hashes: %v", err)
+	}
+
+	output := trace.String()
+	if !strings.Contains(output, "GET ") || !strings.Contains(output, "-> 200 OK") {
+		t.Fatalf("Expected the request and its status to be logged but got:\n%s", output)
+	}
+	if !strings.Contains(output, "> Authorization: [redacted]") || strings.Contains(output, cmdState.AuthToken) {
+		t.Fatalf("Expected the authorization header to be redacted but got:\n%s", output)
+	}
+
+	// nothing is logged without -v
+	trace.Reset()
+	cmdState.Verbosity = 0
+	cmdState.GetAllFileHashes()
+	if trace.Len() != 0 {
+		t.Fatalf("Expected nothing to be logged but got:\n%s", trace.String())
+	}
+}
+
+func TestDebugBundle(t *testing.T) {
+	srv := freezertest.NewMemoryServer(t)
+	defer srv.Close()
+	cmdState := srv.NewUser(t, "bundle", "1234", *flagCryptoPass)
+
+	logPath := filepath.Join(srv.Dir, "agent.log")
+	ioutil.WriteFile(logPath, []byte("Agent sync failed: connection reset\n"), 0644)
+
+	var bundle bytes.Buffer
+	err := cmdState.WriteDebugBundle(&bundle, command.DebugBundle{
+		Settings: map[string]string{"host": cmdState.HostURI, "pass": "1234", "crypt": *flagCryptoPass},
+		LogFiles: []string{logPath},
+		Username: "bundle",
+		Password: "1234",
+	})
+	if err != nil {
+		t.Fatalf("Failed to write the debug bundle: %v", err)
+	}
+
+	files := make(map[string]string)
+	gz, err := gzip.NewReader(&bundle)
+	if err != nil {
+		t.Fatalf("Failed to read the debug bundle: %v", err)
+	}
+	tr := tar.NewReader(gz)
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			t.Fatalf("Failed to read the debug bundle: %v", err)
+		}
+		data, _ := ioutil.ReadAll(tr)
+		files[hdr.Name] = string(data)
+	}
+
+	if !strings.Contains(files["version.txt"], command.Version) {
+		t.Fatalf("Expected the client version in the bundle but got %q.", files["version.txt"])
+	}
+	if strings.Contains(files["settings.json"], "1234") || !strings.Contains(files["settings.json"], cmdState.HostURI) {
+		t.Fatalf("Expected the settings with the secrets redacted but got %s.", files["settings.json"])
+	}
+	if files["logs/1-agent.log"] != "Agent sync failed: connection reset\n" {
+		t.Fatalf("Expected the log file in the bundle but got %q.", files["logs/1-agent.log"])
+	}
+	if !strings.Contains(files["connectivity.txt"], "OK   login") {
+		t.Fatalf("Expected the login to be tested but got:\n%s", files["connectivity.txt"])
+	}
+	if !strings.Contains(files["trace.txt"], "/api/time") || strings.Contains(files["trace.txt"], "1234") {
+		t.Fatalf("Expected a trace of the test without secrets but got:\n%s", files["trace.txt"])
+	}
+}
+
+func TestSyncDirBothWays(t *testing.T) {
+	srv := freezertest.NewServer(t)
+	defer srv.Close()
+	laptop := srv.NewUser(t, "twoway", "1234", *flagCryptoPass)
+	laptop.SyncStateFile = filepath.Join(srv.Dir, "laptop.json")
+	desktop, err := srv.NewClient("twoway", "1234", *flagCryptoPass)
+	if err != nil {
+		t.Fatalf("Failed to create a second client: %v", err)
+	}
+	desktop.SyncStateFile = filepath.Join(srv.Dir, "desktop.json")
+
+	laptopDir := filepath.Join(srv.Dir, "laptop")
+	desktopDir := filepath.Join(srv.Dir, "desktop")
+	os.MkdirAll(filepath.Join(laptopDir, "docs"), 0777)
+	os.MkdirAll(desktopDir, 0777)
+	ioutil.WriteFile(filepath.Join(laptopDir, "docs", "a.txt"), genRandomBytes(100), 0644)
+	ioutil.WriteFile(filepath.Join(laptopDir, "b.txt"), genRandomBytes(100), 0644)
+
+	// the laptop's files reach the desktop and a new desktop file reaches the laptop
+	if _, err = laptop.SyncDirBothWays(laptopDir, "sync"); err != nil {
+		t.Fatalf("Failed to sync the laptop: %v", err)
+	}
+	ioutil.WriteFile(filepath.Join(desktopDir, "c.txt"), genRandomBytes(100), 0644)
+	if _, err = desktop.SyncDirBothWays(desktopDir, "sync"); err != nil {
+		t.Fatalf("Failed to sync the desktop: %v", err)
+	}
+	if _, err = laptop.SyncDirBothWays(laptopDir, "sync"); err != nil {
+		t.Fatalf("Failed to sync the laptop again: %v", err)
+	}
+	for _, name := range []string{"docs/a.txt", "b.txt", "c.txt"} {
+		laptopData, _ := ioutil.ReadFile(filepath.Join(laptopDir, name))
+		desktopData, _ := ioutil.ReadFile(filepath.Join(desktopDir, name))
+		if len(laptopData) == 0 || !bytes.Equal(laptopData, desktopData) {
+			t.Fatalf("Expected %s to be the same on both sides.", name)
+		}
+	}
+
+	// a file removed on one side is removed on the other
+	os.Remove(filepath.Join(desktopDir, "b.txt"))
+	if _, err = desktop.SyncDirBothWays(desktopDir, "sync"); err != nil {
+		t.Fatalf("Failed to sync the removal from the desktop: %v", err)
+	}
+	if _, err = desktop.GetFileInfoByFilename("sync/b.txt"); err == nil {
+		t.Fatal("Expected the file removed on the desktop to be removed from the server.")
+	}
+	if _, err = laptop.SyncDirBothWays(laptopDir, "sync"); err != nil {
+		t.Fatalf("Failed to sync the removal to the laptop: %v", err)
+	}
+	if _, err = os.Stat(filepath.Join(laptopDir, "b.txt")); !os.IsNotExist(err) {
+		t.Fatal("Expected the file removed on the desktop to be removed from the laptop.")
+	}
+
+	// a file removed on one side but changed on the other is kept
+	os.Remove(filepath.Join(laptopDir, "c.txt"))
+	changed := genRandomBytes(200)
+	ioutil.WriteFile(filepath.Join(desktopDir, "c.txt"), changed, 0644)
+	later := time.Now().Add(time.Hour)
+	os.Chtimes(filepath.Join(desktopDir, "c.txt"), later, later)
+	if _, err = desktop.SyncDirBothWays(desktopDir, "sync"); err != nil {
+		t.Fatalf("Failed to sync the change from the desktop: %v", err)
+	}
+	if _, err = laptop.SyncDirBothWays(laptopDir, "sync"); err != nil {
+		t.Fatalf("Failed to sync the laptop after the change: %v", err)
+	}
+	data, _ := ioutil.ReadFile(filepath.Join(laptopDir, "c.txt"))
+	if !bytes.Equal(data, changed) {
+		t.Fatal("Expected the file changed on the desktop to be downloaded again to the laptop.")
+	}
+
+	// without a sync state removed files can't be told from new ones
+	desktop.SyncStateFile = ""
+	if _, err = desktop.SyncDirBothWays(desktopDir, "sync"); err == nil {
+		t.Fatal("Expected a two-way sync without a sync state to fail.")
+	}
+}
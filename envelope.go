@@ -0,0 +1,185 @@
+// Copyright 2017, Timothy Bogdala <tdb@animal-machine.com>
+// See the LICENSE file for more details.
+
+package filefreezer
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"encoding/base64"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+)
+
+// envelopeMagic starts every blob written by an EncryptedBlobStore.
+var envelopeMagic = []byte("FFE1")
+
+// ChunkKeyring holds the keys used to encrypt chunk data at rest on the server,
+// by key ID. Keys are 32 bytes for AES-256.
+type ChunkKeyring struct {
+	// Latest is the ID of the last key in the key file, which is used for
+	// writing unless a store is given its own key
+	Latest string
+
+	keys map[string][]byte
+}
+
+// LoadChunkKeyring reads a key file with a line per key of the form
+// "<key id> <base64 key>". Blank lines and lines starting with # are skipped.
+// Keys are rotated by adding a new line at the end while keeping the old keys
+// so that the chunks they encrypted can still be read.
+func LoadChunkKeyring(path string) (*ChunkKeyring, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open the chunk key file: %v", err)
+	}
+	defer f.Close()
+	return ParseChunkKeyring(f)
+}
+
+// ParseChunkKeyring parses keys in the format read by LoadChunkKeyring.
+func ParseChunkKeyring(r io.Reader) (*ChunkKeyring, error) {
+	keyring := &ChunkKeyring{keys: make(map[string][]byte)}
+	scanner := bufio.NewScanner(r)
+	lineNum := 0
+	for scanner.Scan() {
+		lineNum++
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+
+		fields := strings.Fields(line)
+		if len(fields) != 2 {
+			return nil, fmt.Errorf("line %d of the chunk keys should be a key id and a base64 key", lineNum)
+		}
+		id := fields[0]
+		if len(id) > 255 {
+			return nil, fmt.Errorf("the key id on line %d of the chunk keys is longer than 255 bytes", lineNum)
+		}
+		if _, found := keyring.keys[id]; found {
+			return nil, fmt.Errorf("the key id %s is used more than once in the chunk keys", id)
+		}
+		key, err := base64.StdEncoding.DecodeString(fields[1])
+		if err != nil {
+			return nil, fmt.Errorf("the key %s isn't valid base64: %v", id, err)
+		}
+		if len(key) != 32 {
+			return nil, fmt.Errorf("the key %s is %d bytes but should be 32", id, len(key))
+		}
+
+		keyring.keys[id] = key
+		keyring.Latest = id
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, fmt.Errorf("failed to read the chunk keys: %v", err)
+	}
+	if len(keyring.keys) == 0 {
+		return nil, fmt.Errorf("no keys were found in the chunk keys")
+	}
+	return keyring, nil
+}
+
+// EncryptedBlobStore encrypts the blobs written to a BlobStore with AES-GCM.
+// Each blob is sealed in an envelope whose header records the ID of the key it
+// was encrypted with, so the write key can be rotated while blobs encrypted
+// with older keys of the keyring can still be read.
+//
+// The envelope is "FFE1", a byte with the length of the key ID, the key ID,
+// the nonce and then the ciphertext, with the header authenticated along with
+// it. Blobs without the envelope are read as they are so that encryption can
+// be enabled for a store that already has chunks.
+type EncryptedBlobStore struct {
+	store   BlobStore
+	keyring *ChunkKeyring
+	keyID   string
+}
+
+// NewEncryptedBlobStore wraps the store so that new blobs are encrypted with
+// the key from the keyring with the given ID.
+func NewEncryptedBlobStore(store BlobStore, keyring *ChunkKeyring, keyID string) (*EncryptedBlobStore, error) {
+	if _, found := keyring.keys[keyID]; !found {
+		return nil, fmt.Errorf("the key id %s is not in the chunk keys", keyID)
+	}
+	return &EncryptedBlobStore{store: store, keyring: keyring, keyID: keyID}, nil
+}
+
+// Put encrypts the data with the store's key and writes the envelope.
+func (e *EncryptedBlobStore) Put(key string, data []byte) error {
+	gcm, err := newChunkCipher(e.keyring.keys[e.keyID])
+	if err != nil {
+		return err
+	}
+
+	header := make([]byte, 0, len(envelopeMagic)+1+len(e.keyID))
+	header = append(header, envelopeMagic...)
+	header = append(header, byte(len(e.keyID)))
+	header = append(header, e.keyID...)
+
+	nonce := make([]byte, gcm.NonceSize())
+	_, err = rand.Read(nonce)
+	if err != nil {
+		return fmt.Errorf("failed to generate a nonce for the chunk: %v", err)
+	}
+
+	envelope := append(header, nonce...)
+	envelope = gcm.Seal(envelope, nonce, data, header)
+	return e.store.Put(key, envelope)
+}
+
+// Get reads the envelope and decrypts it with the key it names.
+func (e *EncryptedBlobStore) Get(key string) ([]byte, error) {
+	envelope, err := e.store.Get(key)
+	if err != nil {
+		return nil, err
+	}
+	if !bytes.HasPrefix(envelope, envelopeMagic) {
+		return envelope, nil
+	}
+
+	idStart := len(envelopeMagic) + 1
+	if len(envelope) < idStart {
+		return nil, fmt.Errorf("the chunk envelope for %s is truncated", key)
+	}
+	idEnd := idStart + int(envelope[idStart-1])
+	if len(envelope) < idEnd {
+		return nil, fmt.Errorf("the chunk envelope for %s is truncated", key)
+	}
+	keyID := string(envelope[idStart:idEnd])
+	chunkKey, found := e.keyring.keys[keyID]
+	if !found {
+		return nil, fmt.Errorf("the chunk %s was encrypted with the key %s, which is not in the chunk keys", key, keyID)
+	}
+
+	gcm, err := newChunkCipher(chunkKey)
+	if err != nil {
+		return nil, err
+	}
+	if len(envelope) < idEnd+gcm.NonceSize() {
+		return nil, fmt.Errorf("the chunk envelope for %s is truncated", key)
+	}
+	nonce := envelope[idEnd : idEnd+gcm.NonceSize()]
+	data, err := gcm.Open(nil, nonce, envelope[idEnd+gcm.NonceSize():], envelope[:idEnd])
+	if err != nil {
+		return nil, fmt.Errorf("failed to decrypt the chunk %s: %v", key, err)
+	}
+	return data, nil
+}
+
+// Delete removes the blob from the store.
+func (e *EncryptedBlobStore) Delete(key string) error {
+	return e.store.Delete(key)
+}
+
+func newChunkCipher(key []byte) (cipher.AEAD, error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
@@ -0,0 +1,230 @@
+// Copyright 2017, Timothy Bogdala <tdb@animal-machine.com>
+// See the LICENSE file for more details.
+
+package filefreezer
+
+import (
+	"crypto/sha1"
+	"encoding/base64"
+	"fmt"
+	"io"
+	"os"
+)
+
+const (
+	// ChunkingFixed splits files into chunks of the maximum chunk size, with
+	// only the last one shorter.
+	ChunkingFixed = "fixed"
+
+	// ChunkingFastCDC splits files where their content says with FastCDC, so
+	// that inserting or removing bytes only changes the chunks around the
+	// edit instead of every chunk after it. Chunks average a quarter of the
+	// maximum chunk size and are never larger than it.
+	ChunkingFastCDC = "fastcdc"
+)
+
+// gearSeed seeds the gear table of the rolling hash. Every client has to cut
+// the same content in the same places, so it must never change.
+const gearSeed = 0x667265657a657221
+
+// gearTable maps each byte to the random number the rolling hash adds for it.
+var gearTable = func() (table [256]uint64) {
+	// splitmix64 so that the table is the same everywhere
+	x := uint64(gearSeed)
+	for i := range table {
+		x += 0x9e3779b97f4a7c15
+		z := x
+		z = (z ^ (z >> 30)) * 0xbf58476d1ce4e5b9
+		z = (z ^ (z >> 27)) * 0x94d049bb133111eb
+		table[i] = z ^ (z >> 31)
+	}
+	return
+}()
+
+// cdcParams are the FastCDC chunk sizes and the masks that are tested against
+// the rolling hash before and after the average size. The masks use the high
+// bits, which depend on the last 64 bytes, and the one before the average
+// has two more bits set than the one after so that chunk sizes cluster around
+// the average (normalized chunking).
+type cdcParams struct {
+	min, avg, max int
+	maskS, maskL  uint64
+}
+
+// FastCDCChunkSizes returns the smallest size of a FastCDC chunk other than
+// the last one of a file and the size chunks average for the maximum chunk
+// size, which clients use to estimate file sizes from chunk counts.
+func FastCDCChunkSizes(maxChunkSize int64) (min int64, avg int64) {
+	avg = maxChunkSize / 4
+	if avg < 1 {
+		avg = 1
+	}
+	return maxChunkSize / 16, avg
+}
+
+// newCDCParams returns the parameters for chunks of at most maxChunkSize.
+func newCDCParams(maxChunkSize int) cdcParams {
+	min, avg := FastCDCChunkSizes(int64(maxChunkSize))
+	p := cdcParams{min: int(min), avg: int(avg), max: maxChunkSize}
+	bits := uint(0)
+	for 1<<(bits+1) <= p.avg {
+		bits++
+	}
+	p.maskS = highBits(bits + 2)
+	p.maskL = highBits(bits - 2)
+	if bits < 2 {
+		p.maskL = 0
+	}
+	return p
+}
+
+// highBits returns a mask with the n highest bits set.
+func highBits(n uint) uint64 {
+	if n == 0 {
+		return 0
+	}
+	if n >= 64 {
+		return ^uint64(0)
+	}
+	return ^uint64(0) << (64 - n)
+}
+
+// cut returns the length of the chunk at the start of data, which is all of
+// it if it's shorter than the minimum chunk size and never more than the
+// maximum.
+func (p *cdcParams) cut(data []byte) int {
+	n := len(data)
+	if n <= p.min {
+		return n
+	}
+	if n > p.max {
+		n = p.max
+	}
+	normal := p.avg
+	if normal > n {
+		normal = n
+	}
+
+	var hash uint64
+	i := p.min
+	for ; i < normal; i++ {
+		hash = (hash << 1) + gearTable[data[i]]
+		if hash&p.maskS == 0 {
+			return i + 1
+		}
+	}
+	for ; i < n; i++ {
+		hash = (hash << 1) + gearTable[data[i]]
+		if hash&p.maskL == 0 {
+			return i + 1
+		}
+	}
+	return n
+}
+
+// Chunker splits what's read from a reader into chunks with one of the
+// Chunking methods. Each chunk is at most the maximum chunk size.
+type Chunker struct {
+	r         io.Reader
+	fastCDC   bool
+	params    cdcParams
+	buffer    []byte
+	start     int
+	end       int
+	readError error
+}
+
+// NewChunker returns a chunker splitting r with the chunking method, where an
+// empty method is ChunkingFixed, into chunks of at most maxChunkSize bytes.
+func NewChunker(r io.Reader, chunking string, maxChunkSize int) (*Chunker, error) {
+	if maxChunkSize <= 0 {
+		return nil, fmt.Errorf("the maximum chunk size must be positive")
+	}
+	c := &Chunker{r: r, buffer: make([]byte, maxChunkSize)}
+	switch chunking {
+	case "", ChunkingFixed:
+	case ChunkingFastCDC:
+		c.fastCDC = true
+		c.params = newCDCParams(maxChunkSize)
+	default:
+		return nil, fmt.Errorf("unknown chunking method: %s", chunking)
+	}
+	return c, nil
+}
+
+// Next returns the next chunk, or io.EOF once everything was read. The chunk
+// is only valid until the next call.
+func (c *Chunker) Next() ([]byte, error) {
+	// keep the buffer full so that a cut can be found anywhere up to the
+	// maximum chunk size
+	if c.end-c.start < len(c.buffer) && c.readError == nil {
+		c.end = copy(c.buffer, c.buffer[c.start:c.end])
+		c.start = 0
+		var n int
+		n, c.readError = io.ReadFull(c.r, c.buffer[c.end:])
+		c.end += n
+		if c.readError == io.ErrUnexpectedEOF {
+			c.readError = io.EOF
+		}
+	}
+	if c.start == c.end {
+		if c.readError != nil {
+			return nil, c.readError
+		}
+		return nil, io.EOF
+	}
+	if c.readError != nil && c.readError != io.EOF {
+		return nil, c.readError
+	}
+
+	length := c.end - c.start
+	if c.fastCDC {
+		length = c.params.cut(c.buffer[c.start:c.end])
+	}
+	chunk := c.buffer[c.start : c.start+length]
+	c.start += length
+	return chunk, nil
+}
+
+// CalcFileHashInfoChunked is CalcFileHashInfo for files split with the
+// chunking method, which only reads the file in chunks once.
+func CalcFileHashInfoChunked(chunking string, maxChunkSize int64, filename string) (stats FileStats, e error) {
+	if chunking == "" || chunking == ChunkingFixed {
+		return CalcFileHashInfo(maxChunkSize, filename)
+	}
+
+	fileInfo, err := os.Stat(filename)
+	if err != nil {
+		return stats, fmt.Errorf("failed to stat the local file (%s) for the test: %v", filename, err)
+	}
+	stats.LastMod = fileInfo.ModTime().UTC().Unix()
+	stats.Permissions = uint32(fileInfo.Mode())
+	if fileInfo.IsDir() {
+		stats.IsDir = true
+		return stats, nil
+	}
+
+	f, err := os.Open(filename)
+	if err != nil {
+		return stats, fmt.Errorf("failed to open the local file (%s) for hashing: %v", filename, err)
+	}
+	defer f.Close()
+	chunker, err := NewChunker(f, chunking, int(maxChunkSize))
+	if err != nil {
+		return stats, err
+	}
+	hasher := sha1.New()
+	for {
+		chunk, err := chunker.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return stats, fmt.Errorf("failed to read the local file (%s) for hashing: %v", filename, err)
+		}
+		hasher.Write(chunk)
+		stats.ChunkCount++
+	}
+	stats.HashString = base64.URLEncoding.EncodeToString(hasher.Sum(nil))
+	return stats, nil
+}
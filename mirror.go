@@ -0,0 +1,190 @@
+// Copyright 2017, Timothy Bogdala <tdb@animal-machine.com>
+// See the LICENSE file for more details.
+
+package filefreezer
+
+import (
+	"bytes"
+	"fmt"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// healthCheckKey is the blob written and read back by CheckHealth.
+const healthCheckKey = "health/check"
+
+// MirroredBlobStore keeps every blob in several BlobStores so that chunk data
+// stays available while one of them is unreachable.
+//
+// Stores that fail a write are marked unhealthy and skipped until CheckHealth
+// finds them working again. Blobs written while a store was skipped are copied
+// to it the next time they're read from another store, which is called read
+// repair. Writes succeed as long as one store takes the blob.
+type MirroredBlobStore struct {
+	// Logf is used to log stores changing health; nil discards the messages.
+	Logf func(format string, v ...interface{})
+
+	names   []string
+	stores  []BlobStore
+	lock    sync.Mutex
+	healthy []bool
+}
+
+// NewMirroredBlobStore mirrors the stores, which are reported by the names given.
+// Reads go to the stores in the order given.
+func NewMirroredBlobStore(names []string, stores []BlobStore) *MirroredBlobStore {
+	m := &MirroredBlobStore{
+		names:   names,
+		stores:  stores,
+		healthy: make([]bool, len(stores)),
+	}
+	for i := range m.healthy {
+		m.healthy[i] = true
+	}
+	return m
+}
+
+// Put writes the blob to every healthy store. If every store is unhealthy they
+// are all tried anyway in case one has come back since the last check.
+func (m *MirroredBlobStore) Put(key string, data []byte) error {
+	targets := m.healthyStores()
+	if len(targets) == 0 {
+		targets = m.allStores()
+	}
+
+	written := 0
+	var lastErr error
+	for _, i := range targets {
+		err := m.stores[i].Put(key, data)
+		if err != nil {
+			m.setHealthy(i, false, err)
+			lastErr = err
+			continue
+		}
+		written++
+	}
+	if written == 0 {
+		return fmt.Errorf("failed to write the blob to any of the mirrored stores: %v", lastErr)
+	}
+	return nil
+}
+
+// Get reads the blob from the first healthy store that has it and copies it to
+// the healthy stores before it that didn't.
+func (m *MirroredBlobStore) Get(key string) ([]byte, error) {
+	targets := m.healthyStores()
+	if len(targets) == 0 {
+		targets = m.allStores()
+	}
+
+	var missing []int
+	var lastErr error
+	for _, i := range targets {
+		data, err := m.stores[i].Get(key)
+		if err != nil {
+			missing = append(missing, i)
+			lastErr = err
+			continue
+		}
+
+		// read repair; a store that can't take the blob back is unhealthy
+		for _, j := range missing {
+			err = m.stores[j].Put(key, data)
+			if err != nil {
+				m.setHealthy(j, false, err)
+			}
+		}
+		return data, nil
+	}
+	return nil, lastErr
+}
+
+// Delete removes the blob from every healthy store. Copies left on unhealthy
+// stores are unreferenced and only take up space.
+func (m *MirroredBlobStore) Delete(key string) error {
+	var lastErr error
+	for _, i := range m.healthyStores() {
+		err := m.stores[i].Delete(key)
+		if err != nil {
+			lastErr = err
+		}
+	}
+	return lastErr
+}
+
+// CheckHealth writes a blob to each store and reads it back, marking the
+// stores healthy or not. It returns the names of the unhealthy stores.
+func (m *MirroredBlobStore) CheckHealth() []string {
+	probe := []byte(strconv.FormatInt(time.Now().UnixNano(), 10))
+	var unhealthy []string
+	for i, store := range m.stores {
+		err := store.Put(healthCheckKey, probe)
+		if err == nil {
+			var data []byte
+			data, err = store.Get(healthCheckKey)
+			if err == nil && !bytes.Equal(data, probe) {
+				err = fmt.Errorf("the health check blob read back didn't match")
+			}
+		}
+
+		m.setHealthy(i, err == nil, err)
+		if err != nil {
+			unhealthy = append(unhealthy, m.names[i])
+		}
+	}
+	return unhealthy
+}
+
+// StartHealthChecks runs CheckHealth every interval until quit is closed.
+func (m *MirroredBlobStore) StartHealthChecks(interval time.Duration, quit <-chan struct{}) {
+	go func() {
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ticker.C:
+				m.CheckHealth()
+			case <-quit:
+				return
+			}
+		}
+	}()
+}
+
+func (m *MirroredBlobStore) healthyStores() []int {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	var result []int
+	for i, ok := range m.healthy {
+		if ok {
+			result = append(result, i)
+		}
+	}
+	return result
+}
+
+func (m *MirroredBlobStore) allStores() []int {
+	result := make([]int, len(m.stores))
+	for i := range result {
+		result[i] = i
+	}
+	return result
+}
+
+// setHealthy records the health of a store, logging when it changes.
+func (m *MirroredBlobStore) setHealthy(i int, healthy bool, err error) {
+	m.lock.Lock()
+	changed := m.healthy[i] != healthy
+	m.healthy[i] = healthy
+	m.lock.Unlock()
+
+	if !changed || m.Logf == nil {
+		return
+	}
+	if healthy {
+		m.Logf("The chunk store %s is healthy again.\n", m.names[i])
+	} else {
+		m.Logf("The chunk store %s is unhealthy and will be skipped: %v\n", m.names[i], err)
+	}
+}
@@ -0,0 +1,243 @@
+// Copyright 2017, Timothy Bogdala <tdb@animal-machine.com>
+// See the LICENSE file for more details.
+
+package filefreezer
+
+import (
+	"database/sql"
+	"fmt"
+)
+
+const (
+	getUserByID        = `SELECT Name, Salt, Password, CryptoHash FROM Users WHERE UserID = ?;`
+	getAllUserVersions = `SELECT FileVersion.FileID, VersionID, VersionNum, Perms, LastMod, ChunkCount, FileHash, Created, Device FROM FileVersion
+					INNER JOIN FileInfo ON FileVersion.FileID = FileInfo.FileID
+					WHERE FileInfo.UserID = ?;`
+	getAllUserChunkInfos = `SELECT FileChunks.FileID, VersionID, ChunkNum, ChunkHash, ChunkLength FROM FileChunks
+					INNER JOIN FileInfo ON FileChunks.FileID = FileInfo.FileID
+					WHERE FileInfo.UserID = ?;`
+
+	replaceUser      = `INSERT OR REPLACE INTO Users (UserID, Name, Salt, Password, CryptoHash) VALUES (?, ?, ?, ?, ?);`
+	replaceUserStats = `INSERT OR REPLACE INTO UserStats (UserID, Quota, Allocated, Revision, MaxVersions, MaxEgress) VALUES (?, ?, ?, ?, ?, ?);`
+	replaceFileInfo  = `INSERT INTO FileInfo (FileID, UserID, FileName, IsDir, CurrentVersionID) VALUES (?, ?, ?, ?, ?);`
+	replaceVersion   = `INSERT INTO FileVersion (VersionID, FileID, VersionNum, Perms, LastMod, ChunkCount, FileHash, Created, Device) VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?);`
+
+	removeAllUserFileVersions = `DELETE FROM FileVersion WHERE FileID IN (SELECT FileID FROM FileInfo WHERE UserID = ?);`
+	removeAllUserFileInfos    = `DELETE FROM FileInfo WHERE UserID = ?;`
+)
+
+// UserReplica is the metadata of a user's account that a secondary server
+// needs to mirror it from a primary. The IDs of the user, files, versions and
+// chunks are kept as they are on the primary so that clients can fail over
+// to the secondary without their cached IDs going stale.
+type UserReplica struct {
+	User     User
+	Stats    UserStats
+	Files    []FileInfo
+	Versions []ReplicaVersion
+	Chunks   []ReplicaChunk
+}
+
+// ReplicaVersion is a version of one of the files in a UserReplica.
+type ReplicaVersion struct {
+	FileID int
+	FileVersionInfo
+}
+
+// ReplicaChunk identifies a chunk in a UserReplica without its data, which
+// the secondary only fetches if it doesn't have the same chunk already.
+type ReplicaChunk struct {
+	FileID      int
+	VersionID   int
+	ChunkNumber int
+	ChunkHash   string
+	Length      int64
+}
+
+// GetUserReplica returns the metadata of the user's account for a secondary
+// server to apply with ApplyUserReplica. It's read in one transaction so that
+// the files, versions and chunks are consistent with the user's revision.
+func (s *Storage) GetUserReplica(userID int) (*UserReplica, error) {
+	r := new(UserReplica)
+	err := s.transact(func(tx *sql.Tx) error {
+		r.User.ID = userID
+		err := tx.QueryRow(getUserByID, userID).Scan(&r.User.Name, &r.User.Salt, &r.User.SaltedHash, &r.User.CryptoHash)
+		if err != nil {
+			return fmt.Errorf("failed to get the user (%d) from the database: %v", userID, err)
+		}
+
+		err = tx.QueryRow(getUserStats, userID).Scan(&r.Stats.Quota, &r.Stats.Allocated, &r.Stats.Revision, &r.Stats.MaxVersions, &r.Stats.MaxEgress)
+		if err != nil {
+			return fmt.Errorf("failed to get the user stats (%d) from the database: %v", userID, err)
+		}
+
+		rows, err := tx.Query(getAllUserFiles, userID)
+		if err != nil {
+			return fmt.Errorf("failed to get all of the files for the user (%d): %v", userID, err)
+		}
+		for rows.Next() {
+			fi := FileInfo{UserID: userID}
+			err = rows.Scan(&fi.FileID, &fi.FileName, &fi.IsDir, &fi.CurrentVersion.VersionID)
+			if err != nil {
+				rows.Close()
+				return fmt.Errorf("failed to scan the next row while processing the user's files: %v", err)
+			}
+			r.Files = append(r.Files, fi)
+		}
+		rows.Close()
+
+		rows, err = tx.Query(getAllUserVersions, userID)
+		if err != nil {
+			return fmt.Errorf("failed to get all of the file versions for the user (%d): %v", userID, err)
+		}
+		for rows.Next() {
+			var v ReplicaVersion
+			err = rows.Scan(&v.FileID, &v.VersionID, &v.VersionNumber, &v.Permissions, &v.LastMod,
+				&v.ChunkCount, &v.FileHash, &v.Created, &v.Device)
+			if err != nil {
+				rows.Close()
+				return fmt.Errorf("failed to scan the next row while processing the user's file versions: %v", err)
+			}
+			r.Versions = append(r.Versions, v)
+		}
+		rows.Close()
+
+		r.Chunks, err = userChunkInfos(tx, userID)
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return r, nil
+}
+
+// ApplyUserReplica makes the user's account match a replica from the primary.
+// The data of chunks that are missing or whose hash differs is read with fetch
+// and stored first; then the user, their stats, files and versions are
+// replaced and the chunks the primary no longer has are removed, all in one
+// transaction. A failed fetch leaves the account as it was, apart from the
+// chunks already stored, so the next attempt doesn't fetch them again.
+func (s *Storage) ApplyUserReplica(r *UserReplica, fetch func(chunk ReplicaChunk) ([]byte, error)) error {
+	userID := r.User.ID
+
+	known := make(map[string]string)
+	localChunks, err := userChunkInfos(s.db, userID)
+	if err != nil {
+		return err
+	}
+	for _, c := range localChunks {
+		known[chunkBlobKey(c.FileID, c.VersionID, c.ChunkNumber)] = c.ChunkHash
+	}
+
+	wanted := make(map[string]bool)
+	for _, c := range r.Chunks {
+		key := chunkBlobKey(c.FileID, c.VersionID, c.ChunkNumber)
+		wanted[key] = true
+		if hash, found := known[key]; found && hash == c.ChunkHash {
+			continue
+		}
+
+		data, err := fetch(c)
+		if err != nil {
+			return fmt.Errorf("failed to fetch chunk %d of version %d of file %d: %v", c.ChunkNumber, c.VersionID, c.FileID, err)
+		}
+		if int64(len(data)) != c.Length {
+			return fmt.Errorf("chunk %d of version %d of file %d is %d bytes but should be %d", c.ChunkNumber, c.VersionID, c.FileID, len(data), c.Length)
+		}
+
+		// as in AddFileChunk, the row only records the length when the data is kept in a BlobStore
+		stored := data
+		if s.Blobs != nil {
+			err = s.Blobs.Put(key, data)
+			if err != nil {
+				return fmt.Errorf("failed to store the chunk data: %v", err)
+			}
+			stored = []byte{}
+		}
+		_, err = s.db.Exec(addFileChunk, c.FileID, c.VersionID, c.ChunkNumber, c.ChunkHash, c.Length, chunkDataHash(data), stored)
+		if err != nil {
+			return fmt.Errorf("failed to add a replicated file chunk in the database: %v", err)
+		}
+	}
+
+	var removedKeys []string
+	err = s.transact(func(tx *sql.Tx) error {
+		// chunks are looked up through the files, so the stale ones are found
+		// before the files are replaced
+		localChunks, err := userChunkInfos(tx, userID)
+		if err != nil {
+			return err
+		}
+		for _, c := range localChunks {
+			key := chunkBlobKey(c.FileID, c.VersionID, c.ChunkNumber)
+			if wanted[key] {
+				continue
+			}
+			_, err = tx.Exec(removeFileChunk, c.FileID, c.VersionID, c.ChunkNumber)
+			if err != nil {
+				return fmt.Errorf("failed to remove a file chunk no longer on the primary: %v", err)
+			}
+			removedKeys = append(removedKeys, key)
+		}
+
+		_, err = tx.Exec(replaceUser, userID, r.User.Name, r.User.Salt, r.User.SaltedHash, r.User.CryptoHash)
+		if err != nil {
+			return fmt.Errorf("failed to replace the user %s (id: %d): %v", r.User.Name, userID, err)
+		}
+		_, err = tx.Exec(replaceUserStats, userID, r.Stats.Quota, r.Stats.Allocated, r.Stats.Revision, r.Stats.MaxVersions, r.Stats.MaxEgress)
+		if err != nil {
+			return fmt.Errorf("failed to replace the stats of the user %s (id: %d): %v", r.User.Name, userID, err)
+		}
+
+		_, err = tx.Exec(removeAllUserFileVersions, userID)
+		if err != nil {
+			return fmt.Errorf("failed to remove the file versions of the user %s (id: %d): %v", r.User.Name, userID, err)
+		}
+		_, err = tx.Exec(removeAllUserFileInfos, userID)
+		if err != nil {
+			return fmt.Errorf("failed to remove the files of the user %s (id: %d): %v", r.User.Name, userID, err)
+		}
+		for _, fi := range r.Files {
+			_, err = tx.Exec(replaceFileInfo, fi.FileID, userID, fi.FileName, fi.IsDir, fi.CurrentVersion.VersionID)
+			if err != nil {
+				return fmt.Errorf("failed to add the replicated file %d: %v", fi.FileID, err)
+			}
+		}
+		for _, v := range r.Versions {
+			_, err = tx.Exec(replaceVersion, v.VersionID, v.FileID, v.VersionNumber, v.Permissions, v.LastMod,
+				v.ChunkCount, v.FileHash, v.Created, v.Device)
+			if err != nil {
+				return fmt.Errorf("failed to add the replicated version %d of file %d: %v", v.VersionID, v.FileID, err)
+			}
+		}
+
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+
+	s.removeChunkBlobs(removedKeys)
+	return nil
+}
+
+// userChunkInfos returns the chunks of all of the user's files without their data.
+func userChunkInfos(q queryer, userID int) ([]ReplicaChunk, error) {
+	rows, err := q.Query(getAllUserChunkInfos, userID)
+	if err != nil {
+		return nil, fmt.Errorf("failed to get all of the file chunks for the user (%d): %v", userID, err)
+	}
+	defer rows.Close()
+
+	var chunks []ReplicaChunk
+	for rows.Next() {
+		var c ReplicaChunk
+		err = rows.Scan(&c.FileID, &c.VersionID, &c.ChunkNumber, &c.ChunkHash, &c.Length)
+		if err != nil {
+			return nil, fmt.Errorf("failed to scan the next row while processing the user's file chunks: %v", err)
+		}
+		chunks = append(chunks, c)
+	}
+	return chunks, rows.Err()
+}
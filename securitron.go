@@ -22,6 +22,15 @@ import (
 
 const (
 	defaultPasswordCost = 10 // analogus to bcrypt's DefaultCost
+
+	// derivedLoginPrefix marks login hashes made from a derived password
+	// instead of the plaintext password.
+	derivedLoginPrefix = "ff2$"
+
+	// the scrypt parameters for deriving login passwords
+	derivedLoginN = 16384
+	derivedLoginR = 8
+	derivedLoginP = 1
 )
 
 // FileStats is a structure used to return information about a given
@@ -74,7 +83,9 @@ func CalcFileHashInfo(maxChunkSize int64, filename string) (stats FileStats, e e
 }
 
 // GenLoginPasswordHash takes the user password, generates a new random salt,
-// then generates a hash from the salted password combination.
+// then generates a hash from the salted password combination. The hash is made
+// from the password derived with DeriveLoginPassword so that clients can log
+// in without sending the plaintext password.
 func GenLoginPasswordHash(unsaltedPassword string) (salt string, saltedhash []byte, err error) {
 	// generate a 32 byte salt
 	salt, err = getSalt(32)
@@ -82,19 +93,58 @@ func GenLoginPasswordHash(unsaltedPassword string) (salt string, saltedhash []by
 		return "", nil, fmt.Errorf("failed to generate salt for salted password: %v", err)
 	}
 
-	// technically, bcrypt does its own salting. This is just double salt or maybe some pepper.
-	saltedhash, err = bcrypt.GenerateFromPassword([]byte(unsaltedPassword+salt), defaultPasswordCost)
+	saltedhash, err = GenDerivedLoginHash(unsaltedPassword, salt)
+	return
+}
+
+// GenDerivedLoginHash generates the login hash for the password with an
+// existing salt, such as to upgrade a hash made from the plaintext password.
+func GenDerivedLoginHash(unsaltedPassword string, salt string) ([]byte, error) {
+	derived, err := DeriveLoginPassword(unsaltedPassword, salt)
 	if err != nil {
-		return "", nil, fmt.Errorf("failed to generate hash for salted password: %v", err)
+		return nil, err
 	}
 
-	return
+	// the salt is already mixed in by scrypt, and adding it again would take the
+	// password past the 72 bytes that bcrypt accepts
+	saltedhash, err := bcrypt.GenerateFromPassword([]byte(derived), defaultPasswordCost)
+	if err != nil {
+		return nil, fmt.Errorf("failed to generate hash for salted password: %v", err)
+	}
+
+	return append([]byte(derivedLoginPrefix), saltedhash...), nil
+}
+
+// DeriveLoginPassword derives the password sent by clients to log in from the
+// plaintext password and the user's salt with scrypt, so that the plaintext
+// password never leaves the client.
+func DeriveLoginPassword(unsaltedPassword string, salt string) (string, error) {
+	key, err := scrypt.Key([]byte(unsaltedPassword), []byte("filefreezer-login"+salt), derivedLoginN, derivedLoginR, derivedLoginP, 32)
+	if err != nil {
+		return "", fmt.Errorf("failed to derive the login password: %v", err)
+	}
+	return base64.URLEncoding.EncodeToString(key), nil
+}
+
+// IsDerivedLoginHash returns true if the login hash was made from a derived
+// password and false if it was made from the plaintext password by an older
+// version.
+func IsDerivedLoginHash(saltedHash []byte) bool {
+	return strings.HasPrefix(string(saltedHash), derivedLoginPrefix)
 }
 
 // VerifyLoginPassword takes the user-supplied unsalted password and the stored salt and hash
 // and verifies that the supplied unsalted password is the correct match. Returns true on
 // match and false on fail.
 func VerifyLoginPassword(unsaltedPassowrd string, salt string, saltedHash []byte) bool {
+	if IsDerivedLoginHash(saltedHash) {
+		derived, err := DeriveLoginPassword(unsaltedPassowrd, salt)
+		if err != nil {
+			return false
+		}
+		return VerifyDerivedLoginPassword(derived, saltedHash)
+	}
+
 	err := bcrypt.CompareHashAndPassword(saltedHash, []byte(unsaltedPassowrd+salt))
 	if err == nil {
 		return true
@@ -103,6 +153,33 @@ func VerifyLoginPassword(unsaltedPassowrd string, salt string, saltedHash []byte
 	return false
 }
 
+// VerifyDerivedLoginPassword verifies a password made by DeriveLoginPassword
+// against the stored hash. Hashes made from the plaintext password never match.
+func VerifyDerivedLoginPassword(derivedPassword string, saltedHash []byte) bool {
+	if !IsDerivedLoginHash(saltedHash) {
+		return false
+	}
+	err := bcrypt.CompareHashAndPassword(saltedHash[len(derivedLoginPrefix):], []byte(derivedPassword))
+	return err == nil
+}
+
+// GenSharePasswordHash hashes the password for a share with bcrypt alone. Share
+// passwords are checked on anonymous requests, so they skip the scrypt step of
+// login passwords to keep each attempt cheap for the server.
+func GenSharePasswordHash(password string) ([]byte, error) {
+	hash, err := bcrypt.GenerateFromPassword([]byte(password), defaultPasswordCost)
+	if err != nil {
+		return nil, fmt.Errorf("failed to generate hash for the share password: %v", err)
+	}
+	return hash, nil
+}
+
+// VerifySharePassword returns true if the password matches the hash made by
+// GenSharePasswordHash.
+func VerifySharePassword(password string, hash []byte) bool {
+	return bcrypt.CompareHashAndPassword(hash, []byte(password)) == nil
+}
+
 func getSalt(n int) (string, error) {
 	// generate n-number of crypto random bytes
 	b := make([]byte, n)
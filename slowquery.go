@@ -0,0 +1,157 @@
+// Copyright 2017, Timothy Bogdala <tdb@animal-machine.com>
+// See the LICENSE file for more details.
+
+package filefreezer
+
+import (
+	"context"
+	"database/sql/driver"
+	"fmt"
+	"strings"
+	"sync"
+	"time"
+)
+
+// slowQueryMaxArg is the longest a query argument is logged before it's cut
+// short.
+const slowQueryMaxArg = 64
+
+// slowQueryLog logs the queries that take longer than its threshold. The
+// threshold can be changed while the database is in use.
+type slowQueryLog struct {
+	lock      sync.Mutex
+	threshold time.Duration
+	logf      func(format string, v ...interface{})
+}
+
+// LogSlowQueries logs each query that takes longer than threshold with logf,
+// along with its arguments; a threshold of zero stops logging. The time of a
+// query includes reading all of its rows so that queries scanning a lot of
+// the database, such as for large accounts, stand out.
+func (s *Storage) LogSlowQueries(threshold time.Duration, logf func(format string, v ...interface{})) {
+	s.slow.lock.Lock()
+	defer s.slow.lock.Unlock()
+	s.slow.threshold = threshold
+	s.slow.logf = logf
+}
+
+// check logs the query if it started long enough ago to be slow.
+func (l *slowQueryLog) check(start time.Time, query string, args []driver.NamedValue) {
+	elapsed := time.Since(start)
+	l.lock.Lock()
+	threshold, logf := l.threshold, l.logf
+	l.lock.Unlock()
+	if threshold <= 0 || logf == nil || elapsed < threshold {
+		return
+	}
+	logf("Slow query (%s): %s %s\n", elapsed.Round(time.Millisecond), strings.Join(strings.Fields(query), " "), formatQueryArgs(args))
+}
+
+// formatQueryArgs formats the arguments of a query for the log, leaving out
+// the contents of binary data like chunks.
+func formatQueryArgs(args []driver.NamedValue) string {
+	formatted := make([]string, len(args))
+	for i, arg := range args {
+		switch v := arg.Value.(type) {
+		case []byte:
+			formatted[i] = fmt.Sprintf("<%d bytes>", len(v))
+		case string:
+			if len(v) > slowQueryMaxArg {
+				v = v[:slowQueryMaxArg] + "..."
+			}
+			formatted[i] = fmt.Sprintf("%q", v)
+		default:
+			formatted[i] = fmt.Sprintf("%v", v)
+		}
+	}
+	return "[" + strings.Join(formatted, ", ") + "]"
+}
+
+// timedConnector opens connections to the database whose queries are timed
+// by the slowQueryLog.
+type timedConnector struct {
+	dsn  string
+	base driver.Driver
+	slow *slowQueryLog
+}
+
+// Connect implements driver.Connector.
+func (c *timedConnector) Connect(ctx context.Context) (driver.Conn, error) {
+	conn, err := c.base.Open(c.dsn)
+	if err != nil {
+		return nil, err
+	}
+	return &timedConn{Conn: conn, slow: c.slow}, nil
+}
+
+// Driver implements driver.Connector.
+func (c *timedConnector) Driver() driver.Driver {
+	return c.base
+}
+
+// timedConn times the queries run directly on the connection, which is how
+// both SQLite drivers run them. Anything the driver doesn't support is
+// skipped so that database/sql falls back as it would without the wrapper.
+type timedConn struct {
+	driver.Conn
+	slow *slowQueryLog
+}
+
+// BeginTx implements driver.ConnBeginTx.
+func (c *timedConn) BeginTx(ctx context.Context, opts driver.TxOptions) (driver.Tx, error) {
+	if b, ok := c.Conn.(driver.ConnBeginTx); ok {
+		return b.BeginTx(ctx, opts)
+	}
+	return c.Conn.Begin()
+}
+
+// ExecContext implements driver.ExecerContext.
+func (c *timedConn) ExecContext(ctx context.Context, query string, args []driver.NamedValue) (driver.Result, error) {
+	execer, ok := c.Conn.(driver.ExecerContext)
+	if !ok {
+		return nil, driver.ErrSkip
+	}
+	start := time.Now()
+	result, err := execer.ExecContext(ctx, query, args)
+	c.slow.check(start, query, args)
+	return result, err
+}
+
+// QueryContext implements driver.QueryerContext.
+func (c *timedConn) QueryContext(ctx context.Context, query string, args []driver.NamedValue) (driver.Rows, error) {
+	queryer, ok := c.Conn.(driver.QueryerContext)
+	if !ok {
+		return nil, driver.ErrSkip
+	}
+	start := time.Now()
+	rows, err := queryer.QueryContext(ctx, query, args)
+	if err != nil {
+		c.slow.check(start, query, args)
+		return nil, err
+	}
+	return &timedRows{Rows: rows, slow: c.slow, start: start, query: query, args: args}, nil
+}
+
+// CheckNamedValue implements driver.NamedValueChecker.
+func (c *timedConn) CheckNamedValue(nv *driver.NamedValue) error {
+	if checker, ok := c.Conn.(driver.NamedValueChecker); ok {
+		return checker.CheckNamedValue(nv)
+	}
+	return driver.ErrSkip
+}
+
+// timedRows finishes timing a query once its rows are closed.
+type timedRows struct {
+	driver.Rows
+	slow  *slowQueryLog
+	start time.Time
+	query string
+	args  []driver.NamedValue
+}
+
+// Close implements driver.Rows.
+func (r *timedRows) Close() error {
+	err := r.Rows.Close()
+	r.slow.check(r.start, r.query, r.args)
+	return err
+}
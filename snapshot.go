@@ -0,0 +1,90 @@
+// Copyright 2017, Timothy Bogdala <tdb@animal-machine.com>
+// See the LICENSE file for more details.
+
+package filefreezer
+
+import (
+	"fmt"
+	"os"
+)
+
+const (
+	snapshotDB       = `VACUUM INTO ?;`
+	getAllChunkInfos = `SELECT FileID, VersionID, ChunkNum, ChunkHash, ChunkLength, LENGTH(Chunk) FROM FileChunks ORDER BY FileID, VersionID, ChunkNum;`
+	checkpointWAL    = `PRAGMA wal_checkpoint(TRUNCATE);`
+)
+
+// Snapshot describes a copy of the database made by Storage.Snapshot along
+// with the chunks it references.
+type Snapshot struct {
+	// DBVersion is the version of the tables in the copy
+	DBVersion int
+
+	// Chunks are all of the file chunks in the copy
+	Chunks []SnapshotChunk
+}
+
+// SnapshotChunk is a file chunk referenced by a Snapshot.
+type SnapshotChunk struct {
+	FileID      int
+	VersionID   int
+	ChunkNumber int
+	ChunkHash   string
+	Length      int64
+
+	// BlobKey is the key of the chunk's data in the BlobStore, or empty if
+	// the data is in the database copy itself.
+	BlobKey string
+}
+
+// Snapshot checkpoints the write-ahead log and writes a consistent copy of
+// the database to dbPath, which must not exist yet, then lists the chunks
+// the copy references. Callers should keep other writes out while it runs so
+// that the list matches the copy; the chunk data in a BlobStore has to be
+// backed up separately using the keys listed.
+func (s *Storage) Snapshot(dbPath string) (*Snapshot, error) {
+	if _, err := os.Stat(dbPath); err == nil {
+		return nil, fmt.Errorf("the snapshot %s already exists", dbPath)
+	}
+
+	_, err := s.db.Exec(checkpointWAL)
+	if err != nil {
+		return nil, fmt.Errorf("failed to checkpoint the database: %v", err)
+	}
+	_, err = s.db.Exec(snapshotDB, dbPath)
+	if err != nil {
+		return nil, fmt.Errorf("failed to write the database snapshot to %s: %v", dbPath, err)
+	}
+
+	snap := new(Snapshot)
+	err = s.db.QueryRow(getAppDBVersion).Scan(&snap.DBVersion)
+	if err != nil {
+		return nil, fmt.Errorf("failed to get the database version for the snapshot: %v", err)
+	}
+
+	rows, err := s.db.Query(getAllChunkInfos)
+	if err != nil {
+		return nil, fmt.Errorf("failed to get the file chunks for the snapshot: %v", err)
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var c SnapshotChunk
+		var stored int64
+		err = rows.Scan(&c.FileID, &c.VersionID, &c.ChunkNumber, &c.ChunkHash, &c.Length, &stored)
+		if err != nil {
+			return nil, fmt.Errorf("failed to scan the next row while processing the snapshot chunks: %v", err)
+		}
+
+		// as in GetFileChunk, chunks stored before the BlobStore was set up
+		// are still in the database
+		if s.Blobs != nil && stored == 0 {
+			c.BlobKey = chunkBlobKey(c.FileID, c.VersionID, c.ChunkNumber)
+		}
+		snap.Chunks = append(snap.Chunks, c)
+	}
+	if err = rows.Err(); err != nil {
+		return nil, err
+	}
+
+	return snap, nil
+}
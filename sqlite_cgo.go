@@ -0,0 +1,17 @@
+// Copyright 2017, Timothy Bogdala <tdb@animal-machine.com>
+// See the LICENSE file for more details.
+
+//go:build !purego
+// +build !purego
+
+package filefreezer
+
+import (
+	// import the cgo sqlite3 driver for use with database/sql
+	_ "github.com/mattn/go-sqlite3"
+)
+
+// SQLiteDriver is the name of the database/sql driver that NewStorage opens
+// databases with. Building with the purego tag swaps it for a driver that
+// doesn't need cgo.
+const SQLiteDriver = "sqlite3"
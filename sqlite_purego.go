@@ -0,0 +1,17 @@
+// Copyright 2017, Timothy Bogdala <tdb@animal-machine.com>
+// See the LICENSE file for more details.
+
+//go:build purego
+// +build purego
+
+package filefreezer
+
+import (
+	// import the pure Go sqlite driver for use with database/sql so that
+	// builds can cross-compile without a cgo toolchain
+	_ "modernc.org/sqlite"
+)
+
+// SQLiteDriver is the name of the database/sql driver that NewStorage opens
+// databases with.
+const SQLiteDriver = "sqlite"
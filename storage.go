@@ -5,19 +5,28 @@ package filefreezer
 
 import (
 	"database/sql"
+	"errors"
 	"fmt"
+	"io"
 	"sort"
-
-	// import the sqlite3 driver for use with database/sql
-	_ "github.com/mattn/go-sqlite3"
+	"strings"
+	"time"
 )
 
 const (
 	// CurrentDBVersion is set to the current database version and is used
 	// by filefreezer to detect when the database tables need to get updated.
-	CurrentDBVersion = 1
+	CurrentDBVersion = 6
 )
 
+// ErrVersionFinalized is returned by UpdateFileVersionChunks for a version that
+// already has its chunk count and hash or that isn't the file's current version.
+var ErrVersionFinalized = errors.New("only the current version of a file can be finalized, and only once")
+
+// ErrDropFileTooLarge is returned by AddDropFile when the data read is larger
+// than the drop token's file size limit.
+var ErrDropFileTooLarge = errors.New("the file is larger than the drop token's size limit")
+
 const (
 	createAppDataTable = `CREATE TABLE IF NOT EXISTS AppData (
 		DBVersion	INTEGER				NOT NULL
@@ -35,7 +44,9 @@ const (
         UserID 		INTEGER PRIMARY KEY	NOT NULL,
         Quota		INTEGER				NOT NULL,
         Allocated	INTEGER				NOT NULL,
-        Revision	INTEGER				NOT NULL
+        Revision	INTEGER				NOT NULL,
+        MaxVersions	INTEGER				NOT NULL DEFAULT 0,
+        MaxEgress	INTEGER				NOT NULL DEFAULT 0
     );`
 
 	createFileInfoTable = `CREATE TABLE IF NOT EXISTS FileInfo (
@@ -53,7 +64,9 @@ const (
         Perms       INTEGER             NOT NULL,
         LastMod		INTEGER				NOT NULL,
         ChunkCount  INTEGER				NOT NULL,
-        FileHash	TEXT				NOT NULL
+        FileHash	TEXT				NOT NULL,
+        Created		INTEGER				NOT NULL DEFAULT 0,
+        Device		TEXT				NOT NULL DEFAULT ''
     );`
 
 	createFileChunksTable = `CREATE TABLE IF NOT EXISTS FileChunks (
@@ -62,39 +75,183 @@ const (
         VersionID   INTEGER             NOT NULL,
         ChunkNum	INTEGER 			NOT NULL,
         ChunkHash	TEXT				NOT NULL,
-        Chunk		BLOB				NOT NULL
+        Chunk		BLOB				NOT NULL,
+        ChunkLength	INTEGER				NOT NULL DEFAULT 0,
+        DataHash	TEXT				NOT NULL DEFAULT ''
+	);`
+
+	createAccountFreezesTable = `CREATE TABLE IF NOT EXISTS AccountFreezes (
+        UserID 		INTEGER PRIMARY KEY	NOT NULL,
+        FrozenAt	INTEGER				NOT NULL,
+        Reason		TEXT				NOT NULL
+	);`
+
+	createSharesTable = `CREATE TABLE IF NOT EXISTS Shares (
+        ShareID     INTEGER PRIMARY KEY	NOT NULL,
+        UserID 		INTEGER             NOT NULL,
+        Name		TEXT				NOT NULL,
+        LastMod		INTEGER				NOT NULL,
+        ChunkCount  INTEGER				NOT NULL,
+        FileHash	TEXT				NOT NULL,
+        ContentType TEXT				NOT NULL DEFAULT '',
+        PasswordHash BLOB,
+        MaxDownloads INTEGER			NOT NULL DEFAULT 0,
+        DownloadCount INTEGER			NOT NULL DEFAULT 0,
+        UNIQUE (UserID, Name)
+	);`
+
+	createShareChunksTable = `CREATE TABLE IF NOT EXISTS ShareChunks (
+        ShareID     INTEGER             NOT NULL,
+        ChunkNum	INTEGER 			NOT NULL,
+        Chunk		BLOB				NOT NULL,
+        PRIMARY KEY (ShareID, ChunkNum)
+	);`
+
+	createDropTokensTable = `CREATE TABLE IF NOT EXISTS DropTokens (
+        DropID      INTEGER PRIMARY KEY	NOT NULL,
+        UserID 		INTEGER             NOT NULL,
+        Token		TEXT	UNIQUE		NOT NULL,
+        Folder		TEXT				NOT NULL,
+        MaxFileSize INTEGER				NOT NULL,
+        MaxFiles	INTEGER				NOT NULL,
+        FileCount	INTEGER				NOT NULL,
+        Created		INTEGER				NOT NULL
+	);`
+
+	createDropFilesTable = `CREATE TABLE IF NOT EXISTS DropFiles (
+        DropFileID  INTEGER PRIMARY KEY	NOT NULL,
+        UserID 		INTEGER             NOT NULL,
+        Folder		TEXT				NOT NULL,
+        Name		TEXT				NOT NULL,
+        Uploaded	INTEGER				NOT NULL,
+        Data		BLOB				NOT NULL
+	);`
+
+	createDropFileChunksTable = `CREATE TABLE IF NOT EXISTS DropFileChunks (
+        DropFileID  INTEGER             NOT NULL,
+        ChunkNum	INTEGER 			NOT NULL,
+        Chunk		BLOB				NOT NULL,
+        PRIMARY KEY (DropFileID, ChunkNum)
+	);`
+
+	createSupportConsentsTable = `CREATE TABLE IF NOT EXISTS SupportConsents (
+        UserID 		INTEGER PRIMARY KEY	NOT NULL,
+        Expires		INTEGER				NOT NULL
+	);`
+
+	createSupportTokensTable = `CREATE TABLE IF NOT EXISTS SupportTokens (
+        SupportID   INTEGER PRIMARY KEY	NOT NULL,
+        UserID 		INTEGER             NOT NULL,
+        Token		TEXT	UNIQUE		NOT NULL,
+        Reason		TEXT				NOT NULL,
+        BreakGlass	INTEGER				NOT NULL,
+        Created		INTEGER				NOT NULL,
+        Expires		INTEGER				NOT NULL
+	);`
+
+	createSupportAuditTable = `CREATE TABLE IF NOT EXISTS SupportAudit (
+        AuditID     INTEGER PRIMARY KEY	NOT NULL,
+        UserID 		INTEGER             NOT NULL,
+        SupportID	INTEGER             NOT NULL,
+        Time		INTEGER				NOT NULL,
+        Action		TEXT				NOT NULL
+	);`
+
+	createAccountDeletionsTable = `CREATE TABLE IF NOT EXISTS AccountDeletions (
+        UserID 		INTEGER PRIMARY KEY	NOT NULL,
+        Token		TEXT				NOT NULL,
+        Requested	INTEGER				NOT NULL,
+        DeleteAt	INTEGER				NOT NULL
+	);`
+
+	createBandwidthTable = `CREATE TABLE IF NOT EXISTS Bandwidth (
+        UserID 		INTEGER             NOT NULL,
+        Day			TEXT				NOT NULL,
+        Requests	INTEGER				NOT NULL,
+        Uploaded	INTEGER				NOT NULL,
+        Downloaded	INTEGER				NOT NULL,
+        PRIMARY KEY (UserID, Day)
 	);`
 
-	getAppDBVersion = `SELECT DBVersion FROM AppData;`
-	setAppDBVersion = `INSERT OR REPLACE INTO AppData (DBVersion) VALUES (?);`
+	createFileLocksTable = `CREATE TABLE IF NOT EXISTS FileLocks (
+        FileID		INTEGER PRIMARY KEY	NOT NULL,
+        UserID 		INTEGER             NOT NULL,
+        Token		TEXT				NOT NULL,
+        Holder		TEXT				NOT NULL,
+        Created		INTEGER				NOT NULL,
+        Expires		INTEGER				NOT NULL
+	);`
+
+	// the indexes are created along with the tables, which also adds them to
+	// databases made by older versions. The FileChunks index covers the chunk
+	// listings so that they don't read the rows holding the chunk data.
+	createFileInfoUserIndex = `CREATE INDEX IF NOT EXISTS FileInfoByUser
+		ON FileInfo (UserID, FileName);`
+	createFileVersionFileIndex = `CREATE INDEX IF NOT EXISTS FileVersionByFile
+		ON FileVersion (FileID, VersionNum);`
+	createFileChunksVersionIndex = `CREATE INDEX IF NOT EXISTS FileChunksByVersion
+		ON FileChunks (FileID, VersionID, ChunkNum, ChunkHash, ChunkLength);`
+
+	getAppDBVersion    = `SELECT DBVersion FROM AppData;`
+	setAppDBVersion    = `INSERT OR REPLACE INTO AppData (DBVersion) VALUES (?);`
+	updateAppDBVersion = `UPDATE AppData SET DBVersion = ?;`
+
+	// migrations from version 1 to 2
+	addFileVersionCreated = `ALTER TABLE FileVersion ADD COLUMN Created INTEGER NOT NULL DEFAULT 0;`
+	addFileVersionDevice  = `ALTER TABLE FileVersion ADD COLUMN Device TEXT NOT NULL DEFAULT '';`
+
+	// migrations from version 2 to 3
+	addFileChunkLength  = `ALTER TABLE FileChunks ADD COLUMN ChunkLength INTEGER NOT NULL DEFAULT 0;`
+	setFileChunkLengths = `UPDATE FileChunks SET ChunkLength = LENGTH(Chunk);`
+
+	// migrations from version 3 to 4
+	addUserStatsMaxVersions = `ALTER TABLE UserStats ADD COLUMN MaxVersions INTEGER NOT NULL DEFAULT 0;`
+
+	// migrations from version 4 to 5
+	addFileChunkDataHash = `ALTER TABLE FileChunks ADD COLUMN DataHash TEXT NOT NULL DEFAULT '';`
+
+	// migrations from version 5 to 6
+	addUserStatsMaxEgress = `ALTER TABLE UserStats ADD COLUMN MaxEgress INTEGER NOT NULL DEFAULT 0;`
 
 	lookupUserByName  = `SELECT Name FROM Users WHERE Name = ?;`
 	addUser           = `INSERT INTO Users (Name, Salt, Password) VALUES (?, ?, ?);`
 	getUser           = `SELECT UserID, Salt, Password, CryptoHash FROM Users  WHERE Name = ?;`
+	getAllUsers       = `SELECT UserID, Name, Salt, Password, CryptoHash FROM Users;`
 	setUserCryptoHash = `UPDATE Users SET CryptoHash = (?) WHERE UserID = ?;`
 	updateUser        = `UPDATE Users SET Name = ?, Salt = ?, Password = ?, CryptoHash = ? WHERE UserID = ?;`
 
-	setUserStats    = `INSERT OR REPLACE INTO UserStats (UserID, Quota, Allocated, Revision) VALUES (?, ?, ?, ?);`
-	getUserStats    = `SELECT Quota, Allocated, Revision FROM UserStats WHERE UserID = ?;`
-	updateUserStats = `UPDATE UserStats SET Allocated = Allocated + (?), Revision = Revision + 1 WHERE UserID = ?;`
-	setUserQuota    = `UPDATE UserStats SET Quota = (?) WHERE UserID = ?;`
+	setUserStats       = `INSERT OR REPLACE INTO UserStats (UserID, Quota, Allocated, Revision) VALUES (?, ?, ?, ?);`
+	getUserStats       = `SELECT Quota, Allocated, Revision, MaxVersions, MaxEgress FROM UserStats WHERE UserID = ?;`
+	updateUserStats    = `UPDATE UserStats SET Allocated = Allocated + (?), Revision = Revision + 1 WHERE UserID = ?;`
+	setUserQuota       = `UPDATE UserStats SET Quota = (?), Revision = Revision + 1 WHERE UserID = ?;`
+	setUserMaxVersions = `UPDATE UserStats SET MaxVersions = (?), Revision = Revision + 1 WHERE UserID = ?;`
+	setUserMaxEgress   = `UPDATE UserStats SET MaxEgress = (?), Revision = Revision + 1 WHERE UserID = ?;`
+	bumpUserRevision   = `UPDATE UserStats SET Revision = Revision + 1 WHERE UserID = ?;`
 
 	addFileInfo = `INSERT INTO FileInfo (UserID, FileName, IsDir, CurrentVersionID) SELECT ?, ?, ?, ?
                         WHERE NOT EXISTS (SELECT 1 FROM FileInfo WHERE UserID = ? AND FileName = ?);`
-	getFileInfo           = `SELECT UserID, FileName, IsDir, CurrentVersionID FROM FileInfo WHERE FileID = ?;`
-	getFileInfoByName     = `SELECT FileID, IsDir, CurrentVersionID FROM FileInfo WHERE FileName = ? AND UserID = ?;`
-	getFileInfoOwner      = `SELECT UserID  FROM FileInfo WHERE FileID = ?;`
-	getAllUserFiles       = `SELECT FileID, FileName, IsDir, CurrentVersionID FROM FileInfo WHERE UserID = ?;`
+	getFileInfo            = `SELECT UserID, FileName, IsDir, CurrentVersionID FROM FileInfo WHERE FileID = ?;`
+	getFileInfoByName      = `SELECT FileID, IsDir, CurrentVersionID FROM FileInfo WHERE FileName = ? AND UserID = ?;`
+	getFileInfoOwner       = `SELECT UserID  FROM FileInfo WHERE FileID = ?;`
+	getAllUserFiles        = `SELECT FileID, FileName, IsDir, CurrentVersionID FROM FileInfo WHERE UserID = ?;`
+	getAllUserFileVersions = `SELECT FileInfo.FileID, FileName, IsDir, CurrentVersionID, VersionNum, Perms, LastMod, ChunkCount, FileHash, Created
+					FROM FileInfo INNER JOIN FileVersion ON FileVersion.VersionID = FileInfo.CurrentVersionID
+					WHERE FileInfo.UserID = ?;`
 	removeFileInfoByID    = `DELETE FROM FileInfo WHERE FileID = ?;`
 	setFileCurrentVersion = `UPDATE FileInfo SET CurrentVersionID = ? WHERE FileID = ?;`
-
-	addFileVersion                = `INSERT INTO FileVersion (FileID, VersionNum, Perms, LastMod, ChunkCount, FileHash) VALUES (?, ?, ?, ?, ?, ?);`
-	getFileVersionByID            = `SELECT VersionNum, Perms, LastMod, ChunkCount, FileHash FROM FileVersion WHERE VersionID = ?;`
+	setFileName           = `UPDATE FileInfo SET FileName = ? WHERE FileID = ? AND UserID = ?;`
+
+	addFileVersion                = `INSERT INTO FileVersion (FileID, VersionNum, Perms, LastMod, ChunkCount, FileHash, Created, Device) VALUES (?, ?, ?, ?, ?, ?, ?, ?);`
+	getFileVersionByID            = `SELECT VersionNum, Perms, LastMod, ChunkCount, FileHash, Created FROM FileVersion WHERE VersionID = ?;`
+	getFileVersionChunkCount      = `SELECT ChunkCount FROM FileVersion WHERE VersionID = ? AND FileID = ?;`
+	getFileVersionChunksAndHash   = `SELECT ChunkCount, FileHash FROM FileVersion WHERE VersionID = ? AND FileID = ?;`
+	countFileChunksFrom           = `SELECT COUNT(*) FROM FileChunks WHERE FileID = ? AND VersionID = ? AND ChunkNum >= ?;`
+	updateFileVersionChunks       = `UPDATE FileVersion SET ChunkCount = ?, FileHash = ? WHERE VersionID = ? AND FileID = ?;`
 	removeAllFileVersionsByFileID = `DELETE FROM FileVersion WHERE FileID = ?;`
 	removeFileVersionsByFileID    = `DELETE FROM FileVersion WHERE FileID = ? AND (VersionNum BETWEEN ? AND ?);`
-	getVersionsForFile            = `SELECT VersionID, VersionNum, Perms, LastMod, ChunkCount, FileHash FROM FileVersion WHERE FileID = ?;`
+	getVersionsForFile            = `SELECT VersionID, VersionNum, Perms, LastMod, ChunkCount, FileHash, Created, Device, (SELECT COALESCE(SUM(ChunkLength), 0) FROM FileChunks WHERE FileChunks.FileID = FileVersion.FileID AND FileChunks.VersionID = FileVersion.VersionID) FROM FileVersion WHERE FileID = ?;`
 	getVersionsCountForFile       = `SELECT COUNT(*) AS COUNT FROM FileVersion WHERE FileID = ? AND (VersionNum BETWEEN ? AND ?);`
-	getFileVersionsTotalChunkSize = `SELECT SUM(LENGTH(Chunk)) FROM FileChunks 
+	getFileVersionsTotalChunkSize = `SELECT SUM(ChunkLength) FROM FileChunks 
 					INNER JOIN FileVersion on FileChunks.VersionID = FileVersion.VersionID
 					WHERE FileChunks.FileID = ? AND (VersionNum BETWEEN ? AND ?);`
 	removeAllFileVersionChunks = `DELETE FROM FileChunks
@@ -103,19 +260,126 @@ const (
 						INNER JOIN FileVersion on FileChunks.VersionID = FileVersion.VersionID
 						WHERE FileChunks.FileID = ? AND (VersionNum BETWEEN ? AND ?)
 					);`
+	getFileVersionsChunkKeys = `SELECT FileChunks.FileID, FileChunks.VersionID, ChunkNum FROM FileChunks
+					INNER JOIN FileVersion on FileChunks.VersionID = FileVersion.VersionID
+					WHERE FileChunks.FileID = ? AND (VersionNum BETWEEN ? AND ?);`
 
-	getAllFileChunksByID  = `SELECT ChunkNum, ChunkHash FROM FileChunks WHERE FileID = ? AND VersionID = ?;`
-	addFileChunk          = `INSERT OR REPLACE INTO FileChunks (FileID, VersionID, ChunkNum, ChunkHash, Chunk) VALUES (?, ?, ?, ?, ?);`
+	getAllFileChunksByID  = `SELECT ChunkNum, ChunkHash, ChunkLength FROM FileChunks WHERE FileID = ? AND VersionID = ?;`
+	addFileChunk          = `INSERT OR REPLACE INTO FileChunks (FileID, VersionID, ChunkNum, ChunkHash, ChunkLength, DataHash, Chunk) VALUES (?, ?, ?, ?, ?, ?, ?);`
 	removeAllFileChunks   = `DELETE FROM FileChunks WHERE FileID = ?;`
 	removeFileChunk       = `DELETE FROM FileChunks WHERE FileID = ? AND VersionID = ? AND ChunkNum = ?;`
 	getFileChunk          = `SELECT ChunkHash, Chunk FROM FileChunks WHERE FileID = ? AND VersionID = ? AND ChunkNum = ?;`
-	getFileTotalChunkSize = `SELECT SUM(LENGTH(Chunk)) FROM FileChunks WHERE FileID = ?;`
+	getFileChunkLength    = `SELECT ChunkLength FROM FileChunks WHERE FileID = ? AND VersionID = ? AND ChunkNum = ?;`
+	getFileChunkKeys      = `SELECT FileID, VersionID, ChunkNum FROM FileChunks WHERE FileID = ?;`
+	getFileTotalChunkSize = `SELECT SUM(ChunkLength) FROM FileChunks WHERE FileID = ?;`
 	getNumberOfFileChunks = `SELECT COUNT(*) AS COUNT FROM FileChunks WHERE FileID = ?;`
+	getAllUserChunkSizes  = `SELECT FileChunks.FileID, FileChunks.VersionID, SUM(ChunkLength) FROM FileChunks
+					INNER JOIN FileInfo ON FileChunks.FileID = FileInfo.FileID
+					WHERE FileInfo.UserID = ? GROUP BY FileChunks.FileID, FileChunks.VersionID;`
+	getAllUserChunkKeys = `SELECT FileChunks.FileID, FileChunks.VersionID, ChunkNum FROM FileChunks
+					INNER JOIN FileInfo ON FileChunks.FileID = FileInfo.FileID
+					WHERE FileInfo.UserID = ?;`
+	getUserChunkUsage = `SELECT COALESCE(SUM(Logical), 0), COALESCE(SUM(Physical), 0) FROM (
+						SELECT SUM(ChunkLength) AS Logical, MAX(ChunkLength) AS Physical FROM FileChunks
+						INNER JOIN FileInfo ON FileChunks.FileID = FileInfo.FileID
+						WHERE FileInfo.UserID = ? GROUP BY ChunkHash
+					);`
+	getUserFileCounts = `SELECT COUNT(*), (SELECT COUNT(*) FROM FileVersion
+						INNER JOIN FileInfo ON FileVersion.FileID = FileInfo.FileID
+						WHERE FileInfo.UserID = ?) FROM FileInfo WHERE UserID = ?;`
+	getFileChunkCopyInfo = `SELECT ChunkNum, ChunkLength, LENGTH(Chunk) FROM FileChunks WHERE FileID = ? AND VersionID = ?;`
+	copyFileChunk        = `INSERT INTO FileChunks (FileID, VersionID, ChunkNum, ChunkHash, ChunkLength, DataHash, Chunk)
+					SELECT FileID, ?, ?, ChunkHash, ChunkLength, DataHash, Chunk FROM FileChunks
+					WHERE FileID = ? AND VersionID = ? AND ChunkNum = ?;`
+
+	setAccountFreeze    = `INSERT OR REPLACE INTO AccountFreezes (UserID, FrozenAt, Reason) VALUES (?, ?, ?);`
+	getAccountFreeze    = `SELECT FrozenAt, Reason FROM AccountFreezes WHERE UserID = ?;`
+	removeAccountFreeze = `DELETE FROM AccountFreezes WHERE UserID = ?;`
+
+	addShare             = `INSERT INTO Shares (UserID, Name, LastMod, ChunkCount, FileHash, ContentType, PasswordHash, MaxDownloads) VALUES (?, ?, ?, ?, ?, ?, ?, ?);`
+	getShareByName       = `SELECT ShareID, LastMod, ChunkCount, FileHash, ContentType, COALESCE(LENGTH(PasswordHash), 0) > 0, MaxDownloads, DownloadCount FROM Shares WHERE UserID = ? AND Name = ?;`
+	getShareOwner        = `SELECT UserID, ChunkCount FROM Shares WHERE ShareID = ?;`
+	getAllUserShares     = `SELECT ShareID, Name, LastMod, ChunkCount, FileHash, ContentType, COALESCE(LENGTH(PasswordHash), 0) > 0, MaxDownloads, DownloadCount, (SELECT COALESCE(SUM(LENGTH(Chunk)), 0) FROM ShareChunks WHERE ShareChunks.ShareID = Shares.ShareID) FROM Shares WHERE UserID = ? ORDER BY Name;`
+	setShareLimits       = `UPDATE Shares SET PasswordHash = ?, MaxDownloads = ? WHERE ShareID = ? AND UserID = ?;`
+	getSharePassword     = `SELECT PasswordHash FROM Shares WHERE ShareID = ?;`
+	countShareDownload   = `UPDATE Shares SET DownloadCount = DownloadCount + 1 WHERE ShareID = ? AND (MaxDownloads = 0 OR DownloadCount < MaxDownloads);`
+	setShareContentType  = `UPDATE Shares SET ContentType = ? WHERE ShareID = ? AND UserID = ? AND ContentType = '';`
+	removeShareByID      = `DELETE FROM Shares WHERE ShareID = ?;`
+	addShareChunk        = `INSERT OR REPLACE INTO ShareChunks (ShareID, ChunkNum, Chunk) VALUES (?, ?, ?);`
+	getShareChunk        = `SELECT Chunk FROM ShareChunks WHERE ShareID = ? AND ChunkNum = ?;`
+	getShareChunkSize    = `SELECT COALESCE(LENGTH(Chunk), 0) FROM ShareChunks WHERE ShareID = ? AND ChunkNum = ?;`
+	getShareChunkSizes   = `SELECT ChunkNum, LENGTH(Chunk) FROM ShareChunks WHERE ShareID = ? ORDER BY ChunkNum;`
+	getShareTotalSize    = `SELECT COALESCE(SUM(LENGTH(Chunk)), 0) FROM ShareChunks WHERE ShareID = ?;`
+	removeAllShareChunks = `DELETE FROM ShareChunks WHERE ShareID = ?;`
+	getSharesToRechunk   = `SELECT ShareID, UserID, Name, ChunkCount FROM Shares
+					WHERE ChunkCount = (SELECT COUNT(*) FROM ShareChunks WHERE ShareChunks.ShareID = Shares.ShareID)
+					AND EXISTS (SELECT 1 FROM ShareChunks WHERE ShareChunks.ShareID = Shares.ShareID
+						AND (LENGTH(Chunk) > ? OR (LENGTH(Chunk) < ? AND ChunkNum < Shares.ChunkCount - 1)))
+					ORDER BY ShareID;`
+	removeOldShareChunks = `DELETE FROM ShareChunks WHERE ShareID = ? AND ChunkNum >= 0;`
+	renumberShareChunks  = `UPDATE ShareChunks SET ChunkNum = -ChunkNum - 1 WHERE ShareID = ?;`
+	setShareChunkCount   = `UPDATE Shares SET ChunkCount = ? WHERE ShareID = ?;`
+
+	addDropToken          = `INSERT INTO DropTokens (UserID, Token, Folder, MaxFileSize, MaxFiles, FileCount, Created) VALUES (?, ?, ?, ?, ?, 0, ?);`
+	getDropTokenByToken   = `SELECT DropID, UserID, Folder, MaxFileSize, MaxFiles, FileCount, Created FROM DropTokens WHERE Token = ?;`
+	getAllUserDropTokens  = `SELECT DropID, Token, Folder, MaxFileSize, MaxFiles, FileCount, Created FROM DropTokens WHERE UserID = ? ORDER BY DropID;`
+	removeDropToken       = `DELETE FROM DropTokens WHERE DropID = ? AND UserID = ?;`
+	incDropTokenFileCount = `UPDATE DropTokens SET FileCount = FileCount + 1 WHERE DropID = ?;`
+	decDropTokenFileCount = `UPDATE DropTokens SET FileCount = FileCount - 1 WHERE DropID = ? AND FileCount > 0;`
+	addDropFile           = `INSERT INTO DropFiles (UserID, Folder, Name, Uploaded, Data) VALUES (?, ?, ?, 0, x'');`
+	finishDropFile        = `UPDATE DropFiles SET Uploaded = ? WHERE DropFileID = ?;`
+	addDropFileChunk      = `INSERT INTO DropFileChunks (DropFileID, ChunkNum, Chunk) VALUES (?, ?, ?);`
+	getAllUserDropFiles   = `SELECT DropFileID, Folder, Name, Uploaded, LENGTH(Data) + ` + dropFileChunksSize + ` FROM DropFiles WHERE UserID = ? AND Uploaded > 0 ORDER BY DropFileID;`
+	getDropFileData       = `SELECT Data FROM DropFiles WHERE DropFileID = ? AND UserID = ? AND Uploaded > 0;`
+	getDropFileChunks     = `SELECT Chunk FROM DropFileChunks WHERE DropFileID = ? ORDER BY ChunkNum;`
+	getDropFileSize       = `SELECT LENGTH(Data) + ` + dropFileChunksSize + ` FROM DropFiles WHERE DropFileID = ? AND UserID = ?;`
+	removeDropFile        = `DELETE FROM DropFiles WHERE DropFileID = ? AND UserID = ?;`
+	removeDropFileChunks  = `DELETE FROM DropFileChunks WHERE DropFileID = ?;`
+
+	// dropFileChunksSize sums the chunks of a drop file; files dropped before
+	// they were stored in chunks keep their data in DropFiles itself
+	dropFileChunksSize = `(SELECT COALESCE(SUM(LENGTH(Chunk)), 0) FROM DropFileChunks WHERE DropFileChunks.DropFileID = DropFiles.DropFileID)`
+
+	setSupportConsent      = `INSERT OR REPLACE INTO SupportConsents (UserID, Expires) VALUES (?, ?);`
+	getSupportConsent      = `SELECT Expires FROM SupportConsents WHERE UserID = ?;`
+	removeSupportConsent   = `DELETE FROM SupportConsents WHERE UserID = ?;`
+	addSupportToken        = `INSERT INTO SupportTokens (UserID, Token, Reason, BreakGlass, Created, Expires) VALUES (?, ?, ?, ?, ?, ?);`
+	getSupportTokenByToken = `SELECT SupportID, UserID, Reason, BreakGlass, Created, Expires FROM SupportTokens WHERE Token = ?;`
+	addSupportAudit        = `INSERT INTO SupportAudit (UserID, SupportID, Time, Action) VALUES (?, ?, ?, ?);`
+	getAllUserSupportAudit = `SELECT AuditID, SupportID, Time, Action FROM SupportAudit WHERE UserID = ? ORDER BY AuditID;`
+
+	setAccountDeletion     = `INSERT OR REPLACE INTO AccountDeletions (UserID, Token, Requested, DeleteAt) VALUES (?, ?, ?, ?);`
+	getAccountDeletion     = `SELECT Token, Requested, DeleteAt FROM AccountDeletions WHERE UserID = ?;`
+	getDueAccountDeletions = `SELECT UserID, Token, Requested, DeleteAt FROM AccountDeletions WHERE DeleteAt > 0 AND DeleteAt <= ? ORDER BY UserID;`
+	removeAccountDeletion  = `DELETE FROM AccountDeletions WHERE UserID = ?;`
+
+	addUserBandwidth = `INSERT INTO Bandwidth (UserID, Day, Requests, Uploaded, Downloaded) VALUES (?, ?, 1, ?, ?)
+					ON CONFLICT (UserID, Day) DO UPDATE SET Requests = Requests + 1,
+					Uploaded = Uploaded + excluded.Uploaded, Downloaded = Downloaded + excluded.Downloaded;`
+	getUserBandwidth = `SELECT Day, Requests, Uploaded, Downloaded FROM Bandwidth WHERE UserID = ? AND Day >= ? ORDER BY Day;`
+
+	getFileLock         = `SELECT UserID, Token, Holder, Created, Expires FROM FileLocks WHERE FileID = ?;`
+	setFileLock         = `INSERT OR REPLACE INTO FileLocks (FileID, UserID, Token, Holder, Created, Expires) VALUES (?, ?, ?, ?, ?, ?);`
+	removeFileLock      = `DELETE FROM FileLocks WHERE FileID = ? AND Token = ?;`
+	removeAllFileLocks  = `DELETE FROM FileLocks WHERE FileID = ?;`
+	getAllUserFileLocks = `SELECT FileID, Token, Holder, Created, Expires FROM FileLocks WHERE UserID = ? AND Expires > ? ORDER BY FileID;`
 
 	removeUser = `DELETE FROM FileChunks WHERE FileID IN (SELECT FileID FROM FileInfo WHERE UserID = ?);
 		DELETE FROM FileVersion WHERE FileID IN (SELECT FileID FROM FileInfo WHERE UserID = ?);
 		DELETE FROM FileInfo WHERE UserID = ?;
         DELETE FROM UserStats WHERE UserID = ?;
+        DELETE FROM AccountFreezes WHERE UserID = ?;
+        DELETE FROM ShareChunks WHERE ShareID IN (SELECT ShareID FROM Shares WHERE UserID = ?);
+        DELETE FROM Shares WHERE UserID = ?;
+        DELETE FROM DropTokens WHERE UserID = ?;
+        DELETE FROM DropFileChunks WHERE DropFileID IN (SELECT DropFileID FROM DropFiles WHERE UserID = ?);
+        DELETE FROM DropFiles WHERE UserID = ?;
+        DELETE FROM SupportConsents WHERE UserID = ?;
+        DELETE FROM SupportTokens WHERE UserID = ?;
+        DELETE FROM SupportAudit WHERE UserID = ?;
+        DELETE FROM AccountDeletions WHERE UserID = ?;
+        DELETE FROM Bandwidth WHERE UserID = ?;
+        DELETE FROM FileLocks WHERE UserID = ?;
         DELETE FROM Users WHERE UserID = ?;`
 )
 
@@ -126,6 +390,10 @@ type FileInfo struct {
 	FileName       string
 	IsDir          bool
 	CurrentVersion FileVersionInfo
+
+	// Size is the number of bytes stored for the chunks of all versions of
+	// the file. It's only filled in by GetAllUserFileInfos.
+	Size int64
 }
 
 // FileVersionInfo contains the version-specific information for a given file.
@@ -136,6 +404,18 @@ type FileVersionInfo struct {
 	LastMod       int64
 	ChunkCount    int
 	FileHash      string
+
+	// Created is when the version was registered on the server (time in
+	// seconds since 1/1/1970).
+	Created int64
+
+	// Device identifies the client that uploaded the version; clients encrypt
+	// it like file names. It is empty for versions from older clients.
+	Device string
+
+	// Size is the number of bytes stored for the chunks of the version. It's
+	// only filled in by GetFileVersions and GetAllUserFileInfos.
+	Size int64
 }
 
 // FileChunk contains the information stored about a given file chunk.
@@ -145,6 +425,125 @@ type FileChunk struct {
 	ChunkNumber int
 	ChunkHash   string
 	Chunk       []byte
+
+	// Length is the number of bytes stored for the chunk. It's only set
+	// by GetFileChunkInfos, which leaves out the chunk bytes.
+	Length int64
+}
+
+// Share contains the information stored about a file that has been shared
+// publicly by a user. Shared files are stored unencrypted and separately from
+// the user's private files.
+type Share struct {
+	ShareID    int
+	UserID     int
+	Name       string
+	LastMod    int64
+	ChunkCount int
+	FileHash   string
+
+	// ContentType is the MIME type the share is served with; empty if unknown
+	ContentType string
+
+	// Protected is true if a password is required to download the share
+	Protected bool
+
+	// MaxDownloads is the number of times the share can be downloaded
+	// or zero if there's no limit
+	MaxDownloads int
+
+	// DownloadCount is the number of times the share has been downloaded
+	DownloadCount int
+
+	// Size is the number of bytes uploaded for the share; it's only set
+	// when listing all of a user's shares
+	Size int64
+}
+
+// DropToken contains the information stored about an upload-only link that lets
+// anyone holding the token add files to a folder of a user's account.
+type DropToken struct {
+	DropID      int
+	UserID      int
+	Token       string
+	Folder      string
+	MaxFileSize int64
+	MaxFiles    int
+	FileCount   int
+	Created     int64
+}
+
+// DropFile contains the information stored about a file uploaded with a
+// DropToken that hasn't been collected by the user yet.
+type DropFile struct {
+	DropFileID int
+	UserID     int
+	Folder     string
+	Name       string
+	Uploaded   int64
+	Size       int64
+}
+
+// SupportToken contains the information stored about a time-limited token that
+// lets an admin read the metadata of a user's account to help with problems.
+// Tokens are only made while the user consents to support access unless
+// BreakGlass is set, in which case Reason says why.
+type SupportToken struct {
+	SupportID  int
+	UserID     int
+	Token      string
+	Reason     string
+	BreakGlass bool
+	Created    int64
+	Expires    int64
+}
+
+// SupportAudit is a record of a support token being made or used on a user's
+// account, which the user can review.
+type SupportAudit struct {
+	AuditID   int
+	SupportID int
+	Time      int64
+	Action    string
+}
+
+// AccountDeletion is a user's request to have their account erased. Until the
+// request is confirmed with Token, DeleteAt is zero; afterwards it's when the
+// account gets erased, in Unix seconds.
+type AccountDeletion struct {
+	UserID    int
+	Token     string
+	Requested int64
+	DeleteAt  int64
+}
+
+// FileLock is an advisory lock on a file that clients take before changing it
+// so that other clients can hold off. Token identifies the holder, which renews
+// and releases the lock with it, and Holder describes the holder to the other
+// clients; clients encrypt it like file names. Times are in Unix seconds.
+type FileLock struct {
+	FileID  int
+	UserID  int
+	Token   string
+	Holder  string
+	Created int64
+	Expires int64
+}
+
+// BandwidthDayFormat is the layout of the days that bandwidth is recorded
+// for, which are in UTC.
+const BandwidthDayFormat = "2006-01-02"
+
+// BandwidthDay is the traffic of a user's requests on one day.
+type BandwidthDay struct {
+	// Day is formatted with BandwidthDayFormat
+	Day string
+
+	// Requests is the number of requests made, and Uploaded and Downloaded
+	// are the bytes of their bodies and of the responses.
+	Requests   int64
+	Uploaded   int64
+	Downloaded int64
 }
 
 // User contains the basic information stored about a use, but does not
@@ -162,6 +561,29 @@ type UserStats struct {
 	Quota     int
 	Allocated int
 	Revision  int
+
+	// MaxVersions is the number of versions of each file the server keeps for
+	// the user before pruning the oldest; zero uses the server's setting.
+	MaxVersions int
+
+	// MaxEgress is the number of bytes the user can download each month;
+	// zero uses the server's setting.
+	MaxEgress int64
+}
+
+// UserUsage is a count of what a user has stored, which is too expensive to
+// total up on every request for large accounts.
+type UserUsage struct {
+	// Revision is the user's revision at the time of the count.
+	Revision int
+
+	FileCount    int
+	VersionCount int
+
+	// LogicalSize is the bytes of chunk data in all versions of the user's
+	// files and PhysicalSize is the bytes of the unique chunks among them.
+	LogicalSize  int
+	PhysicalSize int
 }
 
 // Storage is the backend data model for the file storage logic.
@@ -169,17 +591,28 @@ type Storage struct {
 	// ChunkSize is the number of bytes the chunk can maximally be
 	ChunkSize int64
 
+	// Blobs, if set, keeps the data of file chunks instead of the database,
+	// which then only holds their hashes and lengths
+	Blobs BlobStore
+
 	// db is the database connection
 	db *sql.DB
+
+	// slow logs the queries that take too long
+	slow *slowQueryLog
 }
 
-// NewStorage creates a new Storage object using the sqlite3
-// driver at the path given.
+// NewStorage creates a new Storage object using the SQLiteDriver
+// at the path given.
 func NewStorage(dbPath string) (*Storage, error) {
-	db, err := sql.Open("sqlite3", dbPath)
+	// the driver's connections are wrapped so that slow queries can be logged
+	driverDB, err := sql.Open(SQLiteDriver, dbPath)
 	if err != nil {
 		return nil, fmt.Errorf("could not open the database (%s): %v", dbPath, err)
 	}
+	slow := new(slowQueryLog)
+	db := sql.OpenDB(&timedConnector{dsn: dbPath, base: driverDB.Driver(), slow: slow})
+	driverDB.Close()
 
 	// make sure we can hit the database by pinging it; this
 	// will detect potential connection problems early.
@@ -204,10 +637,30 @@ func NewStorage(dbPath string) (*Storage, error) {
 
 	s := new(Storage)
 	s.db = db
+	s.slow = slow
 	s.ChunkSize = 1024 * 1024 * 4 // 4MB
 	return s, nil
 }
 
+// LimitMemory shrinks the memory SQLite uses for the database: the page cache
+// is limited to cacheKiB kilobytes, the database file isn't memory mapped,
+// temporary tables are kept on disk and fewer idle connections, each with its
+// own cache, are kept open.
+func (s *Storage) LimitMemory(cacheKiB int) error {
+	s.db.SetMaxIdleConns(1)
+	for _, pragma := range []string{
+		fmt.Sprintf("PRAGMA main.cache_size=-%d;", cacheKiB),
+		"PRAGMA main.mmap_size=0;",
+		"PRAGMA temp_store=FILE;",
+	} {
+		_, err := s.db.Exec(pragma)
+		if err != nil {
+			return fmt.Errorf("failed to run %s: %v", pragma, err)
+		}
+	}
+	return nil
+}
+
 // Close releases the backend connections to the database.
 func (s *Storage) Close() {
 	s.db.Close()
@@ -246,8 +699,82 @@ func (s *Storage) CreateTables() error {
 		return fmt.Errorf("failed to create the FILECHUNKS table: %v", err)
 	}
 
+	_, err = s.db.Exec(createAccountFreezesTable)
+	if err != nil {
+		return fmt.Errorf("failed to create the ACCOUNTFREEZES table: %v", err)
+	}
+
+	_, err = s.db.Exec(createSharesTable)
+	if err != nil {
+		return fmt.Errorf("failed to create the SHARES table: %v", err)
+	}
+
+	_, err = s.db.Exec(createShareChunksTable)
+	if err != nil {
+		return fmt.Errorf("failed to create the SHARECHUNKS table: %v", err)
+	}
+
+	_, err = s.db.Exec(createDropTokensTable)
+	if err != nil {
+		return fmt.Errorf("failed to create the DROPTOKENS table: %v", err)
+	}
+
+	_, err = s.db.Exec(createDropFilesTable)
+	if err != nil {
+		return fmt.Errorf("failed to create the DROPFILES table: %v", err)
+	}
+
+	_, err = s.db.Exec(createDropFileChunksTable)
+	if err != nil {
+		return fmt.Errorf("failed to create the DROPFILECHUNKS table: %v", err)
+	}
+
+	_, err = s.db.Exec(createSupportConsentsTable)
+	if err != nil {
+		return fmt.Errorf("failed to create the SUPPORTCONSENTS table: %v", err)
+	}
+
+	_, err = s.db.Exec(createSupportTokensTable)
+	if err != nil {
+		return fmt.Errorf("failed to create the SUPPORTTOKENS table: %v", err)
+	}
+
+	_, err = s.db.Exec(createSupportAuditTable)
+	if err != nil {
+		return fmt.Errorf("failed to create the SUPPORTAUDIT table: %v", err)
+	}
+
+	_, err = s.db.Exec(createAccountDeletionsTable)
+	if err != nil {
+		return fmt.Errorf("failed to create the ACCOUNTDELETIONS table: %v", err)
+	}
+
+	_, err = s.db.Exec(createBandwidthTable)
+	if err != nil {
+		return fmt.Errorf("failed to create the BANDWIDTH table: %v", err)
+	}
+
+	_, err = s.db.Exec(createFileLocksTable)
+	if err != nil {
+		return fmt.Errorf("failed to create the FILELOCKS table: %v", err)
+	}
+
+	_, err = s.db.Exec(createFileInfoUserIndex)
+	if err != nil {
+		return fmt.Errorf("failed to create the index of files by user: %v", err)
+	}
+
+	_, err = s.db.Exec(createFileVersionFileIndex)
+	if err != nil {
+		return fmt.Errorf("failed to create the index of versions by file: %v", err)
+	}
+
+	_, err = s.db.Exec(createFileChunksVersionIndex)
+	if err != nil {
+		return fmt.Errorf("failed to create the index of chunks by version: %v", err)
+	}
+
 	// do some initialization if necessary
-	// TODO: Update database tables if there's a version bump.
 	var dbVersion int
 	err = s.db.QueryRow(getAppDBVersion).Scan(&dbVersion)
 	if err == sql.ErrNoRows {
@@ -257,8 +784,101 @@ func (s *Storage) CreateTables() error {
 		}
 	} else if err != nil {
 		return fmt.Errorf("failed to get the DBVersion from the AppData table: %v", err)
+	} else if dbVersion < CurrentDBVersion {
+		return s.migrateTables(dbVersion)
+	}
+
+	return nil
+}
+
+// migrateTables updates the tables of a database created by an older version of
+// filefreezer to the CurrentDBVersion.
+func (s *Storage) migrateTables(dbVersion int) error {
+	return s.transact(func(tx *sql.Tx) error {
+		if dbVersion < 2 {
+			// versions record when they were created and by which device
+			err := addColumn(tx, "FileVersion", "Created", addFileVersionCreated)
+			if err != nil {
+				return err
+			}
+			err = addColumn(tx, "FileVersion", "Device", addFileVersionDevice)
+			if err != nil {
+				return err
+			}
+		}
+		if dbVersion < 3 {
+			// chunk lengths are stored so that chunk data can be kept outside the database
+			err := addColumn(tx, "FileChunks", "ChunkLength", addFileChunkLength)
+			if err != nil {
+				return err
+			}
+			_, err = tx.Exec(setFileChunkLengths)
+			if err != nil {
+				return fmt.Errorf("failed to set the chunk lengths in the FILECHUNKS table: %v", err)
+			}
+		}
+		if dbVersion < 4 {
+			// users can have their own limit on the versions kept for each file
+			err := addColumn(tx, "UserStats", "MaxVersions", addUserStatsMaxVersions)
+			if err != nil {
+				return err
+			}
+		}
+		if dbVersion < 5 {
+			// chunks record a hash of their stored data so that fsck can find corruption;
+			// older chunks are left without one until fsck --repair fills it in
+			err := addColumn(tx, "FileChunks", "DataHash", addFileChunkDataHash)
+			if err != nil {
+				return err
+			}
+		}
+		if dbVersion < 6 {
+			// users can have their own limit on the bytes downloaded each month
+			err := addColumn(tx, "UserStats", "MaxEgress", addUserStatsMaxEgress)
+			if err != nil {
+				return err
+			}
+		}
+
+		_, err := tx.Exec(updateAppDBVersion, CurrentDBVersion)
+		if err != nil {
+			return fmt.Errorf("failed to update the DBVersion in the AppData table: %v", err)
+		}
+		return nil
+	})
+}
+
+// addColumn runs the ALTER TABLE statement adding the column to the table
+// unless the table already has it, which is the case for tables that didn't
+// exist before CreateTables made them with the current columns.
+func addColumn(tx *sql.Tx, table string, column string, alter string) error {
+	rows, err := tx.Query(fmt.Sprintf("PRAGMA table_info(%s);", table))
+	if err != nil {
+		return fmt.Errorf("failed to get the columns of the %s table: %v", strings.ToUpper(table), err)
+	}
+	found := false
+	for rows.Next() {
+		var cid, notNull, pk int
+		var name, colType string
+		var defaultValue sql.NullString
+		err = rows.Scan(&cid, &name, &colType, &notNull, &defaultValue, &pk)
+		if err != nil {
+			rows.Close()
+			return fmt.Errorf("failed to get the columns of the %s table: %v", strings.ToUpper(table), err)
+		}
+		if strings.EqualFold(name, column) {
+			found = true
+		}
+	}
+	rows.Close()
+	if found {
+		return nil
 	}
 
+	_, err = tx.Exec(alter)
+	if err != nil {
+		return fmt.Errorf("failed to add the %s column to the %s table: %v", column, strings.ToUpper(table), err)
+	}
 	return nil
 }
 
@@ -357,6 +977,31 @@ func (s *Storage) GetUser(username string) (*User, error) {
 	return user, nil
 }
 
+// GetAllUsers returns a slice of all of the users registered in the Users table.
+// If the query fails an error will be returned.
+func (s *Storage) GetAllUsers() ([]User, error) {
+	rows, err := s.db.Query(getAllUsers)
+	if err != nil {
+		return nil, fmt.Errorf("failed to get all of the users from the database: %v", err)
+	}
+	defer rows.Close()
+
+	result := []User{}
+	for rows.Next() {
+		var user User
+		err := rows.Scan(&user.ID, &user.Name, &user.Salt, &user.SaltedHash, &user.CryptoHash)
+		if err != nil {
+			return nil, fmt.Errorf("failed to scan the next row while processing all users: %v", err)
+		}
+		result = append(result, user)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("failed to scan all of the search results for all users: %v", err)
+	}
+
+	return result, nil
+}
+
 // RemoveUser removes user and all files and file chunks associated with the user.
 func (s *Storage) RemoveUser(username string) error {
 	// make sure we have a user to begin with
@@ -365,11 +1010,18 @@ func (s *Storage) RemoveUser(username string) error {
 		return fmt.Errorf("Failed to find the user in the database: %v", err)
 	}
 
-	_, err = s.db.Exec(removeUser, user.ID, user.ID, user.ID, user.ID, user.ID)
+	blobKeys, err := s.chunkBlobKeys(s.db, getAllUserChunkKeys, user.ID)
+	if err != nil {
+		return err
+	}
+
+	_, err = s.db.Exec(removeUser, user.ID, user.ID, user.ID, user.ID, user.ID, user.ID, user.ID, user.ID, user.ID, user.ID,
+		user.ID, user.ID, user.ID, user.ID, user.ID, user.ID, user.ID)
 	if err != nil {
 		return fmt.Errorf("failed to remove the user %s (id: %d): %v", user.Name, user.ID, err)
 	}
 
+	s.removeChunkBlobs(blobKeys)
 	return nil
 }
 
@@ -389,6 +1041,11 @@ func (s *Storage) UpdateUserCryptoHash(userID int, cryptoHash []byte) error {
 		return fmt.Errorf("failed to update user's cryptohash in the database: %v", err)
 	}
 
+	_, err = s.db.Exec(bumpUserRevision, userID)
+	if err != nil {
+		return fmt.Errorf("failed to update the user's revision in the database: %v", err)
+	}
+
 	return nil
 }
 
@@ -436,6 +1093,44 @@ func (s *Storage) SetUserQuota(userID int, quota int) error {
 	return nil
 }
 
+// SetUserMaxVersions sets the number of versions of each file kept for a user
+// by user id; zero uses the server's setting.
+func (s *Storage) SetUserMaxVersions(userID int, maxVersions int) error {
+	res, err := s.db.Exec(setUserMaxVersions, maxVersions, userID)
+	if err != nil {
+		return fmt.Errorf("failed to set the user's maximum versions in the database: %v", err)
+	}
+
+	// make sure one row was affected
+	affected, err := res.RowsAffected()
+	if affected != 1 {
+		return fmt.Errorf("failed to set the user stats in the database; no rows were affected")
+	} else if err != nil {
+		return fmt.Errorf("failed to set the user stats in the database: %v", err)
+	}
+
+	return nil
+}
+
+// SetUserMaxEgress sets the number of bytes a user can download each month by
+// user id; zero uses the server's setting.
+func (s *Storage) SetUserMaxEgress(userID int, maxEgress int64) error {
+	res, err := s.db.Exec(setUserMaxEgress, maxEgress, userID)
+	if err != nil {
+		return fmt.Errorf("failed to set the user's maximum egress in the database: %v", err)
+	}
+
+	// make sure one row was affected
+	affected, err := res.RowsAffected()
+	if affected != 1 {
+		return fmt.Errorf("failed to set the user stats in the database; no rows were affected")
+	} else if err != nil {
+		return fmt.Errorf("failed to set the user stats in the database: %v", err)
+	}
+
+	return nil
+}
+
 // SetUserStats sets the user information for a user by user id and is used to
 // do the first insertion of the user into the stats table.
 func (s *Storage) SetUserStats(userID int, quota int, allocated int, revision int) error {
@@ -477,7 +1172,7 @@ func (s *Storage) UpdateUserStats(userID int, allocDelta int) error {
 // GetUserStats returns the user information for a user by user id.
 func (s *Storage) GetUserStats(userID int) (*UserStats, error) {
 	stats := new(UserStats)
-	err := s.db.QueryRow(getUserStats, userID).Scan(&stats.Quota, &stats.Allocated, &stats.Revision)
+	err := s.db.QueryRow(getUserStats, userID).Scan(&stats.Quota, &stats.Allocated, &stats.Revision, &stats.MaxVersions, &stats.MaxEgress)
 	if err != nil {
 		return nil, fmt.Errorf("failed to get the user stats from the database: %v", err)
 	}
@@ -485,6 +1180,42 @@ func (s *Storage) GetUserStats(userID int) (*UserStats, error) {
 	return stats, nil
 }
 
+// FreezeUserPruning marks the user's account so that file and file version
+// removal should be refused until the freeze is lifted. The reason string
+// is stored to explain why the freeze happened.
+func (s *Storage) FreezeUserPruning(userID int, reason string) error {
+	_, err := s.db.Exec(setAccountFreeze, userID, time.Now().UTC().Unix(), reason)
+	if err != nil {
+		return fmt.Errorf("failed to freeze pruning for the user (%d): %v", userID, err)
+	}
+
+	return nil
+}
+
+// UnfreezeUserPruning lifts a freeze previously set with FreezeUserPruning.
+// Unfreezing an account that is not frozen is not an error.
+func (s *Storage) UnfreezeUserPruning(userID int) error {
+	_, err := s.db.Exec(removeAccountFreeze, userID)
+	if err != nil {
+		return fmt.Errorf("failed to unfreeze pruning for the user (%d): %v", userID, err)
+	}
+
+	return nil
+}
+
+// GetUserPruningFreeze returns true if the user's account has pruning frozen along with
+// the time (in seconds since 1/1/1970) the freeze happened and the reason for it.
+func (s *Storage) GetUserPruningFreeze(userID int) (frozen bool, frozenAt int64, reason string, e error) {
+	err := s.db.QueryRow(getAccountFreeze, userID).Scan(&frozenAt, &reason)
+	if err == sql.ErrNoRows {
+		return false, 0, "", nil
+	} else if err != nil {
+		return false, 0, "", fmt.Errorf("failed to get the pruning freeze for the user (%d): %v", userID, err)
+	}
+
+	return true, frozenAt, reason, nil
+}
+
 // RemoveFileVersions will remove any file versions of the file specified by fileID
 // that are between the minVersion and maxVersion (inclusive). A non-nil error
 // value is returned on failure.
@@ -492,6 +1223,7 @@ func (s *Storage) GetUserStats(userID int) (*UserStats, error) {
 // NOTE: supplying a minVersion and maxVersion that does not include any valid
 // file versions will end up returning an error.
 func (s *Storage) RemoveFileVersions(userID, fileID, minVersion, maxVersion int) error {
+	var blobKeys []string
 	err := s.transact(func(tx *sql.Tx) error {
 		// check to make sure the user owns the file id
 		var owningUserID int
@@ -523,6 +1255,10 @@ func (s *Storage) RemoveFileVersions(userID, fileID, minVersion, maxVersion int)
 		}
 
 		// remove all of the file chunks used by the file versions
+		blobKeys, err = s.chunkBlobKeys(tx, getFileVersionsChunkKeys, fileID, minVersion, maxVersion)
+		if err != nil {
+			return err
+		}
 		_, err = tx.Exec(removeAllFileVersionChunks, fileID, minVersion, maxVersion)
 		if err != nil {
 			return fmt.Errorf("failed to delete the file chunks associated with the file: %v", err)
@@ -556,12 +1292,16 @@ func (s *Storage) RemoveFileVersions(userID, fileID, minVersion, maxVersion int)
 		return nil
 	})
 
+	if err == nil {
+		s.removeChunkBlobs(blobKeys)
+	}
 	return err
 }
 
 // RemoveFile removes a file listing and all of the associated chunks in storage.
 // Returns an error on failure
 func (s *Storage) RemoveFile(userID, fileID int) error {
+	var blobKeys []string
 	err := s.transact(func(tx *sql.Tx) error {
 		// check to make sure the user owns the file id
 		var owningUserID int
@@ -585,6 +1325,12 @@ func (s *Storage) RemoveFile(userID, fileID int) error {
 			return fmt.Errorf("failed to remove the file versions in the database: %v", err)
 		}
 
+		// a lock on a file that's gone can't be released by its holder
+		_, err = tx.Exec(removeAllFileLocks, fileID)
+		if err != nil {
+			return fmt.Errorf("failed to remove the lock on the file in the database: %v", err)
+		}
+
 		// check to see if we have file chunks associated with this file -- which
 		// you will not have if the file is empty or the chunks have not been uploaded yet.
 		var totalChunkCount int
@@ -602,6 +1348,10 @@ func (s *Storage) RemoveFile(userID, fileID int) error {
 			}
 
 			// remove all of the file chunks
+			blobKeys, err = s.chunkBlobKeys(tx, getFileChunkKeys, fileID)
+			if err != nil {
+				return err
+			}
 			_, err = tx.Exec(removeAllFileChunks, fileID)
 			if err != nil {
 				return fmt.Errorf("failed to delete the file chunks associated with the file: %v", err)
@@ -630,6 +1380,9 @@ func (s *Storage) RemoveFile(userID, fileID int) error {
 		return nil
 	})
 
+	if err == nil {
+		s.removeChunkBlobs(blobKeys)
+	}
 	return err
 }
 
@@ -650,14 +1403,39 @@ func (s *Storage) RemoveFileInfo(fileID int) error {
 	return nil
 }
 
-// AddFileInfo registers a new file for a given user which is identified by the filename string.
-// lastmod (time in seconds since 1/1/1970) and the filehash string are provided as well. The
-// chunkCount parameter should be the number of chunks required for the size of the file. If the
-// file could not be added an error is returned, otherwise nil on success.
-func (s *Storage) AddFileInfo(userID int, filename string, isDir bool, permissions uint32, lastMod int64, chunkCount int, fileHash string) (*FileInfo, error) {
-	fi := new(FileInfo)
+// RenameFile changes the name of a file owned by the user. The versions and
+// chunks of the file are kept. Returns an error on failure.
+func (s *Storage) RenameFile(userID int, fileID int, filename string) error {
+	res, err := s.db.Exec(setFileName, filename, fileID, userID)
+	if err != nil {
+		return fmt.Errorf("failed to rename a file info in the database: %v", err)
+	}
 
-	const newVersionNumber = 1
+	affected, err := res.RowsAffected()
+	if err != nil {
+		return fmt.Errorf("failed to rename a file info in the database: %v", err)
+	} else if affected != 1 {
+		return fmt.Errorf("user does not own the file id supplied")
+	}
+
+	_, err = s.db.Exec(bumpUserRevision, userID)
+	if err != nil {
+		return fmt.Errorf("failed to update the user's revision in the database: %v", err)
+	}
+
+	return nil
+}
+
+// AddFileInfo registers a new file for a given user which is identified by the filename string.
+// lastmod (time in seconds since 1/1/1970) and the filehash string are provided as well. The
+// chunkCount parameter should be the number of chunks required for the size of the file and
+// device identifies the client adding the file. If the file could not be added an error is
+// returned, otherwise nil on success.
+func (s *Storage) AddFileInfo(userID int, filename string, isDir bool, permissions uint32, lastMod int64, chunkCount int, fileHash string, device string) (*FileInfo, error) {
+	fi := new(FileInfo)
+	created := time.Now().Unix()
+
+	const newVersionNumber = 1
 
 	err := s.transact(func(tx *sql.Tx) error {
 		// attempt to first add to the FileInfo table
@@ -681,7 +1459,7 @@ func (s *Storage) AddFileInfo(userID int, filename string, isDir bool, permissio
 		}
 
 		// now create a new FileVersion entry
-		res, err = tx.Exec(addFileVersion, newFileID, newVersionNumber, permissions, lastMod, chunkCount, fileHash)
+		res, err = tx.Exec(addFileVersion, newFileID, newVersionNumber, permissions, lastMod, chunkCount, fileHash, created, device)
 		if err != nil {
 			return fmt.Errorf("failed to add a new file version in the database: %v", err)
 		}
@@ -712,6 +1490,11 @@ func (s *Storage) AddFileInfo(userID int, filename string, isDir bool, permissio
 			return fmt.Errorf("failed to update the new file version in the database: %v", err)
 		}
 
+		_, err = tx.Exec(bumpUserRevision, userID)
+		if err != nil {
+			return fmt.Errorf("failed to update the user's revision in the database: %v", err)
+		}
+
 		// generate a new UserFileInfo that contains the ID for the file just added to the database
 		fi.FileID = int(newFileID)
 		fi.UserID = userID
@@ -724,6 +1507,8 @@ func (s *Storage) AddFileInfo(userID int, filename string, isDir bool, permissio
 		fi.CurrentVersion.LastMod = lastMod
 		fi.CurrentVersion.ChunkCount = chunkCount
 		fi.CurrentVersion.FileHash = fileHash
+		fi.CurrentVersion.Created = created
+		fi.CurrentVersion.Device = device
 
 		return nil
 	})
@@ -741,7 +1526,8 @@ func (s *Storage) AddFileInfo(userID int, filename string, isDir bool, permissio
 func (s *Storage) GetAllUserFileInfos(userID int) ([]FileInfo, error) {
 	var result []FileInfo
 	err := s.transact(func(tx *sql.Tx) error {
-		rows, err := tx.Query(getAllUserFiles, userID)
+		// the current versions are joined in so that large accounts don't need a query per file
+		rows, err := tx.Query(getAllUserFileVersions, userID)
 		if err != nil {
 			return fmt.Errorf("failed to get all of the file infos from the database: %v", err)
 		}
@@ -751,7 +1537,8 @@ func (s *Storage) GetAllUserFileInfos(userID int) ([]FileInfo, error) {
 		allFileInfos := []FileInfo{}
 		for rows.Next() {
 			var fi FileInfo
-			err := rows.Scan(&fi.FileID, &fi.FileName, &fi.IsDir, &fi.CurrentVersion.VersionID)
+			err := rows.Scan(&fi.FileID, &fi.FileName, &fi.IsDir, &fi.CurrentVersion.VersionID, &fi.CurrentVersion.VersionNumber,
+				&fi.CurrentVersion.Permissions, &fi.CurrentVersion.LastMod, &fi.CurrentVersion.ChunkCount, &fi.CurrentVersion.FileHash, &fi.CurrentVersion.Created)
 			if err != nil {
 				return fmt.Errorf("failed to scan the next row while processing user file infos: %v", err)
 			}
@@ -765,15 +1552,34 @@ func (s *Storage) GetAllUserFileInfos(userID int) ([]FileInfo, error) {
 		// an early Close() call on the result which should be harmless
 		rows.Close()
 
-		// now that the base of the FileInfo slice is built, iterate over it and pull the current version data
-		result = make([]FileInfo, 0, len(allFileInfos))
-		for _, fi := range allFileInfos {
-			err = tx.QueryRow(getFileVersionByID, fi.CurrentVersion.VersionID).Scan(&fi.CurrentVersion.VersionNumber,
-				&fi.CurrentVersion.Permissions, &fi.CurrentVersion.LastMod, &fi.CurrentVersion.ChunkCount, &fi.CurrentVersion.FileHash)
+		// total up the stored bytes for every version of the user's files in one pass
+		fileSizes := make(map[int]int64)
+		versionSizes := make(map[int]int64)
+		rows, err = tx.Query(getAllUserChunkSizes, userID)
+		if err != nil {
+			return fmt.Errorf("failed to get the chunk sizes for the user's files from the database: %v", err)
+		}
+		defer rows.Close()
+		for rows.Next() {
+			var fileID, versionID int
+			var size int64
+			err := rows.Scan(&fileID, &versionID, &size)
 			if err != nil {
-				return fmt.Errorf("failed to get the current file version the database: %v", err)
+				return fmt.Errorf("failed to scan the next row while processing user file sizes: %v", err)
 			}
+			fileSizes[fileID] += size
+			versionSizes[versionID] = size
+		}
+		if err := rows.Err(); err != nil {
+			return fmt.Errorf("failed to scan all of the search results for a user's file sizes: %v", err)
+		}
+		rows.Close()
 
+		// now that the base of the FileInfo slice is built, fill in the sizes
+		result = make([]FileInfo, 0, len(allFileInfos))
+		for _, fi := range allFileInfos {
+			fi.Size = fileSizes[fi.FileID]
+			fi.CurrentVersion.Size = versionSizes[fi.CurrentVersion.VersionID]
 			result = append(result, fi)
 		}
 
@@ -788,6 +1594,37 @@ func (s *Storage) GetAllUserFileInfos(userID int) ([]FileInfo, error) {
 	return result, nil
 }
 
+// GetDuplicateFileInfos returns the user's files grouped by the content hash of
+// their current versions, only including the groups with more than one file.
+// Directories are skipped. The files in each group are ordered by file id and the
+// groups are ordered by the id of their first file.
+func (s *Storage) GetDuplicateFileInfos(userID int) ([][]FileInfo, error) {
+	allFileInfos, err := s.GetAllUserFileInfos(userID)
+	if err != nil {
+		return nil, err
+	}
+
+	byHash := make(map[string][]FileInfo)
+	for _, fi := range allFileInfos {
+		if fi.IsDir || fi.CurrentVersion.FileHash == "" {
+			continue
+		}
+		byHash[fi.CurrentVersion.FileHash] = append(byHash[fi.CurrentVersion.FileHash], fi)
+	}
+
+	groups := [][]FileInfo{}
+	for _, group := range byHash {
+		if len(group) < 2 {
+			continue
+		}
+		sort.Slice(group, func(i, j int) bool { return group[i].FileID < group[j].FileID })
+		groups = append(groups, group)
+	}
+	sort.Slice(groups, func(i, j int) bool { return groups[i][0].FileID < groups[j][0].FileID })
+
+	return groups, nil
+}
+
 // GetFileInfo returns a UserFileInfo object that describes the file identified
 // by the fileID parameter. If this query was unsuccessful an error is returned.
 func (s *Storage) GetFileInfo(userID int, fileID int) (*FileInfo, error) {
@@ -812,7 +1649,7 @@ func (s *Storage) GetFileInfo(userID int, fileID int) (*FileInfo, error) {
 
 		// pull the current version data
 		err = tx.QueryRow(getFileVersionByID, fi.CurrentVersion.VersionID).Scan(&fi.CurrentVersion.VersionNumber,
-			&fi.CurrentVersion.Permissions, &fi.CurrentVersion.LastMod, &fi.CurrentVersion.ChunkCount, &fi.CurrentVersion.FileHash)
+			&fi.CurrentVersion.Permissions, &fi.CurrentVersion.LastMod, &fi.CurrentVersion.ChunkCount, &fi.CurrentVersion.FileHash, &fi.CurrentVersion.Created)
 		if err != nil {
 			return fmt.Errorf("failed to get the current file version the database: %v", err)
 		}
@@ -842,7 +1679,7 @@ func (s *Storage) GetFileInfoByName(userID int, filename string) (*FileInfo, err
 
 		// pull the current version data
 		err = tx.QueryRow(getFileVersionByID, fi.CurrentVersion.VersionID).Scan(&fi.CurrentVersion.VersionNumber,
-			&fi.CurrentVersion.Permissions, &fi.CurrentVersion.LastMod, &fi.CurrentVersion.ChunkCount, &fi.CurrentVersion.FileHash)
+			&fi.CurrentVersion.Permissions, &fi.CurrentVersion.LastMod, &fi.CurrentVersion.ChunkCount, &fi.CurrentVersion.FileHash, &fi.CurrentVersion.Created)
 		if err != nil {
 			return fmt.Errorf("failed to get the current file version the database: %v", err)
 		}
@@ -869,7 +1706,8 @@ func (s *Storage) GetFileVersions(fileID int) ([]FileVersionInfo, error) {
 	result := make([]FileVersionInfo, 0)
 	var vi FileVersionInfo
 	for rows.Next() {
-		err := rows.Scan(&vi.VersionID, &vi.VersionNumber, &vi.Permissions, &vi.LastMod, &vi.ChunkCount, &vi.FileHash)
+		err := rows.Scan(&vi.VersionID, &vi.VersionNumber, &vi.Permissions, &vi.LastMod, &vi.ChunkCount, &vi.FileHash,
+			&vi.Created, &vi.Device, &vi.Size)
 		if err != nil {
 			return nil, fmt.Errorf("failed to scan the next row while processing files versions for fileID %d: %v", fileID, err)
 		}
@@ -879,89 +1717,285 @@ func (s *Storage) GetFileVersions(fileID int) ([]FileVersionInfo, error) {
 	return result, nil
 }
 
-// TagNewFileVersion creates a new version of a given file and returns the new version ID
-// as well as the incremented file-local version number.
-func (s *Storage) TagNewFileVersion(userID int, fileID int, permissions uint32, lastMod int64, chunkCount int, fileHash string) (*FileInfo, error) {
+// TagNewFileVersion creates a new version of a given file, uploaded by the device supplied,
+// and returns the new version ID as well as the incremented file-local version number.
+func (s *Storage) TagNewFileVersion(userID int, fileID int, permissions uint32, lastMod int64, chunkCount int, fileHash string, device string) (*FileInfo, error) {
 	fi := new(FileInfo)
 	err := s.transact(func(tx *sql.Tx) error {
-		// check to make sure the user owns the file id
-		var owningUserID int
-		err := tx.QueryRow(getFileInfoOwner, fileID).Scan(&owningUserID)
+		return tagNewFileVersion(tx, fi, userID, fileID, permissions, lastMod, chunkCount, fileHash, device)
+	})
+
+	if err != nil {
+		return nil, err
+	}
+
+	return fi, nil
+}
+
+// tagNewFileVersion does the work of TagNewFileVersion in the transaction,
+// filling in fi with the file and its new current version.
+func tagNewFileVersion(tx *sql.Tx, fi *FileInfo, userID int, fileID int, permissions uint32, lastMod int64, chunkCount int, fileHash string, device string) error {
+	// check to make sure the user owns the file id
+	var owningUserID int
+	err := tx.QueryRow(getFileInfoOwner, fileID).Scan(&owningUserID)
+	if err != nil {
+		return fmt.Errorf("failed to get the owning user id for a given file: %v", err)
+	}
+	if owningUserID != userID {
+		return fmt.Errorf("user does not own the file id supplied")
+	}
+
+	// get the file information
+	fi.FileID = fileID
+	err = tx.QueryRow(getFileInfo, fi.FileID).Scan(&fi.UserID, &fi.FileName, &fi.IsDir, &fi.CurrentVersion.VersionID)
+	if err != nil {
+		return err
+	}
+
+	// pull the current version data to get the correct chunk count for the current version
+	err = tx.QueryRow(getFileVersionByID, fi.CurrentVersion.VersionID).Scan(&fi.CurrentVersion.VersionNumber,
+		&fi.CurrentVersion.Permissions, &fi.CurrentVersion.LastMod, &fi.CurrentVersion.ChunkCount, &fi.CurrentVersion.FileHash, &fi.CurrentVersion.Created)
+	if err != nil {
+		return fmt.Errorf("failed to get the current file version the database: %v", err)
+	}
+
+	// increment the file-local version number
+	fi.CurrentVersion.VersionNumber++
+
+	// force-update the current version object to match the parameters
+	fi.CurrentVersion.Permissions = permissions
+	fi.CurrentVersion.LastMod = lastMod
+	fi.CurrentVersion.ChunkCount = chunkCount
+	fi.CurrentVersion.FileHash = fileHash
+	fi.CurrentVersion.Created = time.Now().Unix()
+	fi.CurrentVersion.Device = device
+
+	// now create a new FileVersion entry
+	res, err := tx.Exec(addFileVersion, fi.FileID, fi.CurrentVersion.VersionNumber, fi.CurrentVersion.Permissions,
+		fi.CurrentVersion.LastMod, fi.CurrentVersion.ChunkCount, fi.CurrentVersion.FileHash,
+		fi.CurrentVersion.Created, fi.CurrentVersion.Device)
+	if err != nil {
+		return fmt.Errorf("failed to add a new file version in the database: %v", err)
+	}
+
+	// make sure only one row was affected
+	affected, err := res.RowsAffected()
+	if affected != 1 {
+		return fmt.Errorf("failed to add a new file version in the database; no rows were affected (possible duplicate file)")
+	} else if err != nil {
+		return fmt.Errorf("failed to add a new file version in the database: %v", err)
+	}
+
+	newVersionID64, err := res.LastInsertId()
+	if err != nil {
+		return fmt.Errorf("failed to get the id for the last row inserted while adding a new file version into the database: %v", err)
+	}
+	fi.CurrentVersion.VersionID = int(newVersionID64)
+
+	// update the original file info object with the versionID just created
+	res, err = tx.Exec(setFileCurrentVersion, fi.CurrentVersion.VersionID, fi.FileID)
+	if err != nil {
+		return fmt.Errorf("failed to update the file version (%d) for the file id (%d) in the database: %v",
+			fi.CurrentVersion.VersionID, fi.FileID, err)
+	}
+
+	affected, err = res.RowsAffected()
+	if affected != 1 {
+		return fmt.Errorf("failed to update the new file version in the database; no rows were affected (possible duplicate file)")
+	} else if err != nil {
+		return fmt.Errorf("failed to update the new file version in the database: %v", err)
+	}
+
+	_, err = tx.Exec(bumpUserRevision, userID)
+	if err != nil {
+		return fmt.Errorf("failed to update the user's revision in the database: %v", err)
+	}
+
+	return nil
+}
+
+// PatchFileVersion tags a new version of a file like TagNewFileVersion does,
+// but the new version starts out with copies of chunks of the base version:
+// each chunk number of the new version gets the base chunk number at that
+// index of sources, unless it's -1 or the base version doesn't have it. Only
+// the chunks left out then need to be added, which lets clients that know
+// which parts of a large file changed commit them without uploading the rest,
+// even if the unchanged chunks moved. The copied chunks count against the
+// user's quota like uploaded ones. A non-nil error is returned on failure.
+func (s *Storage) PatchFileVersion(userID int, fileID int, baseVersionID int, permissions uint32, lastMod int64, chunkCount int, fileHash string, device string, sources []int) (*FileInfo, error) {
+	if len(sources) > chunkCount {
+		return nil, fmt.Errorf("there are more chunk sources (%d) than chunks (%d)", len(sources), chunkCount)
+	}
+	fi := new(FileInfo)
+	var blobCopies [][2]string
+	err := s.transact(func(tx *sql.Tx) error {
+		// make sure the base version belongs to the file; tagging the new
+		// version checks that the user owns it
+		var baseChunkCount int
+		err := tx.QueryRow(getFileVersionChunkCount, baseVersionID, fileID).Scan(&baseChunkCount)
 		if err != nil {
-			return fmt.Errorf("failed to get the owning user id for a given file: %v", err)
-		}
-		if owningUserID != userID {
-			return fmt.Errorf("user does not own the file id supplied")
+			return fmt.Errorf("failed to get the base version %d for the file: %v", baseVersionID, err)
 		}
 
-		// get the file information
-		fi.FileID = fileID
-		err = tx.QueryRow(getFileInfo, fi.FileID).Scan(&fi.UserID, &fi.FileName, &fi.IsDir, &fi.CurrentVersion.VersionID)
+		err = tagNewFileVersion(tx, fi, userID, fileID, permissions, lastMod, chunkCount, fileHash, device)
 		if err != nil {
 			return err
 		}
 
-		// pull the current version data to get the correct chunk count for the current version
-		err = tx.QueryRow(getFileVersionByID, fi.CurrentVersion.VersionID).Scan(&fi.CurrentVersion.VersionNumber,
-			&fi.CurrentVersion.Permissions, &fi.CurrentVersion.LastMod, &fi.CurrentVersion.ChunkCount, &fi.CurrentVersion.FileHash)
+		// find the base chunks before copying them since sqlite can't write
+		// while the rows are being read
+		rows, err := tx.Query(getFileChunkCopyInfo, fileID, baseVersionID)
 		if err != nil {
-			return fmt.Errorf("failed to get the current file version the database: %v", err)
+			return fmt.Errorf("failed to get the chunks of the base version: %v", err)
+		}
+		type baseChunk struct {
+			length int64
+			blob   bool
+		}
+		base := make(map[int]baseChunk)
+		for rows.Next() {
+			var chunkNumber int
+			var chunkLength, storedLength int64
+			err = rows.Scan(&chunkNumber, &chunkLength, &storedLength)
+			if err != nil {
+				rows.Close()
+				return fmt.Errorf("failed to scan the next row while processing the chunks of the base version: %v", err)
+			}
+			base[chunkNumber] = baseChunk{chunkLength, s.Blobs != nil && storedLength == 0}
+		}
+		rows.Close()
+		if err = rows.Err(); err != nil {
+			return fmt.Errorf("failed to scan all of the chunks of the base version: %v", err)
 		}
 
-		// increment the file-local version number
-		fi.CurrentVersion.VersionNumber++
-
-		// force-update the current version object to match the parameters
-		fi.CurrentVersion.Permissions = permissions
-		fi.CurrentVersion.LastMod = lastMod
-		fi.CurrentVersion.ChunkCount = chunkCount
-		fi.CurrentVersion.FileHash = fileHash
+		var total int64
+		for _, src := range sources {
+			total += base[src].length
+		}
 
-		// now create a new FileVersion entry
-		res, err := tx.Exec(addFileVersion, fi.FileID, fi.CurrentVersion.VersionNumber, fi.CurrentVersion.Permissions,
-			fi.CurrentVersion.LastMod, fi.CurrentVersion.ChunkCount, fi.CurrentVersion.FileHash)
+		// fail the transaction if there's not enough allocation space
+		var quota, allocated, revision, maxVersions, maxEgress int64
+		err = tx.QueryRow(getUserStats, userID).Scan(&quota, &allocated, &revision, &maxVersions, &maxEgress)
 		if err != nil {
-			return fmt.Errorf("failed to add a new file version in the database: %v", err)
+			return fmt.Errorf("failed to get the user quota from the database before copying file chunks: %v", err)
 		}
-
-		// make sure only one row was affected
-		affected, err := res.RowsAffected()
-		if affected != 1 {
-			return fmt.Errorf("failed to add a new file version in the database; no rows were affected (possible duplicate file)")
-		} else if err != nil {
-			return fmt.Errorf("failed to add a new file version in the database: %v", err)
+		if (quota - allocated) < total {
+			return fmt.Errorf("not enough free allocation space (quota: %d ; current allocation %d ; chunks size %d)", quota, allocated, total)
 		}
 
-		newVersionID64, err := res.LastInsertId()
-		if err != nil {
-			return fmt.Errorf("failed to get the id for the last row inserted while adding a new file version into the database: %v", err)
+		for chunkNumber, src := range sources {
+			b, found := base[src]
+			if !found {
+				continue
+			}
+			_, err = tx.Exec(copyFileChunk, fi.CurrentVersion.VersionID, chunkNumber, fileID, baseVersionID, src)
+			if err != nil {
+				return fmt.Errorf("failed to copy chunk %d of the base version: %v", src, err)
+			}
+			if b.blob {
+				blobCopies = append(blobCopies, [2]string{
+					chunkBlobKey(fileID, baseVersionID, src),
+					chunkBlobKey(fileID, fi.CurrentVersion.VersionID, chunkNumber),
+				})
+			}
 		}
-		fi.CurrentVersion.VersionID = int(newVersionID64)
 
-		// update the original file info object with the versionID just created
-		res, err = tx.Exec(setFileCurrentVersion, fi.CurrentVersion.VersionID, fi.FileID)
+		_, err = tx.Exec(updateUserStats, total, userID)
 		if err != nil {
-			return fmt.Errorf("failed to update the file version (%d) for the file id (%d) in the database: %v",
-				fi.CurrentVersion.VersionID, fi.FileID, err)
+			return fmt.Errorf("failed to update the allocated bytes in the database after copying chunks: %v", err)
 		}
 
-		affected, err = res.RowsAffected()
-		if affected != 1 {
-			return fmt.Errorf("failed to update the new file version in the database; no rows were affected (possible duplicate file)")
-		} else if err != nil {
-			return fmt.Errorf("failed to update the new file version in the database: %v", err)
+		// the data goes to the BlobStore last so that a failure rolls back the rows
+		for _, keys := range blobCopies {
+			data, err := s.Blobs.Get(keys[0])
+			if err != nil {
+				return fmt.Errorf("failed to read the chunk data to copy: %v", err)
+			}
+			err = s.Blobs.Put(keys[1], data)
+			if err != nil {
+				return fmt.Errorf("failed to store the copied chunk data: %v", err)
+			}
 		}
 
 		return nil
 	})
 
 	if err != nil {
+		var copied []string
+		for _, keys := range blobCopies {
+			copied = append(copied, keys[1])
+		}
+		s.removeChunkBlobs(copied)
 		return nil, err
 	}
 
 	return fi, nil
 }
 
+// UpdateFileVersionChunks sets the chunk count and file hash for the current version
+// of a file while it's unfinished, having been tagged with no chunks and no hash.
+// This allows clients to stream data of an unknown length by tagging a version,
+// uploading the chunks and then finalizing the version once the whole stream has
+// been read. ErrVersionFinalized is returned if the version isn't the current one
+// or was already finalized, and a non-nil error is returned on other failures.
+func (s *Storage) UpdateFileVersionChunks(userID int, fileID int, versionID int, chunkCount int, fileHash string) error {
+	return s.transact(func(tx *sql.Tx) error {
+		// check to make sure the user owns the file id
+		var owningUserID, currentVersionID int
+		var fileName string
+		var isDir bool
+		err := tx.QueryRow(getFileInfo, fileID).Scan(&owningUserID, &fileName, &isDir, &currentVersionID)
+		if err != nil {
+			return fmt.Errorf("failed to get the owning user id for a given file: %v", err)
+		}
+		if owningUserID != userID {
+			return fmt.Errorf("user does not own the file id supplied")
+		}
+
+		// only the unfinished current version can be changed so that the
+		// versions that are done can't lose their chunks
+		var oldChunkCount int
+		var oldFileHash string
+		err = tx.QueryRow(getFileVersionChunksAndHash, versionID, fileID).Scan(&oldChunkCount, &oldFileHash)
+		if err != nil {
+			return fmt.Errorf("failed to get the version %d for the file: %v", versionID, err)
+		}
+		if versionID != currentVersionID || oldChunkCount != 0 || oldFileHash != "" {
+			return ErrVersionFinalized
+		}
+
+		// chunks uploaded past the final count would never be read back
+		var extraChunks int
+		err = tx.QueryRow(countFileChunksFrom, fileID, versionID, chunkCount).Scan(&extraChunks)
+		if err != nil {
+			return fmt.Errorf("failed to count the chunks of the file version: %v", err)
+		}
+		if extraChunks > 0 {
+			return fmt.Errorf("the file version has %d chunks numbered past the chunk count of %d", extraChunks, chunkCount)
+		}
+
+		res, err := tx.Exec(updateFileVersionChunks, chunkCount, fileHash, versionID, fileID)
+		if err != nil {
+			return fmt.Errorf("failed to update the file version in the database: %v", err)
+		}
+
+		// make sure only one row was affected
+		affected, err := res.RowsAffected()
+		if affected != 1 {
+			return fmt.Errorf("failed to update the file version in the database; no rows were affected (version does not belong to the file)")
+		} else if err != nil {
+			return fmt.Errorf("failed to update the file version in the database: %v", err)
+		}
+
+		_, err = tx.Exec(bumpUserRevision, userID)
+		if err != nil {
+			return fmt.Errorf("failed to update the user's revision in the database: %v", err)
+		}
+
+		return nil
+	})
+}
+
 // GetFileChunkInfos returns a slice of FileChunks containing all of the chunk
 // information except for the chunk bytes themselves.
 func (s *Storage) GetFileChunkInfos(userID int, fileID int, versionID int) ([]FileChunk, error) {
@@ -988,7 +2022,7 @@ func (s *Storage) GetFileChunkInfos(userID int, fileID int, versionID int) ([]Fi
 		chunk.FileID = fileID
 		chunk.VersionID = versionID
 		for rows.Next() {
-			err := rows.Scan(&chunk.ChunkNumber, &chunk.ChunkHash)
+			err := rows.Scan(&chunk.ChunkNumber, &chunk.ChunkHash, &chunk.Length)
 			if err != nil {
 				return fmt.Errorf("failed to scan the next row while processing files chunks for fileID %d: %v", fileID, err)
 			}
@@ -1007,6 +2041,46 @@ func (s *Storage) GetFileChunkInfos(userID int, fileID int, versionID int) ([]Fi
 	return knownChunks, nil
 }
 
+// GetUserChunkUsage returns the bytes of chunk data stored for all versions of
+// the user's files, which is what counts against the quota, along with the
+// bytes of the unique chunks among them. Chunks are considered the same if
+// they have the same hash, so the physical size is what the user would take up
+// if identical chunks were only stored once.
+func (s *Storage) GetUserChunkUsage(userID int) (logical int, physical int, e error) {
+	e = s.db.QueryRow(getUserChunkUsage, userID).Scan(&logical, &physical)
+	if e != nil {
+		return 0, 0, fmt.Errorf("failed to get the chunk usage for the user: %v", e)
+	}
+	return logical, physical, nil
+}
+
+// GetUserUsage counts the user's files, versions and chunk bytes along with
+// the user's revision at the time, all in one transaction.
+func (s *Storage) GetUserUsage(userID int) (*UserUsage, error) {
+	usage := new(UserUsage)
+	err := s.transact(func(tx *sql.Tx) error {
+		var quota, allocated, maxVersions int
+		var maxEgress int64
+		err := tx.QueryRow(getUserStats, userID).Scan(&quota, &allocated, &usage.Revision, &maxVersions, &maxEgress)
+		if err != nil {
+			return fmt.Errorf("failed to get the user stats: %v", err)
+		}
+		err = tx.QueryRow(getUserFileCounts, userID, userID).Scan(&usage.FileCount, &usage.VersionCount)
+		if err != nil {
+			return fmt.Errorf("failed to count the files of the user: %v", err)
+		}
+		err = tx.QueryRow(getUserChunkUsage, userID).Scan(&usage.LogicalSize, &usage.PhysicalSize)
+		if err != nil {
+			return fmt.Errorf("failed to get the chunk usage for the user: %v", err)
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return usage, nil
+}
+
 // GetMissingChunkNumbersForFile will return a slice of chunk numbers that have
 // not been added for a given file.
 func (s *Storage) GetMissingChunkNumbersForFile(userID int, fileID int) ([]int, error) {
@@ -1032,7 +2106,7 @@ func (s *Storage) GetMissingChunkNumbersForFile(userID int, fileID int) ([]int,
 
 		// pull the current version data to get the correct chunk count for the current version
 		err = tx.QueryRow(getFileVersionByID, fi.CurrentVersion.VersionID).Scan(&fi.CurrentVersion.VersionNumber,
-			&fi.CurrentVersion.Permissions, &fi.CurrentVersion.LastMod, &fi.CurrentVersion.ChunkCount, &fi.CurrentVersion.FileHash)
+			&fi.CurrentVersion.Permissions, &fi.CurrentVersion.LastMod, &fi.CurrentVersion.ChunkCount, &fi.CurrentVersion.FileHash, &fi.CurrentVersion.Created)
 		if err != nil {
 			return fmt.Errorf("failed to get the current file version the database: %v", err)
 		}
@@ -1047,7 +2121,8 @@ func (s *Storage) GetMissingChunkNumbersForFile(userID int, fileID int) ([]int,
 		for rows.Next() {
 			var num int
 			var hash string
-			err := rows.Scan(&num, &hash)
+			var length int64
+			err := rows.Scan(&num, &hash, &length)
 			if err != nil {
 				return fmt.Errorf("failed to scan the next row while processing files chunks for fileID %d: %v", fileID, err)
 			}
@@ -1080,6 +2155,11 @@ func (s *Storage) GetMissingChunkNumbersForFile(userID int, fileID int) ([]int,
 	return mia, nil
 }
 
+// MaxChunkSize returns ChunkSize so that Storage satisfies the Backend interface.
+func (s *Storage) MaxChunkSize() int64 {
+	return s.ChunkSize
+}
+
 // AddFileChunk adds a binary chunk to storage for a given file at a position in the file
 // determined by the chunkNumber passed in and identified by the chunkHash. The userID is used
 // to update the allocation count in the same transaction as well as verify ownership.
@@ -1101,9 +2181,23 @@ func (s *Storage) AddFileChunk(userID int, fileID int, versionID int, chunkNumbe
 			return fmt.Errorf("user does not own the file id supplied")
 		}
 
+		// make sure the version belongs to the file and the chunk is within it;
+		// an unfinished version doesn't know its chunk count until it's
+		// finalized, which is when its chunks get checked instead
+		var chunkCount int
+		var fileHash string
+		err = tx.QueryRow(getFileVersionChunksAndHash, versionID, fileID).Scan(&chunkCount, &fileHash)
+		if err != nil {
+			return fmt.Errorf("failed to get the version %d for the file: %v", versionID, err)
+		}
+		unfinished := chunkCount == 0 && fileHash == ""
+		if chunkNumber < 0 || (chunkNumber >= chunkCount && !unfinished) {
+			return fmt.Errorf("chunk number %d is out of range for the file version", chunkNumber)
+		}
+
 		// get the user's quota fand allocation count and test for a voliation
-		var quota, allocated, revision int64
-		err = tx.QueryRow(getUserStats, userID).Scan(&quota, &allocated, &revision)
+		var quota, allocated, revision, maxVersions, maxEgress int64
+		err = tx.QueryRow(getUserStats, userID).Scan(&quota, &allocated, &revision, &maxVersions, &maxEgress)
 		if err != nil {
 			return fmt.Errorf("failed to get the user quota from the database before adding file chunk: %v", err)
 		}
@@ -1113,8 +2207,13 @@ func (s *Storage) AddFileChunk(userID int, fileID int, versionID int, chunkNumbe
 			return fmt.Errorf("not enough free allocation space (quota: %d ; current allocation %d ; chunk size %d)", quota, allocated, chunkLength)
 		}
 
-		// now the that prechecks have succeeded, add the file
-		res, err := tx.Exec(addFileChunk, fileID, versionID, chunkNumber, chunkHash, chunk)
+		// now the that prechecks have succeeded, add the file; when the data is
+		// kept in a BlobStore the row only records its length
+		stored := chunk
+		if s.Blobs != nil {
+			stored = []byte{}
+		}
+		res, err := tx.Exec(addFileChunk, fileID, versionID, chunkNumber, chunkHash, chunkLength, chunkDataHash(chunk), stored)
 		if err != nil {
 			return fmt.Errorf("failed to add a new file chunk in the database: %v", err)
 		}
@@ -1139,6 +2238,14 @@ func (s *Storage) AddFileChunk(userID int, fileID int, versionID int, chunkNumbe
 			return fmt.Errorf("failed to update the user info in the database after adding a chunk: %v", err)
 		}
 
+		// the data goes to the BlobStore last so that a failure rolls back the row
+		if s.Blobs != nil {
+			err = s.Blobs.Put(chunkBlobKey(fileID, versionID, chunkNumber), chunk)
+			if err != nil {
+				return fmt.Errorf("failed to store the chunk data: %v", err)
+			}
+		}
+
 		newChunk.FileID = fileID
 		newChunk.VersionID = versionID
 		newChunk.ChunkNumber = chunkNumber
@@ -1171,15 +2278,12 @@ func (s *Storage) RemoveFileChunk(userID int, fileID int, versionID int, chunkNu
 			return fmt.Errorf("user does not own the file id supplied")
 		}
 
-		// get the existing chunk so that we can caluclate the chunk size in bytes to
-		// remove from the user's allocation count
-		var chunkHash string
-		var chunk []byte
-		err = tx.QueryRow(getFileChunk, fileID, versionID, chunkNumber).Scan(&chunkHash, &chunk)
+		// get the existing chunk size in bytes to remove from the user's allocation count
+		var allocationCount int
+		err = tx.QueryRow(getFileChunkLength, fileID, versionID, chunkNumber).Scan(&allocationCount)
 		if err != nil {
 			return fmt.Errorf("failed to get the existing chunk before removal: %v", err)
 		}
-		allocationCount := len(chunk)
 
 		// remove the chunk from the table
 		res, err := tx.Exec(removeFileChunk, fileID, versionID, chunkNumber)
@@ -1216,6 +2320,7 @@ func (s *Storage) RemoveFileChunk(userID int, fileID int, versionID int, chunkNu
 	if err != nil {
 		return false, err
 	}
+	s.removeChunkBlobs([]string{chunkBlobKey(fileID, versionID, chunkNumber)})
 	return true, nil
 }
 
@@ -1228,53 +2333,952 @@ func (s *Storage) GetFileChunk(fileID int, chunkNumber int, versionID int) (fc *
 	fc.ChunkNumber = chunkNumber
 
 	e = s.db.QueryRow(getFileChunk, fileID, versionID, chunkNumber).Scan(&fc.ChunkHash, &fc.Chunk)
+	if e == nil && s.Blobs != nil && len(fc.Chunk) == 0 {
+		// chunks stored before the BlobStore was set up are still in the database
+		fc.Chunk, e = s.Blobs.Get(chunkBlobKey(fileID, versionID, chunkNumber))
+	}
 	return
 }
 
-// transact takes a function parameter that will get executed within the context
-// of a database/sql.DB transaction. This transaction will Comit or Rollback
-// based on whether or not an error or panic was generated from this function.
-func (s *Storage) transact(transFoo func(*sql.Tx) error) (err error) {
-	// start the transaction
-	tx, err := s.db.Begin()
+// chunkBlobKey returns the BlobStore key for the data of a file chunk.
+func chunkBlobKey(fileID int, versionID int, chunkNumber int) string {
+	return fmt.Sprintf("chunks/%d/%d/%d", fileID, versionID, chunkNumber)
+}
+
+// chunkBlobKeys returns the BlobStore keys for the chunks selected by the query,
+// which must select the FileID, VersionID and ChunkNum columns. Nothing is
+// returned when the chunk data is kept in the database.
+func (s *Storage) chunkBlobKeys(q queryer, query string, args ...interface{}) ([]string, error) {
+	if s.Blobs == nil {
+		return nil, nil
+	}
+
+	rows, err := q.Query(query, args...)
 	if err != nil {
+		return nil, fmt.Errorf("failed to get the chunks to remove from the database: %v", err)
+	}
+	defer rows.Close()
+
+	var keys []string
+	for rows.Next() {
+		var fileID, versionID, chunkNumber int
+		err = rows.Scan(&fileID, &versionID, &chunkNumber)
+		if err != nil {
+			return nil, fmt.Errorf("failed to scan the next row while processing chunks to remove: %v", err)
+		}
+		keys = append(keys, chunkBlobKey(fileID, versionID, chunkNumber))
+	}
+	return keys, rows.Err()
+}
+
+// removeChunkBlobs deletes the data of removed chunks from the BlobStore. The
+// chunks are already gone from the database, so a failure only leaves an
+// unreferenced blob behind and isn't reported.
+func (s *Storage) removeChunkBlobs(keys []string) {
+	if s.Blobs == nil {
 		return
 	}
+	for _, key := range keys {
+		s.Blobs.Delete(key)
+	}
+}
 
-	defer func() {
-		// attempt to recover from a panic and set the error accordingly
-		if p := recover(); p != nil {
-			switch p := p.(type) {
-			case error:
-				err = p
-			default:
-				err = fmt.Errorf("panic: %s", p)
+// AddShare registers a publicly shared file for the user under the name given,
+// replacing any existing share with the same name. The chunks for the share get
+// added afterwards with AddShareChunk. The contentType may be empty if it's not
+// known yet. The passwordHash, made by filefreezer.GenSharePasswordHash, and
+// maxDownloads are stored with the share so that it's never served without
+// them; pass nil and zero for no password or download limit. The new Share is
+// returned on success.
+func (s *Storage) AddShare(userID int, name string, lastMod int64, chunkCount int, fileHash string, contentType string,
+	passwordHash []byte, maxDownloads int) (*Share, error) {
+	share := new(Share)
+	err := s.transact(func(tx *sql.Tx) error {
+		// remove the existing share by the same name, if any
+		var existing Share
+		err := tx.QueryRow(getShareByName, userID, name).Scan(&existing.ShareID, &existing.LastMod, &existing.ChunkCount,
+			&existing.FileHash, &existing.ContentType, &existing.Protected, &existing.MaxDownloads, &existing.DownloadCount)
+		if err == nil {
+			err = removeShareTx(tx, userID, existing.ShareID)
+			if err != nil {
+				return err
 			}
+		} else if err != sql.ErrNoRows {
+			return fmt.Errorf("failed to check for an existing share in the database: %v", err)
 		}
 
-		// if there was an error, we rollback the transaction
+		res, err := tx.Exec(addShare, userID, name, lastMod, chunkCount, fileHash, contentType, passwordHash, maxDownloads)
 		if err != nil {
-			tx.Rollback()
-			return
+			return fmt.Errorf("failed to add a new share in the database: %v", err)
 		}
+		insertedID, err := res.LastInsertId()
+		if err != nil {
+			return fmt.Errorf("failed to get the id for the last row inserted while adding a new share: %v", err)
+		}
+
+		share.ShareID = int(insertedID)
+		share.UserID = userID
+		share.Name = name
+		share.LastMod = lastMod
+		share.ChunkCount = chunkCount
+		share.FileHash = fileHash
+		share.ContentType = contentType
+		share.Protected = len(passwordHash) > 0
+		share.MaxDownloads = maxDownloads
+		return nil
+	})
 
-		// no error, so run the commit and return the result
-		err = tx.Commit()
-	}()
-
-	// run the transaction function and do the commit/rollback in the deferred
-	// function above
-	err = transFoo(tx)
-	return err
-}
-
-// getRowCount is a method to return the number of rows for a given table.
-func (s *Storage) getRowCount(table string) (int, error) {
-	rows, err := s.db.Query("SELECT Count(*) FROM " + table)
 	if err != nil {
-		return 0, err
+		return nil, err
 	}
-	defer rows.Close()
+	return share, nil
+}
+
+// AddShareChunk adds the unencrypted chunk of data for a shared file at the
+// position given by chunkNumber, replacing any chunk already there. The size
+// of the chunk counts against the user's quota.
+func (s *Storage) AddShareChunk(userID int, shareID int, chunkNumber int, chunk []byte) error {
+	chunkLength := int64(len(chunk))
+	return s.transact(func(tx *sql.Tx) error {
+		// check to make sure the user owns the share
+		var owningUserID, chunkCount int
+		err := tx.QueryRow(getShareOwner, shareID).Scan(&owningUserID, &chunkCount)
+		if err != nil {
+			return fmt.Errorf("failed to get the owning user id for a given share: %v", err)
+		}
+		if owningUserID != userID {
+			return fmt.Errorf("user does not own the share id supplied")
+		}
+		if chunkNumber < 0 || chunkNumber >= chunkCount {
+			return fmt.Errorf("chunk number %d is out of range for the share", chunkNumber)
+		}
+
+		// account for a chunk that is being replaced
+		var existingLength int64
+		err = tx.QueryRow(getShareChunkSize, shareID, chunkNumber).Scan(&existingLength)
+		if err != nil && err != sql.ErrNoRows {
+			return fmt.Errorf("failed to get the size of the existing share chunk: %v", err)
+		}
+		allocDelta := chunkLength - existingLength
+
+		// get the user's quota and allocation count and test for a violation
+		var quota, allocated, revision, maxVersions, maxEgress int64
+		err = tx.QueryRow(getUserStats, userID).Scan(&quota, &allocated, &revision, &maxVersions, &maxEgress)
+		if err != nil {
+			return fmt.Errorf("failed to get the user quota from the database before adding a share chunk: %v", err)
+		}
+		if (quota - allocated) < allocDelta {
+			return fmt.Errorf("not enough free allocation space (quota: %d ; current allocation %d ; chunk size %d)", quota, allocated, chunkLength)
+		}
+
+		_, err = tx.Exec(addShareChunk, shareID, chunkNumber, chunk)
+		if err != nil {
+			return fmt.Errorf("failed to add a new share chunk in the database: %v", err)
+		}
+
+		// update the allocation count
+		res, err := tx.Exec(updateUserStats, allocDelta, userID)
+		if err != nil {
+			return fmt.Errorf("failed to update the allocated bytes in the database after adding a share chunk: %v", err)
+		}
+		affected, err := res.RowsAffected()
+		if affected != 1 {
+			return fmt.Errorf("failed to update the user info in the database after adding a share chunk; no rows were affected")
+		} else if err != nil {
+			return fmt.Errorf("failed to update the user info in the database after adding a share chunk: %v", err)
+		}
+
+		return nil
+	})
+}
+
+// GetShares returns all of the shares for a given user sorted by name.
+func (s *Storage) GetShares(userID int) ([]Share, error) {
+	rows, err := s.db.Query(getAllUserShares, userID)
+	if err != nil {
+		return nil, fmt.Errorf("failed to get the shares for the user: %v", err)
+	}
+	defer rows.Close()
+
+	var result []Share
+	for rows.Next() {
+		var sh Share
+		sh.UserID = userID
+		err = rows.Scan(&sh.ShareID, &sh.Name, &sh.LastMod, &sh.ChunkCount, &sh.FileHash, &sh.ContentType,
+			&sh.Protected, &sh.MaxDownloads, &sh.DownloadCount, &sh.Size)
+		if err != nil {
+			return nil, fmt.Errorf("failed to scan the next row while processing user shares: %v", err)
+		}
+		result = append(result, sh)
+	}
+
+	err = rows.Err()
+	if err != nil {
+		return nil, fmt.Errorf("failed to get all of the user shares: %v", err)
+	}
+
+	return result, nil
+}
+
+// GetShareByName returns the share for the user with the name given. If the share
+// does not exist, sql.ErrNoRows is returned as the error.
+func (s *Storage) GetShareByName(userID int, name string) (*Share, error) {
+	sh := new(Share)
+	sh.UserID = userID
+	sh.Name = name
+	err := s.db.QueryRow(getShareByName, userID, name).Scan(&sh.ShareID, &sh.LastMod, &sh.ChunkCount, &sh.FileHash,
+		&sh.ContentType, &sh.Protected, &sh.MaxDownloads, &sh.DownloadCount)
+	if err != nil {
+		return nil, err
+	}
+	return sh, nil
+}
+
+// GetShareChunk returns the data for a chunk of a shared file.
+func (s *Storage) GetShareChunk(shareID int, chunkNumber int) ([]byte, error) {
+	var chunk []byte
+	err := s.db.QueryRow(getShareChunk, shareID, chunkNumber).Scan(&chunk)
+	return chunk, err
+}
+
+// SetShareLimits sets the password hash and the maximum number of downloads for a
+// share owned by the user. An empty passwordHash removes the password requirement
+// and zero for maxDownloads removes the download limit.
+func (s *Storage) SetShareLimits(userID int, shareID int, passwordHash []byte, maxDownloads int) error {
+	res, err := s.db.Exec(setShareLimits, passwordHash, maxDownloads, shareID, userID)
+	if err != nil {
+		return fmt.Errorf("failed to set the limits for the share: %v", err)
+	}
+	affected, err := res.RowsAffected()
+	if err != nil {
+		return fmt.Errorf("failed to set the limits for the share: %v", err)
+	} else if affected != 1 {
+		return fmt.Errorf("failed to set the limits for the share; no rows were affected")
+	}
+	return nil
+}
+
+// GetSharePassword returns the hash of the password for a share made by
+// filefreezer.GenSharePasswordHash. The hash is empty if the share isn't
+// password protected.
+func (s *Storage) GetSharePassword(shareID int) (passwordHash []byte, e error) {
+	e = s.db.QueryRow(getSharePassword, shareID).Scan(&passwordHash)
+	return
+}
+
+// CountShareDownload increments the download count for a share and returns false
+// without counting the download if the share has reached its download limit.
+func (s *Storage) CountShareDownload(shareID int) (bool, error) {
+	res, err := s.db.Exec(countShareDownload, shareID)
+	if err != nil {
+		return false, fmt.Errorf("failed to count the download for the share: %v", err)
+	}
+	affected, err := res.RowsAffected()
+	if err != nil {
+		return false, fmt.Errorf("failed to count the download for the share: %v", err)
+	}
+	return affected == 1, nil
+}
+
+// SetShareContentType sets the MIME type for a share owned by the user if one
+// hasn't been set already.
+func (s *Storage) SetShareContentType(userID int, shareID int, contentType string) error {
+	_, err := s.db.Exec(setShareContentType, contentType, shareID, userID)
+	if err != nil {
+		return fmt.Errorf("failed to set the content type for the share: %v", err)
+	}
+	return nil
+}
+
+// GetShareChunkSizes returns the sizes of the chunks uploaded for a share in
+// chunk number order. Chunks that haven't been uploaded are missing from the
+// result, so callers should compare the length with the share's chunk count.
+func (s *Storage) GetShareChunkSizes(shareID int) ([]int64, error) {
+	rows, err := s.db.Query(getShareChunkSizes, shareID)
+	if err != nil {
+		return nil, fmt.Errorf("failed to get the chunk sizes for the share: %v", err)
+	}
+	defer rows.Close()
+
+	var sizes []int64
+	for rows.Next() {
+		var chunkNum int
+		var size int64
+		err = rows.Scan(&chunkNum, &size)
+		if err != nil {
+			return nil, fmt.Errorf("failed to scan the next row while processing share chunk sizes: %v", err)
+		}
+		if chunkNum != len(sizes) {
+			return nil, fmt.Errorf("the share is missing chunk #%d", len(sizes))
+		}
+		sizes = append(sizes, size)
+	}
+
+	err = rows.Err()
+	if err != nil {
+		return nil, fmt.Errorf("failed to get all of the share chunk sizes: %v", err)
+	}
+
+	return sizes, nil
+}
+
+// GetSharesToRechunk returns the fully uploaded shares that have chunks of a
+// different size than chunkSize, such as after the server's chunk size was
+// changed, sorted by ShareID. Only ShareID, UserID, Name and ChunkCount are set.
+func (s *Storage) GetSharesToRechunk(chunkSize int64) ([]Share, error) {
+	rows, err := s.db.Query(getSharesToRechunk, chunkSize, chunkSize)
+	if err != nil {
+		return nil, fmt.Errorf("failed to get the shares to rechunk: %v", err)
+	}
+	defer rows.Close()
+
+	var result []Share
+	for rows.Next() {
+		var sh Share
+		err = rows.Scan(&sh.ShareID, &sh.UserID, &sh.Name, &sh.ChunkCount)
+		if err != nil {
+			return nil, fmt.Errorf("failed to scan the next row while processing shares to rechunk: %v", err)
+		}
+		result = append(result, sh)
+	}
+
+	err = rows.Err()
+	if err != nil {
+		return nil, fmt.Errorf("failed to get all of the shares to rechunk: %v", err)
+	}
+
+	return result, nil
+}
+
+// RechunkShare splits the data of a share owned by the user into new chunks
+// of chunkSize bytes, with only the last chunk being smaller, and returns the
+// new chunk count. The share is replaced in one transaction so it's never seen
+// half rechunked, and since the data doesn't change neither does the user's
+// allocation. Shares that are still being uploaded can't be rechunked.
+func (s *Storage) RechunkShare(userID int, shareID int, chunkSize int64) (int, error) {
+	if chunkSize <= 0 {
+		return 0, fmt.Errorf("invalid chunk size of %d for rechunking", chunkSize)
+	}
+
+	var newCount int
+	err := s.transact(func(tx *sql.Tx) error {
+		// check to make sure the user owns the share
+		var owningUserID, chunkCount int
+		err := tx.QueryRow(getShareOwner, shareID).Scan(&owningUserID, &chunkCount)
+		if err != nil {
+			return fmt.Errorf("failed to get the owning user id for a given share: %v", err)
+		}
+		if owningUserID != userID {
+			return fmt.Errorf("user does not own the share id supplied")
+		}
+
+		// the new chunks are written with negative chunk numbers so that they
+		// don't collide with the old ones until those are removed
+		var pending []byte
+		for i := 0; i < chunkCount; i++ {
+			var chunk []byte
+			err = tx.QueryRow(getShareChunk, shareID, i).Scan(&chunk)
+			if err == sql.ErrNoRows {
+				return fmt.Errorf("share chunk #%d hasn't been uploaded yet", i)
+			} else if err != nil {
+				return fmt.Errorf("failed to get share chunk #%d from the database: %v", i, err)
+			}
+
+			pending = append(pending, chunk...)
+			for int64(len(pending)) >= chunkSize || (i == chunkCount-1 && len(pending) > 0) {
+				n := int64(len(pending))
+				if n > chunkSize {
+					n = chunkSize
+				}
+				_, err = tx.Exec(addShareChunk, shareID, -newCount-1, pending[:n])
+				if err != nil {
+					return fmt.Errorf("failed to add a rechunked share chunk in the database: %v", err)
+				}
+				pending = pending[n:]
+				newCount++
+			}
+		}
+
+		_, err = tx.Exec(removeOldShareChunks, shareID)
+		if err != nil {
+			return fmt.Errorf("failed to delete the old chunks of the share: %v", err)
+		}
+		_, err = tx.Exec(renumberShareChunks, shareID)
+		if err != nil {
+			return fmt.Errorf("failed to renumber the rechunked share chunks: %v", err)
+		}
+		_, err = tx.Exec(setShareChunkCount, newCount, shareID)
+		if err != nil {
+			return fmt.Errorf("failed to update the chunk count for the share: %v", err)
+		}
+
+		return nil
+	})
+	if err != nil {
+		return 0, err
+	}
+	return newCount, nil
+}
+
+// RemoveShare removes a share and all of its chunks from storage, releasing
+// the space they used from the user's allocation.
+func (s *Storage) RemoveShare(userID int, shareID int) error {
+	return s.transact(func(tx *sql.Tx) error {
+		return removeShareTx(tx, userID, shareID)
+	})
+}
+
+// removeShareTx removes a share and its chunks within the transaction supplied.
+func removeShareTx(tx *sql.Tx, userID int, shareID int) error {
+	// check to make sure the user owns the share
+	var owningUserID, chunkCount int
+	err := tx.QueryRow(getShareOwner, shareID).Scan(&owningUserID, &chunkCount)
+	if err != nil {
+		return fmt.Errorf("failed to get the owning user id for a given share: %v", err)
+	}
+	if owningUserID != userID {
+		return fmt.Errorf("user does not own the share id supplied")
+	}
+
+	var totalSize int
+	err = tx.QueryRow(getShareTotalSize, shareID).Scan(&totalSize)
+	if err != nil {
+		return fmt.Errorf("failed to get the chunk sizes for a share in the database: %v", err)
+	}
+
+	_, err = tx.Exec(removeAllShareChunks, shareID)
+	if err != nil {
+		return fmt.Errorf("failed to delete the chunks associated with the share: %v", err)
+	}
+
+	_, err = tx.Exec(removeShareByID, shareID)
+	if err != nil {
+		return fmt.Errorf("failed to remove the share in the database: %v", err)
+	}
+
+	if totalSize > 0 {
+		_, err = tx.Exec(updateUserStats, -totalSize, userID)
+		if err != nil {
+			return fmt.Errorf("failed to update the allocated bytes in the database after removing a share: %v", err)
+		}
+	}
+
+	return nil
+}
+
+// AddDropToken creates a new upload-only token for the user that allows files to be
+// added to folder. Each file can be at most maxFileSize bytes and no more than
+// maxFiles files can be uploaded with the token; a value of zero for maxFiles
+// removes the count limit.
+func (s *Storage) AddDropToken(userID int, token string, folder string, maxFileSize int64, maxFiles int) (*DropToken, error) {
+	created := time.Now().UTC().Unix()
+	res, err := s.db.Exec(addDropToken, userID, token, folder, maxFileSize, maxFiles, created)
+	if err != nil {
+		return nil, fmt.Errorf("failed to add a new drop token in the database: %v", err)
+	}
+	insertedID, err := res.LastInsertId()
+	if err != nil {
+		return nil, fmt.Errorf("failed to get the id for the last row inserted while adding a new drop token: %v", err)
+	}
+
+	dt := new(DropToken)
+	dt.DropID = int(insertedID)
+	dt.UserID = userID
+	dt.Token = token
+	dt.Folder = folder
+	dt.MaxFileSize = maxFileSize
+	dt.MaxFiles = maxFiles
+	dt.Created = created
+	return dt, nil
+}
+
+// GetDropTokenByToken returns the drop token information for the token string.
+func (s *Storage) GetDropTokenByToken(token string) (*DropToken, error) {
+	dt := new(DropToken)
+	dt.Token = token
+	err := s.db.QueryRow(getDropTokenByToken, token).Scan(&dt.DropID, &dt.UserID, &dt.Folder,
+		&dt.MaxFileSize, &dt.MaxFiles, &dt.FileCount, &dt.Created)
+	if err != nil {
+		return nil, err
+	}
+	return dt, nil
+}
+
+// GetDropTokens returns all of the drop tokens for a given user.
+func (s *Storage) GetDropTokens(userID int) ([]DropToken, error) {
+	rows, err := s.db.Query(getAllUserDropTokens, userID)
+	if err != nil {
+		return nil, fmt.Errorf("failed to get the drop tokens for the user: %v", err)
+	}
+	defer rows.Close()
+
+	var result []DropToken
+	for rows.Next() {
+		var dt DropToken
+		dt.UserID = userID
+		err = rows.Scan(&dt.DropID, &dt.Token, &dt.Folder, &dt.MaxFileSize, &dt.MaxFiles, &dt.FileCount, &dt.Created)
+		if err != nil {
+			return nil, fmt.Errorf("failed to scan the next row while processing drop tokens: %v", err)
+		}
+		result = append(result, dt)
+	}
+
+	err = rows.Err()
+	if err != nil {
+		return nil, fmt.Errorf("failed to get all of the drop tokens: %v", err)
+	}
+
+	return result, nil
+}
+
+// RemoveDropToken revokes a drop token for the user. Files that were already
+// uploaded with the token are kept until they're collected.
+func (s *Storage) RemoveDropToken(userID int, dropID int) error {
+	res, err := s.db.Exec(removeDropToken, dropID, userID)
+	if err != nil {
+		return fmt.Errorf("failed to remove the drop token in the database: %v", err)
+	}
+	affected, err := res.RowsAffected()
+	if affected != 1 {
+		return fmt.Errorf("failed to remove the drop token in the database; no rows were affected")
+	} else if err != nil {
+		return fmt.Errorf("failed to remove the drop token in the database: %v", err)
+	}
+	return nil
+}
+
+// AddDropFile stores a file uploaded with the drop token until the owning user
+// collects it. The data is read from r and stored a chunk at a time so that the
+// whole file is never held in memory, and the file isn't returned by
+// GetDropFiles until all of it has been stored. The token's size and count
+// limits are enforced, returning ErrDropFileTooLarge if r holds more than the
+// token allows, and the file counts against the owning user's quota.
+func (s *Storage) AddDropFile(token string, name string, r io.Reader) (*DropFile, error) {
+	df, dt, err := s.beginDropFile(token, name)
+	if err != nil {
+		return nil, err
+	}
+
+	// a chunk never needs to be bigger than the first byte past the limit
+	bufferSize := s.ChunkSize
+	if bufferSize <= 0 || dt.MaxFileSize < bufferSize {
+		bufferSize = dt.MaxFileSize + 1
+	}
+	buffer := make([]byte, bufferSize)
+	for chunkNum := 0; ; chunkNum++ {
+		n, readErr := io.ReadFull(r, buffer)
+		if n > 0 {
+			if df.Size+int64(n) > dt.MaxFileSize {
+				err = ErrDropFileTooLarge
+			} else {
+				err = s.addDropFileChunk(df, chunkNum, buffer[:n])
+			}
+		}
+		if err == nil && readErr != nil && readErr != io.EOF && readErr != io.ErrUnexpectedEOF {
+			err = fmt.Errorf("failed to read the drop file: %v", readErr)
+		}
+		if err != nil {
+			s.abandonDropFile(df, dt)
+			return nil, err
+		}
+		if readErr != nil {
+			break
+		}
+	}
+
+	df.Uploaded = time.Now().UTC().Unix()
+	_, err = s.db.Exec(finishDropFile, df.Uploaded, df.DropFileID)
+	if err != nil {
+		s.abandonDropFile(df, dt)
+		return nil, fmt.Errorf("failed to finish the drop file in the database: %v", err)
+	}
+	return df, nil
+}
+
+// beginDropFile checks the drop token's file count limit and adds an empty
+// drop file for the chunks of an upload to be added to. The file counts
+// towards the token's limit while it's being uploaded.
+func (s *Storage) beginDropFile(token string, name string) (*DropFile, *DropToken, error) {
+	df := new(DropFile)
+	dt := new(DropToken)
+	err := s.transact(func(tx *sql.Tx) error {
+		err := tx.QueryRow(getDropTokenByToken, token).Scan(&dt.DropID, &dt.UserID, &dt.Folder,
+			&dt.MaxFileSize, &dt.MaxFiles, &dt.FileCount, &dt.Created)
+		if err != nil {
+			return fmt.Errorf("failed to find the drop token: %v", err)
+		}
+		if dt.MaxFiles > 0 && dt.FileCount >= dt.MaxFiles {
+			return fmt.Errorf("the drop token has reached its limit of %d files", dt.MaxFiles)
+		}
+
+		res, err := tx.Exec(addDropFile, dt.UserID, dt.Folder, name)
+		if err != nil {
+			return fmt.Errorf("failed to add a new drop file in the database: %v", err)
+		}
+		insertedID, err := res.LastInsertId()
+		if err != nil {
+			return fmt.Errorf("failed to get the id for the last row inserted while adding a drop file: %v", err)
+		}
+
+		_, err = tx.Exec(incDropTokenFileCount, dt.DropID)
+		if err != nil {
+			return fmt.Errorf("failed to update the file count for the drop token: %v", err)
+		}
+
+		df.DropFileID = int(insertedID)
+		df.UserID = dt.UserID
+		df.Folder = dt.Folder
+		df.Name = name
+		return nil
+	})
+
+	if err != nil {
+		return nil, nil, err
+	}
+	return df, dt, nil
+}
+
+// addDropFileChunk stores the next chunk of a drop file being uploaded and adds
+// its size to the file and to the owning user's allocation.
+func (s *Storage) addDropFileChunk(df *DropFile, chunkNum int, chunk []byte) error {
+	chunkLength := int64(len(chunk))
+	err := s.transact(func(tx *sql.Tx) error {
+		// get the user's quota and allocation count and test for a violation
+		var quota, allocated, revision, maxVersions, maxEgress int64
+		err := tx.QueryRow(getUserStats, df.UserID).Scan(&quota, &allocated, &revision, &maxVersions, &maxEgress)
+		if err != nil {
+			return fmt.Errorf("failed to get the user quota from the database before adding a drop file: %v", err)
+		}
+		if (quota - allocated) < chunkLength {
+			return fmt.Errorf("not enough free allocation space (quota: %d ; current allocation %d ; chunk size %d)", quota, allocated, chunkLength)
+		}
+
+		_, err = tx.Exec(addDropFileChunk, df.DropFileID, chunkNum, chunk)
+		if err != nil {
+			return fmt.Errorf("failed to add a drop file chunk in the database: %v", err)
+		}
+
+		res, err := tx.Exec(updateUserStats, chunkLength, df.UserID)
+		if err != nil {
+			return fmt.Errorf("failed to update the allocated bytes in the database after adding a drop file: %v", err)
+		}
+		affected, err := res.RowsAffected()
+		if affected != 1 {
+			return fmt.Errorf("failed to update the user info in the database after adding a drop file; no rows were affected")
+		} else if err != nil {
+			return fmt.Errorf("failed to update the user info in the database after adding a drop file: %v", err)
+		}
+		return nil
+	})
+
+	if err != nil {
+		return err
+	}
+	df.Size += chunkLength
+	return nil
+}
+
+// abandonDropFile removes a drop file whose upload failed and gives its slot
+// back to the drop token.
+func (s *Storage) abandonDropFile(df *DropFile, dt *DropToken) {
+	s.RemoveDropFile(df.UserID, df.DropFileID)
+	s.db.Exec(decDropTokenFileCount, dt.DropID)
+}
+
+// GetDropFiles returns the information for all of the uncollected drop files
+// for a given user, but not the file data itself.
+func (s *Storage) GetDropFiles(userID int) ([]DropFile, error) {
+	rows, err := s.db.Query(getAllUserDropFiles, userID)
+	if err != nil {
+		return nil, fmt.Errorf("failed to get the drop files for the user: %v", err)
+	}
+	defer rows.Close()
+
+	var result []DropFile
+	for rows.Next() {
+		var df DropFile
+		df.UserID = userID
+		err = rows.Scan(&df.DropFileID, &df.Folder, &df.Name, &df.Uploaded, &df.Size)
+		if err != nil {
+			return nil, fmt.Errorf("failed to scan the next row while processing drop files: %v", err)
+		}
+		result = append(result, df)
+	}
+
+	err = rows.Err()
+	if err != nil {
+		return nil, fmt.Errorf("failed to get all of the drop files: %v", err)
+	}
+
+	return result, nil
+}
+
+// GetDropFileData returns the data for a drop file owned by the user.
+func (s *Storage) GetDropFileData(userID int, dropFileID int) ([]byte, error) {
+	var data []byte
+	err := s.db.QueryRow(getDropFileData, dropFileID, userID).Scan(&data)
+	if err != nil {
+		return nil, err
+	}
+
+	rows, err := s.db.Query(getDropFileChunks, dropFileID)
+	if err != nil {
+		return nil, fmt.Errorf("failed to get the chunks for the drop file: %v", err)
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var chunk []byte
+		err = rows.Scan(&chunk)
+		if err != nil {
+			return nil, fmt.Errorf("failed to scan the next chunk of the drop file: %v", err)
+		}
+		data = append(data, chunk...)
+	}
+	return data, rows.Err()
+}
+
+// RemoveDropFile removes a drop file owned by the user, releasing the space
+// it used from the user's allocation.
+func (s *Storage) RemoveDropFile(userID int, dropFileID int) error {
+	return s.transact(func(tx *sql.Tx) error {
+		var size int64
+		err := tx.QueryRow(getDropFileSize, dropFileID, userID).Scan(&size)
+		if err != nil {
+			return fmt.Errorf("failed to find the drop file for the user: %v", err)
+		}
+
+		_, err = tx.Exec(removeDropFile, dropFileID, userID)
+		if err != nil {
+			return fmt.Errorf("failed to remove the drop file in the database: %v", err)
+		}
+
+		_, err = tx.Exec(removeDropFileChunks, dropFileID)
+		if err != nil {
+			return fmt.Errorf("failed to remove the chunks of the drop file in the database: %v", err)
+		}
+
+		_, err = tx.Exec(updateUserStats, -size, userID)
+		if err != nil {
+			return fmt.Errorf("failed to update the allocated bytes in the database after removing a drop file: %v", err)
+		}
+
+		return nil
+	})
+}
+
+// queryer is implemented by both sql.DB and sql.Tx.
+type queryer interface {
+	Query(query string, args ...interface{}) (*sql.Rows, error)
+}
+
+// transact takes a function parameter that will get executed within the context
+// of a database/sql.DB transaction. This transaction will Comit or Rollback
+// based on whether or not an error or panic was generated from this function.
+func (s *Storage) transact(transFoo func(*sql.Tx) error) (err error) {
+	// start the transaction
+	tx, err := s.db.Begin()
+	if err != nil {
+		return
+	}
+
+	defer func() {
+		// attempt to recover from a panic and set the error accordingly
+		if p := recover(); p != nil {
+			switch p := p.(type) {
+			case error:
+				err = p
+			default:
+				err = fmt.Errorf("panic: %s", p)
+			}
+		}
+
+		// if there was an error, we rollback the transaction
+		if err != nil {
+			tx.Rollback()
+			return
+		}
+
+		// no error, so run the commit and return the result
+		err = tx.Commit()
+	}()
+
+	// run the transaction function and do the commit/rollback in the deferred
+	// function above
+	err = transFoo(tx)
+	return err
+}
+
+// SetSupportConsent records that the user allows support tokens to be made for
+// their account until the expires time, in Unix seconds.
+func (s *Storage) SetSupportConsent(userID int, expires int64) error {
+	_, err := s.db.Exec(setSupportConsent, userID, expires)
+	if err != nil {
+		return fmt.Errorf("failed to set the support consent in the database: %v", err)
+	}
+	return nil
+}
+
+// GetSupportConsent returns the time, in Unix seconds, that the user's consent to
+// support access expires; zero is returned if the user hasn't consented.
+func (s *Storage) GetSupportConsent(userID int) (int64, error) {
+	var expires int64
+	err := s.db.QueryRow(getSupportConsent, userID).Scan(&expires)
+	if err == sql.ErrNoRows {
+		return 0, nil
+	} else if err != nil {
+		return 0, fmt.Errorf("failed to get the support consent from the database: %v", err)
+	}
+	return expires, nil
+}
+
+// RemoveSupportConsent withdraws the user's consent to support access.
+func (s *Storage) RemoveSupportConsent(userID int) error {
+	_, err := s.db.Exec(removeSupportConsent, userID)
+	if err != nil {
+		return fmt.Errorf("failed to remove the support consent from the database: %v", err)
+	}
+	return nil
+}
+
+// AddSupportToken adds a support token for the user that expires at the time
+// given in Unix seconds.
+func (s *Storage) AddSupportToken(userID int, token string, reason string, breakGlass bool, expires int64) (*SupportToken, error) {
+	created := time.Now().UTC().Unix()
+	res, err := s.db.Exec(addSupportToken, userID, token, reason, breakGlass, created, expires)
+	if err != nil {
+		return nil, fmt.Errorf("failed to add a new support token in the database: %v", err)
+	}
+	insertedID, err := res.LastInsertId()
+	if err != nil {
+		return nil, fmt.Errorf("failed to get the id for the last row inserted while adding a new support token: %v", err)
+	}
+
+	st := new(SupportToken)
+	st.SupportID = int(insertedID)
+	st.UserID = userID
+	st.Token = token
+	st.Reason = reason
+	st.BreakGlass = breakGlass
+	st.Created = created
+	st.Expires = expires
+	return st, nil
+}
+
+// GetSupportTokenByToken returns the support token information for the token string.
+func (s *Storage) GetSupportTokenByToken(token string) (*SupportToken, error) {
+	st := new(SupportToken)
+	st.Token = token
+	err := s.db.QueryRow(getSupportTokenByToken, token).Scan(&st.SupportID, &st.UserID, &st.Reason,
+		&st.BreakGlass, &st.Created, &st.Expires)
+	if err != nil {
+		return nil, err
+	}
+	return st, nil
+}
+
+// AddSupportAudit records the action taken with a support token on the user's account.
+func (s *Storage) AddSupportAudit(userID int, supportID int, action string) error {
+	_, err := s.db.Exec(addSupportAudit, userID, supportID, time.Now().UTC().Unix(), action)
+	if err != nil {
+		return fmt.Errorf("failed to add the support audit record in the database: %v", err)
+	}
+	return nil
+}
+
+// GetSupportAudit returns the support audit records for the user, oldest first.
+func (s *Storage) GetSupportAudit(userID int) ([]SupportAudit, error) {
+	rows, err := s.db.Query(getAllUserSupportAudit, userID)
+	if err != nil {
+		return nil, fmt.Errorf("failed to get the support audit for the user: %v", err)
+	}
+	defer rows.Close()
+
+	var result []SupportAudit
+	for rows.Next() {
+		var sa SupportAudit
+		err = rows.Scan(&sa.AuditID, &sa.SupportID, &sa.Time, &sa.Action)
+		if err != nil {
+			return nil, fmt.Errorf("failed to scan the next row while processing the support audit: %v", err)
+		}
+		result = append(result, sa)
+	}
+
+	err = rows.Err()
+	if err != nil {
+		return nil, fmt.Errorf("failed to get all of the support audit records: %v", err)
+	}
+
+	return result, nil
+}
+
+// SetAccountDeletion records the user's request to erase their account,
+// replacing any earlier one. A deleteAt of zero means the request still has to
+// be confirmed with the token.
+func (s *Storage) SetAccountDeletion(userID int, token string, deleteAt int64) error {
+	_, err := s.db.Exec(setAccountDeletion, userID, token, time.Now().UTC().Unix(), deleteAt)
+	if err != nil {
+		return fmt.Errorf("failed to set the account deletion in the database: %v", err)
+	}
+	return nil
+}
+
+// GetAccountDeletion returns the user's request to erase their account, or nil
+// if there isn't one.
+func (s *Storage) GetAccountDeletion(userID int) (*AccountDeletion, error) {
+	ad := new(AccountDeletion)
+	ad.UserID = userID
+	err := s.db.QueryRow(getAccountDeletion, userID).Scan(&ad.Token, &ad.Requested, &ad.DeleteAt)
+	if err == sql.ErrNoRows {
+		return nil, nil
+	} else if err != nil {
+		return nil, fmt.Errorf("failed to get the account deletion from the database: %v", err)
+	}
+	return ad, nil
+}
+
+// GetDueAccountDeletions returns the confirmed account deletions whose grace
+// period ended by the time now, in Unix seconds.
+func (s *Storage) GetDueAccountDeletions(now int64) ([]AccountDeletion, error) {
+	rows, err := s.db.Query(getDueAccountDeletions, now)
+	if err != nil {
+		return nil, fmt.Errorf("failed to get the due account deletions: %v", err)
+	}
+	defer rows.Close()
+
+	var result []AccountDeletion
+	for rows.Next() {
+		var ad AccountDeletion
+		err = rows.Scan(&ad.UserID, &ad.Token, &ad.Requested, &ad.DeleteAt)
+		if err != nil {
+			return nil, fmt.Errorf("failed to scan the next row while processing account deletions: %v", err)
+		}
+		result = append(result, ad)
+	}
+
+	err = rows.Err()
+	if err != nil {
+		return nil, fmt.Errorf("failed to get all of the due account deletions: %v", err)
+	}
+
+	return result, nil
+}
+
+// RemoveAccountDeletion cancels the user's request to erase their account.
+func (s *Storage) RemoveAccountDeletion(userID int) error {
+	_, err := s.db.Exec(removeAccountDeletion, userID)
+	if err != nil {
+		return fmt.Errorf("failed to remove the account deletion from the database: %v", err)
+	}
+	return nil
+}
+
+// getRowCount is a method to return the number of rows for a given table.
+func (s *Storage) getRowCount(table string) (int, error) {
+	rows, err := s.db.Query("SELECT Count(*) FROM " + table)
+	if err != nil {
+		return 0, err
+	}
+	defer rows.Close()
 
 	var count int
 	for rows.Next() {
@@ -1289,3 +3293,146 @@ func (s *Storage) getRowCount(table string) (int, error) {
 
 	return count, nil
 }
+
+// AddUserBandwidth adds a request with the bytes uploaded and downloaded to
+// the user's bandwidth for the day, formatted with BandwidthDayFormat.
+func (s *Storage) AddUserBandwidth(userID int, day string, uploaded int64, downloaded int64) error {
+	_, err := s.db.Exec(addUserBandwidth, userID, day, uploaded, downloaded)
+	if err != nil {
+		return fmt.Errorf("failed to add the bandwidth in the database: %v", err)
+	}
+	return nil
+}
+
+// GetUserBandwidth returns the user's bandwidth for each day on or after the
+// day given, oldest first. Days without requests are left out.
+func (s *Storage) GetUserBandwidth(userID int, since string) ([]BandwidthDay, error) {
+	rows, err := s.db.Query(getUserBandwidth, userID, since)
+	if err != nil {
+		return nil, fmt.Errorf("failed to get the bandwidth from the database: %v", err)
+	}
+	defer rows.Close()
+
+	var result []BandwidthDay
+	for rows.Next() {
+		var day BandwidthDay
+		err = rows.Scan(&day.Day, &day.Requests, &day.Uploaded, &day.Downloaded)
+		if err != nil {
+			return nil, fmt.Errorf("failed to scan the next row while processing the bandwidth: %v", err)
+		}
+		result = append(result, day)
+	}
+	if err = rows.Err(); err != nil {
+		return nil, err
+	}
+	return result, nil
+}
+
+// LockFile takes the advisory lock on a file owned by the user for the holder
+// with the token until expires, in Unix seconds. A lock the token already holds
+// is renewed and an expired lock is taken over. If another token holds the lock
+// it's returned along with false and nothing is changed.
+func (s *Storage) LockFile(userID int, fileID int, token string, holder string, expires int64) (*FileLock, bool, error) {
+	now := time.Now().UTC().Unix()
+	lock := &FileLock{FileID: fileID, UserID: userID, Token: token, Holder: holder, Created: now, Expires: expires}
+	acquired := true
+	err := s.transact(func(tx *sql.Tx) error {
+		// check to make sure the user owns the file id
+		var owningUserID int
+		err := tx.QueryRow(getFileInfoOwner, fileID).Scan(&owningUserID)
+		if err != nil {
+			return fmt.Errorf("failed to get the owning user id for a given file: %v", err)
+		}
+		if owningUserID != userID {
+			return fmt.Errorf("user does not own the file id supplied")
+		}
+
+		existing := FileLock{FileID: fileID}
+		err = tx.QueryRow(getFileLock, fileID).Scan(&existing.UserID, &existing.Token, &existing.Holder, &existing.Created, &existing.Expires)
+		if err == nil && existing.Expires > now {
+			if existing.Token != token {
+				lock = &existing
+				acquired = false
+				return nil
+			}
+			lock.Created = existing.Created
+		} else if err != nil && err != sql.ErrNoRows {
+			return fmt.Errorf("failed to get the lock on the file from the database: %v", err)
+		}
+
+		_, err = tx.Exec(setFileLock, fileID, userID, token, holder, lock.Created, expires)
+		if err != nil {
+			return fmt.Errorf("failed to set the lock on the file in the database: %v", err)
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, false, err
+	}
+	return lock, acquired, nil
+}
+
+// GetFileLock returns the lock on a file owned by the user, or nil if the file
+// isn't locked or the lock has expired.
+func (s *Storage) GetFileLock(userID int, fileID int) (*FileLock, error) {
+	lock := &FileLock{FileID: fileID}
+	err := s.db.QueryRow(getFileLock, fileID).Scan(&lock.UserID, &lock.Token, &lock.Holder, &lock.Created, &lock.Expires)
+	if err == sql.ErrNoRows {
+		return nil, nil
+	} else if err != nil {
+		return nil, fmt.Errorf("failed to get the lock on the file from the database: %v", err)
+	}
+	if lock.UserID != userID || lock.Expires <= time.Now().UTC().Unix() {
+		return nil, nil
+	}
+	return lock, nil
+}
+
+// UnlockFile releases the lock on a file owned by the user if it's held by the
+// token and returns false if it wasn't.
+func (s *Storage) UnlockFile(userID int, fileID int, token string) (bool, error) {
+	var owningUserID int
+	err := s.db.QueryRow(getFileInfoOwner, fileID).Scan(&owningUserID)
+	if err != nil {
+		return false, fmt.Errorf("failed to get the owning user id for a given file: %v", err)
+	}
+	if owningUserID != userID {
+		return false, fmt.Errorf("user does not own the file id supplied")
+	}
+
+	res, err := s.db.Exec(removeFileLock, fileID, token)
+	if err != nil {
+		return false, fmt.Errorf("failed to remove the lock on the file: %v", err)
+	}
+	affected, err := res.RowsAffected()
+	if err != nil {
+		return false, fmt.Errorf("failed to remove the lock on the file: %v", err)
+	}
+	return affected == 1, nil
+}
+
+// GetFileLocks returns the unexpired locks on the user's files sorted by FileID.
+func (s *Storage) GetFileLocks(userID int) ([]FileLock, error) {
+	rows, err := s.db.Query(getAllUserFileLocks, userID, time.Now().UTC().Unix())
+	if err != nil {
+		return nil, fmt.Errorf("failed to get the locks on the user's files: %v", err)
+	}
+	defer rows.Close()
+
+	var result []FileLock
+	for rows.Next() {
+		lock := FileLock{UserID: userID}
+		err = rows.Scan(&lock.FileID, &lock.Token, &lock.Holder, &lock.Created, &lock.Expires)
+		if err != nil {
+			return nil, fmt.Errorf("failed to scan the next row while processing file locks: %v", err)
+		}
+		result = append(result, lock)
+	}
+
+	err = rows.Err()
+	if err != nil {
+		return nil, fmt.Errorf("failed to get all of the file locks: %v", err)
+	}
+
+	return result, nil
+}
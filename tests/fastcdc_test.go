@@ -0,0 +1,100 @@
+// Copyright 2017, Timothy Bogdala <tdb@animal-machine.com>
+// See the LICENSE file for more details.
+
+package tests
+
+import (
+	"bytes"
+	"crypto/sha1"
+	"io"
+	"io/ioutil"
+	"math/rand"
+	"os"
+	"testing"
+
+	"github.com/marcoziti/gringotts"
+)
+
+// splitChunks returns copies of the chunks of data split with the chunking.
+func splitChunks(t *testing.T, data []byte, chunking string, maxChunkSize int) [][]byte {
+	chunker, err := filefreezer.NewChunker(bytes.NewReader(data), chunking, maxChunkSize)
+	if err != nil {
+		t.Fatalf("Failed to create the chunker: %v", err)
+	}
+	var chunks [][]byte
+	for {
+		chunk, err := chunker.Next()
+		if err == io.EOF {
+			return chunks
+		}
+		if err != nil {
+			t.Fatalf("Failed to read the next chunk: %v", err)
+		}
+		chunks = append(chunks, append([]byte(nil), chunk...))
+	}
+}
+
+func TestChunker(t *testing.T) {
+	const maxChunkSize = 64 * 1024
+	data := make([]byte, 2*1024*1024+123)
+	rand.New(rand.NewSource(1)).Read(data)
+
+	// fixed chunks are all the maximum size but the last
+	fixed := splitChunks(t, data, filefreezer.ChunkingFixed, maxChunkSize)
+	if len(fixed) != len(data)/maxChunkSize+1 || len(fixed[len(fixed)-1]) != 123 {
+		t.Fatalf("Expected %d fixed chunks but got %d.", len(data)/maxChunkSize+1, len(fixed))
+	}
+
+	// content defined chunks put back together are the data, and only the
+	// last one is shorter than the minimum
+	min, avg := filefreezer.FastCDCChunkSizes(maxChunkSize)
+	chunks := splitChunks(t, data, filefreezer.ChunkingFastCDC, maxChunkSize)
+	if !bytes.Equal(bytes.Join(chunks, nil), data) {
+		t.Fatal("The content defined chunks don't add up to the data.")
+	}
+	for i, c := range chunks {
+		if len(c) > maxChunkSize || (len(c) < int(min) && i != len(chunks)-1) {
+			t.Fatalf("Chunk %d is %d bytes, outside of %d to %d.", i, len(c), min, maxChunkSize)
+		}
+	}
+	if average := len(data) / len(chunks); average < int(avg)/2 || average > int(avg)*2 {
+		t.Fatalf("The chunks average %d bytes instead of about %d.", average, avg)
+	}
+
+	// inserting bytes only changes the chunks around them
+	edited := append(append(append([]byte(nil), data[:1000000]...), []byte("inserted bytes")...), data[1000000:]...)
+	hashes := make(map[[sha1.Size]byte]bool)
+	for _, c := range chunks {
+		hashes[sha1.Sum(c)] = true
+	}
+	changed := 0
+	for _, c := range splitChunks(t, edited, filefreezer.ChunkingFastCDC, maxChunkSize) {
+		if !hashes[sha1.Sum(c)] {
+			changed++
+		}
+	}
+	if changed == 0 || changed > 3 {
+		t.Fatalf("Expected one to three chunks to change after the insert but %d did.", changed)
+	}
+
+	// the file hash info counts the same chunks
+	f, err := ioutil.TempFile("", "fastcdc")
+	if err != nil {
+		t.Fatalf("Failed to create a temporary file: %v", err)
+	}
+	defer os.Remove(f.Name())
+	f.Write(data)
+	f.Close()
+	stats, err := filefreezer.CalcFileHashInfoChunked(filefreezer.ChunkingFastCDC, maxChunkSize, f.Name())
+	if err != nil || stats.ChunkCount != len(chunks) {
+		t.Fatalf("Expected the file to have %d chunks but it has %d: %v", len(chunks), stats.ChunkCount, err)
+	}
+	fixedStats, err := filefreezer.CalcFileHashInfo(maxChunkSize, f.Name())
+	if err != nil || fixedStats.HashString != stats.HashString {
+		t.Fatalf("The file hash shouldn't depend on the chunking: %v", err)
+	}
+
+	if _, err = filefreezer.NewChunker(bytes.NewReader(data), "rabin", maxChunkSize); err == nil {
+		t.Fatal("Creating a chunker with an unknown method should fail.")
+	}
+}
@@ -11,7 +11,7 @@ import (
 	"testing"
 	"time"
 
-	"github.com/tbogdala/filefreezer"
+	"github.com/marcoziti/gringotts"
 )
 
 func setupBenchmarkStorage(dbPath string, b *testing.B) (*filefreezer.Storage, *filefreezer.User) {
@@ -79,7 +79,7 @@ func doBenchFileWrite(dbPath string, chunkSize int, b *testing.B) {
 
 	// loop: create a file with one chunk and upload the chunk
 	for n := 0; n < b.N; n++ {
-		fi, err := store.AddFileInfo(user.ID, fmt.Sprintf("TestFile_%08d.dat", n), false, 0777, modTime, 1, hashString)
+		fi, err := store.AddFileInfo(user.ID, fmt.Sprintf("TestFile_%08d.dat", n), false, 0777, modTime, 1, hashString, "")
 		if err != nil {
 			b.Fatalf("Failed to add a test file for iteration %d: %v", n, err)
 		}
@@ -121,7 +121,7 @@ func doBenchReadChunk(dbPath string, chunkSize int, b *testing.B) {
 	modTime := time.Now().Unix()
 
 	// create a file with one chunk and upload the chunk
-	fi, err := store.AddFileInfo(user.ID, "TestFile_00.dat", false, 0777, modTime, 1, hashString)
+	fi, err := store.AddFileInfo(user.ID, "TestFile_00.dat", false, 0777, modTime, 1, hashString, "")
 	if err != nil {
 		b.Fatalf("Failed to add a test file: %v", err)
 	}
@@ -141,3 +141,51 @@ func doBenchReadChunk(dbPath string, chunkSize int, b *testing.B) {
 		}
 	}
 }
+
+func BenchmarkListFiles100kMemory(b *testing.B) {
+	doBenchListFiles("file:list_bench?mode=memory&cache=shared", 100000, b)
+}
+
+func BenchmarkListFiles100kFilesystem(b *testing.B) {
+	const filename = "list_bench1.db"
+	os.Remove(filename)
+	doBenchListFiles(filename, 100000, b)
+	os.Remove(filename)
+}
+
+func doBenchListFiles(dbPath string, fileCount int, b *testing.B) {
+	store, user := setupBenchmarkStorage(dbPath, b)
+	defer store.Close()
+
+	// give every file a small chunk so that the listing totals up their sizes
+	randoBytes, hashString := setupRandomBytes(256)
+	modTime := time.Now().Unix()
+	for n := 0; n < fileCount; n++ {
+		fi, err := store.AddFileInfo(user.ID, fmt.Sprintf("dir_%04d/TestFile_%08d.dat", n/1000, n), false, 0777, modTime, 1, hashString, "")
+		if err != nil {
+			b.Fatalf("Failed to add test file %d: %v", n, err)
+		}
+
+		_, err = store.AddFileChunk(user.ID, fi.FileID, fi.CurrentVersion.VersionID, 0, hashString, randoBytes)
+		if err != nil {
+			b.Fatalf("Failed to add a test chunk for file %d: %v", n, err)
+		}
+	}
+
+	b.ResetTimer()
+
+	// list all of the files, which should take under a second even for large accounts
+	start := time.Now()
+	for n := 0; n < b.N; n++ {
+		allFiles, err := store.GetAllUserFileInfos(user.ID)
+		if err != nil {
+			b.Fatalf("Failed to list the files for iteration %d: %v", n, err)
+		}
+		if len(allFiles) != fileCount {
+			b.Fatalf("Expected %d files to be listed but got %d.", fileCount, len(allFiles))
+		}
+	}
+	if perList := time.Since(start) / time.Duration(b.N); perList > time.Second {
+		b.Errorf("Listing %d files took %s, which is over a second.", fileCount, perList)
+	}
+}
@@ -6,18 +6,20 @@ package tests
 import (
 	"bytes"
 	"crypto/sha1"
+	"database/sql"
 	"encoding/base64"
 	"io"
 	"io/ioutil"
 	"math/rand"
 	"os"
 	"sort"
+	"strings"
 	"testing"
 	"time"
 
 	"fmt"
 
-	"github.com/tbogdala/filefreezer"
+	"github.com/marcoziti/gringotts"
 )
 
 func TestMain(m *testing.M) {
@@ -79,6 +81,16 @@ func TestQuotasAndPermissions(t *testing.T) {
 	if err != nil {
 		t.Fatalf("Failed to get the user: %v", err)
 	}
+
+	// both users should be returned when listing all of them
+	allUsers, err := store.GetAllUsers()
+	if err != nil {
+		t.Fatalf("Failed to get all of the users: %v", err)
+	}
+	if len(allUsers) != 2 || allUsers[0].Name != "admin" || allUsers[1].Name != "admin2" {
+		t.Fatalf("Expected to get both test users when listing all users but got: %v", allUsers)
+	}
+
 	err = store.SetUserQuota(user.ID, 100)
 	if err != nil {
 		t.Fatalf("Failed to set the user quota for (id:%d): %v", user.ID, err)
@@ -114,7 +126,7 @@ func TestQuotasAndPermissions(t *testing.T) {
 
 	// add the file information to the storage server
 	fi, err := store.AddFileInfo(user.ID, filename, fileStats.IsDir, fileStats.Permissions,
-		fileStats.LastMod, fileStats.ChunkCount, fileStats.HashString)
+		fileStats.LastMod, fileStats.ChunkCount, fileStats.HashString, "")
 	if err != nil {
 		t.Fatalf("Failed to add a new file (%s): %v", filename, err)
 	}
@@ -251,7 +263,7 @@ func TestBasicDBCreation(t *testing.T) {
 
 	// add the file information to the storage server
 	fi, err := store.AddFileInfo(user.ID, filename, fileStats.IsDir, fileStats.Permissions,
-		fileStats.LastMod, fileStats.ChunkCount, fileStats.HashString)
+		fileStats.LastMod, fileStats.ChunkCount, fileStats.HashString, "")
 	if err != nil {
 		t.Fatalf("Failed to add a new file (%s): %v", filename, err)
 	}
@@ -277,7 +289,7 @@ func TestBasicDBCreation(t *testing.T) {
 
 	// add the file information to the storage server again for the rest of the tests
 	_, err = store.AddFileInfo(user.ID, filename, fileStats.IsDir, fileStats.Permissions,
-		fileStats.LastMod, fileStats.ChunkCount, fileStats.HashString)
+		fileStats.LastMod, fileStats.ChunkCount, fileStats.HashString, "")
 	if err != nil {
 		t.Fatalf("Failed to add a new file (%s): %v", filename, err)
 	}
@@ -333,14 +345,14 @@ func TestBasicDBCreation(t *testing.T) {
 
 	// add the file information to the storage server
 	_, err = store.AddFileInfo(user.ID, filename, fileStats.IsDir, fileStats.Permissions,
-		fileStats.LastMod, fileStats.ChunkCount, fileStats.HashString)
+		fileStats.LastMod, fileStats.ChunkCount, fileStats.HashString, "")
 	if err != nil {
 		t.Fatalf("Failed to add a new file (%s): %v", filename, err)
 	}
 
 	// attempt to add the same file information again, which should fail as a duplicate
 	_, err = store.AddFileInfo(user.ID, filename, fileStats.IsDir, fileStats.Permissions,
-		fileStats.LastMod, fileStats.ChunkCount, fileStats.HashString)
+		fileStats.LastMod, fileStats.ChunkCount, fileStats.HashString, "")
 	if err == nil {
 		t.Fatal("Added a duplicate filename under the same user successuflly when a failure was expected.")
 	}
@@ -417,7 +429,7 @@ func TestBasicDBCreation(t *testing.T) {
 
 	// add the first file back in so that the rests of the tests can continue
 	first, err = store.AddFileInfo(first.UserID, first.FileName, first.IsDir, first.CurrentVersion.Permissions,
-		first.CurrentVersion.LastMod, first.CurrentVersion.ChunkCount, first.CurrentVersion.FileHash)
+		first.CurrentVersion.LastMod, first.CurrentVersion.ChunkCount, first.CurrentVersion.FileHash, "")
 	if err != nil {
 		t.Fatalf("Failed to add a the file again (%s): %v", first.FileName, err)
 	}
@@ -464,6 +476,20 @@ func TestBasicDBCreation(t *testing.T) {
 		t.Fatal("A call to GetMissingChunkNumbersForFile with an incorrect user ID succeeded when failure was expected.")
 	}
 
+	// chunks outside of the version or for another file's version should be rejected
+	_, err = store.AddFileChunk(first.UserID, first.FileID, first.CurrentVersion.VersionID, first.CurrentVersion.ChunkCount, chunk.ChunkHash, chunk.Chunk)
+	if err == nil {
+		t.Fatal("Adding a chunk past the end of the file version succeeded when failure was expected.")
+	}
+	_, err = store.AddFileChunk(first.UserID, first.FileID, first.CurrentVersion.VersionID, -1, chunk.ChunkHash, chunk.Chunk)
+	if err == nil {
+		t.Fatal("Adding a chunk with a negative chunk number succeeded when failure was expected.")
+	}
+	_, err = store.AddFileChunk(first.UserID, first.FileID, second.CurrentVersion.VersionID, 0, chunk.ChunkHash, chunk.Chunk)
+	if err == nil {
+		t.Fatal("Adding a chunk to another file's version succeeded when failure was expected.")
+	}
+
 	miaList, err = store.GetMissingChunkNumbersForFile(second.UserID, second.FileID)
 	if err != nil {
 		t.Fatalf("Could not get a list of missing chunks for the file (%s): %v", second.FileName, err)
@@ -623,7 +649,7 @@ func TestFileVersioning(t *testing.T) {
 
 	// add the file information to the storage server
 	fi, err := store.AddFileInfo(user.ID, testFilename1, fileStats.IsDir, fileStats.Permissions,
-		fileStats.LastMod, fileStats.ChunkCount, fileStats.HashString)
+		fileStats.LastMod, fileStats.ChunkCount, fileStats.HashString, "")
 	if err != nil {
 		t.Fatalf("Failed to add a new file (%s): %v", testFilename1, err)
 	}
@@ -685,7 +711,7 @@ func TestFileVersioning(t *testing.T) {
 
 	// register a new version of the file in storage with the updated local information
 	fiV2, err := store.TagNewFileVersion(user.ID, fi.FileID, fileStats.Permissions,
-		fileStats.LastMod, fileStats.ChunkCount, fileStats.HashString)
+		fileStats.LastMod, fileStats.ChunkCount, fileStats.HashString, "")
 	if err != nil {
 		t.Fatalf("Failed to tag a new file version for %s: %v", testFilename1, err)
 	}
@@ -744,7 +770,7 @@ func TestFileVersioning(t *testing.T) {
 
 	// register a new version of the file in storage with the updated local information
 	fiV3, err := store.TagNewFileVersion(user.ID, fiV2.FileID, fileStats.Permissions,
-		fileStats.LastMod, fileStats.ChunkCount, fileStats.HashString)
+		fileStats.LastMod, fileStats.ChunkCount, fileStats.HashString, "")
 	if err != nil {
 		t.Fatalf("Failed to tag a new file version for %s: %v", testFilename1, err)
 	}
@@ -803,7 +829,7 @@ func TestFileVersioning(t *testing.T) {
 
 	// register a new version of the file in storage with the updated local information
 	fiV4, err := store.TagNewFileVersion(user.ID, fiV3.FileID, fileStats.Permissions,
-		fileStats.LastMod, fileStats.ChunkCount, fileStats.HashString)
+		fileStats.LastMod, fileStats.ChunkCount, fileStats.HashString, "")
 	if err != nil {
 		t.Fatalf("Failed to tag a new file version for %s: %v", testFilename1, err)
 	}
@@ -862,7 +888,7 @@ func TestFileVersioning(t *testing.T) {
 
 	// register a new version of the file in storage with the updated local information
 	fiV5, err := store.TagNewFileVersion(user.ID, fiV4.FileID, fileStats.Permissions,
-		fileStats.LastMod, fileStats.ChunkCount, fileStats.HashString)
+		fileStats.LastMod, fileStats.ChunkCount, fileStats.HashString, "")
 	if err != nil {
 		t.Fatalf("Failed to tag a new file version for %s: %v", testFilename1, err)
 	}
@@ -1176,6 +1202,316 @@ func addMissingFileChunks(store *filefreezer.Storage, fi *filefreezer.FileInfo)
 	return nil
 }
 
+func TestVersionMetadata(t *testing.T) {
+	// create an in memory storage
+	store, err := filefreezer.NewStorage("file::memory:?mode=memory&cache=shared")
+	if err != nil {
+		t.Fatalf("Failed to create the in-memory storage for testing. %v", err)
+	}
+	defer store.Close()
+	err = store.CreateTables()
+	if err != nil {
+		t.Fatalf("Failed to create tables for testing. %v", err)
+	}
+	setupTestUser(store, "admin", "12345667890", t)
+	user, err := store.GetUser("admin")
+	if err != nil {
+		t.Fatal("GetUser failed to get the admin test user.")
+	}
+
+	// each version records when it was created and the device that uploaded it
+	const filename = "version_metadata_test.dat"
+	defer os.Remove(filename)
+	before := time.Now().Unix()
+	fi := addNewRandomFile(store, user, filename, 2, t)
+	fi, err = store.TagNewFileVersion(user.ID, fi.FileID, fi.CurrentVersion.Permissions,
+		fi.CurrentVersion.LastMod, 1, fi.CurrentVersion.FileHash, "desktop")
+	if err != nil {
+		t.Fatalf("Failed to tag a new file version: %v", err)
+	}
+	err = addMissingFileChunks(store, fi)
+	if err != nil {
+		t.Fatalf("Failed to upload the chunks for the new version: %v", err)
+	}
+
+	versions, err := store.GetFileVersions(fi.FileID)
+	if err != nil || len(versions) != 2 {
+		t.Fatalf("Expected two versions of the file but got %d: %v", len(versions), err)
+	}
+	sort.Slice(versions, func(i, j int) bool { return versions[i].VersionNumber < versions[j].VersionNumber })
+	for _, v := range versions {
+		if v.Created < before || v.Created > time.Now().Unix() {
+			t.Fatalf("Version %d has a creation time (%d) outside of the test.", v.VersionNumber, v.Created)
+		}
+	}
+	if versions[0].Device != "" || versions[1].Device != "desktop" {
+		t.Fatalf("Expected the versions to be from no device and desktop but got %q and %q.", versions[0].Device, versions[1].Device)
+	}
+	if versions[0].ChunkCount != 2 || versions[0].Size != 2*store.ChunkSize {
+		t.Fatalf("Expected the first version to have 2 chunks and %d bytes but got %d and %d.",
+			2*store.ChunkSize, versions[0].ChunkCount, versions[0].Size)
+	}
+	if versions[1].ChunkCount != 1 || versions[1].Size != store.ChunkSize {
+		t.Fatalf("Expected the second version to have 1 chunk and %d bytes but got %d and %d.",
+			store.ChunkSize, versions[1].ChunkCount, versions[1].Size)
+	}
+
+	// the file listing carries the sizes totaled by the server
+	allFiles, err := store.GetAllUserFileInfos(user.ID)
+	if err != nil || len(allFiles) != 1 {
+		t.Fatalf("Expected one file for the user but got %d: %v", len(allFiles), err)
+	}
+	if allFiles[0].CurrentVersion.Size != store.ChunkSize || allFiles[0].Size != 3*store.ChunkSize {
+		t.Fatalf("Expected the file to use %d bytes currently and %d in total but got %d and %d.",
+			store.ChunkSize, 3*store.ChunkSize, allFiles[0].CurrentVersion.Size, allFiles[0].Size)
+	}
+
+	// databases from before version metadata was tracked get migrated
+	dbFile, err := ioutil.TempFile("", "freezer-migrate")
+	if err != nil {
+		t.Fatalf("Failed to create a temporary database file: %v", err)
+	}
+	dbFile.Close()
+	defer os.Remove(dbFile.Name())
+	defer os.Remove(dbFile.Name() + "-wal")
+	defer os.Remove(dbFile.Name() + "-shm")
+
+	oldDB, err := sql.Open(filefreezer.SQLiteDriver, dbFile.Name())
+	if err != nil {
+		t.Fatalf("Failed to open the old database: %v", err)
+	}
+	for _, stmt := range []string{
+		`CREATE TABLE AppData (DBVersion INTEGER NOT NULL);`,
+		`INSERT INTO AppData (DBVersion) VALUES (1);`,
+		`CREATE TABLE FileVersion (VersionID INTEGER PRIMARY KEY NOT NULL, FileID INTEGER NOT NULL,
+			VersionNum INTEGER NOT NULL, Perms INTEGER NOT NULL, LastMod INTEGER NOT NULL,
+			ChunkCount INTEGER NOT NULL, FileHash TEXT NOT NULL);`,
+		`INSERT INTO FileVersion (FileID, VersionNum, Perms, LastMod, ChunkCount, FileHash) VALUES (1, 1, 420, 0, 0, 'hash');`,
+	} {
+		_, err = oldDB.Exec(stmt)
+		if err != nil {
+			oldDB.Close()
+			t.Fatalf("Failed to set up the old database: %v", err)
+		}
+	}
+	oldDB.Close()
+
+	migrated, err := filefreezer.NewStorage(dbFile.Name())
+	if err != nil {
+		t.Fatalf("Failed to open the old database as storage: %v", err)
+	}
+	defer migrated.Close()
+	err = migrated.CreateTables()
+	if err != nil {
+		t.Fatalf("Failed to migrate the old database: %v", err)
+	}
+	dbVersion, err := migrated.GetDBVersion()
+	if err != nil || dbVersion != filefreezer.CurrentDBVersion {
+		t.Fatalf("Expected the migrated database to be version %d but got %d: %v", filefreezer.CurrentDBVersion, dbVersion, err)
+	}
+	versions, err = migrated.GetFileVersions(1)
+	if err != nil || len(versions) != 1 || versions[0].Created != 0 || versions[0].Device != "" {
+		t.Fatalf("Expected the old version to be kept without metadata: %+v (%v)", versions, err)
+	}
+}
+
+func TestDuplicateFiles(t *testing.T) {
+	// create an in memory storage
+	store, err := filefreezer.NewStorage("file::memory:?mode=memory&cache=shared")
+	if err != nil {
+		t.Fatalf("Failed to create the in-memory storage for testing. %v", err)
+	}
+	defer store.Close()
+	err = store.CreateTables()
+	if err != nil {
+		t.Fatalf("Failed to create tables for testing. %v", err)
+	}
+	setupTestUser(store, "admin", "12345667890", t)
+	user, err := store.GetUser("admin")
+	if err != nil {
+		t.Fatal("GetUser failed to get the admin test user.")
+	}
+
+	// only the current version's hash counts and directories are never duplicates
+	files := []struct {
+		name  string
+		isDir bool
+		hash  string
+	}{
+		{"a.txt", false, "hash1"},
+		{"b.txt", false, "hash2"},
+		{"copy/a.txt", false, "hash1"},
+		{"dir1", true, ""},
+		{"dir2", true, ""},
+		{"changed.txt", false, "hash2"},
+		{"again/a.txt", false, "hash1"},
+	}
+	fileIDs := make(map[string]int)
+	for _, f := range files {
+		fi, err := store.AddFileInfo(user.ID, f.name, f.isDir, 0644, 1, 0, f.hash, "")
+		if err != nil {
+			t.Fatalf("Failed to add the file %s: %v", f.name, err)
+		}
+		fileIDs[f.name] = fi.FileID
+	}
+	_, err = store.TagNewFileVersion(user.ID, fileIDs["changed.txt"], 0644, 2, 0, "hash3", "")
+	if err != nil {
+		t.Fatalf("Failed to tag a new file version: %v", err)
+	}
+
+	groups, err := store.GetDuplicateFileInfos(user.ID)
+	if err != nil {
+		t.Fatalf("Failed to get the duplicate files: %v", err)
+	}
+	if len(groups) != 1 || len(groups[0]) != 3 {
+		t.Fatalf("Expected one group of three duplicates but got %+v.", groups)
+	}
+	for i, name := range []string{"a.txt", "copy/a.txt", "again/a.txt"} {
+		if groups[0][i].FileID != fileIDs[name] || groups[0][i].CurrentVersion.FileHash != "hash1" {
+			t.Fatalf("Expected %s to be duplicate %d but got %+v.", name, i, groups[0][i])
+		}
+	}
+}
+
+// flakyBlobStore is an in-memory BlobStore that fails everything while down.
+type flakyBlobStore struct {
+	down  bool
+	blobs map[string][]byte
+}
+
+func (f *flakyBlobStore) Put(key string, data []byte) error {
+	if f.down {
+		return fmt.Errorf("store is down")
+	}
+	f.blobs[key] = data
+	return nil
+}
+
+func (f *flakyBlobStore) Get(key string) ([]byte, error) {
+	data, found := f.blobs[key]
+	if f.down || !found {
+		return nil, fmt.Errorf("blob not found")
+	}
+	return data, nil
+}
+
+func (f *flakyBlobStore) Delete(key string) error {
+	if f.down {
+		return fmt.Errorf("store is down")
+	}
+	delete(f.blobs, key)
+	return nil
+}
+
+func TestMirroredBlobStore(t *testing.T) {
+	primary := &flakyBlobStore{blobs: make(map[string][]byte)}
+	secondary := &flakyBlobStore{blobs: make(map[string][]byte)}
+	mirror := filefreezer.NewMirroredBlobStore([]string{"primary", "secondary"}, []filefreezer.BlobStore{primary, secondary})
+
+	err := mirror.Put("a", []byte("first"))
+	if err != nil || len(primary.blobs) != 1 || len(secondary.blobs) != 1 {
+		t.Fatalf("The blob should be written to both stores: %v", err)
+	}
+
+	// with the primary down, writes fail over to the secondary
+	primary.down = true
+	err = mirror.Put("b", []byte("second"))
+	if err != nil {
+		t.Fatalf("A write should succeed while one store is up: %v", err)
+	}
+	data, err := mirror.Get("b")
+	if err != nil || string(data) != "second" {
+		t.Fatalf("The blob should be read from the secondary store (%q): %v", data, err)
+	}
+	if unhealthy := mirror.CheckHealth(); len(unhealthy) != 1 || unhealthy[0] != "primary" {
+		t.Fatalf("The primary store should be reported as unhealthy: %v", unhealthy)
+	}
+
+	// once the primary is back, reading the blob it missed repairs it
+	primary.down = false
+	if unhealthy := mirror.CheckHealth(); len(unhealthy) != 0 {
+		t.Fatalf("Both stores should be healthy again: %v", unhealthy)
+	}
+	data, err = mirror.Get("b")
+	if err != nil || string(data) != "second" {
+		t.Fatalf("The blob should still be readable (%q): %v", data, err)
+	}
+	if string(primary.blobs["b"]) != "second" {
+		t.Fatal("Reading the blob should have repaired the primary store's copy.")
+	}
+
+	err = mirror.Delete("a")
+	if err != nil || len(primary.blobs["a"]) != 0 || len(secondary.blobs["a"]) != 0 {
+		t.Fatalf("The blob should be deleted from both stores: %v", err)
+	}
+
+	primary.down = true
+	secondary.down = true
+	if err = mirror.Put("c", []byte("third")); err == nil {
+		t.Fatal("A write should fail when every store is down.")
+	}
+}
+
+func TestEncryptedBlobStore(t *testing.T) {
+	key1 := base64.StdEncoding.EncodeToString(genRandomBytes(32))
+	key2 := base64.StdEncoding.EncodeToString(genRandomBytes(32))
+	keyring, err := filefreezer.ParseChunkKeyring(strings.NewReader("# hot tier\nhot1 " + key1 + "\n"))
+	if err != nil {
+		t.Fatalf("Failed to parse the chunk keys: %v", err)
+	}
+	if _, err = filefreezer.ParseChunkKeyring(strings.NewReader("short " + base64.StdEncoding.EncodeToString([]byte("tiny")))); err == nil {
+		t.Fatal("A key that isn't 32 bytes should be rejected.")
+	}
+
+	backing := &flakyBlobStore{blobs: make(map[string][]byte)}
+	backing.blobs["old"] = []byte("written before encryption")
+	store, err := filefreezer.NewEncryptedBlobStore(backing, keyring, keyring.Latest)
+	if err != nil {
+		t.Fatalf("Failed to create the encrypted blob store: %v", err)
+	}
+	err = store.Put("a", []byte("chunk data"))
+	if err != nil {
+		t.Fatalf("Failed to put an encrypted blob: %v", err)
+	}
+	if bytes.Contains(backing.blobs["a"], []byte("chunk data")) || !bytes.HasPrefix(backing.blobs["a"], []byte("FFE1\x04hot1")) {
+		t.Fatalf("The blob should be stored in an envelope naming its key: %q", backing.blobs["a"])
+	}
+	data, err := store.Get("old")
+	if err != nil || string(data) != "written before encryption" {
+		t.Fatalf("Blobs written before encryption should be read as they are (%q): %v", data, err)
+	}
+
+	// rotating the key keeps the old blobs readable
+	keyring, err = filefreezer.ParseChunkKeyring(strings.NewReader("hot1 " + key1 + "\nhot2 " + key2 + "\n"))
+	if err != nil || keyring.Latest != "hot2" {
+		t.Fatalf("The last key should be the latest (%s): %v", keyring.Latest, err)
+	}
+	store, _ = filefreezer.NewEncryptedBlobStore(backing, keyring, keyring.Latest)
+	store.Put("b", []byte("newer chunk"))
+	data, err = store.Get("a")
+	if err != nil || string(data) != "chunk data" {
+		t.Fatalf("A blob encrypted with an older key should still decrypt (%q): %v", data, err)
+	}
+	data, err = store.Get("b")
+	if err != nil || string(data) != "newer chunk" || !bytes.HasPrefix(backing.blobs["b"], []byte("FFE1\x04hot2")) {
+		t.Fatalf("New blobs should be encrypted with the latest key (%q): %v", data, err)
+	}
+
+	// a store without the old key can't read its blobs, and tampering is caught
+	keyring, _ = filefreezer.ParseChunkKeyring(strings.NewReader("hot2 " + key2 + "\n"))
+	store, _ = filefreezer.NewEncryptedBlobStore(backing, keyring, "hot2")
+	if _, err = store.Get("a"); err == nil {
+		t.Fatal("A blob encrypted with a key that was dropped shouldn't decrypt.")
+	}
+	backing.blobs["b"][len(backing.blobs["b"])-1] ^= 0xff
+	if _, err = store.Get("b"); err == nil {
+		t.Fatal("A tampered blob shouldn't decrypt.")
+	}
+	if _, err = filefreezer.NewEncryptedBlobStore(backing, keyring, "missing"); err == nil {
+		t.Fatal("A store shouldn't be created with a key that isn't in the keyring.")
+	}
+}
+
 func addNewRandomFile(store *filefreezer.Storage, user *filefreezer.User, filename string,
 	chunkCount int, t *testing.T) *filefreezer.FileInfo {
 	existingFI, err := store.GetFileInfoByName(user.ID, filename)
@@ -1194,7 +1530,7 @@ func addNewRandomFile(store *filefreezer.Storage, user *filefreezer.User, filena
 	var fi *filefreezer.FileInfo
 	if existingFI != nil {
 		fi, err = store.TagNewFileVersion(user.ID, existingFI.FileID, fileStats.Permissions,
-			fileStats.LastMod, fileStats.ChunkCount, fileStats.HashString)
+			fileStats.LastMod, fileStats.ChunkCount, fileStats.HashString, "")
 		if err != nil {
 			t.Fatalf("Failed to tag a new file version for %s: %v", filename, err)
 		}
@@ -1204,7 +1540,7 @@ func addNewRandomFile(store *filefreezer.Storage, user *filefreezer.User, filena
 	} else {
 		// add the file information to the storage server
 		fi, err = store.AddFileInfo(user.ID, filename, fileStats.IsDir, fileStats.Permissions,
-			fileStats.LastMod, fileStats.ChunkCount, fileStats.HashString)
+			fileStats.LastMod, fileStats.ChunkCount, fileStats.HashString, "")
 		if err != nil {
 			t.Fatalf("Failed to add a new file (%s): %v", filename, err)
 		}